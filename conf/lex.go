@@ -981,7 +981,7 @@ func lexNumberOrDateOrStringOrIP(lx *lexer) stateFn {
 		return lexFloatStart
 	case isNumberSuffix(r):
 		return lexConvenientNumber
-	case !(isNL(r) || r == eof || r == mapEnd || r == optValTerm || r == mapValTerm || isWhitespace(r) || unicode.IsDigit(r)):
+	case !(isNL(r) || r == eof || r == mapEnd || r == arrayEnd || r == optValTerm || r == mapValTerm || isWhitespace(r) || unicode.IsDigit(r)):
 		// Treat it as a string value once we get a rune that
 		// is not a number.
 		return lexString
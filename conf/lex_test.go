@@ -526,6 +526,17 @@ func TestArrays(t *testing.T) {
 	lx = lex("foo = [1,2,3,'bar']")
 	expect(t, lx, expectedItems)
 
+	expectedItems = []item{
+		{itemKey, "foo", 1, 0},
+		{itemArrayStart, "", 1, 7},
+		{itemInteger, "1", 1, 7},
+		{itemInteger, "2", 1, 10},
+		{itemArrayEnd, "", 1, 12},
+		{itemEOF, "", 1, 0},
+	}
+	lx = lex("foo = [1, 2]")
+	expect(t, lx, expectedItems)
+
 	expectedItems = []item{
 		{itemKey, "foo", 1, 0},
 		{itemArrayStart, "", 1, 7},
@@ -110,6 +110,11 @@ func main() {
 	// Configure the logger based on the flags
 	s.ConfigureLogger()
 
+	// Check the environment, reporting all problems at once.
+	if err := s.Preflight(); err != nil {
+		server.PrintAndDie(fmt.Sprintf("%s: %s", exe, err))
+	}
+
 	// Start things up. Block here until done.
 	if err := server.Run(s); err != nil {
 		server.PrintAndDie(err.Error())
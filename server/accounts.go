@@ -42,6 +42,8 @@ type Account struct {
 	Issuer       string
 	claimJWT     string
 	updated      time.Time
+	validated    time.Time
+	refreshing   int32
 	mu           sync.RWMutex
 	sqmu         sync.Mutex
 	sl           *Sublist
@@ -74,6 +76,19 @@ type Account struct {
 	eventIds     *nuid.NUID
 	eventIdsMu   sync.Mutex
 	defaultPerms *Permissions
+	denyDefault  bool          // users without permissions are denied everything
+	inactive     time.Duration // overrides the server's inactive client timeout
+	ipFilter     *IPFilterOpts // remote IPs allowed to bind to the account
+	msgSigning   *MsgSigningOpts
+	cloudEvents  *CloudEventsOpts
+	schemas      *SchemaOpts
+	subjQuota    *SubjectQuotaOpts
+	presenceOpts *PresenceOpts
+	presence     *presence
+	queueGroups  map[string]*QueueGroupOpts
+	pubClaims    *publisherClaims
+	rspHints     *responderHints
+	svcGraph     *serviceGraph
 }
 
 // Account based limits.
@@ -250,6 +265,16 @@ func (a *Account) shallowCopy() *Account {
 		}
 	}
 	na.jsLimits = a.jsLimits
+	na.defaultPerms = a.defaultPerms
+	na.denyDefault = a.denyDefault
+	na.inactive = a.inactive
+	na.ipFilter = a.ipFilter
+	na.msgSigning = a.msgSigning
+	na.cloudEvents = a.cloudEvents
+	na.schemas = a.schemas
+	na.subjQuota = a.subjQuota
+	na.presenceOpts = a.presenceOpts
+	na.queueGroups = a.queueGroups
 
 	return na
 }
@@ -407,6 +432,18 @@ func (a *Account) numLocalLeafNodes() int {
 	return int(a.nleafs)
 }
 
+// defaultPermissions returns the permissions of the users bound to the
+// account without permissions of their own, nil if they are allowed
+// everything.
+func (a *Account) defaultPermissions() *Permissions {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.defaultPerms == nil && a.denyDefault {
+		return denyAllPermissions()
+	}
+	return a.defaultPerms
+}
+
 // MaxTotalConnectionsReached returns if we have reached our limit for number of connections.
 func (a *Account) MaxTotalConnectionsReached() bool {
 	var mtce bool
@@ -2229,7 +2266,11 @@ func authAccounts(tokenReq bool) []*Account {
 func (s *Server) SetAccountResolver(ar AccountResolver) {
 	s.mu.Lock()
 	s.accResolver = ar
+	running := s.running
 	s.mu.Unlock()
+	if running {
+		s.startAccountResolverNotifications()
+	}
 }
 
 // AccountResolver returns the registered account resolver.
@@ -2240,6 +2281,75 @@ func (s *Server) AccountResolver() AccountResolver {
 	return ar
 }
 
+// UpdateAccountJWT applies the given JWT to the account if it is currently
+// loaded. Accounts not yet loaded will get their claims from the resolver
+// when first looked up. This is the function handed to AccountResolverNotifier
+// implementations, but can be invoked directly by embedding applications.
+// The JWT has to be the one of the named account.
+func (s *Server) UpdateAccountJWT(name, claimJWT string) error {
+	v, ok := s.accounts.Load(name)
+	if !ok {
+		return nil
+	}
+	ac, err := jwt.DecodeAccountClaims(claimJWT)
+	if err != nil {
+		return err
+	}
+	if ac.Subject != name {
+		return fmt.Errorf("account JWT of %q can not update account %q", ac.Subject, name)
+	}
+	err = s.updateAccountWithClaimJWT(v.(*Account), claimJWT)
+	if err == ErrAccountResolverSameClaims {
+		err = nil
+	}
+	return err
+}
+
+// Starts update notifications if the account resolver supports them,
+// stopping the ones of a previous resolver if needed.
+// Lock MUST NOT be held upon entry.
+func (s *Server) startAccountResolverNotifications() {
+	arn, _ := s.AccountResolver().(AccountResolverNotifier)
+	s.mu.Lock()
+	prev := s.accResNotifier
+	if prev == arn {
+		s.mu.Unlock()
+		return
+	}
+	s.accResNotifier = arn
+	s.mu.Unlock()
+
+	if prev != nil {
+		prev.Stop()
+	}
+	if arn != nil {
+		if err := arn.Start(s.UpdateAccountJWT); err != nil {
+			s.Errorf("Error starting account resolver notifications: %v", err)
+		}
+	}
+}
+
+// Stops update notifications of the account resolver, if any.
+// Lock MUST NOT be held upon entry.
+func (s *Server) stopAccountResolverNotifications() {
+	s.mu.Lock()
+	arn := s.accResNotifier
+	s.accResNotifier = nil
+	s.mu.Unlock()
+	if arn != nil {
+		arn.Stop()
+	}
+}
+
+// Returns the duration after which account claims should be fetched
+// again, or 0 if the resolver does not control caching.
+func (s *Server) accountResolverCacheTTL() time.Duration {
+	if cc, ok := s.AccountResolver().(AccountResolverCacheControl); ok {
+		return cc.CacheTTL()
+	}
+	return 0
+}
+
 // isClaimAccount returns if this account is backed by a JWT claim.
 // Lock should be held.
 func (a *Account) isClaimAccount() bool {
@@ -2354,6 +2464,10 @@ func (s *Server) UpdateAccountClaims(a *Account, ac *jwt.AccountClaims) {
 			s.Errorf("Can't locate account [%s] for import of [%v] %s (err=%v)", i.Account, i.Subject, i.Type, err)
 			continue
 		}
+		if !s.sameOperator(a, acc) {
+			s.Errorf("Can't import [%v] %s of account [%s] of another operator in account [%s]", i.Subject, i.Type, i.Account, a.Name)
+			continue
+		}
 		switch i.Type {
 		case jwt.Stream:
 			s.Debugf("Adding stream import %s:%q for %s:%q", acc.Name, i.Subject, a.Name, i.To)
@@ -2593,6 +2707,25 @@ type AccountResolver interface {
 	Store(name, jwt string) error
 }
 
+// AccountResolverCacheControl can be implemented by an AccountResolver to
+// control how long the server uses account claims before fetching them again.
+// A zero duration means that claims are used until explicitly updated.
+type AccountResolverCacheControl interface {
+	AccountResolver
+	CacheTTL() time.Duration
+}
+
+// AccountResolverNotifier can be implemented by an AccountResolver that is
+// able to detect changes to account JWTs, for instance when they are stored
+// in an external database. The server calls Start when the resolver becomes
+// active and the resolver then invokes the given function for each updated
+// account JWT. Stop is called when the resolver is no longer used.
+type AccountResolverNotifier interface {
+	AccountResolver
+	Start(update func(name, jwt string) error) error
+	Stop()
+}
+
 // MemAccResolver is a memory only resolver.
 // Mostly for testing.
 type MemAccResolver struct {
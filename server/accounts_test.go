@@ -24,6 +24,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 )
@@ -2302,3 +2303,116 @@ func BenchmarkNewRouteReply(b *testing.B) {
 		g.newServiceReply(false)
 	}
 }
+
+type notifyAccResolver struct {
+	MemAccResolver
+	sync.Mutex
+	update  func(name, jwt string) error
+	ttl     time.Duration
+	stopped bool
+}
+
+func (r *notifyAccResolver) CacheTTL() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	return r.ttl
+}
+
+func (r *notifyAccResolver) Start(update func(name, jwt string) error) error {
+	r.Lock()
+	r.update = update
+	r.Unlock()
+	return nil
+}
+
+func (r *notifyAccResolver) Stop() {
+	r.Lock()
+	r.stopped = true
+	r.Unlock()
+}
+
+func TestAccountResolverNotifierAndCacheControl(t *testing.T) {
+	okp, _ := nkeys.FromSeed(oSeed)
+	opub, _ := okp.PublicKey()
+	r := &notifyAccResolver{}
+	opts := DefaultOptions()
+	opts.TrustedKeys = []string{opub}
+	opts.AccountResolver = r
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	r.Lock()
+	update := r.update
+	r.Unlock()
+	if update == nil {
+		t.Fatal("Expected resolver to have been started")
+	}
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	encode := func(subs int64) string {
+		nac := jwt.NewAccountClaims(apub)
+		nac.Limits.Subs = subs
+		ajwt, err := nac.Encode(okp)
+		if err != nil {
+			t.Fatalf("Error encoding account claims: %v", err)
+		}
+		return ajwt
+	}
+	checkSubs := func(acc *Account, expected int32) {
+		t.Helper()
+		acc.mu.RLock()
+		msubs := acc.msubs
+		acc.mu.RUnlock()
+		if msubs != expected {
+			t.Fatalf("Expected max subs of %v, got %v", expected, msubs)
+		}
+	}
+
+	r.Store(apub, encode(10))
+	acc, err := s.LookupAccount(apub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	checkSubs(acc, 10)
+
+	// Simulate a change detected by the resolver.
+	if err := update(apub, encode(20)); err != nil {
+		t.Fatalf("Error updating account: %v", err)
+	}
+	checkSubs(acc, 20)
+
+	// The JWT of another account is not applied.
+	bkp, _ := nkeys.CreateAccount()
+	bpub, _ := bkp.PublicKey()
+	bac := jwt.NewAccountClaims(bpub)
+	bac.Limits.Subs = 5
+	bjwt, err := bac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error encoding account claims: %v", err)
+	}
+	if err := update(apub, bjwt); err == nil {
+		t.Fatal("Expected error updating account with the JWT of another one")
+	}
+	checkSubs(acc, 20)
+
+	// With a cache TTL, stale claims are fetched again on lookup.
+	r.Store(apub, encode(30))
+	r.Lock()
+	r.ttl = 50 * time.Millisecond
+	r.Unlock()
+	s.LookupAccount(apub)
+	checkSubs(acc, 20)
+	// Updates are not done more often than once per second.
+	time.Sleep(1100 * time.Millisecond)
+	s.LookupAccount(apub)
+	checkSubs(acc, 30)
+
+	s.Shutdown()
+	r.Lock()
+	stopped := r.stopped
+	r.Unlock()
+	if !stopped {
+		t.Fatal("Expected resolver to have been stopped")
+	}
+}
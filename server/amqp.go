@@ -0,0 +1,1312 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// AMQP 1.0 peers, such as brokers forwarding messages, connect on their own
+// listener and attach links whose target is an address. The address is
+// mapped to a subject, either explicitly in the configuration or by
+// stripping any queue:// or topic:// prefix and leading '/', and using '.'
+// in place of '/'. Only incoming links are supported: the messages
+// transferred on them are published with the permissions of the user
+// authenticated with SASL PLAIN, or of the no auth user for ANONYMOUS.
+// Unsettled messages on a subject captured by a stream of the account are
+// accepted once the stream has stored them, the others once published.
+// Properties and application properties are carried as message headers.
+
+const (
+	amqpFrameAMQP = 0x00
+	amqpFrameSASL = 0x01
+
+	// Descriptors of performatives.
+	amqpOpen        = 0x10
+	amqpBegin       = 0x11
+	amqpAttach      = 0x12
+	amqpFlow        = 0x13
+	amqpTransfer    = 0x14
+	amqpDisposition = 0x15
+	amqpDetach      = 0x16
+	amqpEnd         = 0x17
+	amqpClose       = 0x18
+
+	// Descriptors of other composite types.
+	amqpError    = 0x1d
+	amqpAccepted = 0x24
+	amqpRejected = 0x25
+	amqpSource   = 0x28
+	amqpTarget   = 0x29
+
+	// Descriptors of SASL frames.
+	amqpSASLMechanisms = 0x40
+	amqpSASLInit       = 0x41
+	amqpSASLOutcome    = 0x44
+
+	// Descriptors of message sections.
+	amqpHeader                = 0x70
+	amqpDeliveryAnnotations   = 0x71
+	amqpMessageAnnotations    = 0x72
+	amqpProperties            = 0x73
+	amqpApplicationProperties = 0x74
+	amqpData                  = 0x75
+	amqpSequence              = 0x76
+	amqpValue                 = 0x77
+	amqpFooter                = 0x78
+
+	// Maximum size of the frames we accept.
+	amqpMaxFrameSize = 256 * 1024
+	// Maximum number of links per session.
+	amqpMaxLinks = 1024
+	// Credit granted to links, replenished when half of it is used.
+	amqpLinkCredit = 1000
+	// Maximum nesting of composite values.
+	amqpMaxDepth = 32
+	// How long to wait for a stream to store a message.
+	amqpStoreTimeout = 5 * time.Second
+)
+
+var (
+	amqpProtoHeader = []byte("AMQP\x00\x01\x00\x00")
+	amqpSASLHeader  = []byte("AMQP\x03\x01\x00\x00")
+
+	errAMQPShortRead    = errors.New("short read")
+	errAMQPStoreTimeout = errors.New("timeout waiting for the message to be stored")
+)
+
+// Headers of the message properties, empty for those not carried.
+var amqpPropertyHeaders = []string{
+	"Amqp-Message-Id",
+	_EMPTY_,
+	"Amqp-To",
+	"Amqp-Subject",
+	"Amqp-Reply-To",
+	"Amqp-Correlation-Id",
+	"Content-Type",
+	"Content-Encoding",
+	_EMPTY_,
+	_EMPTY_,
+	"Amqp-Group-Id",
+}
+
+// AMQPOpts are options for the AMQP 1.0 listener.
+type AMQPOpts struct {
+	// The server will accept AMQP connections on this hostname/IP.
+	Host string
+	// The server will accept AMQP connections on this port.
+	Port int
+	// If SASL ANONYMOUS is used, or no SASL layer at all, will default to
+	// this user and associated account. This user has to exist in the
+	// global options.
+	NoAuthUser string
+	// TLS configuration is required for secure AMQP connections.
+	TLSConfig *tls.Config
+	// Addresses maps link target addresses to subjects, overriding the
+	// default mapping.
+	Addresses map[string]string
+}
+
+// subject returns the subject of the address of a link target.
+func (o *AMQPOpts) subject(address string) string {
+	if subject, ok := o.Addresses[address]; ok {
+		return subject
+	}
+	for _, prefix := range []string{"queue://", "topic://"} {
+		address = strings.TrimPrefix(address, prefix)
+	}
+	address = strings.TrimPrefix(address, "/")
+	return strings.Replace(address, "/", ".", -1)
+}
+
+func validateAMQPOptions(o *Options) error {
+	ao := &o.AMQP
+	for address, subject := range ao.Addresses {
+		if !IsValidLiteralSubject(subject) {
+			return fmt.Errorf("amqp address %q mapped to invalid subject %q", address, subject)
+		}
+	}
+	if ao.NoAuthUser == _EMPTY_ {
+		return nil
+	}
+	if ao.Port == 0 {
+		return fmt.Errorf("amqp no_auth_user %q requires a port", ao.NoAuthUser)
+	}
+	for _, u := range o.Users {
+		if u.Username == ao.NoAuthUser {
+			return nil
+		}
+	}
+	return fmt.Errorf("amqp no_auth_user %q not present as user in authorization block or account configuration",
+		ao.NoAuthUser)
+}
+
+// srvAMQP is the state of the AMQP listener.
+type srvAMQP struct {
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[*amqpConn]struct{}
+}
+
+// startAMQPListener listens for AMQP connections.
+func (s *Server) startAMQPListener() {
+	o := s.getOpts().AMQP
+
+	port := o.Port
+	if port == -1 {
+		port = 0
+	}
+	hp := net.JoinHostPort(o.Host, strconv.Itoa(port))
+	l, err := net.Listen("tcp", hp)
+	if err != nil {
+		s.Fatalf("Unable to listen for AMQP connections: %v", err)
+		return
+	}
+	scheme := "amqp"
+	if o.TLSConfig != nil {
+		l = tls.NewListener(l, o.TLSConfig)
+		scheme = "amqps"
+	}
+	s.Noticef("Listening for AMQP connections on %s://%s", scheme, l.Addr())
+
+	s.mu.Lock()
+	s.amqp.listener = l
+	s.mu.Unlock()
+	s.amqp.mu.Lock()
+	s.amqp.conns = make(map[*amqpConn]struct{})
+	s.amqp.mu.Unlock()
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		tmpDelay := ACCEPT_MIN_SLEEP
+		for s.isRunning() {
+			conn, err := l.Accept()
+			if err != nil {
+				if s.isLameDuckMode() {
+					// Signal that we are not accepting new clients
+					s.ldmCh <- true
+					// Now wait for the Shutdown...
+					<-s.quitCh
+					return
+				}
+				tmpDelay = s.acceptError("AMQP", err, tmpDelay)
+				continue
+			}
+			tmpDelay = ACCEPT_MIN_SLEEP
+			s.startGoRoutine(func() {
+				s.handleAMQPConn(conn)
+				s.grWG.Done()
+			})
+		}
+		s.done <- true
+	})
+}
+
+// AMQPAddr returns the address of the AMQP listener, or nil if not
+// listening.
+func (s *Server) AMQPAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.amqp.listener == nil {
+		return nil
+	}
+	return s.amqp.listener.Addr()
+}
+
+// closeAMQPConns closes the AMQP connections on shutdown.
+func (s *Server) closeAMQPConns() {
+	s.amqp.mu.Lock()
+	for ac := range s.amqp.conns {
+		ac.conn.Close()
+	}
+	s.amqp.mu.Unlock()
+}
+
+// amqpErr is an error sent to the peer, with its condition.
+type amqpErr struct {
+	condition   string
+	description string
+}
+
+func (e *amqpErr) Error() string {
+	return fmt.Sprintf("%s: %s", e.condition, e.description)
+}
+
+func (e *amqpErr) described() *amqpDescribed {
+	return &amqpDescribed{uint64(amqpError), []interface{}{amqpSymbol(e.condition), e.description}}
+}
+
+func newAMQPErr(condition, format string, args ...interface{}) *amqpErr {
+	return &amqpErr{condition, fmt.Sprintf(format, args...)}
+}
+
+// amqpLink is an incoming link, with the delivery being transferred if
+// split in several frames.
+type amqpLink struct {
+	handle        uint32
+	subject       string
+	deliveryCount uint32
+	credit        uint32
+
+	partial     bool
+	deliveryID  uint32
+	settled     bool
+	aborted     bool
+	payload     []byte
+	payloadSize int
+}
+
+// amqpSession is a session, using the channel of the peer for ours.
+type amqpSession struct {
+	channel        uint16
+	nextIncomingID uint32
+	links          map[uint32]*amqpLink
+}
+
+// amqpAck is the response of a stream to a message.
+type amqpAck struct {
+	reply string
+	msg   []byte
+}
+
+// amqpConn is an AMQP connection, using an internal client registered
+// with the account of its user.
+type amqpConn struct {
+	srv      *Server
+	conn     net.Conn
+	br       *bufio.Reader
+	c        *client
+	opened   bool
+	sessions map[uint16]*amqpSession
+	done     chan struct{}
+
+	// Responses of streams are received on an inbox.
+	inbox   string
+	replies uint64
+	acks    chan amqpAck
+
+	wmu sync.Mutex
+}
+
+func (s *Server) handleAMQPConn(conn net.Conn) {
+	ac := &amqpConn{
+		srv:      s,
+		conn:     conn,
+		br:       bufio.NewReader(conn),
+		sessions: make(map[uint16]*amqpSession),
+		done:     make(chan struct{}),
+		acks:     make(chan amqpAck, 16),
+	}
+	s.amqp.mu.Lock()
+	if s.amqp.conns == nil {
+		s.amqp.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.amqp.conns[ac] = struct{}{}
+	s.amqp.mu.Unlock()
+
+	defer func() {
+		s.amqp.mu.Lock()
+		delete(s.amqp.conns, ac)
+		s.amqp.mu.Unlock()
+		close(ac.done)
+		conn.Close()
+		if ac.c != nil {
+			ac.c.closeConnection(ClientClosed)
+		}
+	}()
+	s.Debugf("AMQP connection from %s", conn.RemoteAddr())
+
+	if err := ac.handshake(); err != nil {
+		s.Debugf("AMQP connection from %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	for {
+		ftype, channel, body, err := ac.readFrame()
+		if err != nil {
+			if err != io.EOF {
+				ac.sendClose(err)
+			}
+			return
+		}
+		// Empty frames keep the connection alive.
+		if len(body) == 0 {
+			continue
+		}
+		if ftype != amqpFrameAMQP {
+			ac.sendClose(newAMQPErr("amqp:not-allowed", "unexpected frame type %d", ftype))
+			return
+		}
+		code, fields, payload, err := amqpPerformative(body)
+		if err == nil {
+			err = ac.processFrame(channel, code, fields, payload)
+		}
+		if err != nil {
+			ac.sendClose(err)
+			return
+		}
+		if code == amqpClose {
+			return
+		}
+	}
+}
+
+// handshake exchanges the protocol headers, authenticating the peer with
+// SASL when requested, and registers the internal client.
+func (ac *amqpConn) handshake() error {
+	var proto [8]byte
+	if _, err := io.ReadFull(ac.br, proto[:]); err != nil {
+		return err
+	}
+	noAuthUser := ac.srv.getOpts().AMQP.NoAuthUser
+	anonymous := ac.srv.anonymousLogin(noAuthUser)
+
+	var acc *Account
+	var user *User
+	var err error
+	switch {
+	case bytes.Equal(proto[:], amqpSASLHeader):
+		if acc, user, err = ac.authenticate(anonymous); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(ac.br, proto[:]); err != nil {
+			return err
+		}
+		if !bytes.Equal(proto[:], amqpProtoHeader) {
+			ac.write(amqpProtoHeader)
+			return fmt.Errorf("unsupported protocol header %q", proto[:])
+		}
+	case bytes.Equal(proto[:], amqpProtoHeader):
+		if !anonymous {
+			// Authentication is required.
+			ac.write(amqpSASLHeader)
+			return ErrAuthentication
+		}
+		if acc, user, err = ac.srv.checkLogin(ac.conn.RemoteAddr(), _EMPTY_, _EMPTY_, noAuthUser); err != nil {
+			ac.write(amqpSASLHeader)
+			return err
+		}
+	default:
+		ac.write(amqpProtoHeader)
+		return fmt.Errorf("unsupported protocol header %q", proto[:])
+	}
+	if err := ac.write(amqpProtoHeader); err != nil {
+		return err
+	}
+
+	c := ac.srv.createInternalAccountClient()
+	if err := ac.srv.registerLogin(c, acc, user); err != nil {
+		c.closeConnection(ClientClosed)
+		return err
+	}
+	ac.c = c
+	ac.inbox = "_INBOX." + nuid.Next() + "."
+	sub, err := c.processSub([]byte(ac.inbox+"* 1"), false)
+	if err != nil {
+		return err
+	}
+	sub.icb = func(_ *subscription, _ *client, subject, _ string, msg []byte) {
+		select {
+		case ac.acks <- amqpAck{subject, append([]byte(nil), msg...)}:
+		default:
+		}
+	}
+	return nil
+}
+
+// authenticate runs the SASL exchange, with PLAIN and, if allowed,
+// ANONYMOUS mechanisms.
+func (ac *amqpConn) authenticate(anonymous bool) (*Account, *User, error) {
+	if err := ac.write(amqpSASLHeader); err != nil {
+		return nil, nil, err
+	}
+	mechanisms := []amqpSymbol{"PLAIN"}
+	if anonymous {
+		mechanisms = append(mechanisms, "ANONYMOUS")
+	}
+	if err := ac.writeFrame(amqpFrameSASL, 0, amqpSASLMechanisms, []interface{}{mechanisms}); err != nil {
+		return nil, nil, err
+	}
+	ftype, _, body, err := ac.readFrame()
+	if err != nil {
+		return nil, nil, err
+	}
+	code, fields, _, err := amqpPerformative(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ftype != amqpFrameSASL || code != amqpSASLInit {
+		return nil, nil, fmt.Errorf("unexpected SASL frame %#x", code)
+	}
+	mechanism, _ := amqpField(fields, 0).(amqpSymbol)
+	response, _ := amqpField(fields, 1).([]byte)
+
+	var login, password string
+	switch {
+	case mechanism == "PLAIN":
+		// The response is the authorization identity, login and password,
+		// separated by null bytes.
+		parts := bytes.SplitN(response, []byte{0}, 3)
+		if len(parts) != 3 {
+			err = fmt.Errorf("invalid PLAIN response")
+			break
+		}
+		if login, password = string(parts[1]), string(parts[2]); login == _EMPTY_ {
+			err = ErrAuthentication
+		}
+	case mechanism == "ANONYMOUS" && anonymous:
+	default:
+		err = fmt.Errorf("unsupported SASL mechanism %q", mechanism)
+	}
+	var acc *Account
+	var user *User
+	if err == nil {
+		acc, user, err = ac.srv.checkLogin(ac.conn.RemoteAddr(), login, password, ac.srv.getOpts().AMQP.NoAuthUser)
+	}
+	outcome := uint8(0)
+	if err != nil {
+		ac.srv.Debugf("AMQP connection from %s not authorized: %v", ac.conn.RemoteAddr(), err)
+		outcome = 1
+	}
+	if werr := ac.writeFrame(amqpFrameSASL, 0, amqpSASLOutcome, []interface{}{outcome}); werr != nil && err == nil {
+		err = werr
+	}
+	return acc, user, err
+}
+
+func (ac *amqpConn) processFrame(channel uint16, code uint64, fields []interface{}, payload []byte) error {
+	if !ac.opened && code != amqpOpen {
+		return newAMQPErr("amqp:not-allowed", "expected open, got performative %#x", code)
+	}
+	switch code {
+	case amqpOpen:
+		return ac.processOpen(fields)
+	case amqpBegin:
+		return ac.processBegin(channel, fields)
+	case amqpClose:
+		return ac.writeFrame(amqpFrameAMQP, 0, amqpClose, nil)
+	}
+	ss := ac.sessions[channel]
+	if ss == nil {
+		return newAMQPErr("amqp:not-allowed", "no session on channel %d", channel)
+	}
+	switch code {
+	case amqpAttach:
+		return ac.processAttach(ss, fields)
+	case amqpFlow:
+		return ac.processFlow(ss, fields)
+	case amqpTransfer:
+		return ac.processTransfer(ss, fields, payload)
+	case amqpDisposition:
+		// We only receive, the peer settling its deliveries has no effect.
+		return nil
+	case amqpDetach:
+		handle, _ := amqpField(fields, 0).(uint32)
+		closed, _ := amqpField(fields, 1).(bool)
+		delete(ss.links, handle)
+		return ac.writeFrame(amqpFrameAMQP, ss.channel, amqpDetach, []interface{}{handle, closed})
+	case amqpEnd:
+		delete(ac.sessions, channel)
+		return ac.writeFrame(amqpFrameAMQP, ss.channel, amqpEnd, nil)
+	default:
+		return newAMQPErr("amqp:not-implemented", "unsupported performative %#x", code)
+	}
+}
+
+func (ac *amqpConn) processOpen(fields []interface{}) error {
+	if ac.opened {
+		return newAMQPErr("amqp:not-allowed", "connection already open")
+	}
+	ac.opened = true
+	// Send empty frames often enough for the idle timeout of the peer.
+	if timeout, _ := amqpField(fields, 4).(uint32); timeout > 0 {
+		ac.srv.startGoRoutine(func() {
+			defer ac.srv.grWG.Done()
+			ac.keepAlive(time.Duration(timeout) * time.Millisecond / 2)
+		})
+	}
+	return ac.writeFrame(amqpFrameAMQP, 0, amqpOpen, []interface{}{
+		ac.srv.ID(),
+		nil,
+		uint32(amqpMaxFrameSize),
+		uint16(math.MaxUint16),
+	})
+}
+
+func (ac *amqpConn) keepAlive(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := ac.write([]byte{0, 0, 0, 8, 2, amqpFrameAMQP, 0, 0}); err != nil {
+				return
+			}
+		case <-ac.done:
+			return
+		case <-ac.srv.quitCh:
+			return
+		}
+	}
+}
+
+func (ac *amqpConn) processBegin(channel uint16, fields []interface{}) error {
+	if _, ok := ac.sessions[channel]; ok {
+		return newAMQPErr("amqp:not-allowed", "session already begun on channel %d", channel)
+	}
+	nextOutgoingID, _ := amqpField(fields, 1).(uint32)
+	ss := &amqpSession{
+		channel:        channel,
+		nextIncomingID: nextOutgoingID,
+		links:          make(map[uint32]*amqpLink),
+	}
+	ac.sessions[channel] = ss
+	return ac.writeFrame(amqpFrameAMQP, ss.channel, amqpBegin, []interface{}{
+		channel,
+		uint32(1),
+		uint32(math.MaxInt32),
+		uint32(0),
+		uint32(amqpMaxLinks - 1),
+	})
+}
+
+func (ac *amqpConn) processAttach(ss *amqpSession, fields []interface{}) error {
+	name, _ := amqpField(fields, 0).(string)
+	handle, ok := amqpField(fields, 1).(uint32)
+	if !ok || handle >= amqpMaxLinks {
+		return newAMQPErr("amqp:invalid-field", "invalid handle")
+	}
+	if _, ok := ss.links[handle]; ok {
+		return newAMQPErr("amqp:session:handle-in-use", "handle %d in use", handle)
+	}
+	role, _ := amqpField(fields, 2).(bool)
+	sndSettleMode, _ := amqpField(fields, 3).(uint8)
+	source, _ := amqpField(fields, 5).(*amqpDescribed)
+	target, _ := amqpField(fields, 6).(*amqpDescribed)
+
+	// Only the addresses of the terminus are sent back.
+	var sourceAddr, targetAddr interface{}
+	if source != nil {
+		if f, ok := source.value.([]interface{}); ok {
+			sourceAddr = amqpField(f, 0)
+		}
+	}
+	if target != nil {
+		if f, ok := target.value.([]interface{}); ok {
+			targetAddr = amqpField(f, 0)
+		}
+	}
+	attach := []interface{}{
+		name,
+		handle,
+		!role,
+		sndSettleMode,
+		uint8(0),
+		&amqpDescribed{uint64(amqpSource), []interface{}{sourceAddr}},
+		&amqpDescribed{uint64(amqpTarget), []interface{}{targetAddr}},
+		nil,
+		nil,
+		nil,
+		uint64(ac.srv.getOpts().MaxPayload),
+	}
+
+	var subject string
+	var err *amqpErr
+	address, _ := targetAddr.(string)
+	if role {
+		err = newAMQPErr("amqp:not-implemented", "outgoing links are not supported")
+	} else if subject = ac.srv.getOpts().AMQP.subject(address); !IsValidLiteralSubject(subject) {
+		err = newAMQPErr("amqp:invalid-field", "invalid target address %q", address)
+	} else {
+		c := ac.c
+		c.mu.Lock()
+		allowed := c.perms == nil || c.pubAllowed(subject)
+		c.mu.Unlock()
+		if !allowed {
+			err = newAMQPErr("amqp:unauthorized-access", "permissions violation for publish to %q", subject)
+		}
+	}
+	if err != nil {
+		// The link is refused with a null terminus, and then detached.
+		if role {
+			attach[5] = nil
+		} else {
+			attach[6] = nil
+		}
+		if werr := ac.writeFrame(amqpFrameAMQP, ss.channel, amqpAttach, attach); werr != nil {
+			return werr
+		}
+		return ac.writeFrame(amqpFrameAMQP, ss.channel, amqpDetach, []interface{}{handle, true, err.described()})
+	}
+
+	deliveryCount, _ := amqpField(fields, 9).(uint32)
+	l := &amqpLink{handle: handle, subject: subject, deliveryCount: deliveryCount, credit: amqpLinkCredit}
+	ss.links[handle] = l
+	if err := ac.writeFrame(amqpFrameAMQP, ss.channel, amqpAttach, attach); err != nil {
+		return err
+	}
+	return ac.sendFlow(ss, l)
+}
+
+func (ac *amqpConn) sendFlow(ss *amqpSession, l *amqpLink) error {
+	return ac.writeFrame(amqpFrameAMQP, ss.channel, amqpFlow, []interface{}{
+		ss.nextIncomingID,
+		uint32(math.MaxInt32),
+		uint32(1),
+		uint32(0),
+		l.handle,
+		l.deliveryCount,
+		l.credit,
+	})
+}
+
+func (ac *amqpConn) processFlow(ss *amqpSession, fields []interface{}) error {
+	handle, ok := amqpField(fields, 4).(uint32)
+	if !ok {
+		return nil
+	}
+	l := ss.links[handle]
+	if l == nil {
+		return newAMQPErr("amqp:session:unattached-handle", "unknown handle %d", handle)
+	}
+	if echo, _ := amqpField(fields, 9).(bool); echo {
+		return ac.sendFlow(ss, l)
+	}
+	return nil
+}
+
+func (ac *amqpConn) processTransfer(ss *amqpSession, fields []interface{}, payload []byte) error {
+	ss.nextIncomingID++
+	handle, _ := amqpField(fields, 0).(uint32)
+	l := ss.links[handle]
+	if l == nil {
+		return newAMQPErr("amqp:session:unattached-handle", "unknown handle %d", handle)
+	}
+	if !l.partial {
+		deliveryID, ok := amqpField(fields, 1).(uint32)
+		if !ok {
+			return newAMQPErr("amqp:invalid-field", "missing delivery-id")
+		}
+		l.partial, l.deliveryID, l.settled, l.aborted = true, deliveryID, false, false
+		l.payload, l.payloadSize = nil, 0
+	}
+	if settled, _ := amqpField(fields, 4).(bool); settled {
+		l.settled = true
+	}
+	if aborted, _ := amqpField(fields, 9).(bool); aborted {
+		l.aborted = true
+	}
+	// A message larger than allowed is still received, but not kept.
+	l.payloadSize += len(payload)
+	if !l.aborted && l.payloadSize <= int(ac.srv.getOpts().MaxPayload) {
+		l.payload = append(l.payload, payload...)
+	}
+	if more, _ := amqpField(fields, 5).(bool); more && !l.aborted {
+		return nil
+	}
+	l.partial = false
+	l.deliveryCount++
+	if l.credit > 0 {
+		l.credit--
+	}
+
+	if !l.aborted {
+		var err error
+		if l.payloadSize > int(ac.srv.getOpts().MaxPayload) {
+			err = newAMQPErr("amqp:link:message-size-exceeded", "message of %d bytes exceeds maximum payload", l.payloadSize)
+		} else {
+			err = ac.ingest(l.subject, l.payload, l.settled)
+		}
+		l.payload = nil
+		if err != nil {
+			ac.srv.Debugf("AMQP message for %q from %s rejected: %v", l.subject, ac.conn.RemoteAddr(), err)
+		}
+		if !l.settled {
+			var state *amqpDescribed
+			if err == nil {
+				state = &amqpDescribed{uint64(amqpAccepted), []interface{}{}}
+			} else {
+				aerr, ok := err.(*amqpErr)
+				if !ok {
+					aerr = newAMQPErr("amqp:internal-error", "%v", err)
+				}
+				state = &amqpDescribed{uint64(amqpRejected), []interface{}{aerr.described()}}
+			}
+			if err := ac.writeFrame(amqpFrameAMQP, ss.channel, amqpDisposition, []interface{}{
+				true, l.deliveryID, nil, true, state,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	if l.credit <= amqpLinkCredit/2 {
+		l.credit = amqpLinkCredit
+		return ac.sendFlow(ss, l)
+	}
+	return nil
+}
+
+// ingest publishes the message. Unless settled by the sender, messages on
+// subjects captured by a stream are acknowledged by the stream before
+// returning.
+func (ac *amqpConn) ingest(subject string, payload []byte, settled bool) error {
+	hdr, body, err := amqpDecodeMessage(payload)
+	if err != nil {
+		return newAMQPErr("amqp:decode-error", "%v", err)
+	}
+	if len(hdr)+len(body) > int(ac.srv.getOpts().MaxPayload) {
+		return newAMQPErr("amqp:link:message-size-exceeded", "%v", ErrMaxPayload)
+	}
+	c := ac.c
+	if settled || !ac.isStored(subject) {
+		c.processInternalMsg(subject, _EMPTY_, hdr, body)
+		return nil
+	}
+
+	ac.replies++
+	reply := ac.inbox + strconv.FormatUint(ac.replies, 10)
+	c.processInternalMsg(subject, reply, hdr, body)
+	t := time.NewTimer(amqpStoreTimeout)
+	defer t.Stop()
+	for {
+		select {
+		case ack := <-ac.acks:
+			if ack.reply != reply {
+				// Late response to a message that timed out.
+				continue
+			}
+			resp := bytes.TrimSpace(ack.msg)
+			if !bytes.HasPrefix(resp, []byte("+OK")) {
+				return fmt.Errorf("unable to store message: %s", resp)
+			}
+			return nil
+		case <-t.C:
+			return errAMQPStoreTimeout
+		case <-ac.srv.quitCh:
+			return ErrServerNotRunning
+		}
+	}
+}
+
+// isStored returns true if a stream of the account captures the subject.
+func (ac *amqpConn) isStored(subject string) bool {
+	for _, mset := range ac.c.Account().Streams() {
+		for _, subj := range mset.Config().Subjects {
+			if matchLiteral(subject, subj) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ac *amqpConn) sendClose(err error) {
+	aerr, ok := err.(*amqpErr)
+	if !ok {
+		aerr = newAMQPErr("amqp:decode-error", "%v", err)
+	}
+	ac.srv.Debugf("AMQP connection from %s closed: %v", ac.conn.RemoteAddr(), aerr)
+	ac.writeFrame(amqpFrameAMQP, 0, amqpClose, []interface{}{aerr.described()})
+}
+
+// readFrame reads the next frame, returning its type, channel and body.
+func (ac *amqpConn) readFrame() (byte, uint16, []byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(ac.br, hdr[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:4])
+	doff := uint32(hdr[4]) * 4
+	if doff < 8 || size < doff {
+		return 0, 0, nil, newAMQPErr("amqp:connection:framing-error", "invalid frame header")
+	}
+	if size > amqpMaxFrameSize {
+		return 0, 0, nil, newAMQPErr("amqp:connection:framing-error", "frame of %d bytes too large", size)
+	}
+	body := make([]byte, size-8)
+	if _, err := io.ReadFull(ac.br, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return hdr[5], binary.BigEndian.Uint16(hdr[6:]), body[doff-8:], nil
+}
+
+// writeFrame writes a frame with the performative and its fields.
+func (ac *amqpConn) writeFrame(ftype byte, channel uint16, code uint64, fields []interface{}) error {
+	w := &amqpWriter{b: make([]byte, 8, 64)}
+	w.encode(&amqpDescribed{code, fields})
+	binary.BigEndian.PutUint32(w.b, uint32(len(w.b)))
+	w.b[4] = 2
+	w.b[5] = ftype
+	binary.BigEndian.PutUint16(w.b[6:], channel)
+	return ac.write(w.b)
+}
+
+func (ac *amqpConn) write(b []byte) error {
+	ac.wmu.Lock()
+	defer ac.wmu.Unlock()
+	_, err := ac.conn.Write(b)
+	return err
+}
+
+// amqpPerformative decodes the performative at the start of a frame body,
+// returning its descriptor, fields and the payload that follows.
+func amqpPerformative(body []byte) (uint64, []interface{}, []byte, error) {
+	r := &amqpReader{b: body}
+	v := r.value(0)
+	if r.err != nil {
+		return 0, nil, nil, r.err
+	}
+	d, ok := v.(*amqpDescribed)
+	if !ok {
+		return 0, nil, nil, fmt.Errorf("invalid performative")
+	}
+	code, ok := d.descriptor.(uint64)
+	fields, ok2 := d.value.([]interface{})
+	if !ok || !ok2 {
+		return 0, nil, nil, fmt.Errorf("invalid performative")
+	}
+	return code, fields, r.b, nil
+}
+
+func amqpField(fields []interface{}, i int) interface{} {
+	if i < len(fields) {
+		return fields[i]
+	}
+	return nil
+}
+
+// amqpDecodeMessage returns the header and body of the message, from its
+// properties, application properties and data or value sections.
+func amqpDecodeMessage(payload []byte) ([]byte, []byte, error) {
+	var hdr, body []byte
+	addHeader := func(k string, v interface{}) {
+		s, ok := amqpString(v)
+		if !ok || k == _EMPTY_ || strings.ContainsAny(k, ": \t\r\n") || strings.ContainsAny(s, "\r\n") {
+			return
+		}
+		if hdr == nil {
+			hdr = []byte("NATS/1.0" + _CRLF_)
+		}
+		hdr = append(hdr, fmt.Sprintf("%s: %s%s", k, s, _CRLF_)...)
+	}
+
+	r := &amqpReader{b: payload}
+	for len(r.b) > 0 {
+		v := r.value(0)
+		if r.err != nil {
+			return nil, nil, r.err
+		}
+		d, ok := v.(*amqpDescribed)
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid message section")
+		}
+		code, _ := d.descriptor.(uint64)
+		switch code {
+		case amqpHeader, amqpDeliveryAnnotations, amqpMessageAnnotations, amqpFooter:
+		case amqpProperties:
+			fields, _ := d.value.([]interface{})
+			for i, k := range amqpPropertyHeaders {
+				if k != _EMPTY_ && i < len(fields) {
+					addHeader(k, fields[i])
+				}
+			}
+		case amqpApplicationProperties:
+			m, _ := d.value.(amqpMap)
+			for _, kv := range m {
+				if k, ok := kv[0].(string); ok {
+					addHeader(k, kv[1])
+				}
+			}
+		case amqpData:
+			b, ok := d.value.([]byte)
+			if !ok {
+				return nil, nil, fmt.Errorf("invalid data section")
+			}
+			body = append(body, b...)
+		case amqpValue:
+			switch v := d.value.(type) {
+			case nil:
+			case string:
+				body = append(body, v...)
+			case []byte:
+				body = append(body, v...)
+			default:
+				return nil, nil, fmt.Errorf("unsupported amqp-value of type %T", v)
+			}
+		case amqpSequence:
+			return nil, nil, fmt.Errorf("unsupported amqp-sequence section")
+		default:
+			return nil, nil, fmt.Errorf("unknown message section %#x", code)
+		}
+	}
+	if hdr != nil {
+		hdr = append(hdr, _CRLF_...)
+	}
+	return hdr, body, nil
+}
+
+// amqpString returns the string form of a primitive value.
+func amqpString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case amqpSymbol:
+		return string(v), true
+	case []byte:
+		return hex.EncodeToString(v), true
+	case amqpUUID:
+		return fmt.Sprintf("%x-%x-%x-%x-%x", v[:4], v[4:6], v[6:8], v[8:10], v[10:]), true
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano), true
+	case bool, uint8, uint16, uint32, uint64, int8, int16, int32, int64, float32, float64:
+		return fmt.Sprint(v), true
+	}
+	return _EMPTY_, false
+}
+
+// Types of AMQP values without a Go equivalent.
+type (
+	amqpSymbol string
+	amqpUUID   [16]byte
+	// amqpMap keeps the entries in order, keys may not be comparable.
+	amqpMap [][2]interface{}
+)
+
+type amqpDescribed struct {
+	descriptor interface{}
+	value      interface{}
+}
+
+// amqpReader decodes values, the first error being kept.
+type amqpReader struct {
+	b   []byte
+	err error
+}
+
+func (r *amqpReader) next(n int) []byte {
+	if r.err != nil || n < 0 || len(r.b) < n {
+		r.err = errAMQPShortRead
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *amqpReader) uint8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *amqpReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *amqpReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *amqpReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// size reads a size or count, in one or four bytes.
+func (r *amqpReader) size(wide bool) int {
+	if wide {
+		return int(r.uint32())
+	}
+	return int(r.uint8())
+}
+
+// value decodes the next value with its constructor.
+func (r *amqpReader) value(depth int) interface{} {
+	code := r.uint8()
+	if r.err != nil {
+		return nil
+	}
+	if code == 0x00 {
+		if depth >= amqpMaxDepth {
+			r.err = fmt.Errorf("values nested too deeply")
+			return nil
+		}
+		descriptor := r.value(depth + 1)
+		return &amqpDescribed{descriptor, r.value(depth + 1)}
+	}
+	return r.valueOf(code, depth)
+}
+
+// valueOf decodes a value of the type of the format code.
+func (r *amqpReader) valueOf(code uint8, depth int) interface{} {
+	switch code {
+	case 0x40:
+		return nil
+	case 0x41:
+		return true
+	case 0x42:
+		return false
+	case 0x56:
+		return r.uint8() != 0
+	case 0x50:
+		return r.uint8()
+	case 0x60:
+		return r.uint16()
+	case 0x70:
+		return r.uint32()
+	case 0x52:
+		return uint32(r.uint8())
+	case 0x43:
+		return uint32(0)
+	case 0x80:
+		return r.uint64()
+	case 0x53:
+		return uint64(r.uint8())
+	case 0x44:
+		return uint64(0)
+	case 0x51:
+		return int8(r.uint8())
+	case 0x61:
+		return int16(r.uint16())
+	case 0x71:
+		return int32(r.uint32())
+	case 0x54:
+		return int32(int8(r.uint8()))
+	case 0x81:
+		return int64(r.uint64())
+	case 0x55:
+		return int64(int8(r.uint8()))
+	case 0x72:
+		return math.Float32frombits(r.uint32())
+	case 0x82:
+		return math.Float64frombits(r.uint64())
+	case 0x73:
+		return rune(r.uint32())
+	case 0x74, 0x84, 0x94:
+		// Decimals are not converted.
+		r.next(4 << ((code >> 4) - 7))
+		return nil
+	case 0x83:
+		ms := int64(r.uint64())
+		return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+	case 0x98:
+		var u amqpUUID
+		copy(u[:], r.next(16))
+		return u
+	case 0xa0, 0xb0:
+		return append([]byte(nil), r.next(r.size(code == 0xb0))...)
+	case 0xa1, 0xb1:
+		return string(r.next(r.size(code == 0xb1)))
+	case 0xa3, 0xb3:
+		return amqpSymbol(r.next(r.size(code == 0xb3)))
+	case 0x45:
+		return []interface{}{}
+	case 0xc0, 0xd0, 0xc1, 0xd1, 0xe0, 0xf0:
+		if depth >= amqpMaxDepth {
+			r.err = fmt.Errorf("values nested too deeply")
+			return nil
+		}
+		wide := code&0xf0 != 0xc0 && code&0xf0 != 0xe0
+		cr := &amqpReader{b: r.next(r.size(wide))}
+		if r.err != nil {
+			return nil
+		}
+		count := cr.size(wide)
+		// Each value is at least a byte, except in arrays.
+		if count > len(cr.b) && code != 0xe0 && code != 0xf0 {
+			r.err = errAMQPShortRead
+			return nil
+		}
+		var v interface{}
+		switch code {
+		case 0xc0, 0xd0:
+			list := make([]interface{}, 0, count)
+			for i := 0; i < count && cr.err == nil; i++ {
+				list = append(list, cr.value(depth+1))
+			}
+			v = list
+		case 0xc1, 0xd1:
+			m := make(amqpMap, 0, count/2)
+			for i := 0; i+1 < count && cr.err == nil; i += 2 {
+				m = append(m, [2]interface{}{cr.value(depth + 1), cr.value(depth + 1)})
+			}
+			v = m
+		default:
+			v = cr.array(count, depth+1)
+		}
+		if cr.err != nil {
+			r.err = cr.err
+			return nil
+		}
+		return v
+	}
+	r.err = fmt.Errorf("unknown format code %#x", code)
+	return nil
+}
+
+// array decodes the elements of an array, sharing a constructor.
+func (r *amqpReader) array(count, depth int) []interface{} {
+	code := r.uint8()
+	var descriptor interface{}
+	described := code == 0x00
+	if described {
+		descriptor = r.value(depth)
+		code = r.uint8()
+	}
+	if r.err != nil {
+		return nil
+	}
+	var list []interface{}
+	for i := 0; i < count && r.err == nil; i++ {
+		// Elements of zero width can't be more than the remaining bytes.
+		if i > len(r.b) {
+			r.err = errAMQPShortRead
+			break
+		}
+		v := r.valueOf(code, depth)
+		if described {
+			v = &amqpDescribed{descriptor, v}
+		}
+		list = append(list, v)
+	}
+	return list
+}
+
+// amqpWriter encodes values.
+type amqpWriter struct {
+	b []byte
+}
+
+func (w *amqpWriter) uint32(v uint32) {
+	w.b = append(w.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *amqpWriter) variable(code8, code32 byte, b []byte) {
+	if len(b) < 256 {
+		w.b = append(w.b, code8, byte(len(b)))
+	} else {
+		w.b = append(w.b, code32)
+		w.uint32(uint32(len(b)))
+	}
+	w.b = append(w.b, b...)
+}
+
+// compound writes a list or map with its size and count.
+func (w *amqpWriter) compound(code byte, count int, values []interface{}) {
+	cw := &amqpWriter{}
+	for _, v := range values {
+		cw.encode(v)
+	}
+	w.b = append(w.b, code)
+	w.uint32(uint32(len(cw.b) + 4))
+	w.uint32(uint32(count))
+	w.b = append(w.b, cw.b...)
+}
+
+func (w *amqpWriter) encode(v interface{}) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			w.b = append(w.b, 0x41)
+		} else {
+			w.b = append(w.b, 0x42)
+		}
+	case uint8:
+		w.b = append(w.b, 0x50, v)
+	case uint16:
+		w.b = append(w.b, 0x60, byte(v>>8), byte(v))
+	case uint32:
+		switch {
+		case v == 0:
+			w.b = append(w.b, 0x43)
+		case v < 256:
+			w.b = append(w.b, 0x52, byte(v))
+		default:
+			w.b = append(w.b, 0x70)
+			w.uint32(v)
+		}
+	case uint64:
+		switch {
+		case v == 0:
+			w.b = append(w.b, 0x44)
+		case v < 256:
+			w.b = append(w.b, 0x53, byte(v))
+		default:
+			w.b = append(w.b, 0x80)
+			w.uint32(uint32(v >> 32))
+			w.uint32(uint32(v))
+		}
+	case string:
+		w.variable(0xa1, 0xb1, []byte(v))
+	case amqpSymbol:
+		w.variable(0xa3, 0xb3, []byte(v))
+	case []byte:
+		w.variable(0xa0, 0xb0, v)
+	case []interface{}:
+		if len(v) == 0 {
+			w.b = append(w.b, 0x45)
+			return
+		}
+		w.compound(0xd0, len(v), v)
+	case amqpMap:
+		values := make([]interface{}, 0, 2*len(v))
+		for _, kv := range v {
+			values = append(values, kv[0], kv[1])
+		}
+		w.compound(0xd1, len(values), values)
+	case []amqpSymbol:
+		aw := &amqpWriter{}
+		for _, s := range v {
+			aw.uint32(uint32(len(s)))
+			aw.b = append(aw.b, s...)
+		}
+		w.b = append(w.b, 0xf0)
+		w.uint32(uint32(len(aw.b) + 5))
+		w.uint32(uint32(len(v)))
+		w.b = append(w.b, 0xb3)
+		w.b = append(w.b, aw.b...)
+	case *amqpDescribed:
+		w.b = append(w.b, 0x00)
+		w.encode(v.descriptor)
+		w.encode(v.value)
+	default:
+		w.b = append(w.b, 0x40)
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type amqpTestClient struct {
+	t  *testing.T
+	ac *amqpConn
+}
+
+func newAMQPTestClient(t *testing.T, s *Server) *amqpTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.AMQPAddr().String())
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	return &amqpTestClient{t: t, ac: &amqpConn{conn: conn, br: bufio.NewReader(conn)}}
+}
+
+func (c *amqpTestClient) header(send, expected []byte) {
+	c.t.Helper()
+	if err := c.ac.write(send); err != nil {
+		c.t.Fatalf("Error writing header: %v", err)
+	}
+	var proto [8]byte
+	c.ac.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(c.ac.br, proto[:]); err != nil {
+		c.t.Fatalf("Error reading header: %v", err)
+	}
+	if !bytes.Equal(proto[:], expected) {
+		c.t.Fatalf("Expected header %q, got %q", expected, proto[:])
+	}
+}
+
+func (c *amqpTestClient) send(ftype byte, code uint64, payload []byte, fields ...interface{}) {
+	c.t.Helper()
+	w := &amqpWriter{b: make([]byte, 8)}
+	w.encode(&amqpDescribed{code, fields})
+	w.b = append(w.b, payload...)
+	binary.BigEndian.PutUint32(w.b, uint32(len(w.b)))
+	w.b[4], w.b[5] = 2, ftype
+	if err := c.ac.write(w.b); err != nil {
+		c.t.Fatalf("Error writing frame: %v", err)
+	}
+}
+
+func (c *amqpTestClient) expect(code uint64) []interface{} {
+	c.t.Helper()
+	c.ac.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, body, err := c.ac.readFrame()
+	if err != nil {
+		c.t.Fatalf("Error reading frame: %v", err)
+	}
+	fcode, fields, _, err := amqpPerformative(body)
+	if err != nil {
+		c.t.Fatalf("Error decoding frame: %v", err)
+	}
+	if fcode != code {
+		c.t.Fatalf("Expected performative %#x, got %#x %v", code, fcode, fields)
+	}
+	return fields
+}
+
+// connect authenticates and opens a session on channel 0.
+func (c *amqpTestClient) connect(login, password string) {
+	c.t.Helper()
+	c.header(amqpSASLHeader, amqpSASLHeader)
+	c.expect(amqpSASLMechanisms)
+	c.send(amqpFrameSASL, amqpSASLInit, nil, amqpSymbol("PLAIN"), []byte("\x00"+login+"\x00"+password))
+	if outcome := c.expect(amqpSASLOutcome); outcome[0] != uint8(0) {
+		c.t.Fatalf("Unexpected outcome %v", outcome)
+	}
+	c.header(amqpProtoHeader, amqpProtoHeader)
+	c.send(amqpFrameAMQP, amqpOpen, nil, "test")
+	c.expect(amqpOpen)
+	c.send(amqpFrameAMQP, amqpBegin, nil, nil, uint32(0), uint32(100), uint32(100))
+	c.expect(amqpBegin)
+}
+
+// attach attaches a sending link to the address.
+func (c *amqpTestClient) attach(name string, handle uint32, address string) {
+	c.t.Helper()
+	c.send(amqpFrameAMQP, amqpAttach, nil, name, handle, false, uint8(0), uint8(0),
+		&amqpDescribed{uint64(amqpSource), []interface{}{name}},
+		&amqpDescribed{uint64(amqpTarget), []interface{}{address}},
+		nil, nil, uint32(0))
+}
+
+func (c *amqpTestClient) transfer(handle, id uint32, more bool, payload []byte) {
+	c.t.Helper()
+	c.send(amqpFrameAMQP, amqpTransfer, payload, handle, id, []byte{byte(id)}, uint32(0), false, more)
+}
+
+func amqpTestMessage(body string) []byte {
+	w := &amqpWriter{}
+	w.encode(&amqpDescribed{uint64(amqpProperties), []interface{}{"m1", nil, nil, nil, nil, nil, amqpSymbol("text/plain")}})
+	w.encode(&amqpDescribed{uint64(amqpApplicationProperties), amqpMap{{"region", "eu"}, {"count", uint32(5)}}})
+	w.encode(&amqpDescribed{uint64(amqpData), []byte(body)})
+	return w.b
+}
+
+func TestAMQPIngestion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amqp")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := DefaultOptions()
+	opts.Cluster.Port = 0
+	opts.JetStream = true
+	opts.StoreDir = filepath.Join(dir, "js")
+	opts.Users = []*User{{Username: "a", Password: "pwd", Permissions: &Permissions{
+		Publish: &SubjectPermission{Allow: []string{"orders.>"}},
+	}}}
+	opts.AMQP.Host = "127.0.0.1"
+	opts.AMQP.Port = -1
+	opts.AMQP.Addresses = map[string]string{"legacy": "orders.legacy"}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "ORDERS", Subjects: []string{"orders.stored.>"}})
+	if err != nil {
+		t.Fatalf("Error adding stream: %v", err)
+	}
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "orders.>")
+	natsFlush(t, nc)
+
+	c := newAMQPTestClient(t, s)
+	defer c.ac.conn.Close()
+	c.connect("a", "pwd")
+
+	c.attach("l1", 0, "queue:///orders/new")
+	if attach := c.expect(amqpAttach); attach[2] != true {
+		t.Fatalf("Expected receiver role, got %v", attach)
+	}
+	if flow := c.expect(amqpFlow); flow[6] != uint32(amqpLinkCredit) {
+		t.Fatalf("Unexpected credit %v", flow)
+	}
+	c.transfer(0, 0, false, amqpTestMessage("hello"))
+	if state := c.expect(amqpDisposition)[4].(*amqpDescribed); state.descriptor != uint64(amqpAccepted) {
+		t.Fatalf("Expected accepted, got %v", state)
+	}
+	m := natsNexMsg(t, sub, time.Second)
+	if m.Subject != "orders.new" || string(m.Data) != "hello" || m.Header.Get("Amqp-Message-Id") != "m1" ||
+		m.Header.Get("Content-Type") != "text/plain" || m.Header.Get("region") != "eu" || m.Header.Get("count") != "5" {
+		t.Fatalf("Unexpected message %q %v %q", m.Subject, m.Header, m.Data)
+	}
+
+	// A message split in several transfers, on a mapped address.
+	c.attach("l2", 1, "legacy")
+	c.expect(amqpAttach)
+	c.expect(amqpFlow)
+	msg := amqpTestMessage("split")
+	c.transfer(1, 1, true, msg[:10])
+	c.transfer(1, 1, false, msg[10:])
+	c.expect(amqpDisposition)
+	if m := natsNexMsg(t, sub, time.Second); m.Subject != "orders.legacy" || string(m.Data) != "split" {
+		t.Fatalf("Unexpected message %q %q", m.Subject, m.Data)
+	}
+
+	// Messages captured by a stream are accepted once stored.
+	c.attach("l3", 2, "orders/stored/1")
+	c.expect(amqpAttach)
+	c.expect(amqpFlow)
+	c.transfer(2, 2, false, amqpTestMessage("stored"))
+	if state := c.expect(amqpDisposition)[4].(*amqpDescribed); state.descriptor != uint64(amqpAccepted) {
+		t.Fatalf("Expected accepted, got %v", state)
+	}
+	if state := mset.State(); state.Msgs != 1 {
+		t.Fatalf("Expected 1 stored message, got %d", state.Msgs)
+	}
+	if m := natsNexMsg(t, sub, time.Second); m.Subject != "orders.stored.1" || string(m.Data) != "stored" {
+		t.Fatalf("Unexpected message %q %q", m.Subject, m.Data)
+	}
+
+	// Undecodable messages are rejected.
+	c.transfer(2, 3, false, []byte{0x00, 0x53, 0x77, 0xff})
+	if state := c.expect(amqpDisposition)[4].(*amqpDescribed); state.descriptor != uint64(amqpRejected) {
+		t.Fatalf("Expected rejected, got %v", state)
+	}
+
+	// Links to addresses the user can't publish to, and outgoing links,
+	// are refused.
+	c.attach("l4", 3, "other")
+	c.expect(amqpAttach)
+	detach := c.expect(amqpDetach)
+	if e := detach[2].(*amqpDescribed).value.([]interface{}); e[0] != amqpSymbol("amqp:unauthorized-access") {
+		t.Fatalf("Unexpected error %v", e)
+	}
+	c.send(amqpFrameAMQP, amqpAttach, nil, "l5", uint32(4), true, uint8(0), uint8(0),
+		&amqpDescribed{uint64(amqpSource), []interface{}{"orders.new"}}, nil)
+	c.expect(amqpAttach)
+	detach = c.expect(amqpDetach)
+	if e := detach[2].(*amqpDescribed).value.([]interface{}); e[0] != amqpSymbol("amqp:not-implemented") {
+		t.Fatalf("Unexpected error %v", e)
+	}
+
+	c.send(amqpFrameAMQP, amqpDetach, nil, uint32(0), true)
+	c.expect(amqpDetach)
+	c.send(amqpFrameAMQP, amqpClose, nil)
+	c.expect(amqpClose)
+}
+
+func TestAMQPAuthentication(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization { users: [{user: a, password: pwd}] }
+		amqp { listen: "127.0.0.1:-1" }
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	c := newAMQPTestClient(t, s)
+	c.header(amqpSASLHeader, amqpSASLHeader)
+	mechanisms := c.expect(amqpSASLMechanisms)
+	if m := mechanisms[0].([]interface{}); len(m) != 1 || m[0] != amqpSymbol("PLAIN") {
+		t.Fatalf("Unexpected mechanisms %v", m)
+	}
+	c.send(amqpFrameSASL, amqpSASLInit, nil, amqpSymbol("PLAIN"), []byte("\x00a\x00bad"))
+	if outcome := c.expect(amqpSASLOutcome); outcome[0] != uint8(1) {
+		t.Fatalf("Unexpected outcome %v", outcome)
+	}
+	c.ac.conn.Close()
+
+	// Without SASL, authentication is required.
+	c = newAMQPTestClient(t, s)
+	c.header(amqpProtoHeader, amqpSASLHeader)
+	c.ac.conn.Close()
+
+	c = newAMQPTestClient(t, s)
+	defer c.ac.conn.Close()
+	c.connect("a", "pwd")
+}
+
+func TestAMQPConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		amqp {
+			listen: "127.0.0.1:5672"
+			addresses {
+				"queue://orders": "orders.new"
+				"bad": "bad.*"
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.AMQP.Host != "127.0.0.1" || opts.AMQP.Port != 5672 || opts.AMQP.Addresses["queue://orders"] != "orders.new" {
+		t.Fatalf("Unexpected options: %+v", opts.AMQP)
+	}
+	if err := validateAMQPOptions(opts); err == nil || !strings.Contains(err.Error(), "bad.*") {
+		t.Fatalf("Expected error about subject, got %v", err)
+	}
+	for address, subject := range map[string]string{
+		"queue://orders": "orders.new",
+		"topic://a/b":    "a.b",
+		"/a/b":           "a.b",
+		"a.b":            "a.b",
+	} {
+		if s := opts.AMQP.subject(address); s != subject {
+			t.Fatalf("Expected subject %q for %q, got %q", subject, address, s)
+		}
+	}
+	conf = createConfFile(t, []byte(`amqp { bad: 1 }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Fatalf("Expected error on unknown field, got %v", err)
+	}
+}
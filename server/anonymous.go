@@ -0,0 +1,99 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+)
+
+// Public data feeds can be served to clients without credentials, while
+// other clients still authenticate, by binding the clients that connect
+// without any credentials to an anonymous account. Anonymous clients can
+// not publish, and can only subscribe to the configured subjects, or to
+// any subject of the account if none are configured.
+
+// AnonymousOpts bind clients without credentials to a read-only account.
+type AnonymousOpts struct {
+	// Account anonymous clients are bound to. Disabled when empty.
+	Account string
+	// Subscribe are the subjects anonymous clients can subscribe to.
+	Subscribe []string
+}
+
+func validateAnonymousOptions(o *Options) error {
+	ao := &o.Anonymous
+	if ao.Account == _EMPTY_ {
+		if len(ao.Subscribe) > 0 {
+			return fmt.Errorf("anonymous access requires an account")
+		}
+		return nil
+	}
+	if o.NoAuthUser != _EMPTY_ {
+		return fmt.Errorf("anonymous access not compatible with no_auth_user")
+	}
+	for _, subj := range ao.Subscribe {
+		if !IsValidSubject(subj) {
+			return fmt.Errorf("invalid anonymous subscribe subject %q", subj)
+		}
+	}
+	if len(o.TrustedOperators) > 0 {
+		return nil
+	}
+	for _, acc := range o.Accounts {
+		if acc.Name == ao.Account {
+			return nil
+		}
+	}
+	return fmt.Errorf("anonymous access to unknown account %q", ao.Account)
+}
+
+// permissions returns the permissions of anonymous clients.
+func (ao *AnonymousOpts) permissions() *Permissions {
+	p := &Permissions{Publish: &SubjectPermission{Deny: []string{">"}}}
+	if len(ao.Subscribe) > 0 {
+		p.Subscribe = &SubjectPermission{Allow: append([]string(nil), ao.Subscribe...)}
+	}
+	return p
+}
+
+// isAnonymous returns true if the client connected without credentials.
+func (c *client) isAnonymous() bool {
+	if c.kind != CLIENT {
+		return false
+	}
+	o := &c.opts
+	if o.Username != _EMPTY_ || o.Password != _EMPTY_ || o.Token != _EMPTY_ ||
+		o.Nkey != _EMPTY_ || o.JWT != _EMPTY_ || c.scram != nil {
+		return false
+	}
+	// Clients presenting a certificate may be mapped with it.
+	if tlsState := c.GetTLSConnectionState(); tlsState != nil && len(tlsState.PeerCertificates) > 0 {
+		return false
+	}
+	return true
+}
+
+// processAnonymousAuthentication binds the client to the anonymous account.
+func (s *Server) processAnonymousAuthentication(c *client, ao *AnonymousOpts) bool {
+	acc, err := s.LookupAccount(ao.Account)
+	if err != nil {
+		c.Debugf("Anonymous account %q lookup error: %v", ao.Account, err)
+		return c.authFailed(authFailUnknownAccount)
+	}
+	if err := c.BindAccount(acc, ao.permissions()); err != nil {
+		return false
+	}
+	c.Debugf("Bound anonymous client to account %q", acc.Name)
+	return true
+}
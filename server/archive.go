@@ -0,0 +1,146 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Messages of a stream with an archive are moved, once older than the
+// archive age, to the archive stream of the same account instead of being
+// deleted, so that a hot stream can be kept small while older messages
+// live on in a stream with a different storage or limits. Messages are
+// kept in the stream while the archive stream can not take them.
+
+// Headers of archived messages.
+const (
+	// StreamArchivedHdr is set to the name of the stream the message was
+	// archived from.
+	StreamArchivedHdr = "Nats-Archived-Stream"
+	// StreamArchivedSeqHdr is set to the sequence of the message in the
+	// stream it was archived from.
+	StreamArchivedSeqHdr = "Nats-Archived-Seq"
+)
+
+// Maximum interval at which messages are checked for archival.
+const streamArchiveInterval = time.Second
+
+// StreamArchive is the archive messages of a stream are moved to once
+// older than MaxAge.
+type StreamArchive struct {
+	Stream string        `json:"stream"`
+	MaxAge time.Duration `json:"max_age"`
+}
+
+// checkArchiveCfg validates the archive of the stream configuration.
+func checkArchiveCfg(cfg *StreamConfig) error {
+	ac := cfg.Archive
+	if !isValidName(ac.Stream) {
+		return fmt.Errorf("stream archive requires a valid stream name")
+	}
+	if ac.Stream == cfg.Name {
+		return fmt.Errorf("stream can not be archived to itself")
+	}
+	if ac.MaxAge <= 0 {
+		return fmt.Errorf("stream archive requires a positive maximum age")
+	}
+	if cfg.MaxAge > 0 && cfg.MaxAge <= ac.MaxAge {
+		return fmt.Errorf("stream maximum age has to be greater than the archive maximum age")
+	}
+	return nil
+}
+
+// archiveInterval returns the interval at which messages are checked for
+// archival.
+// Lock should be held.
+func (mset *Stream) archiveInterval() time.Duration {
+	if age := mset.config.Archive.MaxAge; age < streamArchiveInterval {
+		return age
+	}
+	return streamArchiveInterval
+}
+
+// setupArchive starts or stops the archival of messages according to the
+// configuration.
+// Lock should be held.
+func (mset *Stream) setupArchive() {
+	if mset.config.Archive == nil || mset.client == nil {
+		if mset.atmr != nil {
+			mset.atmr.Stop()
+			mset.atmr = nil
+		}
+		return
+	}
+	if mset.atmr == nil {
+		mset.atmr = time.AfterFunc(mset.archiveInterval(), mset.archiveMsgs)
+	}
+}
+
+// archiveMsgs moves the messages older than the archive age to the
+// archive stream.
+func (mset *Stream) archiveMsgs() {
+	mset.mu.Lock()
+	mset.atmr = nil
+	ac, store, jsa, name := mset.config.Archive, mset.store, mset.jsa, mset.config.Name
+	c := mset.client
+	if c == nil || store == nil || ac == nil {
+		mset.mu.Unlock()
+		return
+	}
+	mset.mu.Unlock()
+
+	jsa.mu.Lock()
+	archive := jsa.streams[ac.Stream]
+	jsa.mu.Unlock()
+
+	var err error
+	if archive == nil {
+		err = fmt.Errorf("archive stream %q not found", ac.Stream)
+	} else {
+		minAge := time.Now().UnixNano() - int64(ac.MaxAge)
+		state := store.State()
+		for seq := state.FirstSeq; seq > 0 && seq <= state.LastSeq; seq++ {
+			subj, hdr, msg, ts, lerr := store.LoadMsg(seq)
+			if lerr == ErrStoreMsgNotFound {
+				continue
+			}
+			if lerr != nil || ts > minAge {
+				break
+			}
+			hdr = setHeaders(hdr, []string{StreamArchivedHdr, StreamArchivedSeqHdr}, StreamArchivedHdr, name)
+			hdr = setHeaders(hdr, nil, StreamArchivedSeqHdr, strconv.FormatUint(seq, 10))
+			if _, err = archive.storeMsg(nil, subj, hdr, msg); err != nil && err != errDuplicateMsg {
+				err = fmt.Errorf("archive stream %q: %v", ac.Stream, err)
+				break
+			}
+			err = nil
+			store.RemoveMsg(seq)
+		}
+	}
+
+	mset.mu.Lock()
+	// Only warn when the reason changes, archival being retried.
+	var reason string
+	if err != nil {
+		reason = err.Error()
+		if reason != mset.archErr {
+			c.Warnf("JetStream failed to archive messages of stream %q: %v", name, err)
+		}
+	}
+	mset.archErr = reason
+	mset.setupArchive()
+	mset.mu.Unlock()
+}
@@ -14,18 +14,26 @@
 package server
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nats-io/jwt/v2"
-	"github.com/nats-io/nkeys"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -47,20 +55,230 @@ type ClientAuthentication interface {
 	RemoteAddress() net.Addr
 }
 
+// AuthenticationV2 is an interface for implementing authentication that
+// can report why a client is rejected, and bind it to an account.
+type AuthenticationV2 interface {
+	// Check if a client is authorized to connect, a client is rejected
+	// if an error is returned, which is logged as the reason.
+	Check(c ClientAuthenticationV2) (bool, error)
+}
+
+// ClientAuthenticationV2 is an interface for client authentication that
+// gives access to the accounts of the server.
+type ClientAuthenticationV2 interface {
+	ClientAuthentication
+	// BindAccount binds the client to the account, the global account if
+	// nil, with the permissions, if any.
+	BindAccount(acc *Account, perms *Permissions) error
+	// LookupAccount returns the account of the server with this name.
+	LookupAccount(name string) (*Account, error)
+}
+
 // NkeyUser is for multiple nkey based users
 type NkeyUser struct {
-	Nkey        string       `json:"user"`
-	Permissions *Permissions `json:"permissions,omitempty"`
-	Account     *Account     `json:"account,omitempty"`
-	SigningKey  string       `json:"signing_key,omitempty"`
+	Nkey               string       `json:"user"`
+	Permissions        *Permissions `json:"permissions,omitempty"`
+	Account            *Account     `json:"account,omitempty"`
+	SigningKey         string       `json:"signing_key,omitempty"`
+	AllowedConnections []string     `json:"allowed_connections,omitempty"`
+	// MaxConnections limits the client connections of the user, if set.
+	MaxConnections int `json:"max_connections,omitempty"`
 }
 
 // User is for multiple accounts/users.
 type User struct {
-	Username    string       `json:"user"`
-	Password    string       `json:"password"`
+	Username           string       `json:"user"`
+	Password           string       `json:"password"`
+	Permissions        *Permissions `json:"permissions,omitempty"`
+	Account            *Account     `json:"account,omitempty"`
+	AllowedConnections []string     `json:"allowed_connections,omitempty"`
+	// The user can only connect within this window, and clients are
+	// disconnected when it expires. Zero values are not enforced.
+	ValidFrom time.Time `json:"valid_from,omitempty"`
+	Expires   time.Time `json:"expires,omitempty"`
+	// SHA-256 fingerprints, in lowercase hex, of the client certificates of
+	// the user. With TLS map, a certificate with one of them is mapped to
+	// the user whatever its subject, and the user can not be mapped from
+	// other certificates.
+	CertFingerprints []string `json:"cert_fingerprints,omitempty"`
+	// MaxConnections limits the client connections of the user, if set.
+	MaxConnections int `json:"max_connections,omitempty"`
+}
+
+// validAt returns true if the user is valid at the given time.
+func (u *User) validAt(now time.Time) bool {
+	if !u.ValidFrom.IsZero() && now.Before(u.ValidFrom) {
+		return false
+	}
+	return u.Expires.IsZero() || now.Before(u.Expires)
+}
+
+// TokenUser is one of several tokens clients can authenticate with, with
+// its own permissions and account, the global account if not set.
+type TokenUser struct {
+	Token       string       `json:"token"`
 	Permissions *Permissions `json:"permissions,omitempty"`
-	Account     *Account     `json:"account,omitempty"`
+	Account     string       `json:"account,omitempty"`
+}
+
+func validateTokens(o *Options) error {
+	if len(o.Tokens) == 0 {
+		return nil
+	}
+	if len(o.TrustedOperators) > 0 || len(o.TrustedKeys) > 0 {
+		return fmt.Errorf("tokens can not be used with trusted operators")
+	}
+	if o.Authorization != _EMPTY_ {
+		return fmt.Errorf("can not have a token and tokens")
+	}
+	seen := make(map[string]struct{}, len(o.Tokens))
+	for _, t := range o.Tokens {
+		if _, ok := seen[t.Token]; ok {
+			return fmt.Errorf("duplicate token")
+		}
+		seen[t.Token] = struct{}{}
+		if t.Account == _EMPTY_ {
+			continue
+		}
+		found := false
+		for _, acc := range o.Accounts {
+			if acc.Name == t.Account {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("token of unknown account %q", t.Account)
+		}
+	}
+	return nil
+}
+
+// processTokenAuthentication registers the client with the account and
+// permissions of its token, returns false if the token is unknown.
+func (s *Server) processTokenAuthentication(c *client, tokens []*TokenUser) bool {
+	user, reason := s.tokenUser(c.opts.Token, tokens)
+	if user == nil {
+		return c.authFailed(reason)
+	}
+	c.RegisterUser(user)
+	s.accountConnectEvent(c)
+	return true
+}
+
+// tokenUser returns the user with the account and permissions of the
+// token, or nil and the reason of the failure.
+func (s *Server) tokenUser(token string, tokens []*TokenUser) (*User, string) {
+	var tu *TokenUser
+	for _, t := range tokens {
+		if comparePasswords(t.Token, token) {
+			tu = t
+			break
+		}
+	}
+	if tu == nil {
+		return nil, authFailBadToken
+	}
+	acc := s.globalAccount()
+	if tu.Account != _EMPTY_ {
+		v, ok := s.accounts.Load(tu.Account)
+		if !ok {
+			return nil, authFailUnknownAccount
+		}
+		acc = v.(*Account)
+	}
+	user := &User{Account: acc}
+	if tu.Permissions != nil {
+		user.Permissions = tu.Permissions.clone()
+		validateResponsePermissions(user.Permissions)
+	}
+	return user, _EMPTY_
+}
+
+// userConns counts the connections of authenticated users and nkeys, for
+// the connection limits of users.
+type userConns struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// addUserConn counts the client as a connection of the authenticated user
+// or nkey, unless the user already has the maximum number of connections,
+// in which case it returns false. A client counted for another user, as on
+// reload, is moved to this one.
+func (s *Server) addUserConn(c *client, user string, max int) bool {
+	if user == _EMPTY_ || (c.kind != CLIENT && c.kind != ACCOUNT) {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.flags.isSet(closeConnection) {
+		return true
+	}
+	uc := &s.uconns
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	if c.uconn == user {
+		// Already counted, check it is within a limit lowered on reload.
+		return max <= 0 || uc.counts[user] <= max
+	}
+	if max > 0 && uc.counts[user] >= max {
+		return false
+	}
+	if uc.counts == nil {
+		uc.counts = make(map[string]int)
+	}
+	uc.remove(c.uconn)
+	uc.counts[user]++
+	c.uconn = user
+	return true
+}
+
+// removeUserConn stops counting the closed client for its user.
+// Client lock is held on entry.
+func (s *Server) removeUserConn(c *client) {
+	if c.uconn == _EMPTY_ {
+		return
+	}
+	s.uconns.mu.Lock()
+	s.uconns.remove(c.uconn)
+	s.uconns.mu.Unlock()
+	c.uconn = _EMPTY_
+}
+
+// Lock is held on entry.
+func (uc *userConns) remove(user string) {
+	if user == _EMPTY_ {
+		return
+	}
+	if n := uc.counts[user] - 1; n > 0 {
+		uc.counts[user] = n
+	} else {
+		delete(uc.counts, user)
+	}
+}
+
+// userConnCount returns the number of connections of the user.
+func (s *Server) userConnCount(user string) int {
+	s.uconns.mu.Lock()
+	defer s.uconns.mu.Unlock()
+	return s.uconns.counts[user]
+}
+
+func (u *User) hasCertFingerprint(fp string) bool {
+	for _, ufp := range u.CertFingerprints {
+		if ufp == fp {
+			return true
+		}
+	}
+	return false
+}
+
+// certFingerprint returns the SHA-256 fingerprint, in lowercase hex, of the
+// certificate.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
 }
 
 // clone performs a deep copy of the User struct, returning a new clone with
@@ -107,6 +325,8 @@ type Permissions struct {
 	Publish   *SubjectPermission  `json:"publish"`
 	Subscribe *SubjectPermission  `json:"subscribe"`
 	Response  *ResponsePermission `json:"responses,omitempty"`
+	// PublishRateLimits throttle the publications on some subjects.
+	PublishRateLimits []*PublishRateLimit `json:"publish_rate_limits,omitempty"`
 }
 
 // RoutePermissions are similar to user permissions
@@ -153,6 +373,93 @@ func (p *Permissions) clone() *Permissions {
 			Expires: p.Response.Expires,
 		}
 	}
+	for _, l := range p.PublishRateLimits {
+		lc := *l
+		clone.PublishRateLimits = append(clone.PublishRateLimits, &lc)
+	}
+	return clone
+}
+
+// denyAllPermissions returns the permissions of the users of accounts
+// with deny_by_default that have no permissions of their own.
+func denyAllPermissions() *Permissions {
+	return &Permissions{
+		Publish:   &SubjectPermission{Deny: []string{string(fwc)}},
+		Subscribe: &SubjectPermission{Deny: []string{string(fwc)}},
+	}
+}
+
+// Placeholders of permission templates, expanded in the subjects of the
+// permissions of a user when they are assigned to its client, so that
+// "private.{{user}}.>" gives each user its own subjects.
+const (
+	permTemplateUser     = "{{user}}"
+	permTemplateAccount  = "{{account}}"
+	permTemplateClientID = "{{client_id}}"
+)
+
+// hasTemplates returns true if any of the subjects has a placeholder.
+func (p *Permissions) hasTemplates() bool {
+	for _, sp := range []*SubjectPermission{p.Publish, p.Subscribe} {
+		if sp == nil {
+			continue
+		}
+		for _, subjects := range [][]string{sp.Allow, sp.Deny} {
+			for _, subject := range subjects {
+				if strings.Contains(subject, "{{") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// isValidTemplateValue returns true if the value can replace a placeholder
+// without changing the tokens or wildcards of the subject.
+func isValidTemplateValue(v string) bool {
+	return v != _EMPTY_ && !strings.ContainsAny(v, ".*> \t\r\n")
+}
+
+// expandTemplates returns the permissions with the placeholders replaced by
+// their values, or the permissions themselves if they have none. Allowed
+// subjects whose placeholders can not be expanded are left out, while the
+// placeholders of denied subjects are then replaced by a wildcard.
+func (p *Permissions) expandTemplates(values map[string]string) *Permissions {
+	if p == nil || !p.hasTemplates() {
+		return p
+	}
+	var allow, deny []string
+	for tmpl, v := range values {
+		if isValidTemplateValue(v) {
+			allow = append(allow, tmpl, v)
+			deny = append(deny, tmpl, v)
+		} else {
+			deny = append(deny, tmpl, string(pwc))
+		}
+	}
+	ar, dr := strings.NewReplacer(allow...), strings.NewReplacer(deny...)
+	expand := func(sp *SubjectPermission) *SubjectPermission {
+		if sp == nil {
+			return nil
+		}
+		esp := &SubjectPermission{}
+		if sp.Allow != nil {
+			esp.Allow = make([]string, 0, len(sp.Allow))
+			for _, subject := range sp.Allow {
+				if subject = ar.Replace(subject); !strings.Contains(subject, "{{") {
+					esp.Allow = append(esp.Allow, subject)
+				}
+			}
+		}
+		for _, subject := range sp.Deny {
+			esp.Deny = append(esp.Deny, dr.Replace(subject))
+		}
+		return esp
+	}
+	clone := p.clone()
+	clone.Publish = expand(p.Publish)
+	clone.Subscribe = expand(p.Subscribe)
 	return clone
 }
 
@@ -160,7 +467,7 @@ func (p *Permissions) clone() *Permissions {
 // Lock is assumed held.
 func (s *Server) checkAuthforWarnings() {
 	warn := false
-	if s.opts.Password != "" && !isBcrypt(s.opts.Password) {
+	if s.opts.Password != "" && !isHashedPassword(s.opts.Password) {
 		warn = true
 	}
 	for _, u := range s.users {
@@ -170,14 +477,23 @@ func (s *Server) checkAuthforWarnings() {
 			continue
 		}
 
-		if !isBcrypt(u.Password) {
+		if !isHashedPassword(u.Password) {
 			warn = true
 			break
 		}
 	}
 	if warn {
 		// Warning about using plaintext passwords.
-		s.Warnf("Plaintext passwords detected, use nkeys or bcrypt")
+		s.Warnf("Plaintext passwords detected, use nkeys, bcrypt, pbkdf2 or scram")
+	}
+	weak := 0
+	for _, u := range s.users {
+		if weakBcryptCost(u.Password, s.opts.BcryptMinCost) > 0 {
+			weak++
+		}
+	}
+	if weak > 0 {
+		s.Warnf("%d passwords hashed with a bcrypt cost lower than %d", weak, s.opts.BcryptMinCost)
 	}
 }
 
@@ -230,16 +546,20 @@ func (s *Server) configureAuthorization() {
 		return
 	}
 
+	// Users of the users file are added to the ones of the options.
+	s.loadUsersFileLocked(opts)
+	nkeys, users := s.usersFromOptions(opts)
+
 	// Check for multiple users first
 	// This just checks and sets up the user map if we have multiple users.
-	if opts.CustomClientAuthentication != nil {
+	if opts.CustomClientAuthentication != nil || opts.CustomClientAuthenticationV2 != nil {
 		s.info.AuthRequired = true
 	} else if len(s.trustedKeys) > 0 {
 		s.info.AuthRequired = true
-	} else if opts.Nkeys != nil || opts.Users != nil {
-		s.nkeys, s.users = s.buildNkeysAndUsersFromOptions(opts.Nkeys, opts.Users)
+	} else if nkeys != nil || users != nil || opts.UsersFile != _EMPTY_ {
+		s.nkeys, s.users = s.buildNkeysAndUsersFromOptions(nkeys, users)
 		s.info.AuthRequired = true
-	} else if opts.Username != "" || opts.Authorization != "" {
+	} else if opts.Username != "" || opts.Authorization != "" || len(opts.Tokens) > 0 || len(opts.TLSAccountMappings) > 0 || len(opts.SPIFFEMappings) > 0 || opts.Anonymous.Account != "" {
 		s.info.AuthRequired = true
 	} else {
 		s.users = nil
@@ -247,8 +567,15 @@ func (s *Server) configureAuthorization() {
 		s.info.AuthRequired = false
 	}
 
+	// OIDC tokens are accepted in addition to the other methods.
+	s.configureOIDC(&opts.OIDC)
+	s.configureKerberos(&opts.Kerberos)
+
 	// Do similar for websocket config
 	s.wsConfigAuth(&opts.Websocket)
+
+	// Disconnect clients when their revocations take effect.
+	s.scheduleRevocations()
 }
 
 // Takes the given slices of NkeyUser and User options and build
@@ -320,11 +647,24 @@ func (s *Server) isClientAuthorized(c *client) bool {
 	// Check custom auth first, then jwts, then nkeys, then
 	// multiple users with TLS map if enabled, then token,
 	// then single user/pass.
+	var ok bool
 	if opts.CustomClientAuthentication != nil {
-		return opts.CustomClientAuthentication.Check(c)
+		ok = opts.CustomClientAuthentication.Check(c)
+	} else if opts.CustomClientAuthenticationV2 != nil {
+		var err error
+		if ok, err = opts.CustomClientAuthenticationV2.Check(c); err != nil {
+			c.Errorf("Custom authentication rejected the client: %v", err)
+			return false
+		}
+	} else {
+		ok = s.processClientOrLeafAuthentication(c, opts)
 	}
-
-	return s.processClientOrLeafAuthentication(c, opts)
+	// Users, nkeys and certificates revoked by the configuration are
+	// rejected whatever authenticated them.
+	if ok && s.isRevoked(c) {
+		return c.authFailed(authFailRevokedUser)
+	}
+	return ok
 }
 
 type authOpts struct {
@@ -335,6 +675,7 @@ type authOpts struct {
 	tlsMap     bool
 	users      map[string]*User
 	nkeys      map[string]*NkeyUser
+	tokens     []*TokenUser
 }
 
 func (s *Server) getAuthOpts(c *client, o *Options, auth *authOpts) bool {
@@ -352,6 +693,11 @@ func (s *Server) getAuthOpts(c *client, o *Options, auth *authOpts) bool {
 	}
 	auth.noAuthUser = o.NoAuthUser
 	auth.tlsMap = o.TLSMap
+	// Clients on the unix socket are authorized by the socket file permissions.
+	if c.unix && o.UnixSocket.NoAuthUser != _EMPTY_ {
+		auth.noAuthUser = o.UnixSocket.NoAuthUser
+		auth.tlsMap = false
+	}
 	if wsClient {
 		wo := &o.Websocket
 		// If those are specified, override, regardless if there is
@@ -378,9 +724,42 @@ func (s *Server) getAuthOpts(c *client, o *Options, auth *authOpts) bool {
 	auth.token = o.Authorization
 	auth.users = s.users
 	auth.nkeys = s.nkeys
+	auth.tokens = o.Tokens
 	return true
 }
 
+// Reasons of authentication failures in auth events.
+const (
+	authFailInvalidCredentials = "invalid_credentials"
+	authFailNoCredentials      = "no_credentials"
+	authFailUnknownUser        = "unknown_user"
+	authFailBadPassword        = "bad_password"
+	authFailBadToken           = "bad_token"
+	authFailBadSignature       = "bad_signature"
+	authFailJWTRequired        = "jwt_required"
+	authFailInvalidJWT         = "invalid_jwt"
+	authFailExpiredJWT         = "expired_jwt"
+	authFailUnknownAccount     = "unknown_account"
+	authFailUntrustedIssuer    = "untrusted_issuer"
+	authFailExpiredAccount     = "expired_account"
+	authFailRevokedUser        = "revoked_user"
+	authFailRemoteNotAllowed   = "remote_not_allowed"
+	authFailUserNotValid       = "user_not_valid"
+	authFailInvalidToken       = "invalid_oidc_token"
+	authFailInvalidScram       = "invalid_scram_proof"
+	authFailInvalidKerberos    = "invalid_kerberos_ticket"
+	authFailOperatorLimit      = "operator_limit"
+	authFailLockedOut          = "locked_out"
+	authFailUserConnLimit      = "user_connection_limit"
+)
+
+// authFailed records the reason the authentication of the client failed,
+// for the auth event, and returns false.
+func (c *client) authFailed(reason string) bool {
+	c.afail = reason
+	return false
+}
+
 func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) bool {
 	var (
 		nkey *NkeyUser
@@ -400,27 +779,60 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 		return true
 	}
 
+	// Access tokens of the OIDC provider are validated with its keys.
+	if oidc := s.oidc; oidc != nil && c.kind == CLIENT && isOIDCToken(c.opts.Token) {
+		s.mu.Unlock()
+		if !s.processOIDCAuthentication(c, oidc) {
+			return c.authFailed(authFailInvalidToken)
+		}
+		return true
+	}
+
+	// Kerberos tickets are validated with the keys of the keytab.
+	if krb := s.kerberos; krb != nil && c.kind == CLIENT && isKerberosToken(c.opts.Token) {
+		s.mu.Unlock()
+		if !s.processKerberosAuthentication(c, krb) {
+			return c.authFailed(authFailInvalidKerberos)
+		}
+		return true
+	}
+
+	// Clients that started a SCRAM exchange authenticate with its proof.
+	if c.kind == CLIENT && c.scram != nil {
+		s.mu.Unlock()
+		return s.processScramAuthentication(c, auth.users)
+	}
+
+	// Clients without credentials are bound to the anonymous account.
+	if opts.Anonymous.Account != _EMPTY_ && c.isAnonymous() {
+		s.mu.Unlock()
+		return s.processAnonymousAuthentication(c, &opts.Anonymous)
+	}
+
 	// Check if we have trustedKeys defined in the server. If so we require a user jwt.
 	if s.trustedKeys != nil {
 		if c.opts.JWT == "" && (c.opts.Nkey == "" || s.opts.SystemAccount == "") {
 			s.mu.Unlock()
 			c.Debugf("Authentication requires a user JWT")
-			return false
+			return c.authFailed(authFailJWTRequired)
 		}
 		if c.opts.JWT != "" {
 			// So we have a valid user jwt here.
-			juc, err = jwt.DecodeUserClaims(c.opts.JWT)
+			juc, err = s.decodeUserClaims(c.opts.JWT)
 			if err != nil {
 				s.mu.Unlock()
 				c.Debugf("User JWT not valid: %v", err)
-				return false
+				return c.authFailed(authFailInvalidJWT)
 			}
 			vr := jwt.CreateValidationResults()
 			juc.Validate(vr)
 			if vr.IsBlocking(true) {
 				s.mu.Unlock()
 				c.Debugf("User JWT no longer valid: %+v", vr)
-				return false
+				if juc.Expires > 0 && juc.Expires <= time.Now().Unix() {
+					return c.authFailed(authFailExpiredJWT)
+				}
+				return c.authFailed(authFailInvalidJWT)
 			}
 		}
 	}
@@ -432,25 +844,59 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 		nkey, ok = auth.nkeys[c.opts.Nkey]
 		if !ok && s.opts.SystemAccount == "" {
 			s.mu.Unlock()
-			return false
+			return c.authFailed(authFailUnknownUser)
 		}
-	} else if hasUsers {
+	} else if hasUsers || auth.tlsMap && (len(opts.TLSAccountMappings) > 0 || len(opts.SPIFFEMappings) > 0) {
 		// Check if we are tls verify and are mapping users from the client_certificate
 		if auth.tlsMap {
 			var euser string
-			authorized := checkClientTLSCertSubject(c, func(u string) bool {
+			// Users pinning the certificate are mapped regardless of its subject.
+			if tlsState := c.GetTLSConnectionState(); tlsState != nil && len(tlsState.PeerCertificates) > 0 {
+				fp := certFingerprint(tlsState.PeerCertificates[0])
+				for _, u := range auth.users {
+					if u.hasCertFingerprint(fp) {
+						c.Debugf("Using certificate fingerprint for auth [%q]", u.Username)
+						user, euser = u, u.Username
+						break
+					}
+				}
+			}
+			authorized := user != nil || checkClientTLSCertSubject(c, opts.TLSMapOrder, func(u string) bool {
 				var ok bool
 				user, ok = auth.users[u]
 				if !ok {
 					c.Debugf("User in cert [%q], not found", u)
 					return false
 				}
+				if len(user.CertFingerprints) > 0 {
+					c.Debugf("User in cert [%q], certificate fingerprint not pinned", u)
+					user = nil
+					return false
+				}
 				euser = u
 				return true
 			})
+			// Otherwise the SPIFFE ID of the certificate may map to an account.
+			if !authorized && len(opts.SPIFFEMappings) > 0 {
+				if tlsState := c.GetTLSConnectionState(); tlsState != nil && len(tlsState.PeerCertificates) > 0 {
+					if user = s.spiffeUser(c, opts.SPIFFEMappings, tlsState.PeerCertificates[0]); user != nil {
+						c.Debugf("Using SPIFFE ID [%q] for account [%q]", user.Username, user.Account.Name)
+						authorized, euser = true, user.Username
+					}
+				}
+			}
+			// Otherwise the certificate may map to an account.
+			if !authorized && len(opts.TLSAccountMappings) > 0 {
+				if tlsState := c.GetTLSConnectionState(); tlsState != nil && len(tlsState.PeerCertificates) > 0 {
+					if user = s.tlsAccountUser(opts.TLSAccountMappings, tlsState.PeerCertificates[0]); user != nil {
+						c.Debugf("Using certificate attributes for account [%q]", user.Account.Name)
+						authorized, euser = true, user.Username
+					}
+				}
+			}
 			if !authorized {
 				s.mu.Unlock()
-				return false
+				return c.authFailed(authFailUnknownUser)
 			}
 			if c.opts.Username != "" {
 				s.Warnf("User found in connect proto, but user required from cert - %v", c)
@@ -469,7 +915,7 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 				user, ok = auth.users[c.opts.Username]
 				if !ok {
 					s.mu.Unlock()
-					return false
+					return c.authFailed(authFailUnknownUser)
 				}
 			}
 		}
@@ -485,50 +931,39 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 		}
 		if acc, err = s.LookupAccount(issuer); acc == nil {
 			c.Debugf("Account JWT lookup error: %v", err)
-			return false
+			return c.authFailed(authFailUnknownAccount)
 		}
 		if !s.isTrustedIssuer(acc.Issuer) {
 			c.Debugf("Account JWT not signed by trusted operator")
-			return false
+			return c.authFailed(authFailUntrustedIssuer)
+		}
+		if s.operatorConnectionsReached(acc) {
+			c.Debugf("Maximum operator connections reached")
+			return c.authFailed(authFailOperatorLimit)
 		}
 		if juc.IssuerAccount != "" && !acc.hasIssuer(juc.Issuer) {
 			c.Debugf("User JWT issuer is not known")
-			return false
+			return c.authFailed(authFailUntrustedIssuer)
 		}
 		if acc.IsExpired() {
 			c.Debugf("Account JWT has expired")
-			return false
+			return c.authFailed(authFailExpiredAccount)
+		}
+		// Skip validation of nonce when presented with a bearer token,
+		// if accepted on this listener.
+		bearer := juc.BearerToken && c.bearerTokenAllowed(opts.BearerTokenListeners)
+		if juc.BearerToken && !bearer {
+			c.Debugf("User JWT bearer token not accepted on %s listener", c.listenerType())
 		}
-		// skip validation of nonce when presented with a bearer token
-		// FIXME: if BearerToken is only for WSS, need check for server with that port enabled
-		if !juc.BearerToken {
+		if !bearer {
 			// Verify the signature against the nonce.
-			if c.opts.Sig == "" {
-				c.Debugf("Signature missing")
-				return false
-			}
-			sig, err := base64.RawURLEncoding.DecodeString(c.opts.Sig)
-			if err != nil {
-				// Allow fallback to normal base64.
-				sig, err = base64.StdEncoding.DecodeString(c.opts.Sig)
-				if err != nil {
-					c.Debugf("Signature not valid base64")
-					return false
-				}
-			}
-			pub, err := nkeys.FromPublicKey(juc.Subject)
-			if err != nil {
-				c.Debugf("User nkey not valid: %v", err)
-				return false
-			}
-			if err := pub.Verify(c.nonce, sig); err != nil {
-				c.Debugf("Signature not verified")
-				return false
+			if !c.verifyNonceSignature(juc.Subject) {
+				return c.authFailed(authFailBadSignature)
 			}
 		}
 		if acc.checkUserRevoked(juc.Subject) {
 			c.Debugf("User authentication revoked")
-			return false
+			return c.authFailed(authFailRevokedUser)
 		}
 
 		nkey = buildInternalNkeyUser(juc, acc)
@@ -582,27 +1017,16 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 	}
 
 	if nkey != nil {
-		if c.opts.Sig == "" {
-			c.Debugf("Signature missing")
-			return false
+		if !c.verifyNonceSignature(c.opts.Nkey) {
+			return c.authFailed(authFailBadSignature)
 		}
-		sig, err := base64.RawURLEncoding.DecodeString(c.opts.Sig)
-		if err != nil {
-			// Allow fallback to normal base64.
-			sig, err = base64.StdEncoding.DecodeString(c.opts.Sig)
-			if err != nil {
-				c.Debugf("Signature not valid base64")
-				return false
-			}
+		if !remoteAllowed(c, nkey.AllowedConnections) {
+			c.Debugf("Nkey %q not allowed to connect from %v", nkey.Nkey, c.RemoteAddress())
+			return c.authFailed(authFailRemoteNotAllowed)
 		}
-		pub, err := nkeys.FromPublicKey(c.opts.Nkey)
-		if err != nil {
-			c.Debugf("User nkey not valid: %v", err)
-			return false
-		}
-		if err := pub.Verify(c.nonce, sig); err != nil {
-			c.Debugf("Signature not verified")
-			return false
+		if !s.addUserConn(c, nkey.Nkey, nkey.MaxConnections) {
+			c.Debugf("Nkey %q reached its maximum connections", nkey.Nkey)
+			return c.authFailed(authFailUserConnLimit)
 		}
 		if err := c.RegisterNkeyUser(nkey); err != nil {
 			return false
@@ -611,25 +1035,51 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 	}
 
 	if user != nil {
-		ok = comparePasswords(user.Password, c.opts.Password)
+		if ok = s.compareCachedPasswords(c, user.Username, user.Password, c.opts.Password); !ok {
+			c.authFailed(authFailBadPassword)
+		}
+		if ok && !remoteAllowed(c, user.AllowedConnections) {
+			c.Debugf("User %q not allowed to connect from %v", user.Username, c.RemoteAddress())
+			ok = c.authFailed(authFailRemoteNotAllowed)
+		}
+		if ok && !user.validAt(time.Now()) {
+			c.Debugf("User %q not valid at this time", user.Username)
+			ok = c.authFailed(authFailUserNotValid)
+		}
+		if ok && !s.addUserConn(c, user.Username, user.MaxConnections) {
+			c.Debugf("User %q reached its maximum connections", user.Username)
+			ok = c.authFailed(authFailUserConnLimit)
+		}
 		// If we are authorized, register the user which will properly setup any permissions
 		// for pub/sub authorizations.
 		if ok {
 			c.RegisterUser(user)
+			s.checkPasswordCost(c, user.Password)
 			// Generate an event if we have a system account and this is not the $G account.
 			s.accountConnectEvent(c)
+			// Check if we need to set an auth timer if the user expires.
+			c.checkExpiresAt(user.Expires)
 		}
 		return ok
 	}
 
 	if c.kind == CLIENT {
+		if len(auth.tokens) > 0 && c.opts.Token != "" {
+			return s.processTokenAuthentication(c, auth.tokens)
+		}
 		if auth.token != "" {
-			return comparePasswords(auth.token, c.opts.Token)
+			if !comparePasswords(auth.token, c.opts.Token) {
+				return c.authFailed(authFailBadToken)
+			}
+			return true
 		} else if auth.username != "" {
 			if auth.username != c.opts.Username {
-				return false
+				return c.authFailed(authFailUnknownUser)
 			}
-			return comparePasswords(auth.password, c.opts.Password)
+			if !s.compareCachedPasswords(c, auth.username, auth.password, c.opts.Password) {
+				return c.authFailed(authFailBadPassword)
+			}
+			return true
 		}
 	} else if c.kind == LEAF {
 		// There is no required username/password to connect and
@@ -639,7 +1089,7 @@ func (s *Server) processClientOrLeafAuthentication(c *client, opts *Options) boo
 		return s.registerLeafWithAccount(c, opts.LeafNode.Account)
 	}
 
-	return false
+	return c.authFailed(authFailNoCredentials)
 }
 
 func getTLSAuthDCs(rdns *pkix.RDNSequence) string {
@@ -662,7 +1112,36 @@ func getTLSAuthDCs(rdns *pkix.RDNSequence) string {
 	return strings.Join(dcs, ",")
 }
 
-func checkClientTLSCertSubject(c *client, fn func(string) bool) bool {
+// Certificate fields users can be mapped from, in the order of
+// tls_map_order.
+const (
+	tlsMapEmail       = "email"
+	tlsMapDNS         = "dns"
+	tlsMapURI         = "uri"
+	tlsMapSubject     = "subject"
+	tlsMapFingerprint = "fingerprint"
+)
+
+func validateTLSMapOrder(o *Options) error {
+	seen := make(map[string]bool, len(o.TLSMapOrder))
+	for _, f := range o.TLSMapOrder {
+		switch f {
+		case tlsMapEmail, tlsMapDNS, tlsMapURI, tlsMapSubject, tlsMapFingerprint:
+		default:
+			return fmt.Errorf("tls_map_order: unknown certificate field %q", f)
+		}
+		if seen[f] {
+			return fmt.Errorf("tls_map_order: duplicate certificate field %q", f)
+		}
+		seen[f] = true
+	}
+	return nil
+}
+
+// checkClientTLSCertSubject maps the peer certificate to a user with fn, by
+// default trying the emails, DNS names or URIs, and then the subject, or
+// only the fields of order, in that order.
+func checkClientTLSCertSubject(c *client, order []string, fn func(string) bool) bool {
 	tlsState := c.GetTLSConnectionState()
 	if tlsState == nil {
 		c.Debugf("User required in cert, no TLS connection state")
@@ -677,6 +1156,16 @@ func checkClientTLSCertSubject(c *client, fn func(string) bool) bool {
 		c.Debugf("Multiple peer certificates found, selecting first")
 	}
 
+	if len(order) > 0 {
+		for _, f := range order {
+			if checkClientTLSCertField(c, cert, f, fn) {
+				return true
+			}
+		}
+		c.Debugf("User required in cert, none found in %v", order)
+		return false
+	}
+
 	hasSANs := len(cert.DNSNames) > 0
 	hasEmailAddresses := len(cert.EmailAddresses) > 0
 	hasSubject := len(cert.Subject.String()) > 0
@@ -688,49 +1177,78 @@ func checkClientTLSCertSubject(c *client, fn func(string) bool) bool {
 
 	switch {
 	case hasEmailAddresses:
+		if checkClientTLSCertField(c, cert, tlsMapEmail, fn) {
+			return true
+		}
+		fallthrough
+	case hasSANs:
+		if checkClientTLSCertField(c, cert, tlsMapDNS, fn) {
+			return true
+		}
+	case hasURIs:
+		if checkClientTLSCertField(c, cert, tlsMapURI, fn) {
+			return true
+		}
+	}
+	return checkClientTLSCertField(c, cert, tlsMapSubject, fn)
+}
+
+// checkClientTLSCertField maps the field of the certificate to a user.
+func checkClientTLSCertField(c *client, cert *x509.Certificate, field string, fn func(string) bool) bool {
+	switch field {
+	case tlsMapEmail:
 		for _, u := range cert.EmailAddresses {
 			if fn(u) {
 				c.Debugf("Using email found in cert for auth [%q]", u)
 				return true
 			}
 		}
-		fallthrough
-	case hasSANs:
+	case tlsMapDNS:
 		for _, u := range cert.DNSNames {
 			if fn(u) {
 				c.Debugf("Using SAN found in cert for auth [%q]", u)
 				return true
 			}
 		}
-	case hasURIs:
+	case tlsMapURI:
 		for _, u := range cert.URIs {
 			if fn(u.String()) {
 				c.Debugf("Using URI found in cert for auth [%q]", u)
 				return true
 			}
 		}
-	}
-
-	// Try to get the full RDN Sequence that includes the domain components.
-	var rdns pkix.RDNSequence
-	if _, err := asn1.Unmarshal(cert.RawSubject, &rdns); err == nil {
-		// If found domain components then include roughly following
-		// the order from https://tools.ietf.org/html/rfc2253
-		rdn := cert.Subject.ToRDNSequence().String()
-		dcs := getTLSAuthDCs(&rdns)
-		if len(dcs) > 0 {
-			u := strings.Join([]string{rdn, dcs}, ",")
-			if fn(u) {
-				c.Debugf("Using RDNSequence for auth [%q]", u)
-				return true
+	case tlsMapFingerprint:
+		u := certFingerprint(cert)
+		if fn(u) {
+			c.Debugf("Using certificate fingerprint for auth [%q]", u)
+			return true
+		}
+	case tlsMapSubject:
+		// Try to get the full RDN Sequence that includes the domain components.
+		var rdns pkix.RDNSequence
+		if _, err := asn1.Unmarshal(cert.RawSubject, &rdns); err == nil {
+			// If found domain components then include roughly following
+			// the order from https://tools.ietf.org/html/rfc2253
+			rdn := cert.Subject.ToRDNSequence().String()
+			dcs := getTLSAuthDCs(&rdns)
+			if len(dcs) > 0 {
+				u := strings.Join([]string{rdn, dcs}, ",")
+				if fn(u) {
+					c.Debugf("Using RDNSequence for auth [%q]", u)
+					return true
+				}
 			}
 		}
-	}
 
-	// Use the subject of the certificate.
-	u := cert.Subject.String()
-	c.Debugf("Using certificate subject for auth [%q]", u)
-	return fn(u)
+		// Use the subject of the certificate.
+		u := cert.Subject.String()
+		if u == _EMPTY_ {
+			return false
+		}
+		c.Debugf("Using certificate subject for auth [%q]", u)
+		return fn(u)
+	}
+	return false
 }
 
 // checkRouterAuth checks optional router authorization which can be nil or username/password.
@@ -738,18 +1256,22 @@ func (s *Server) isRouterAuthorized(c *client) bool {
 	// Snapshot server options.
 	opts := s.getOpts()
 
-	// Check custom auth first, then TLS map if enabled
-	// then single user/pass.
+	// Check custom auth first, then nkey if configured and
+	// presented, then TLS map if enabled then single user/pass.
 	if s.opts.CustomRouterAuthentication != nil {
 		return s.opts.CustomRouterAuthentication.Check(c)
 	}
 
+	if len(opts.Cluster.Nkeys) > 0 && c.opts.Nkey != _EMPTY_ {
+		return s.isServerNkeyAuthorized(c, opts.Cluster.Nkeys)
+	}
+
 	if opts.Cluster.Username == "" {
-		return true
+		return len(opts.Cluster.Nkeys) == 0
 	}
 
 	if opts.Cluster.TLSMap {
-		return checkClientTLSCertSubject(c, func(user string) bool {
+		return checkClientTLSCertSubject(c, opts.TLSMapOrder, func(user string) bool {
 			return opts.Cluster.Username == user
 		})
 	}
@@ -763,17 +1285,20 @@ func (s *Server) isRouterAuthorized(c *client) bool {
 	return true
 }
 
-// isGatewayAuthorized checks optional gateway authorization which can be nil or username/password.
+// isGatewayAuthorized checks optional gateway authorization which can be nil, nkey or username/password.
 func (s *Server) isGatewayAuthorized(c *client) bool {
 	// Snapshot server options.
 	opts := s.getOpts()
+	if len(opts.Gateway.Nkeys) > 0 && c.opts.Nkey != _EMPTY_ {
+		return s.isServerNkeyAuthorized(c, opts.Gateway.Nkeys)
+	}
 	if opts.Gateway.Username == "" {
-		return true
+		return len(opts.Gateway.Nkeys) == 0
 	}
 
 	// Check whether TLS map is enabled, otherwise use single user/pass.
 	if opts.Gateway.TLSMap {
-		return checkClientTLSCertSubject(c, func(user string) bool {
+		return checkClientTLSCertSubject(c, opts.TLSMapOrder, func(user string) bool {
 			return opts.Gateway.Username == user
 		})
 	}
@@ -807,10 +1332,10 @@ func (s *Server) isLeafNodeAuthorized(c *client) bool {
 
 	isAuthorized := func(username, password, account string) bool {
 		if username != c.opts.Username {
-			return false
+			return c.authFailed(authFailUnknownUser)
 		}
 		if !comparePasswords(password, c.opts.Password) {
-			return false
+			return c.authFailed(authFailBadPassword)
 		}
 		return s.registerLeafWithAccount(c, account)
 	}
@@ -831,7 +1356,7 @@ func (s *Server) isLeafNodeAuthorized(c *client) bool {
 				return isAuthorized(u.Username, u.Password, accName)
 			}
 		}
-		return false
+		return c.authFailed(authFailUnknownUser)
 	}
 
 	// We are here if we accept leafnode connections without any credential.
@@ -854,7 +1379,104 @@ func isBcrypt(password string) bool {
 	return false
 }
 
+// Support for PBKDF2 stored passwords and tokens, approved by FIPS 140-3,
+// in the form $pbkdf2-sha256$<iterations>$<base64 salt>$<base64 key>.
+const (
+	pbkdf2Prefix        = "$pbkdf2-sha256$"
+	pbkdf2SaltLen       = 16
+	pbkdf2MinIterations = 10000
+)
+
+// DefaultPBKDF2Iterations is the number of iterations used to hash passwords
+// with PBKDF2 when not specified.
+const DefaultPBKDF2Iterations = 310000
+
+// isPBKDF2 checks whether the given password or token is hashed with PBKDF2.
+func isPBKDF2(password string) bool {
+	return strings.HasPrefix(password, pbkdf2Prefix)
+}
+
+// isHashedPassword checks whether the given password or token is hashed.
+func isHashedPassword(password string) bool {
+	return isBcrypt(password) || isPBKDF2(password) || isScramVerifier(password)
+}
+
+// pbkdf2SHA256 derives a key of keyLen bytes from the password, see RFC 8018.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+// GeneratePBKDF2Password hashes the password with PBKDF2-HMAC-SHA256 and a
+// random salt, for use as a password or token in the configuration.
+func GeneratePBKDF2Password(password string, iterations int) (string, error) {
+	if iterations < pbkdf2MinIterations {
+		return _EMPTY_, fmt.Errorf("pbkdf2 requires at least %d iterations", pbkdf2MinIterations)
+	}
+	salt := make([]byte, pbkdf2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return _EMPTY_, err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, iterations, sha256.Size)
+	return fmt.Sprintf("%s%d$%s$%s", pbkdf2Prefix, iterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// comparePBKDF2 checks the password against the PBKDF2 hash.
+func comparePBKDF2(hash, password string) bool {
+	parts := strings.Split(strings.TrimPrefix(hash, pbkdf2Prefix), "$")
+	if len(parts) != 3 {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	dk := pbkdf2SHA256([]byte(password), salt, iterations, len(key))
+	return subtle.ConstantTimeCompare(dk, key) == 1
+}
+
 func comparePasswords(serverPassword, clientPassword string) bool {
+	// Check to see if the server password is a PBKDF2 hash
+	if isPBKDF2(serverPassword) {
+		return comparePBKDF2(serverPassword, clientPassword)
+	}
+	// Check to see if the server password is a SCRAM verifier
+	if isScramVerifier(serverPassword) {
+		return compareScram(serverPassword, clientPassword)
+	}
 	// Check to see if the server password is a bcrypt hash
 	if isBcrypt(serverPassword) {
 		if err := bcrypt.CompareHashAndPassword([]byte(serverPassword), []byte(clientPassword)); err != nil {
@@ -867,6 +1489,9 @@ func comparePasswords(serverPassword, clientPassword string) bool {
 }
 
 func validateAuth(o *Options) error {
+	if o.CustomClientAuthentication != nil && o.CustomClientAuthenticationV2 != nil {
+		return fmt.Errorf("can not have both custom client authentication and custom client authentication v2")
+	}
 	if o.NoAuthUser == "" {
 		return nil
 	}
@@ -885,3 +1510,101 @@ func validateAuth(o *Options) error {
 		`no_auth_user: "%s" not present as user in authorization block or account configuration`,
 		o.NoAuthUser)
 }
+
+// checkLogin authenticates the login and password of clients of other
+// protocols connecting from the remote address, defaulting to the no auth
+// user if there is no login. It returns the account, and user if any.
+func (s *Server) checkLogin(remote net.Addr, login, password, noAuthUser string) (*Account, *User, error) {
+	opts := s.getOpts()
+	s.mu.Lock()
+	users, authRequired := s.users, s.info.AuthRequired
+	s.mu.Unlock()
+
+	noAuth := false
+	if login == _EMPTY_ && noAuthUser != _EMPTY_ {
+		login, noAuth = noAuthUser, true
+	}
+	var host string
+	if ip := addrIP(remote); ip != nil {
+		host = ip.String()
+	}
+	keys := lockoutKeys(host, login)
+	lockout := opts.AuthLockout.MaxFailures > 0
+	if lockout {
+		if k, locked := s.lockedOutKey(keys); locked {
+			s.Debugf("Authentication of %q from %s rejected, %s %q locked out", login, remote, k.kind, k.value)
+			return nil, nil, ErrAuthentication
+		}
+	}
+	fail := func() (*Account, *User, error) {
+		if lockout {
+			s.recordAuthFailures(keys, ClientInfo{Host: host})
+		}
+		return nil, nil, ErrAuthentication
+	}
+
+	acc, user := s.globalAccount(), (*User)(nil)
+	switch {
+	case len(opts.Tokens) > 0 && login == _EMPTY_ && !noAuth:
+		// The password is the token.
+		if user, _ = s.tokenUser(password, opts.Tokens); user == nil {
+			return fail()
+		}
+		acc = user.Account
+	case len(users) > 0:
+		u := users[login]
+		if u == nil || (!noAuth && !comparePasswords(u.Password, password)) {
+			return fail()
+		}
+		if !addrAllowed(remote, u.AllowedConnections) || !u.validAt(time.Now()) {
+			return fail()
+		}
+		if u.Account != nil {
+			acc = u.Account
+		}
+		user = u
+	case opts.Username != _EMPTY_:
+		if login != opts.Username || !comparePasswords(opts.Password, password) {
+			return fail()
+		}
+	case opts.Authorization != _EMPTY_:
+		if !comparePasswords(opts.Authorization, password) {
+			return fail()
+		}
+	case authRequired:
+		// Nkeys, operators and custom authentication can not be used with
+		// a login and password.
+		return fail()
+	}
+	if opts.Revocations.revoked(login, _EMPTY_, nil, time.Now()) {
+		return fail()
+	}
+	if lockout {
+		s.resetAuthFailureKeys(keys)
+	}
+	return acc, user, nil
+}
+
+// anonymousLogin returns true if clients of other protocols can connect
+// without a login, as the no auth user if set.
+func (s *Server) anonymousLogin(noAuthUser string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.info.AuthRequired || noAuthUser != _EMPTY_
+}
+
+// registerLogin registers the internal client of a connection of another
+// protocol than NATS with the account and user of its login, counting the
+// connection against the connection limit of the user.
+func (s *Server) registerLogin(c *client, acc *Account, user *User) error {
+	if user != nil {
+		if !s.addUserConn(c, user.Username, user.MaxConnections) {
+			return ErrAuthentication
+		}
+		c.RegisterUser(user)
+	}
+	if c.acc == nil {
+		return c.registerWithAccount(acc)
+	}
+	return nil
+}
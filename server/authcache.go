@@ -0,0 +1,172 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Verifying bcrypt, PBKDF2 or SCRAM hashed passwords is deliberately slow,
+// which is costly for clients reconnecting often. With `auth_cache`, the
+// successful verifications are cached for a while, keyed by the username,
+// the stored hash, the remote IP of the client and the password it sent.
+// The key is a HMAC with a secret of the server, so that passwords are not
+// kept in memory. Changing the password of a user changes the stored hash,
+// which invalidates its entries.
+
+// Default maximum number of cached verifications.
+const authCacheDefaultMaxEntries = 10000
+
+// AuthCacheOpts enable the caching of password verifications.
+type AuthCacheOpts struct {
+	// TTL of the cached verifications. Disabled when 0.
+	TTL time.Duration
+	// MaxEntries is the maximum number of cached verifications. Defaults
+	// to 10000.
+	MaxEntries int
+}
+
+func (o *AuthCacheOpts) maxEntries() int {
+	if o.MaxEntries > 0 {
+		return o.MaxEntries
+	}
+	return authCacheDefaultMaxEntries
+}
+
+func validateAuthCacheOptions(o *Options) error {
+	if o.AuthCache.TTL < 0 || o.AuthCache.MaxEntries < 0 {
+		return errors.New("auth_cache values can not be negative")
+	}
+	return nil
+}
+
+// AuthCacheVarz are the stats of the cache of password verifications.
+type AuthCacheVarz struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// authCache holds the expiration of the cached verifications.
+type authCache struct {
+	// Updated atomically, first for alignment.
+	hits   uint64
+	misses uint64
+
+	mu      sync.Mutex
+	secret  []byte
+	entries map[[sha256.Size]byte]time.Time
+}
+
+// key returns the key of the verification.
+// Lock should be held.
+func (ac *authCache) key(username, serverPassword, clientPassword, host string) [sha256.Size]byte {
+	h := hmac.New(sha256.New, ac.secret)
+	for _, f := range []string{username, serverPassword, clientPassword, host} {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+	var k [sha256.Size]byte
+	copy(k[:], h.Sum(nil))
+	return k
+}
+
+// compareCachedPasswords compares the passwords of the user, using the
+// cached verification of the password for the remote IP if any.
+func (s *Server) compareCachedPasswords(c *client, username, serverPassword, clientPassword string) bool {
+	opts := s.getOpts().AuthCache
+	if opts.TTL <= 0 || !(isBcrypt(serverPassword) || isPBKDF2(serverPassword) || isScramVerifier(serverPassword)) {
+		return comparePasswords(serverPassword, clientPassword)
+	}
+	c.mu.Lock()
+	host := c.host
+	c.mu.Unlock()
+
+	ac := &s.authCache
+	now := time.Now()
+	ac.mu.Lock()
+	if ac.secret == nil {
+		secret := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+			ac.mu.Unlock()
+			return comparePasswords(serverPassword, clientPassword)
+		}
+		ac.secret = secret
+		ac.entries = make(map[[sha256.Size]byte]time.Time)
+	}
+	k := ac.key(username, serverPassword, clientPassword, host)
+	if exp, ok := ac.entries[k]; ok && now.Before(exp) {
+		ac.mu.Unlock()
+		atomic.AddUint64(&ac.hits, 1)
+		return true
+	}
+	ac.mu.Unlock()
+	atomic.AddUint64(&ac.misses, 1)
+
+	// Verify without the lock, it is the slow part.
+	if !comparePasswords(serverPassword, clientPassword) {
+		return false
+	}
+	ac.mu.Lock()
+	// The cache may have been purged, or purged and enabled again, since.
+	if ac.entries == nil || ac.key(username, serverPassword, clientPassword, host) != k {
+		ac.mu.Unlock()
+		return true
+	}
+	if len(ac.entries) >= opts.maxEntries() {
+		for ek, exp := range ac.entries {
+			if !now.Before(exp) {
+				delete(ac.entries, ek)
+			}
+		}
+	}
+	if len(ac.entries) < opts.maxEntries() {
+		ac.entries[k] = now.Add(opts.TTL)
+	}
+	ac.mu.Unlock()
+	return true
+}
+
+// purgeAuthCache removes the cached verifications, when the cache is
+// disabled or its TTL reduced on reload.
+func (s *Server) purgeAuthCache() {
+	ac := &s.authCache
+	ac.mu.Lock()
+	ac.entries = nil
+	ac.secret = nil
+	ac.mu.Unlock()
+}
+
+// authCacheVarz returns the stats of the cache, if enabled.
+func (s *Server) authCacheVarz() *AuthCacheVarz {
+	if s.getOpts().AuthCache.TTL <= 0 {
+		return nil
+	}
+	ac := &s.authCache
+	ac.mu.Lock()
+	entries := len(ac.entries)
+	ac.mu.Unlock()
+	return &AuthCacheVarz{
+		Entries: entries,
+		Hits:    atomic.LoadUint64(&ac.hits),
+		Misses:  atomic.LoadUint64(&ac.misses),
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthCache(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pwd"), 11)
+	if err != nil {
+		t.Fatalf("Error generating hash: %v", err)
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization { users: [{user: a, password: "%s"}, {user: b, password: plain}] }
+		auth_cache { ttl: "1h", max_entries: 10 }
+	`, hash)))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	if ac := opts.AuthCache; ac.TTL != time.Hour || ac.MaxEntries != 10 {
+		t.Fatalf("Unexpected options: %+v", ac)
+	}
+
+	connect := func(user, pass string) error {
+		t.Helper()
+		nc, err := nats.Connect(s.ClientURL(), nats.UserInfo(user, pass), nats.MaxReconnects(0))
+		if err == nil {
+			nc.Close()
+		}
+		return err
+	}
+	checkStats := func(entries int, hits, misses uint64) {
+		t.Helper()
+		v, err := s.Varz(nil)
+		if err != nil {
+			t.Fatalf("Error on varz: %v", err)
+		}
+		if ac := v.AuthCache; ac == nil || ac.Entries != entries || ac.Hits != hits || ac.Misses != misses {
+			t.Fatalf("Unexpected auth cache stats: %+v", ac)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := connect("a", "pwd"); err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+	}
+	checkStats(1, 2, 1)
+
+	// Wrong passwords are never cached.
+	for i := 0; i < 2; i++ {
+		if err := connect("a", "bad"); err == nil {
+			t.Fatal("Expected connection to fail")
+		}
+	}
+	checkStats(1, 2, 3)
+
+	// Plain passwords are not cached.
+	if err := connect("b", "plain"); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	checkStats(1, 2, 3)
+
+	// Changing the password invalidates the cached verification.
+	hash, err = bcrypt.GenerateFromPassword([]byte("pwd2"), 11)
+	if err != nil {
+		t.Fatalf("Error generating hash: %v", err)
+	}
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization { users: [{user: a, password: "%s"}, {user: b, password: plain}] }
+		auth_cache { ttl: "1h", max_entries: 10 }
+	`, hash)))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	if err := connect("a", "pwd"); err == nil {
+		t.Fatal("Expected connection with the old password to fail")
+	}
+	if err := connect("a", "pwd2"); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	checkStats(2, 2, 5)
+
+	// Disabling the cache purges it.
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization { users: [{user: a, password: "%s"}, {user: b, password: plain}] }
+	`, hash)))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	if v, _ := s.Varz(nil); v.AuthCache != nil {
+		t.Fatalf("Expected no auth cache stats, got %+v", v.AuthCache)
+	}
+	if err := connect("a", "pwd2"); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	if len(s.authCache.entries) != 0 {
+		t.Fatalf("Expected cache to be empty, got %v", len(s.authCache.entries))
+	}
+
+	conf = createConfFile(t, []byte(`auth_cache { ttl: "-1s" }`))
+	defer os.Remove(conf)
+	o, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if err := validateOptions(o); err == nil || !strings.Contains(err.Error(), "negative") {
+		t.Fatalf("Expected error on negative ttl, got %v", err)
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BackupTarget is an object storage where stream backups are kept, for
+// instance an S3 or GCS bucket. Object names use forward slashes.
+type BackupTarget interface {
+	// Exists reports whether the named object exists.
+	Exists(name string) (bool, error)
+	// Put stores the named object.
+	Put(name string, r io.Reader, size int64) error
+	// Get returns the content of the named object.
+	Get(name string) (io.ReadCloser, error)
+}
+
+// BackupManifest describes a stream backup. Files are stored as content
+// addressed objects, so files unchanged since a previous backup, like
+// sealed message blocks, are not uploaded again.
+type BackupManifest struct {
+	Account string        `json:"account"`
+	Stream  string        `json:"stream"`
+	Created time.Time     `json:"created"`
+	Files   []*BackupFile `json:"files"`
+}
+
+// BackupFile is a file of a stream backup.
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupResult is returned by a backup.
+type BackupResult struct {
+	// Manifest is the name of the manifest object, needed for restore.
+	Manifest string
+	Files    int
+	// Uploaded and Bytes account for files that were not in the target yet.
+	Uploaded int
+	Bytes    int64
+}
+
+const (
+	// Where backup objects live in a target.
+	backupBlobsDir     = "blobs"
+	backupManifestsDir = "manifests"
+	// Suffix of the manifest checksum object.
+	backupSumSuffix = ".sum"
+	// How long a backup can take to read the stream snapshot.
+	backupSnapshotDeadline = 5 * time.Minute
+)
+
+// Backup stores an incremental backup of the stream, including its
+// consumers, to the target.
+func (mset *Stream) Backup(target BackupTarget) (*BackupResult, error) {
+	mset.mu.RLock()
+	name, jsa := mset.config.Name, mset.jsa
+	mset.mu.RUnlock()
+
+	var acc string
+	if jsa != nil && jsa.account != nil {
+		acc = jsa.account.Name
+	}
+
+	sr, err := mset.Snapshot(backupSnapshotDeadline, true, true)
+	if err != nil {
+		return nil, err
+	}
+	// Closing unblocks the snapshot if we bail early.
+	defer sr.Reader.Close()
+
+	gzr, err := gzip.NewReader(sr.Reader)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+
+	m := &BackupManifest{Account: acc, Stream: name, Created: time.Now().UTC()}
+	res := &BackupResult{}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == errFile {
+			return nil, fmt.Errorf("snapshot error: %s", buf)
+		}
+		sum := sha256.Sum256(buf)
+		bf := &BackupFile{Name: hdr.Name, Size: int64(len(buf)), SHA256: hex.EncodeToString(sum[:])}
+		m.Files = append(m.Files, bf)
+
+		blob := backupBlobName(bf.SHA256)
+		exists, err := target.Exists(blob)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			if err := target.Put(blob, bytes.NewReader(buf), bf.Size); err != nil {
+				return nil, err
+			}
+			res.Uploaded++
+			res.Bytes += bf.Size
+		}
+	}
+	res.Files = len(m.Files)
+
+	// Manifest goes last, along with its checksum for integrity.
+	mb, err := json.MarshalIndent(m, _EMPTY_, "  ")
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(mb)
+	msum := []byte(hex.EncodeToString(sum[:]))
+	res.Manifest = fmt.Sprintf("%s/%s/%s/%d.json", backupManifestsDir, acc, name, m.Created.UnixNano())
+	if err := target.Put(res.Manifest, bytes.NewReader(mb), int64(len(mb))); err != nil {
+		return nil, err
+	}
+	if err := target.Put(res.Manifest+backupSumSuffix, bytes.NewReader(msum), int64(len(msum))); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// BackupJetStream stores an incremental backup of all streams of all
+// JetStream enabled accounts to the target.
+func (s *Server) BackupJetStream(target BackupTarget) ([]*BackupResult, error) {
+	if !s.JetStreamEnabled() {
+		return nil, fmt.Errorf("jetstream not enabled")
+	}
+	var accounts []*Account
+	s.accounts.Range(func(k, v interface{}) bool {
+		if acc := v.(*Account); acc.JetStreamEnabled() {
+			accounts = append(accounts, acc)
+		}
+		return true
+	})
+
+	var results []*BackupResult
+	for _, acc := range accounts {
+		for _, mset := range acc.Streams() {
+			res, err := mset.Backup(target)
+			if err != nil {
+				return results, fmt.Errorf("error backing up stream %q in account %q: %v", mset.Name(), acc.Name, err)
+			}
+			results = append(results, res)
+		}
+	}
+	return results, nil
+}
+
+// LoadBackupManifest loads and verifies the named manifest from the target.
+func LoadBackupManifest(target BackupTarget, manifest string) (*BackupManifest, error) {
+	mb, err := readBackupObject(target, manifest)
+	if err != nil {
+		return nil, err
+	}
+	msum, err := readBackupObject(target, manifest+backupSumSuffix)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(mb)
+	if hex.EncodeToString(sum[:]) != strings.TrimSpace(string(msum)) {
+		return nil, fmt.Errorf("backup manifest %q checksum mismatch", manifest)
+	}
+	var m BackupManifest
+	if err := json.Unmarshal(mb, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// RestoreStreamFromBackup restores a stream from the named manifest of a
+// backup stored in the target. All files are verified against the manifest.
+func (a *Account) RestoreStreamFromBackup(target BackupTarget, manifest string) (*Stream, error) {
+	m, err := LoadBackupManifest(target, manifest)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeBackupSnapshot(pw, target, m))
+	}()
+	mset, err := a.RestoreStream(m.Stream, pr)
+	// Unblock the writer if restore did not read everything.
+	pr.Close()
+	return mset, err
+}
+
+// Rebuilds a stream snapshot from the backup files.
+func writeBackupSnapshot(w io.Writer, target BackupTarget, m *BackupManifest) error {
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+	for _, bf := range m.Files {
+		buf, err := readBackupObject(target, backupBlobName(bf.SHA256))
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(buf)
+		if int64(len(buf)) != bf.Size || hex.EncodeToString(sum[:]) != bf.SHA256 {
+			return fmt.Errorf("backup file %q is corrupt", bf.Name)
+		}
+		hdr := &tar.Header{Name: bf.Name, Mode: 0600, ModTime: m.Created, Size: bf.Size, Format: tar.FormatPAX}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+func readBackupObject(target BackupTarget, name string) ([]byte, error) {
+	rc, err := target.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// Blobs are spread in sub directories using the start of their hash.
+func backupBlobName(sum string) string {
+	return fmt.Sprintf("%s/%s/%s", backupBlobsDir, sum[:2], sum)
+}
+
+// NewDirBackupTarget returns a backup target storing objects as files in
+// the given directory, for instance a mounted bucket or network volume.
+func NewDirBackupTarget(dir string) BackupTarget {
+	return dirBackupTarget(dir)
+}
+
+type dirBackupTarget string
+
+func (d dirBackupTarget) path(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (d dirBackupTarget) Exists(name string) (bool, error) {
+	_, err := os.Stat(d.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d dirBackupTarget) Put(name string, r io.Reader, _ int64) error {
+	fn := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so objects are never partially written.
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), ".put-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (d dirBackupTarget) Get(name string) (io.ReadCloser, error) {
+	return os.Open(d.path(name))
+}
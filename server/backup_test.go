@@ -0,0 +1,117 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStreamBackupAndRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.Cluster.Port = 0
+	opts.JetStream = true
+	opts.StoreDir = filepath.Join(dir, "js")
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	acc := s.GlobalAccount()
+	cfg := &StreamConfig{Name: "BACKUP", Storage: FileStorage}
+	mset, err := acc.AddStreamWithStore(cfg, &FileStoreConfig{BlockSize: 4 * 1024})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	if _, err := mset.AddConsumer(&ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit}); err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	msg := make([]byte, 512)
+	publish := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if _, err := mset.Publish("BACKUP", nil, msg); err != nil {
+				t.Fatalf("Unexpected error publishing: %v", err)
+			}
+		}
+	}
+	publish(50)
+
+	target := NewDirBackupTarget(filepath.Join(dir, "bucket"))
+	res1, err := mset.Backup(target)
+	if err != nil {
+		t.Fatalf("Unexpected error on backup: %v", err)
+	}
+	if res1.Files == 0 || res1.Uploaded != res1.Files {
+		t.Fatalf("Unexpected backup result: %+v", res1)
+	}
+
+	// Only changed blocks are uploaded on the next backup.
+	publish(5)
+	results, err := s.BackupJetStream(target)
+	if err != nil {
+		t.Fatalf("Unexpected error on backup: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 backup result, got %d", len(results))
+	}
+	res2 := results[0]
+	if res2.Uploaded == 0 || res2.Uploaded >= res2.Files || res2.Manifest == res1.Manifest {
+		t.Fatalf("Expected incremental backup, got %+v after %+v", res2, res1)
+	}
+
+	mset.Delete()
+	mset, err = acc.RestoreStreamFromBackup(target, res1.Manifest)
+	if err != nil {
+		t.Fatalf("Unexpected error on restore: %v", err)
+	}
+	if state := mset.State(); state.Msgs != 50 {
+		t.Fatalf("Expected 50 messages, got %d", state.Msgs)
+	}
+	if o := mset.LookupConsumer("dlc"); o == nil {
+		t.Fatal("Expected consumer to be restored")
+	}
+
+	mset.Delete()
+	mset, err = acc.RestoreStreamFromBackup(target, res2.Manifest)
+	if err != nil {
+		t.Fatalf("Unexpected error on restore: %v", err)
+	}
+	if state := mset.State(); state.Msgs != 55 {
+		t.Fatalf("Expected 55 messages, got %d", state.Msgs)
+	}
+	mset.Delete()
+
+	// Corrupted files are detected.
+	m, err := LoadBackupManifest(target, res2.Manifest)
+	if err != nil {
+		t.Fatalf("Unexpected error loading manifest: %v", err)
+	}
+	blob := target.(dirBackupTarget).path(backupBlobName(m.Files[len(m.Files)-1].SHA256))
+	if err := ioutil.WriteFile(blob, []byte("bad"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := acc.RestoreStreamFromBackup(target, res2.Manifest); err == nil {
+		t.Fatal("Expected restore of corrupted backup to fail")
+	}
+	if _, err := acc.LookupStream("BACKUP"); err == nil {
+		t.Fatal("Expected stream to not be restored")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// With a minimum bcrypt cost, users logging in with a password hashed at a
+// lower cost are reported with an event. With rehash enabled, the hash of
+// the password is replaced in the users file by one at the minimum cost,
+// the watcher of the file then applying it, so that weak hashes are
+// upgraded as users log in. Users defined elsewhere are only reported.
+
+func validateBcryptCost(o *Options) error {
+	if o.BcryptMinCost == 0 {
+		if o.BcryptRehash {
+			return fmt.Errorf("bcrypt rehash requires a minimum bcrypt cost")
+		}
+		return nil
+	}
+	if o.BcryptMinCost < bcrypt.MinCost || o.BcryptMinCost > bcrypt.MaxCost {
+		return fmt.Errorf("minimum bcrypt cost has to be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if o.BcryptRehash && o.UsersFile == _EMPTY_ {
+		return fmt.Errorf("bcrypt rehash requires a users file")
+	}
+	return nil
+}
+
+// weakBcryptCost returns the cost of the bcrypt hash if lower than the
+// minimum, 0 otherwise.
+func weakBcryptCost(hash string, min int) int {
+	if min <= 0 || !isBcrypt(hash) {
+		return 0
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil || cost >= min {
+		return 0
+	}
+	return cost
+}
+
+// checkPasswordCost reports the client that logged in with a password
+// hashed at a cost lower than the minimum, and rehashes it if enabled.
+func (s *Server) checkPasswordCost(c *client, hash string) {
+	opts := s.getOpts()
+	cost := weakBcryptCost(hash, opts.BcryptMinCost)
+	if cost == 0 {
+		return
+	}
+	c.mu.Lock()
+	password := c.opts.Password
+	c.mu.Unlock()
+
+	rehash := false
+	if opts.BcryptRehash {
+		s.mu.Lock()
+		if _, ok := s.rehashing[hash]; !ok {
+			if s.rehashing == nil {
+				s.rehashing = make(map[string]struct{})
+			}
+			s.rehashing[hash] = struct{}{}
+			rehash = true
+		}
+		s.mu.Unlock()
+	}
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		rehashed := false
+		if rehash {
+			if err := s.rehashUsersFilePassword(opts.UsersFile, hash, password, opts.BcryptMinCost); err != nil {
+				c.Warnf("Could not rehash password: %v", err)
+			} else {
+				rehashed = true
+			}
+			s.mu.Lock()
+			delete(s.rehashing, hash)
+			s.mu.Unlock()
+		}
+		s.sendWeakHashEvent(c, cost, opts.BcryptMinCost, rehashed)
+	})
+}
+
+// rehashUsersFilePassword replaces the hash in the users file by a hash of
+// the password at the cost.
+func (s *Server) rehashUsersFilePassword(fn, hash, password string, cost int) error {
+	s.usersFileMu.Lock()
+	defer s.usersFileMu.Unlock()
+
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	if bytes.Count(buf, []byte(hash)) != 1 {
+		return fmt.Errorf("password hash not found once in users file %q", fn)
+	}
+	nhash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, bytes.Replace(buf, []byte(hash), nhash, 1), fi.Mode()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// sendWeakHashEvent sends an event for the client that logged in with a
+// password hashed at a cost lower than the minimum.
+func (s *Server) sendWeakHashEvent(c *client, cost, min int, rehashed bool) {
+	c.mu.Lock()
+	m := AuthWeakHashEventMsg{
+		TypedEvent: TypedEvent{
+			Type: AuthWeakHashEventMsgType,
+			Time: time.Now().UTC(),
+		},
+		Client: ClientInfo{
+			Start:   c.start,
+			Host:    c.host,
+			ID:      c.cid,
+			Account: accForClient(c),
+			User:    c.getRawAuthUser(),
+			Name:    c.opts.Name,
+			Lang:    c.opts.Lang,
+			Version: c.opts.Version,
+		},
+		Cost:     cost,
+		MinCost:  min,
+		Rehashed: rehashed,
+	}
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	m.ID = s.nextEventID()
+	s.sendInternalMsg(fmt.Sprintf(authWeakHashEventSubj, s.info.ID), _EMPTY_, &m.Server, &m)
+}
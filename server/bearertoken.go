@@ -0,0 +1,74 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+)
+
+// User JWTs marked as bearer tokens skip the signature of the nonce, which
+// is meant for clients, such as browsers, that can not hold the seed of
+// the user. With bearer_token_listeners, they are only accepted as such on
+// the listed listeners, e.g. websocket, and the clients of the others must
+// still sign the nonce. Without it, they are only accepted on websocket.
+
+// Listeners bearer tokens can be accepted on.
+const (
+	bearerTokenClient    = "client"
+	bearerTokenWebsocket = "websocket"
+	bearerTokenLeafnode  = "leafnode"
+	bearerTokenUnix      = "unix"
+)
+
+// Listeners bearer tokens are accepted on when not configured.
+var defaultBearerTokenListeners = []string{bearerTokenWebsocket}
+
+func validateBearerTokenListeners(o *Options) error {
+	for _, l := range o.BearerTokenListeners {
+		switch l {
+		case bearerTokenClient, bearerTokenWebsocket, bearerTokenLeafnode, bearerTokenUnix:
+		default:
+			return fmt.Errorf("bearer_token_listeners: unknown listener %q", l)
+		}
+	}
+	return nil
+}
+
+// listenerType returns the type of the listener the client connected to.
+func (c *client) listenerType() string {
+	switch {
+	case c.kind == LEAF:
+		return bearerTokenLeafnode
+	case c.ws != nil:
+		return bearerTokenWebsocket
+	case c.unix:
+		return bearerTokenUnix
+	}
+	return bearerTokenClient
+}
+
+// bearerTokenAllowed returns true if bearer tokens are accepted on the
+// listener the client connected to.
+func (c *client) bearerTokenAllowed(listeners []string) bool {
+	if listeners == nil {
+		listeners = defaultBearerTokenListeners
+	}
+	lt := c.listenerType()
+	for _, l := range listeners {
+		if l == lt {
+			return true
+		}
+	}
+	return false
+}
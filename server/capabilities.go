@@ -0,0 +1,92 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+)
+
+// Wire features are negotiated with a bitmap of capabilities: the server
+// advertises the ones it supports in INFO, clients the ones they support
+// in CONNECT, and a feature can only be used on a connection if both sides
+// support it. New features are registered here, and only advertised once
+// the server implements them, so that clients of different versions can
+// be mixed safely.
+
+// Capabilities is a bitmap of wire features.
+type Capabilities uint32
+
+// Registered capabilities.
+const (
+	// CapHeadersV2 is the second version of message headers.
+	CapHeadersV2 Capabilities = 1 << iota
+	// CapCompression is the compression of message payloads.
+	CapCompression
+	// CapBatching is the batching of messages in a single protocol operation.
+	CapBatching
+	// CapBinaryFrames is the binary framing of protocol operations.
+	CapBinaryFrames
+)
+
+// Names of the registered capabilities, as reported by the monitoring.
+var capabilityNames = []struct {
+	cap  Capabilities
+	name string
+}{
+	{CapHeadersV2, "headers_v2"},
+	{CapCompression, "compression"},
+	{CapBatching, "batching"},
+	{CapBinaryFrames, "binary_frames"},
+}
+
+// Capabilities implemented by the server, features add their bit here once
+// supported.
+var supportedCapabilities Capabilities
+
+// Has returns true if all the capabilities are set.
+func (c Capabilities) Has(caps Capabilities) bool {
+	return c&caps == caps
+}
+
+// Names returns the names of the registered capabilities that are set.
+func (c Capabilities) Names() []string {
+	var names []string
+	for _, cn := range capabilityNames {
+		if c.Has(cn.cap) {
+			names = append(names, cn.name)
+		}
+	}
+	return names
+}
+
+// String returns the comma separated names of the capabilities.
+func (c Capabilities) String() string {
+	return strings.Join(c.Names(), ",")
+}
+
+// negotiateCapabilities returns the capabilities both the server and the
+// client support.
+func negotiateCapabilities(server, client Capabilities) Capabilities {
+	return server & client
+}
+
+// capabilities returns the capabilities advertised by the server.
+func (s *Server) capabilities() Capabilities {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info.Capabilities
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// How often certificates are checked for expiry.
+var certExpiryCheckInterval = time.Hour
+
+// Days before expiry at which advisories are sent, if not configured.
+var defaultTLSExpiryThresholds = []int{30, 7, 1}
+
+// CertExpiry describes when a TLS certificate used by the server expires.
+type CertExpiry struct {
+	// Kind is the listener or connection type, client, cluster, gateway, leafnode or websocket.
+	Kind string `json:"kind"`
+	// Peer is set for certificates presented by remote servers.
+	Peer          bool      `json:"peer,omitempty"`
+	Subject       string    `json:"subject"`
+	Fingerprint   string    `json:"fingerprint"`
+	Expires       time.Time `json:"expires"`
+	DaysRemaining int       `json:"days_remaining"`
+}
+
+func newCertExpiry(kind string, peer bool, cert *x509.Certificate, now time.Time) *CertExpiry {
+	return &CertExpiry{
+		Kind:          kind,
+		Peer:          peer,
+		Subject:       cert.Subject.String(),
+		Fingerprint:   certFingerprint(cert),
+		Expires:       cert.NotAfter,
+		DaysRemaining: int(cert.NotAfter.Sub(now).Hours() / 24),
+	}
+}
+
+// certExpiries returns the configured certificates and the ones presented
+// by routes, gateways and leafnodes, soonest to expire first.
+// Lock should be held upon entry.
+func (s *Server) certExpiries() []*CertExpiry {
+	now := time.Now()
+	opts := s.getOpts()
+	seen := make(map[string]struct{})
+	var certs []*CertExpiry
+	add := func(ce *CertExpiry) {
+		key := ce.Kind + ce.Fingerprint
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			certs = append(certs, ce)
+		}
+	}
+
+	for _, tc := range []struct {
+		kind   string
+		config *tls.Config
+	}{
+		{"client", opts.TLSConfig},
+		{"cluster", opts.Cluster.TLSConfig},
+		{"gateway", opts.Gateway.TLSConfig},
+		{"leafnode", opts.LeafNode.TLSConfig},
+		{"websocket", opts.Websocket.TLSConfig},
+	} {
+		if tc.config == nil {
+			continue
+		}
+		for _, cert := range tc.config.Certificates {
+			leaf := cert.Leaf
+			if leaf == nil && len(cert.Certificate) > 0 {
+				leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+			}
+			if leaf != nil {
+				add(newCertExpiry(tc.kind, false, leaf, now))
+			}
+		}
+	}
+
+	addPeer := func(kind string, c *client) {
+		c.mu.Lock()
+		tc, ok := c.nc.(*tls.Conn)
+		c.mu.Unlock()
+		if !ok {
+			return
+		}
+		if pc := tc.ConnectionState().PeerCertificates; len(pc) > 0 {
+			add(newCertExpiry(kind, true, pc[0], now))
+		}
+	}
+	for _, r := range s.routes {
+		addPeer("cluster", r)
+	}
+	for _, l := range s.leafs {
+		addPeer("leafnode", l)
+	}
+	gws := make(map[uint64]*client)
+	s.getAllGatewayConnections(gws)
+	for _, g := range gws {
+		addPeer("gateway", g)
+	}
+
+	sort.Slice(certs, func(i, j int) bool { return certs[i].Expires.Before(certs[j].Expires) })
+	return certs
+}
+
+// TLSCertExpiryEventMsg is sent when a certificate is about to expire.
+type TLSCertExpiryEventMsg struct {
+	TypedEvent
+	Server    ServerInfo `json:"server"`
+	Cert      CertExpiry `json:"cert"`
+	Threshold int        `json:"threshold_days"`
+}
+
+// TLSCertExpiryEventMsgType is the schema type for TLSCertExpiryEventMsg
+const TLSCertExpiryEventMsgType = "io.nats.server.advisory.v1.tls_cert_expiry"
+
+// startCertExpiryCheck will periodically check certificates for expiry.
+func (s *Server) startCertExpiryCheck() {
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		t := time.NewTimer(0)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.checkCertExpiry()
+				t.Reset(certExpiryCheckInterval)
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+// checkCertExpiry sends an advisory and warns once for each threshold a
+// certificate crosses.
+func (s *Server) checkCertExpiry() {
+	thresholds := s.getOpts().TLSExpiryThresholds
+	if len(thresholds) == 0 {
+		thresholds = defaultTLSExpiryThresholds
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.certExpiryNotified == nil {
+		s.certExpiryNotified = make(map[string]int)
+	}
+	for _, ce := range s.certExpiries() {
+		// Lowest threshold crossed by this certificate, if any.
+		threshold := -1
+		for _, days := range thresholds {
+			if ce.DaysRemaining <= days && (threshold < 0 || days < threshold) {
+				threshold = days
+			}
+		}
+		key := ce.Kind + ce.Fingerprint
+		if last, ok := s.certExpiryNotified[key]; threshold < 0 || (ok && last <= threshold) {
+			continue
+		}
+		s.certExpiryNotified[key] = threshold
+
+		what := "certificate"
+		if ce.Peer {
+			what = "peer certificate"
+		}
+		if ce.DaysRemaining < 0 {
+			s.Errorf("TLS %s %s %q expired on %v", ce.Kind, what, ce.Subject, ce.Expires)
+		} else {
+			s.Warnf("TLS %s %s %q expires in %d days on %v", ce.Kind, what, ce.Subject, ce.DaysRemaining, ce.Expires)
+		}
+		if !s.eventsEnabled() {
+			continue
+		}
+		m := TLSCertExpiryEventMsg{
+			TypedEvent: TypedEvent{
+				Type: TLSCertExpiryEventMsgType,
+				ID:   s.nextEventID(),
+				Time: time.Now().UTC(),
+			},
+			Cert:      *ce,
+			Threshold: threshold,
+		}
+		s.sendInternalMsg(fmt.Sprintf(tlsExpiryEventSubj, s.info.ID), _EMPTY_, &m.Server, &m)
+	}
+}
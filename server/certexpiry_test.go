@@ -0,0 +1,135 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func createTestCert(t *testing.T, cn string, expires time.Time) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     expires,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSCertExpiry(t *testing.T) {
+	opts := DefaultOptions()
+	opts.LeafNode.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{createTestCert(t, "leaf", time.Now().Add(5*24*time.Hour+time.Hour))},
+	}
+	sys := NewAccount("SYS")
+	opts.Accounts = []*Account{sys}
+	opts.SystemAccount = "SYS"
+	opts.Users = []*User{{Username: "sys", Password: "pwd", Account: sys}}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	v, err := s.Varz(nil)
+	if err != nil {
+		t.Fatalf("Error on varz: %v", err)
+	}
+	if len(v.TLSCerts) != 1 {
+		t.Fatalf("Expected 1 certificate, got %+v", v.TLSCerts)
+	}
+	if ce := v.TLSCerts[0]; ce.Kind != "leafnode" || ce.Peer || ce.Subject != "CN=leaf" || ce.DaysRemaining != 5 {
+		t.Fatalf("Unexpected certificate: %+v", ce)
+	}
+
+	// The startup check crossed the 7 days threshold.
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, days := range s.certExpiryNotified {
+			if days == 7 {
+				return nil
+			}
+		}
+		return fmt.Errorf("Expected 7 days threshold to be notified, got %v", s.certExpiryNotified)
+	})
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, fmt.Sprintf(tlsExpiryEventSubj, s.ID()))
+	natsFlush(t, nc)
+
+	// Same threshold is not notified again.
+	s.checkCertExpiry()
+	if _, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected no advisory, got %v", err)
+	}
+
+	// A lower threshold is.
+	s.optsMu.Lock()
+	s.opts.TLSExpiryThresholds = []int{30, 7, 6}
+	s.optsMu.Unlock()
+	s.checkCertExpiry()
+	var ev TLSCertExpiryEventMsg
+	if err := json.Unmarshal(natsNexMsg(t, sub, time.Second).Data, &ev); err != nil {
+		t.Fatalf("Error unmarshalling advisory: %v", err)
+	}
+	if ev.Type != TLSCertExpiryEventMsgType || ev.Threshold != 6 || ev.Cert.Subject != "CN=leaf" {
+		t.Fatalf("Unexpected advisory: %+v", ev)
+	}
+}
+
+func TestTLSCertExpiryThresholdsConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		tls_expiry_thresholds: [60, 14, 2]
+		listen: "127.0.0.1:-1"
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Received unexpected error %s", err)
+	}
+	if !reflect.DeepEqual(opts.TLSExpiryThresholds, []int{60, 14, 2}) {
+		t.Fatalf("Unexpected thresholds: %v", opts.TLSExpiryThresholds)
+	}
+
+	conf = createConfFile(t, []byte(`
+		tls_expiry_thresholds: ["soon"]
+		listen: "127.0.0.1:-1"
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil {
+		t.Fatal("Expected error for invalid threshold")
+	}
+}
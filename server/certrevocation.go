@@ -0,0 +1,253 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// With verify, the certificates presented by peers can be checked against
+// CRL files and with an OCSP responder during the handshake, so that
+// revoked certificates are rejected before being mapped to users. The CRL
+// files are read when the TLS configuration is loaded, and thus on reload.
+// The OCSP responder is the one configured, or else the one of the
+// certificate. OCSP responses are cached until their next update, capped
+// by the cache TTL. When the responder can not be reached or does not know
+// the certificate, the certificate is accepted unless the require_status
+// option of ocsp is set. Session resumption is disabled, since resumed sessions do not
+// present their certificate again.
+
+const (
+	// Default timeout of OCSP requests.
+	ocspDefaultTimeout = 2 * time.Second
+	// Default maximum time OCSP responses are cached for.
+	ocspDefaultCacheTTL = time.Hour
+	// Maximum size of OCSP responses.
+	ocspMaxResponseSize = 1024 * 1024
+	// Number of cached OCSP statuses above which expired ones are removed.
+	ocspCacheSweepSize = 1024
+)
+
+// certRevocationChecker checks the peer certificates of a TLS configuration.
+type certRevocationChecker struct {
+	crls []*pkix.CertificateList
+
+	ocsp          bool
+	responder     string
+	timeout       time.Duration
+	cacheTTL      time.Duration
+	requireStatus bool
+	client        *http.Client
+
+	mu sync.Mutex
+	// CRLs verified against the subject of an issuer, by its raw subject.
+	issuerCRLs map[string][]*pkix.CertificateList
+	// OCSP statuses by issuer and serial number.
+	statuses map[string]*ocspStatus
+}
+
+type ocspStatus struct {
+	revoked bool
+	expires time.Time
+}
+
+// setupCertRevocation checks the peer certificates of the configuration
+// against the CRL files and OCSP responder of the options, if any.
+func setupCertRevocation(config *tls.Config, tc *TLSConfigOpts) error {
+	if len(tc.CRLFiles) == 0 && !tc.OCSP {
+		return nil
+	}
+	if !tc.Verify {
+		return fmt.Errorf("crl_files and ocsp require verify")
+	}
+	rc := &certRevocationChecker{
+		ocsp:          tc.OCSP,
+		responder:     tc.OCSPResponder,
+		timeout:       tc.OCSPTimeout,
+		cacheTTL:      tc.OCSPCacheTTL,
+		requireStatus: tc.OCSPRequireStatus,
+		issuerCRLs:    make(map[string][]*pkix.CertificateList),
+		statuses:      make(map[string]*ocspStatus),
+	}
+	if rc.timeout <= 0 {
+		rc.timeout = ocspDefaultTimeout
+	}
+	if rc.cacheTTL <= 0 {
+		rc.cacheTTL = ocspDefaultCacheTTL
+	}
+	rc.client = &http.Client{Timeout: rc.timeout}
+	for _, file := range tc.CRLFiles {
+		crls, err := loadCRLFile(file)
+		if err != nil {
+			return err
+		}
+		rc.crls = append(rc.crls, crls...)
+	}
+	config.SessionTicketsDisabled = true
+	config.VerifyPeerCertificate = rc.verifyPeerCertificate
+	return nil
+}
+
+// loadCRLFile returns the CRLs of the file, in PEM or DER.
+func loadCRLFile(file string) ([]*pkix.CertificateList, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading crl file: %v", err)
+	}
+	var crls []*pkix.CertificateList
+	if !bytes.Contains(b, []byte("-----BEGIN")) {
+		crl, err := x509.ParseDERCRL(b)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing crl file %q: %v", file, err)
+		}
+		return append(crls, crl), nil
+	}
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseDERCRL(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing crl file %q: %v", file, err)
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, fmt.Errorf("no crl found in file %q", file)
+	}
+	return crls, nil
+}
+
+// verifyPeerCertificate rejects the peer certificate if it is revoked.
+func (rc *certRevocationChecker) verifyPeerCertificate(_ [][]byte, chains [][]*x509.Certificate) error {
+	if len(chains) == 0 || len(chains[0]) < 2 {
+		// Nothing to check without the issuer, e.g. with insecure.
+		return nil
+	}
+	cert, issuer := chains[0][0], chains[0][1]
+	if rc.revokedByCRL(cert, issuer) {
+		return fmt.Errorf("certificate %q is revoked by crl", cert.Subject)
+	}
+	if rc.ocsp {
+		revoked, err := rc.revokedByOCSP(cert, issuer)
+		if err != nil && rc.requireStatus {
+			return fmt.Errorf("certificate %q ocsp status unknown: %v", cert.Subject, err)
+		}
+		if revoked {
+			return fmt.Errorf("certificate %q is revoked by ocsp responder", cert.Subject)
+		}
+	}
+	return nil
+}
+
+// revokedByCRL returns true if the certificate is in a CRL of its issuer.
+func (rc *certRevocationChecker) revokedByCRL(cert, issuer *x509.Certificate) bool {
+	if len(rc.crls) == 0 {
+		return false
+	}
+	rc.mu.Lock()
+	crls, ok := rc.issuerCRLs[string(issuer.RawSubject)]
+	if !ok {
+		for _, crl := range rc.crls {
+			if issuer.CheckCRLSignature(crl) == nil {
+				crls = append(crls, crl)
+			}
+		}
+		rc.issuerCRLs[string(issuer.RawSubject)] = crls
+	}
+	rc.mu.Unlock()
+	for _, crl := range crls {
+		for _, rcert := range crl.TBSCertList.RevokedCertificates {
+			if rcert.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// revokedByOCSP returns true if the responder reports the certificate as
+// revoked, caching its response.
+func (rc *certRevocationChecker) revokedByOCSP(cert, issuer *x509.Certificate) (bool, error) {
+	key := string(issuer.RawSubjectPublicKeyInfo) + cert.SerialNumber.String()
+	now := time.Now()
+	rc.mu.Lock()
+	st := rc.statuses[key]
+	rc.mu.Unlock()
+	if st != nil && now.Before(st.expires) {
+		return st.revoked, nil
+	}
+
+	responder := rc.responder
+	if responder == _EMPTY_ && len(cert.OCSPServer) > 0 {
+		responder = cert.OCSPServer[0]
+	}
+	if responder == _EMPTY_ {
+		return false, fmt.Errorf("no ocsp responder")
+	}
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := rc.client.Post(responder, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("ocsp responder returned status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, ocspMaxResponseSize))
+	if err != nil {
+		return false, err
+	}
+	or, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return false, err
+	}
+	if or.Status == ocsp.Unknown {
+		return false, fmt.Errorf("certificate unknown to the ocsp responder")
+	}
+	st = &ocspStatus{revoked: or.Status == ocsp.Revoked, expires: now.Add(rc.cacheTTL)}
+	if !or.NextUpdate.IsZero() && or.NextUpdate.Before(st.expires) {
+		st.expires = or.NextUpdate
+	}
+	rc.mu.Lock()
+	if len(rc.statuses) >= ocspCacheSweepSize {
+		for k, s := range rc.statuses {
+			if !now.Before(s.expires) {
+				delete(rc.statuses, k)
+			}
+		}
+	}
+	rc.statuses[key] = st
+	rc.mu.Unlock()
+	return st.revoked, nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/conf"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func createTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert, key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+// issue returns the certificate and key PEM, and the TLS certificate, of a
+// certificate signed by the CA.
+func (ca *testCA) issue(t *testing.T, cn string, serial int64) (string, string, tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshaling key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})),
+		tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSClientCertRevocation(t *testing.T) {
+	ca := createTestCA(t)
+	srvCert, srvKey, _ := ca.issue(t, "server", 10)
+	_, _, good := ca.issue(t, "good", 11)
+	_, _, crlRevoked := ca.issue(t, "crl-revoked", 12)
+	_, _, ocspRevoked := ca.issue(t, "ocsp-revoked", 13)
+
+	crl, err := ca.cert.CreateCRL(rand.Reader, ca.key, []pkix.RevokedCertificate{
+		{SerialNumber: big.NewInt(12), RevocationTime: time.Now()},
+	}, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Error creating crl: %v", err)
+	}
+	crlFile, err := ioutil.TempFile("", "crl")
+	if err != nil {
+		t.Fatalf("Error creating file: %v", err)
+	}
+	defer os.Remove(crlFile.Name())
+	crlFile.Write(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}))
+	crlFile.Close()
+
+	var requests int32
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tmpl := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		if req.SerialNumber.Int64() == 13 {
+			tmpl.Status, tmpl.RevokedAt = ocsp.Revoked, time.Now().Add(-time.Minute)
+		}
+		resp, err := ocsp.CreateResponse(ca.cert, ca.cert, tmpl, ca.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	opts := DefaultOptions()
+	opts.TLSConfig, err = GenTLSConfig(&TLSConfigOpts{
+		Cert:          srvCert,
+		Key:           srvKey,
+		Ca:            ca.pem,
+		Verify:        true,
+		CRLFiles:      []string{crlFile.Name()},
+		OCSP:          true,
+		OCSPResponder: responder.URL,
+	})
+	if err != nil {
+		t.Fatalf("Error generating tls config: %v", err)
+	}
+	opts.TLSVerify = true
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	connect := func(cert tls.Certificate) error {
+		nc, err := nats.Connect(s.ClientURL(), nats.MaxReconnects(0),
+			nats.Secure(&tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool, ServerName: "localhost"}))
+		if err == nil {
+			nc.Close()
+		}
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if err := connect(good); err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+	}
+	// Responses are cached.
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("Expected 1 ocsp request, got %d", n)
+	}
+	if err := connect(crlRevoked); err == nil {
+		t.Fatal("Expected certificate revoked by crl to be rejected")
+	}
+	if err := connect(ocspRevoked); err == nil {
+		t.Fatal("Expected certificate revoked by ocsp to be rejected")
+	}
+
+	// Without a responder the status is unknown, which is only rejected
+	// when a status is required.
+	for _, require := range []bool{false, true} {
+		config, err := GenTLSConfig(&TLSConfigOpts{Cert: srvCert, Key: srvKey, Ca: ca.pem, Verify: true, OCSP: true, OCSPRequireStatus: require})
+		if err != nil {
+			t.Fatalf("Error generating tls config: %v", err)
+		}
+		leaf, _ := x509.ParseCertificate(good.Certificate[0])
+		err = config.VerifyPeerCertificate(nil, [][]*x509.Certificate{{leaf, ca.cert}})
+		if require != (err != nil) {
+			t.Fatalf("Unexpected result with require_status %v: %v", require, err)
+		}
+	}
+
+	confFile := createConfFile(t, []byte(`
+		tls {
+			verify: true
+			crl_files: ["a.crl", "b.crl"]
+			ocsp { responder: "http://127.0.0.1:8888", timeout: "1s", cache_ttl: "5m", require_status: true }
+		}
+	`))
+	defer os.Remove(confFile)
+	m, err := conf.ParseFileWithChecks(confFile)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	tc, err := parseTLS(m["tls"])
+	if err != nil {
+		t.Fatalf("Error parsing tls: %v", err)
+	}
+	if len(tc.CRLFiles) != 2 || !tc.OCSP || tc.OCSPResponder != "http://127.0.0.1:8888" ||
+		tc.OCSPTimeout != time.Second || tc.OCSPCacheTTL != 5*time.Minute || !tc.OCSPRequireStatus {
+		t.Fatalf("Unexpected tls options: %+v", tc)
+	}
+	if _, err := GenTLSConfig(&TLSConfigOpts{OCSP: true}); err == nil || !strings.Contains(err.Error(), "require verify") {
+		t.Fatalf("Expected error without verify, got %v", err)
+	}
+}
@@ -112,6 +112,7 @@ const (
 	writeLoopStarted                         // Marks that the writeLoop has been started.
 	skipFlushOnClose                         // Marks that flushOutbound() should not be called on connection close.
 	expectConnect                            // Marks if this connection is expected to send a CONNECT
+	nonceVerified                            // Marks that the signature of the nonce has been verified
 )
 
 // set the flag (would be equivalent to set the boolean to true)
@@ -173,6 +174,11 @@ const (
 	Revocation
 	InternalClient
 	MsgHeaderViolation
+	MaintenanceMode
+	InactivityTimeout
+	AccountDrained
+	IPNotAllowed
+	TLSDowngrade
 )
 
 // Some flags passed to processMsgResultsEx
@@ -200,6 +206,10 @@ type client struct {
 	opts    clientOpts
 	start   time.Time
 	nonce   []byte
+	scram   *scramState
+	krb     *kerberosTicket
+	afail   string // Reason the authentication failed, for the auth event.
+	uconn   string // Authenticated user the connection is counted for.
 	pubKey  string
 	nc      net.Conn
 	ncs     string
@@ -222,6 +232,8 @@ type client struct {
 	last    time.Time
 	parseState
 	headers bool
+	// Capabilities negotiated with the client.
+	caps Capabilities
 
 	rtt      time.Duration
 	rttStart time.Time
@@ -232,6 +244,11 @@ type client struct {
 	gw    *gateway
 	leaf  *leaf
 	ws    *websocket
+	unix  bool
+
+	// Hash of the TLS client hello and fingerprint of the client library.
+	tlsHello    string
+	fingerprint *ClientFingerprint
 
 	// To keep track of gateway replies mapping
 	gwrm map[string]*gwReplyMap
@@ -281,6 +298,7 @@ type permissions struct {
 	sub    perm
 	pub    perm
 	resp   *ResponsePermission
+	rates  []*pubRateLimiter
 	pcache map[string]bool
 }
 
@@ -429,6 +447,7 @@ type clientOpts struct {
 	Token       string `json:"auth_token,omitempty"`
 	Username    string `json:"user,omitempty"`
 	Password    string `json:"pass,omitempty"`
+	Scram       string `json:"scram,omitempty"`
 	Name        string `json:"name"`
 	Lang        string `json:"lang"`
 	Version     string `json:"version"`
@@ -436,6 +455,10 @@ type clientOpts struct {
 	Account     string `json:"account,omitempty"`
 	AccountNew  bool   `json:"new_account,omitempty"`
 	Headers     bool   `json:"headers,omitempty"`
+	// NoResponders requests a 503 status when no one receives a request.
+	NoResponders bool `json:"no_responders,omitempty"`
+	// Capabilities supported by the client.
+	Capabilities Capabilities `json:"capabilities,omitempty"`
 
 	// Routes only
 	Import *SubjectPermission `json:"import,omitempty"`
@@ -533,6 +556,12 @@ func (c *client) reportErrRegisterAccount(acc *Account, err error) {
 	if err == ErrTooManyAccountConnections {
 		c.maxAccountConnExceeded()
 		return
+	} else if err == ErrAccountDraining {
+		c.accountDraining()
+		return
+	} else if err == ErrIPNotAllowed {
+		c.ipNotAllowed()
+		return
 	}
 	c.Errorf("Problem registering with account [%s]", acc.Name)
 	c.sendErr("Failed Account Registration")
@@ -554,6 +583,7 @@ func (c *client) registerWithAccount(acc *Account) error {
 	c.mu.Lock()
 	kind := c.kind
 	srv := c.srv
+	host, unix := c.host, c.unix
 	c.acc = acc
 	c.applyAccountLimits()
 	c.mu.Unlock()
@@ -564,6 +594,14 @@ func (c *client) registerWithAccount(acc *Account) error {
 	} else if kind == LEAF && acc.MaxTotalLeafNodesReached() {
 		return ErrTooManyAccountConnections
 	}
+	// Check if the remote IP is allowed by the account.
+	if (kind == CLIENT || kind == LEAF) && !unix && !acc.ipAllowed(host) {
+		return ErrIPNotAllowed
+	}
+	// Check if the account is being drained.
+	if (kind == CLIENT || kind == LEAF) && srv != nil && srv.isAccountDraining(acc.Name) {
+		return ErrAccountDraining
+	}
 
 	// Add in new one.
 	if prev := acc.addClient(c); prev == 0 && srv != nil {
@@ -630,17 +668,56 @@ func (c *client) RegisterUser(user *User) {
 		}
 	}
 
-	c.mu.Lock()
+	// Users without permissions of their own have the defaults of the account.
+	perms := user.Permissions
+	if perms == nil && user.Account != nil {
+		perms = user.Account.defaultPermissions()
+	}
 
+	c.mu.Lock()
 	// Assign permissions.
-	if user.Permissions == nil {
+	if perms == nil {
+		// Reset perms to nil in case client previously had them.
+		c.perms = nil
+		c.mperms = nil
+	} else {
+		c.setPermissions(perms.expandTemplates(c.permTemplateValues(user.Username)))
+	}
+	c.mu.Unlock()
+}
+
+// BindAccount allows custom auth to bind a new client to
+// an account, the global one if nil, and permissions.
+func (c *client) BindAccount(acc *Account, perms *Permissions) error {
+	if acc == nil && c.srv != nil {
+		acc = c.srv.globalAccount()
+	}
+	if acc != nil {
+		if err := c.registerWithAccount(acc); err != nil {
+			c.reportErrRegisterAccount(acc, err)
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	if perms == nil {
 		// Reset perms to nil in case client previously had them.
 		c.perms = nil
 		c.mperms = nil
 	} else {
-		c.setPermissions(user.Permissions)
+		c.setPermissions(perms)
 	}
 	c.mu.Unlock()
+	return nil
+}
+
+// LookupAccount allows custom auth to lookup the accounts
+// of the server.
+func (c *client) LookupAccount(name string) (*Account, error) {
+	if c.srv == nil {
+		return nil, ErrMissingAccount
+	}
+	return c.srv.LookupAccount(name)
 }
 
 // RegisterNkey allows auth to call back into a new nkey
@@ -655,26 +732,60 @@ func (c *client) RegisterNkeyUser(user *NkeyUser) error {
 		}
 	}
 
+	// Users without permissions of their own have the defaults of the account.
+	perms := user.Permissions
+	if perms == nil && user.Account != nil {
+		perms = user.Account.defaultPermissions()
+	}
+
 	c.mu.Lock()
 	c.user = user
 	// Assign permissions.
-	if user.Permissions == nil {
+	if perms == nil {
 		// Reset perms to nil in case client previously had them.
 		c.perms = nil
 		c.mperms = nil
 	} else {
-		c.setPermissions(user.Permissions)
+		c.setPermissions(perms.expandTemplates(c.permTemplateValues(user.Nkey)))
 	}
 	c.mu.Unlock()
 	return nil
 }
 
+// permTemplateValues returns the values of the placeholders of the
+// permission templates of the user.
+// Lock is held on entry.
+func (c *client) permTemplateValues(user string) map[string]string {
+	values := map[string]string{
+		permTemplateUser:     user,
+		permTemplateAccount:  _EMPTY_,
+		permTemplateClientID: strconv.FormatUint(c.cid, 10),
+	}
+	if c.acc != nil {
+		values[permTemplateAccount] = c.acc.Name
+	}
+	return values
+}
+
+// Prefix of the queue group of subject-queue permissions, which makes
+// explicit that the permission is scoped to queue groups, as in
+// "orders.* q:workers".
+const queuePermPrefix = "q:"
+
+// splitSubjectQueue splits a subscribe permission into its subject and the
+// queue group it is scoped to, if any.
 func splitSubjectQueue(sq string) ([]byte, []byte, error) {
 	vals := strings.Fields(strings.TrimSpace(sq))
+	if len(vals) == 0 {
+		return nil, nil, fmt.Errorf("invalid subject-queue %q", sq)
+	}
 	s := []byte(vals[0])
 	var q []byte
 	if len(vals) == 2 {
-		q = []byte(vals[1])
+		q = []byte(strings.TrimPrefix(vals[1], queuePermPrefix))
+		if len(q) == 0 {
+			return nil, nil, fmt.Errorf("invalid subject-queue %q", sq)
+		}
 	} else if len(vals) > 2 {
 		return nil, nil, fmt.Errorf("invalid subject-queue %q", sq)
 	}
@@ -689,6 +800,7 @@ func (c *client) setPermissions(perms *Permissions) {
 	}
 	c.perms = &permissions{}
 	c.perms.pcache = make(map[string]bool)
+	c.perms.rates = newPubRateLimiters(perms.PublishRateLimits)
 
 	// Loop over publish permissions
 	if perms.Publish != nil {
@@ -753,12 +865,20 @@ func (c *client) checkExpiration(claims *jwt.ClaimsData) {
 	if claims.Expires == 0 {
 		return
 	}
-	tn := time.Now().Unix()
-	if claims.Expires < tn {
+	c.checkExpiresAt(time.Unix(claims.Expires, 0))
+}
+
+// checkExpiresAt sets the auth timer to disconnect the client when its
+// credentials expire, unless the time is zero.
+func (c *client) checkExpiresAt(expires time.Time) {
+	if expires.IsZero() {
+		return
+	}
+	d := time.Until(expires)
+	if d < 0 {
 		return
 	}
-	expiresAt := time.Duration(claims.Expires - tn)
-	c.setExpirationTimer(expiresAt * time.Second)
+	c.setExpirationTimer(d)
 }
 
 // This will load up the deny structure used for filtering delivered
@@ -1441,6 +1561,7 @@ func computeRTT(start time.Time) time.Duration {
 // processConnect will process a client connect op.
 func (c *client) processConnect(arg []byte) error {
 	supportsHeaders := c.srv.supportsHeaders()
+	srvCaps := c.srv.capabilities()
 	c.mu.Lock()
 	// If we can't stop the timer because the callback is in progress...
 	if !c.clearAuthTimer() {
@@ -1475,6 +1596,13 @@ func (c *client) processConnect(arg []byte) error {
 		c.mu.Unlock()
 		return err
 	}
+	// The first CONNECT of a SCRAM exchange carries the client-first
+	// message, the client authenticates with the next one.
+	if kind == CLIENT && srv != nil && c.scram == nil && c.opts.Scram != _EMPTY_ {
+		msg := c.opts.Scram
+		c.mu.Unlock()
+		return srv.processScramClientFirst(c, msg)
+	}
 	// Indicate that the CONNECT protocol has been received, and that the
 	// server now knows which protocol this client supports.
 	c.flags.set(connectReceived)
@@ -1488,6 +1616,9 @@ func (c *client) processConnect(arg []byte) error {
 	ujwt := c.opts.JWT
 	// For headers both client and server need to support.
 	c.headers = supportsHeaders && c.opts.Headers
+	c.caps = negotiateCapabilities(srvCaps, c.opts.Capabilities)
+	// Websocket and unix socket clients do not negotiate TLS themselves.
+	tlsAdvertised := c.opts.TLSRequired || c.ws != nil || c.unix
 	c.mu.Unlock()
 
 	if srv != nil {
@@ -1502,6 +1633,22 @@ func (c *client) processConnect(arg []byte) error {
 			srv.mu.Unlock()
 		}
 
+		// Clients have to advertise TLS if downgrades are not allowed.
+		if kind == CLIENT && !tlsAdvertised && srv.getOpts().NoTLSDowngrade {
+			c.tlsDowngradeRejected(tlsDowngradeConnect)
+			return ErrTLSDowngrade
+		}
+
+		// Reject attempts of locked out remotes and users without checking
+		// their credentials.
+		if kind == CLIENT {
+			if k, locked := srv.authLockedOut(c); locked {
+				srv.sendAuthEvent(c, authFailLockedOut)
+				c.authLockoutRejected(k)
+				return ErrAuthentication
+			}
+		}
+
 		// Check for Auth
 		if ok := srv.checkAuthentication(c); !ok {
 			// We may fail here because we reached max limits on an account.
@@ -1519,6 +1666,10 @@ func (c *client) processConnect(arg []byte) error {
 			c.authViolation()
 			return ErrAuthentication
 		}
+		srv.sendAuthEvent(c, _EMPTY_)
+		if kind == CLIENT {
+			srv.resetAuthFailures(c)
+		}
 
 		// Check for Account designation, this section should be only used when there is not a jwt.
 		if account != "" {
@@ -1553,6 +1704,10 @@ func (c *client) processConnect(arg []byte) error {
 			c.registerWithAccount(srv.globalAccount())
 		}
 
+		if kind == CLIENT {
+			srv.clientConnectHook(c)
+			srv.checkClientFingerprint(c)
+		}
 	}
 
 	switch kind {
@@ -1614,7 +1769,11 @@ func (c *client) authViolation() {
 		hasUsers = s.users != nil
 		s.mu.Unlock()
 		defer s.sendAuthErrorEvent(c)
-
+		defer s.sendAuthFailureEvent(c)
+		if c.kind == CLIENT {
+			defer s.authFailureHook(c)
+			defer s.recordAuthFailure(c)
+		}
 	}
 	if hasTrustedNkeys {
 		c.Errorf("%v", ErrAuthentication)
@@ -1638,11 +1797,30 @@ func (c *client) maxAccountConnExceeded() {
 	c.closeConnection(MaxAccountConnectionsExceeded)
 }
 
+func (c *client) accountDraining() {
+	c.sendErrAndDebug(ErrAccountDraining.Error())
+	c.closeConnection(AccountDrained)
+}
+
+func (c *client) ipNotAllowed() {
+	c.sendErrAndDebug(ErrIPNotAllowed.Error())
+	c.closeConnection(IPNotAllowed)
+}
+
 func (c *client) maxConnExceeded() {
 	c.sendErrAndErr(ErrTooManyConnections.Error())
 	c.closeConnection(MaxConnectionsExceeded)
 }
 
+func (c *client) maintenanceRejected(hint string) {
+	err := ErrMaintenanceMode.Error()
+	if hint != _EMPTY_ {
+		err = fmt.Sprintf("%s: %s", err, hint)
+	}
+	c.sendErrAndDebug(err)
+	c.closeConnection(MaintenanceMode)
+}
+
 func (c *client) maxSubsExceeded() {
 	c.sendErrAndErr(ErrTooManySubs.Error())
 }
@@ -2111,6 +2289,7 @@ func (c *client) processSub(argo []byte, noForward bool) (*subscription, error)
 		// allow = ["foo"]            -> can subscribe or queue subscribe to foo using any queue
 		// allow = ["foo v1"]         -> can only queue subscribe to 'foo v1', no plain subs allowed.
 		// allow = ["foo", "foo v1"]  -> can subscribe to 'foo' but can only queue subscribe to 'foo v1'
+		// allow = ["foo q:v1"]       -> same as 'foo v1', the queue group can be prefixed with 'q:'
 		//
 		if sub.queue != nil {
 			if !c.canQueueSubscribe(string(sub.subject), string(sub.queue)) {
@@ -2132,6 +2311,16 @@ func (c *client) processSub(argo []byte, noForward bool) (*subscription, error)
 		return nil, nil
 	}
 
+	// Check the subject quota of the account, which can not be done
+	// while holding the client lock.
+	if kind == CLIENT && acc != nil && c.subs[sid] == nil {
+		c.mu.Unlock()
+		if !c.checkSubjectQuota(acc, SubjectQuotaInterest, sub.subject) {
+			return nil, nil
+		}
+		c.mu.Lock()
+	}
+
 	var updateGWs bool
 	var err error
 
@@ -2742,6 +2931,9 @@ func (c *client) deliverMsg(sub *subscription, subject, mh, msg []byte, gwrply b
 	// Monitor is reading those also under client's lock.
 	client.outMsgs++
 	client.outBytes += msgSize
+	if client.kind == LEAF && client.leaf != nil && client.leaf.usage != nil {
+		client.leaf.usage.add(subject, msgSize, false)
+	}
 
 	// Check for internal subscriptions.
 	if sub.icb != nil || client.kind == SYSTEM || client.kind == JETSTREAM || client.kind == ACCOUNT {
@@ -3047,6 +3239,28 @@ func (c *client) processInboundMsg(msg []byte) {
 	}
 }
 
+// processInternalMsg publishes a message on behalf of an internal client
+// bridging another protocol. The header, if any, ends with an empty line.
+func (c *client) processInternalMsg(subject, reply string, hdr, body []byte) {
+	c.pa.subject = []byte(subject)
+	c.pa.reply = []byte(reply)
+	c.pa.size = len(hdr) + len(body)
+	c.pa.szb = []byte(strconv.Itoa(c.pa.size))
+	if hdr != nil {
+		c.pa.hdr = len(hdr)
+		c.pa.hdb = []byte(strconv.Itoa(c.pa.hdr))
+	} else {
+		c.pa.hdr = -1
+		c.pa.hdb = nil
+	}
+	msg := make([]byte, 0, c.pa.size+LEN_CR_LF)
+	msg = append(msg, hdr...)
+	msg = append(append(msg, body...), _CRLF_...)
+	c.processInboundClientMsg(msg)
+	c.pa.szb = nil
+	c.flushClients(0)
+}
+
 // processInboundClientMsg is called to process an inbound msg from a client.
 func (c *client) processInboundClientMsg(msg []byte) bool {
 	// Update statistics
@@ -3066,12 +3280,70 @@ func (c *client) processInboundClientMsg(msg []byte) bool {
 		return false
 	}
 
+	// Drop the message if publishing too fast on its subject.
+	if c.perms != nil && len(c.perms.rates) > 0 && !c.pubRateAllowed(string(c.pa.subject), int64(c.pa.size)) {
+		return false
+	}
+
 	// Now check for reserved replies. These are used for service imports.
 	if len(c.pa.reply) > 0 && isReservedReply(c.pa.reply) {
 		c.replySubjectViolation(c.pa.reply)
 		return false
 	}
 
+	// Check the subject quota of the account.
+	if c.kind == CLIENT && c.acc != nil && !c.checkSubjectQuota(c.acc, SubjectQuotaPublish, c.pa.subject) {
+		return false
+	}
+
+	// Reject messages on subjects claimed by other publishers.
+	if c.kind == CLIENT && c.acc != nil {
+		if pc := c.acc.publisherClaims(false); pc != nil && !pc.allowed(c, string(c.pa.subject)) {
+			c.pubPermissionViolation(c.pa.subject)
+			return false
+		}
+	}
+
+	// Run the message through interceptors registered by embedding applications.
+	if c.kind == CLIENT && c.srv != nil && c.acc != nil {
+		if mis := c.srv.msgInterceptors(); len(mis) > 0 {
+			var ok bool
+			if msg, ok = c.interceptInboundMsg(mis, msg); !ok {
+				return false
+			}
+		}
+	}
+
+	// Verify the signature of messages on subjects requiring one.
+	if c.kind == CLIENT && c.acc != nil {
+		if ms := c.acc.msgSigningOpts(); ms != nil && ms.required(string(c.pa.subject)) {
+			var ok bool
+			if msg, ok = c.verifyMsgSignature(ms, msg); !ok {
+				return false
+			}
+		}
+	}
+
+	// Validate the payload of messages on subjects bound to schemas.
+	if c.kind == CLIENT && c.acc != nil {
+		if so := c.acc.schemaOpts(); so != nil {
+			var ok bool
+			if msg, ok = c.validateMsgSchemas(so, msg); !ok {
+				return false
+			}
+		}
+	}
+
+	// Validate and convert messages on subjects carrying CloudEvents.
+	if c.kind == CLIENT && c.acc != nil {
+		if ce := c.acc.cloudEventsOpts(); ce != nil && ce.applies(string(c.pa.subject)) {
+			var ok bool
+			if msg, ok = c.processCloudEvent(ce, msg); !ok {
+				return false
+			}
+		}
+	}
+
 	if c.opts.Verbose {
 		c.sendOK()
 	}
@@ -3081,6 +3353,19 @@ func (c *client) processInboundClientMsg(msg []byte) bool {
 		return false
 	}
 
+	// Fan scatter-gather requests out to the responders of their subject.
+	if c.kind == CLIENT && bytes.HasPrefix(c.pa.subject, []byte(ScatterGatherPrefix)) {
+		if sg := c.srv.getOpts().ScatterGather; sg.Enabled {
+			return c.processScatterGather(&sg, msg)
+		}
+	}
+
+	// Claim or release subjects for exclusive publishing.
+	if c.kind == CLIENT && isPublisherClaimRequest(c.pa.subject) {
+		c.processPublisherClaim(msg)
+		return true
+	}
+
 	// Check if this client's gateway replies map is not empty
 	if atomic.LoadInt32(&c.cgwrt) > 0 && c.handleGWReplyMap(msg) {
 		return true
@@ -3158,12 +3443,24 @@ func (c *client) processInboundClientMsg(msg []byte) bool {
 		}
 		didDeliver, qnames = c.processMsgResults(c.acc, r, msg, c.pa.deliver, c.pa.subject, c.pa.reply, flag)
 	}
+	localDeliver := didDeliver
 
 	// Now deal with gateways
 	if c.srv.gateway.enabled {
 		didDeliver = c.sendMsgToGateways(c.acc, msg, c.pa.subject, c.pa.reply, qnames) || didDeliver
 	}
 
+	// Tell the requester that no one received its request, or remember
+	// where it was received for the hints.
+	if c.kind == CLIENT && len(c.pa.reply) > 0 {
+		hints := c.srv.getOpts().NoRespondersHints
+		if !didDeliver && c.opts.NoResponders && c.headers {
+			c.sendNoResponders(hints)
+		} else if didDeliver && hints {
+			c.recordResponder(localDeliver)
+		}
+	}
+
 	return didDeliver
 }
 
@@ -3247,6 +3544,11 @@ func (c *client) processServiceImport(si *serviceImport, acc *Account, msg []byt
 		return
 	}
 
+	// Count the request in the service graph of the exporting account.
+	if !si.response && c.srv != nil && c.srv.getOpts().ServiceGraph.Enabled {
+		c.recordServiceRequest(acc, si)
+	}
+
 	var nrr []byte
 	var rsi *serviceImport
 
@@ -3467,6 +3769,8 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, deliver,
 
 	// Declared here because of goto.
 	var queues [][]byte
+	var okey []byte
+	var qgs map[string]*QueueGroupOpts
 
 	// For all non-client connections, we may still want to send messages to
 	// leaf nodes or routes even if there are no queue filters since we collect
@@ -3482,6 +3786,12 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, deliver,
 		c.in.prand = rand.New(rand.NewSource(time.Now().UnixNano()))
 	}
 
+	// Messages with an ordering key go to the member the key maps to.
+	if len(r.qsubs) > 0 {
+		okey = c.orderingKey(msg)
+		qgs = acc.queueGroupOpts()
+	}
+
 	// Process queue subs
 	for i := 0; i < len(r.qsubs); i++ {
 		qsubs := r.qsubs[i]
@@ -3524,7 +3834,16 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, deliver,
 		sindex := 0
 		lqs := len(qsubs)
 		if lqs > 1 {
-			sindex = c.in.prand.Int() % lqs
+			sindex = -1
+			if qg := qgs[string(qsubs[0].queue)]; qg != nil {
+				sindex = c.weightedQueueIndex(qg, qsubs, okey)
+			}
+			if sindex < 0 && okey != nil {
+				sindex = orderingKeyIndex(okey, qsubs)
+			}
+			if sindex < 0 {
+				sindex = c.in.prand.Int() % lqs
+			}
 		}
 
 		// Find a subscription that is able to deliver this message starting at a random index.
@@ -3869,6 +4188,9 @@ func (c *client) closeConnection(reason ClosedState) {
 	// Will return true if no writeLoop was started and TCP connection was
 	// closed in place, in which case we need to do the teardown.
 	teardownNow := c.markConnAsClosed(reason)
+	if c.srv != nil {
+		c.srv.removeUserConn(c)
+	}
 	c.mu.Unlock()
 
 	if teardownNow {
@@ -3945,6 +4267,9 @@ func (c *client) teardownConn() {
 	// Remove client's or leaf node or jetstream subscriptions.
 	if acc != nil && (kind == CLIENT || kind == LEAF || kind == JETSTREAM) {
 		acc.sl.RemoveBatch(subs)
+		if kind == CLIENT {
+			acc.releasePublisherClaims(c)
+		}
 	} else if kind == ROUTER {
 		go c.removeRemoteSubs()
 	}
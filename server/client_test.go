@@ -265,6 +265,47 @@ func TestClientHeaderSupport(t *testing.T) {
 	}
 }
 
+func TestClientCapabilities(t *testing.T) {
+	if names := (CapHeadersV2 | CapBinaryFrames).Names(); !reflect.DeepEqual(names, []string{"headers_v2", "binary_frames"}) {
+		t.Fatalf("Unexpected names: %v", names)
+	}
+
+	defer func(caps Capabilities) { supportedCapabilities = caps }(supportedCapabilities)
+	supportedCapabilities = CapHeadersV2 | CapBatching
+
+	opts := defaultServerOptions
+	opts.Port = -1
+	s := New(&opts)
+
+	c, _, l := newClientForServer(s)
+	defer c.close()
+
+	info := Info{}
+	if err := json.Unmarshal([]byte(l[5:]), &info); err != nil {
+		t.Fatalf("Could not parse INFO json: %v\n", err)
+	}
+	if info.Capabilities != CapHeadersV2|CapBatching {
+		t.Fatalf("Unexpected capabilities in INFO: %v", info.Capabilities)
+	}
+
+	// Only the capabilities supported by both sides are negotiated.
+	connect := fmt.Sprintf("CONNECT {\"capabilities\":%d}\r\nPING\r\n", CapBatching|CapCompression)
+	if err := c.parse([]byte(connect)); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	ci := &ConnInfo{}
+	c.mu.Lock()
+	caps := c.caps
+	ci.fill(c.client, nil, time.Now())
+	c.mu.Unlock()
+	if caps != CapBatching {
+		t.Fatalf("Unexpected negotiated capabilities: %v", caps)
+	}
+	if !reflect.DeepEqual(ci.Capabilities, []string{"batching"}) {
+		t.Fatalf("Unexpected capabilities in connection info: %v", ci.Capabilities)
+	}
+}
+
 var hmsgPat = regexp.MustCompile(`HMSG\s+([^\s]+)\s+([^\s]+)\s+(([^\s]+)[^\S\r\n]+)?(\d+)[^\S\r\n]+(\d+)\r\n`)
 
 func TestClientHeaderDeliverMsg(t *testing.T) {
@@ -769,6 +810,10 @@ func TestSplitSubjectQueue(t *testing.T) {
 			sq: "foo  bar", wantSubject: []byte("foo"), wantQueue: []byte("bar")},
 		{name: "subject, queue, and extra token",
 			sq: "foo  bar fizz", wantSubject: []byte(nil), wantQueue: []byte(nil), wantErr: true},
+		{name: "subject and prefixed queue",
+			sq: "foo q:bar", wantSubject: []byte("foo"), wantQueue: []byte("bar")},
+		{name: "subject and empty prefixed queue",
+			sq: "foo q:", wantSubject: []byte(nil), wantQueue: []byte(nil), wantErr: true},
 	}
 
 	for _, c := range cases {
@@ -900,6 +945,26 @@ func TestQueueSubscribePermissions(t *testing.T) {
 			queue:   "fizz",
 			want:    "-ERR 'Permissions Violation for Subscription to \"foo\" using queue \"fizz\"'\r\n",
 		},
+		{
+			name:    "queue subscribe with allowed prefixed group",
+			perms:   &SubjectPermission{Allow: []string{"orders.* q:workers"}},
+			subject: "orders.new",
+			queue:   "workers",
+			want:    "+OK\r\n",
+		},
+		{
+			name:    "plain subscribe with allowed prefixed group",
+			perms:   &SubjectPermission{Allow: []string{"orders.* q:workers"}},
+			subject: "orders.new",
+			want:    "-ERR 'Permissions Violation for Subscription to \"orders.new\"'\r\n",
+		},
+		{
+			name:    "queue subscribe with denied prefixed group",
+			perms:   &SubjectPermission{Allow: []string{">"}, Deny: []string{"orders.* q:audit"}},
+			subject: "orders.new",
+			queue:   "audit",
+			want:    "-ERR 'Permissions Violation for Subscription to \"orders.new\" using queue \"audit\"'\r\n",
+		},
 		{
 			name:    "allow plain sub, but do queue subscribe",
 			perms:   &SubjectPermission{Allow: []string{"foo"}},
@@ -935,6 +1000,54 @@ func TestQueueSubscribePermissions(t *testing.T) {
 	}
 }
 
+func TestPermissionTemplates(t *testing.T) {
+	perms := &Permissions{
+		Publish: &SubjectPermission{
+			Allow: []string{"private.{{user}}.>", "acc.{{account}}", "_INBOX.{{client_id}}.*"},
+		},
+		Subscribe: &SubjectPermission{
+			Allow: []string{">"},
+			Deny:  []string{"private.*.{{user}}"},
+		},
+	}
+	s, c, _ := setupClient()
+	defer c.close()
+	c.RegisterUser(&User{Username: "alice", Permissions: perms, Account: s.globalAccount()})
+
+	for _, test := range []struct {
+		subject string
+		pub     bool
+		sub     bool
+	}{
+		{"private.alice.foo", true, true},
+		{"private.bob.foo", false, true},
+		{"private.bob.alice", false, false},
+		{"acc." + globalAccountName, true, true},
+		{fmt.Sprintf("_INBOX.%d.foo", c.cid), true, true},
+		{"_INBOX.0.foo", false, true},
+	} {
+		if ok := c.pubAllowed(test.subject); ok != test.pub {
+			t.Fatalf("Expected publish on %q allowed to be %v", test.subject, test.pub)
+		}
+		if ok := c.canSubscribe(test.subject); ok != test.sub {
+			t.Fatalf("Expected subscribe on %q allowed to be %v", test.subject, test.sub)
+		}
+	}
+	// The configured permissions are left untouched.
+	if perms.Publish.Allow[0] != "private.{{user}}.>" {
+		t.Fatalf("Expected the permissions not to be modified, got %q", perms.Publish.Allow[0])
+	}
+
+	// Names that would change the subjects are not expanded.
+	c.RegisterUser(&User{Username: "*", Permissions: perms})
+	if c.pubAllowed("private.bob.foo") {
+		t.Fatal("Expected publish to be denied")
+	}
+	if c.canSubscribe("private.bob.alice") {
+		t.Fatal("Expected subscribe to be denied")
+	}
+}
+
 func TestClientPubWithQueueSubNoEcho(t *testing.T) {
 	opts := DefaultOptions()
 	s := RunServer(opts)
@@ -0,0 +1,330 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nats-io/nuid"
+)
+
+// Messages published on the CloudEvents subjects of an account are events
+// of the NATS protocol binding of CloudEvents 1.0. In binary mode, the
+// context attributes are headers prefixed with ce- and the payload is the
+// data. In structured mode, the payload is the JSON event, with the
+// application/cloudevents+json content type. Missing required attributes
+// are set by the server, and events can be converted to one mode.
+
+// Content modes of CloudEvents.
+const (
+	CloudEventsBinary     = "binary"
+	CloudEventsStructured = "structured"
+)
+
+const (
+	cloudEventsHdrPrefix   = "ce-"
+	cloudEventsContentType = "application/cloudevents+json"
+	cloudEventsSpecVersion = "1.0"
+)
+
+// CloudEventsOpts are the subjects of an account whose messages are
+// CloudEvents.
+type CloudEventsOpts struct {
+	Subjects []string
+	// Mode is the content mode events are converted to, binary or
+	// structured. Events are delivered in the mode they were published in
+	// when empty.
+	Mode string
+	// Source is the source of events published without one. Defaults to
+	// nats://<server name>/<account>.
+	Source string
+	// Reject drops non-conforming events with an error to the publisher,
+	// instead of delivering them unchanged.
+	Reject bool
+}
+
+// applies returns true if messages on the subject are CloudEvents.
+func (o *CloudEventsOpts) applies(subject string) bool {
+	for _, s := range o.Subjects {
+		if matchLiteral(subject, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// cloudEventsOpts returns the CloudEvents options of the account.
+func (a *Account) cloudEventsOpts() *CloudEventsOpts {
+	a.mu.RLock()
+	ce := a.cloudEvents
+	a.mu.RUnlock()
+	return ce
+}
+
+// cloudEvent is a decoded event.
+type cloudEvent struct {
+	// Context attributes, with string, number or boolean values.
+	attrs map[string]interface{}
+	data  []byte
+	// Header lines of the message that are not attributes.
+	other [][]byte
+}
+
+// isJSONContentType returns true for JSON media types.
+func isJSONContentType(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	return mt == "application/json" || mt == "text/json" || strings.HasSuffix(mt, "+json")
+}
+
+// isStructuredCloudEvent returns true if the content type is the one of
+// structured events.
+func isStructuredCloudEvent(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	return err == nil && mt == cloudEventsContentType
+}
+
+// decodeCloudEvent decodes the event from the message, returning the
+// content mode it was published in.
+func decodeCloudEvent(hdr, data []byte) (*cloudEvent, string, error) {
+	ev := &cloudEvent{attrs: make(map[string]interface{})}
+	var ct string
+	binary := make(map[string]interface{})
+	if len(hdr) > 0 {
+		for _, line := range bytes.Split(bytes.TrimSuffix(hdr, []byte(_CRLF_+_CRLF_)), []byte(_CRLF_))[1:] {
+			i := bytes.IndexByte(line, ':')
+			if i <= 0 {
+				continue
+			}
+			key := strings.ToLower(string(line[:i]))
+			value := string(bytes.TrimSpace(line[i+1:]))
+			switch {
+			case key == "content-type":
+				ct = value
+			case strings.HasPrefix(key, cloudEventsHdrPrefix):
+				binary[key[len(cloudEventsHdrPrefix):]] = value
+			default:
+				ev.other = append(ev.other, line)
+			}
+		}
+	}
+	if !isStructuredCloudEvent(ct) {
+		ev.attrs = binary
+		if ct != _EMPTY_ {
+			ev.attrs["datacontenttype"] = ct
+		}
+		ev.data = data
+		return ev, CloudEventsBinary, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, CloudEventsStructured, fmt.Errorf("invalid structured event: %v", err)
+	}
+	for k, raw := range fields {
+		switch k {
+		case "data", "data_base64":
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, CloudEventsStructured, err
+		}
+		switch v.(type) {
+		case nil:
+		case string, float64, bool:
+			ev.attrs[k] = v
+		default:
+			return nil, CloudEventsStructured, fmt.Errorf("invalid value of attribute %q", k)
+		}
+	}
+	raw, hasData := fields["data"]
+	b64, hasB64 := fields["data_base64"]
+	switch {
+	case hasData && hasB64:
+		return nil, CloudEventsStructured, fmt.Errorf("both data and data_base64 are set")
+	case hasB64:
+		var s string
+		if err := json.Unmarshal(b64, &s); err != nil {
+			return nil, CloudEventsStructured, fmt.Errorf("invalid data_base64: %v", err)
+		}
+		d, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, CloudEventsStructured, fmt.Errorf("invalid data_base64: %v", err)
+		}
+		ev.data = d
+	case hasData:
+		ct, _ := ev.attrs["datacontenttype"].(string)
+		var s string
+		if ct != _EMPTY_ && !isJSONContentType(ct) && json.Unmarshal(raw, &s) == nil {
+			ev.data = []byte(s)
+		} else {
+			ev.data = raw
+		}
+	}
+	return ev, CloudEventsStructured, nil
+}
+
+// validate checks the attributes of the event.
+func (ev *cloudEvent) validate() error {
+	for k, v := range ev.attrs {
+		if k == _EMPTY_ {
+			return fmt.Errorf("empty attribute name")
+		}
+		for _, r := range k {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+				return fmt.Errorf("invalid attribute name %q", k)
+			}
+		}
+		if s, ok := v.(string); ok && strings.ContainsAny(s, "\r\n") {
+			return fmt.Errorf("invalid value of attribute %q", k)
+		}
+	}
+	if v := ev.attrs["specversion"]; v != cloudEventsSpecVersion {
+		return fmt.Errorf("unsupported specversion %v", v)
+	}
+	for _, k := range []string{"id", "source", "type"} {
+		if s, ok := ev.attrs[k].(string); !ok || s == _EMPTY_ {
+			return fmt.Errorf("invalid attribute %q", k)
+		}
+	}
+	if v, ok := ev.attrs["time"]; ok {
+		s, _ := v.(string)
+		if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+			return fmt.Errorf("invalid attribute %q", "time")
+		}
+	}
+	return nil
+}
+
+// attrString returns the value of the attribute as a string.
+func attrString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return _EMPTY_
+}
+
+// encode returns the header and payload of the event in the content mode.
+func (ev *cloudEvent) encode(mode string) ([]byte, []byte, error) {
+	hdr := []byte("NATS/1.0" + _CRLF_)
+	for _, line := range ev.other {
+		hdr = append(append(hdr, line...), _CRLF_...)
+	}
+	ct, _ := ev.attrs["datacontenttype"].(string)
+
+	if mode == CloudEventsBinary {
+		keys := make([]string, 0, len(ev.attrs))
+		for k := range ev.attrs {
+			if k != "datacontenttype" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			hdr = append(hdr, fmt.Sprintf("%s%s: %s%s", cloudEventsHdrPrefix, k, attrString(ev.attrs[k]), _CRLF_)...)
+		}
+		if ct != _EMPTY_ {
+			hdr = append(hdr, fmt.Sprintf("Content-Type: %s%s", ct, _CRLF_)...)
+		}
+		return append(hdr, _CRLF_...), ev.data, nil
+	}
+
+	fields := make(map[string]interface{}, len(ev.attrs)+1)
+	for k, v := range ev.attrs {
+		fields[k] = v
+	}
+	switch {
+	case len(ev.data) == 0:
+	case (ct == _EMPTY_ || isJSONContentType(ct)) && json.Valid(ev.data):
+		fields["data"] = json.RawMessage(ev.data)
+	case ct != _EMPTY_ && utf8.Valid(ev.data):
+		fields["data"] = string(ev.data)
+	default:
+		fields["data_base64"] = base64.StdEncoding.EncodeToString(ev.data)
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	hdr = append(hdr, fmt.Sprintf("Content-Type: %s%s", cloudEventsContentType, _CRLF_)...)
+	return append(hdr, _CRLF_...), data, nil
+}
+
+// processCloudEvent validates the inbound event, sets its missing required
+// attributes and converts it to the content mode of the options. It returns
+// the message and false if it has to be dropped.
+func (c *client) processCloudEvent(ce *CloudEventsOpts, msg []byte) ([]byte, bool) {
+	var hdr, data []byte
+	if c.pa.hdr > 0 {
+		hdr, data = msg[:c.pa.hdr], msg[c.pa.hdr:len(msg)-LEN_CR_LF]
+	} else {
+		data = msg[:len(msg)-LEN_CR_LF]
+	}
+	ev, mode, err := decodeCloudEvent(hdr, data)
+	if err == nil {
+		setAttr := func(k, v string) {
+			if _, ok := ev.attrs[k]; !ok {
+				ev.attrs[k] = v
+			}
+		}
+		source := ce.Source
+		if source == _EMPTY_ {
+			source = fmt.Sprintf("nats://%s/%s", c.srv.Name(), c.acc.GetName())
+		}
+		setAttr("specversion", cloudEventsSpecVersion)
+		setAttr("id", nuid.Next())
+		setAttr("source", source)
+		setAttr("type", string(c.pa.subject))
+		setAttr("time", time.Now().UTC().Format(time.RFC3339Nano))
+		err = ev.validate()
+	}
+	if err != nil {
+		if !ce.Reject {
+			c.Debugf("Non-conforming CloudEvent on %q delivered unchanged: %v", c.pa.subject, err)
+			return msg, true
+		}
+		c.sendErrAndDebug(fmt.Sprintf("Permissions Violation for Publish to %q, Message Rejected: %v: %v",
+			c.pa.subject, ErrCloudEvent, err))
+		return nil, false
+	}
+	if ce.Mode != _EMPTY_ {
+		mode = ce.Mode
+	}
+	nhdr, ndata, err := ev.encode(mode)
+	if err == nil {
+		var nmsg []byte
+		if nmsg, err = c.setInboundMsgHeader(nhdr, ndata); err == nil {
+			return nmsg, true
+		}
+	}
+	c.sendErrAndDebug(fmt.Sprintf("Permissions Violation for Publish to %q, Message Rejected: %v", c.pa.subject, err))
+	return nil, false
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestCloudEventsConversion(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		server_name: "srv"
+		accounts {
+			S: {
+				users: [{user: s, password: pwd}]
+				cloudevents: { subjects: ["events.>"], mode: structured }
+			}
+			B: {
+				users: [{user: b, password: pwd}]
+				cloudevents: { subjects: ["events.>"], mode: binary, source: "/orders", reject: true }
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	// Binary to structured, with required attributes from NATS.
+	ncS := natsConnect(t, s.ClientURL(), nats.UserInfo("s", "pwd"))
+	defer ncS.Close()
+	subS := natsSubSync(t, ncS, ">")
+	natsFlush(t, ncS)
+	m := nats.NewMsg("events.created")
+	m.Header.Set("ce-id", "1")
+	m.Header.Set("ce-orderid", "42")
+	m.Header.Set("Content-Type", "application/json")
+	m.Header.Set("Other", "kept")
+	m.Data = []byte(`{"total":10}`)
+	if err := ncS.PublishMsg(m); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	rm := natsNexMsg(t, subS, time.Second)
+	if ct := rm.Header.Get("Content-Type"); ct != cloudEventsContentType || rm.Header.Get("Other") != "kept" ||
+		rm.Header.Get("ce-id") != _EMPTY_ {
+		t.Fatalf("Unexpected headers: %v", rm.Header)
+	}
+	var ev map[string]interface{}
+	if err := json.Unmarshal(rm.Data, &ev); err != nil {
+		t.Fatalf("Error decoding event %q: %v", rm.Data, err)
+	}
+	if ev["id"] != "1" || ev["orderid"] != "42" || ev["specversion"] != "1.0" || ev["type"] != "events.created" ||
+		ev["source"] != "nats://srv/S" || ev["datacontenttype"] != "application/json" || ev["time"] == nil {
+		t.Fatalf("Unexpected event: %v", ev)
+	}
+	if data, _ := ev["data"].(map[string]interface{}); data["total"] != float64(10) {
+		t.Fatalf("Unexpected data: %v", ev["data"])
+	}
+	// Other subjects are not events.
+	natsPub(t, ncS, "other", []byte("x"))
+	if rm := natsNexMsg(t, subS, time.Second); rm.Header != nil || string(rm.Data) != "x" {
+		t.Fatalf("Unexpected message %v %q", rm.Header, rm.Data)
+	}
+	// Non-conforming events are delivered unchanged.
+	m = nats.NewMsg("events.bad")
+	m.Header.Set("ce-specversion", "0.3")
+	m.Data = []byte("x")
+	ncS.PublishMsg(m)
+	if rm := natsNexMsg(t, subS, time.Second); rm.Header.Get("ce-specversion") != "0.3" || string(rm.Data) != "x" {
+		t.Fatalf("Unexpected message %v %q", rm.Header, rm.Data)
+	}
+
+	// Structured to binary, with non-conforming events rejected.
+	errCh := make(chan error, 10)
+	ncB := natsConnect(t, s.ClientURL(), nats.UserInfo("b", "pwd"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errCh <- err }))
+	defer ncB.Close()
+	subB := natsSubSync(t, ncB, ">")
+	natsFlush(t, ncB)
+	m = nats.NewMsg("events.created")
+	m.Header.Set("Content-Type", cloudEventsContentType+"; charset=utf-8")
+	m.Data = []byte(`{"specversion":"1.0","id":"7","type":"order.created","datacontenttype":"text/plain","data":"hello"}`)
+	ncB.PublishMsg(m)
+	rm = natsNexMsg(t, subB, time.Second)
+	if rm.Header.Get("ce-id") != "7" || rm.Header.Get("ce-type") != "order.created" || rm.Header.Get("ce-source") != "/orders" ||
+		rm.Header.Get("Content-Type") != "text/plain" || string(rm.Data) != "hello" {
+		t.Fatalf("Unexpected message %v %q", rm.Header, rm.Data)
+	}
+	for _, data := range []string{`not json`, `{"specversion":"1.0","Bad":"x"}`, `{"time":"yesterday"}`} {
+		m = nats.NewMsg("events.created")
+		m.Header.Set("Content-Type", cloudEventsContentType)
+		m.Data = []byte(data)
+		ncB.PublishMsg(m)
+		select {
+		case err := <-errCh:
+			if !strings.Contains(err.Error(), ErrCloudEvent.Error()) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected event %q to be rejected", data)
+		}
+	}
+	if rm, err := subB.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Unexpected message %v or error %v", rm, err)
+	}
+}
+
+func TestCloudEventsEncoding(t *testing.T) {
+	ev, mode, err := decodeCloudEvent(nil, []byte{0xff, 0x00})
+	if err != nil || mode != CloudEventsBinary {
+		t.Fatalf("Unexpected result %v %q", err, mode)
+	}
+	ev.attrs["specversion"], ev.attrs["id"], ev.attrs["source"], ev.attrs["type"] = "1.0", "1", "/s", "t"
+	if err := ev.validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, data, err := ev.encode(CloudEventsStructured)
+	if err != nil || !strings.Contains(string(data), `"data_base64":"/wA="`) {
+		t.Fatalf("Unexpected structured event %q: %v", data, err)
+	}
+	hdr, _, _ := ev.encode(CloudEventsBinary)
+	if string(hdr) != "NATS/1.0\r\nce-id: 1\r\nce-source: /s\r\nce-specversion: 1.0\r\nce-type: t\r\n\r\n" {
+		t.Fatalf("Unexpected header %q", hdr)
+	}
+	if ev, _, err = decodeCloudEvent(nil, data); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ev, _, err = decodeCloudEvent([]byte("NATS/1.0\r\nContent-Type: application/cloudevents+json\r\n\r\n"), data)
+	if err != nil || string(ev.data) != "\xff\x00" {
+		t.Fatalf("Unexpected data %q: %v", ev.data, err)
+	}
+
+	conf := createConfFile(t, []byte(`accounts { A: { cloudevents: { subjects: ["a.>"], mode: batch } } }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "batch") {
+		t.Fatalf("Expected error on mode, got %v", err)
+	}
+}
@@ -1036,6 +1036,21 @@ func TestConfigCheck(t *testing.T) {
 			errorLine: 5,
 			errorPos:  9,
 		},
+		{
+			name: "when user authorization permissions subject-queue is invalid",
+			config: `
+		authorization {
+		  permissions {
+		    subscribe = {
+		      allow = ["orders.* q:workers q:audit"]
+		    }
+		  }
+		}
+		`,
+			err:       errors.New(`invalid subject-queue "orders.* q:workers q:audit"`),
+			errorLine: 5,
+			errorPos:  9,
+		},
 		{
 			name: "when cluster config listen is invalid",
 			config: `
@@ -115,6 +115,13 @@ const (
 	// DEFAULT_ROUTE_DIAL Route dial timeout.
 	DEFAULT_ROUTE_DIAL = 1 * time.Second
 
+	// DEFAULT_UNIX_SOCKET_MODE is the mode of the unix socket file, only
+	// accessible to the user running the server.
+	DEFAULT_UNIX_SOCKET_MODE = 0600
+
+	// DEFAULT_DNS_TIMEOUT is the timeout of queries to configured dns servers.
+	DEFAULT_DNS_TIMEOUT = 2 * time.Second
+
 	// DEFAULT_LEAF_NODE_RECONNECT LeafNode reconnect interval.
 	DEFAULT_LEAF_NODE_RECONNECT = time.Second
 
@@ -142,6 +149,9 @@ const (
 	// DEFAULT_MAX_CLOSED_CLIENTS is the maximum number of closed connections we hold onto.
 	DEFAULT_MAX_CLOSED_CLIENTS = 10000
 
+	// DEFAULT_CONFIG_SNAPSHOTS is the number of configurations kept for rollback.
+	DEFAULT_CONFIG_SNAPSHOTS = 5
+
 	// DEFAULT_LAME_DUCK_DURATION is the time in which the server spreads
 	// the closing of clients when signaled to go in lame duck mode.
 	DEFAULT_LAME_DUCK_DURATION = 2 * time.Minute
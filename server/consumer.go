@@ -190,6 +190,16 @@ type Consumer struct {
 	ackEventT         string
 	deliveryExcEventT string
 	created           time.Time
+	// Visibility groups of the stream and timeouts of pending messages
+	// in one of them.
+	vgroups []*VisibilityGroup
+	vis     map[uint64]int64
+	// Revision of the last change.
+	rev uint64
+	// Traces deliveries of sampled messages, if configured, with the spans
+	// of the unacknowledged ones.
+	tracer *tracer
+	traces map[uint64]*otlpSpan
 }
 
 const (
@@ -358,6 +368,9 @@ func (mset *Stream) AddConsumer(config *ConsumerConfig) (*Consumer, error) {
 		sfreq:   int32(sampleFreq),
 		maxdc:   uint64(config.MaxDeliver),
 		created: time.Now().UTC(),
+		vgroups: mset.config.Visibility,
+		rev:     mset.jsa.nextRevision(),
+		tracer:  mset.tracer,
 	}
 	if isDurableConsumer(config) {
 		if len(config.Durable) > JSMaxNameLen {
@@ -479,6 +492,7 @@ func (mset *Stream) AddConsumer(config *ConsumerConfig) (*Consumer, error) {
 	go o.updateStateLoop()
 
 	o.sendCreateAdvisory()
+	s.consumerCreatedHook(a, mset.Name(), o.Config())
 
 	return o, nil
 }
@@ -638,6 +652,7 @@ func (o *Consumer) updateDeliverSubject(newDeliver string) {
 	oldDeliver := o.config.DeliverSubject
 	o.dsubj = newDeliver
 	o.config.DeliverSubject = newDeliver
+	o.rev = mset.jsa.nextRevision()
 	// FIXME(dlc) - check partitions, we may need offset.
 	o.dseq = o.adflr
 	o.sseq = o.asflr
@@ -700,6 +715,7 @@ func (o *Consumer) processNak(sseq, dseq uint64) {
 			return
 		}
 	}
+	o.endDelivery(sseq, traceNak)
 	// If already queued up also ignore.
 	if !o.onRedeliverQueue(sseq) {
 		o.rdq = append(o.rdq, sseq)
@@ -713,6 +729,10 @@ func (o *Consumer) processNak(sseq, dseq uint64) {
 
 // Process a TERM
 func (o *Consumer) processTerm(sseq, dseq, dcount uint64) {
+	o.mu.Lock()
+	o.endDelivery(sseq, traceTerm)
+	o.mu.Unlock()
+
 	// Treat like an ack to suppress redelivery.
 	o.processAckMsg(sseq, dseq, dcount, false)
 
@@ -751,7 +771,7 @@ func (o *Consumer) ackWait(next time.Duration) time.Duration {
 	if next != 0 {
 		return next + ackWaitDelay
 	}
-	return o.config.AckWait + ackWaitDelay
+	return o.minPendingTTL() + ackWaitDelay
 }
 
 // This will restore the state from disk.
@@ -919,6 +939,7 @@ func (o *Consumer) processAckMsg(sseq, dseq, dcount uint64, doSample bool) {
 				o.sampleAck(sseq, dseq, dcount)
 			}
 			delete(o.pending, sseq)
+			o.endDelivery(sseq, traceAck)
 		}
 		// Consumers sequence numbers can skip during redlivery since
 		// they always increment. So if we do not have any pending treat
@@ -941,6 +962,7 @@ func (o *Consumer) processAckMsg(sseq, dseq, dcount uint64, doSample bool) {
 			delete(o.pending, seq)
 			delete(o.rdc, seq)
 			o.removeFromRedeliverQueue(seq)
+			o.endDelivery(seq, traceAck)
 		}
 	case AckNone:
 		// FIXME(dlc) - This is error but do we care?
@@ -1283,6 +1305,9 @@ func (o *Consumer) deliverMsg(dsubj, subj string, hdr, msg []byte, seq, dcount u
 		return
 	}
 
+	if o.tracer != nil {
+		hdr = o.traceDelivery(hdr, seq, dcount)
+	}
 	pmsg := &jsPubMsg{dsubj, subj, o.ackReply(seq, o.dseq, dcount, ts), hdr, msg, o, seq}
 	sendq := o.mset.sendq
 
@@ -1291,17 +1316,84 @@ func (o *Consumer) deliverMsg(dsubj, subj string, hdr, msg []byte, seq, dcount u
 	sendq <- pmsg
 	o.mu.Lock()
 
+	o.didDeliver(subj, seq)
+}
+
+// Updates our state after a message has been delivered.
+// Lock should be held.
+func (o *Consumer) didDeliver(subj string, seq uint64) {
 	ap := o.config.AckPolicy
 	if ap == AckNone {
 		o.adflr = o.dseq
 		o.asflr = seq
 	} else if ap == AckExplicit || ap == AckAll {
+		o.trackVisibility(seq, subj)
 		o.trackPending(seq)
 	}
 	o.dseq++
 	o.updateStore()
 }
 
+// ConsumerMsg is a message fetched directly from a pull based consumer.
+type ConsumerMsg struct {
+	StoredMsg
+	// DeliverySeq is the consumer sequence of this delivery.
+	DeliverySeq uint64
+	// Deliveries is the number of times this message has been delivered.
+	Deliveries uint64
+}
+
+// Fetch returns up to batch messages from a pull based consumer directly,
+// without going through a client connection. Messages are tracked as if
+// they had been delivered and need to be acknowledged with AckMsg, unless
+// the consumer has an ack policy of none. This returns an empty list if no
+// message is currently available.
+func (o *Consumer) Fetch(batch int) ([]*ConsumerMsg, error) {
+	if batch <= 0 {
+		batch = 1
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.mset == nil {
+		return nil, ErrStoreClosed
+	}
+	if o.isPushMode() {
+		return nil, fmt.Errorf("consumer is not pull based")
+	}
+	var msgs []*ConsumerMsg
+	for len(msgs) < batch && !o.replay {
+		subj, hdr, msg, seq, dc, ts, err := o.getNextMsg()
+		if err != nil {
+			if err == ErrStoreMsgNotFound || err == ErrStoreEOF {
+				break
+			}
+			return msgs, err
+		}
+		if o.tracer != nil {
+			hdr = o.traceDelivery(hdr, seq, dc)
+		}
+		msgs = append(msgs, &ConsumerMsg{
+			StoredMsg:   StoredMsg{Subject: subj, Sequence: seq, Header: hdr, Data: msg, Time: time.Unix(0, ts)},
+			DeliverySeq: o.dseq,
+			Deliveries:  dc,
+		})
+		o.didDeliver(subj, seq)
+	}
+	return msgs, nil
+}
+
+// AckMsg acknowledges a message obtained with Fetch.
+func (o *Consumer) AckMsg(m *ConsumerMsg) {
+	o.ackMsg(m.Sequence, m.DeliverySeq, m.Deliveries)
+}
+
+// NakMsg signals that a message obtained with Fetch was not processed
+// and should be redelivered.
+func (o *Consumer) NakMsg(m *ConsumerMsg) {
+	o.processNak(m.Sequence, m.DeliverySeq)
+}
+
 // Tracks our outstanding pending acks. Only applicable to AckExplicit mode.
 // Lock should be held.
 func (o *Consumer) trackPending(seq uint64) {
@@ -1376,7 +1468,6 @@ func (o *Consumer) checkPending() {
 		o.mu.Unlock()
 		return
 	}
-	ttl := int64(o.config.AckWait)
 	next := int64(o.ackWait(0))
 	now := time.Now().UnixNano()
 	shouldSignal := false
@@ -1387,12 +1478,19 @@ func (o *Consumer) checkPending() {
 	var expired []uint64
 	for seq, ts := range o.pending {
 		elapsed := now - ts
+		ttl := o.pendingTTL(seq)
 		if elapsed > ttl && !o.onRedeliverQueue(seq) {
 			expired = append(expired, seq)
 			shouldSignal = true
-		} else if elapsed-ttl < next {
+		} else if ttl-elapsed > 0 && ttl-elapsed < next {
 			// Update when we should fire next.
-			next = elapsed - ttl
+			next = ttl - elapsed
+		}
+	}
+	// Forget the timeouts of messages not pending anymore.
+	for seq := range o.vis {
+		if _, ok := o.pending[seq]; !ok {
+			delete(o.vis, seq)
 		}
 	}
 
@@ -1574,6 +1672,7 @@ func (o *Consumer) purge(sseq uint64) {
 	o.sseq = sseq
 	o.asflr = sseq - 1
 	o.adflr = o.dseq - 1
+	o.vis = nil
 	if len(o.pending) > 0 {
 		o.pending = nil
 		if o.ptmr != nil {
@@ -1596,6 +1695,15 @@ func (o *Consumer) purge(sseq uint64) {
 	o.mu.Unlock()
 }
 
+// setAckFloor moves the consumer past the stream sequence, as if all the
+// messages up to it were delivered and acknowledged, and stores its state.
+func (o *Consumer) setAckFloor(sseq uint64) {
+	o.purge(sseq + 1)
+	o.mu.Lock()
+	o.updateStore()
+	o.mu.Unlock()
+}
+
 func stopAndClearTimer(tp **time.Timer) {
 	if *tp == nil {
 		return
@@ -1644,6 +1752,7 @@ func (o *Consumer) stop(dflag, doSignal, advisory bool) error {
 	o.reqSub = nil
 	stopAndClearTimer(&o.ptmr)
 	stopAndClearTimer(&o.dtmr)
+	o.traces = nil
 	delivery := o.config.DeliverSubject
 	o.mu.Unlock()
 
@@ -1662,8 +1771,13 @@ func (o *Consumer) stop(dflag, doSignal, advisory bool) error {
 	mset.unsubscribe(ackSub)
 	mset.unsubscribe(reqSub)
 	delete(mset.consumers, o.name)
+	jsa, sname := mset.jsa, mset.config.Name
 	mset.mu.Unlock()
 
+	if dflag {
+		jsa.assetDeleted(sname, o.name)
+	}
+
 	// Make sure we stamp our update state
 	if !dflag {
 		o.writeState()
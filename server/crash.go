@@ -0,0 +1,200 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of recent notices, warnings and errors kept for crash reports.
+	crashReportEvents = 64
+	// Crash reports are named crash-<time>-<pid>.json, and renamed with
+	// the sent suffix once sent to the system account.
+	crashReportPrefix     = "crash-"
+	crashReportSuffix     = ".json"
+	crashReportSentSuffix = ".sent"
+)
+
+// CrashReport is written to the crash report directory when the server panics.
+type CrashReport struct {
+	ID            string    `json:"server_id"`
+	Name          string    `json:"server_name"`
+	Version       string    `json:"version"`
+	GoVersion     string    `json:"go"`
+	Start         time.Time `json:"start"`
+	Time          time.Time `json:"time"`
+	ConfigFile    string    `json:"config_file,omitempty"`
+	OptionsDigest string    `json:"options_digest,omitempty"`
+	Panic         string    `json:"panic"`
+	Stack         string    `json:"stack"`
+	Events        []string  `json:"events,omitempty"`
+	Goroutines    string    `json:"goroutines"`
+}
+
+// CrashReportEventMsg is sent on startup for each crash report found.
+type CrashReportEventMsg struct {
+	TypedEvent
+	Server ServerInfo  `json:"server"`
+	Report CrashReport `json:"report"`
+}
+
+// CrashReportEventMsgType is the schema type for CrashReportEventMsg
+const CrashReportEventMsgType = "io.nats.server.advisory.v1.crash_report"
+
+// Ring of the recent log events included in crash reports.
+type crashEvents struct {
+	sync.Mutex
+	events []string
+	total  int
+}
+
+// recordCrashEvent keeps the log statement for crash reports, if enabled.
+func (s *Server) recordCrashEvent(level, format string, v ...interface{}) {
+	if opts := s.getOpts(); opts == nil || opts.CrashReportDir == _EMPTY_ {
+		return
+	}
+	ev := fmt.Sprintf("%s [%s] %s", time.Now().UTC().Format(time.RFC3339Nano), level, fmt.Sprintf(format, v...))
+	ce := &s.crashEvents
+	ce.Lock()
+	if ce.events == nil {
+		ce.events = make([]string, crashReportEvents)
+	}
+	ce.events[ce.total%crashReportEvents] = ev
+	ce.total++
+	ce.Unlock()
+}
+
+// recentCrashEvents returns the recent log events, oldest first.
+func (s *Server) recentCrashEvents() []string {
+	ce := &s.crashEvents
+	ce.Lock()
+	defer ce.Unlock()
+	if ce.total <= crashReportEvents {
+		return append([]string(nil), ce.events[:ce.total]...)
+	}
+	head := ce.total % crashReportEvents
+	return append(append([]string(nil), ce.events[head:]...), ce.events[:head]...)
+}
+
+// capturePanic writes a crash report if a panic is in progress, and lets
+// it continue. Needs to be deferred.
+func (s *Server) capturePanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if dir := s.getOpts().CrashReportDir; dir != _EMPTY_ {
+		if fn, err := s.writeCrashReport(dir, r, debug.Stack()); err != nil {
+			s.Errorf("Error writing crash report: %v", err)
+		} else {
+			s.Errorf("Crash report written to %q", fn)
+		}
+	}
+	panic(r)
+}
+
+func (s *Server) writeCrashReport(dir string, r interface{}, stack []byte) (string, error) {
+	// The server lock is not acquired since the panicking go routine may
+	// hold it, the fields used here do not change once the server started.
+	opts := s.getOpts()
+	cr := &CrashReport{
+		ID:         s.info.ID,
+		Name:       s.info.Name,
+		Version:    VERSION,
+		GoVersion:  runtime.Version(),
+		Start:      s.start,
+		Time:       time.Now().UTC(),
+		ConfigFile: opts.ConfigFile,
+		Panic:      fmt.Sprintf("%v", r),
+		Stack:      string(stack),
+	}
+	cr.OptionsDigest = optionsDigest(opts)
+	cr.Events = s.recentCrashEvents()
+
+	buf := make([]byte, 1024*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			cr.Goroutines = string(buf[:n])
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	b, err := json.MarshalIndent(cr, "", "  ")
+	if err != nil {
+		return _EMPTY_, err
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return _EMPTY_, err
+	}
+	fn := filepath.Join(dir, fmt.Sprintf("%s%s-%d%s", crashReportPrefix, cr.Time.Format("20060102T150405.000000000"), os.Getpid(), crashReportSuffix))
+	return fn, ioutil.WriteFile(fn, b, 0640)
+}
+
+// sendCrashReports sends the crash reports not sent yet to the system
+// account, and marks them as sent.
+func (s *Server) sendCrashReports() {
+	opts := s.getOpts()
+	if opts.CrashReportDir == _EMPTY_ || !opts.SendCrashReports || !s.EventsEnabled() {
+		return
+	}
+	files, err := ioutil.ReadDir(opts.CrashReportDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.Errorf("Error reading crash reports: %v", err)
+		}
+		return
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, crashReportPrefix) || !strings.HasSuffix(name, crashReportSuffix) {
+			continue
+		}
+		fn := filepath.Join(opts.CrashReportDir, name)
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			s.Errorf("Error reading crash report %q: %v", fn, err)
+			continue
+		}
+		var m CrashReportEventMsg
+		if err := json.Unmarshal(b, &m.Report); err != nil {
+			s.Errorf("Error parsing crash report %q: %v", fn, err)
+			continue
+		}
+		s.mu.Lock()
+		m.TypedEvent = TypedEvent{
+			Type: CrashReportEventMsgType,
+			ID:   s.nextEventID(),
+			Time: time.Now().UTC(),
+		}
+		s.sendInternalMsg(fmt.Sprintf(crashReportEventSubj, s.info.ID), _EMPTY_, &m.Server, &m)
+		s.mu.Unlock()
+		if err := os.Rename(fn, fn+crashReportSentSuffix); err != nil {
+			s.Errorf("Error marking crash report %q as sent: %v", fn, err)
+			continue
+		}
+		s.Noticef("Sent crash report %q", fn)
+	}
+}
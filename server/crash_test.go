@@ -0,0 +1,108 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestCrashReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crash")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.CrashReportDir = dir
+	s := RunServer(opts)
+	s.SetLogger(&DummyLogger{}, false, false)
+	s.Noticef("Something happened")
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("Expected panic to continue, got %v", r)
+			}
+		}()
+		defer s.capturePanic()
+		panic("boom")
+	}()
+	s.Shutdown()
+
+	files, _ := filepath.Glob(filepath.Join(dir, crashReportPrefix+"*"+crashReportSuffix))
+	if len(files) != 1 {
+		t.Fatalf("Expected a crash report, got %v", files)
+	}
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Error reading report: %v", err)
+	}
+	var cr CrashReport
+	if err := json.Unmarshal(b, &cr); err != nil {
+		t.Fatalf("Error unmarshalling report: %v", err)
+	}
+	if cr.ID != s.ID() || cr.Version != VERSION || cr.Panic != "boom" || cr.OptionsDigest == _EMPTY_ {
+		t.Fatalf("Unexpected report: %+v", cr)
+	}
+	if !strings.Contains(cr.Stack, "TestCrashReport") || !strings.Contains(cr.Goroutines, "goroutine") {
+		t.Fatalf("Expected stacks in report, got %q and %q", cr.Stack, cr.Goroutines)
+	}
+	if len(cr.Events) == 0 || !strings.Contains(cr.Events[len(cr.Events)-1], "[INF] Something happened") {
+		t.Fatalf("Expected recent events in report, got %v", cr.Events)
+	}
+
+	// The report is sent on restart and marked as sent.
+	opts.SendCrashReports = true
+	sys := NewAccount("SYS")
+	opts.Accounts = []*Account{sys}
+	opts.SystemAccount = "SYS"
+	opts.Users = []*User{{Username: "sys", Password: "pwd", Account: sys}}
+	s = RunServer(opts)
+	defer s.Shutdown()
+	if _, err := os.Stat(files[0] + crashReportSentSuffix); err != nil {
+		t.Fatalf("Expected report to be marked as sent: %v", err)
+	}
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, fmt.Sprintf(crashReportEventSubj, s.ID()))
+	natsFlush(t, nc)
+
+	if _, err := s.writeCrashReport(dir, "bang", nil); err != nil {
+		t.Fatalf("Error writing report: %v", err)
+	}
+	s.sendCrashReports()
+	var ev CrashReportEventMsg
+	if err := json.Unmarshal(natsNexMsg(t, sub, time.Second).Data, &ev); err != nil {
+		t.Fatalf("Error unmarshalling event: %v", err)
+	}
+	if ev.Type != CrashReportEventMsgType || ev.Report.Panic != "bang" {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+	// Sent reports are not sent again.
+	s.sendCrashReports()
+	if _, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected no event, got %v", err)
+	}
+}
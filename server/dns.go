@@ -0,0 +1,292 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNSResolverOpts are options for resolving the host names of routes,
+// gateways and remote leafnodes.
+type DNSResolverOpts struct {
+	// Servers to query instead of the ones of the system, as host:port.
+	Servers []string `json:"servers,omitempty"`
+	// Hosts are pinned to the given IPs and never looked up.
+	Hosts map[string][]string `json:"hosts,omitempty"`
+	// DNSSEC requires the answers to be validated by the servers, which
+	// need to be trusted validating resolvers, reached over a secure path.
+	DNSSEC bool `json:"dnssec,omitempty"`
+	// Timeout of each query.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// configured returns true if outbound host names are not simply resolved
+// by the system.
+func (o *DNSResolverOpts) configured() bool {
+	return len(o.Servers) > 0 || len(o.Hosts) > 0
+}
+
+// validateDNSResolverOptions checks the servers and pinned IPs.
+func validateDNSResolverOptions(o *Options) error {
+	ro := &o.DNSResolver
+	for _, srv := range ro.Servers {
+		if _, _, err := net.SplitHostPort(srv); err != nil {
+			return fmt.Errorf("invalid dns resolver server %q: %v", srv, err)
+		}
+	}
+	for host, ips := range ro.Hosts {
+		if len(ips) == 0 {
+			return fmt.Errorf("no IP pinned for dns resolver host %q", host)
+		}
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("invalid IP %q pinned for dns resolver host %q", ip, host)
+			}
+		}
+	}
+	if ro.DNSSEC && len(ro.Servers) == 0 {
+		return errors.New("dns resolver requires servers for dnssec")
+	}
+	return nil
+}
+
+// dnsResolver resolves host names with the current dns resolver options,
+// so that they take effect on reload.
+type dnsResolver struct {
+	s *Server
+}
+
+var (
+	errDNSNotFound      = errors.New("no such host")
+	errDNSNotValidated  = errors.New("answer not validated with dnssec")
+	errDNSBadResponse   = errors.New("malformed response")
+	errDNSQueryMismatch = errors.New("response does not match query")
+)
+
+// LookupHost implements netResolver.
+func (r *dnsResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	ro := &r.s.getOpts().DNSResolver
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if ips, ok := ro.Hosts[name]; ok {
+		return append([]string(nil), ips...), nil
+	}
+	if len(ro.Servers) == 0 {
+		return net.DefaultResolver.LookupHost(ctx, host)
+	}
+	timeout := ro.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_DNS_TIMEOUT
+	}
+	var err error
+	for _, srv := range ro.Servers {
+		var ips, ips6 []string
+		ips, err = dnsQuery(srv, name, dnsTypeA, ro.DNSSEC, timeout)
+		if err != nil && err != errDNSNotFound {
+			continue
+		}
+		ips6, err = dnsQuery(srv, name, dnsTypeAAAA, ro.DNSSEC, timeout)
+		if err != nil && err != errDNSNotFound {
+			continue
+		}
+		if ips = append(ips, ips6...); len(ips) > 0 {
+			return ips, nil
+		}
+		err = errDNSNotFound
+	}
+	return nil, err
+}
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeOPT  = 41
+	dnsClassIN  = 1
+
+	dnsFlagResponse  = 1 << 15
+	dnsFlagTruncated = 1 << 9
+	dnsFlagRecursion = 1 << 8
+	dnsFlagAuthData  = 1 << 5
+	dnsRcodeMask     = 0xf
+	dnsRcodeNXDomain = 3
+
+	dnsHeaderLen   = 12
+	dnsMaxUDPSize  = 4096
+	dnsEDNSFlagDO  = 1 << 15
+	dnsMaxLabelLen = 63
+)
+
+// dnsQuery sends a query for the IPs of name to the server, over UDP, or
+// TCP if the answer was truncated. With dnssec, the answer is rejected
+// unless the server flagged it as authenticated.
+func dnsQuery(server, name string, qtype uint16, dnssec bool, timeout time.Duration) ([]string, error) {
+	id := uint16(rand.Uint32())
+	q, err := dnsPackQuery(id, name, qtype, dnssec)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dnsExchange("udp", server, q, timeout)
+	if err == nil && len(resp) >= dnsHeaderLen && binary.BigEndian.Uint16(resp[2:])&dnsFlagTruncated != 0 {
+		resp, err = dnsExchange("tcp", server, q, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dnsParseResponse(resp, id, qtype, dnssec)
+}
+
+// dnsExchange sends the query and reads the response.
+func dnsExchange(network, server string, q []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout(network, server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if network == "udp" {
+		if _, err := conn.Write(q); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dnsMaxUDPSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	// Messages over TCP are prefixed with their length.
+	msg := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(msg, uint16(len(q)))
+	copy(msg[2:], q)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// dnsPackQuery builds a recursive query. With dnssec, the query asks for
+// the authenticated data flag and carries an EDNS record with the DO bit.
+func dnsPackQuery(id uint16, name string, qtype uint16, dnssec bool) ([]byte, error) {
+	q := make([]byte, dnsHeaderLen, dnsHeaderLen+len(name)+2+4+11)
+	flags := uint16(dnsFlagRecursion)
+	if dnssec {
+		flags |= dnsFlagAuthData
+		binary.BigEndian.PutUint16(q[10:], 1) // ARCOUNT
+	}
+	binary.BigEndian.PutUint16(q, id)
+	binary.BigEndian.PutUint16(q[2:], flags)
+	binary.BigEndian.PutUint16(q[4:], 1) // QDCOUNT
+
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > dnsMaxLabelLen {
+			return nil, fmt.Errorf("invalid host name %q", name)
+		}
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	if dnssec {
+		// Root name, type OPT, class is the UDP payload size, the TTL holds
+		// the extended flags, and no data.
+		q = append(q, 0, 0, dnsTypeOPT, byte(dnsMaxUDPSize>>8), byte(dnsMaxUDPSize&0xff),
+			0, 0, byte(dnsEDNSFlagDO>>8), 0, 0, 0)
+	}
+	return q, nil
+}
+
+// dnsParseResponse returns the IPs in the answers of the response.
+func dnsParseResponse(resp []byte, id, qtype uint16, dnssec bool) ([]string, error) {
+	if len(resp) < dnsHeaderLen {
+		return nil, errDNSBadResponse
+	}
+	flags := binary.BigEndian.Uint16(resp[2:])
+	if binary.BigEndian.Uint16(resp) != id || flags&dnsFlagResponse == 0 {
+		return nil, errDNSQueryMismatch
+	}
+	switch rcode := flags & dnsRcodeMask; rcode {
+	case 0:
+	case dnsRcodeNXDomain:
+		return nil, errDNSNotFound
+	default:
+		return nil, fmt.Errorf("server failure, rcode %d", rcode)
+	}
+	if dnssec && flags&dnsFlagAuthData == 0 {
+		return nil, errDNSNotValidated
+	}
+	qdcount := int(binary.BigEndian.Uint16(resp[4:]))
+	ancount := int(binary.BigEndian.Uint16(resp[6:]))
+
+	off := dnsHeaderLen
+	var ok bool
+	for i := 0; i < qdcount; i++ {
+		if off, ok = dnsSkipName(resp, off); !ok || off+4 > len(resp) {
+			return nil, errDNSBadResponse
+		}
+		off += 4
+	}
+	var ips []string
+	for i := 0; i < ancount; i++ {
+		if off, ok = dnsSkipName(resp, off); !ok || off+10 > len(resp) {
+			return nil, errDNSBadResponse
+		}
+		rtype := binary.BigEndian.Uint16(resp[off:])
+		rdlen := int(binary.BigEndian.Uint16(resp[off+8:]))
+		off += 10
+		if off+rdlen > len(resp) {
+			return nil, errDNSBadResponse
+		}
+		// Answers may include the CNAME records leading to the addresses.
+		if rtype == qtype && (rdlen == net.IPv4len || rdlen == net.IPv6len) {
+			ips = append(ips, net.IP(resp[off:off+rdlen]).String())
+		}
+		off += rdlen
+	}
+	if len(ips) == 0 {
+		return nil, errDNSNotFound
+	}
+	return ips, nil
+}
+
+// dnsSkipName returns the offset after the possibly compressed name at off.
+func dnsSkipName(msg []byte, off int) (int, bool) {
+	for off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, true
+		case l&0xc0 == 0xc0:
+			// Pointer to a previous name ends it.
+			return off + 2, off+2 <= len(msg)
+		default:
+			off += 1 + l
+		}
+	}
+	return off, false
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runTestDNSServer answers A queries with 127.0.0.1, setting the
+// authenticated data flag if ad is not 0.
+func runTestDNSServer(t *testing.T, ad *int32) (string, func()) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := buf[:n]
+			qend, _ := dnsSkipName(q, dnsHeaderLen)
+			qtype := binary.BigEndian.Uint16(q[qend:])
+			resp := append([]byte(nil), q[:qend+4]...)
+			flags := uint16(dnsFlagResponse | dnsFlagRecursion)
+			if atomic.LoadInt32(ad) != 0 {
+				flags |= dnsFlagAuthData
+			}
+			binary.BigEndian.PutUint16(resp[2:], flags)
+			binary.BigEndian.PutUint16(resp[10:], 0)
+			if qtype == dnsTypeA {
+				binary.BigEndian.PutUint16(resp[6:], 1)
+				resp = append(resp, 0xc0, dnsHeaderLen, 0, dnsTypeA, 0, dnsClassIN, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func TestDNSResolver(t *testing.T) {
+	var ad int32
+	addr, stop := runTestDNSServer(t, &ad)
+	defer stop()
+
+	o := DefaultOptions()
+	o.DNSResolver.Servers = []string{addr}
+	o.DNSResolver.Hosts = map[string][]string{"pinned.example.com": {"10.0.0.1", "10.0.0.2"}}
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	lookup := func(host string) ([]string, error) {
+		return s.dnsResolver.LookupHost(context.Background(), host)
+	}
+	if ips, err := lookup("pinned.example.com."); err != nil || !reflect.DeepEqual(ips, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Fatalf("Unexpected pinned IPs: %v, %v", ips, err)
+	}
+	if ips, err := lookup("nats.example.com"); err != nil || !reflect.DeepEqual(ips, []string{"127.0.0.1"}) {
+		t.Fatalf("Unexpected IPs: %v, %v", ips, err)
+	}
+
+	// Answers not validated are rejected with dnssec.
+	o = o.Clone()
+	o.DNSResolver.DNSSEC = true
+	o.DNSResolver.Timeout = 250 * time.Millisecond
+	if err := s.ReloadOptions(o); err != nil {
+		t.Fatalf("Error reloading: %v", err)
+	}
+	if _, err := lookup("nats.example.com"); err != errDNSNotValidated {
+		t.Fatalf("Expected %v, got %v", errDNSNotValidated, err)
+	}
+	atomic.StoreInt32(&ad, 1)
+	if ips, err := lookup("nats.example.com"); err != nil || !reflect.DeepEqual(ips, []string{"127.0.0.1"}) {
+		t.Fatalf("Unexpected IPs: %v, %v", ips, err)
+	}
+}
+
+func TestDNSResolverPinnedRoute(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		cluster {
+			listen: "127.0.0.1:-1"
+		}
+	`))
+	defer os.Remove(conf)
+	s1, _ := RunServerWithConfig(conf)
+	defer s1.Shutdown()
+
+	conf2 := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		cluster {
+			listen: "127.0.0.1:-1"
+			routes: ["nats://route.nats.invalid:%d"]
+		}
+		dns_resolver {
+			hosts: { "route.nats.invalid": "127.0.0.1" }
+		}
+	`, s1.ClusterAddr().Port)))
+	defer os.Remove(conf2)
+	s2, opts2 := RunServerWithConfig(conf2)
+	defer s2.Shutdown()
+	if ips := opts2.DNSResolver.Hosts["route.nats.invalid"]; len(ips) != 1 || ips[0] != "127.0.0.1" {
+		t.Fatalf("Unexpected pinned hosts: %v", opts2.DNSResolver.Hosts)
+	}
+
+	checkClusterFormed(t, s1, s2)
+}
+
+func TestDNSResolverValidation(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts DNSResolverOpts
+	}{
+		{"bad server", DNSResolverOpts{Servers: []string{"1.1.1.1"}}},
+		{"bad pinned ip", DNSResolverOpts{Hosts: map[string][]string{"a.example.com": {"not an ip"}}}},
+		{"dnssec without servers", DNSResolverOpts{DNSSEC: true}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			o := DefaultOptions()
+			o.DNSResolver = test.opts
+			if err := validateOptions(o); err == nil {
+				t.Fatal("Expected error")
+			}
+		})
+	}
+}
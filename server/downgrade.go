@@ -0,0 +1,78 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Reasons of the TLS downgrade events.
+const (
+	// The client did not start a TLS handshake although allow_non_tls is set.
+	tlsDowngradePlaintext = "plaintext_connection"
+	// The client did not set tls_required in its CONNECT.
+	tlsDowngradeConnect = "connect_without_tls"
+)
+
+// validateTLSDowngradeOptions checks that downgrade protection is only
+// enabled along with TLS. The websocket listener always requires TLS, and
+// local clients on the unix socket are not subject to it.
+func validateTLSDowngradeOptions(o *Options) error {
+	if o.NoTLSDowngrade && o.TLSConfig == nil {
+		return errors.New("no_tls_downgrade requires TLS configuration")
+	}
+	return nil
+}
+
+// tlsDowngradeRejected sends the TLS downgrade event and closes the client.
+func (c *client) tlsDowngradeRejected(reason string) {
+	c.Warnf("Rejecting TLS downgrade: %s", reason)
+	if c.srv != nil {
+		c.srv.sendTLSDowngradeEvent(c, reason)
+	}
+	c.sendErrAndDebug(ErrTLSDowngrade.Error())
+	c.closeConnection(TLSDowngrade)
+}
+
+// sendTLSDowngradeEvent sends a security event for a client connection
+// rejected because it did not use TLS.
+func (s *Server) sendTLSDowngradeEvent(c *client, reason string) {
+	c.mu.Lock()
+	m := TLSDowngradeEventMsg{
+		TypedEvent: TypedEvent{
+			Type: TLSDowngradeEventMsgType,
+		},
+		Client: ClientInfo{
+			Start:   c.start,
+			Host:    c.host,
+			ID:      c.cid,
+			Name:    c.opts.Name,
+			Lang:    c.opts.Lang,
+			Version: c.opts.Version,
+		},
+		Reason: reason,
+	}
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	m.ID = s.nextEventID()
+	m.Time = time.Now().UTC()
+	s.sendInternalMsg(fmt.Sprintf(tlsDowngradeEventSubj, s.info.ID), _EMPTY_, &m.Server, &m)
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestNoTLSDowngradeRequiresTLS(t *testing.T) {
+	opts := DefaultOptions()
+	opts.NoTLSDowngrade = true
+	if err := validateOptions(opts); err == nil || !strings.Contains(err.Error(), "requires TLS") {
+		t.Fatalf("Expected error about TLS, got %v", err)
+	}
+}
+
+func TestNoTLSDowngrade(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		tls {
+			cert_file: "../test/configs/certs/server-cert.pem"
+			key_file: "../test/configs/certs/server-key.pem"
+		}
+		allow_non_tls: true
+		no_tls_downgrade: true
+		accounts {
+			SYS: { users: [{user: sys, password: pwd}] }
+		}
+		system_account: SYS
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	tc := &tls.Config{InsecureSkipVerify: true}
+	sys := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"), nats.Secure(tc))
+	defer sys.Close()
+	sub := natsSubSync(t, sys, fmt.Sprintf(tlsDowngradeEventSubj, s.ID()))
+	natsFlush(t, sys)
+
+	checkRejected := func(secure bool, connect, reason string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatalf("Error on dial: %v", err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		cr := bufio.NewReader(conn)
+		if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "INFO ") {
+			t.Fatalf("Expected INFO, got %q", l)
+		}
+		if secure {
+			tlsConn := tls.Client(conn, tc)
+			if err := tlsConn.Handshake(); err != nil {
+				t.Fatalf("Error on handshake: %v", err)
+			}
+			conn, cr = tlsConn, bufio.NewReader(tlsConn)
+		}
+		fmt.Fprint(conn, connect)
+		if l, _ := cr.ReadString('\n'); !strings.Contains(l, ErrTLSDowngrade.Error()) {
+			t.Fatalf("Expected %q error, got %q", ErrTLSDowngrade, l)
+		}
+		var ev TLSDowngradeEventMsg
+		if err := json.Unmarshal(natsNexMsg(t, sub, time.Second).Data, &ev); err != nil {
+			t.Fatalf("Error unmarshalling event: %v", err)
+		}
+		if ev.Type != TLSDowngradeEventMsgType || ev.Reason != reason {
+			t.Fatalf("Unexpected event: %+v", ev)
+		}
+	}
+
+	// Plaintext is rejected although allowed by the TLS options.
+	checkRejected(false, "CONNECT {\"verbose\":false}\r\nPING\r\n", tlsDowngradePlaintext)
+	// TLS not advertised in the CONNECT is rejected.
+	checkRejected(true, "CONNECT {\"verbose\":false,\"tls_required\":false}\r\nPING\r\n", tlsDowngradeConnect)
+
+	if conns := s.closedClients(); conns[len(conns)-1].Reason != TLSDowngrade.String() {
+		t.Fatalf("Unexpected reason: %q", conns[len(conns)-1].Reason)
+	}
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"), nats.Secure(tc))
+	nc.Close()
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// An account is drained cluster-wide with a request to
+// $SYS.REQ.ACCOUNT.<account>.DRAIN, which all servers answer. A draining
+// account's new client and leafnode connections are rejected, existing
+// ones are closed and the state of its JetStream consumers is flushed,
+// without affecting other accounts.
+
+// AccountDrainOptions are the options for account drain requests.
+type AccountDrainOptions struct {
+	// Duration over which existing connections are closed. They are all
+	// closed at once if not set.
+	Duration time.Duration `json:"duration,omitempty"`
+	// Resume accepting connections for the account, ending the drain.
+	Resume bool `json:"resume,omitempty"`
+}
+
+// AccountDrainStatus reports what was drained on a server.
+type AccountDrainStatus struct {
+	Account     string `json:"account"`
+	Draining    bool   `json:"draining"`
+	Connections int    `json:"connections"`
+	Consumers   int    `json:"consumers"`
+}
+
+// isAccountDraining returns true if connections to the account are rejected.
+func (s *Server) isAccountDraining(name string) bool {
+	s.mu.Lock()
+	_, ok := s.drainingAccounts[name]
+	s.mu.Unlock()
+	return ok
+}
+
+// DrainAccount stops accepting new connections for the account on this
+// server, closes existing ones and flushes its JetStream consumers state.
+func (s *Server) DrainAccount(name string, opts *AccountDrainOptions) (*AccountDrainStatus, error) {
+	if name == _EMPTY_ {
+		return nil, ErrMissingAccount
+	}
+	if opts == nil {
+		opts = &AccountDrainOptions{}
+	}
+	st := &AccountDrainStatus{Account: name, Draining: !opts.Resume}
+
+	s.mu.Lock()
+	if name == s.gacc.Name || (s.sys != nil && s.sys.account != nil && name == s.sys.account.Name) {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("account %q can not be drained", name)
+	}
+	if opts.Resume {
+		if _, ok := s.drainingAccounts[name]; ok {
+			delete(s.drainingAccounts, name)
+			s.Noticef("Accepting connections for account %q again", name)
+		}
+		s.mu.Unlock()
+		return st, nil
+	}
+	if s.drainingAccounts == nil {
+		s.drainingAccounts = make(map[string]struct{})
+	}
+	s.drainingAccounts[name] = struct{}{}
+	s.mu.Unlock()
+
+	// Only drain what is local, we do not want to fetch the account.
+	v, ok := s.accounts.Load(name)
+	if !ok {
+		return st, nil
+	}
+	acc := v.(*Account)
+	s.Noticef("Draining account %q", name)
+
+	for _, mset := range acc.Streams() {
+		for _, o := range mset.Consumers() {
+			o.writeState()
+			st.Consumers++
+		}
+	}
+
+	acc.mu.RLock()
+	clients := make([]*client, 0, len(acc.clients))
+	for c := range acc.clients {
+		if c.kind == CLIENT || c.kind == LEAF {
+			clients = append(clients, c)
+		}
+	}
+	acc.mu.RUnlock()
+	st.Connections = len(clients)
+	if len(clients) == 0 {
+		return st, nil
+	}
+
+	if opts.Duration <= 0 {
+		for _, c := range clients {
+			c.closeConnection(AccountDrained)
+		}
+		return st, nil
+	}
+	si := opts.Duration / time.Duration(len(clients))
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		t := time.NewTimer(si)
+		defer t.Stop()
+		for _, c := range clients {
+			c.closeConnection(AccountDrained)
+			select {
+			case <-t.C:
+				t.Reset(si)
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+	return st, nil
+}
+
+// accountDrainRequest handles account drain requests for the account in
+// the subject.
+func (s *Server) accountDrainRequest(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	// Subject is $SYS.REQ.ACCOUNT.<account>.DRAIN
+	tokens := strings.Split(subject, tsep)
+	if len(tokens) != accReqTokens {
+		return
+	}
+	optz := &AccountDrainOptions{}
+	s.zReq(reply, msg, optz, func() (interface{}, error) { return s.DrainAccount(tokens[accReqAccIndex], optz) })
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestDrainAccount(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A: { users: [{user: a, password: pwd}] }
+			B: { users: [{user: b, password: pwd}] }
+			SYS: { users: [{user: sys, password: pwd}] }
+		}
+		system_account: SYS
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	closed := make(chan struct{}, 1)
+	a := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"), nats.NoReconnect(),
+		nats.ClosedHandler(func(_ *nats.Conn) { closed <- struct{}{} }))
+	defer a.Close()
+	b := natsConnect(t, s.ClientURL(), nats.UserInfo("b", "pwd"))
+	defer b.Close()
+	sys := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer sys.Close()
+
+	drain := func(opts *AccountDrainOptions) *AccountDrainStatus {
+		t.Helper()
+		req, _ := json.Marshal(opts)
+		msg, err := sys.Request(fmt.Sprintf(accDrainReqSubj, "A"), req, time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		var resp struct {
+			Data  *AccountDrainStatus    `json:"data"`
+			Error map[string]interface{} `json:"error"`
+		}
+		if err := json.Unmarshal(msg.Data, &resp); err != nil {
+			t.Fatalf("Error unmarshalling response: %v", err)
+		}
+		if resp.Error != nil || resp.Data == nil {
+			t.Fatalf("Unexpected error: %+v", resp.Error)
+		}
+		return resp.Data
+	}
+
+	if st := drain(nil); !st.Draining || st.Account != "A" || st.Connections != 1 {
+		t.Fatalf("Unexpected status: %+v", st)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection of drained account should have been closed")
+	}
+	if _, err := nats.Connect(s.ClientURL(), nats.UserInfo("a", "pwd")); err == nil {
+		t.Fatal("Connection to drained account should have been rejected")
+	}
+	if conns := s.closedClients(); conns[len(conns)-1].Reason != AccountDrained.String() {
+		t.Fatalf("Unexpected reason: %q", conns[len(conns)-1].Reason)
+	}
+	// Other accounts are not affected.
+	if !b.IsConnected() {
+		t.Fatal("Connection of other account should not have been closed")
+	}
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("b", "pwd"))
+	nc.Close()
+
+	if st := drain(&AccountDrainOptions{Resume: true}); st.Draining {
+		t.Fatalf("Unexpected status: %+v", st)
+	}
+	nc = natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"))
+	nc.Close()
+
+	if _, err := s.DrainAccount("SYS", nil); err == nil {
+		t.Fatal("Expected error draining the system account")
+	}
+}
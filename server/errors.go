@@ -54,6 +54,41 @@ var (
 	// connections.
 	ErrTooManyAccountConnections = errors.New("maximum account active connections exceeded")
 
+	// ErrAccountDraining signals that an account does not accept new connections
+	// because it is being drained.
+	ErrAccountDraining = errors.New("account is draining")
+
+	// ErrIPNotAllowed signals that the remote IP of a connection is not
+	// allowed by the account.
+	ErrIPNotAllowed = errors.New("ip not allowed")
+
+	// ErrMsgSignature signals that a message on a subject requiring a
+	// signature was not signed by its publisher.
+	ErrMsgSignature = errors.New("invalid message signature")
+
+	// ErrCloudEvent signals that a message on a CloudEvents subject of an
+	// account rejecting non-conforming events was not a valid event.
+	ErrCloudEvent = errors.New("invalid cloud event")
+
+	// ErrSchemaViolation signals that the payload of a message on a subject
+	// bound to a schema of the account does not conform to it.
+	ErrSchemaViolation = errors.New("schema violation")
+
+	// ErrMissingSchema signals that a schema is not registered in the account.
+	ErrMissingSchema = errors.New("schema not found")
+
+	// ErrOperatorAccountNotAllowed signals that the policy of the operator
+	// of an account does not allow it.
+	ErrOperatorAccountNotAllowed = errors.New("account not allowed by operator policy")
+
+	// ErrOperatorTooManyAccounts signals that the operator of an account has
+	// reached the maximum number of accounts of its policy.
+	ErrOperatorTooManyAccounts = errors.New("maximum operator accounts exceeded")
+
+	// ErrTLSDowngrade signals that a client connection was rejected because
+	// it did not use, or did not advertise, TLS while the server requires it.
+	ErrTLSDowngrade = errors.New("tls downgrade rejected")
+
 	// ErrTooManySubs signals a client that the maximum number of subscriptions per connection
 	// has been reached.
 	ErrTooManySubs = errors.New("maximum subscriptions exceeded")
@@ -83,6 +118,22 @@ var (
 	// ErrMissingAccount is returned when an account does not exist.
 	ErrMissingAccount = errors.New("account missing")
 
+	// ErrAccountInUse is returned when removing an account that users are still bound to.
+	ErrAccountInUse = errors.New("account in use")
+
+	// ErrBadUser represents a malformed or incomplete user.
+	ErrBadUser = errors.New("bad user")
+
+	// ErrUserExists is returned when adding a user that already exists.
+	ErrUserExists = errors.New("user exists")
+
+	// ErrMissingUser is returned when a user can not be found.
+	ErrMissingUser = errors.New("user missing")
+
+	// ErrOperatorModeNotSupported is returned for operations that can not be
+	// performed when the server is configured with trusted operators.
+	ErrOperatorModeNotSupported = errors.New("not supported in operator mode")
+
 	// ErrMissingService is returned when an account does not have an exported service.
 	ErrMissingService = errors.New("service missing")
 
@@ -144,6 +195,24 @@ var (
 	// ErrMsgHeadersNotSupported signals the parser detected a message header
 	// but they are not supported on this server.
 	ErrMsgHeadersNotSupported = errors.New("message headers not supported")
+
+	// ErrBadSubject represents an error condition for an invalid subject.
+	ErrBadSubject = errors.New("invalid subject")
+
+	// ErrInterceptorNoName is returned when registering a message interceptor without a name.
+	ErrInterceptorNoName = errors.New("message interceptor requires a name")
+
+	// ErrInterceptorNoHandler is returned when registering a message interceptor without a handler.
+	ErrInterceptorNoHandler = errors.New("message interceptor requires a handler")
+
+	// ErrInterceptorExists is returned when a message interceptor with the same name is already registered.
+	ErrInterceptorExists = errors.New("message interceptor already registered")
+
+	// ErrInterceptorNotFound is returned when removing a message interceptor that is not registered.
+	ErrInterceptorNotFound = errors.New("message interceptor not found")
+
+	// ErrMaintenanceMode is returned to new connections on a listener in maintenance mode.
+	ErrMaintenanceMode = errors.New("server in maintenance mode, try again later")
 )
 
 // configErr is a configuration error.
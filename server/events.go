@@ -33,17 +33,34 @@ import (
 const (
 	connectEventSubj         = "$SYS.ACCOUNT.%s.CONNECT"
 	disconnectEventSubj      = "$SYS.ACCOUNT.%s.DISCONNECT"
+	inactiveEventSubj        = "$SYS.ACCOUNT.%s.CLIENT.INACTIVE"
+	clientAnomalyEventSubj   = "$SYS.ACCOUNT.%s.CLIENT.ANOMALY"
+	subjectQuotaEventSubj    = "$SYS.ACCOUNT.%s.SUBJECT.QUOTA"
 	accConnsReqSubj          = "$SYS.REQ.ACCOUNT.%s.CONNS"
+	accDrainReqSubj          = "$SYS.REQ.ACCOUNT.%s.DRAIN"
+	accSchemasReqSubj        = "$SYS.REQ.ACCOUNT.%s.SCHEMAS"
 	accUpdateEventSubj       = "$SYS.ACCOUNT.%s.CLAIMS.UPDATE"
 	connsRespSubj            = "$SYS._INBOX_.%s"
 	accConnsEventSubj        = "$SYS.SERVER.ACCOUNT.%s.CONNS"
 	shutdownEventSubj        = "$SYS.SERVER.%s.SHUTDOWN"
 	authErrorEventSubj       = "$SYS.SERVER.%s.CLIENT.AUTH.ERR"
+	authVerifyEventSubj      = "$SYS.SERVER.%s.CLIENT.AUTH.VERIFY"
+	tlsDowngradeEventSubj    = "$SYS.SERVER.%s.CLIENT.TLS.DOWNGRADE"
+	authLockoutEventSubj     = "$SYS.SERVER.%s.CLIENT.AUTH.LOCKOUT"
+	authEventSubj            = "$SYS.SERVER.%s.AUTH"
+	authWeakHashEventSubj    = "$SYS.SERVER.%s.CLIENT.AUTH.WEAK_HASH"
 	serverStatsSubj          = "$SYS.SERVER.%s.STATSZ"
 	serverStatsReqSubj       = "$SYS.REQ.SERVER.%s.STATSZ"
 	serverStatsPingReqSubj   = "$SYS.REQ.SERVER.PING"
 	leafNodeConnectEventSubj = "$SYS.ACCOUNT.%s.LEAFNODE.CONNECT"
 	remoteLatencyEventSubj   = "$SYS.LATENCY.M2.%s"
+	jsRecoveryEventSubj      = "$SYS.SERVER.%s.JETSTREAM.RECOVERY"
+	jsUsageEventSubj         = "$SYS.ACCOUNT.%s.JETSTREAM.USAGE"
+	lameDuckEventSubj        = "$SYS.SERVER.%s.LAMEDUCK"
+	upgradeEventSubj         = "$SYS.SERVER.%s.UPGRADE"
+	tlsExpiryEventSubj       = "$SYS.SERVER.%s.TLS.EXPIRY"
+	crashReportEventSubj     = "$SYS.SERVER.%s.CRASH"
+	leafNodeUsageEventSubj   = "$SYS.SERVER.%s.LEAFNODE.USAGE"
 	inboxRespSubj            = "$SYS._INBOX.%s.%s"
 
 	// FIXME(dlc) - Should account scope, even with wc for now, but later on
@@ -57,6 +74,8 @@ const (
 	serverSubjectIndex  = 2
 	accUpdateTokens     = 5
 	accUpdateAccIndex   = 2
+	accReqTokens        = 5
+	accReqAccIndex      = 3
 )
 
 // FIXME(dlc) - make configurable.
@@ -112,6 +131,116 @@ type DisconnectEventMsg struct {
 // DisconnectEventMsgType is the schema type for DisconnectEventMsg
 const DisconnectEventMsgType = "io.nats.server.advisory.v1.client_disconnect"
 
+// AuthVerifyEventMsg is sent when the signature of the nonce challenge
+// could not be verified, for instance when replayed.
+type AuthVerifyEventMsg struct {
+	TypedEvent
+	Server ServerInfo `json:"server"`
+	Client ClientInfo `json:"client"`
+	Kind   string     `json:"kind"`
+	Nkey   string     `json:"nkey,omitempty"`
+	Reason string     `json:"reason"`
+}
+
+// AuthVerifyEventMsgType is the schema type for AuthVerifyEventMsg
+const AuthVerifyEventMsgType = "io.nats.server.advisory.v1.auth_verify"
+
+// TLSDowngradeEventMsg is sent when a client connection is rejected because
+// it attempted to use plaintext while the server requires TLS.
+type TLSDowngradeEventMsg struct {
+	TypedEvent
+	Server ServerInfo `json:"server"`
+	Client ClientInfo `json:"client"`
+	Reason string     `json:"reason"`
+}
+
+// TLSDowngradeEventMsgType is the schema type for TLSDowngradeEventMsg
+const TLSDowngradeEventMsgType = "io.nats.server.advisory.v1.tls_downgrade"
+
+// AuthEventMsg is sent for every authentication of a client or leafnode
+// connection, with the reason of failures.
+type AuthEventMsg struct {
+	TypedEvent
+	Server  ServerInfo `json:"server"`
+	Client  ClientInfo `json:"client"`
+	Kind    string     `json:"kind"`
+	Success bool       `json:"success"`
+	Reason  string     `json:"reason,omitempty"`
+}
+
+// AuthEventMsgType is the schema type for AuthEventMsg
+const AuthEventMsgType = "io.nats.server.advisory.v1.auth"
+
+// AuthWeakHashEventMsg is sent when a client logs in with a password hashed
+// with a bcrypt cost lower than the minimum.
+type AuthWeakHashEventMsg struct {
+	TypedEvent
+	Server   ServerInfo `json:"server"`
+	Client   ClientInfo `json:"client"`
+	Cost     int        `json:"cost"`
+	MinCost  int        `json:"min_cost"`
+	Rehashed bool       `json:"rehashed"`
+}
+
+// AuthWeakHashEventMsgType is the schema type for AuthWeakHashEventMsg
+const AuthWeakHashEventMsgType = "io.nats.server.advisory.v1.auth_weak_hash"
+
+// AuthLockoutEventMsg is sent when a remote IP or username is locked out
+// after too many failed authentication attempts.
+type AuthLockoutEventMsg struct {
+	TypedEvent
+	Server   ServerInfo `json:"server"`
+	Client   ClientInfo `json:"client"`
+	Kind     string     `json:"kind"`
+	Value    string     `json:"value"`
+	Failures int        `json:"failures"`
+	Until    time.Time  `json:"until"`
+}
+
+// AuthLockoutEventMsgType is the schema type for AuthLockoutEventMsg
+const AuthLockoutEventMsgType = "io.nats.server.advisory.v1.auth_lockout"
+
+// ClientAnomalyEventMsg is sent when the credentials of a user are used by
+// a different client library or from a new network, which may indicate that
+// they were stolen.
+type ClientAnomalyEventMsg struct {
+	TypedEvent
+	Server      ServerInfo         `json:"server"`
+	Client      ClientInfo         `json:"client"`
+	Fingerprint *ClientFingerprint `json:"fingerprint"`
+	Previous    *ClientFingerprint `json:"previous,omitempty"`
+	Reason      string             `json:"reason"`
+}
+
+// ClientAnomalyEventMsgType is the schema type for ClientAnomalyEventMsg
+const ClientAnomalyEventMsgType = "io.nats.server.advisory.v1.client_anomaly"
+
+// JetStreamRecoveryEventMsg is sent while JetStream state is recovered from
+// storage, and once recovery is done.
+type JetStreamRecoveryEventMsg struct {
+	TypedEvent
+	Server   ServerInfo              `json:"server"`
+	Recovery JetStreamRecoveryStatus `json:"recovery"`
+}
+
+// JetStreamRecoveryEventMsgType is the schema type for JetStreamRecoveryEventMsg
+const JetStreamRecoveryEventMsgType = "io.nats.server.advisory.v1.jetstream_recovery"
+
+// LameDuckEventMsg is sent while the server is in lame duck mode to report
+// the progress of evicting its clients.
+type LameDuckEventMsg struct {
+	TypedEvent
+	Server  ServerInfo `json:"server"`
+	Clients int        `json:"clients"`
+	Evicted int        `json:"evicted"`
+}
+
+// LameDuckEventMsgType is the schema type for LameDuckEventMsg
+const LameDuckEventMsgType = "io.nats.server.advisory.v1.lame_duck"
+
+// How often at most we send lame duck progress events.
+var ldmEventInterval = time.Second
+
 // AccountNumConns is an event that will be sent from a server that is tracking
 // a given account when the number of connections changes. It will also HB
 // updates in the absence of any changes.
@@ -574,6 +703,16 @@ func (s *Server) initEventTracking() {
 	if _, err := s.sysSubscribe(subject, s.connsRequest); err != nil {
 		s.Errorf("Error setting up internal tracking: %v", err)
 	}
+	// Listen for requests to drain an account.
+	subject = fmt.Sprintf(accDrainReqSubj, "*")
+	if _, err := s.sysSubscribe(subject, s.accountDrainRequest); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to manage the schemas of an account.
+	subject = fmt.Sprintf(accSchemasReqSubj, "*")
+	if _, err := s.sysSubscribe(subject, s.accountSchemasRequest); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
 	// Listen for broad requests to respond with number of subscriptions for a given subject.
 	if _, err := s.sysSubscribe(accNumSubsReqSubj, s.nsubsRequest); err != nil {
 		s.Errorf("Error setting up internal tracking: %v", err)
@@ -583,6 +722,11 @@ func (s *Server) initEventTracking() {
 	if _, err := s.sysSubscribe(subject, s.remoteServerShutdown); err != nil {
 		s.Errorf("Error setting up internal tracking: %v", err)
 	}
+	// Listen for upgrade mode status of other servers.
+	subject = fmt.Sprintf(upgradeEventSubj, "*")
+	if _, err := s.sysSubscribe(subject, s.remoteUpgradeStatus); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
 	// Listen for account claims updates.
 	subject = fmt.Sprintf(accUpdateEventSubj, "*")
 	if _, err := s.sysSubscribe(subject, s.accountClaimUpdate); err != nil {
@@ -623,6 +767,22 @@ func (s *Server) initEventTracking() {
 			optz := &LeafzOptions{}
 			s.zReq(reply, msg, optz, func() (interface{}, error) { return s.Leafz(optz) })
 		},
+		"UPGRADE": func(sub *subscription, _ *client, subject, reply string, msg []byte) {
+			optz := &UpgradeOptions{}
+			s.zReq(reply, msg, optz, func() (interface{}, error) { return s.EnterUpgradeMode(optz) })
+		},
+		"CONFIG": func(sub *subscription, _ *client, subject, reply string, msg []byte) {
+			optz := &ConfigSnapshotsOptions{}
+			s.zReq(reply, msg, optz, func() (interface{}, error) { return s.configSnapshotsReq(optz) })
+		},
+		"MAINTENANCE": func(sub *subscription, _ *client, subject, reply string, msg []byte) {
+			optz := &MaintenanceOptions{}
+			s.zReq(reply, msg, optz, func() (interface{}, error) { return s.MaintenanceMode(optz) })
+		},
+		"SERVICEZ": func(sub *subscription, _ *client, subject, reply string, msg []byte) {
+			optz := &ServicezOptions{}
+			s.zReq(reply, msg, optz, func() (interface{}, error) { return s.Servicez(optz) })
+		},
 	}
 
 	for name, req := range monSrvc {
@@ -764,6 +924,9 @@ func (s *Server) shutdownEventing() {
 	s.mu.Lock()
 	clearTimer(&s.sys.sweeper)
 	clearTimer(&s.sys.stmr)
+	if s.upgrade != nil {
+		clearTimer(&s.upgrade.tmr)
+	}
 	s.mu.Unlock()
 
 	// We will queue up a shutdown event and wait for the
@@ -1140,6 +1303,143 @@ func (s *Server) sendAuthErrorEvent(c *client) {
 	s.mu.Unlock()
 }
 
+// sendJetStreamRecoveryEvent will send the progress of JetStream state recovery.
+func (s *Server) sendJetStreamRecoveryEvent() {
+	rs := s.JetStreamRecovery()
+	if rs == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	m := JetStreamRecoveryEventMsg{
+		TypedEvent: TypedEvent{
+			Type: JetStreamRecoveryEventMsgType,
+			ID:   s.nextEventID(),
+			Time: time.Now().UTC(),
+		},
+		Recovery: *rs,
+	}
+	subj := fmt.Sprintf(jsRecoveryEventSubj, s.info.ID)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, &m)
+}
+
+// sendLameDuckEvent will send the progress of client evictions in lame duck mode.
+func (s *Server) sendLameDuckEvent(clients, evicted int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	m := LameDuckEventMsg{
+		TypedEvent: TypedEvent{
+			Type: LameDuckEventMsgType,
+			ID:   s.nextEventID(),
+			Time: time.Now().UTC(),
+		},
+		Clients: clients,
+		Evicted: evicted,
+	}
+	subj := fmt.Sprintf(lameDuckEventSubj, s.info.ID)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, &m)
+}
+
+// sendAuthEvent sends the auth event of the connection, which failed to
+// authenticate for the reason when set.
+func (s *Server) sendAuthEvent(c *client, reason string) {
+	s.mu.Lock()
+	if !s.eventsEnabled() {
+		s.mu.Unlock()
+		return
+	}
+	eid := s.nextEventID()
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	m := AuthEventMsg{
+		TypedEvent: TypedEvent{
+			Type: AuthEventMsgType,
+			ID:   eid,
+			Time: time.Now().UTC(),
+		},
+		Client: ClientInfo{
+			Start:   c.start,
+			Host:    c.host,
+			ID:      c.cid,
+			Account: accForClient(c),
+			User:    c.getRawAuthUser(),
+			Name:    c.opts.Name,
+			Lang:    c.opts.Lang,
+			Version: c.opts.Version,
+		},
+		Kind:    c.typeString(),
+		Success: reason == _EMPTY_,
+		Reason:  reason,
+	}
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	s.sendInternalMsg(fmt.Sprintf(authEventSubj, s.info.ID), _EMPTY_, &m.Server, &m)
+	s.mu.Unlock()
+}
+
+// sendAuthFailureEvent sends the auth event of a connection that failed
+// to authenticate.
+func (s *Server) sendAuthFailureEvent(c *client) {
+	reason := c.afail
+	if reason == _EMPTY_ {
+		reason = authFailInvalidCredentials
+	}
+	s.sendAuthEvent(c, reason)
+}
+
+// sendAuthVerifyEvent sends a security event for a nonce signature that
+// could not be verified. Events are rate limited with a token bucket.
+func (s *Server) sendAuthVerifyEvent(c *client, nkey, reason string) {
+	c.mu.Lock()
+	m := AuthVerifyEventMsg{
+		TypedEvent: TypedEvent{
+			Type: AuthVerifyEventMsgType,
+		},
+		Client: ClientInfo{
+			Start:   c.start,
+			Host:    c.host,
+			ID:      c.cid,
+			Name:    c.opts.Name,
+			Lang:    c.opts.Lang,
+			Version: c.opts.Version,
+		},
+		Kind:   c.typeString(),
+		Nkey:   nkey,
+		Reason: reason,
+	}
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	now := time.Now()
+	if refill := int(now.Sub(s.authVerifyRefill) / authVerifyEventInterval); refill > 0 {
+		s.authVerifyTokens += refill
+		if s.authVerifyTokens > authVerifyEventBurst {
+			s.authVerifyTokens = authVerifyEventBurst
+		}
+		s.authVerifyRefill = now
+	}
+	if s.authVerifyTokens <= 0 {
+		return
+	}
+	s.authVerifyTokens--
+
+	m.ID = s.nextEventID()
+	m.Time = now.UTC()
+	s.sendInternalMsg(fmt.Sprintf(authVerifyEventSubj, s.info.ID), _EMPTY_, &m.Server, &m)
+}
+
 // Internal message callback. If the msg is needed past the callback it is
 // required to be copied.
 type msgHandler func(sub *subscription, client *client, subject, reply string, msg []byte)
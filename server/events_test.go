@@ -560,6 +560,141 @@ func TestSystemAccountDisconnectBadLogin(t *testing.T) {
 	}
 }
 
+func TestSystemAccountAuthEvents(t *testing.T) {
+	s, opts := runTrustedServer(t)
+	defer s.Shutdown()
+
+	sacc, sakp := createAccount(s)
+	s.setSystemAccount(sacc)
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	ncs, err := nats.Connect(url, createUserCreds(t, s, sakp))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+	sub := natsSubSync(t, ncs, fmt.Sprintf(authEventSubj, "*"))
+	natsFlush(t, ncs)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+	acc, akp := createAccount(s)
+	// Connects with a user JWT, signing the nonce with the signer.
+	connect := func(akp nkeys.KeyPair, expires int64, signer nkeys.KeyPair) (string, error) {
+		t.Helper()
+		kp, _ := nkeys.CreateUser()
+		pub, _ := kp.PublicKey()
+		nuc := jwt.NewUserClaims(pub)
+		nuc.Expires = expires
+		ujwt, err := nuc.Encode(akp)
+		if err != nil {
+			t.Fatalf("Error generating user JWT: %v", err)
+		}
+		if signer == nil {
+			signer = kp
+		}
+		nc, err := nats.Connect(url, nats.UserJWT(
+			func() (string, error) { return ujwt, nil },
+			func(nonce []byte) ([]byte, error) { return signer.Sign(nonce) }))
+		if err == nil {
+			nc.Close()
+		}
+		return pub, err
+	}
+	checkEvent := func(user, reason string) {
+		t.Helper()
+		var ev AuthEventMsg
+		if err := json.Unmarshal(natsNexMsg(t, sub, time.Second).Data, &ev); err != nil {
+			t.Fatalf("Error unmarshalling event: %v", err)
+		}
+		if ev.Type != AuthEventMsgType || ev.Kind != "Client" || ev.Success != (reason == _EMPTY_) ||
+			ev.Reason != reason || ev.Client.Host != "127.0.0.1" || (user != _EMPTY_ && ev.Client.User != user) {
+			t.Fatalf("Unexpected event: %+v", ev)
+		}
+		if reason == _EMPTY_ && ev.Client.Account != acc.Name {
+			t.Fatalf("Unexpected account %q", ev.Client.Account)
+		}
+	}
+
+	pub, err := connect(akp, 0, nil)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	checkEvent(pub, _EMPTY_)
+	other, _ := nkeys.CreateUser()
+	connect(akp, 0, other)
+	checkEvent(_EMPTY_, authFailBadSignature)
+	connect(akp, time.Now().Add(-time.Minute).Unix(), nil)
+	checkEvent(_EMPTY_, authFailExpiredJWT)
+	unknown, _ := nkeys.CreateAccount()
+	connect(unknown, 0, nil)
+	checkEvent(_EMPTY_, authFailUnknownAccount)
+
+	// Revoked users.
+	rkp, _ := nkeys.CreateUser()
+	rpub, _ := rkp.PublicKey()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	nac.Revoke(rpub)
+	ajwt, _ := nac.Encode(okp)
+	if err := s.updateAccountWithClaimJWT(acc, ajwt); err != nil {
+		t.Fatalf("Error updating account: %v", err)
+	}
+	nuc := jwt.NewUserClaims(rpub)
+	rjwt, _ := nuc.Encode(akp)
+	if nc, err := nats.Connect(url, nats.UserJWT(
+		func() (string, error) { return rjwt, nil },
+		func(nonce []byte) ([]byte, error) { return rkp.Sign(nonce) })); err == nil {
+		nc.Close()
+		t.Fatalf("Expected revoked user to be rejected")
+	}
+	checkEvent(_EMPTY_, authFailRevokedUser)
+}
+
+func TestAuthEventsUsers(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A: { users: [{user: a, password: pwd}] }
+			SYS: { users: [{user: sys, password: pwd}] }
+		}
+		system_account: SYS
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sys := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer sys.Close()
+	sub := natsSubSync(t, sys, fmt.Sprintf(authEventSubj, s.ID()))
+	natsFlush(t, sys)
+
+	for _, test := range []struct {
+		user, pass, reason string
+	}{
+		{"a", "pwd", _EMPTY_},
+		{"a", "bad", authFailBadPassword},
+		{"b", "pwd", authFailUnknownUser},
+		{_EMPTY_, _EMPTY_, authFailNoCredentials},
+	} {
+		opts := []nats.Option{nats.MaxReconnects(0)}
+		if test.user != _EMPTY_ {
+			opts = append(opts, nats.UserInfo(test.user, test.pass))
+		}
+		if nc, err := nats.Connect(s.ClientURL(), opts...); err == nil {
+			nc.Close()
+		}
+		var ev AuthEventMsg
+		if err := json.Unmarshal(natsNexMsg(t, sub, time.Second).Data, &ev); err != nil {
+			t.Fatalf("Error unmarshalling event: %v", err)
+		}
+		if ev.Success != (test.reason == _EMPTY_) || ev.Reason != test.reason || ev.Client.User != test.user {
+			t.Fatalf("Unexpected event for %q: %+v", test.user, ev)
+		}
+		if ev.Success && ev.Client.Account != "A" {
+			t.Fatalf("Unexpected account %q", ev.Client.Account)
+		}
+	}
+}
+
 func TestSystemAccountInternalSubscriptions(t *testing.T) {
 	s, opts := runTrustedServer(t)
 	defer s.Shutdown()
@@ -1297,7 +1432,7 @@ func TestSystemAccountWithGateways(t *testing.T) {
 
 	// If this tests fails with wrong number after 10 seconds we may have
 	// added a new inititial subscription for the eventing system.
-	checkExpectedSubs(t, 25, sa)
+	checkExpectedSubs(t, 36, sa)
 
 	// Create a client on B and see if we receive the event
 	urlb := fmt.Sprintf("nats://%s:%d", ob.Host, ob.Port)
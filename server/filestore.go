@@ -49,6 +49,18 @@ type FileStoreConfig struct {
 	ReadCacheExpire time.Duration
 	// SyncInterval is how often we sync to disk in the background.
 	SyncInterval time.Duration
+	// AdaptiveSync adjusts the background sync interval between a quarter and
+	// four times SyncInterval, based on write activity and time spent syncing.
+	AdaptiveSync bool
+	// SyncMaxLatency, when set, makes stored messages durable before StoreMsg
+	// returns. Concurrent appends are batched into a single group sync issued
+	// at most this long after the first append of the group.
+	SyncMaxLatency time.Duration
+	// CompactInterval is how often sparse blocks are compacted in the background.
+	CompactInterval time.Duration
+	// ScrubInterval is how often the checksums of all messages are verified
+	// in the background. Scrubbing is disabled when not set.
+	ScrubInterval time.Duration
 }
 
 // FileStreamInfo allows us to remember created time.
@@ -70,6 +82,9 @@ type fileStore struct {
 	scb     func(int64)
 	ageChk  *time.Timer
 	syncTmr *time.Timer
+	cmpTmr  *time.Timer
+	scrTmr  *time.Timer
+	scrub   *ScrubReport
 	cfg     FileStreamInfo
 	fcfg    FileStoreConfig
 	lmb     *msgBlock
@@ -81,6 +96,16 @@ type fileStore struct {
 	cfs     []*consumerFileStore
 	closed  bool
 	sips    int
+	sival   time.Duration
+	dirty   uint64
+	gc      *groupCommit
+	gch     chan struct{}
+}
+
+// Appends waiting on the same group sync.
+type groupCommit struct {
+	done chan struct{}
+	err  error
 }
 
 // Represents a message store block and its data.
@@ -145,6 +170,8 @@ const (
 	blkScan = "%d.blk"
 	// used to scan index file names.
 	indexScan = "%d.idx"
+	// used for msg block files being compacted.
+	compactScan = "%d.cmp"
 	// This is where we keep state on consumers.
 	consumerDir = "obs"
 	// Index file for a consumer.
@@ -163,6 +190,10 @@ const (
 	defaultCacheExpiration = 5 * time.Second
 	// default sync interval
 	defaultSyncInterval = 10 * time.Second
+	// adaptive sync interval bounds, relative to the configured interval.
+	adaptiveSyncFactor = 4
+	// default compaction interval
+	defaultCompactInterval = 2 * time.Minute
 	// coalesceMinimum
 	coalesceMinimum = 64 * 1024
 
@@ -195,6 +226,9 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	if fcfg.SyncInterval == 0 {
 		fcfg.SyncInterval = defaultSyncInterval
 	}
+	if fcfg.CompactInterval == 0 {
+		fcfg.CompactInterval = defaultCompactInterval
+	}
 
 	// Check the directory
 	if stat, err := os.Stat(fcfg.StoreDir); os.IsNotExist(err) {
@@ -216,6 +250,7 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 		wmb:  &bytes.Buffer{},
 		fch:  make(chan struct{}),
 		qch:  make(chan struct{}),
+		gch:  make(chan struct{}, 1),
 	}
 
 	// Check if this is a new setup.
@@ -250,7 +285,16 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 
 	go fs.flushLoop(fs.fch, fs.qch)
 
-	fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
+	if fcfg.SyncMaxLatency > 0 {
+		go fs.groupCommitLoop(fs.gch, fs.qch)
+	}
+
+	fs.sival = fcfg.SyncInterval
+	fs.syncTmr = time.AfterFunc(fs.sival, fs.syncBlocks)
+	fs.cmpTmr = time.AfterFunc(fcfg.CompactInterval, fs.compactBlocks)
+	if fcfg.ScrubInterval > 0 {
+		fs.scrTmr = time.AfterFunc(fcfg.ScrubInterval, fs.scrubBlocks)
+	}
 
 	return fs, nil
 }
@@ -428,6 +472,11 @@ func (fs *fileStore) recoverMsgs() error {
 	// These can come in a random order, so account for that.
 	for _, fi := range fis {
 		var index uint64
+		// Remove any block we were compacting when interrupted.
+		if n, err := fmt.Sscanf(fi.Name(), compactScan, &index); err == nil && n == 1 {
+			os.Remove(path.Join(mdir, fi.Name()))
+			continue
+		}
 		if n, err := fmt.Sscanf(fi.Name(), blkScan, &index); err == nil && n == 1 {
 			if mb := fs.recoverMsgBlock(fi, index); mb != nil {
 				if fs.state.FirstSeq == 0 || mb.first.seq < fs.state.FirstSeq {
@@ -528,7 +577,8 @@ func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 	if fs.lmb != nil {
 		index = fs.lmb.index + 1
 		fs.flushPendingWrites()
-		fs.closeLastMsgBlock(false)
+		// Appends waiting on a group sync need this block to be synced.
+		fs.closeLastMsgBlock(fs.gc != nil)
 	}
 
 	mb := &msgBlock{index: index, expire: fs.fcfg.ReadCacheExpire}
@@ -616,6 +666,7 @@ func (fs *fileStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, erro
 	fs.state.Bytes += n
 	fs.state.LastSeq = seq
 	fs.state.LastTime = time.Unix(0, ts).UTC()
+	fs.dirty += n
 
 	// Limits checks and enforcement.
 	// If they do any deletions they will update the
@@ -628,6 +679,16 @@ func (fs *fileStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, erro
 		fs.startAgeChk()
 	}
 
+	// Join the pending group sync if we need to be durable on return.
+	var gc *groupCommit
+	if fs.fcfg.SyncMaxLatency > 0 {
+		if gc = fs.gc; gc == nil {
+			gc = &groupCommit{done: make(chan struct{})}
+			fs.gc = gc
+			fs.kickGroupCommit()
+		}
+	}
+
 	cb := fs.scb
 	fs.mu.Unlock()
 
@@ -635,6 +696,13 @@ func (fs *fileStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, erro
 		cb(int64(n))
 	}
 
+	if gc != nil {
+		<-gc.done
+		if gc.err != nil {
+			return 0, 0, gc.err
+		}
+	}
+
 	return seq, ts, nil
 }
 
@@ -824,6 +892,10 @@ func (fs *fileStore) deleteMsgFromBlock(mb *msgBlock, seq uint64, sm *fileStored
 		shouldWriteIndex = true
 	}
 	if secure {
+		// The block may have been compacted since the message was fetched.
+		if csm, _ := mb.cacheLookupLocked(seq); csm != nil {
+			sm = csm
+		}
 		fs.eraseMsg(mb, sm)
 	}
 
@@ -929,6 +1001,8 @@ func checkMsgBlockFile(fp *os.File, hh hash.Hash) []uint64 {
 			break
 		}
 		rl := le.Uint32(hdr[0:])
+		hasHeaders := rl&hbit != 0
+		rl &^= hbit
 		seq := le.Uint64(hdr[4:])
 		slen := le.Uint16(hdr[20:])
 		dlen := int(rl) - msgHdrSize
@@ -944,7 +1018,11 @@ func checkMsgBlockFile(fp *os.File, hh hash.Hash) []uint64 {
 		hh.Reset()
 		hh.Write(hdr[4:20])
 		hh.Write(data[:slen])
-		hh.Write(data[slen : dlen-8])
+		if hasHeaders {
+			hh.Write(data[slen+4 : dlen-8])
+		} else {
+			hh.Write(data[slen : dlen-8])
+		}
 		checksum := hh.Sum(nil)
 		if !bytes.Equal(checksum, data[len(data)-8:]) {
 			bad = append(bad, seq)
@@ -982,6 +1060,61 @@ func (fs *fileStore) checkMsgs() []uint64 {
 	return bad
 }
 
+// Scrub verifies the checksums of all stored messages and reports the
+// sequences of the corrupted ones.
+func (fs *fileStore) Scrub() (*ScrubReport, error) {
+	if fs.isClosed() {
+		return nil, ErrStoreClosed
+	}
+	start := time.Now()
+	bad := fs.checkMsgs()
+	// Skip erased and deleted messages, they may have been
+	// rewritten while we were scrubbing.
+	var corrupted []uint64
+	for _, seq := range bad {
+		if seq != 0 && !fs.isDeleted(seq) {
+			corrupted = append(corrupted, seq)
+		}
+	}
+	sr := &ScrubReport{Time: start.UTC(), Duration: time.Since(start), Corrupted: corrupted}
+	fs.mu.Lock()
+	fs.scrub = sr
+	fs.mu.Unlock()
+	return sr, nil
+}
+
+// Returns true if the message is no longer in the store.
+// Lock should not be held.
+func (fs *fileStore) isDeleted(seq uint64) bool {
+	mb := fs.selectMsgBlock(seq)
+	if mb == nil {
+		return true
+	}
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	_, deleted := mb.dmap[seq]
+	return deleted || seq < mb.first.seq
+}
+
+// LastScrub returns the report of the last scrub, if any.
+func (fs *fileStore) LastScrub() *ScrubReport {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.scrub
+}
+
+// Scrub messages. This is called from a timer.
+func (fs *fileStore) scrubBlocks() {
+	if _, err := fs.Scrub(); err == ErrStoreClosed {
+		return
+	}
+	fs.mu.Lock()
+	if !fs.closed {
+		fs.scrTmr = time.AfterFunc(fs.fcfg.ScrubInterval, fs.scrubBlocks)
+	}
+	fs.mu.Unlock()
+}
+
 // This will kick out our flush routine if its waiting.
 func (fs *fileStore) kickFlusher() {
 	select {
@@ -1000,6 +1133,53 @@ func (fs *fileStore) pendingWriteSize() int {
 	return sz
 }
 
+// This will kick out our group commit routine if its waiting.
+func (fs *fileStore) kickGroupCommit() {
+	select {
+	case fs.gch <- struct{}{}:
+	default:
+	}
+}
+
+// Writes and syncs groups of appends. The sync itself is done without
+// holding the store lock so new appends can form the next group meanwhile.
+func (fs *fileStore) groupCommitLoop(gch, qch chan struct{}) {
+	for {
+		select {
+		case <-gch:
+			// Give other appends a chance to join, up to the latency bound.
+			select {
+			case <-time.After(fs.fcfg.SyncMaxLatency):
+			case <-qch:
+				return
+			}
+			fs.mu.Lock()
+			gc := fs.gc
+			fs.gc = nil
+			err := fs.flushPendingWrites()
+			var mfd *os.File
+			if err == nil {
+				mfd = fs.lmb.mfd
+			}
+			fs.mu.Unlock()
+			if gc == nil {
+				continue
+			}
+			// The block may be closed if it was rolled or the store stopped
+			// in the meantime, in which case it was synced when closed.
+			if mfd != nil {
+				if serr := mfd.Sync(); serr != nil && !errors.Is(serr, os.ErrClosed) {
+					err = serr
+				}
+			}
+			gc.err = err
+			close(gc.done)
+		case <-qch:
+			return
+		}
+	}
+}
+
 func (fs *fileStore) flushLoop(fch, qch chan struct{}) {
 	for {
 		select {
@@ -1192,14 +1372,17 @@ func (fs *fileStore) eraseMsg(mb *msgBlock, sm *fileStoredMsg) error {
 
 // Sync msg and index files as needed. This is called from a timer.
 func (fs *fileStore) syncBlocks() {
-	fs.mu.RLock()
+	fs.mu.Lock()
 	closed := fs.closed
 	blks := fs.blks
-	fs.mu.RUnlock()
+	dirty := fs.dirty
+	fs.dirty = 0
+	fs.mu.Unlock()
 
 	if closed {
 		return
 	}
+	start := time.Now()
 	for _, mb := range blks {
 		mb.mu.RLock()
 		if mb.mfd != nil {
@@ -1211,12 +1394,16 @@ func (fs *fileStore) syncBlocks() {
 		}
 		mb.mu.RUnlock()
 	}
+	elapsed := time.Since(start)
 
 	var _cfs [256]*consumerFileStore
 
 	fs.mu.Lock()
 	cfs := append(_cfs[:0], fs.cfs...)
-	fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
+	if fs.fcfg.AdaptiveSync {
+		fs.sival = adaptSyncInterval(fs.fcfg.SyncInterval, fs.sival, dirty, elapsed)
+	}
+	fs.syncTmr = time.AfterFunc(fs.sival, fs.syncBlocks)
 	fs.mu.Unlock()
 
 	// Do consumers.
@@ -1225,6 +1412,184 @@ func (fs *fileStore) syncBlocks() {
 	}
 }
 
+// Returns the next background sync interval. We back off when idle or when
+// syncs are slow relative to the interval, to avoid saturating high latency
+// disks, and sync more often under a heavy write load to bound what is at
+// risk. The result stays within adaptiveSyncFactor of the configured interval.
+func adaptSyncInterval(base, cur time.Duration, dirty uint64, elapsed time.Duration) time.Duration {
+	min, max := base/adaptiveSyncFactor, base*adaptiveSyncFactor
+	switch {
+	case dirty == 0 || elapsed > cur/2:
+		cur *= 2
+	case dirty >= defaultStreamBlockSize:
+		cur /= 2
+	default:
+		return cur
+	}
+	if cur < min {
+		cur = min
+	} else if cur > max {
+		cur = max
+	}
+	return cur
+}
+
+// Compact sparse blocks. This is called from a timer.
+func (fs *fileStore) compactBlocks() {
+	if _, err := fs.CompactBlocks(); err == ErrStoreClosed {
+		return
+	}
+	fs.mu.Lock()
+	if !fs.closed {
+		fs.cmpTmr = time.AfterFunc(fs.fcfg.CompactInterval, fs.compactBlocks)
+	}
+	fs.mu.Unlock()
+}
+
+// CompactBlocks rewrites sparse message blocks, left behind by interior
+// deletes, without the deleted messages. Blocks are compacted one at a time
+// so writes are only held up for the duration of a single block rewrite.
+// Returns the number of bytes reclaimed.
+func (fs *fileStore) CompactBlocks() (uint64, error) {
+	fs.mu.RLock()
+	closed, blks := fs.closed, append([]*msgBlock(nil), fs.blks...)
+	fs.mu.RUnlock()
+
+	if closed {
+		return 0, ErrStoreClosed
+	}
+
+	var reclaimed uint64
+	for _, mb := range blks {
+		fs.mu.Lock()
+		if fs.closed {
+			fs.mu.Unlock()
+			return reclaimed, ErrStoreClosed
+		}
+		if fs.sips > 0 {
+			fs.mu.Unlock()
+			return reclaimed, ErrStoreSnapshotInProgress
+		}
+		// Skip the block we are writing to and blocks removed in the meantime.
+		if mb == fs.lmb || fs.blockIndex(mb) < 0 {
+			fs.mu.Unlock()
+			continue
+		}
+		mb.mu.Lock()
+		n, err := mb.compact()
+		mb.mu.Unlock()
+		if n > 0 && err == nil {
+			err = mb.writeIndexInfo()
+		}
+		fs.mu.Unlock()
+		reclaimed += n
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+	return reclaimed, nil
+}
+
+// Returns the position of the block, or -1 if not found.
+// Lock should be held.
+func (fs *fileStore) blockIndex(mb *msgBlock) int {
+	for i, omb := range fs.blks {
+		if omb == mb {
+			return i
+		}
+	}
+	return -1
+}
+
+// Rewrites the block file without its deleted messages if at least half of
+// the file is taken by them. Messages deleted from the front are dropped.
+// Interior deleted messages are kept as empty erased records so that the
+// cache index, which is positional, remains valid.
+// Both fs and mb locks should be held.
+func (mb *msgBlock) compact() (uint64, error) {
+	fi, err := os.Stat(mb.mfn)
+	if err != nil {
+		return 0, err
+	}
+	if mb.msgs == 0 || mb.bytes*2 >= uint64(fi.Size()) {
+		return 0, nil
+	}
+	buf, err := ioutil.ReadFile(mb.mfn)
+	if err != nil {
+		return 0, err
+	}
+
+	var le = binary.LittleEndian
+
+	// Erased record with no subject nor payload.
+	var erased [msgHdrSize + checksumSize]byte
+	le.PutUint32(erased[0:], uint32(len(erased)))
+	mb.hh.Reset()
+	mb.hh.Write(erased[4:20])
+	copy(erased[msgHdrSize:], mb.hh.Sum(nil))
+
+	nbuf := make([]byte, 0, mb.bytes)
+	var first bool
+
+	for index := 0; index < len(buf); {
+		if index+msgHdrSize > len(buf) {
+			return 0, errBadMsg
+		}
+		hdr := buf[index : index+msgHdrSize]
+		rl := int(le.Uint32(hdr[0:]) &^ hbit)
+		seq := le.Uint64(hdr[4:])
+		if rl < len(erased) || index+rl > len(buf) {
+			return 0, errBadMsg
+		}
+		rec := buf[index : index+rl]
+		index += rl
+
+		// Everything before our first message is gone.
+		if !first {
+			if first = seq == mb.first.seq; !first {
+				continue
+			}
+		}
+		if _, deleted := mb.dmap[seq]; seq == 0 || deleted {
+			nbuf = append(nbuf, erased[:]...)
+		} else {
+			nbuf = append(nbuf, rec...)
+		}
+	}
+	if !first {
+		return 0, errBadMsg
+	}
+	if len(nbuf) >= len(buf) {
+		return 0, nil
+	}
+
+	// Write to a temporary file and swap in place.
+	tmp := path.Join(path.Dir(mb.mfn), fmt.Sprintf(compactScan, mb.index))
+	if err := ioutil.WriteFile(tmp, nbuf, 0644); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, mb.mfn); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if mfd, err := os.Open(mb.mfn); err == nil {
+		mfd.Sync()
+		mfd.Close()
+	}
+
+	// The last record may have changed, and the cache is stale.
+	copy(mb.lchk[0:], nbuf[len(nbuf)-checksumSize:])
+	mb.cache = nil
+	atomic.AddUint64(&mb.cgenid, 1)
+	if err := mb.indexCacheBuf(nbuf); err != nil {
+		return 0, err
+	}
+	mb.startCacheExpireTimer()
+
+	return uint64(len(buf) - len(nbuf)), nil
+}
+
 // Select the message block where this message should be found.
 // Return nil if not in the set.
 func (fs *fileStore) selectMsgBlock(seq uint64) *msgBlock {
@@ -1982,10 +2347,25 @@ func (fs *fileStore) Stop() error {
 
 	fs.closeAllMsgBlocks(true)
 
+	// Release appends waiting on a group sync, blocks were synced on close.
+	if gc := fs.gc; gc != nil {
+		fs.gc = nil
+		gc.err = err
+		close(gc.done)
+	}
+
 	if fs.syncTmr != nil {
 		fs.syncTmr.Stop()
 		fs.syncTmr = nil
 	}
+	if fs.cmpTmr != nil {
+		fs.cmpTmr.Stop()
+		fs.cmpTmr = nil
+	}
+	if fs.scrTmr != nil {
+		fs.scrTmr.Stop()
+		fs.scrTmr = nil
+	}
 	if fs.ageChk != nil {
 		fs.ageChk.Stop()
 		fs.ageChk = nil
@@ -28,6 +28,7 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -706,6 +707,59 @@ func TestFileStoreBitRot(t *testing.T) {
 	}
 }
 
+func TestFileStoreScrub(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fs, err := newFileStore(
+		FileStoreConfig{StoreDir: storeDir, ScrubInterval: 10 * time.Millisecond},
+		StreamConfig{Name: "zzz", Storage: FileStorage},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	subj, hdr, msg := "foo", []byte("NATS/1.0\r\nkey: val\r\n\r\n"), []byte("Hello World")
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg(subj, hdr, msg)
+	}
+	fs.flushPendingWritesUnlocked()
+
+	// Background scrub should find nothing wrong, including with headers.
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if sr := fs.LastScrub(); sr == nil {
+			return fmt.Errorf("no scrub yet")
+		} else if len(sr.Corrupted) > 0 {
+			t.Fatalf("Expected no corrupted messages, got %v", sr.Corrupted)
+		}
+		return nil
+	})
+
+	// Flip a byte of the payload of the fifth message.
+	rl := fileStoreMsgSize(subj, hdr, msg)
+	fs.mu.Lock()
+	mfn := fs.lmb.mfn
+	fs.mu.Unlock()
+	contents, _ := ioutil.ReadFile(mfn)
+	off := 4*rl + uint64(msgHdrSize+len(subj)+4+len(hdr)+1)
+	contents[off] = ^contents[off]
+	ioutil.WriteFile(mfn, contents, 0644)
+
+	sr, err := fs.Scrub()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(sr.Corrupted, []uint64{5}) {
+		t.Fatalf("Expected message 5 to be corrupted, got %v", sr.Corrupted)
+	}
+	if fs.LastScrub() != sr {
+		t.Fatalf("Expected last scrub report to be updated")
+	}
+
+}
+
 func TestFileStoreEraseMsg(t *testing.T) {
 	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
 	os.MkdirAll(storeDir, 0755)
@@ -979,6 +1033,200 @@ func TestFileStoreAndRetrieveMultiBlock(t *testing.T) {
 	}
 }
 
+func TestFileStoreGroupCommit(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	subj, msg := "foo", []byte("Hello World!")
+	storedMsgSize := fileStoreMsgSize(subj, nil, msg)
+
+	fs, err := newFileStore(
+		FileStoreConfig{StoreDir: storeDir, BlockSize: 8 * storedMsgSize, SyncMaxLatency: 5 * time.Millisecond},
+		StreamConfig{Name: "zzz", Storage: FileStorage},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	// A single append is written out before StoreMsg returns.
+	if _, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := fs.pendingWriteSize(); n != 0 {
+		t.Fatalf("Expected no pending writes, got %d", n)
+	}
+
+	// Concurrent appends, rolling over multiple blocks, share group syncs.
+	var wg sync.WaitGroup
+	errCh := make(chan error, 100)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
+					errCh <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected error: %v", err)
+	default:
+	}
+	if n := fs.pendingWriteSize(); n != 0 {
+		t.Fatalf("Expected no pending writes, got %d", n)
+	}
+	if state := fs.State(); state.Msgs != 101 || state.Bytes != 101*storedMsgSize {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	fs.Stop()
+
+	fs, err = newFileStore(
+		FileStoreConfig{StoreDir: storeDir, BlockSize: 8 * storedMsgSize},
+		StreamConfig{Name: "zzz", Storage: FileStorage},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	if state := fs.State(); state.Msgs != 101 {
+		t.Fatalf("Expected 101 msgs after restart, got %d", state.Msgs)
+	}
+}
+
+func TestFileStoreAdaptSyncInterval(t *testing.T) {
+	base := 10 * time.Second
+	for _, test := range []struct {
+		name    string
+		cur     time.Duration
+		dirty   uint64
+		elapsed time.Duration
+		expect  time.Duration
+	}{
+		{"idle", base, 0, 0, 2 * base},
+		{"idle max", 4 * base, 0, 0, 4 * base},
+		{"slow sync", base, 1024, 6 * time.Second, 2 * base},
+		{"steady", base, 1024, time.Millisecond, base},
+		{"heavy writes", base, defaultStreamBlockSize, time.Millisecond, base / 2},
+		{"heavy writes min", base / 4, defaultStreamBlockSize, time.Millisecond, base / 4},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if ival := adaptSyncInterval(base, test.cur, test.dirty, test.elapsed); ival != test.expect {
+				t.Fatalf("Expected interval %v, got %v", test.expect, ival)
+			}
+		})
+	}
+}
+
+func TestFileStoreCompactBlocks(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	subj, msg := "foo", make([]byte, 256)
+	storedMsgSize := fileStoreMsgSize(subj, nil, msg)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 10 * storedMsgSize}
+	fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	for i := 0; i < 30; i++ {
+		fs.StoreMsg(subj, nil, msg)
+	}
+	// Remove from the front and interior messages of the first two blocks.
+	for seq := uint64(1); seq <= 20; seq++ {
+		if seq <= 3 || seq%3 != 0 {
+			if _, err := fs.RemoveMsg(seq); err != nil {
+				t.Fatalf("Unexpected error removing %d: %v", seq, err)
+			}
+		}
+	}
+	// Securely erase one too.
+	if _, err := fs.EraseMsg(6); err != nil {
+		t.Fatalf("Unexpected error erasing: %v", err)
+	}
+	state := fs.State()
+	blkSize := func(index uint64) int64 {
+		fi, err := os.Stat(path.Join(storeDir, msgDir, fmt.Sprintf(blkScan, index)))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return fi.Size()
+	}
+	before := blkSize(1)
+
+	reclaimed, err := fs.CompactBlocks()
+	if err != nil {
+		t.Fatalf("Unexpected error compacting: %v", err)
+	}
+	if reclaimed == 0 {
+		t.Fatalf("Expected space to be reclaimed")
+	}
+	if after := blkSize(1); after >= before {
+		t.Fatalf("Expected block to shrink, was %d, now %d", before, after)
+	}
+	if nstate := fs.State(); !reflect.DeepEqual(state, nstate) {
+		t.Fatalf("Expected state to be unchanged, was %+v, now %+v", state, nstate)
+	}
+	// Nothing left to reclaim.
+	if reclaimed, _ := fs.CompactBlocks(); reclaimed != 0 {
+		t.Fatalf("Expected nothing reclaimed, got %d", reclaimed)
+	}
+
+	checkMsgs := func() {
+		t.Helper()
+		for seq := uint64(1); seq <= 30; seq++ {
+			_, _, _, _, err := fs.LoadMsg(seq)
+			if live := seq > 20 || (seq > 3 && seq%3 == 0 && seq != 6); live && err != nil {
+				t.Fatalf("Error loading %d: %v", seq, err)
+			} else if !live && err == nil {
+				t.Fatalf("Expected error loading deleted message %d", seq)
+			}
+		}
+	}
+	checkMsgs()
+
+	// Deleting from a compacted block still works.
+	if _, err := fs.EraseMsg(15); err != nil {
+		t.Fatalf("Unexpected error erasing: %v", err)
+	}
+	if _, _, _, _, err := fs.LoadMsg(15); err == nil {
+		t.Fatalf("Expected error loading erased message")
+	}
+	fs.StoreMsg(subj, nil, msg)
+	state = fs.State()
+	fs.Stop()
+
+	fs, err = newFileStore(fcfg, StreamConfig{Name: "zzz", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	if nstate := fs.State(); nstate.FirstSeq != state.FirstSeq || nstate.LastSeq != state.LastSeq {
+		t.Fatalf("Expected state to be recovered, was %+v, now %+v", state, nstate)
+	}
+	if _, _, _, _, err := fs.LoadMsg(15); err == nil {
+		t.Fatalf("Expected error loading erased message")
+	}
+	if bad := fs.checkMsgs(); len(bad) > 0 {
+		t.Fatalf("Expected no bad messages, got %v", bad)
+	}
+	for _, seq := range []uint64{9, 12, 18, 31} {
+		if _, _, _, _, err := fs.LoadMsg(seq); err != nil {
+			t.Fatalf("Error loading %d: %v", seq, err)
+		}
+	}
+}
+
 func TestFileStoreCollapseDmap(t *testing.T) {
 	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
 	os.MkdirAll(storeDir, 0755)
@@ -0,0 +1,281 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of users whose fingerprints are remembered.
+	fingerprintMaxUsers = 10000
+	// Maximum number of networks remembered per user.
+	fingerprintMaxNetworks = 16
+	// Networks are compared with these prefix lengths.
+	fingerprintIPv4Prefix = 24
+	fingerprintIPv6Prefix = 48
+)
+
+// Reasons of the client anomaly advisories.
+const (
+	AnomalyFingerprintChanged = "fingerprint_changed"
+	AnomalyNewNetwork         = "new_network"
+)
+
+// ClientFingerprint identifies the client library of a connection.
+type ClientFingerprint struct {
+	Lang     string `json:"lang,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Protocol int    `json:"protocol"`
+	// Flags are the protocol options set in the CONNECT, which differ
+	// between libraries.
+	Flags string `json:"flags,omitempty"`
+	// TLS is a JA3 style hash of the TLS client hello: highest version,
+	// cipher suites, curves and point formats. The extensions are not
+	// exposed by the TLS stack and are not part of it.
+	TLS string `json:"tls,omitempty"`
+}
+
+// sameLibrary returns true if both fingerprints are from the same library.
+// Versions are not compared so that upgrades are not reported.
+func (fp *ClientFingerprint) sameLibrary(o *ClientFingerprint) bool {
+	return fp.Lang == o.Lang && fp.Protocol == o.Protocol && fp.Flags == o.Flags && fp.TLS == o.TLS
+}
+
+// userFingerprint is what is remembered about a user.
+type userFingerprint struct {
+	last     ClientFingerprint
+	networks []string
+}
+
+// fingerprints remembers the last fingerprint and the networks of users.
+type fingerprints struct {
+	sync.Mutex
+	users map[string]*userFingerprint
+}
+
+// fingerprintNetwork returns the network of the host used to detect
+// connections from a new location.
+func fingerprintNetwork(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return _EMPTY_
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(fingerprintIPv4Prefix, 32)),
+			Mask: net.CIDRMask(fingerprintIPv4Prefix, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(fingerprintIPv6Prefix, 128)),
+		Mask: net.CIDRMask(fingerprintIPv6Prefix, 128)}).String()
+}
+
+// isGREASE returns true for the reserved values clients add to the hello
+// to keep servers tolerant, which vary between connections.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// tlsHelloHash returns the JA3 style hash of the client hello.
+func tlsHelloHash(hello *tls.ClientHelloInfo) string {
+	join := func(vals []uint16) string {
+		var sb strings.Builder
+		for _, v := range vals {
+			if isGREASE(v) {
+				continue
+			}
+			if sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteString(strconv.Itoa(int(v)))
+		}
+		return sb.String()
+	}
+	var version uint16
+	for _, v := range hello.SupportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+	curves := make([]uint16, 0, len(hello.SupportedCurves))
+	for _, c := range hello.SupportedCurves {
+		curves = append(curves, uint16(c))
+	}
+	points := make([]uint16, 0, len(hello.SupportedPoints))
+	for _, p := range hello.SupportedPoints {
+		points = append(points, uint16(p))
+	}
+	s := fmt.Sprintf("%d,%s,%s,%s", version, join(hello.CipherSuites), join(curves), join(points))
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// fingerprintTLSConfig returns a copy of the TLS configuration recording
+// the hash of the client hello of the connection.
+func (c *client) fingerprintTLSConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	getConfig := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		h := tlsHelloHash(hello)
+		c.mu.Lock()
+		c.tlsHello = h
+		c.mu.Unlock()
+		if getConfig != nil {
+			return getConfig(hello)
+		}
+		return nil, nil
+	}
+	return config
+}
+
+// Lock should be held.
+func (c *client) getFingerprint() *ClientFingerprint {
+	var flags []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"echo", c.opts.Echo},
+		{"headers", c.opts.Headers},
+		{"pedantic", c.opts.Pedantic},
+		{"verbose", c.opts.Verbose},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return &ClientFingerprint{
+		Lang:     c.opts.Lang,
+		Version:  c.opts.Version,
+		Protocol: c.opts.Protocol,
+		Flags:    strings.Join(flags, ","),
+		TLS:      c.tlsHello,
+	}
+}
+
+// checkClientFingerprint records the fingerprint and network of the
+// authenticated user of the client, and sends an anomaly advisory when the
+// credentials are used by a different library or from a new network.
+func (s *Server) checkClientFingerprint(c *client) {
+	if !s.getOpts().ConnectionFingerprinting {
+		return
+	}
+	c.mu.Lock()
+	if c.acc == nil {
+		c.mu.Unlock()
+		return
+	}
+	user := c.getRawAuthUser()
+	if user == _EMPTY_ {
+		c.mu.Unlock()
+		return
+	}
+	fp := c.getFingerprint()
+	c.fingerprint = fp
+	network := fingerprintNetwork(c.host)
+	key := c.acc.Name + " " + user
+	c.mu.Unlock()
+
+	s.fingerprints.Lock()
+	if s.fingerprints.users == nil {
+		s.fingerprints.users = make(map[string]*userFingerprint)
+	}
+	uf := s.fingerprints.users[key]
+	if uf == nil {
+		// Make room by forgetting a random user.
+		if len(s.fingerprints.users) >= fingerprintMaxUsers {
+			for k := range s.fingerprints.users {
+				delete(s.fingerprints.users, k)
+				break
+			}
+		}
+		uf = &userFingerprint{last: *fp}
+		if network != _EMPTY_ {
+			uf.networks = append(uf.networks, network)
+		}
+		s.fingerprints.users[key] = uf
+		s.fingerprints.Unlock()
+		return
+	}
+	var reasons []string
+	prev := uf.last
+	if !fp.sameLibrary(&prev) {
+		reasons = append(reasons, AnomalyFingerprintChanged)
+	}
+	uf.last = *fp
+	if network != _EMPTY_ {
+		known := false
+		for _, n := range uf.networks {
+			if n == network {
+				known = true
+				break
+			}
+		}
+		if !known {
+			reasons = append(reasons, AnomalyNewNetwork)
+			if len(uf.networks) >= fingerprintMaxNetworks {
+				uf.networks = uf.networks[1:]
+			}
+			uf.networks = append(uf.networks, network)
+		}
+	}
+	s.fingerprints.Unlock()
+
+	for _, reason := range reasons {
+		c.Warnf("Client anomaly for user %q: %s", user, reason)
+		s.sendClientAnomalyEvent(c, &prev, reason)
+	}
+}
+
+// sendClientAnomalyEvent sends an advisory for a client whose credentials
+// are used in an unusual way.
+func (s *Server) sendClientAnomalyEvent(c *client, prev *ClientFingerprint, reason string) {
+	c.mu.Lock()
+	m := ClientAnomalyEventMsg{
+		TypedEvent: TypedEvent{
+			Type: ClientAnomalyEventMsgType,
+		},
+		Client: ClientInfo{
+			Start:   c.start,
+			Host:    c.host,
+			ID:      c.cid,
+			Account: accForClient(c),
+			User:    c.getRawAuthUser(),
+			Name:    c.opts.Name,
+			Lang:    c.opts.Lang,
+			Version: c.opts.Version,
+		},
+		Fingerprint: c.fingerprint,
+		Previous:    prev,
+		Reason:      reason,
+	}
+	accName := c.acc.Name
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	m.ID = s.nextEventID()
+	m.Time = time.Now().UTC()
+	s.sendInternalMsg(fmt.Sprintf(clientAnomalyEventSubj, accName), _EMPTY_, &m.Server, &m)
+}
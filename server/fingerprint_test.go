@@ -0,0 +1,135 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestFingerprintTLSHelloHash(t *testing.T) {
+	hello := &tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+		SupportedPoints:   []uint8{0},
+	}
+	h := tlsHelloHash(hello)
+	// GREASE values vary between connections and are ignored.
+	grease := *hello
+	grease.SupportedVersions = append([]uint16{0x2a2a}, hello.SupportedVersions...)
+	grease.CipherSuites = append([]uint16{0x8a8a}, hello.CipherSuites...)
+	grease.SupportedCurves = append([]tls.CurveID{0xfafa}, hello.SupportedCurves...)
+	if gh := tlsHelloHash(&grease); gh != h {
+		t.Fatalf("Expected same hash with GREASE values, got %q and %q", h, gh)
+	}
+	other := *hello
+	other.CipherSuites = hello.CipherSuites[1:]
+	if oh := tlsHelloHash(&other); oh == h {
+		t.Fatal("Expected different hash for different cipher suites")
+	}
+}
+
+func TestFingerprintNetwork(t *testing.T) {
+	for host, network := range map[string]string{
+		"10.1.2.3":       "10.1.2.0/24",
+		"2001:db8:1:2::": "2001:db8:1::/48",
+		"":               _EMPTY_,
+	} {
+		if n := fingerprintNetwork(host); n != network {
+			t.Fatalf("Expected network of %q to be %q, got %q", host, network, n)
+		}
+	}
+}
+
+func TestFingerprintAnomalyEvents(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		connection_fingerprinting: true
+		accounts {
+			A: { users: [{user: a, password: pwd}] }
+			SYS: { users: [{user: sys, password: pwd}] }
+		}
+		system_account: SYS
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sys := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer sys.Close()
+	sub := natsSubSync(t, sys, fmt.Sprintf(clientAnomalyEventSubj, "A"))
+	natsFlush(t, sys)
+
+	connect := func(lang string) {
+		t.Helper()
+		c, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatalf("Error on dial: %v", err)
+		}
+		defer c.Close()
+		cr := bufio.NewReader(c)
+		if _, err := cr.ReadString('\n'); err != nil {
+			t.Fatalf("Error reading INFO: %v", err)
+		}
+		fmt.Fprintf(c, "CONNECT {\"user\":\"a\",\"pass\":\"pwd\",\"lang\":%q,\"version\":\"1.0.0\",\"protocol\":1,\"verbose\":false}\r\nPING\r\n", lang)
+		if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "PONG") {
+			t.Fatalf("Expected a PONG, got %q", l)
+		}
+	}
+	checkEvent := func(reason, lang, prevLang string) {
+		t.Helper()
+		var ev ClientAnomalyEventMsg
+		if err := json.Unmarshal(natsNexMsg(t, sub, time.Second).Data, &ev); err != nil {
+			t.Fatalf("Error unmarshalling event: %v", err)
+		}
+		if ev.Type != ClientAnomalyEventMsgType || ev.Reason != reason || ev.Client.User != "a" ||
+			ev.Fingerprint == nil || ev.Fingerprint.Lang != lang ||
+			ev.Previous == nil || ev.Previous.Lang != prevLang {
+			t.Fatalf("Unexpected event: %+v", ev)
+		}
+	}
+	checkNoEvent := func() {
+		t.Helper()
+		if msg, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+			t.Fatalf("Unexpected event: %s", msg.Data)
+		}
+	}
+
+	// First connection and same library are not reported.
+	connect("go")
+	connect("go")
+	checkNoEvent()
+
+	connect("python3")
+	checkEvent(AnomalyFingerprintChanged, "python3", "go")
+	checkNoEvent()
+
+	// Pretend the user was only seen from another network.
+	s.fingerprints.Lock()
+	s.fingerprints.users["A a"].networks = []string{"10.0.0.0/24"}
+	s.fingerprints.Unlock()
+	connect("python3")
+	checkEvent(AnomalyNewNetwork, "python3", "python3")
+	checkNoEvent()
+}
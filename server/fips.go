@@ -0,0 +1,176 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// In FIPS 140-3 mode, enabled with the fips option or always when built with
+// a validated crypto module, the server refuses to start with cryptography
+// that is not approved: bcrypt passwords, TLS cipher suites and curves.
+
+// FIPS approved TLS cipher suites.
+var fipsCipherSuites = map[uint16]struct{}{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: {},
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   {},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: {},
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   {},
+	tls.TLS_AES_128_GCM_SHA256:                  {},
+	tls.TLS_AES_256_GCM_SHA384:                  {},
+}
+
+// FIPS approved TLS curves.
+var fipsCurves = map[tls.CurveID]struct{}{
+	tls.CurveP256: {},
+	tls.CurveP384: {},
+	tls.CurveP521: {},
+}
+
+// fipsEnabled returns true if the server runs in FIPS mode.
+func fipsEnabled(o *Options) bool {
+	return o.FIPS || fipsValidatedCrypto
+}
+
+// validateFIPSOptions returns an error for the first option not compliant
+// in FIPS mode.
+func validateFIPSOptions(o *Options) error {
+	if !fipsEnabled(o) {
+		return nil
+	}
+	passwords := map[string]string{
+		"password":           o.Password,
+		"token":              o.Authorization,
+		"cluster password":   o.Cluster.Password,
+		"gateway password":   o.Gateway.Password,
+		"leafnode password":  o.LeafNode.Password,
+		"websocket password": o.Websocket.Password,
+		"websocket token":    o.Websocket.Token,
+	}
+	for what, pwd := range passwords {
+		if isBcrypt(pwd) {
+			return fmt.Errorf("fips mode does not allow bcrypt %s, use a pbkdf2 hash", what)
+		}
+	}
+	for _, users := range [][]*User{o.Users, o.LeafNode.Users} {
+		for _, u := range users {
+			if isBcrypt(u.Password) {
+				return fmt.Errorf("fips mode does not allow bcrypt password of user %q, use a pbkdf2 hash", u.Username)
+			}
+		}
+	}
+
+	tlsConfigs := map[string]*tls.Config{
+		"client":           o.TLSConfig,
+		"cluster":          o.Cluster.TLSConfig,
+		"gateway":          o.Gateway.TLSConfig,
+		"leafnode":         o.LeafNode.TLSConfig,
+		"websocket":        o.Websocket.TLSConfig,
+		"account resolver": o.AccountResolverTLSConfig,
+	}
+	for _, rgw := range o.Gateway.Gateways {
+		tlsConfigs[fmt.Sprintf("gateway %q", rgw.Name)] = rgw.TLSConfig
+	}
+	for i, r := range o.LeafNode.Remotes {
+		tlsConfigs[fmt.Sprintf("leafnode remote %d", i+1)] = r.TLSConfig
+	}
+	for what, tc := range tlsConfigs {
+		if tc == nil {
+			continue
+		}
+		if err := fipsRestrictTLSConfig(tc); err != nil {
+			return fmt.Errorf("fips mode: %s tls: %v", what, err)
+		}
+	}
+	return nil
+}
+
+// fipsRestrictTLSConfig checks that the configured cipher suites and curves
+// are approved, restricting the defaults to the approved ones. Without a
+// validated crypto module, TLS 1.3 cipher suites can not be restricted, so
+// TLS is limited to 1.2.
+func fipsRestrictTLSConfig(tc *tls.Config) error {
+	if tc.MinVersion != 0 && tc.MinVersion < tls.VersionTLS12 {
+		return fmt.Errorf("minimum version lower than 1.2")
+	}
+	if len(tc.CipherSuites) == 0 || sameCipherSuites(tc.CipherSuites, defaultCipherSuites()) {
+		suites := make([]uint16, 0, len(fipsCipherSuites))
+		for _, cs := range defaultCipherSuites() {
+			if _, ok := fipsCipherSuites[cs]; ok {
+				suites = append(suites, cs)
+			}
+		}
+		tc.CipherSuites = suites
+	}
+	for _, cs := range tc.CipherSuites {
+		if _, ok := fipsCipherSuites[cs]; !ok {
+			return fmt.Errorf("cipher suite %s not approved", tls.CipherSuiteName(cs))
+		}
+	}
+	if len(tc.CurvePreferences) == 0 || sameCurves(tc.CurvePreferences, defaultCurvePreferences()) {
+		curves := make([]tls.CurveID, 0, len(fipsCurves))
+		for _, c := range defaultCurvePreferences() {
+			if _, ok := fipsCurves[c]; ok {
+				curves = append(curves, c)
+			}
+		}
+		tc.CurvePreferences = curves
+	}
+	for _, c := range tc.CurvePreferences {
+		if _, ok := fipsCurves[c]; !ok {
+			return fmt.Errorf("curve %v not approved", c)
+		}
+	}
+	if !fipsValidatedCrypto {
+		tc.MaxVersion = tls.VersionTLS12
+	}
+	return nil
+}
+
+func sameCipherSuites(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameCurves(a, b []tls.CurveID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// logFIPSMode reports how FIPS mode is enforced.
+func (s *Server) logFIPSMode() {
+	if !fipsEnabled(s.getOpts()) {
+		return
+	}
+	if fipsValidatedCrypto {
+		s.Noticef("FIPS 140-3 mode, using the validated crypto module")
+	} else {
+		s.Warnf("FIPS 140-3 mode without a validated crypto module, TLS is limited to 1.2 with approved cipher suites")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestPBKDF2Passwords(t *testing.T) {
+	// Test vectors of PBKDF2-HMAC-SHA256.
+	for _, test := range []struct {
+		iterations int
+		key        string
+	}{
+		{1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	} {
+		if key := hex.EncodeToString(pbkdf2SHA256([]byte("password"), []byte("salt"), test.iterations, 32)); key != test.key {
+			t.Fatalf("Unexpected key for %d iterations: %s", test.iterations, key)
+		}
+	}
+
+	if _, err := GeneratePBKDF2Password("pwd", 1); err == nil {
+		t.Fatal("Expected error with too few iterations")
+	}
+	hash, err := GeneratePBKDF2Password("pwd", pbkdf2MinIterations)
+	if err != nil {
+		t.Fatalf("Error generating hash: %v", err)
+	}
+	if !isHashedPassword(hash) || !comparePasswords(hash, "pwd") || comparePasswords(hash, "bad") {
+		t.Fatalf("Unexpected comparison for %q", hash)
+	}
+}
+
+func TestFIPSMode(t *testing.T) {
+	bcrypted := "$2a$11$3kIDaCxw.Glsl1.u5nKa6eUnNDLV5HV9tIuUp7EHhMt6Nm9myW1aS"
+	pbkdf2ed, err := GeneratePBKDF2Password("pwd", pbkdf2MinIterations)
+	if err != nil {
+		t.Fatalf("Error generating hash: %v", err)
+	}
+
+	o := DefaultOptions()
+	o.FIPS = true
+	o.Users = []*User{{Username: "a", Password: bcrypted}}
+	if err := validateOptions(o); err == nil || !strings.Contains(err.Error(), "bcrypt") {
+		t.Fatalf("Expected bcrypt error, got %v", err)
+	}
+
+	// Default cipher suites and curves are restricted.
+	tc, err := GenTLSConfig(&TLSConfigOpts{CertFile: "../test/configs/certs/server-cert.pem", KeyFile: "../test/configs/certs/server-key.pem"})
+	if err != nil {
+		t.Fatalf("Error generating tls config: %v", err)
+	}
+	o.Users[0].Password = pbkdf2ed
+	o.TLSConfig = tc
+	if err := validateOptions(o); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, cs := range tc.CipherSuites {
+		if strings.Contains(tls.CipherSuiteName(cs), "CHACHA20") {
+			t.Fatalf("Unexpected cipher suite: %s", tls.CipherSuiteName(cs))
+		}
+	}
+	for _, c := range tc.CurvePreferences {
+		if c == tls.X25519 {
+			t.Fatal("Unexpected curve X25519")
+		}
+	}
+	if !fipsValidatedCrypto && tc.MaxVersion != tls.VersionTLS12 {
+		t.Fatalf("Unexpected max version: %x", tc.MaxVersion)
+	}
+
+	// But configured ones have to be approved.
+	tc.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305}
+	if err := validateOptions(o); err == nil || !strings.Contains(err.Error(), "not approved") {
+		t.Fatalf("Expected cipher suite error, got %v", err)
+	}
+}
+
+func TestFIPSModePBKDF2User(t *testing.T) {
+	hash, err := GeneratePBKDF2Password("pwd", pbkdf2MinIterations)
+	if err != nil {
+		t.Fatalf("Error generating hash: %v", err)
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		fips: true
+		authorization {
+			users: [{user: a, password: %q}]
+		}
+	`, hash)))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	if !opts.FIPS {
+		t.Fatal("Expected fips mode")
+	}
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"))
+	nc.Close()
+	if _, err := nats.Connect(s.ClientURL(), nats.UserInfo("a", "bad")); err == nil {
+		t.Fatal("Expected connection with bad password to fail")
+	}
+}
@@ -325,7 +325,7 @@ func (s *Server) newGateway(opts *Options) error {
 	gateway.pasi.m = make(map[string]map[string]*sitally)
 
 	if gateway.resolver == nil {
-		gateway.resolver = netResolver(net.DefaultResolver)
+		gateway.resolver = netResolver(s.dnsResolver)
 	}
 
 	// Create remote gateways
@@ -454,7 +454,7 @@ func (s *Server) gatewayAcceptLoop(ch chan struct{}) {
 
 	s.mu.Lock()
 	tlsReq := opts.Gateway.TLSConfig != nil
-	authRequired := opts.Gateway.Username != ""
+	authRequired := opts.Gateway.Username != "" || len(opts.Gateway.Nkeys) > 0
 	info := &Info{
 		ID:           s.info.ID,
 		Name:         opts.ServerName,
@@ -728,8 +728,26 @@ func (s *Server) createGateway(cfg *gatewayCfg, url *url.URL, conn net.Conn) {
 
 	s.gateway.RLock()
 	infoJSON := s.gateway.infoJSON
+	var info Info
+	if !solicit && len(opts.Gateway.Nkeys) > 0 {
+		info = *s.gateway.info
+	}
 	s.gateway.RUnlock()
 
+	// Inbound gateways authenticating with an nkey sign the nonce of
+	// their own INFO protocol.
+	if !solicit && len(opts.Gateway.Nkeys) > 0 {
+		s.mu.Lock()
+		info.Nonce = string(s.generateNonce())
+		s.mu.Unlock()
+		c.nonce = []byte(info.Nonce)
+		b, err := json.Marshal(&info)
+		if err != nil {
+			panic(err)
+		}
+		infoJSON = []byte(fmt.Sprintf(InfoProto, b))
+	}
+
 	// Perform some initialization under the client lock
 	c.mu.Lock()
 	c.initClient()
@@ -807,6 +825,9 @@ func (s *Server) createGateway(cfg *gatewayCfg, url *url.URL, conn net.Conn) {
 		}
 		// Reset the read deadline
 		conn.SetReadDeadline(time.Time{})
+		if !solicit {
+			s.recordTLSHandshake("gateway", conn.ConnectionState().DidResume)
+		}
 
 		// Re-Grab lock
 		c.mu.Lock()
@@ -864,7 +885,7 @@ func (s *Server) createGateway(cfg *gatewayCfg, url *url.URL, conn net.Conn) {
 }
 
 // Builds and sends the CONNECT protocol for a gateway.
-func (c *client) sendGatewayConnect() {
+func (c *client) sendGatewayConnect(nonce string) {
 	tlsRequired := c.gw.cfg.TLSConfig != nil
 	url := c.gw.connectURL
 	c.gw.connectURL = nil
@@ -873,6 +894,14 @@ func (c *client) sendGatewayConnect() {
 		user = userInfo.Username()
 		pass, _ = userInfo.Password()
 	}
+	var nkey, sig string
+	if o := c.srv.getOpts().Gateway; o.NkeySeed != _EMPTY_ || o.Signer != nil {
+		var err error
+		if nkey, sig, err = signNonce(o.Signer, o.NkeySeed, nonce); err != nil {
+			c.Errorf("Error signing gateway nonce: %v", err)
+			return
+		}
+	}
 	cinfo := connectInfo{
 		Verbose:  false,
 		Pedantic: false,
@@ -881,6 +910,8 @@ func (c *client) sendGatewayConnect() {
 		TLS:      tlsRequired,
 		Name:     c.srv.info.ID,
 		Gateway:  c.srv.getGatewayName(),
+		Nkey:     nkey,
+		Sig:      sig,
 	}
 	b, err := json.Marshal(cinfo)
 	if err != nil {
@@ -1022,11 +1053,10 @@ func (c *client) processGatewayInfo(info *Info) {
 
 			supportsHeaders := s.supportsHeaders()
 
-			// Note, if we want to support NKeys, then we would get the nonce
-			// from this INFO protocol and can sign it in the CONNECT we are
-			// going to send now.
+			// The CONNECT signs the nonce of this INFO protocol if we
+			// authenticate with an nkey.
 			c.mu.Lock()
-			c.sendGatewayConnect()
+			c.sendGatewayConnect(info.Nonce)
 			c.Debugf("Gateway connect protocol sent to %q", gwName)
 			// Send INFO too
 			c.enqueueProto(infoJSON)
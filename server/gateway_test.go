@@ -32,6 +32,7 @@ import (
 
 	"github.com/nats-io/nats-server/v2/logger"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 func init() {
@@ -936,6 +937,36 @@ func TestGatewayAuth(t *testing.T) {
 	waitForGatewayFailedConnect(t, s1, "B", true, 2*time.Second)
 }
 
+func TestGatewayNkeyAuth(t *testing.T) {
+	kpA, _ := nkeys.CreateServer()
+	seedA, _ := kpA.Seed()
+	pubA, _ := kpA.PublicKey()
+	kpC, _ := nkeys.CreateServer()
+	seedC, _ := kpC.Seed()
+
+	o2 := testDefaultOptionsForGateway("B")
+	o2.Gateway.Nkeys = []string{pubA}
+	s2 := runGatewayServer(o2)
+	defer s2.Shutdown()
+
+	o1 := testGatewayOptionsFromToWithServers(t, "A", "B", s2)
+	o1.Gateway.NkeySeed = string(seedA)
+	s1 := runGatewayServer(o1)
+	defer s1.Shutdown()
+
+	waitForOutboundGateways(t, s1, 1, time.Second)
+	waitForInboundGateways(t, s2, 1, time.Second)
+
+	s1.Shutdown()
+
+	// An unknown key is rejected.
+	o1.Gateway.NkeySeed = string(seedC)
+	s1 = runGatewayServer(o1)
+	defer s1.Shutdown()
+
+	waitForGatewayFailedConnect(t, s1, "B", true, 2*time.Second)
+}
+
 func TestGatewayTLS(t *testing.T) {
 	o2 := testGatewayOptionsWithTLS(t, "B")
 	s2 := runGatewayServer(o2)
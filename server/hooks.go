@@ -0,0 +1,383 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// LifecycleHooks are Go callbacks an application embedding the server can
+// register to be notified of server events without having to create a
+// client connection and subscribe to the system account.
+// Callbacks are invoked from internal go routines and should not block.
+// Any callback left to nil is simply ignored.
+type LifecycleHooks struct {
+	// ClientConnect is invoked after a client connection has been authenticated.
+	ClientConnect func(ci *ClientInfo)
+	// ClientDisconnect is invoked when a client connection has been closed.
+	ClientDisconnect func(ci *ClientInfo, reason string)
+	// AuthFailure is invoked when a client connection fails authentication.
+	AuthFailure func(ci *ClientInfo)
+	// LameDuckMode is invoked when the server enters lame duck mode.
+	LameDuckMode func()
+	// StreamCreated is invoked when a JetStream stream has been created.
+	StreamCreated func(account string, cfg StreamConfig)
+	// ConsumerCreated is invoked when a JetStream consumer has been created.
+	ConsumerCreated func(account, stream string, cfg ConsumerConfig)
+}
+
+// SetLifecycleHooks registers the given hooks with the server, replacing
+// any previously registered ones. Passing nil removes all hooks.
+func (s *Server) SetLifecycleHooks(hooks *LifecycleHooks) {
+	var h *LifecycleHooks
+	if hooks != nil {
+		hc := *hooks
+		h = &hc
+	}
+	s.mu.Lock()
+	s.hooks = h
+	s.mu.Unlock()
+}
+
+// Returns the registered hooks, possibly nil.
+// Server lock should not be held.
+func (s *Server) lifecycleHooks() *LifecycleHooks {
+	s.mu.Lock()
+	h := s.hooks
+	s.mu.Unlock()
+	return h
+}
+
+// Build the client information passed to the hooks.
+// Client lock should be held.
+func (c *client) hookClientInfo(stop *time.Time) *ClientInfo {
+	ci := &ClientInfo{
+		Start:   c.start,
+		Host:    c.host,
+		ID:      c.cid,
+		Account: accForClient(c),
+		User:    c.getRawAuthUser(),
+		Name:    c.opts.Name,
+		Lang:    c.opts.Lang,
+		Version: c.opts.Version,
+		Stop:    stop,
+	}
+	if stop != nil {
+		ci.RTT = c.getRTT()
+	}
+	return ci
+}
+
+// Invoke the client connect hook if one is registered.
+func (s *Server) clientConnectHook(c *client) {
+	h := s.lifecycleHooks()
+	if h == nil || h.ClientConnect == nil {
+		return
+	}
+	c.mu.Lock()
+	ci := c.hookClientInfo(nil)
+	c.mu.Unlock()
+	h.ClientConnect(ci)
+}
+
+// Invoke the client disconnect hook if one is registered.
+func (s *Server) clientDisconnectHook(c *client, now time.Time, reason string) {
+	h := s.lifecycleHooks()
+	if h == nil || h.ClientDisconnect == nil {
+		return
+	}
+	c.mu.Lock()
+	ci := c.hookClientInfo(&now)
+	c.mu.Unlock()
+	h.ClientDisconnect(ci, reason)
+}
+
+// Invoke the auth failure hook if one is registered.
+func (s *Server) authFailureHook(c *client) {
+	h := s.lifecycleHooks()
+	if h == nil || h.AuthFailure == nil {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	ci := c.hookClientInfo(&now)
+	c.mu.Unlock()
+	h.AuthFailure(ci)
+}
+
+// Invoke the lame duck mode hook if one is registered.
+func (s *Server) lameDuckModeHook() {
+	if h := s.lifecycleHooks(); h != nil && h.LameDuckMode != nil {
+		h.LameDuckMode()
+	}
+}
+
+// Invoke the stream created hook if one is registered.
+func (s *Server) streamCreatedHook(acc *Account, cfg StreamConfig) {
+	if h := s.lifecycleHooks(); h != nil && h.StreamCreated != nil {
+		h.StreamCreated(acc.GetName(), cfg)
+	}
+}
+
+// Invoke the consumer created hook if one is registered.
+func (s *Server) consumerCreatedHook(acc *Account, stream string, cfg ConsumerConfig) {
+	if h := s.lifecycleHooks(); h != nil && h.ConsumerCreated != nil {
+		h.ConsumerCreated(acc.GetName(), stream, cfg)
+	}
+}
+
+// InterceptedMsg is a message published by a client and handed to a
+// MsgInterceptor before being delivered to any subscriber.
+type InterceptedMsg struct {
+	Account string
+	Subject string
+	Reply   string
+	// Header is the raw header block, nil if the message has no headers.
+	Header []byte
+	// Data is the message payload. It must not be modified or retained.
+	Data []byte
+
+	newHdr []byte
+}
+
+// SetHeader replaces the header block of the message. The header needs to
+// be a complete NATS header block, that is start with "NATS/1.0" and end
+// with an empty line.
+func (m *InterceptedMsg) SetHeader(hdr []byte) {
+	m.newHdr = hdr
+}
+
+// MsgInterceptor allows an embedding application to inspect, enrich or
+// reject messages published by clients, before they are routed.
+type MsgInterceptor struct {
+	// Name uniquely identifies the interceptor.
+	Name string
+	// Account restricts the interceptor to this account. Empty means all accounts.
+	Account string
+	// Subject restricts the interceptor to matching subjects, wildcards
+	// are allowed. Empty means all subjects.
+	Subject string
+	// Budget is the maximum time the publisher waits for the handler. If the
+	// handler runs past this limit, the message is delivered unmodified and
+	// the result of the handler, which is then given a copy of the message,
+	// is discarded. Zero means no limit.
+	Budget time.Duration
+	// Handler is invoked for each matching message. Returning an error
+	// rejects the message and the error is reported to the publisher.
+	Handler func(m *InterceptedMsg) error
+}
+
+// MsgInterceptorStats are the metrics collected for a registered interceptor.
+type MsgInterceptorStats struct {
+	Name           string        `json:"name"`
+	Invocations    int64         `json:"invocations"`
+	Rejected       int64         `json:"rejected"`
+	Modified       int64         `json:"modified"`
+	BudgetExceeded int64         `json:"budget_exceeded"`
+	TotalTime      time.Duration `json:"total_time"`
+}
+
+// Internal representation of a registered interceptor.
+type msgInterceptor struct {
+	// Make sure these are 64bits aligned for atomic use.
+	invocations int64
+	rejected    int64
+	modified    int64
+	exceeded    int64
+	totalTime   int64
+	cfg         MsgInterceptor
+}
+
+// Returns the list of registered interceptors. Safe to call without the lock.
+func (s *Server) msgInterceptors() []*msgInterceptor {
+	mis, _ := s.interceptors.Load().([]*msgInterceptor)
+	return mis
+}
+
+// AddMsgInterceptor registers a message interceptor.
+func (s *Server) AddMsgInterceptor(mi *MsgInterceptor) error {
+	if mi == nil || mi.Name == "" {
+		return ErrInterceptorNoName
+	}
+	if mi.Handler == nil {
+		return ErrInterceptorNoHandler
+	}
+	if mi.Subject != "" && !IsValidSubject(mi.Subject) {
+		return ErrBadSubject
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur := s.msgInterceptors()
+	for _, e := range cur {
+		if e.cfg.Name == mi.Name {
+			return ErrInterceptorExists
+		}
+	}
+	// Copy on write so that the publish path does not need any lock.
+	mis := make([]*msgInterceptor, 0, len(cur)+1)
+	mis = append(mis, cur...)
+	mis = append(mis, &msgInterceptor{cfg: *mi})
+	s.interceptors.Store(mis)
+	return nil
+}
+
+// RemoveMsgInterceptor removes the interceptor registered with that name.
+func (s *Server) RemoveMsgInterceptor(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur := s.msgInterceptors()
+	mis := make([]*msgInterceptor, 0, len(cur))
+	for _, e := range cur {
+		if e.cfg.Name != name {
+			mis = append(mis, e)
+		}
+	}
+	if len(mis) == len(cur) {
+		return ErrInterceptorNotFound
+	}
+	s.interceptors.Store(mis)
+	return nil
+}
+
+// MsgInterceptorsStats returns the metrics of all registered interceptors.
+func (s *Server) MsgInterceptorsStats() []*MsgInterceptorStats {
+	mis := s.msgInterceptors()
+	stats := make([]*MsgInterceptorStats, 0, len(mis))
+	for _, mi := range mis {
+		stats = append(stats, &MsgInterceptorStats{
+			Name:           mi.cfg.Name,
+			Invocations:    atomic.LoadInt64(&mi.invocations),
+			Rejected:       atomic.LoadInt64(&mi.rejected),
+			Modified:       atomic.LoadInt64(&mi.modified),
+			BudgetExceeded: atomic.LoadInt64(&mi.exceeded),
+			TotalTime:      time.Duration(atomic.LoadInt64(&mi.totalTime)),
+		})
+	}
+	return stats
+}
+
+// Runs the registered interceptors against the message currently being
+// processed. Returns the possibly rewritten message and false if the
+// message has been rejected, in which case the publisher was notified.
+// Lock should not be held.
+func (c *client) interceptInboundMsg(mis []*msgInterceptor, msg []byte) ([]byte, bool) {
+	var im *InterceptedMsg
+	accName := c.acc.Name
+	subject := string(c.pa.subject)
+
+	for _, mi := range mis {
+		if mi.cfg.Account != "" && mi.cfg.Account != accName {
+			continue
+		}
+		if mi.cfg.Subject != "" && !matchLiteral(subject, mi.cfg.Subject) {
+			continue
+		}
+		if im == nil {
+			im = &InterceptedMsg{Account: accName, Subject: subject, Reply: string(c.pa.reply)}
+			if c.pa.hdr > 0 {
+				im.Header = msg[:c.pa.hdr]
+				im.Data = msg[c.pa.hdr : len(msg)-LEN_CR_LF]
+			} else {
+				im.Data = msg[:len(msg)-LEN_CR_LF]
+			}
+		}
+		im.newHdr = nil
+
+		start := time.Now()
+		var err error
+		inBudget := true
+		if mi.cfg.Budget > 0 {
+			inBudget, err = mi.handleWithinBudget(im)
+		} else {
+			err = mi.cfg.Handler(im)
+		}
+		elapsed := time.Since(start)
+
+		atomic.AddInt64(&mi.invocations, 1)
+		atomic.AddInt64(&mi.totalTime, int64(elapsed))
+		if !inBudget {
+			atomic.AddInt64(&mi.exceeded, 1)
+			c.Warnf("Message interceptor %q exceeded its budget of %v, message delivered unmodified",
+				mi.cfg.Name, mi.cfg.Budget)
+			continue
+		}
+		if err == nil && im.newHdr != nil {
+			var nmsg []byte
+			if nmsg, err = c.setInboundMsgHeader(im.newHdr, im.Data); err == nil {
+				atomic.AddInt64(&mi.modified, 1)
+				msg = nmsg
+				im.Header = msg[:c.pa.hdr]
+				im.Data = msg[c.pa.hdr : len(msg)-LEN_CR_LF]
+			}
+		}
+		if err != nil {
+			atomic.AddInt64(&mi.rejected, 1)
+			// Reported as a permission violation so that clients do not
+			// treat it as a fatal protocol error.
+			c.sendErrAndDebug(fmt.Sprintf("Permissions Violation for Publish to %q, Message Rejected: %v", subject, err))
+			return nil, false
+		}
+	}
+	return msg, true
+}
+
+// Runs the handler for at most the budget of the interceptor. Returns false
+// if the budget was exceeded, the handler then keeps running on its own copy
+// of the message, since the buffers of the original are reused.
+func (mi *msgInterceptor) handleWithinBudget(im *InterceptedMsg) (bool, error) {
+	cm := &InterceptedMsg{
+		Account: im.Account,
+		Subject: im.Subject,
+		Reply:   im.Reply,
+		Header:  append([]byte(nil), im.Header...),
+		Data:    append([]byte(nil), im.Data...),
+	}
+	done := make(chan error, 1)
+	go func() { done <- mi.cfg.Handler(cm) }()
+
+	t := time.NewTimer(mi.cfg.Budget)
+	defer t.Stop()
+	select {
+	case err := <-done:
+		im.newHdr = cm.newHdr
+		return true, err
+	case <-t.C:
+		return false, nil
+	}
+}
+
+// Replaces the header block of the inbound message. Returns the new
+// message and updates the pub arguments accordingly.
+func (c *client) setInboundMsgHeader(hdr, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(hdr, []byte("NATS/1.0")) || !bytes.HasSuffix(hdr, []byte(_CRLF_+_CRLF_)) {
+		return nil, ErrBadMsgHeader
+	}
+	size := len(hdr) + len(data)
+	if mp := atomic.LoadInt32(&c.mpay); mp > 0 && int64(size) > int64(mp) {
+		return nil, ErrMaxPayload
+	}
+	buf := make([]byte, 0, size+LEN_CR_LF)
+	buf = append(buf, hdr...)
+	buf = append(buf, data...)
+	buf = append(buf, _CRLF_...)
+	c.pa.hdr = len(hdr)
+	c.pa.hdb = []byte(strconv.Itoa(c.pa.hdr))
+	c.pa.size = size
+	c.pa.szb = []byte(strconv.Itoa(size))
+	return buf, nil
+}
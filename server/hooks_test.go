@@ -0,0 +1,248 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestLifecycleHooksClientEvents(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Users = []*User{{Username: "derek", Password: "foo"}}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	connCh := make(chan *ClientInfo, 1)
+	discCh := make(chan string, 1)
+	authCh := make(chan *ClientInfo, 1)
+	s.SetLifecycleHooks(&LifecycleHooks{
+		ClientConnect:    func(ci *ClientInfo) { connCh <- ci },
+		ClientDisconnect: func(ci *ClientInfo, reason string) { discCh <- reason },
+		AuthFailure:      func(ci *ClientInfo) { authCh <- ci },
+	})
+
+	nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("derek", "foo"), nats.Name("hooks"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	select {
+	case ci := <-connCh:
+		if ci.User != "derek" || ci.Name != "hooks" {
+			t.Fatalf("Unexpected client info: %+v", ci)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Connect hook not invoked")
+	}
+	nc.Close()
+	select {
+	case reason := <-discCh:
+		if reason != ClientClosed.String() {
+			t.Fatalf("Unexpected reason: %q", reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Disconnect hook not invoked")
+	}
+
+	if nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("derek", "bar")); err == nil {
+		nc.Close()
+		t.Fatalf("Expected auth error")
+	}
+	select {
+	case ci := <-authCh:
+		if ci.User != "derek" {
+			t.Fatalf("Unexpected client info: %+v", ci)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Auth failure hook not invoked")
+	}
+
+	// Removing hooks should stop notifications.
+	s.SetLifecycleHooks(nil)
+	nc, err = nats.Connect(s.ClientURL(), nats.UserInfo("derek", "foo"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+	select {
+	case <-connCh:
+		t.Fatalf("Connect hook should not have been invoked")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLifecycleHooksJetStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.Cluster.Port = 0
+	opts.JetStream = true
+	opts.StoreDir = dir
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	streamCh := make(chan string, 1)
+	consCh := make(chan string, 1)
+	s.SetLifecycleHooks(&LifecycleHooks{
+		StreamCreated: func(acc string, cfg StreamConfig) {
+			streamCh <- acc + ":" + cfg.Name
+		},
+		ConsumerCreated: func(acc, stream string, cfg ConsumerConfig) {
+			consCh <- acc + ":" + stream + ":" + cfg.Durable
+		},
+	})
+
+	acc := s.GlobalAccount()
+	mset, err := acc.AddStream(&StreamConfig{Name: "ORDERS", Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+	if v := <-streamCh; v != "$G:ORDERS" {
+		t.Fatalf("Unexpected stream hook value: %q", v)
+	}
+	o, err := mset.AddConsumer(&ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.Delete()
+	if v := <-consCh; v != "$G:ORDERS:dlc" {
+		t.Fatalf("Unexpected consumer hook value: %q", v)
+	}
+}
+
+func TestLifecycleHooksLameDuckMode(t *testing.T) {
+	opts := DefaultOptions()
+	opts.LameDuckDuration = 100 * time.Millisecond
+	opts.LameDuckGracePeriod = 50 * time.Millisecond
+	s := RunServer(opts)
+
+	ldmCh := make(chan struct{}, 1)
+	s.SetLifecycleHooks(&LifecycleHooks{LameDuckMode: func() { ldmCh <- struct{}{} }})
+	// Lame duck mode shuts the server down when done.
+	go s.lameDuckMode()
+	defer s.WaitForShutdown()
+	select {
+	case <-ldmCh:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Lame duck mode hook not invoked")
+	}
+}
+
+func TestMsgInterceptor(t *testing.T) {
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+
+	if err := s.AddMsgInterceptor(&MsgInterceptor{Name: "bad"}); err != ErrInterceptorNoHandler {
+		t.Fatalf("Expected error %v, got %v", ErrInterceptorNoHandler, err)
+	}
+	err := s.AddMsgInterceptor(&MsgInterceptor{
+		Name:    "validate",
+		Subject: "orders.>",
+		Handler: func(m *InterceptedMsg) error {
+			if string(m.Data) == "bad" {
+				return fmt.Errorf("payload not valid")
+			}
+			m.SetHeader([]byte("NATS/1.0\r\nValidated: yes\r\n\r\n"))
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error adding interceptor: %v", err)
+	}
+	if err := s.AddMsgInterceptor(&MsgInterceptor{Name: "validate", Handler: func(*InterceptedMsg) error { return nil }}); err != ErrInterceptorExists {
+		t.Fatalf("Expected error %v, got %v", ErrInterceptorExists, err)
+	}
+
+	errCh := make(chan error, 1)
+	nc := natsConnect(t, s.ClientURL(), nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		errCh <- err
+	}))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "orders.*")
+
+	natsPub(t, nc, "orders.new", []byte("bad"))
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "payload not valid") {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Did not get the rejection error")
+	}
+	if _, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Rejected message should not have been delivered: %v", err)
+	}
+
+	natsPub(t, nc, "orders.new", []byte("good"))
+	m := natsNexMsg(t, sub, time.Second)
+	if string(m.Data) != "good" || m.Header.Get("Validated") != "yes" {
+		t.Fatalf("Unexpected message: %q %v", m.Data, m.Header)
+	}
+
+	stats := s.MsgInterceptorsStats()
+	if len(stats) != 1 {
+		t.Fatalf("Expected 1 interceptor stats, got %v", len(stats))
+	}
+	if st := stats[0]; st.Invocations != 2 || st.Rejected != 1 || st.Modified != 1 {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+
+	if err := s.RemoveMsgInterceptor("validate"); err != nil {
+		t.Fatalf("Error removing interceptor: %v", err)
+	}
+	natsPub(t, nc, "orders.new", []byte("bad"))
+	if m := natsNexMsg(t, sub, time.Second); string(m.Data) != "bad" {
+		t.Fatalf("Unexpected message: %q", m.Data)
+	}
+}
+
+func TestMsgInterceptorBudget(t *testing.T) {
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+
+	err := s.AddMsgInterceptor(&MsgInterceptor{
+		Name:   "slow",
+		Budget: 10 * time.Millisecond,
+		Handler: func(m *InterceptedMsg) error {
+			time.Sleep(2 * time.Second)
+			m.SetHeader([]byte("NATS/1.0\r\nX: 1\r\n\r\n"))
+			return fmt.Errorf("too late")
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error adding interceptor: %v", err)
+	}
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "foo")
+	// The message is not held for longer than the budget.
+	natsPub(t, nc, "foo", []byte("hello"))
+	if m := natsNexMsg(t, sub, time.Second); string(m.Data) != "hello" || m.Header != nil {
+		t.Fatalf("Unexpected message: %+v", m)
+	}
+	if st := s.MsgInterceptorsStats()[0]; st.BudgetExceeded != 1 || st.Rejected != 0 {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// A stream with an idempotency configuration remembers the Nats-Msg-Id
+// header of the messages it stored, for as long as configured, and does not
+// store a message again when its id was already seen. The publisher is
+// acknowledged with the sequence of the original message, flagged as a
+// duplicate. Ids are unique in the whole stream, per subject or per
+// publisher. For file based streams, the ids are persisted so that they
+// survive restarts.
+
+// JSMsgId is the header of the idempotency key of a message.
+const JSMsgId = "Nats-Msg-Id"
+
+// IdempotencyScope is the scope in which message ids are unique.
+type IdempotencyScope string
+
+const (
+	// IdempotencyStream makes ids unique in the whole stream.
+	IdempotencyStream IdempotencyScope = "stream"
+	// IdempotencySubject makes ids unique per subject.
+	IdempotencySubject IdempotencyScope = "subject"
+	// IdempotencyPublisher makes ids unique per authenticated publisher.
+	IdempotencyPublisher IdempotencyScope = "publisher"
+)
+
+// IdempotencyConfig is the idempotency configuration of a stream.
+type IdempotencyConfig struct {
+	Scope IdempotencyScope `json:"scope,omitempty"`
+	// TTL is how long ids are remembered, forever if not set.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// MaxKeys is the maximum number of ids remembered, the oldest being
+	// forgotten first, unlimited if not set.
+	MaxKeys int `json:"max_keys,omitempty"`
+}
+
+// Name of the file of the ids of a file based stream.
+const idempotencyFile = "idempotency.log"
+
+// Number of forgotten records after which the file is rewritten.
+const idempotencyCompactThreshold = 4096
+
+// errDuplicateMsg is returned when a message id was already stored.
+var errDuplicateMsg = errors.New("duplicate message id")
+
+// checkIdempotencyCfg validates the configuration and sets defaults.
+func checkIdempotencyCfg(cfg *IdempotencyConfig) error {
+	switch cfg.Scope {
+	case _EMPTY_:
+		cfg.Scope = IdempotencyStream
+	case IdempotencyStream, IdempotencySubject, IdempotencyPublisher:
+	default:
+		return fmt.Errorf("idempotency scope must be %q, %q or %q", IdempotencyStream, IdempotencySubject, IdempotencyPublisher)
+	}
+	if cfg.TTL < 0 || cfg.MaxKeys < 0 {
+		return fmt.Errorf("idempotency ttl and max keys can not be negative")
+	}
+	return nil
+}
+
+// idempotencyEntry is a remembered id, also the record of the file.
+type idempotencyEntry struct {
+	Key string `json:"k"`
+	Seq uint64 `json:"s"`
+	TS  int64  `json:"t"`
+}
+
+// idempotencyIndex remembers the ids of the messages of a stream.
+type idempotencyIndex struct {
+	mu   sync.Mutex
+	cfg  IdempotencyConfig
+	keys map[string]*idempotencyEntry
+	// Entries from oldest to newest, replaced ones being nil.
+	order []*idempotencyEntry
+	// Records in the file, remembered or not.
+	records int
+	file    *os.File
+	fn      string
+}
+
+// newIdempotencyIndex returns the index of the stream, loading the ids of
+// the directory if set.
+func newIdempotencyIndex(cfg IdempotencyConfig, dir string) (*idempotencyIndex, error) {
+	ix := &idempotencyIndex{cfg: cfg, keys: make(map[string]*idempotencyEntry)}
+	if dir == _EMPTY_ {
+		return ix, nil
+	}
+	ix.fn = path.Join(dir, idempotencyFile)
+	if f, err := os.Open(ix.fn); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 4096), 1<<20)
+		for scanner.Scan() {
+			var e idempotencyEntry
+			// Skip a partial last record.
+			if json.Unmarshal(scanner.Bytes(), &e) == nil {
+				ix.add(&e)
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not open idempotency index: %v", err)
+	}
+	ix.expire(time.Now().UnixNano())
+	if err := ix.rewrite(); err != nil {
+		return nil, err
+	}
+	return ix, nil
+}
+
+// lookup returns the sequence of the message with the key, if remembered.
+// Lock should be held.
+func (ix *idempotencyIndex) lookup(key string, now int64) (uint64, bool) {
+	ix.expire(now)
+	if e, ok := ix.keys[key]; ok {
+		return e.Seq, true
+	}
+	return 0, false
+}
+
+// store remembers the key of a stored message.
+// Lock should be held.
+func (ix *idempotencyIndex) store(key string, seq uint64, now int64) error {
+	e := &idempotencyEntry{Key: key, Seq: seq, TS: now}
+	ix.add(e)
+	ix.expire(now)
+	if ix.file == nil {
+		return nil
+	}
+	if forgotten := ix.records - len(ix.keys); forgotten > idempotencyCompactThreshold && forgotten > len(ix.keys) {
+		return ix.rewrite()
+	}
+	b, _ := json.Marshal(e)
+	ix.records++
+	_, err := ix.file.Write(append(b, '\n'))
+	return err
+}
+
+// add remembers the entry, replacing one with the same key.
+func (ix *idempotencyIndex) add(e *idempotencyEntry) {
+	if old, ok := ix.keys[e.Key]; ok {
+		ix.forget(old)
+	}
+	ix.keys[e.Key] = e
+	ix.order = append(ix.order, e)
+}
+
+// forget removes the entry from the order of entries.
+func (ix *idempotencyIndex) forget(e *idempotencyEntry) {
+	for i, oe := range ix.order {
+		if oe == e {
+			ix.order[i] = nil
+			return
+		}
+	}
+}
+
+// expire forgets the entries older than the ttl and the oldest ones over
+// the maximum number of keys.
+func (ix *idempotencyIndex) expire(now int64) {
+	var i int
+	for ; i < len(ix.order); i++ {
+		e := ix.order[i]
+		if e == nil {
+			continue
+		}
+		expired := ix.cfg.TTL > 0 && now-e.TS >= int64(ix.cfg.TTL)
+		if !expired && (ix.cfg.MaxKeys == 0 || len(ix.keys) <= ix.cfg.MaxKeys) {
+			break
+		}
+		delete(ix.keys, e.Key)
+	}
+	if i > 0 {
+		ix.order = append(ix.order[:0], ix.order[i:]...)
+	}
+}
+
+// rewrite replaces the file with the remembered entries.
+func (ix *idempotencyIndex) rewrite() error {
+	if ix.fn == _EMPTY_ {
+		return nil
+	}
+	if ix.file != nil {
+		ix.file.Close()
+		ix.file = nil
+	}
+	tmp := ix.fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("could not write idempotency index: %v", err)
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range ix.order {
+		if e != nil {
+			b, _ := json.Marshal(e)
+			w.Write(append(b, '\n'))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write idempotency index: %v", err)
+	}
+	f.Close()
+	if err := os.Rename(tmp, ix.fn); err != nil {
+		return fmt.Errorf("could not write idempotency index: %v", err)
+	}
+	ix.records = len(ix.keys)
+	ix.file, err = os.OpenFile(ix.fn, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// close closes the file of the index.
+func (ix *idempotencyIndex) close() {
+	ix.mu.Lock()
+	if ix.file != nil {
+		ix.file.Close()
+		ix.file = nil
+	}
+	ix.mu.Unlock()
+}
+
+// idempotencyKey returns the key of the message id in the scope of the
+// index, or an empty key if the message has no id.
+func (ix *idempotencyIndex) idempotencyKey(subject, publisher string, hdr []byte) string {
+	if len(hdr) == 0 {
+		return _EMPTY_
+	}
+	id := getHeader(JSMsgId, hdr)
+	if len(id) == 0 {
+		return _EMPTY_
+	}
+	switch ix.cfg.Scope {
+	case IdempotencySubject:
+		return subject + " " + string(id)
+	case IdempotencyPublisher:
+		return publisher + " " + string(id)
+	}
+	return string(id)
+}
+
+// publisherID returns the identity of the publisher for idempotency keys,
+// as its account and user, nkey or JWT public key.
+func publisherID(c *client) string {
+	if c == nil {
+		return _EMPTY_
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var acc string
+	if c.acc != nil {
+		acc = c.acc.Name
+	}
+	switch {
+	case c.opts.Nkey != _EMPTY_:
+		return acc + "/" + c.opts.Nkey
+	case c.opts.Username != _EMPTY_:
+		return acc + "/" + c.opts.Username
+	case c.opts.JWT != _EMPTY_:
+		return acc + "/" + c.pubKey
+	}
+	return acc
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nkeys"
+)
+
+// With sign_identity, the INFO sent to clients and leafnodes carries an
+// identity assertion of the server, signed with the nkey whose public key
+// is the server ID. It holds the cluster of the server, the time it was
+// issued and the nonce of the INFO, if any. This lets clients and leafnodes
+// check that they are connected to a known server even when TLS is
+// terminated by an intermediary. Leafnode remotes with trusted_servers only
+// accept the servers of the list, with an assertion issued within
+// serverIdentityMaxSkew, so that a captured INFO can only be replayed for
+// that long.
+
+// ServerIdentity is the identity asserted by a server in its INFO.
+type ServerIdentity struct {
+	ServerID string `json:"server_id"`
+	Cluster  string `json:"cluster,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	IssuedAt int64  `json:"iat"`
+}
+
+// Maximum difference between the time an identity assertion was issued and
+// the time it is verified.
+const serverIdentityMaxSkew = 30 * time.Second
+
+var (
+	// ErrServerIdentityInvalid is returned for malformed identity assertions
+	// and the ones whose signature does not verify.
+	ErrServerIdentityInvalid = errors.New("server identity is invalid")
+
+	// ErrServerIdentityUntrusted is returned when the server is not trusted.
+	ErrServerIdentityUntrusted = errors.New("server identity is not trusted")
+)
+
+// signIdentity returns the identity assertion of the server for an INFO
+// with the nonce.
+func (s *Server) signIdentity(cluster, nonce string) (string, error) {
+	id := &ServerIdentity{ServerID: s.info.ID, Cluster: cluster, Nonce: nonce, IssuedAt: time.Now().Unix()}
+	return signServerIdentity(s.kp, id)
+}
+
+// signServerIdentity encodes the identity and signs it with the signer.
+func signServerIdentity(signer Signer, id *ServerIdentity) (string, error) {
+	b, err := json.Marshal(id)
+	if err != nil {
+		return _EMPTY_, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	sig, err := signer.Sign([]byte(payload))
+	if err != nil {
+		return _EMPTY_, err
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// setIdentity sets the identity assertion of the INFO when enabled.
+func (s *Server) setIdentity(info *Info) {
+	if !s.getOpts().SignIdentity {
+		return
+	}
+	identity, err := s.signIdentity(info.Cluster, info.Nonce)
+	if err != nil {
+		s.Errorf("Error signing server identity: %v", err)
+		return
+	}
+	info.Identity = identity
+}
+
+// VerifyServerIdentity verifies the signature of the identity assertion of
+// an INFO and returns the identity. It is up to the caller to check that
+// the server is trusted, and the nonce and time of the assertion.
+func VerifyServerIdentity(identity string) (*ServerIdentity, error) {
+	i := strings.IndexByte(identity, '.')
+	if i < 0 {
+		return nil, ErrServerIdentityInvalid
+	}
+	payload := identity[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(identity[i+1:])
+	if err != nil {
+		return nil, ErrServerIdentityInvalid
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrServerIdentityInvalid
+	}
+	id := &ServerIdentity{}
+	if err := json.Unmarshal(b, id); err != nil {
+		return nil, ErrServerIdentityInvalid
+	}
+	pub, err := nkeys.FromPublicKey(id.ServerID)
+	if err != nil || !nkeys.IsValidPublicServerKey(id.ServerID) {
+		return nil, ErrServerIdentityInvalid
+	}
+	if err := pub.Verify([]byte(payload), sig); err != nil {
+		return nil, ErrServerIdentityInvalid
+	}
+	return id, nil
+}
+
+// verifyServerIdentity checks that the INFO of the server the leafnode
+// remote connected to carries a valid identity of one of its trusted
+// servers, for the nonce of the INFO, issued around now.
+func verifyServerIdentity(info *Info, trusted []string, now time.Time) error {
+	if info.Identity == _EMPTY_ {
+		return ErrServerIdentityUntrusted
+	}
+	id, err := VerifyServerIdentity(info.Identity)
+	if err != nil {
+		return err
+	}
+	if id.ServerID != info.ID || id.Nonce != info.Nonce {
+		return ErrServerIdentityInvalid
+	}
+	if d := now.Sub(time.Unix(id.IssuedAt, 0)); d > serverIdentityMaxSkew || d < -serverIdentityMaxSkew {
+		return ErrServerIdentityInvalid
+	}
+	for _, pub := range trusted {
+		if pub == id.ServerID {
+			return nil
+		}
+	}
+	return ErrServerIdentityUntrusted
+}
+
+func validateServerIdentityOptions(o *Options) error {
+	for _, r := range o.LeafNode.Remotes {
+		for _, pub := range r.TrustedServers {
+			if !nkeys.IsValidPublicServerKey(pub) {
+				return fmt.Errorf("leafnode remote trusted server %q is not a valid public server key", pub)
+			}
+		}
+	}
+	return nil
+}
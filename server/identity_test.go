@@ -0,0 +1,113 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nkeys"
+)
+
+func TestServerIdentity(t *testing.T) {
+	opts := DefaultOptions()
+	opts.SignIdentity = true
+	opts.LeafNode.Host = "127.0.0.1"
+	opts.LeafNode.Port = -1
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", opts.Port))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	l, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+	var info Info
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(l, "INFO ")), &info); err != nil {
+		t.Fatalf("Error decoding INFO: %v", err)
+	}
+	id, err := VerifyServerIdentity(info.Identity)
+	if err != nil {
+		t.Fatalf("Error verifying identity: %v", err)
+	}
+	if id.ServerID != s.ID() || time.Since(time.Unix(id.IssuedAt, 0)) > time.Minute {
+		t.Fatalf("Unexpected identity: %+v", id)
+	}
+	// Tampered assertions do not verify.
+	other, _ := nkeys.CreateServer()
+	otherPub, _ := other.PublicKey()
+	forged := strings.Replace(info.Identity, info.Identity[:4], "eyJa", 1)
+	if _, err := VerifyServerIdentity(forged); err != ErrServerIdentityInvalid {
+		t.Fatalf("Expected invalid identity, got %v", err)
+	}
+
+	// Assertions issued too long ago, or in the future, are replays.
+	kp, _ := nkeys.CreateServer()
+	pub, _ := kp.PublicKey()
+	now := time.Now()
+	for _, iat := range []time.Time{now, now.Add(-time.Hour), now.Add(time.Hour)} {
+		identity, err := signServerIdentity(kp, &ServerIdentity{ServerID: pub, Nonce: "nonce", IssuedAt: iat.Unix()})
+		if err != nil {
+			t.Fatalf("Error signing identity: %v", err)
+		}
+		err = verifyServerIdentity(&Info{ID: pub, Nonce: "nonce", Identity: identity}, []string{pub}, now)
+		if iat.Equal(now) && err != nil {
+			t.Fatalf("Error verifying identity: %v", err)
+		} else if !iat.Equal(now) && err != ErrServerIdentityInvalid {
+			t.Fatalf("Expected invalid identity for %v, got %v", iat, err)
+		}
+	}
+
+	u, _ := url.Parse(fmt.Sprintf("nats://127.0.0.1:%d", opts.LeafNode.Port))
+	lopts := DefaultOptions()
+	lopts.LeafNode.ReconnectInterval = 15 * time.Millisecond
+	lopts.LeafNode.Remotes = []*RemoteLeafOpts{{URLs: []*url.URL{u}, TrustedServers: []string{s.ID()}}}
+	ln := RunServer(lopts)
+	defer ln.Shutdown()
+	checkLeafNodeConnected(t, ln)
+
+	lopts = DefaultOptions()
+	lopts.LeafNode.ReconnectInterval = 15 * time.Millisecond
+	lopts.LeafNode.Remotes = []*RemoteLeafOpts{{URLs: []*url.URL{u}, TrustedServers: []string{otherPub}}}
+	ln2 := RunServer(lopts)
+	defer ln2.Shutdown()
+	l2 := &captureErrorLogger{errCh: make(chan string, 10)}
+	ln2.SetLogger(l2, false, false)
+	select {
+	case e := <-l2.errCh:
+		if !strings.Contains(e, ErrServerIdentityUntrusted.Error()) {
+			t.Fatalf("Expected untrusted server error, got %s", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected an error about the untrusted server")
+	}
+	if n := ln2.NumLeafNodes(); n != 0 {
+		t.Fatalf("Expected no leafnode connection, got %d", n)
+	}
+
+	lopts.LeafNode.Remotes[0].TrustedServers = []string{"bad"}
+	if err := validateServerIdentityOptions(lopts); err == nil {
+		t.Fatal("Expected error for invalid trusted server key")
+	}
+}
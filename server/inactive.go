@@ -0,0 +1,122 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// How often client connections are checked for inactivity.
+var inactiveClientCheckInterval = 30 * time.Second
+
+// ClientInactiveEventMsg is sent when a client connection is closed
+// because it had no subscription and did not publish for too long.
+type ClientInactiveEventMsg struct {
+	TypedEvent
+	Server   ServerInfo    `json:"server"`
+	Client   ClientInfo    `json:"client"`
+	Inactive time.Duration `json:"inactive"`
+}
+
+// ClientInactiveEventMsgType is the schema type for ClientInactiveEventMsg
+const ClientInactiveEventMsgType = "io.nats.server.advisory.v1.client_inactive"
+
+// startInactiveClientCheck will periodically close inactive client connections.
+func (s *Server) startInactiveClientCheck() {
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		t := time.NewTicker(inactiveClientCheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.checkInactiveClients()
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+// checkInactiveClients closes the client connections without subscriptions
+// whose last activity is older than the timeout of their account, or the
+// server's one.
+func (s *Server) checkInactiveClients() {
+	timeout := s.getOpts().InactiveClientTimeout
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	now := time.Now()
+	for _, c := range clients {
+		c.mu.Lock()
+		acc, last, subs := c.acc, c.last, len(c.subs)
+		c.mu.Unlock()
+		if c.kind != CLIENT || acc == nil || subs > 0 {
+			continue
+		}
+		ttl := timeout
+		acc.mu.RLock()
+		if acc.inactive > 0 {
+			ttl = acc.inactive
+		}
+		acc.mu.RUnlock()
+		if ttl <= 0 || last.IsZero() || now.Sub(last) < ttl {
+			continue
+		}
+		inactive := now.Sub(last)
+		c.Debugf("Closing connection inactive for %v", inactive)
+		s.sendClientInactiveEvent(c, acc, inactive)
+		c.closeConnection(InactivityTimeout)
+	}
+}
+
+// sendClientInactiveEvent sends an advisory for a client connection about
+// to be closed for inactivity.
+func (s *Server) sendClientInactiveEvent(c *client, acc *Account, inactive time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	eid := s.nextEventID()
+
+	c.mu.Lock()
+	m := ClientInactiveEventMsg{
+		TypedEvent: TypedEvent{
+			Type: ClientInactiveEventMsgType,
+			ID:   eid,
+			Time: time.Now().UTC(),
+		},
+		Client: ClientInfo{
+			Start:   c.start,
+			Host:    c.host,
+			ID:      c.cid,
+			Account: accForClient(c),
+			User:    c.getRawAuthUser(),
+			Name:    c.opts.Name,
+			Lang:    c.opts.Lang,
+			Version: c.opts.Version,
+		},
+		Inactive: inactive,
+	}
+	c.mu.Unlock()
+
+	s.sendInternalMsg(fmt.Sprintf(inactiveEventSubj, acc.Name), _EMPTY_, &m.Server, &m)
+}
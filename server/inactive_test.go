@@ -0,0 +1,98 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestInactiveClientTimeout(t *testing.T) {
+	orgInterval := inactiveClientCheckInterval
+	inactiveClientCheckInterval = 25 * time.Millisecond
+	defer func() { inactiveClientCheckInterval = orgInterval }()
+
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		inactive_client_timeout: "1h"
+		accounts {
+			A: { users: [{user: a, password: pwd}], inactive_client_timeout: "250ms" }
+			B: { users: [{user: b, password: pwd}] }
+			SYS: { users: [{user: sys, password: pwd}] }
+		}
+		system_account: SYS
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	if opts.InactiveClientTimeout != time.Hour {
+		t.Fatalf("Unexpected timeout: %v", opts.InactiveClientTimeout)
+	}
+
+	sys := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer sys.Close()
+	sub := natsSubSync(t, sys, fmt.Sprintf(inactiveEventSubj, "A"))
+	natsFlush(t, sys)
+
+	closed := make(chan struct{}, 1)
+	idle := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"), nats.NoReconnect(),
+		nats.ClosedHandler(func(_ *nats.Conn) { closed <- struct{}{} }))
+	defer idle.Close()
+	subscriber := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"))
+	defer subscriber.Close()
+	natsSubSync(t, subscriber, "foo")
+	natsFlush(t, subscriber)
+	other := natsConnect(t, s.ClientURL(), nats.UserInfo("b", "pwd"))
+	defer other.Close()
+
+	var ev ClientInactiveEventMsg
+	if err := json.Unmarshal(natsNexMsg(t, sub, 2*time.Second).Data, &ev); err != nil {
+		t.Fatalf("Error unmarshalling advisory: %v", err)
+	}
+	if ev.Type != ClientInactiveEventMsgType || ev.Client.Account != "A" || ev.Inactive < 250*time.Millisecond {
+		t.Fatalf("Unexpected advisory: %+v", ev)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Inactive connection should have been closed")
+	}
+
+	// Connections with subscriptions or in other accounts are kept.
+	time.Sleep(300 * time.Millisecond)
+	if !subscriber.IsConnected() || !other.IsConnected() {
+		t.Fatal("Active connections should not have been closed")
+	}
+	if _, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected a single advisory, got %v", err)
+	}
+
+	var reason string
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		conns := s.closedClients()
+		if len(conns) == 0 {
+			return fmt.Errorf("no closed connection")
+		}
+		reason = conns[len(conns)-1].Reason
+		return nil
+	})
+	if reason != InactivityTimeout.String() {
+		t.Fatalf("Unexpected reason: %q", reason)
+	}
+}
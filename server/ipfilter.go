@@ -0,0 +1,199 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPFilterOpts are CIDR based allow and deny lists of remote IPs. Denied
+// IPs are always rejected and, if the allow list is not empty, only the
+// IPs in it are accepted. Plain IPs are accepted as single host ranges.
+//
+// Filters are enforced when accepting connections on the client ("client"),
+// websocket ("websocket") and leafnode ("leafnode") listeners, and when
+// clients and leafnodes bind to an account.
+type IPFilterOpts struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// compile parses the allow and deny lists.
+func (f *IPFilterOpts) compile() error {
+	parse := func(list []string) ([]*net.IPNet, error) {
+		nets := make([]*net.IPNet, 0, len(list))
+		for _, s := range list {
+			if !strings.Contains(s, "/") {
+				ip := net.ParseIP(s)
+				if ip == nil {
+					return nil, fmt.Errorf("invalid IP %q", s)
+				}
+				bits := net.IPv6len * 8
+				if ip4 := ip.To4(); ip4 != nil {
+					ip, bits = ip4, net.IPv4len*8
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, n)
+		}
+		return nets, nil
+	}
+	var err error
+	if f.allow, err = parse(f.Allow); err != nil {
+		return err
+	}
+	f.deny, err = parse(f.Deny)
+	return err
+}
+
+// allowed returns true if the IP passes the filter.
+func (f *IPFilterOpts) allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateIPFilterOptions checks the listener names and parses the filters.
+func validateIPFilterOptions(o *Options) error {
+	for listener, f := range o.IPFilters {
+		switch listener {
+		case MaintenanceClient, MaintenanceWebsocket, MaintenanceLeafNode:
+		default:
+			return fmt.Errorf("unknown listener %q for ip filter", listener)
+		}
+		if err := f.compile(); err != nil {
+			return fmt.Errorf("%s ip filter: %v", listener, err)
+		}
+	}
+	return nil
+}
+
+// validateAllowedConnections parses the networks users are allowed to
+// connect from.
+func validateAllowedConnections(o *Options) error {
+	for _, u := range o.Users {
+		if err := (&IPFilterOpts{Allow: u.AllowedConnections}).compile(); err != nil {
+			return fmt.Errorf("allowed connections of user %q: %v", u.Username, err)
+		}
+	}
+	for _, u := range o.Nkeys {
+		if err := (&IPFilterOpts{Allow: u.AllowedConnections}).compile(); err != nil {
+			return fmt.Errorf("allowed connections of nkey %q: %v", u.Nkey, err)
+		}
+	}
+	return nil
+}
+
+// remoteAllowed returns true if the list is empty, or if the remote address
+// of the client is in one of its CIDRs or IPs. Clients on the unix socket
+// are not filtered.
+func remoteAllowed(c ClientAuthentication, list []string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	return addrAllowed(c.RemoteAddress(), list)
+}
+
+// addrAllowed returns true if the list is empty, or if the address is in
+// one of its CIDRs or IPs. Unix socket addresses are not filtered.
+func addrAllowed(addr net.Addr, list []string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return true
+	}
+	f := &IPFilterOpts{Allow: list}
+	if err := f.compile(); err != nil {
+		return false
+	}
+	return f.allowed(addrIP(addr))
+}
+
+// remoteIP returns the IP of the remote end of the connection, if any.
+func remoteIP(conn net.Conn) net.IP {
+	return addrIP(conn.RemoteAddr())
+}
+
+// addrIP returns the IP of the address, if any.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
+
+// ipAllowedOnListener returns true if the remote IP of the connection is
+// allowed on the listener. Connections without IP, for instance on the unix
+// socket, are not filtered.
+func (s *Server) ipAllowedOnListener(listener string, conn net.Conn) bool {
+	f := s.getOpts().IPFilters[listener]
+	if f == nil {
+		return true
+	}
+	if _, ok := conn.(*net.UnixConn); ok {
+		return true
+	}
+	if ip := remoteIP(conn); !f.allowed(ip) {
+		s.Debugf("Rejecting %s connection from %v not allowed by ip filter", listener, conn.RemoteAddr())
+		return false
+	}
+	return true
+}
+
+// ipAllowed returns true if the remote host is allowed by the account.
+func (a *Account) ipAllowed(host string) bool {
+	a.mu.RLock()
+	f := a.ipFilter
+	a.mu.RUnlock()
+	if f == nil {
+		return true
+	}
+	return f.allowed(net.ParseIP(host))
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func TestIPFilter(t *testing.T) {
+	f := &IPFilterOpts{Allow: []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}, Deny: []string{"10.1.0.0/16"}}
+	if err := f.compile(); err != nil {
+		t.Fatalf("Error compiling filter: %v", err)
+	}
+	for ip, allowed := range map[string]bool{
+		"10.0.0.1":    true,
+		"10.1.2.3":    false,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"fd00::1":     true,
+		"fe80::1":     false,
+	} {
+		if f.allowed(net.ParseIP(ip)) != allowed {
+			t.Fatalf("Expected %s allowed to be %v", ip, allowed)
+		}
+	}
+	if f.allowed(nil) {
+		t.Fatal("Expected no IP to not be allowed")
+	}
+	if err := (&IPFilterOpts{Deny: []string{"10.0.0.0/33"}}).compile(); err == nil {
+		t.Fatal("Expected error for invalid CIDR")
+	}
+}
+
+func TestIPFilterListenerWithReload(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		ip_filters {
+			client: { deny: ["127.0.0.0/8"] }
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if nc, err := nats.Connect(s.ClientURL(), nats.NoReconnect()); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to be rejected")
+	}
+
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(`
+		listen: "127.0.0.1:-1"
+		ip_filters {
+			client: { allow: ["127.0.0.1"] }
+		}
+	`))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error reloading: %v", err)
+	}
+	nc := natsConnect(t, s.ClientURL())
+	nc.Close()
+}
+
+func TestIPFilterAccount(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A: { users: [{user: a, password: pwd}], ip_filter: { allow: ["10.0.0.0/8"] } }
+			B: { users: [{user: b, password: pwd}], ip_filter: { allow: ["127.0.0.1"] } }
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if _, err := nats.Connect(s.ClientURL(), nats.UserInfo("a", "pwd")); err == nil || !strings.Contains(err.Error(), ErrIPNotAllowed.Error()) {
+		t.Fatalf("Expected %q error, got %v", ErrIPNotAllowed, err)
+	}
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("b", "pwd"))
+	nc.Close()
+
+	if conns := s.closedClients(); conns[0].Reason != IPNotAllowed.String() {
+		t.Fatalf("Unexpected reason: %q", conns[0].Reason)
+	}
+}
+
+func TestIPFilterUserAllowedConnections(t *testing.T) {
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users: [
+				{user: local, password: pwd, allowed_connections: ["127.0.0.0/8", "::1"]}
+				{user: remote, password: pwd, allowed_connections: ["10.0.0.0/8"]}
+				{nkey: %q, allowed_connections: "10.0.0.1"}
+			]
+		}
+	`, pub)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("local", "pwd"))
+	nc.Close()
+	if _, err := nats.Connect(s.ClientURL(), nats.UserInfo("remote", "pwd")); err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Fatalf("Expected authorization error, got %v", err)
+	}
+	nkeyOpt := nats.Nkey(pub, func(nonce []byte) ([]byte, error) { return kp.Sign(nonce) })
+	if _, err := nats.Connect(s.ClientURL(), nkeyOpt); err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Fatalf("Expected authorization error, got %v", err)
+	}
+
+	opts := DefaultOptions()
+	opts.Users = []*User{{Username: "a", Password: "pwd", AllowedConnections: []string{"10.0.0.0/33"}}}
+	if err := validateOptions(opts); err == nil || !strings.Contains(err.Error(), `user "a"`) {
+		t.Fatalf("Expected error about user, got %v", err)
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/minio/highwayhash"
 	"github.com/nats-io/nats-server/v2/server/sysmem"
@@ -33,10 +34,27 @@ import (
 
 // JetStreamConfig determines this server's configuration.
 // MaxMemory and MaxStore are in bytes.
+// RecoveryConcurrency bounds how many streams are recovered in parallel at startup.
 type JetStreamConfig struct {
-	MaxMemory int64
-	MaxStore  int64
-	StoreDir  string
+	MaxMemory           int64
+	MaxStore            int64
+	StoreDir            string
+	RecoveryConcurrency int
+	// UsageInterval is how often usage records of the accounts are sent,
+	// none being sent if not set.
+	UsageInterval time.Duration
+	// UsageAggregation is JSUsageDelta, the default, or JSUsageCumulative.
+	UsageAggregation string
+}
+
+// JetStreamRecoveryStatus reports the progress of recovering JetStream state from storage.
+type JetStreamRecoveryStatus struct {
+	Recovering bool          `json:"recovering"`
+	Streams    int           `json:"streams"`
+	Recovered  int           `json:"recovered"`
+	Failed     int           `json:"failed"`
+	Start      time.Time     `json:"start"`
+	Elapsed    time.Duration `json:"elapsed"`
 }
 
 // TODO(dlc) - need to track and rollup against server limits, etc.
@@ -63,6 +81,17 @@ type jetStream struct {
 	accounts      map[*Account]*jsAccount
 	memReserved   int64
 	storeReserved int64
+	// Recovery progress.
+	recovering bool
+	rstart     time.Time
+	rend       time.Time
+	revent     time.Time
+	rstreams   int
+	rdone      int
+	rfailed    int
+	// Set once a shutdown started, so that a concurrent one, as when a
+	// graceful shutdown gives up waiting, does not run again.
+	stopping bool
 }
 
 // This represents a jetstream enabled account.
@@ -71,6 +100,8 @@ type jetStream struct {
 // and internal sub for a msgSet, so we will direct link to the msgSet
 // and walk backwards as needed vs multiple hash lookups and locks, etc.
 type jsAccount struct {
+	// Revision of the assets, first for alignment of atomic operations.
+	rev           uint64
 	mu            sync.RWMutex
 	js            *jetStream
 	account       *Account
@@ -80,9 +111,28 @@ type jsAccount struct {
 	storeReserved int64
 	storeUsed     int64
 	storeDir      string
+	usage         *jsUsage
 	streams       map[string]*Stream
 	templates     map[string]*StreamTemplate
 	store         TemplateStore
+	// Deleted assets, and the last revision of the ones not kept anymore.
+	tombstones []jsTombstone
+	trimmedRev uint64
+}
+
+// SetStreamStoreProvider sets the provider used to create the stores of new
+// and restored streams. It should be set before JetStream is enabled. A nil
+// provider restores the builtin file and memory stores.
+func (s *Server) SetStreamStoreProvider(sp StreamStoreProvider) {
+	s.mu.Lock()
+	s.storeProvider = sp
+	s.mu.Unlock()
+}
+
+func (s *Server) streamStoreProvider() StreamStoreProvider {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.storeProvider
 }
 
 // EnableJetStream will enable JetStream support on this server with the given configuration.
@@ -102,16 +152,28 @@ func (s *Server) EnableJetStream(config *JetStreamConfig) error {
 	if config == nil || config.MaxMemory <= 0 || config.MaxStore <= 0 {
 		var storeDir string
 		s.Debugf("JetStream creating dynamic configuration - 75%% of system memory, %s disk", FriendlyBytes(JetStreamMaxStoreDefault))
+		var rc int
+		var ui time.Duration
+		var ua string
 		if config != nil {
-			storeDir = config.StoreDir
+			storeDir, rc = config.StoreDir, config.RecoveryConcurrency
+			ui, ua = config.UsageInterval, config.UsageAggregation
 		}
 		config = s.dynJetStreamConfig(storeDir)
+		config.RecoveryConcurrency = rc
+		config.UsageInterval, config.UsageAggregation = ui, ua
 	}
 	// Copy, don't change callers.
 	cfg := *config
 	if cfg.StoreDir == "" {
 		cfg.StoreDir = filepath.Join(os.TempDir(), JetStreamStoreDir)
 	}
+	if cfg.RecoveryConcurrency <= 0 {
+		cfg.RecoveryConcurrency = JetStreamRecoveryConcurrencyDefault
+	}
+	if cfg.UsageAggregation == _EMPTY_ {
+		cfg.UsageAggregation = JSUsageDelta
+	}
 
 	s.js = &jetStream{srv: s, config: cfg, accounts: make(map[*Account]*jsAccount)}
 	s.mu.Unlock()
@@ -174,6 +236,14 @@ func (s *Server) EnableJetStream(config *JetStreamConfig) error {
 	}
 	s.Noticef("----------------------------------------")
 
+	// Enabling the accounts will recover their state, track progress while doing so.
+	js := s.getJetStream()
+	js.startRecovery()
+	defer func() {
+		js.endRecovery()
+		s.sendJetStreamRecoveryEvent()
+	}()
+
 	// If we have no configured accounts setup then setup imports on global account.
 	if s.globalAccountOnly() {
 		if err := s.GlobalAccount().EnableJetStream(nil); err != nil {
@@ -183,9 +253,75 @@ func (s *Server) EnableJetStream(config *JetStreamConfig) error {
 		return fmt.Errorf("Error enabling jetstream on configured accounts: %v", err)
 	}
 
+	// Send the usage records of the accounts, if configured.
+	s.startJetStreamUsage(js)
+
 	return nil
 }
 
+// JetStreamRecovery returns the progress of recovering JetStream state from storage.
+// Returns nil if JetStream is not enabled.
+func (s *Server) JetStreamRecovery() *JetStreamRecoveryStatus {
+	js := s.getJetStream()
+	if js == nil {
+		return nil
+	}
+	return js.recoveryStatus()
+}
+
+func (js *jetStream) startRecovery() {
+	js.mu.Lock()
+	js.recovering = true
+	js.rstart = time.Now()
+	js.mu.Unlock()
+}
+
+func (js *jetStream) endRecovery() {
+	js.mu.Lock()
+	js.recovering = false
+	js.rend = time.Now()
+	js.mu.Unlock()
+}
+
+func (js *jetStream) recoveryStatus() *JetStreamRecoveryStatus {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	rs := &JetStreamRecoveryStatus{
+		Recovering: js.recovering,
+		Streams:    js.rstreams,
+		Recovered:  js.rdone,
+		Failed:     js.rfailed,
+		Start:      js.rstart,
+	}
+	if js.recovering {
+		rs.Elapsed = time.Since(js.rstart)
+	} else {
+		rs.Elapsed = js.rend.Sub(js.rstart)
+	}
+	return rs
+}
+
+// Track that a stream was recovered, or failed to, and send progress events
+// from time to time.
+func (js *jetStream) streamRecovered(ok bool) {
+	js.mu.Lock()
+	if ok {
+		js.rdone++
+	} else {
+		js.rfailed++
+	}
+	var send bool
+	if js.recovering && time.Since(js.revent) >= jsRecoveryEventInterval {
+		js.revent = time.Now()
+		send = true
+	}
+	js.mu.Unlock()
+
+	if send {
+		js.srv.sendJetStreamRecoveryEvent()
+	}
+}
+
 // enableAllJetStreamServiceImports turns on all service imports for jetstream for this account.
 func (a *Account) enableAllJetStreamServiceImports() error {
 	a.mu.RLock()
@@ -288,24 +424,26 @@ func (s *Server) JetStreamEnabled() bool {
 // Shutdown jetstream for this server.
 func (s *Server) shutdownJetStream() {
 	s.mu.Lock()
-	if s.js == nil {
+	if s.js == nil || s.js.stopping {
 		s.mu.Unlock()
 		return
 	}
+	js := s.js
+	js.stopping = true
 	var _jsa [512]*jsAccount
 	jsas := _jsa[:0]
 	// Collect accounts.
-	for _, jsa := range s.js.accounts {
+	for _, jsa := range js.accounts {
 		jsas = append(jsas, jsa)
 	}
 	s.mu.Unlock()
 
 	for _, jsa := range jsas {
-		s.js.disableJetStream(jsa)
+		js.disableJetStream(jsa)
 	}
 
 	s.mu.Lock()
-	s.js.accounts = nil
+	js.accounts = nil
 	s.js = nil
 	s.mu.Unlock()
 }
@@ -385,7 +523,7 @@ func (a *Account) EnableJetStream(limits *JetStreamAccountLimits) error {
 		js.mu.Unlock()
 		return fmt.Errorf("jetstream already enabled for account")
 	}
-	jsa := &jsAccount{js: js, account: a, limits: *limits, streams: make(map[string]*Stream)}
+	jsa := &jsAccount{js: js, account: a, limits: *limits, usage: newJSUsage(), streams: make(map[string]*Stream)}
 	jsa.storeDir = path.Join(js.config.StoreDir, a.Name)
 	js.accounts[a] = jsa
 	js.reserveResources(limits)
@@ -470,120 +608,141 @@ func (a *Account) EnableJetStream(limits *JetStreamAccountLimits) error {
 		}
 	}
 
-	// Now recover the streams.
+	// Now recover the streams. This is mostly IO so we do it in parallel, but bounded.
 	fis, _ := ioutil.ReadDir(sdir)
+	js.mu.Lock()
+	js.rstreams += len(fis)
+	js.mu.Unlock()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, js.config.RecoveryConcurrency)
 	for _, fi := range fis {
-		mdir := path.Join(sdir, fi.Name())
-		key := sha256.Sum256([]byte(fi.Name()))
-		hh, err := highwayhash.New64(key[:])
-		if err != nil {
-			return err
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			js.streamRecovered(a.recoverStream(jsa, sdir, name))
+			<-sem
+		}(fi.Name())
+	}
+	wg.Wait()
+
+	// Make sure to cleanup and old remaining snapshots.
+	os.RemoveAll(path.Join(jsa.storeDir, snapsDir))
+
+	s.Noticef("JetStream state for account %q recovered", a.Name)
+
+	return nil
+}
+
+// recoverStream restores a stream and its consumers from the given directory.
+func (a *Account) recoverStream(jsa *jsAccount, sdir, name string) bool {
+	s := jsa.js.srv
+	mdir := path.Join(sdir, name)
+	key := sha256.Sum256([]byte(name))
+	hh, err := highwayhash.New64(key[:])
+	if err != nil {
+		s.Warnf("  Error creating Stream checksum hash: %v", err)
+		return false
+	}
+	metafile := path.Join(mdir, JetStreamMetaFile)
+	metasum := path.Join(mdir, JetStreamMetaFileSum)
+	if _, err := os.Stat(metafile); os.IsNotExist(err) {
+		s.Warnf("  Missing Stream metafile for %q", metafile)
+		return false
+	}
+	buf, err := ioutil.ReadFile(metafile)
+	if err != nil {
+		s.Warnf("  Error reading metafile %q: %v", metasum, err)
+		return false
+	}
+	if _, err := os.Stat(metasum); os.IsNotExist(err) {
+		s.Warnf("  Missing Stream checksum for %q", metasum)
+		return false
+	}
+	sum, err := ioutil.ReadFile(metasum)
+	if err != nil {
+		s.Warnf("  Error reading Stream metafile checksum %q: %v", metasum, err)
+		return false
+	}
+	hh.Write(buf)
+	checksum := hex.EncodeToString(hh.Sum(nil))
+	if checksum != string(sum) {
+		s.Warnf("  Stream metafile checksums do not match %q vs %q", sum, checksum)
+		return false
+	}
+
+	var cfg FileStreamInfo
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		s.Warnf("  Error unmarshalling Stream metafile: %v", err)
+		return false
+	}
+	if cfg.Template != _EMPTY_ {
+		if err := jsa.addStreamNameToTemplate(cfg.Template, cfg.Name); err != nil {
+			s.Warnf("  Error adding Stream %q to Template %q: %v", cfg.Name, cfg.Template, err)
 		}
-		metafile := path.Join(mdir, JetStreamMetaFile)
-		metasum := path.Join(mdir, JetStreamMetaFileSum)
+	}
+	mset, err := a.AddStream(&cfg.StreamConfig)
+	if err != nil {
+		s.Warnf("  Error recreating Stream %q: %v", cfg.Name, err)
+		return false
+	}
+	if !cfg.Created.IsZero() {
+		mset.setCreated(cfg.Created)
+	}
+
+	stats := mset.State()
+	s.Noticef("  Restored %s messages for Stream %q", comma(int64(stats.Msgs)), name)
+
+	// Now do Consumers.
+	odir := path.Join(sdir, name, consumerDir)
+	ofis, _ := ioutil.ReadDir(odir)
+	if len(ofis) > 0 {
+		s.Noticef("  Recovering %d Consumers for Stream - %q", len(ofis), name)
+	}
+	for _, ofi := range ofis {
+		metafile := path.Join(odir, ofi.Name(), JetStreamMetaFile)
+		metasum := path.Join(odir, ofi.Name(), JetStreamMetaFileSum)
 		if _, err := os.Stat(metafile); os.IsNotExist(err) {
-			s.Warnf("  Missing Stream metafile for %q", metafile)
+			s.Warnf("    Missing Consumer Metafile %q", metafile)
 			continue
 		}
 		buf, err := ioutil.ReadFile(metafile)
 		if err != nil {
-			s.Warnf("  Error reading metafile %q: %v", metasum, err)
+			s.Warnf("    Error reading consumer metafile %q: %v", metasum, err)
 			continue
 		}
 		if _, err := os.Stat(metasum); os.IsNotExist(err) {
-			s.Warnf("  Missing Stream checksum for %q", metasum)
-			continue
-		}
-		sum, err := ioutil.ReadFile(metasum)
-		if err != nil {
-			s.Warnf("  Error reading Stream metafile checksum %q: %v", metasum, err)
+			s.Warnf("    Missing Consumer checksum for %q", metasum)
 			continue
 		}
-		hh.Write(buf)
-		checksum := hex.EncodeToString(hh.Sum(nil))
-		if checksum != string(sum) {
-			s.Warnf("  Stream metafile checksums do not match %q vs %q", sum, checksum)
-			continue
-		}
-
-		var cfg FileStreamInfo
+		var cfg FileConsumerInfo
 		if err := json.Unmarshal(buf, &cfg); err != nil {
-			s.Warnf("  Error unmarshalling Stream metafile: %v", err)
+			s.Warnf("    Error unmarshalling Consumer metafile: %v", err)
 			continue
 		}
-		if cfg.Template != _EMPTY_ {
-			if err := jsa.addStreamNameToTemplate(cfg.Template, cfg.Name); err != nil {
-				s.Warnf("  Error adding Stream %q to Template %q: %v", cfg.Name, cfg.Template, err)
-			}
+		isEphemeral := !isDurableConsumer(&cfg.ConsumerConfig)
+		if isEphemeral {
+			// This is an ephermal consumer and this could fail on restart until
+			// the consumer can reconnect. We will create it as a durable and switch it.
+			cfg.ConsumerConfig.Durable = ofi.Name()
 		}
-		mset, err := a.AddStream(&cfg.StreamConfig)
+		obs, err := mset.AddConsumer(&cfg.ConsumerConfig)
 		if err != nil {
-			s.Warnf("  Error recreating Stream %q: %v", cfg.Name, err)
+			s.Warnf("    Error adding Consumer: %v", err)
 			continue
 		}
+		if isEphemeral {
+			obs.switchToEphemeral()
+		}
 		if !cfg.Created.IsZero() {
-			mset.setCreated(cfg.Created)
+			obs.setCreated(cfg.Created)
 		}
-
-		stats := mset.State()
-		s.Noticef("  Restored %s messages for Stream %q", comma(int64(stats.Msgs)), fi.Name())
-
-		// Now do Consumers.
-		odir := path.Join(sdir, fi.Name(), consumerDir)
-		ofis, _ := ioutil.ReadDir(odir)
-		if len(ofis) > 0 {
-			s.Noticef("  Recovering %d Consumers for Stream - %q", len(ofis), fi.Name())
-		}
-		for _, ofi := range ofis {
-			metafile := path.Join(odir, ofi.Name(), JetStreamMetaFile)
-			metasum := path.Join(odir, ofi.Name(), JetStreamMetaFileSum)
-			if _, err := os.Stat(metafile); os.IsNotExist(err) {
-				s.Warnf("    Missing Consumer Metafile %q", metafile)
-				continue
-			}
-			buf, err := ioutil.ReadFile(metafile)
-			if err != nil {
-				s.Warnf("    Error reading consumer metafile %q: %v", metasum, err)
-				continue
-			}
-			if _, err := os.Stat(metasum); os.IsNotExist(err) {
-				s.Warnf("    Missing Consumer checksum for %q", metasum)
-				continue
-			}
-			var cfg FileConsumerInfo
-			if err := json.Unmarshal(buf, &cfg); err != nil {
-				s.Warnf("    Error unmarshalling Consumer metafile: %v", err)
-				continue
-			}
-			isEphemeral := !isDurableConsumer(&cfg.ConsumerConfig)
-			if isEphemeral {
-				// This is an ephermal consumer and this could fail on restart until
-				// the consumer can reconnect. We will create it as a durable and switch it.
-				cfg.ConsumerConfig.Durable = ofi.Name()
-			}
-			obs, err := mset.AddConsumer(&cfg.ConsumerConfig)
-			if err != nil {
-				s.Warnf("    Error adding Consumer: %v", err)
-				continue
-			}
-			if isEphemeral {
-				obs.switchToEphemeral()
-			}
-			if !cfg.Created.IsZero() {
-				obs.setCreated(cfg.Created)
-			}
-			if err := obs.readStoredState(); err != nil {
-				s.Warnf("    Error restoring Consumer state: %v", err)
-			}
+		if err := obs.readStoredState(); err != nil {
+			s.Warnf("    Error restoring Consumer state: %v", err)
 		}
 	}
-
-	// Make sure to cleanup and old remaining snapshots.
-	os.RemoveAll(path.Join(jsa.storeDir, snapsDir))
-
-	s.Noticef("JetStream state for account %q recovered", a.Name)
-
-	return nil
+	return true
 }
 
 // NumStreams will return how many streams we have.
@@ -761,6 +920,7 @@ func (a *Account) JetStreamEnabled() bool {
 func (jsa *jsAccount) updateUsage(storeType StorageType, delta int64) {
 	// TODO(dlc) - atomics? snapshot limits?
 	jsa.mu.Lock()
+	jsa.accrueUsage(time.Now().UTC())
 	if storeType == MemoryStorage {
 		jsa.memUsed += delta
 	} else {
@@ -917,8 +1077,13 @@ const (
 	JetStreamMaxStoreDefault = 1024 * 1024 * 1024 * 1024
 	// JetStreamMaxMemDefault is only used when we can't determine system memory. 256MB
 	JetStreamMaxMemDefault = 1024 * 1024 * 256
+	// JetStreamRecoveryConcurrencyDefault is how many streams are recovered in parallel.
+	JetStreamRecoveryConcurrencyDefault = 8
 )
 
+// How often at most we send recovery progress events.
+var jsRecoveryEventInterval = time.Second
+
 // Dynamically create a config with a tmp based directory (repeatable) and 75% of system memory.
 func (s *Server) dynJetStreamConfig(storeDir string) *JetStreamConfig {
 	jsc := &JetStreamConfig{}
@@ -85,6 +85,21 @@ const (
 	JSApiStreamPurge  = "$JS.API.STREAM.PURGE.*"
 	JSApiStreamPurgeT = "$JS.API.STREAM.PURGE.%s"
 
+	// JSApiStreamCompact is the endpoint to reclaim the storage space left behind by deleted messages.
+	// Will return JSON response.
+	JSApiStreamCompact  = "$JS.API.STREAM.COMPACT.*"
+	JSApiStreamCompactT = "$JS.API.STREAM.COMPACT.%s"
+
+	// JSApiStreamScrub is the endpoint to verify the integrity of all messages of a stream.
+	// Will return JSON response.
+	JSApiStreamScrub  = "$JS.API.STREAM.SCRUB.*"
+	JSApiStreamScrubT = "$JS.API.STREAM.SCRUB.%s"
+
+	// JSApiStreamQuery is the endpoint to filter and aggregate the messages of a stream.
+	// Will return JSON response.
+	JSApiStreamQuery  = "$JS.API.STREAM.QUERY.*"
+	JSApiStreamQueryT = "$JS.API.STREAM.QUERY.%s"
+
 	// JSApiStreamSnapshot is the endpoint to snapshot streams.
 	// Will return a stream of chunks with a nil chunk as EOF to
 	// the deliver subject. Caller should respond to each chunk
@@ -223,11 +238,20 @@ type ApiPaged struct {
 	Total  int `json:"total"`
 	Offset int `json:"offset"`
 	Limit  int `json:"limit"`
+	// Next is the cursor of the next page, if any.
+	Next string `json:"next,omitempty"`
+	// Revision of the assets, and the ones deleted since the requested one.
+	Revision uint64   `json:"revision,omitempty"`
+	Deleted  []string `json:"deleted,omitempty"`
 }
 
 // ApiPagedRequest includes parameters allowing specific pages to be requests from APIs responding with ApiPaged
 type ApiPagedRequest struct {
 	Offset int `json:"offset"`
+	// After is the cursor of the page, taking precedence over Offset.
+	After string `json:"after,omitempty"`
+	// Since only lists the assets changed after the revision.
+	Since uint64 `json:"since,omitempty"`
 }
 
 // JSApiAccountInfoResponse reports back information on jetstream for this account.
@@ -300,6 +324,46 @@ type JSApiStreamPurgeResponse struct {
 
 const JSApiStreamPurgeResponseType = "io.nats.jetstream.api.v1.stream_purge_response"
 
+// JSApiStreamCompactResponse.
+type JSApiStreamCompactResponse struct {
+	ApiResponse
+	Success   bool   `json:"success,omitempty"`
+	Reclaimed uint64 `json:"reclaimed,omitempty"`
+}
+
+const JSApiStreamCompactResponseType = "io.nats.jetstream.api.v1.stream_compact_response"
+
+// JSApiStreamScrubResponse.
+type JSApiStreamScrubResponse struct {
+	ApiResponse
+	Report *ScrubReport `json:"report,omitempty"`
+}
+
+const JSApiStreamScrubResponseType = "io.nats.jetstream.api.v1.stream_scrub_response"
+
+// JSApiStreamQueryRequest selects the messages of a stream, from a sequence
+// or time and up to a time, on a subject and whose JSON payload matches all
+// predicates. Without aggregates the messages are returned, up to the limit.
+type JSApiStreamQueryRequest struct {
+	Subject    string                  `json:"subject,omitempty"`
+	StartSeq   uint64                  `json:"start_seq,omitempty"`
+	StartTime  *time.Time              `json:"start_time,omitempty"`
+	EndTime    *time.Time              `json:"end_time,omitempty"`
+	Where      []*StreamQueryPredicate `json:"where,omitempty"`
+	Aggregates []*StreamQueryAggregate `json:"aggregates,omitempty"`
+	GroupBy    string                  `json:"group_by,omitempty"`
+	Limit      int                     `json:"limit,omitempty"`
+	MaxScan    int                     `json:"max_scan,omitempty"`
+}
+
+// JSApiStreamQueryResponse.
+type JSApiStreamQueryResponse struct {
+	ApiResponse
+	*StreamQueryResult
+}
+
+const JSApiStreamQueryResponseType = "io.nats.jetstream.api.v1.stream_query_response"
+
 // JSApiStreamUpdateResponse for updating a stream.
 type JSApiStreamUpdateResponse struct {
 	ApiResponse
@@ -356,12 +420,24 @@ const JSApiStreamRestoreResponseType = "io.nats.jetstream.api.v1.stream_restore_
 // JSApiMsgGetRequest get a message request.
 type JSApiMsgGetRequest struct {
 	Seq uint64 `json:"seq"`
+	// Seqs and LastBySubjects request a batch of messages, by sequences or
+	// as the last message of each subject matching the subjects.
+	Seqs           []uint64 `json:"seqs,omitempty"`
+	LastBySubjects []string `json:"last_by_subjects,omitempty"`
+	// Limits of the batch.
+	Batch    int `json:"batch,omitempty"`
+	MaxBytes int `json:"max_bytes,omitempty"`
+	// To continue a truncated last per subject batch.
+	UpToSeq      uint64 `json:"up_to_seq,omitempty"`
+	AfterSubject string `json:"after_subject,omitempty"`
 }
 
 // JSApiMsgGetResponse.
 type JSApiMsgGetResponse struct {
 	ApiResponse
 	Message *StoredMsg `json:"message,omitempty"`
+	// EOB is set on the last response of a batch.
+	EOB *JSApiMsgGetEOB `json:"eob,omitempty"`
 }
 
 const JSApiMsgGetResponseType = "io.nats.jetstream.api.v1.stream_msg_get_response"
@@ -456,6 +532,7 @@ var (
 	jsBadRequestErr      = &ApiError{Code: 400, Description: "bad request"}
 	jsNotEmptyRequestErr = &ApiError{Code: 400, Description: "expected an empty request payload"}
 	jsInvalidJSONErr     = &ApiError{Code: 400, Description: "invalid JSON received in request"}
+	jsRevisionExpiredErr = &ApiError{Code: 410, Description: "revision expired, list all again"}
 )
 
 // For easier handling of exports and imports.
@@ -472,6 +549,9 @@ var allJsExports = []string{
 	JSApiStreamInfo,
 	JSApiStreamDelete,
 	JSApiStreamPurge,
+	JSApiStreamCompact,
+	JSApiStreamScrub,
+	JSApiStreamQuery,
 	JSApiStreamSnapshot,
 	JSApiStreamRestore,
 	JSApiMsgDelete,
@@ -501,6 +581,9 @@ func (s *Server) setJetStreamExportSubs() error {
 		{JSApiStreamInfo, s.jsStreamInfoRequest},
 		{JSApiStreamDelete, s.jsStreamDeleteRequest},
 		{JSApiStreamPurge, s.jsStreamPurgeRequest},
+		{JSApiStreamCompact, s.jsStreamCompactRequest},
+		{JSApiStreamScrub, s.jsStreamScrubRequest},
+		{JSApiStreamQuery, s.jsStreamQueryRequest},
 		{JSApiStreamSnapshot, s.jsStreamSnapshotRequest},
 		{JSApiStreamRestore, s.jsStreamRestoreRequest},
 		{JSApiMsgDelete, s.jsMsgDeleteRequest},
@@ -522,6 +605,7 @@ func (s *Server) setJetStreamExportSubs() error {
 }
 
 func (s *Server) sendAPIResponse(c *client, subject, reply, request, response string) {
+	c.acc.meterJetStreamAPICall()
 	s.sendInternalAccountMsg(c.acc, reply, response)
 	s.sendJetStreamAPIAuditAdvisory(c, subject, request, response)
 }
@@ -714,7 +798,7 @@ func (s *Server) jsTemplateDeleteRequest(sub *subscription, c *client, subject,
 func (s *Server) jsonResponse(v interface{}) string {
 	b, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
-		s.Warnf("Problem marshaling JSON for JetStream API:", err)
+		s.Warnf("Problem marshaling JSON for JetStream API: %v", err)
 		return ""
 	}
 	return string(b)
@@ -822,33 +906,25 @@ func (s *Server) jsStreamNamesRequest(sub *subscription, c *client, subject, rep
 		return
 	}
 
-	var offset int
+	var req JSApiStreamNamesRequest
 	if !isEmptyRequest(msg) {
-		var req JSApiStreamNamesRequest
 		if err := json.Unmarshal(msg, &req); err != nil {
 			resp.Error = jsInvalidJSONErr
 			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 			return
 		}
-		offset = req.Offset
 	}
 
-	// TODO(dlc) - Maybe hold these results for large results that we expect to be paged.
 	// TODO(dlc) - If this list is long maybe do this in a Go routine?
-	msets := c.acc.Streams()
-	sort.Slice(msets, func(i, j int) bool {
-		return strings.Compare(msets[i].config.Name, msets[j].config.Name) < 0
-	})
-
-	for _, mset := range msets[offset:] {
-		resp.Streams = append(resp.Streams, mset.config.Name)
-		if len(resp.Streams) >= JSApiNamesLimit {
-			break
-		}
+	msets, apiErr := pagedStreams(c.acc, &req.ApiPagedRequest, JSApiNamesLimit, &resp.ApiPaged)
+	if apiErr != nil {
+		resp.Error = apiErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	for _, mset := range msets {
+		resp.Streams = append(resp.Streams, mset.Name())
 	}
-	resp.Total = len(msets)
-	resp.Limit = JSApiNamesLimit
-	resp.Offset = offset
 	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
@@ -870,33 +946,25 @@ func (s *Server) jsStreamListRequest(sub *subscription, c *client, subject, repl
 		return
 	}
 
-	var offset int
+	var req JSApiStreamNamesRequest
 	if !isEmptyRequest(msg) {
-		var req JSApiStreamNamesRequest
 		if err := json.Unmarshal(msg, &req); err != nil {
 			resp.Error = jsInvalidJSONErr
 			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 			return
 		}
-		offset = req.Offset
 	}
 
-	// TODO(dlc) - Maybe hold these results for large results that we expect to be paged.
 	// TODO(dlc) - If this list is long maybe do this in a Go routine?
-	msets := c.acc.Streams()
-	sort.Slice(msets, func(i, j int) bool {
-		return strings.Compare(msets[i].config.Name, msets[j].config.Name) < 0
-	})
-
-	for _, mset := range msets[offset:] {
+	msets, apiErr := pagedStreams(c.acc, &req.ApiPagedRequest, JSApiListLimit, &resp.ApiPaged)
+	if apiErr != nil {
+		resp.Error = apiErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	for _, mset := range msets {
 		resp.Streams = append(resp.Streams, &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config()})
-		if len(resp.Streams) >= JSApiListLimit {
-			break
-		}
 	}
-	resp.Total = len(msets)
-	resp.Limit = JSApiListLimit
-	resp.Offset = offset
 	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
@@ -1059,6 +1127,16 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, subject, reply st
 		return
 	}
 
+	if req.isBatch() {
+		if err := req.validate(); err != nil {
+			resp.Error = &ApiError{Code: 400, Description: err.Error()}
+		} else if resp.EOB, err = s.sendMsgGetBatch(c, mset, reply, &req); err != nil {
+			resp.Error = jsError(err)
+		}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
 	subj, hdr, msg, ts, err := mset.store.LoadMsg(req.Seq)
 	if err != nil {
 		resp.Error = jsError(err)
@@ -1104,6 +1182,106 @@ func (s *Server) jsStreamPurgeRequest(sub *subscription, c *client, subject, rep
 	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
+// Request to compact the storage of a stream.
+func (s *Server) jsStreamCompactRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiStreamCompactResponse{ApiResponse: ApiResponse{Type: JSApiStreamCompactResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !isEmptyRequest(msg) {
+		resp.Error = jsNotEmptyRequestErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	stream := streamNameFromSubject(subject)
+	mset, err := c.acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if resp.Reclaimed, err = mset.CompactStore(); err != nil {
+		resp.Error = jsError(err)
+	} else {
+		resp.Success = true
+	}
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to verify the integrity of the messages of a stream.
+func (s *Server) jsStreamScrubRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiStreamScrubResponse{ApiResponse: ApiResponse{Type: JSApiStreamScrubResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !isEmptyRequest(msg) {
+		resp.Error = jsNotEmptyRequestErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	stream := streamNameFromSubject(subject)
+	mset, err := c.acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if resp.Report, err = mset.Scrub(); err != nil {
+		resp.Error = jsError(err)
+	}
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to filter and aggregate the messages of a stream.
+func (s *Server) jsStreamQueryRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiStreamQueryResponse{ApiResponse: ApiResponse{Type: JSApiStreamQueryResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var req JSApiStreamQueryRequest
+	if !isEmptyRequest(msg) {
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = jsInvalidJSONErr
+			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+	}
+	if err := req.validate(); err != nil {
+		resp.Error = &ApiError{Code: 400, Description: err.Error()}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	stream := streamNameFromSubject(subject)
+	mset, err := c.acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if resp.StreamQueryResult, err = mset.Query(&req); err != nil {
+		resp.Error = jsError(err)
+	}
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
 // Request to restore a stream.
 func (s *Server) jsStreamRestoreRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
 	if c.acc == nil {
@@ -1213,7 +1391,7 @@ func (s *Server) jsStreamRestoreRequest(sub *subscription, c *client, subject, r
 		}
 		// Append chunk to temp file. Mark as issue if we encounter an error.
 		if n, err := tfile.Write(msg); n != len(msg) || err != nil {
-			s.Warnf("Storage failure for restore at %s for stream in account %q: %v",
+			s.Warnf("Storage failure for restore at %s for stream %q in account %q: %v",
 				FriendlyBytes(int64(received)), stream, c.acc.Name, err)
 			tfile.Close()
 			os.Remove(tfile.Name())
@@ -1519,15 +1697,13 @@ func (s *Server) jsConsumerNamesRequest(sub *subscription, c *client, subject, r
 		return
 	}
 
-	var offset int
+	var req JSApiConsumersRequest
 	if !isEmptyRequest(msg) {
-		var req JSApiConsumersRequest
 		if err := json.Unmarshal(msg, &req); err != nil {
 			resp.Error = jsInvalidJSONErr
 			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 			return
 		}
-		offset = req.Offset
 	}
 
 	streamName := streamNameFromSubject(subject)
@@ -1538,19 +1714,15 @@ func (s *Server) jsConsumerNamesRequest(sub *subscription, c *client, subject, r
 		return
 	}
 
-	obs := mset.Consumers()
-	sort.Slice(obs, func(i, j int) bool {
-		return strings.Compare(obs[i].name, obs[j].name) < 0
-	})
-	for _, o := range obs[offset:] {
+	obs, apiErr := pagedConsumers(mset, &req.ApiPagedRequest, JSApiNamesLimit, &resp.ApiPaged)
+	if apiErr != nil {
+		resp.Error = apiErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	for _, o := range obs {
 		resp.Consumers = append(resp.Consumers, o.Name())
-		if len(resp.Consumers) >= JSApiNamesLimit {
-			break
-		}
 	}
-	resp.Total = len(obs)
-	resp.Limit = JSApiNamesLimit
-	resp.Offset = offset
 	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
@@ -1571,15 +1743,13 @@ func (s *Server) jsConsumerListRequest(sub *subscription, c *client, subject, re
 		return
 	}
 
-	var offset int
+	var req JSApiConsumersRequest
 	if !isEmptyRequest(msg) {
-		var req JSApiConsumersRequest
 		if err := json.Unmarshal(msg, &req); err != nil {
 			resp.Error = jsInvalidJSONErr
 			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 			return
 		}
-		offset = req.Offset
 	}
 
 	streamName := streamNameFromSubject(subject)
@@ -1590,19 +1760,15 @@ func (s *Server) jsConsumerListRequest(sub *subscription, c *client, subject, re
 		return
 	}
 
-	obs := mset.Consumers()
-	sort.Slice(obs, func(i, j int) bool {
-		return strings.Compare(obs[i].name, obs[j].name) < 0
-	})
-	for _, o := range obs[offset:] {
+	obs, apiErr := pagedConsumers(mset, &req.ApiPagedRequest, JSApiListLimit, &resp.ApiPaged)
+	if apiErr != nil {
+		resp.Error = apiErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	for _, o := range obs {
 		resp.Consumers = append(resp.Consumers, o.Info())
-		if len(resp.Consumers) >= JSApiListLimit {
-			break
-		}
 	}
-	resp.Total = len(obs)
-	resp.Limit = JSApiListLimit
-	resp.Offset = offset
 	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
@@ -0,0 +1,275 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nkeys"
+)
+
+// Aggregation of JetStream usage records.
+const (
+	// JSUsageDelta records cover the time since the previous record.
+	JSUsageDelta = "delta"
+	// JSUsageCumulative records cover the time since JetStream was enabled
+	// for the account.
+	JSUsageCumulative = "cumulative"
+)
+
+// JSUsage is the usage of JetStream by an account over a period of time.
+type JSUsage struct {
+	// Server is the public key of the server that signed the record.
+	Server  string    `json:"server"`
+	Account string    `json:"account"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	// Bytes stored over time, integrated over the period.
+	MemoryByteHours  float64 `json:"memory_byte_hours"`
+	StorageByteHours float64 `json:"storage_byte_hours"`
+	// Messages ingested by the streams of the account.
+	Messages uint64 `json:"messages"`
+	Bytes    uint64 `json:"bytes"`
+	// Requests to the JetStream API.
+	APICalls uint64 `json:"api_calls"`
+	// Messages delivered by the consumers of the account.
+	DeliveredMessages uint64 `json:"delivered_messages"`
+	DeliveredBytes    uint64 `json:"delivered_bytes"`
+}
+
+// JSUsageEventMsg is sent periodically on the system account with the usage
+// of JetStream by an account. Usage is the JSUsage record and Signature the
+// base64 url encoded, unpadded, signature of its compact JSON by the nkey of
+// the server, so that billing pipelines can check that records were not
+// altered.
+type JSUsageEventMsg struct {
+	TypedEvent
+	Server    ServerInfo      `json:"server"`
+	Usage     json.RawMessage `json:"usage"`
+	Signature string          `json:"sig"`
+}
+
+// JSUsageEventMsgType is the schema type for JSUsageEventMsg
+const JSUsageEventMsgType = "io.nats.jetstream.metering.v1.usage"
+
+// Verify checks the signature of the usage record and returns it.
+func (m *JSUsageEventMsg) Verify() (*JSUsage, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, m.Usage); err != nil {
+		return nil, fmt.Errorf("invalid usage record: %v", err)
+	}
+	var u JSUsage
+	if err := json.Unmarshal(buf.Bytes(), &u); err != nil {
+		return nil, fmt.Errorf("invalid usage record: %v", err)
+	}
+	kp, err := nkeys.FromPublicKey(u.Server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid usage record signer: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid usage record signature: %v", err)
+	}
+	if err := kp.Verify(buf.Bytes(), sig); err != nil {
+		return nil, fmt.Errorf("invalid usage record signature: %v", err)
+	}
+	return &u, nil
+}
+
+// jsUsage meters the usage of JetStream by an account.
+type jsUsage struct {
+	// Totals since JetStream was enabled for the account, updated
+	// atomically.
+	msgs     uint64
+	bytes    uint64
+	apiCalls uint64
+	dmsgs    uint64
+	dbytes   uint64
+
+	// Protected by the lock of the account.
+	start          time.Time
+	last           time.Time
+	memByteHours   float64
+	storeByteHours float64
+	// Totals of the last record, for delta records.
+	reported JSUsage
+}
+
+func newJSUsage() *jsUsage {
+	now := time.Now().UTC()
+	return &jsUsage{start: now, last: now, reported: JSUsage{End: now}}
+}
+
+// Meters a message ingested by a stream.
+func (jsa *jsAccount) meterIngest(size int) {
+	atomic.AddUint64(&jsa.usage.msgs, 1)
+	atomic.AddUint64(&jsa.usage.bytes, uint64(size))
+}
+
+// Meters a message delivered by a consumer.
+func (jsa *jsAccount) meterDelivery(size int) {
+	atomic.AddUint64(&jsa.usage.dmsgs, 1)
+	atomic.AddUint64(&jsa.usage.dbytes, uint64(size))
+}
+
+// Meters a request to the JetStream API.
+func (a *Account) meterJetStreamAPICall() {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+	if jsa != nil {
+		atomic.AddUint64(&jsa.usage.apiCalls, 1)
+	}
+}
+
+// Integrates the bytes in use up to now, before they change.
+// Lock should be held.
+func (jsa *jsAccount) accrueUsage(now time.Time) {
+	u := jsa.usage
+	if hours := now.Sub(u.last).Hours(); hours > 0 {
+		u.memByteHours += float64(jsa.memUsed) * hours
+		u.storeByteHours += float64(jsa.storeUsed) * hours
+		u.last = now
+	}
+}
+
+// usageRecord returns the usage of the account since JetStream was enabled
+// for it, or since the previous record for delta records. Returns nil if
+// there was no usage.
+func (jsa *jsAccount) usageRecord(now time.Time, aggregation string) *JSUsage {
+	jsa.mu.Lock()
+	defer jsa.mu.Unlock()
+	jsa.accrueUsage(now)
+	u := jsa.usage
+	total := JSUsage{
+		Account:           jsa.account.Name,
+		Start:             u.start,
+		End:               now,
+		MemoryByteHours:   u.memByteHours,
+		StorageByteHours:  u.storeByteHours,
+		Messages:          atomic.LoadUint64(&u.msgs),
+		Bytes:             atomic.LoadUint64(&u.bytes),
+		APICalls:          atomic.LoadUint64(&u.apiCalls),
+		DeliveredMessages: atomic.LoadUint64(&u.dmsgs),
+		DeliveredBytes:    atomic.LoadUint64(&u.dbytes),
+	}
+	r, prev := total, u.reported
+	u.reported = total
+	if aggregation != JSUsageCumulative {
+		r.Start = prev.End
+		r.MemoryByteHours -= prev.MemoryByteHours
+		r.StorageByteHours -= prev.StorageByteHours
+		r.Messages -= prev.Messages
+		r.Bytes -= prev.Bytes
+		r.APICalls -= prev.APICalls
+		r.DeliveredMessages -= prev.DeliveredMessages
+		r.DeliveredBytes -= prev.DeliveredBytes
+	}
+	if r.MemoryByteHours == 0 && r.StorageByteHours == 0 && r.Messages == 0 &&
+		r.APICalls == 0 && r.DeliveredMessages == 0 {
+		return nil
+	}
+	return &r
+}
+
+// startJetStreamUsage will periodically send the usage records of the
+// accounts, as long as JetStream is enabled.
+func (s *Server) startJetStreamUsage(js *jetStream) {
+	interval := js.config.UsageInterval
+	if interval <= 0 {
+		return
+	}
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if s.getJetStream() != js {
+					return
+				}
+				s.sendJetStreamUsage(js)
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+// sendJetStreamUsage sends a signed usage record for each account with
+// JetStream usage.
+func (s *Server) sendJetStreamUsage(js *jetStream) {
+	if !s.EventsEnabled() {
+		return
+	}
+	js.mu.RLock()
+	jsas := make([]*jsAccount, 0, len(js.accounts))
+	for _, jsa := range js.accounts {
+		jsas = append(jsas, jsa)
+	}
+	aggregation := js.config.UsageAggregation
+	js.mu.RUnlock()
+
+	now := time.Now().UTC()
+	for _, jsa := range jsas {
+		u := jsa.usageRecord(now, aggregation)
+		if u == nil {
+			continue
+		}
+		u.Server = s.info.ID
+		b, err := json.Marshal(u)
+		if err != nil {
+			s.Warnf("JetStream usage record could not be serialized for account %q: %v", u.Account, err)
+			continue
+		}
+		sig, err := s.kp.Sign(b)
+		if err != nil {
+			s.Warnf("JetStream usage record could not be signed for account %q: %v", u.Account, err)
+			continue
+		}
+		m := JSUsageEventMsg{
+			TypedEvent: TypedEvent{
+				Type: JSUsageEventMsgType,
+				ID:   s.nextEventID(),
+				Time: now,
+			},
+			Usage:     b,
+			Signature: base64.RawURLEncoding.EncodeToString(sig),
+		}
+		s.mu.Lock()
+		s.sendInternalMsg(fmt.Sprintf(jsUsageEventSubj, u.Account), _EMPTY_, &m.Server, &m)
+		s.mu.Unlock()
+	}
+}
+
+// validateJetStreamUsage checks the settings of the usage records.
+func validateJetStreamUsage(o *Options) error {
+	if o.JetStreamUsageInterval < 0 {
+		return fmt.Errorf("jetstream usage interval can not be negative")
+	}
+	switch o.JetStreamUsageAggregation {
+	case _EMPTY_, JSUsageDelta, JSUsageCumulative:
+	default:
+		return fmt.Errorf("jetstream usage aggregation must be %q or %q, got %q",
+			JSUsageDelta, JSUsageCumulative, o.JetStreamUsageAggregation)
+	}
+	return nil
+}
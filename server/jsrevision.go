@@ -0,0 +1,188 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// Changes to the streams and consumers of an account are numbered with a
+// revision, so that list requests can ask only for the assets changed since
+// the revision of a previous response, along with the names of the ones
+// deleted since, instead of listing everything again. Deletions are kept
+// for a bounded number of revisions, older revisions requiring to list
+// again.
+
+// Maximum number of deletions kept for the assets of an account.
+const jsMaxTombstones = 4096
+
+// jsTombstone records the deletion of a stream, or of a consumer of it.
+type jsTombstone struct {
+	rev      uint64
+	stream   string
+	consumer string
+}
+
+// nextRevision returns the revision of a change to the assets.
+func (jsa *jsAccount) nextRevision() uint64 {
+	return atomic.AddUint64(&jsa.rev, 1)
+}
+
+// revision returns the current revision of the assets.
+func (jsa *jsAccount) revision() uint64 {
+	return atomic.LoadUint64(&jsa.rev)
+}
+
+// assetDeleted records the deletion of the stream, or of the consumer if
+// not empty.
+func (jsa *jsAccount) assetDeleted(stream, consumer string) {
+	rev := jsa.nextRevision()
+	jsa.mu.Lock()
+	jsa.tombstones = append(jsa.tombstones, jsTombstone{rev, stream, consumer})
+	if n := len(jsa.tombstones) - jsMaxTombstones; n > 0 {
+		jsa.trimmedRev = jsa.tombstones[n-1].rev
+		jsa.tombstones = append(jsa.tombstones[:0], jsa.tombstones[n:]...)
+	}
+	jsa.mu.Unlock()
+}
+
+// deletedSince returns the sorted names of the streams, or of the consumers
+// of the stream if not empty, deleted after the revision. It returns false
+// if deletions of that revision are not kept anymore.
+func (jsa *jsAccount) deletedSince(since uint64, stream string) ([]string, bool) {
+	jsa.mu.RLock()
+	defer jsa.mu.RUnlock()
+	if since < jsa.trimmedRev {
+		return nil, false
+	}
+	var names []string
+	for _, t := range jsa.tombstones {
+		if t.rev <= since {
+			continue
+		}
+		if stream == _EMPTY_ && t.consumer == _EMPTY_ {
+			names = append(names, t.stream)
+		} else if stream != _EMPTY_ && t.stream == stream && t.consumer != _EMPTY_ {
+			names = append(names, t.consumer)
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// page returns the range of the sorted names to respond with, starting
+// after the cursor if set, or at the offset, and sets the paging of the
+// response.
+func (req *ApiPagedRequest) page(names []string, limit int, resp *ApiPaged) (int, int) {
+	start := req.Offset
+	if req.After != _EMPTY_ {
+		start = sort.Search(len(names), func(i int) bool { return names[i] > req.After })
+	}
+	if start < 0 {
+		start = 0
+	} else if start > len(names) {
+		start = len(names)
+	}
+	end := start + limit
+	if end > len(names) {
+		end = len(names)
+	}
+	resp.Total, resp.Offset, resp.Limit = len(names), start, limit
+	if end < len(names) {
+		resp.Next = names[end-1]
+	}
+	return start, end
+}
+
+// changes sets the revision of the response and the assets deleted since
+// the revision of the request. It returns false if the request has to list
+// all the assets again.
+func (req *ApiPagedRequest) changes(jsa *jsAccount, stream string, resp *ApiPaged) bool {
+	resp.Revision = jsa.revision()
+	if req.Since == 0 {
+		return true
+	}
+	deleted, ok := jsa.deletedSince(req.Since, stream)
+	if !ok {
+		return false
+	}
+	resp.Deleted = deleted
+	return true
+}
+
+// revision returns the revision of the last change to the stream.
+func (mset *Stream) revision() uint64 {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	return mset.rev
+}
+
+// revision returns the revision of the last change to the consumer.
+func (o *Consumer) revision() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.rev
+}
+
+// pagedStreams returns the streams of the account for the page of the
+// request, only the ones changed since its revision if set.
+func pagedStreams(acc *Account, req *ApiPagedRequest, limit int, resp *ApiPaged) ([]*Stream, *ApiError) {
+	acc.mu.RLock()
+	jsa := acc.js
+	acc.mu.RUnlock()
+	if jsa == nil {
+		return nil, jsNotEnabledErr
+	}
+	if !req.changes(jsa, _EMPTY_, resp) {
+		return nil, jsRevisionExpiredErr
+	}
+	var msets []*Stream
+	for _, mset := range acc.Streams() {
+		if mset.revision() > req.Since {
+			msets = append(msets, mset)
+		}
+	}
+	sort.Slice(msets, func(i, j int) bool { return msets[i].config.Name < msets[j].config.Name })
+	names := make([]string, len(msets))
+	for i, mset := range msets {
+		names[i] = mset.config.Name
+	}
+	start, end := req.page(names, limit, resp)
+	return msets[start:end], nil
+}
+
+// pagedConsumers returns the consumers of the stream for the page of the
+// request, only the ones changed since its revision if set.
+func pagedConsumers(mset *Stream, req *ApiPagedRequest, limit int, resp *ApiPaged) ([]*Consumer, *ApiError) {
+	mset.mu.Lock()
+	jsa, name := mset.jsa, mset.config.Name
+	mset.mu.Unlock()
+	if !req.changes(jsa, name, resp) {
+		return nil, jsRevisionExpiredErr
+	}
+	var obs []*Consumer
+	for _, o := range mset.Consumers() {
+		if o.revision() > req.Since {
+			obs = append(obs, o)
+		}
+	}
+	sort.Slice(obs, func(i, j int) bool { return obs[i].name < obs[j].name })
+	names := make([]string, len(obs))
+	for i, o := range obs {
+		names[i] = o.name
+	}
+	start, end := req.page(names, limit, resp)
+	return obs[start:end], nil
+}
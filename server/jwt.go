@@ -72,12 +72,19 @@ func wipeSlice(buf []byte) {
 // will expand the trusted keys in options.
 func validateTrustedOperators(o *Options) error {
 	if len(o.TrustedOperators) == 0 {
+		if len(o.OperatorPolicies) > 0 {
+			return fmt.Errorf("operator policies require trusted operators")
+		}
 		return nil
 	}
+	if err := validateOperatorPolicies(o); err != nil {
+		return err
+	}
 	if o.AllowNewAccounts {
 		return fmt.Errorf("operators do not allow dynamic creation of new accounts")
 	}
-	if o.AccountResolver == nil {
+	// Operators with policies may each have their own resolver.
+	if o.AccountResolver == nil && len(o.OperatorPolicies) == 0 {
 		return fmt.Errorf("operators require an account resolver to be configured")
 	}
 	if len(o.Accounts) > 0 {
@@ -93,10 +100,11 @@ func validateTrustedOperators(o *Options) error {
 		foundSys := false
 		foundNonEmpty := false
 		for _, op := range o.TrustedOperators {
-			if op.SystemAccount != "" {
+			sa := operatorSystemAccount(o, op)
+			if sa != "" {
 				foundNonEmpty = true
 			}
-			if op.SystemAccount == o.SystemAccount {
+			if sa == o.SystemAccount {
 				foundSys = true
 				break
 			}
@@ -2478,6 +2478,10 @@ func TestBearerToken(t *testing.T) {
 	defer s.Shutdown()
 	buildMemAccResolver(s)
 	addAccountToMemResolver(s, apub, ajwt)
+	// Bearer tokens are only accepted on websocket by default.
+	s.mu.Lock()
+	s.opts.BearerTokenListeners = []string{"client"}
+	s.mu.Unlock()
 
 	c, cr, _ := newClientForServer(s)
 	defer c.close()
@@ -2499,6 +2503,99 @@ func TestBearerToken(t *testing.T) {
 	wg.Wait()
 }
 
+func TestBearerTokenListeners(t *testing.T) {
+	okp, _ := nkeys.FromSeed(oSeed)
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	ajwt, err := nac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	nkp, _ := nkeys.CreateUser()
+	pub, _ := nkp.PublicKey()
+	nuc := newJWTTestUserClaims()
+	nuc.Subject = pub
+	nuc.BearerToken = true
+	ujwt, err := nuc.Encode(akp)
+	if err != nil {
+		t.Fatalf("Error generating user JWT: %v", err)
+	}
+
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+	addAccountToMemResolver(s, apub, ajwt)
+
+	connect := func(sign bool) string {
+		t.Helper()
+		c, cr, l := newClientForServer(s)
+		defer c.close()
+		var sig string
+		if sign {
+			var info nonceInfo
+			json.Unmarshal([]byte(l[5:]), &info)
+			sigraw, _ := nkp.Sign([]byte(info.Nonce))
+			sig = base64.RawURLEncoding.EncodeToString(sigraw)
+		}
+		cs := fmt.Sprintf("CONNECT {\"jwt\":%q,\"sig\":%q,\"verbose\":true,\"pedantic\":true}\r\nPING\r\n", ujwt, sig)
+		done := make(chan struct{})
+		go func() {
+			c.parse([]byte(cs))
+			close(done)
+		}()
+		l, _ = cr.ReadString('\n')
+		<-done
+		return l
+	}
+	// TCP clients must still sign the nonce, by default and when only
+	// websocket is listed.
+	for _, listeners := range [][]string{nil, {"websocket"}} {
+		s.mu.Lock()
+		s.opts.BearerTokenListeners = listeners
+		s.mu.Unlock()
+		if l := connect(false); !strings.HasPrefix(l, "-ERR 'Authorization Violation'") {
+			t.Fatalf("Expected authorization violation with %v, got %s", listeners, l)
+		}
+		if l := connect(true); !strings.HasPrefix(l, "+OK") {
+			t.Fatalf("Expected +OK with %v, got %s", listeners, l)
+		}
+	}
+
+	s.mu.Lock()
+	s.opts.BearerTokenListeners = []string{"client"}
+	s.mu.Unlock()
+	if l := connect(false); !strings.HasPrefix(l, "+OK") {
+		t.Fatalf("Expected +OK, got %s", l)
+	}
+
+	for _, test := range []struct {
+		conf string
+		err  string
+	}{
+		{`bearer_token_listeners: [websocket, Leafnode]`, _EMPTY_},
+		{`bearer_token_listeners: []`, _EMPTY_},
+		{`bearer_token_listeners: [tcp]`, "unknown listener"},
+	} {
+		conf := createConfFile(t, []byte(test.conf))
+		defer os.Remove(conf)
+		o, err := ProcessConfigFile(conf)
+		if err != nil {
+			t.Fatalf("Error processing config: %v", err)
+		}
+		if o.BearerTokenListeners == nil {
+			t.Fatalf("Expected listeners to be set")
+		}
+		err = validateBearerTokenListeners(o)
+		if test.err == _EMPTY_ && err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		} else if test.err != _EMPTY_ && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Fatalf("Expected error about %q, got %v", test.err, err)
+		}
+	}
+}
+
 func TestExpiredUserCredentialsRenewal(t *testing.T) {
 	createTmpFile := func(t *testing.T, content []byte) string {
 		t.Helper()
@@ -0,0 +1,1716 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// The Kafka bridge implements the subset of the Kafka wire protocol used by
+// producers and consumers in groups, so that Kafka clients can be pointed
+// at the server. Topics are the JetStream streams of the account, with a
+// single partition whose offsets are the stream sequences minus one.
+// Records are stored on the first subject of the stream, with their key in
+// the Kafka-Key header, and the offsets committed by a consumer group are
+// the ack floor of a durable pull consumer named after the group.
+//
+// Only uncompressed and gzip record batches are supported, and neither
+// idempotent producers nor transactions are. When the server requires
+// authentication, clients authenticate with SASL/PLAIN as users of the
+// configured account, whose permissions apply to the subjects of the
+// streams they produce to and fetch from.
+
+// KafkaKeyHdr is the header holding the base64 encoded key of the records
+// produced by Kafka clients.
+const KafkaKeyHdr = "Kafka-Key"
+
+const (
+	// Maximum size of a request.
+	kafkaMaxRequestSize = 64 * 1024 * 1024
+	// Node id of the server in metadata responses.
+	kafkaNodeID = 0
+	// Interval at which fetch requests check for new messages, and group
+	// sessions are checked.
+	kafkaFetchPoll    = 25 * time.Millisecond
+	kafkaSessionCheck = time.Second
+)
+
+// Kafka API keys.
+const (
+	kafkaProduce          = 0
+	kafkaFetch            = 1
+	kafkaListOffsets      = 2
+	kafkaMetadata         = 3
+	kafkaOffsetCommit     = 8
+	kafkaOffsetFetch      = 9
+	kafkaFindCoordinator  = 10
+	kafkaJoinGroup        = 11
+	kafkaHeartbeat        = 12
+	kafkaLeaveGroup       = 13
+	kafkaSyncGroup        = 14
+	kafkaSaslHandshake    = 17
+	kafkaAPIVersions      = 18
+	kafkaSaslAuthenticate = 36
+)
+
+// Supported versions of each API, none of them using the flexible encoding.
+var kafkaAPIs = []struct {
+	key, min, max int16
+}{
+	{kafkaProduce, 3, 3},
+	{kafkaFetch, 4, 4},
+	{kafkaListOffsets, 1, 1},
+	{kafkaMetadata, 1, 1},
+	{kafkaOffsetCommit, 2, 2},
+	{kafkaOffsetFetch, 1, 1},
+	{kafkaFindCoordinator, 0, 0},
+	{kafkaJoinGroup, 2, 2},
+	{kafkaHeartbeat, 0, 0},
+	{kafkaLeaveGroup, 0, 0},
+	{kafkaSyncGroup, 0, 0},
+	{kafkaSaslHandshake, 1, 1},
+	{kafkaAPIVersions, 0, 2},
+	{kafkaSaslAuthenticate, 0, 1},
+}
+
+// Kafka error codes.
+const (
+	kafkaErrUnknown                  = -1
+	kafkaErrNone                     = 0
+	kafkaErrOffsetOutOfRange         = 1
+	kafkaErrCorruptMessage           = 2
+	kafkaErrUnknownTopicOrPartition  = 3
+	kafkaErrMessageTooLarge          = 10
+	kafkaErrInvalidTopic             = 17
+	kafkaErrIllegalGeneration        = 22
+	kafkaErrInconsistentGroupProto   = 23
+	kafkaErrInvalidGroupID           = 24
+	kafkaErrUnknownMemberID          = 25
+	kafkaErrRebalanceInProgress      = 27
+	kafkaErrTopicAuthorizationFailed = 29
+	kafkaErrUnsupportedSaslMechanism = 33
+	kafkaErrIllegalSaslState         = 34
+	kafkaErrUnsupportedVersion       = 35
+	kafkaErrUnsupportedMessageFormat = 43
+	kafkaErrPolicyViolation          = 44
+	kafkaErrSaslAuthenticationFailed = 58
+	kafkaErrUnsupportedCompression   = 76
+)
+
+var errKafkaShortRead = errors.New("kafka request too short")
+
+var kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// KafkaOpts are options for the Kafka protocol listener.
+type KafkaOpts struct {
+	// The server will accept Kafka client connections on this hostname/IP.
+	Host string
+	// The server will accept Kafka client connections on this port.
+	Port int
+	// The host:port advertised to clients in metadata responses. Defaults
+	// to the local address of each connection.
+	Advertise string
+	// Account of the streams, the global account if not set.
+	Account string
+	// TLS configuration is required for secure Kafka connections.
+	TLSConfig *tls.Config
+	// Create a stream, with the name of the topic as its subject, when
+	// a client refers to a topic that does not exist.
+	AutoCreateTopics bool
+}
+
+func validateKafkaOptions(o *Options) error {
+	ko := &o.Kafka
+	if ko.Port == 0 {
+		return nil
+	}
+	if !o.JetStream {
+		return fmt.Errorf("kafka listener requires jetstream to be enabled")
+	}
+	if ko.Advertise != _EMPTY_ {
+		if _, _, err := parseKafkaAdvertise(ko.Advertise); err != nil {
+			return fmt.Errorf("kafka advertise %q is invalid: %v", ko.Advertise, err)
+		}
+	}
+	if ko.Account == _EMPTY_ || ko.Account == globalAccountName || len(o.TrustedOperators) > 0 {
+		return nil
+	}
+	for _, a := range o.Accounts {
+		if a.Name == ko.Account {
+			return nil
+		}
+	}
+	return fmt.Errorf("kafka account %q is not defined", ko.Account)
+}
+
+func parseKafkaAdvertise(advertise string) (string, int32, error) {
+	host, sport, err := net.SplitHostPort(advertise)
+	if err != nil {
+		return _EMPTY_, 0, err
+	}
+	port, err := strconv.ParseInt(sport, 10, 32)
+	if err != nil {
+		return _EMPTY_, 0, err
+	}
+	return host, int32(port), nil
+}
+
+// srvKafka is the state of the Kafka listener.
+type srvKafka struct {
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	groups   map[string]*kafkaGroup
+}
+
+// startKafkaListener listens for Kafka client connections.
+func (s *Server) startKafkaListener() {
+	o := s.getOpts().Kafka
+
+	port := o.Port
+	if port == -1 {
+		port = 0
+	}
+	hp := net.JoinHostPort(o.Host, strconv.Itoa(port))
+	l, err := net.Listen("tcp", hp)
+	if err != nil {
+		s.Fatalf("Unable to listen for Kafka connections: %v", err)
+		return
+	}
+	s.Noticef("Listening for Kafka clients on %s", l.Addr())
+	if o.TLSConfig != nil {
+		l = tls.NewListener(l, o.TLSConfig)
+	}
+
+	s.mu.Lock()
+	s.kafka.listener = l
+	s.mu.Unlock()
+	s.kafka.mu.Lock()
+	s.kafka.conns = make(map[net.Conn]struct{})
+	s.kafka.groups = make(map[string]*kafkaGroup)
+	s.kafka.mu.Unlock()
+
+	s.startGoRoutine(s.kafkaSessionLoop)
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		tmpDelay := ACCEPT_MIN_SLEEP
+		for s.isRunning() {
+			conn, err := l.Accept()
+			if err != nil {
+				if s.isLameDuckMode() {
+					// Signal that we are not accepting new clients
+					s.ldmCh <- true
+					// Now wait for the Shutdown...
+					<-s.quitCh
+					return
+				}
+				tmpDelay = s.acceptError("Kafka", err, tmpDelay)
+				continue
+			}
+			tmpDelay = ACCEPT_MIN_SLEEP
+			s.startGoRoutine(func() {
+				s.handleKafkaConn(conn)
+				s.grWG.Done()
+			})
+		}
+		s.done <- true
+	})
+}
+
+// KafkaAddr returns the address of the Kafka listener, or nil if not
+// listening.
+func (s *Server) KafkaAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.kafka.listener == nil {
+		return nil
+	}
+	return s.kafka.listener.Addr()
+}
+
+// closeKafkaConns closes the connections of Kafka clients on shutdown.
+func (s *Server) closeKafkaConns() {
+	s.kafka.mu.Lock()
+	for conn := range s.kafka.conns {
+		conn.Close()
+	}
+	s.kafka.mu.Unlock()
+}
+
+// kafkaConn is a connection of a Kafka client.
+type kafkaConn struct {
+	srv  *Server
+	acc  *Account
+	conn net.Conn
+	// Address advertised in metadata and coordinator responses.
+	host string
+	port int32
+	// Identifier of the client from the request header.
+	clientID string
+	// Set when authentication is required, until the client authenticated.
+	authRequired bool
+	// Set after a SASL handshake.
+	sasl bool
+	// Internal client of the authenticated user, for its permissions.
+	c *client
+}
+
+func (s *Server) handleKafkaConn(conn net.Conn) {
+	s.kafka.mu.Lock()
+	if s.kafka.conns == nil {
+		s.kafka.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.kafka.conns[conn] = struct{}{}
+	s.kafka.mu.Unlock()
+
+	defer func() {
+		s.kafka.mu.Lock()
+		delete(s.kafka.conns, conn)
+		s.kafka.mu.Unlock()
+		conn.Close()
+	}()
+
+	o := s.getOpts().Kafka
+	acc := s.globalAccount()
+	if o.Account != _EMPTY_ {
+		var err error
+		if acc, err = s.LookupAccount(o.Account); err != nil {
+			s.Errorf("Kafka connection from %s rejected: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+	kc := &kafkaConn{srv: s, acc: acc, conn: conn, authRequired: !s.anonymousLogin(_EMPTY_)}
+	defer func() {
+		if kc.c != nil {
+			kc.c.closeConnection(ClientClosed)
+		}
+	}()
+	if o.Advertise != _EMPTY_ {
+		kc.host, kc.port, _ = parseKafkaAdvertise(o.Advertise)
+	} else if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		kc.host, kc.port = addr.IP.String(), int32(addr.Port)
+	}
+	s.Debugf("Kafka connection from %s", conn.RemoteAddr())
+
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		n := int32(binary.BigEndian.Uint32(size[:]))
+		if n < 8 || n > kafkaMaxRequestSize {
+			s.Debugf("Kafka connection from %s sent a request of invalid size %d", conn.RemoteAddr(), n)
+			return
+		}
+		req := make([]byte, n)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		resp, err := kc.processRequest(req)
+		if err != nil {
+			s.Debugf("Kafka connection from %s closed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		if resp == nil {
+			continue
+		}
+		binary.BigEndian.PutUint32(size[:], uint32(len(resp)))
+		if _, err := conn.Write(append(size[:], resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// processRequest returns the response to the request, without its size,
+// or nil if the request has no response.
+func (kc *kafkaConn) processRequest(req []byte) ([]byte, error) {
+	r := &kafkaReader{b: req}
+	key, version, correlation := r.int16(), r.int16(), r.int32()
+	kc.clientID, _ = r.nullableString()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	w := &kafkaWriter{}
+	w.int32(correlation)
+	if key == kafkaAPIVersions {
+		// Unsupported versions are answered with a version 0 response, so
+		// that the client can select a supported one.
+		kc.apiVersions(w, version)
+		return w.b, nil
+	}
+	supported := false
+	for _, api := range kafkaAPIs {
+		if api.key == key && version >= api.min && version <= api.max {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return nil, fmt.Errorf("unsupported api key %d version %d", key, version)
+	}
+	if kc.authRequired && key != kafkaSaslHandshake && key != kafkaSaslAuthenticate {
+		return nil, fmt.Errorf("api key %d requires authentication", key)
+	}
+
+	respond := true
+	switch key {
+	case kafkaProduce:
+		respond = kc.produce(r, w)
+	case kafkaFetch:
+		kc.fetch(r, w)
+	case kafkaListOffsets:
+		kc.listOffsets(r, w)
+	case kafkaMetadata:
+		kc.metadata(r, w)
+	case kafkaOffsetCommit:
+		kc.offsetCommit(r, w)
+	case kafkaOffsetFetch:
+		kc.offsetFetch(r, w)
+	case kafkaFindCoordinator:
+		kc.findCoordinator(r, w)
+	case kafkaJoinGroup:
+		kc.joinGroup(r, w)
+	case kafkaHeartbeat:
+		kc.heartbeat(r, w)
+	case kafkaLeaveGroup:
+		kc.leaveGroup(r, w)
+	case kafkaSyncGroup:
+		kc.syncGroup(r, w)
+	case kafkaSaslHandshake:
+		kc.saslHandshake(r, w)
+	case kafkaSaslAuthenticate:
+		kc.saslAuthenticate(r, w, version)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if !respond {
+		return nil, nil
+	}
+	return w.b, nil
+}
+
+func (kc *kafkaConn) apiVersions(w *kafkaWriter, version int16) {
+	code := int16(kafkaErrNone)
+	if version < 0 || version > 2 {
+		code, version = kafkaErrUnsupportedVersion, 0
+	}
+	w.int16(code)
+	w.int32(int32(len(kafkaAPIs)))
+	for _, api := range kafkaAPIs {
+		w.int16(api.key)
+		w.int16(api.min)
+		w.int16(api.max)
+	}
+	if version >= 1 {
+		// Throttle time.
+		w.int32(0)
+	}
+}
+
+func (kc *kafkaConn) saslHandshake(r *kafkaReader, w *kafkaWriter) {
+	code := int16(kafkaErrNone)
+	if mechanism := r.string(); mechanism == "PLAIN" {
+		kc.sasl = true
+	} else {
+		code = kafkaErrUnsupportedSaslMechanism
+	}
+	w.int16(code)
+	w.int32(1)
+	w.string("PLAIN")
+}
+
+func (kc *kafkaConn) saslAuthenticate(r *kafkaReader, w *kafkaWriter, version int16) {
+	auth := r.bytes()
+	if r.err != nil {
+		return
+	}
+	var err error
+	code := int16(kafkaErrNone)
+	if !kc.sasl || kc.c != nil {
+		code, err = kafkaErrIllegalSaslState, fmt.Errorf("unexpected SASL authentication")
+	} else if err = kc.authenticate(auth); err != nil {
+		kc.srv.Debugf("Kafka connection from %s not authorized: %v", kc.conn.RemoteAddr(), err)
+		code, err = kafkaErrSaslAuthenticationFailed, ErrAuthentication
+	}
+	w.int16(code)
+	if err != nil {
+		w.string(err.Error())
+	} else {
+		w.int16(-1)
+	}
+	// Server challenge.
+	w.bytes(nil)
+	if version >= 1 {
+		// Session lifetime.
+		w.int64(0)
+	}
+}
+
+// authenticate checks the SASL/PLAIN response, made of the authorization
+// identity, login and password separated by null bytes, and registers the
+// internal client of the user.
+func (kc *kafkaConn) authenticate(response []byte) error {
+	parts := bytes.SplitN(response, []byte{0}, 3)
+	if len(parts) != 3 || len(parts[1]) == 0 {
+		return fmt.Errorf("invalid PLAIN response")
+	}
+	login := string(parts[1])
+	acc, user, err := kc.srv.checkLogin(kc.conn.RemoteAddr(), login, string(parts[2]), _EMPTY_)
+	if err != nil {
+		return err
+	}
+	if acc != kc.acc {
+		return fmt.Errorf("user %q is not a user of account %q", login, kc.acc.Name)
+	}
+	c := kc.srv.createInternalAccountClient()
+	if err := kc.srv.registerLogin(c, acc, user); err != nil {
+		c.closeConnection(ClientClosed)
+		return err
+	}
+	kc.c, kc.authRequired = c, false
+	return nil
+}
+
+// allowed returns true if the authenticated user, if any, can publish, or
+// subscribe, to the subject.
+func (kc *kafkaConn) allowed(subject string, publish bool) bool {
+	if kc.c == nil {
+		return true
+	}
+	c := kc.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.perms == nil {
+		return true
+	}
+	if publish {
+		return c.pubAllowed(subject)
+	}
+	return c.canSubscribe(subject)
+}
+
+// streamAllowed returns true if the authenticated user, if any, can
+// publish to the subject records are stored on, or subscribe to all the
+// subjects of the stream.
+func (kc *kafkaConn) streamAllowed(mset *Stream, publish bool) bool {
+	subjects := mset.Config().Subjects
+	if publish && len(subjects) > 0 {
+		subjects = subjects[:1]
+	}
+	for _, subject := range subjects {
+		if !kc.allowed(subject, publish) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupTopic returns the stream of the topic, creating it if allowed.
+func (kc *kafkaConn) lookupTopic(topic string, create bool) (*Stream, int16) {
+	if !isValidName(topic) {
+		return nil, kafkaErrInvalidTopic
+	}
+	mset, err := kc.acc.LookupStream(topic)
+	if err == nil {
+		return mset, kafkaErrNone
+	}
+	if !create || !kc.srv.getOpts().Kafka.AutoCreateTopics {
+		return nil, kafkaErrUnknownTopicOrPartition
+	}
+	if !kc.allowed(topic, true) {
+		return nil, kafkaErrTopicAuthorizationFailed
+	}
+	mset, err = kc.acc.AddStream(&StreamConfig{Name: topic, Subjects: []string{topic}})
+	if err != nil {
+		kc.srv.Warnf("Kafka unable to create stream for topic %q: %v", topic, err)
+		return nil, kafkaErrUnknown
+	}
+	kc.srv.Noticef("Kafka created stream for topic %q", topic)
+	return mset, kafkaErrNone
+}
+
+// kafkaOffsets returns the first and next offsets of the stream.
+func kafkaOffsets(mset *Stream) (int64, int64) {
+	st := mset.State()
+	end := int64(st.LastSeq)
+	start := end
+	if st.FirstSeq > 0 && int64(st.FirstSeq)-1 < end {
+		start = int64(st.FirstSeq) - 1
+	}
+	return start, end
+}
+
+func kafkaStoreError(err error) int16 {
+	if err == ErrStreamMsgSizeExceeded || err == ErrMaxPayload {
+		return kafkaErrMessageTooLarge
+	}
+	return kafkaErrUnknown
+}
+
+func (kc *kafkaConn) produce(r *kafkaReader, w *kafkaWriter) bool {
+	r.nullableString() // Transactional id
+	acks := r.int16()
+	r.int32() // Timeout
+	nt := r.arrayLen()
+	w.int32(nt)
+	for i := int32(0); i < nt && r.err == nil; i++ {
+		topic := r.string()
+		w.string(topic)
+		np := r.arrayLen()
+		w.int32(np)
+		for j := int32(0); j < np && r.err == nil; j++ {
+			partition, records := r.int32(), r.bytes()
+			offset, code := int64(-1), int16(kafkaErrNone)
+			mset, code := kc.lookupTopic(topic, true)
+			if code == kafkaErrNone && !kc.streamAllowed(mset, true) {
+				code = kafkaErrTopicAuthorizationFailed
+			}
+			if code == kafkaErrNone && partition != 0 {
+				code = kafkaErrUnknownTopicOrPartition
+			}
+			if code == kafkaErrNone {
+				offset, code = kc.storeRecords(mset, records)
+			}
+			w.int32(partition)
+			w.int16(code)
+			w.int64(offset)
+			// Log append time, not used.
+			w.int64(-1)
+		}
+	}
+	// Throttle time.
+	w.int32(0)
+	return acks != 0
+}
+
+// storeRecords stores the records in the stream and returns the offset of
+// the first one.
+func (kc *kafkaConn) storeRecords(mset *Stream, records []byte) (int64, int16) {
+	subjects := mset.Config().Subjects
+	if len(subjects) == 0 || !subjectIsLiteral(subjects[0]) {
+		return -1, kafkaErrPolicyViolation
+	}
+	recs, code := decodeKafkaRecordBatches(records)
+	if code != kafkaErrNone {
+		return -1, code
+	}
+	first := int64(-1)
+	for _, rec := range recs {
+		seq, err := mset.Publish(subjects[0], rec.natsHeader(), rec.value)
+		if err != nil {
+			kc.srv.Debugf("Kafka unable to store record in stream %q: %v", mset.Name(), err)
+			return first, kafkaStoreError(err)
+		}
+		if first < 0 {
+			first = int64(seq) - 1
+		}
+	}
+	return first, kafkaErrNone
+}
+
+func (kc *kafkaConn) fetch(r *kafkaReader, w *kafkaWriter) {
+	r.int32() // Replica id
+	maxWait := time.Duration(r.int32()) * time.Millisecond
+	minBytes, maxBytes := int(r.int32()), int(r.int32())
+	r.int8() // Isolation level
+
+	type fetchPartition struct {
+		partition int32
+		offset    int64
+		maxBytes  int
+	}
+	type fetchTopic struct {
+		name       string
+		partitions []fetchPartition
+	}
+	var topics []fetchTopic
+	nt := r.arrayLen()
+	for i := int32(0); i < nt && r.err == nil; i++ {
+		ft := fetchTopic{name: r.string()}
+		np := r.arrayLen()
+		for j := int32(0); j < np && r.err == nil; j++ {
+			ft.partitions = append(ft.partitions, fetchPartition{r.int32(), r.int64(), int(r.int32())})
+		}
+		topics = append(topics, ft)
+	}
+	if r.err != nil {
+		return
+	}
+
+	// Wait for new messages until there are enough to respond, polling
+	// the streams since they have no way to notify other waiters.
+	deadline := time.Now().Add(maxWait)
+	for {
+		resp := &kafkaWriter{}
+		// Throttle time.
+		resp.int32(0)
+		resp.int32(int32(len(topics)))
+		total := 0
+		for _, ft := range topics {
+			resp.string(ft.name)
+			resp.int32(int32(len(ft.partitions)))
+			for _, fp := range ft.partitions {
+				hw, code := int64(-1), int16(kafkaErrNone)
+				var batch []byte
+				mset, code := kc.lookupTopic(ft.name, false)
+				if code == kafkaErrNone && !kc.streamAllowed(mset, false) {
+					code = kafkaErrTopicAuthorizationFailed
+				}
+				if code == kafkaErrNone && fp.partition != 0 {
+					code = kafkaErrUnknownTopicOrPartition
+				}
+				if code == kafkaErrNone {
+					var start int64
+					start, hw = kafkaOffsets(mset)
+					if fp.offset < start || fp.offset > hw {
+						code = kafkaErrOffsetOutOfRange
+					} else if budget := maxBytes - total; budget > 0 {
+						if fp.maxBytes < budget {
+							budget = fp.maxBytes
+						}
+						batch = kafkaLoadRecordBatch(mset, fp.offset, hw, budget)
+						total += len(batch)
+					}
+				}
+				resp.int32(fp.partition)
+				resp.int16(code)
+				resp.int64(hw)
+				// Last stable offset.
+				resp.int64(hw)
+				// Aborted transactions.
+				resp.int32(-1)
+				if batch == nil {
+					resp.int32(-1)
+				} else {
+					resp.bytes(batch)
+				}
+			}
+		}
+		if total >= minBytes || !time.Now().Before(deadline) || !kc.srv.isRunning() {
+			w.b = append(w.b, resp.b...)
+			return
+		}
+		time.Sleep(kafkaFetchPoll)
+	}
+}
+
+func (kc *kafkaConn) listOffsets(r *kafkaReader, w *kafkaWriter) {
+	r.int32() // Replica id
+	nt := r.arrayLen()
+	w.int32(nt)
+	for i := int32(0); i < nt && r.err == nil; i++ {
+		topic := r.string()
+		w.string(topic)
+		np := r.arrayLen()
+		w.int32(np)
+		for j := int32(0); j < np && r.err == nil; j++ {
+			partition, ts := r.int32(), r.int64()
+			offset, rts := int64(-1), int64(-1)
+			mset, code := kc.lookupTopic(topic, false)
+			if code == kafkaErrNone && !kc.streamAllowed(mset, false) {
+				code = kafkaErrTopicAuthorizationFailed
+			}
+			if code == kafkaErrNone && partition != 0 {
+				code = kafkaErrUnknownTopicOrPartition
+			}
+			if code == kafkaErrNone {
+				start, end := kafkaOffsets(mset)
+				switch ts {
+				case -1:
+					offset = end
+				case -2:
+					offset = start
+				default:
+					// First message at or after the time, if any.
+					offset = end
+					seq := mset.store.GetSeqFromTime(time.Unix(0, ts*int64(time.Millisecond)))
+					if sm, err := mset.GetMsg(seq); err == nil {
+						offset, rts = int64(seq)-1, sm.Time.UnixNano()/int64(time.Millisecond)
+					}
+				}
+			}
+			w.int32(partition)
+			w.int16(code)
+			w.int64(rts)
+			w.int64(offset)
+		}
+	}
+}
+
+func (kc *kafkaConn) metadata(r *kafkaReader, w *kafkaWriter) {
+	var topics []string
+	nt := r.arrayLen()
+	if nt < 0 {
+		for _, mset := range kc.acc.Streams() {
+			topics = append(topics, mset.Name())
+		}
+	}
+	for i := int32(0); i < nt && r.err == nil; i++ {
+		topics = append(topics, r.string())
+	}
+	if r.err != nil {
+		return
+	}
+
+	w.int32(1)
+	w.int32(kafkaNodeID)
+	w.string(kc.host)
+	w.int32(kc.port)
+	// Rack.
+	w.int16(-1)
+	// Controller id.
+	w.int32(kafkaNodeID)
+	w.int32(int32(len(topics)))
+	for _, topic := range topics {
+		_, code := kc.lookupTopic(topic, true)
+		w.int16(code)
+		w.string(topic)
+		// Not internal.
+		w.int8(0)
+		if code != kafkaErrNone {
+			w.int32(0)
+			continue
+		}
+		w.int32(1)
+		w.int16(kafkaErrNone)
+		w.int32(0)
+		// Leader, replicas and in sync replicas.
+		w.int32(kafkaNodeID)
+		w.int32(1)
+		w.int32(kafkaNodeID)
+		w.int32(1)
+		w.int32(kafkaNodeID)
+	}
+}
+
+func (kc *kafkaConn) findCoordinator(r *kafkaReader, w *kafkaWriter) {
+	group := r.string()
+	code := int16(kafkaErrNone)
+	if !isValidName(group) {
+		code = kafkaErrInvalidGroupID
+	}
+	w.int16(code)
+	w.int32(kafkaNodeID)
+	w.string(kc.host)
+	w.int32(kc.port)
+}
+
+// groupConsumer returns the durable consumer holding the offsets of the
+// group on the stream, creating it if needed.
+func groupConsumer(mset *Stream, group string, create bool) (*Consumer, error) {
+	if o := mset.LookupConsumer(group); o != nil || !create {
+		return o, nil
+	}
+	o, err := mset.AddConsumer(&ConsumerConfig{Durable: group, AckPolicy: AckExplicit})
+	if err != nil {
+		// Created concurrently.
+		if o := mset.LookupConsumer(group); o != nil {
+			return o, nil
+		}
+	}
+	return o, err
+}
+
+func (kc *kafkaConn) offsetCommit(r *kafkaReader, w *kafkaWriter) {
+	group, generation, member := r.string(), r.int32(), r.string()
+	r.int64() // Retention time
+	gcode := int16(kafkaErrNone)
+	if !isValidName(group) {
+		gcode = kafkaErrInvalidGroupID
+	} else if generation >= 0 || member != _EMPTY_ {
+		// Commits of members of the group, as opposed to standalone ones.
+		gcode = kc.srv.kafkaGroup(group).checkMember(member, generation)
+	}
+	nt := r.arrayLen()
+	w.int32(nt)
+	for i := int32(0); i < nt && r.err == nil; i++ {
+		topic := r.string()
+		w.string(topic)
+		np := r.arrayLen()
+		w.int32(np)
+		for j := int32(0); j < np && r.err == nil; j++ {
+			partition, offset := r.int32(), r.int64()
+			r.nullableString() // Metadata
+			code := gcode
+			var mset *Stream
+			if code == kafkaErrNone {
+				mset, code = kc.lookupTopic(topic, false)
+				if code == kafkaErrNone && !kc.streamAllowed(mset, false) {
+					code = kafkaErrTopicAuthorizationFailed
+				}
+			}
+			if code == kafkaErrNone && partition != 0 {
+				code = kafkaErrUnknownTopicOrPartition
+			}
+			if code == kafkaErrNone {
+				o, err := groupConsumer(mset, group, true)
+				if err != nil {
+					kc.srv.Warnf("Kafka unable to commit offset of group %q: %v", group, err)
+					code = kafkaErrUnknown
+				} else if offset >= 0 {
+					o.setAckFloor(uint64(offset))
+				}
+			}
+			w.int32(partition)
+			w.int16(code)
+		}
+	}
+}
+
+func (kc *kafkaConn) offsetFetch(r *kafkaReader, w *kafkaWriter) {
+	group := r.string()
+	nt := r.arrayLen()
+	w.int32(nt)
+	for i := int32(0); i < nt && r.err == nil; i++ {
+		topic := r.string()
+		w.string(topic)
+		np := r.arrayLen()
+		w.int32(np)
+		for j := int32(0); j < np && r.err == nil; j++ {
+			partition := r.int32()
+			offset := int64(-1)
+			mset, code := kc.lookupTopic(topic, false)
+			if code == kafkaErrNone && !kc.streamAllowed(mset, false) {
+				code = kafkaErrTopicAuthorizationFailed
+			}
+			if code == kafkaErrNone && partition != 0 {
+				code = kafkaErrUnknownTopicOrPartition
+			}
+			if code == kafkaErrNone {
+				if o, _ := groupConsumer(mset, group, false); o != nil {
+					offset = int64(o.Info().AckFloor.StreamSeq)
+				}
+			}
+			w.int32(partition)
+			w.int64(offset)
+			// Metadata.
+			w.string(_EMPTY_)
+			w.int16(code)
+		}
+	}
+}
+
+func (kc *kafkaConn) joinGroup(r *kafkaReader, w *kafkaWriter) {
+	group := r.string()
+	session := time.Duration(r.int32()) * time.Millisecond
+	rebalance := time.Duration(r.int32()) * time.Millisecond
+	member, ptype := r.string(), r.string()
+	var protocols []kafkaProtocol
+	np := r.arrayLen()
+	for i := int32(0); i < np && r.err == nil; i++ {
+		protocols = append(protocols, kafkaProtocol{r.string(), r.bytes()})
+	}
+	if r.err != nil {
+		return
+	}
+	var res *kafkaJoinResult
+	code := int16(kafkaErrInvalidGroupID)
+	if isValidName(group) {
+		res, member, code = kc.srv.kafkaGroup(group).join(kc.srv, member, kc.clientID, ptype, session, rebalance, protocols)
+	}
+	// Throttle time.
+	w.int32(0)
+	w.int16(code)
+	if code != kafkaErrNone {
+		w.int32(-1)
+		w.string(_EMPTY_)
+		w.string(_EMPTY_)
+		w.string(member)
+		w.int32(0)
+		return
+	}
+	w.int32(res.generation)
+	w.string(res.protocol)
+	w.string(res.leader)
+	w.string(member)
+	if member != res.leader {
+		w.int32(0)
+		return
+	}
+	w.int32(int32(len(res.members)))
+	for _, m := range res.members {
+		w.string(m.name)
+		w.bytes(m.metadata)
+	}
+}
+
+func (kc *kafkaConn) syncGroup(r *kafkaReader, w *kafkaWriter) {
+	group, generation, member := r.string(), r.int32(), r.string()
+	assignments := make(map[string][]byte)
+	na := r.arrayLen()
+	for i := int32(0); i < na && r.err == nil; i++ {
+		assignments[r.string()] = r.bytes()
+	}
+	if r.err != nil {
+		return
+	}
+	var assignment []byte
+	code := int16(kafkaErrInvalidGroupID)
+	if isValidName(group) {
+		assignment, code = kc.srv.kafkaGroup(group).sync(kc.srv, member, generation, assignments)
+	}
+	w.int16(code)
+	w.bytes(assignment)
+}
+
+func (kc *kafkaConn) heartbeat(r *kafkaReader, w *kafkaWriter) {
+	group, generation, member := r.string(), r.int32(), r.string()
+	code := int16(kafkaErrInvalidGroupID)
+	if isValidName(group) {
+		code = kc.srv.kafkaGroup(group).heartbeat(member, generation)
+	}
+	w.int16(code)
+}
+
+func (kc *kafkaConn) leaveGroup(r *kafkaReader, w *kafkaWriter) {
+	group, member := r.string(), r.string()
+	code := int16(kafkaErrInvalidGroupID)
+	if isValidName(group) {
+		code = kc.srv.kafkaGroup(group).leave(member)
+	}
+	w.int16(code)
+}
+
+// Group coordination.
+
+type kafkaGroupState int
+
+const (
+	kafkaGroupEmpty kafkaGroupState = iota
+	kafkaGroupPreparingRebalance
+	kafkaGroupCompletingRebalance
+	kafkaGroupStable
+)
+
+// kafkaProtocol is an assignment protocol of a member, or a member and its
+// metadata in join responses.
+type kafkaProtocol struct {
+	name     string
+	metadata []byte
+}
+
+type kafkaMember struct {
+	id         string
+	protocols  []kafkaProtocol
+	session    time.Duration
+	rebalance  time.Duration
+	seen       time.Time
+	joined     bool
+	assignment []byte
+}
+
+// kafkaJoinResult is the outcome of a rebalance, shared with the members
+// waiting for it.
+type kafkaJoinResult struct {
+	done       chan struct{}
+	generation int32
+	protocol   string
+	leader     string
+	members    []kafkaProtocol
+}
+
+// kafkaSyncResult is closed when the leader sent the assignments, or
+// aborted if a new rebalance started before.
+type kafkaSyncResult struct {
+	done    chan struct{}
+	aborted bool
+}
+
+type kafkaGroup struct {
+	mu         sync.Mutex
+	name       string
+	state      kafkaGroupState
+	generation int32
+	ptype      string
+	leader     string
+	members    map[string]*kafkaMember
+	joinRes    *kafkaJoinResult
+	syncRes    *kafkaSyncResult
+	rtmr       *time.Timer
+}
+
+// kafkaGroup returns the group, creating it if needed.
+func (s *Server) kafkaGroup(name string) *kafkaGroup {
+	s.kafka.mu.Lock()
+	defer s.kafka.mu.Unlock()
+	g := s.kafka.groups[name]
+	if g == nil {
+		g = &kafkaGroup{name: name, members: make(map[string]*kafkaMember)}
+		if s.kafka.groups != nil {
+			s.kafka.groups[name] = g
+		}
+	}
+	return g
+}
+
+// supports returns true if all members support the protocol.
+// Lock should be held.
+func (g *kafkaGroup) supports(protocol string, except string) bool {
+	for _, m := range g.members {
+		if m.id == except {
+			continue
+		}
+		found := false
+		for _, p := range m.protocols {
+			if p.name == protocol {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// prepareRebalance waits for all members to join again. Lock should be held.
+func (g *kafkaGroup) prepareRebalance() {
+	if g.state == kafkaGroupPreparingRebalance {
+		return
+	}
+	if g.syncRes != nil {
+		g.syncRes.aborted = true
+		close(g.syncRes.done)
+		g.syncRes = nil
+	}
+	g.state = kafkaGroupPreparingRebalance
+	var timeout time.Duration
+	for _, m := range g.members {
+		m.joined = false
+		if m.rebalance > timeout {
+			timeout = m.rebalance
+		}
+	}
+	res := &kafkaJoinResult{done: make(chan struct{})}
+	g.joinRes = res
+	g.rtmr = time.AfterFunc(timeout, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.joinRes != res {
+			return
+		}
+		// Members that did not join in time are removed.
+		for id, m := range g.members {
+			if !m.joined {
+				delete(g.members, id)
+			}
+		}
+		g.completeJoin()
+	})
+}
+
+// completeJoin starts a new generation if all members joined.
+// Lock should be held.
+func (g *kafkaGroup) completeJoin() {
+	if g.state != kafkaGroupPreparingRebalance {
+		return
+	}
+	for _, m := range g.members {
+		if !m.joined {
+			return
+		}
+	}
+	res := g.joinRes
+	g.joinRes = nil
+	if g.rtmr != nil {
+		g.rtmr.Stop()
+		g.rtmr = nil
+	}
+	if len(g.members) == 0 {
+		g.state, g.leader, g.ptype = kafkaGroupEmpty, _EMPTY_, _EMPTY_
+		close(res.done)
+		return
+	}
+	if g.members[g.leader] == nil {
+		g.leader = _EMPTY_
+		for id := range g.members {
+			if g.leader == _EMPTY_ || id < g.leader {
+				g.leader = id
+			}
+		}
+	}
+	// The first protocol of the leader supported by all members.
+	for _, p := range g.members[g.leader].protocols {
+		if g.supports(p.name, _EMPTY_) {
+			res.protocol = p.name
+			break
+		}
+	}
+	now := time.Now()
+	for _, m := range g.members {
+		m.seen = now
+		m.assignment = nil
+		for _, p := range m.protocols {
+			if p.name == res.protocol {
+				res.members = append(res.members, kafkaProtocol{m.id, p.metadata})
+				break
+			}
+		}
+	}
+	g.generation++
+	res.generation, res.leader = g.generation, g.leader
+	g.state = kafkaGroupCompletingRebalance
+	g.syncRes = &kafkaSyncResult{done: make(chan struct{})}
+	close(res.done)
+}
+
+// removeMember removes the member and rebalances the group.
+// Lock should be held.
+func (g *kafkaGroup) removeMember(id string) {
+	delete(g.members, id)
+	g.prepareRebalance()
+	g.completeJoin()
+}
+
+func (g *kafkaGroup) join(s *Server, member, clientID, ptype string, session, rebalance time.Duration, protocols []kafkaProtocol) (*kafkaJoinResult, string, int16) {
+	g.mu.Lock()
+	m := g.members[member]
+	if member != _EMPTY_ && m == nil {
+		g.mu.Unlock()
+		return nil, member, kafkaErrUnknownMemberID
+	}
+	if len(g.members) > 0 && ptype != g.ptype {
+		g.mu.Unlock()
+		return nil, member, kafkaErrInconsistentGroupProto
+	}
+	supported := false
+	for _, p := range protocols {
+		if g.supports(p.name, member) {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		g.mu.Unlock()
+		return nil, member, kafkaErrInconsistentGroupProto
+	}
+	if m == nil {
+		m = &kafkaMember{id: fmt.Sprintf("%s-%s", clientID, nuid.Next())}
+		g.members[m.id] = m
+	}
+	m.protocols, m.session, m.rebalance, m.seen = protocols, session, rebalance, time.Now()
+	g.ptype = ptype
+	// A member joining a stable group with the same protocols gets the
+	// current generation again, as it may have missed the response.
+	g.prepareRebalance()
+	m.joined = true
+	res := g.joinRes
+	g.completeJoin()
+	g.mu.Unlock()
+
+	select {
+	case <-res.done:
+	case <-s.quitCh:
+		return nil, m.id, kafkaErrRebalanceInProgress
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.members[m.id] == nil {
+		return nil, m.id, kafkaErrUnknownMemberID
+	}
+	return res, m.id, kafkaErrNone
+}
+
+// checkMember returns the error code if the member is not part of the
+// generation of the group.
+func (g *kafkaGroup) checkMember(member string, generation int32) int16 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.checkMemberLocked(member, generation)
+}
+
+// Lock should be held.
+func (g *kafkaGroup) checkMemberLocked(member string, generation int32) int16 {
+	m := g.members[member]
+	switch {
+	case m == nil:
+		return kafkaErrUnknownMemberID
+	case generation != g.generation:
+		return kafkaErrIllegalGeneration
+	case g.state == kafkaGroupPreparingRebalance:
+		return kafkaErrRebalanceInProgress
+	}
+	m.seen = time.Now()
+	return kafkaErrNone
+}
+
+func (g *kafkaGroup) sync(s *Server, member string, generation int32, assignments map[string][]byte) ([]byte, int16) {
+	g.mu.Lock()
+	if code := g.checkMemberLocked(member, generation); code != kafkaErrNone {
+		g.mu.Unlock()
+		return nil, code
+	}
+	if g.state == kafkaGroupCompletingRebalance && member == g.leader {
+		for id, m := range g.members {
+			m.assignment = assignments[id]
+		}
+		g.state = kafkaGroupStable
+		close(g.syncRes.done)
+		g.syncRes = nil
+	}
+	res := g.syncRes
+	g.mu.Unlock()
+
+	if res != nil {
+		select {
+		case <-res.done:
+		case <-s.quitCh:
+		}
+		if res.aborted {
+			return nil, kafkaErrRebalanceInProgress
+		}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m := g.members[member]
+	if m == nil {
+		return nil, kafkaErrUnknownMemberID
+	}
+	if g.state != kafkaGroupStable || g.generation != generation {
+		return nil, kafkaErrRebalanceInProgress
+	}
+	return m.assignment, kafkaErrNone
+}
+
+func (g *kafkaGroup) heartbeat(member string, generation int32) int16 {
+	return g.checkMember(member, generation)
+}
+
+func (g *kafkaGroup) leave(member string) int16 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.members[member] == nil {
+		return kafkaErrUnknownMemberID
+	}
+	g.removeMember(member)
+	return kafkaErrNone
+}
+
+// expireSessions removes the members that did not send a heartbeat within
+// their session timeout, except those waiting for a rebalance.
+func (g *kafkaGroup) expireSessions(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for id, m := range g.members {
+		if g.state == kafkaGroupPreparingRebalance && m.joined {
+			continue
+		}
+		if now.Sub(m.seen) > m.session {
+			g.removeMember(id)
+		}
+	}
+}
+
+// kafkaSessionLoop expires the members of groups whose session timed out.
+func (s *Server) kafkaSessionLoop() {
+	defer s.grWG.Done()
+
+	t := time.NewTicker(kafkaSessionCheck)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case now := <-t.C:
+			s.kafka.mu.Lock()
+			groups := make([]*kafkaGroup, 0, len(s.kafka.groups))
+			for _, g := range s.kafka.groups {
+				groups = append(groups, g)
+			}
+			s.kafka.mu.Unlock()
+			for _, g := range groups {
+				g.expireSessions(now)
+			}
+		}
+	}
+}
+
+// Records.
+
+type kafkaRecord struct {
+	offset    int64
+	timestamp int64
+	key       []byte
+	value     []byte
+	headers   []kafkaProtocol
+}
+
+// natsHeader returns the header of the message storing the record.
+// Headers that can not be represented are dropped.
+func (rec *kafkaRecord) natsHeader() []byte {
+	if rec.key == nil && len(rec.headers) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	b.WriteString("NATS/1.0" + _CRLF_)
+	if rec.key != nil {
+		fmt.Fprintf(&b, "%s: %s%s", KafkaKeyHdr, base64.StdEncoding.EncodeToString(rec.key), _CRLF_)
+	}
+	for _, h := range rec.headers {
+		if h.name == _EMPTY_ || bytes.ContainsAny([]byte(h.name), ": \r\n") || bytes.ContainsAny(h.metadata, "\r\n") {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s%s", h.name, h.metadata, _CRLF_)
+	}
+	b.WriteString(_CRLF_)
+	return b.Bytes()
+}
+
+// kafkaRecordFromMsg returns the key and headers of the record of a stored
+// message.
+func kafkaRecordFromMsg(sm *StoredMsg) *kafkaRecord {
+	rec := &kafkaRecord{value: sm.Data, timestamp: sm.Time.UnixNano() / int64(time.Millisecond)}
+	if len(sm.Header) == 0 {
+		return rec
+	}
+	for _, line := range bytes.Split(sm.Header, []byte(_CRLF_))[1:] {
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		key, value := string(line[:i]), bytes.TrimSpace(line[i+1:])
+		if key == KafkaKeyHdr {
+			if k, err := base64.StdEncoding.DecodeString(string(value)); err == nil {
+				rec.key = k
+				continue
+			}
+		}
+		rec.headers = append(rec.headers, kafkaProtocol{key, value})
+	}
+	return rec
+}
+
+// decodeKafkaRecordBatches decodes the records of version 2 record batches.
+func decodeKafkaRecordBatches(b []byte) ([]*kafkaRecord, int16) {
+	var recs []*kafkaRecord
+	for len(b) > 0 {
+		r := &kafkaReader{b: b}
+		base, length := r.int64(), r.int32()
+		if r.err != nil || length < 0 || int(length) > len(r.b) {
+			return nil, kafkaErrCorruptMessage
+		}
+		batch := &kafkaReader{b: r.b[:length]}
+		b = r.b[length:]
+
+		batch.int32() // Partition leader epoch
+		if magic := batch.int8(); magic != 2 {
+			return nil, kafkaErrUnsupportedMessageFormat
+		}
+		crc := uint32(batch.int32())
+		if batch.err != nil || crc32.Checksum(batch.b, kafkaCRCTable) != crc {
+			return nil, kafkaErrCorruptMessage
+		}
+		attrs := batch.int16()
+		batch.int32() // Last offset delta
+		baseTs := batch.int64()
+		// Max timestamp, producer id and epoch, and base sequence.
+		batch.skip(8 + 8 + 2 + 4)
+		count := batch.int32()
+		if batch.err != nil {
+			return nil, kafkaErrCorruptMessage
+		}
+		// Control batches of transactions.
+		if attrs&0x20 != 0 {
+			continue
+		}
+		switch attrs & 0x7 {
+		case 0:
+		case 1:
+			zr, err := gzip.NewReader(bytes.NewReader(batch.b))
+			if err != nil {
+				return nil, kafkaErrCorruptMessage
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(zr, kafkaMaxRequestSize))
+			if err != nil {
+				return nil, kafkaErrCorruptMessage
+			}
+			batch.b = data
+		default:
+			return nil, kafkaErrUnsupportedCompression
+		}
+		for i := int32(0); i < count; i++ {
+			length := batch.varint()
+			if batch.err != nil || length < 0 || int(length) > len(batch.b) {
+				return nil, kafkaErrCorruptMessage
+			}
+			rr := &kafkaReader{b: batch.b[:length]}
+			batch.b = batch.b[length:]
+			rr.int8() // Attributes
+			rec := &kafkaRecord{timestamp: baseTs + rr.varint(), offset: base + rr.varint()}
+			rec.key, rec.value = rr.varBytes(), rr.varBytes()
+			nh := rr.varint()
+			for j := int64(0); j < nh && rr.err == nil; j++ {
+				rec.headers = append(rec.headers, kafkaProtocol{string(rr.varBytes()), rr.varBytes()})
+			}
+			if rr.err != nil {
+				return nil, kafkaErrCorruptMessage
+			}
+			recs = append(recs, rec)
+		}
+	}
+	return recs, kafkaErrNone
+}
+
+// kafkaLoadRecordBatch returns a record batch with the messages from the
+// offset up to the end, within max bytes but with at least one message,
+// or nil if there are none.
+func kafkaLoadRecordBatch(mset *Stream, offset, end int64, max int) []byte {
+	var recs []*kafkaRecord
+	size := 0
+	for o := offset; o < end; o++ {
+		sm, err := mset.GetMsg(uint64(o) + 1)
+		if err != nil {
+			// Deleted message.
+			continue
+		}
+		rec := kafkaRecordFromMsg(sm)
+		rec.offset = o
+		// Approximate size of the encoded record.
+		rsize := len(rec.key) + len(rec.value) + 16
+		for _, h := range rec.headers {
+			rsize += len(h.name) + len(h.metadata) + 4
+		}
+		if len(recs) > 0 && size+rsize > max {
+			break
+		}
+		recs = append(recs, rec)
+		size += rsize
+	}
+	if len(recs) == 0 {
+		return nil
+	}
+	return encodeKafkaRecordBatch(recs)
+}
+
+// encodeKafkaRecordBatch returns an uncompressed version 2 record batch.
+func encodeKafkaRecordBatch(recs []*kafkaRecord) []byte {
+	base, baseTs, maxTs := recs[0].offset, recs[0].timestamp, recs[0].timestamp
+	var records kafkaWriter
+	for _, rec := range recs {
+		if rec.timestamp > maxTs {
+			maxTs = rec.timestamp
+		}
+		var rw kafkaWriter
+		// Attributes.
+		rw.int8(0)
+		rw.varint(rec.timestamp - baseTs)
+		rw.varint(rec.offset - base)
+		rw.varBytes(rec.key)
+		rw.varBytes(rec.value)
+		rw.varint(int64(len(rec.headers)))
+		for _, h := range rec.headers {
+			rw.varBytes([]byte(h.name))
+			rw.varBytes(h.metadata)
+		}
+		records.varint(int64(len(rw.b)))
+		records.b = append(records.b, rw.b...)
+	}
+
+	var body kafkaWriter
+	// Attributes: no compression and create time.
+	body.int16(0)
+	body.int32(int32(recs[len(recs)-1].offset - base))
+	body.int64(baseTs)
+	body.int64(maxTs)
+	// No producer id, epoch and base sequence.
+	body.int64(-1)
+	body.int16(-1)
+	body.int32(-1)
+	body.int32(int32(len(recs)))
+	body.b = append(body.b, records.b...)
+
+	var w kafkaWriter
+	w.int64(base)
+	// Length of the batch after this field.
+	w.int32(int32(4 + 1 + 4 + len(body.b)))
+	// Partition leader epoch.
+	w.int32(0)
+	// Magic.
+	w.int8(2)
+	w.int32(int32(crc32.Checksum(body.b, kafkaCRCTable)))
+	w.b = append(w.b, body.b...)
+	return w.b
+}
+
+// Encoding.
+
+// kafkaReader decodes the fields of a request. The first error is kept and
+// further reads return zero values.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil || n < 0 || len(r.b) < n {
+		r.err = errKafkaShortRead
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *kafkaReader) skip(n int) {
+	r.next(n)
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) nullableString() (string, bool) {
+	n := r.int16()
+	if n < 0 {
+		return _EMPTY_, false
+	}
+	return string(r.next(int(n))), r.err == nil
+}
+
+func (r *kafkaReader) string() string {
+	s, _ := r.nullableString()
+	return s
+}
+
+func (r *kafkaReader) bytes() []byte {
+	n := r.int32()
+	if n < 0 {
+		return nil
+	}
+	return r.next(int(n))
+}
+
+// arrayLen returns the length of an array, -1 if null.
+func (r *kafkaReader) arrayLen() int32 {
+	n := r.int32()
+	if r.err == nil && int(n) > len(r.b) {
+		r.err = errKafkaShortRead
+	}
+	if r.err != nil {
+		return 0
+	}
+	return n
+}
+
+func (r *kafkaReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errKafkaShortRead
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) varBytes() []byte {
+	n := r.varint()
+	if n < 0 {
+		return nil
+	}
+	return r.next(int(n))
+}
+
+// kafkaWriter encodes the fields of a response.
+type kafkaWriter struct {
+	b []byte
+}
+
+func (w *kafkaWriter) int8(v int8) {
+	w.b = append(w.b, byte(v))
+}
+
+func (w *kafkaWriter) int16(v int16) {
+	w.b = append(w.b, byte(v>>8), byte(v))
+}
+
+func (w *kafkaWriter) int32(v int32) {
+	w.b = append(w.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *kafkaWriter) int64(v int64) {
+	w.int32(int32(v >> 32))
+	w.int32(int32(v))
+}
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.b = append(w.b, s...)
+}
+
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	w.b = append(w.b, b...)
+}
+
+func (w *kafkaWriter) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.b = append(w.b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func (w *kafkaWriter) varBytes(b []byte) {
+	if b == nil {
+		w.varint(-1)
+		return
+	}
+	w.varint(int64(len(b)))
+	w.b = append(w.b, b...)
+}
@@ -0,0 +1,591 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type kafkaTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	corr int32
+}
+
+func newKafkaTestClient(t *testing.T, s *Server) *kafkaTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.KafkaAddr().String())
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	return &kafkaTestClient{t: t, conn: conn}
+}
+
+// write sends the request.
+func (c *kafkaTestClient) write(key, version int16, body func(w *kafkaWriter)) {
+	c.t.Helper()
+	c.corr++
+	w := &kafkaWriter{}
+	w.int16(key)
+	w.int16(version)
+	w.int32(c.corr)
+	w.string("test")
+	if body != nil {
+		body(w)
+	}
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(w.b)))
+	if _, err := c.conn.Write(append(size, w.b...)); err != nil {
+		c.t.Fatalf("Error writing request: %v", err)
+	}
+}
+
+// request sends the request and returns the reader of the response body.
+func (c *kafkaTestClient) request(key, version int16, body func(w *kafkaWriter)) *kafkaReader {
+	c.t.Helper()
+	c.write(key, version, body)
+	size := make([]byte, 4)
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c.conn, size); err != nil {
+		c.t.Fatalf("Error reading response: %v", err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size))
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		c.t.Fatalf("Error reading response: %v", err)
+	}
+	r := &kafkaReader{b: resp}
+	if corr := r.int32(); corr != c.corr {
+		c.t.Fatalf("Expected correlation id %d, got %d", c.corr, corr)
+	}
+	return r
+}
+
+func runKafkaServer(t *testing.T, autoCreate bool) (*Server, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kafka")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	opts := DefaultOptions()
+	opts.Cluster.Port = 0
+	opts.JetStream = true
+	opts.StoreDir = filepath.Join(dir, "js")
+	opts.Kafka.Host = "127.0.0.1"
+	opts.Kafka.Port = -1
+	opts.Kafka.AutoCreateTopics = autoCreate
+	return RunServer(opts), dir
+}
+
+func TestKafkaAPIVersions(t *testing.T) {
+	s, dir := runKafkaServer(t, false)
+	defer os.RemoveAll(dir)
+	defer s.Shutdown()
+
+	c := newKafkaTestClient(t, s)
+	defer c.conn.Close()
+	for _, test := range []struct {
+		version int16
+		code    int16
+	}{
+		{2, kafkaErrNone},
+		{3, kafkaErrUnsupportedVersion},
+	} {
+		r := c.request(kafkaAPIVersions, test.version, nil)
+		if code := r.int16(); code != test.code {
+			t.Fatalf("Expected error code %d, got %d", test.code, code)
+		}
+		if n := r.arrayLen(); int(n) != len(kafkaAPIs) {
+			t.Fatalf("Expected %d apis, got %d", len(kafkaAPIs), n)
+		}
+	}
+}
+
+func TestKafkaProduceFetch(t *testing.T) {
+	s, dir := runKafkaServer(t, true)
+	defer os.RemoveAll(dir)
+	defer s.Shutdown()
+
+	c := newKafkaTestClient(t, s)
+	defer c.conn.Close()
+
+	// Metadata creates the topic.
+	r := c.request(kafkaMetadata, 1, func(w *kafkaWriter) {
+		w.int32(2)
+		w.string("orders")
+		w.string("bad.topic")
+	})
+	if n := r.arrayLen(); n != 1 {
+		t.Fatalf("Expected 1 broker, got %d", n)
+	}
+	r.int32()
+	host, port := r.string(), r.int32()
+	if addr := s.KafkaAddr().(*net.TCPAddr); host != "127.0.0.1" || int(port) != addr.Port {
+		t.Fatalf("Unexpected broker %s:%d", host, port)
+	}
+	r.string()
+	r.int32()
+	r.arrayLen()
+	for _, expected := range []int16{kafkaErrNone, kafkaErrInvalidTopic} {
+		if code := r.int16(); code != expected {
+			t.Fatalf("Expected error code %d, got %d", expected, code)
+		}
+		r.string()
+		r.int8()
+		for i, np := int32(0), r.arrayLen(); i < np; i++ {
+			r.int16()
+			r.int32()
+			r.int32()
+			r.skip(int(4 * r.arrayLen()))
+			r.skip(int(4 * r.arrayLen()))
+		}
+	}
+	mset, err := s.GlobalAccount().LookupStream("orders")
+	if err != nil {
+		t.Fatalf("Expected stream to be created: %v", err)
+	}
+
+	// Messages of NATS clients are in the topic as well.
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	natsPub(t, nc, "orders", []byte("from nats"))
+	natsFlush(t, nc)
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if st := mset.State(); st.Msgs != 1 {
+			return io.EOF
+		}
+		return nil
+	})
+
+	batch := encodeKafkaRecordBatch([]*kafkaRecord{
+		{key: []byte("k1"), value: []byte("v1"), headers: []kafkaProtocol{{"h", []byte("1")}}},
+		{offset: 1, value: []byte("v2")},
+	})
+	r = c.request(kafkaProduce, 3, func(w *kafkaWriter) {
+		w.int16(-1)
+		w.int16(1)
+		w.int32(1000)
+		w.int32(1)
+		w.string("orders")
+		w.int32(1)
+		w.int32(0)
+		w.bytes(batch)
+	})
+	r.arrayLen()
+	r.string()
+	r.arrayLen()
+	r.int32()
+	if code, offset := r.int16(), r.int64(); code != kafkaErrNone || offset != 1 {
+		t.Fatalf("Unexpected produce response %d, offset %d", code, offset)
+	}
+	sm, err := mset.GetMsg(2)
+	if err != nil {
+		t.Fatalf("Error loading message: %v", err)
+	}
+	if !strings.Contains(string(sm.Header), "Kafka-Key: azE=\r\nh: 1\r\n") || string(sm.Data) != "v1" {
+		t.Fatalf("Unexpected message %q %q", sm.Header, sm.Data)
+	}
+
+	fetch := func(offset int64) (int16, int64, []*kafkaRecord) {
+		t.Helper()
+		r := c.request(kafkaFetch, 4, func(w *kafkaWriter) {
+			w.int32(-1)
+			w.int32(100)
+			w.int32(1)
+			w.int32(1024 * 1024)
+			w.int8(0)
+			w.int32(1)
+			w.string("orders")
+			w.int32(1)
+			w.int32(0)
+			w.int64(offset)
+			w.int32(1024 * 1024)
+		})
+		r.int32()
+		r.arrayLen()
+		r.string()
+		r.arrayLen()
+		r.int32()
+		code, hw := r.int16(), r.int64()
+		r.int64()
+		r.int32()
+		recs, rc := decodeKafkaRecordBatches(r.bytes())
+		if rc != kafkaErrNone || r.err != nil {
+			t.Fatalf("Error decoding fetch response: %d %v", rc, r.err)
+		}
+		return code, hw, recs
+	}
+	code, hw, recs := fetch(0)
+	if code != kafkaErrNone || hw != 3 || len(recs) != 3 {
+		t.Fatalf("Unexpected fetch response %d, high watermark %d, %d records", code, hw, len(recs))
+	}
+	for i, expected := range []string{"from nats", "v1", "v2"} {
+		if recs[i].offset != int64(i) || string(recs[i].value) != expected {
+			t.Fatalf("Unexpected record %d: %+v", i, recs[i])
+		}
+	}
+	if string(recs[1].key) != "k1" || len(recs[1].headers) != 1 || recs[1].headers[0].name != "h" {
+		t.Fatalf("Unexpected record %+v", recs[1])
+	}
+	// Caught up, after waiting.
+	start := time.Now()
+	if code, _, recs := fetch(3); code != kafkaErrNone || len(recs) != 0 || time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("Unexpected fetch response %d, %d records", code, len(recs))
+	}
+	if code, _, _ := fetch(4); code != kafkaErrOffsetOutOfRange {
+		t.Fatalf("Expected out of range, got %d", code)
+	}
+
+	for _, test := range []struct {
+		ts     int64
+		offset int64
+	}{
+		{-2, 0},
+		{-1, 3},
+	} {
+		r = c.request(kafkaListOffsets, 1, func(w *kafkaWriter) {
+			w.int32(-1)
+			w.int32(1)
+			w.string("orders")
+			w.int32(1)
+			w.int32(0)
+			w.int64(test.ts)
+		})
+		r.arrayLen()
+		r.string()
+		r.arrayLen()
+		r.int32()
+		r.int16()
+		r.int64()
+		if offset := r.int64(); offset != test.offset {
+			t.Fatalf("Expected offset %d for %d, got %d", test.offset, test.ts, offset)
+		}
+	}
+}
+
+func TestKafkaConsumerGroup(t *testing.T) {
+	s, dir := runKafkaServer(t, false)
+	defer os.RemoveAll(dir)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "orders"})
+	if err != nil {
+		t.Fatalf("Error adding stream: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		mset.Publish("orders", nil, []byte("msg"))
+	}
+
+	join := func(c *kafkaTestClient, member string) (int16, int32, string, string, int32) {
+		t.Helper()
+		r := c.request(kafkaJoinGroup, 2, func(w *kafkaWriter) {
+			w.string("grp")
+			w.int32(10000)
+			w.int32(2000)
+			w.string(member)
+			w.string("consumer")
+			w.int32(1)
+			w.string("range")
+			w.bytes([]byte("meta"))
+		})
+		r.int32()
+		code, generation := r.int16(), r.int32()
+		r.string()
+		leader, member := r.string(), r.string()
+		return code, generation, leader, member, r.arrayLen()
+	}
+	sync := func(c *kafkaTestClient, member string, generation int32, assign bool) (int16, string) {
+		t.Helper()
+		r := c.request(kafkaSyncGroup, 0, func(w *kafkaWriter) {
+			w.string("grp")
+			w.int32(generation)
+			w.string(member)
+			if assign {
+				w.int32(1)
+				w.string(member)
+				w.bytes([]byte("orders-0"))
+			} else {
+				w.int32(0)
+			}
+		})
+		return r.int16(), string(r.bytes())
+	}
+	heartbeat := func(c *kafkaTestClient, member string, generation int32) int16 {
+		t.Helper()
+		return c.request(kafkaHeartbeat, 0, func(w *kafkaWriter) {
+			w.string("grp")
+			w.int32(generation)
+			w.string(member)
+		}).int16()
+	}
+
+	c1 := newKafkaTestClient(t, s)
+	defer c1.conn.Close()
+	r := c1.request(kafkaFindCoordinator, 0, func(w *kafkaWriter) { w.string("grp") })
+	if code := r.int16(); code != kafkaErrNone {
+		t.Fatalf("Unexpected find coordinator error %d", code)
+	}
+
+	code, gen, leader, m1, members := join(c1, _EMPTY_)
+	if code != kafkaErrNone || gen != 1 || leader != m1 || members != 1 || !strings.HasPrefix(m1, "test-") {
+		t.Fatalf("Unexpected join response %d %d %q %q %d", code, gen, leader, m1, members)
+	}
+	if code, a := sync(c1, m1, gen, true); code != kafkaErrNone || a != "orders-0" {
+		t.Fatalf("Unexpected sync response %d %q", code, a)
+	}
+	if code := heartbeat(c1, m1, gen); code != kafkaErrNone {
+		t.Fatalf("Unexpected heartbeat error %d", code)
+	}
+
+	// Offsets are the ack floor of the consumer of the group.
+	r = c1.request(kafkaOffsetCommit, 2, func(w *kafkaWriter) {
+		w.string("grp")
+		w.int32(gen)
+		w.string(m1)
+		w.int64(-1)
+		w.int32(1)
+		w.string("orders")
+		w.int32(1)
+		w.int32(0)
+		w.int64(4)
+		w.string(_EMPTY_)
+	})
+	r.arrayLen()
+	r.string()
+	r.arrayLen()
+	r.int32()
+	if code := r.int16(); code != kafkaErrNone {
+		t.Fatalf("Unexpected commit error %d", code)
+	}
+	o := mset.LookupConsumer("grp")
+	if o == nil {
+		t.Fatal("Expected consumer of the group")
+	}
+	if info := o.Info(); info.AckFloor.StreamSeq != 4 || info.Delivered.StreamSeq != 4 {
+		t.Fatalf("Unexpected consumer state: %+v", info)
+	}
+	r = c1.request(kafkaOffsetFetch, 1, func(w *kafkaWriter) {
+		w.string("grp")
+		w.int32(1)
+		w.string("orders")
+		w.int32(1)
+		w.int32(0)
+	})
+	r.arrayLen()
+	r.string()
+	r.arrayLen()
+	r.int32()
+	if offset := r.int64(); offset != 4 {
+		t.Fatalf("Expected committed offset 4, got %d", offset)
+	}
+
+	// A second member triggers a rebalance.
+	c2 := newKafkaTestClient(t, s)
+	defer c2.conn.Close()
+	type joinResult struct {
+		code    int16
+		gen     int32
+		member  string
+		members int32
+	}
+	ch := make(chan joinResult, 1)
+	go func() {
+		code, gen, _, member, members := join(c2, _EMPTY_)
+		ch <- joinResult{code, gen, member, members}
+	}()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if code := heartbeat(c1, m1, gen); code != kafkaErrRebalanceInProgress {
+			return io.EOF
+		}
+		return nil
+	})
+	code, gen, leader, _, members = join(c1, m1)
+	if code != kafkaErrNone || gen != 2 || leader != m1 || members != 2 {
+		t.Fatalf("Unexpected join response %d %d %q %d", code, gen, leader, members)
+	}
+	res := <-ch
+	if res.code != kafkaErrNone || res.gen != 2 || res.members != 0 {
+		t.Fatalf("Unexpected join response %+v", res)
+	}
+	syncCh := make(chan int16, 1)
+	go func() {
+		code, _ := sync(c2, res.member, res.gen, false)
+		syncCh <- code
+	}()
+	if code, _ := sync(c1, m1, gen, true); code != kafkaErrNone {
+		t.Fatalf("Unexpected sync error %d", code)
+	}
+	if code := <-syncCh; code != kafkaErrNone {
+		t.Fatalf("Unexpected sync error %d", code)
+	}
+
+	// The first member leaves and the other has to join again.
+	r = c1.request(kafkaLeaveGroup, 0, func(w *kafkaWriter) {
+		w.string("grp")
+		w.string(m1)
+	})
+	if code := r.int16(); code != kafkaErrNone {
+		t.Fatalf("Unexpected leave error %d", code)
+	}
+	if code := heartbeat(c2, res.member, res.gen); code != kafkaErrRebalanceInProgress {
+		t.Fatalf("Expected rebalance, got %d", code)
+	}
+	if code := heartbeat(c1, m1, gen); code != kafkaErrUnknownMemberID {
+		t.Fatalf("Expected unknown member, got %d", code)
+	}
+	code, gen, leader, _, members = join(c2, res.member)
+	if code != kafkaErrNone || gen != 3 || leader != res.member || members != 1 {
+		t.Fatalf("Unexpected join response %d %d %q %d", code, gen, leader, members)
+	}
+}
+
+func TestKafkaAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := DefaultOptions()
+	opts.Cluster.Port = 0
+	opts.JetStream = true
+	opts.StoreDir = filepath.Join(dir, "js")
+	opts.Users = []*User{{Username: "a", Password: "pwd", Permissions: &Permissions{
+		Publish:   &SubjectPermission{Allow: []string{"orders"}},
+		Subscribe: &SubjectPermission{Allow: []string{"orders"}},
+	}}}
+	opts.Kafka.Host = "127.0.0.1"
+	opts.Kafka.Port = -1
+	opts.Kafka.AutoCreateTopics = true
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	produce := func(c *kafkaTestClient, topic string) int16 {
+		batch := encodeKafkaRecordBatch([]*kafkaRecord{{value: []byte("v")}})
+		r := c.request(kafkaProduce, 3, func(w *kafkaWriter) {
+			w.int16(-1)
+			w.int16(1)
+			w.int32(1000)
+			w.int32(1)
+			w.string(topic)
+			w.int32(1)
+			w.int32(0)
+			w.bytes(batch)
+		})
+		r.arrayLen()
+		r.string()
+		r.arrayLen()
+		r.int32()
+		return r.int16()
+	}
+	authenticate := func(c *kafkaTestClient, password string) int16 {
+		r := c.request(kafkaSaslAuthenticate, 1, func(w *kafkaWriter) {
+			w.bytes([]byte("\x00a\x00" + password))
+		})
+		return r.int16()
+	}
+
+	// Requests other than the authentication ones close the connection.
+	c := newKafkaTestClient(t, s)
+	defer c.conn.Close()
+	if r := c.request(kafkaAPIVersions, 2, nil); r.int16() != kafkaErrNone {
+		t.Fatal("Expected api versions to be allowed")
+	}
+	c.write(kafkaMetadata, 1, func(w *kafkaWriter) { w.int32(-1) })
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected connection to be closed")
+	}
+
+	c = newKafkaTestClient(t, s)
+	defer c.conn.Close()
+	if code := authenticate(c, "pwd"); code != kafkaErrIllegalSaslState {
+		t.Fatalf("Expected illegal state before the handshake, got %d", code)
+	}
+	if r := c.request(kafkaSaslHandshake, 1, func(w *kafkaWriter) { w.string("SCRAM-SHA-256") }); r.int16() != kafkaErrUnsupportedSaslMechanism {
+		t.Fatal("Expected unsupported mechanism")
+	}
+	if r := c.request(kafkaSaslHandshake, 1, func(w *kafkaWriter) { w.string("PLAIN") }); r.int16() != kafkaErrNone {
+		t.Fatal("Expected PLAIN to be supported")
+	}
+	if code := authenticate(c, "bad"); code != kafkaErrSaslAuthenticationFailed {
+		t.Fatalf("Expected authentication to fail, got %d", code)
+	}
+	if code := authenticate(c, "pwd"); code != kafkaErrNone {
+		t.Fatalf("Expected authentication to succeed, got %d", code)
+	}
+	// Permissions of the user apply to the subjects of the streams.
+	if code := produce(c, "orders"); code != kafkaErrNone {
+		t.Fatalf("Expected produce to succeed, got %d", code)
+	}
+	if code := produce(c, "other"); code != kafkaErrTopicAuthorizationFailed {
+		t.Fatalf("Expected produce to be denied, got %d", code)
+	}
+	if _, err := s.GlobalAccount().LookupStream("other"); err == nil {
+		t.Fatal("Expected stream not to be created")
+	}
+}
+
+func TestKafkaConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		jetstream: enabled
+		kafka {
+			listen: "127.0.0.1:9092"
+			advertise: "kafka.example.com:9092"
+			auto_create_topics: true
+			tls {
+				cert_file: "./configs/certs/server.pem"
+				key_file: "./configs/certs/key.pem"
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if ko := opts.Kafka; ko.Host != "127.0.0.1" || ko.Port != 9092 || !ko.AutoCreateTopics || ko.TLSConfig == nil {
+		t.Fatalf("Unexpected options: %+v", ko)
+	}
+	if err := validateKafkaOptions(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	opts.JetStream = false
+	if err := validateKafkaOptions(opts); err == nil || !strings.Contains(err.Error(), "jetstream") {
+		t.Fatalf("Expected error about jetstream, got %v", err)
+	}
+	opts.JetStream = true
+	opts.Kafka.Account = "missing"
+	if err := validateKafkaOptions(opts); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("Expected error about account, got %v", err)
+	}
+
+	// Kafka clients are closed on shutdown.
+	s, dir := runKafkaServer(t, false)
+	defer os.RemoveAll(dir)
+	c := newKafkaTestClient(t, s)
+	defer c.conn.Close()
+	c.request(kafkaAPIVersions, 0, nil)
+	s.Shutdown()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected connection to be closed")
+	}
+}
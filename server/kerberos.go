@@ -0,0 +1,1079 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clients may present a Kerberos service ticket as their auth_token, as
+// the base64 encoding of a SPNEGO or Kerberos GSS-API initial context
+// token, optionally prefixed with "Negotiate ". The ticket is decrypted
+// with the key of the service in the configured keytab, and the principal
+// of the client selects its account and permissions. Only the AES and
+// RC4-HMAC encryption types are supported, and mutual authentication is
+// not, since the server does not reply to the CONNECT.
+
+const (
+	// Default allowed difference between our clock and the one of clients.
+	kerberosDefaultClockSkew = 5 * time.Minute
+	// Number of authenticators in the replay cache above which expired ones
+	// are removed.
+	kerberosReplaySweepSize = 1024
+	// Prefix of tokens in the HTTP Negotiate form.
+	kerberosNegotiatePrefix = "Negotiate "
+)
+
+// Kerberos encryption types.
+const (
+	krbAES128 = 17
+	krbAES256 = 18
+	krbRC4    = 23
+)
+
+// Kerberos key usages.
+const (
+	krbUsageTicket        = 2
+	krbUsageAuthenticator = 11
+)
+
+// Object identifiers of the SPNEGO and Kerberos mechanisms.
+var (
+	oidSPNEGO     = []byte{0x2b, 0x06, 0x01, 0x05, 0x05, 0x02}
+	oidKerberos   = []byte{0x2a, 0x86, 0x48, 0x86, 0xf7, 0x12, 0x01, 0x02, 0x02}
+	oidKerberosMS = []byte{0x2a, 0x86, 0x48, 0x82, 0xf7, 0x12, 0x01, 0x02, 0x02}
+)
+
+// KerberosOpts are options for the validation of Kerberos tickets.
+type KerberosOpts struct {
+	// Keytab is the path of the keytab holding the keys of the service.
+	Keytab string
+	// ServicePrincipal, if set, is the only principal of the keytab tickets
+	// are accepted for, such as nats/host.example.com@EXAMPLE.COM.
+	ServicePrincipal string
+	// ClockSkew is the allowed difference between our clock and the one of
+	// clients. Defaults to five minutes.
+	ClockSkew time.Duration
+	// Mappings select the account and permissions of clients, the first
+	// matching the principal being used. Without mappings, clients use the
+	// global account.
+	Mappings []*KerberosMapping
+}
+
+// KerberosMapping maps client principals to an account and permissions.
+type KerberosMapping struct {
+	// Principal matches the principal of clients, such as alice@EXAMPLE.COM,
+	// with * matching any characters, as in *@EXAMPLE.COM.
+	Principal   string
+	Account     string
+	Permissions *Permissions
+}
+
+func (o *KerberosOpts) clockSkew() time.Duration {
+	if o.ClockSkew > 0 {
+		return o.ClockSkew
+	}
+	return kerberosDefaultClockSkew
+}
+
+// mapping returns the first mapping matching the principal, if any.
+func (o *KerberosOpts) mapping(principal string) *KerberosMapping {
+	for _, m := range o.Mappings {
+		if kerberosMatch(m.Principal, principal) {
+			return m
+		}
+	}
+	return nil
+}
+
+// kerberosMatch returns true if the principal matches the pattern, in which
+// * matches any characters.
+func kerberosMatch(pattern, principal string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == principal
+	}
+	if !strings.HasPrefix(principal, parts[0]) {
+		return false
+	}
+	principal = principal[len(parts[0]):]
+	for _, p := range parts[1 : len(parts)-1] {
+		i := strings.Index(principal, p)
+		if i < 0 {
+			return false
+		}
+		principal = principal[i+len(p):]
+	}
+	return strings.HasSuffix(principal, parts[len(parts)-1])
+}
+
+func validateKerberosOptions(o *Options) error {
+	ko := &o.Kerberos
+	if ko.Keytab == _EMPTY_ {
+		return nil
+	}
+	if len(o.TrustedOperators) > 0 || len(o.TrustedKeys) > 0 {
+		return fmt.Errorf("kerberos can not be used with trusted operators")
+	}
+	if ko.ClockSkew < 0 {
+		return fmt.Errorf("kerberos clock skew can not be negative")
+	}
+	kt, err := readKeytab(ko.Keytab)
+	if err != nil {
+		return fmt.Errorf("kerberos keytab %q: %v", ko.Keytab, err)
+	}
+	if ko.ServicePrincipal != _EMPTY_ && len(kt.keys(ko.ServicePrincipal)) == 0 {
+		return fmt.Errorf("kerberos keytab %q has no key of %q", ko.Keytab, ko.ServicePrincipal)
+	}
+	for _, m := range ko.Mappings {
+		if m.Account == _EMPTY_ {
+			continue
+		}
+		found := false
+		for _, acc := range o.Accounts {
+			if acc.Name == m.Account {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("kerberos mapping to unknown account %q", m.Account)
+		}
+	}
+	return nil
+}
+
+// configureKerberos loads the keytab, keeping the replay cache of the
+// current acceptor.
+// Lock is held on entry.
+func (s *Server) configureKerberos(o *KerberosOpts) {
+	if o.Keytab == _EMPTY_ {
+		s.kerberos = nil
+		return
+	}
+	s.info.AuthRequired = true
+	kt, err := readKeytab(o.Keytab)
+	if err != nil {
+		s.Errorf("Error loading kerberos keytab %q: %v", o.Keytab, err)
+		s.kerberos = nil
+		return
+	}
+	ka := &kerberosAcceptor{opts: *o, keytab: kt, replays: make(map[string]time.Time)}
+	if s.kerberos != nil {
+		s.kerberos.mu.Lock()
+		ka.replays = s.kerberos.replays
+		s.kerberos.mu.Unlock()
+	}
+	s.kerberos = ka
+}
+
+// isKerberosToken returns true if the token is a base64 encoded SPNEGO or
+// Kerberos token, so that other tokens are authenticated as usual.
+func isKerberosToken(token string) bool {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(token, kerberosNegotiatePrefix))
+	if err != nil || len(b) == 0 || (b[0] != 0x60 && b[0] != 0xa0 && b[0] != 0x6e) {
+		return false
+	}
+	_, err = unwrapGSSToken(b, 0)
+	return err == nil
+}
+
+// kerberosTicket is the verified ticket of a client.
+type kerberosTicket struct {
+	principal string
+	expires   time.Time
+}
+
+// processKerberosAuthentication validates the ticket of the client and
+// registers it with the account and permissions its principal maps to.
+// Clients authorized again, on reload, are so with the principal of their
+// verified ticket, since the ticket can not be used twice.
+func (s *Server) processKerberosAuthentication(c *client, ka *kerberosAcceptor) bool {
+	c.mu.Lock()
+	kt := c.krb
+	c.mu.Unlock()
+	if kt == nil {
+		principal, expires, err := ka.verify(c.opts.Token, time.Now())
+		if err != nil {
+			c.Debugf("Kerberos authentication failed: %v", err)
+			return false
+		}
+		kt = &kerberosTicket{principal, expires.Add(ka.opts.clockSkew())}
+	} else if !time.Now().Before(kt.expires) {
+		c.Debugf("Kerberos ticket of %q expired", kt.principal)
+		return false
+	}
+	user, err := s.kerberosUser(ka, kt.principal)
+	if err != nil {
+		c.Debugf("Kerberos authentication failed: %v", err)
+		return false
+	}
+	c.mu.Lock()
+	c.krb = kt
+	c.mu.Unlock()
+	c.RegisterUser(user)
+	s.accountConnectEvent(c)
+	c.setExpirationTimer(time.Until(kt.expires))
+	return true
+}
+
+// kerberosUser returns the user the principal maps to.
+func (s *Server) kerberosUser(ka *kerberosAcceptor, principal string) (*User, error) {
+	acc := s.globalAccount()
+	var perms *Permissions
+	if len(ka.opts.Mappings) > 0 {
+		m := ka.opts.mapping(principal)
+		if m == nil {
+			return nil, fmt.Errorf("principal %q not mapped to an account", principal)
+		}
+		if m.Account != _EMPTY_ {
+			var err error
+			if acc, err = s.LookupAccount(m.Account); err != nil {
+				return nil, fmt.Errorf("account %q lookup error: %v", m.Account, err)
+			}
+		}
+		perms = m.Permissions
+	}
+	user := &User{Username: principal, Account: acc}
+	if perms != nil {
+		user.Permissions = perms.clone()
+		validateResponsePermissions(user.Permissions)
+	}
+	return user, nil
+}
+
+// kerberosAcceptor validates tickets with the keys of a keytab.
+type kerberosAcceptor struct {
+	opts   KerberosOpts
+	keytab *keytab
+
+	mu sync.Mutex
+	// Authenticators already used, with the time they expire from the cache.
+	replays map[string]time.Time
+}
+
+// verify validates the token, returning the principal of the client and
+// the end time of its ticket.
+func (ka *kerberosAcceptor) verify(token string, now time.Time) (string, time.Time, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(token, kerberosNegotiatePrefix))
+	if err != nil {
+		return _EMPTY_, time.Time{}, fmt.Errorf("malformed token: %v", err)
+	}
+	apReq, err := unwrapGSSToken(b, 0)
+	if err != nil {
+		return _EMPTY_, time.Time{}, err
+	}
+	req, err := parseAPReq(apReq)
+	if err != nil {
+		return _EMPTY_, time.Time{}, fmt.Errorf("malformed AP-REQ: %v", err)
+	}
+
+	service := req.ticket.sname.String()
+	if ka.opts.ServicePrincipal != _EMPTY_ && service != ka.opts.ServicePrincipal {
+		return _EMPTY_, time.Time{}, fmt.Errorf("ticket for unexpected service %q", service)
+	}
+	key := ka.keytab.key(service, req.ticket.encPart.etype, req.ticket.encPart.kvno)
+	if key == nil {
+		return _EMPTY_, time.Time{}, fmt.Errorf("no key of %q with encryption type %d", service, req.ticket.encPart.etype)
+	}
+	plain, err := krbDecrypt(key.etype, key.value, krbUsageTicket, req.ticket.encPart.cipher)
+	if err != nil {
+		return _EMPTY_, time.Time{}, fmt.Errorf("ticket decryption failed: %v", err)
+	}
+	tkt, err := parseEncTicketPart(plain)
+	if err != nil {
+		return _EMPTY_, time.Time{}, fmt.Errorf("malformed ticket: %v", err)
+	}
+	skew := ka.opts.clockSkew()
+	switch {
+	case tkt.invalid:
+		return _EMPTY_, time.Time{}, fmt.Errorf("ticket is invalid")
+	case now.Add(skew).Before(tkt.start):
+		return _EMPTY_, time.Time{}, fmt.Errorf("ticket not yet valid")
+	case !now.Add(-skew).Before(tkt.end):
+		return _EMPTY_, time.Time{}, fmt.Errorf("ticket expired")
+	}
+
+	plain, err = krbDecrypt(tkt.keyType, tkt.key, krbUsageAuthenticator, req.authenticator.cipher)
+	if err != nil {
+		return _EMPTY_, time.Time{}, fmt.Errorf("authenticator decryption failed: %v", err)
+	}
+	auth, err := parseAuthenticator(plain)
+	if err != nil {
+		return _EMPTY_, time.Time{}, fmt.Errorf("malformed authenticator: %v", err)
+	}
+	principal := tkt.cname.String()
+	if auth.cname.String() != principal {
+		return _EMPTY_, time.Time{}, fmt.Errorf("authenticator of %q for ticket of %q", auth.cname, principal)
+	}
+	if d := now.Sub(auth.ctime); d > skew || d < -skew {
+		return _EMPTY_, time.Time{}, fmt.Errorf("authenticator time outside of clock skew")
+	}
+	if ka.replayed(fmt.Sprintf("%s %d %d", principal, auth.ctime.Unix(), auth.cusec), now, skew) {
+		return _EMPTY_, time.Time{}, fmt.Errorf("authenticator replayed")
+	}
+	return principal, tkt.end, nil
+}
+
+// replayed records the authenticator, returning true if it was already
+// used.
+func (ka *kerberosAcceptor) replayed(id string, now time.Time, skew time.Duration) bool {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+	if len(ka.replays) >= kerberosReplaySweepSize {
+		for k, exp := range ka.replays {
+			if now.After(exp) {
+				delete(ka.replays, k)
+			}
+		}
+	}
+	if exp, ok := ka.replays[id]; ok && !now.After(exp) {
+		return true
+	}
+	ka.replays[id] = now.Add(2 * skew)
+	return false
+}
+
+// unwrapGSSToken returns the AP-REQ of a SPNEGO or Kerberos GSS-API token.
+func unwrapGSSToken(b []byte, depth int) ([]byte, error) {
+	if depth > 2 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	v, _, err := derParse(b)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %v", err)
+	}
+	switch {
+	case v.class == derApplication && v.tag == 14:
+		return b, nil
+	case v.class == derContext && v.tag == 0:
+		// SPNEGO NegTokenInit without the GSS-API framing.
+		return unwrapNegTokenInit(v.content, depth)
+	case v.class != derApplication || v.tag != 0:
+		return nil, fmt.Errorf("unsupported token")
+	}
+	oid, rest, err := derExpect(v.content, derUniversal, 6)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %v", err)
+	}
+	switch {
+	case bytes.Equal(oid, oidSPNEGO):
+		nt, _, err := derExpect(rest, derContext, 0)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported SPNEGO token")
+		}
+		return unwrapNegTokenInit(nt, depth)
+	case bytes.Equal(oid, oidKerberos), bytes.Equal(oid, oidKerberosMS):
+		// The AP-REQ follows its token identifier.
+		if len(rest) < 2 || rest[0] != 0x01 || rest[1] != 0x00 {
+			return nil, fmt.Errorf("unsupported Kerberos token")
+		}
+		return rest[2:], nil
+	}
+	return nil, fmt.Errorf("unsupported mechanism")
+}
+
+// unwrapNegTokenInit returns the AP-REQ of the Kerberos token of the
+// NegTokenInit.
+func unwrapNegTokenInit(b []byte, depth int) ([]byte, error) {
+	seq, _, err := derExpect(b, derUniversal, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed SPNEGO token: %v", err)
+	}
+	fields, err := derFields(seq)
+	if err != nil {
+		return nil, fmt.Errorf("malformed SPNEGO token: %v", err)
+	}
+	mt, err := derOctets(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("SPNEGO token without Kerberos token")
+	}
+	return unwrapGSSToken(mt, depth+1)
+}
+
+// krbPrincipal is a Kerberos principal name.
+type krbPrincipal struct {
+	names []string
+	realm string
+}
+
+func (p krbPrincipal) String() string {
+	return strings.Join(p.names, "/") + "@" + p.realm
+}
+
+type krbEncryptedData struct {
+	etype  int
+	kvno   int
+	cipher []byte
+}
+
+type krbAPReq struct {
+	ticket struct {
+		sname   krbPrincipal
+		encPart krbEncryptedData
+	}
+	authenticator krbEncryptedData
+}
+
+type krbEncTicketPart struct {
+	invalid bool
+	keyType int
+	key     []byte
+	cname   krbPrincipal
+	start   time.Time
+	end     time.Time
+}
+
+type krbAuthenticator struct {
+	cname krbPrincipal
+	ctime time.Time
+	cusec int
+}
+
+// parseAPReq parses an AP-REQ.
+func parseAPReq(b []byte) (*krbAPReq, error) {
+	f, err := derApplicationFields(b, 14)
+	if err != nil {
+		return nil, err
+	}
+	if pvno, err := derInt(f[0]); err != nil || pvno != 5 {
+		return nil, fmt.Errorf("unsupported protocol version")
+	}
+	if mt, err := derInt(f[1]); err != nil || mt != 14 {
+		return nil, fmt.Errorf("unexpected message type")
+	}
+	req := &krbAPReq{}
+	tf, err := derApplicationFields(f[3], 1)
+	if err != nil {
+		return nil, fmt.Errorf("ticket: %v", err)
+	}
+	realm, err := derString(tf[1])
+	if err != nil {
+		return nil, fmt.Errorf("ticket realm: %v", err)
+	}
+	if req.ticket.sname, err = parsePrincipal(tf[2], realm); err != nil {
+		return nil, fmt.Errorf("ticket sname: %v", err)
+	}
+	if req.ticket.encPart, err = parseEncryptedData(tf[3]); err != nil {
+		return nil, fmt.Errorf("ticket enc-part: %v", err)
+	}
+	if req.authenticator, err = parseEncryptedData(f[4]); err != nil {
+		return nil, fmt.Errorf("authenticator: %v", err)
+	}
+	return req, nil
+}
+
+// parseEncTicketPart parses a decrypted ticket.
+func parseEncTicketPart(b []byte) (*krbEncTicketPart, error) {
+	f, err := derApplicationFields(b, 3)
+	if err != nil {
+		return nil, err
+	}
+	t := &krbEncTicketPart{}
+	flags, _, err := derExpect(f[0], derUniversal, 3)
+	if err != nil {
+		return nil, fmt.Errorf("flags: %v", err)
+	}
+	// Bit 7 of the flags, after the unused bits count, is the invalid flag.
+	t.invalid = len(flags) > 1 && flags[1]&0x01 != 0
+	kseq, _, err := derExpect(f[1], derUniversal, 16)
+	if err != nil {
+		return nil, fmt.Errorf("key: %v", err)
+	}
+	kf, err := derFields(kseq)
+	if err != nil {
+		return nil, fmt.Errorf("key: %v", err)
+	}
+	kt, err := derInt(kf[0])
+	if err != nil {
+		return nil, fmt.Errorf("key type: %v", err)
+	}
+	t.keyType = int(kt)
+	if t.key, err = derOctets(kf[1]); err != nil {
+		return nil, fmt.Errorf("key value: %v", err)
+	}
+	crealm, err := derString(f[2])
+	if err != nil {
+		return nil, fmt.Errorf("crealm: %v", err)
+	}
+	if t.cname, err = parsePrincipal(f[3], crealm); err != nil {
+		return nil, fmt.Errorf("cname: %v", err)
+	}
+	if t.start, err = derTime(f[5]); err != nil {
+		return nil, fmt.Errorf("authtime: %v", err)
+	}
+	if f[6] != nil {
+		if t.start, err = derTime(f[6]); err != nil {
+			return nil, fmt.Errorf("starttime: %v", err)
+		}
+	}
+	if t.end, err = derTime(f[7]); err != nil {
+		return nil, fmt.Errorf("endtime: %v", err)
+	}
+	return t, nil
+}
+
+// parseAuthenticator parses a decrypted authenticator.
+func parseAuthenticator(b []byte) (*krbAuthenticator, error) {
+	f, err := derApplicationFields(b, 2)
+	if err != nil {
+		return nil, err
+	}
+	a := &krbAuthenticator{}
+	crealm, err := derString(f[1])
+	if err != nil {
+		return nil, fmt.Errorf("crealm: %v", err)
+	}
+	if a.cname, err = parsePrincipal(f[2], crealm); err != nil {
+		return nil, fmt.Errorf("cname: %v", err)
+	}
+	cusec, err := derInt(f[4])
+	if err != nil {
+		return nil, fmt.Errorf("cusec: %v", err)
+	}
+	a.cusec = int(cusec)
+	if a.ctime, err = derTime(f[5]); err != nil {
+		return nil, fmt.Errorf("ctime: %v", err)
+	}
+	return a, nil
+}
+
+// parsePrincipal parses a PrincipalName.
+func parsePrincipal(b []byte, realm string) (krbPrincipal, error) {
+	p := krbPrincipal{realm: realm}
+	seq, _, err := derExpect(b, derUniversal, 16)
+	if err != nil {
+		return p, err
+	}
+	f, err := derFields(seq)
+	if err != nil {
+		return p, err
+	}
+	names, _, err := derExpect(f[1], derUniversal, 16)
+	if err != nil {
+		return p, err
+	}
+	for len(names) > 0 {
+		v, rest, err := derParse(names)
+		if err != nil {
+			return p, err
+		}
+		p.names = append(p.names, string(v.content))
+		names = rest
+	}
+	if len(p.names) == 0 {
+		return p, fmt.Errorf("empty name")
+	}
+	return p, nil
+}
+
+// parseEncryptedData parses an EncryptedData.
+func parseEncryptedData(b []byte) (krbEncryptedData, error) {
+	var ed krbEncryptedData
+	seq, _, err := derExpect(b, derUniversal, 16)
+	if err != nil {
+		return ed, err
+	}
+	f, err := derFields(seq)
+	if err != nil {
+		return ed, err
+	}
+	etype, err := derInt(f[0])
+	if err != nil {
+		return ed, fmt.Errorf("etype: %v", err)
+	}
+	ed.etype = int(etype)
+	if f[1] != nil {
+		kvno, err := derInt(f[1])
+		if err != nil {
+			return ed, fmt.Errorf("kvno: %v", err)
+		}
+		ed.kvno = int(kvno)
+	}
+	if ed.cipher, err = derOctets(f[2]); err != nil {
+		return ed, fmt.Errorf("cipher: %v", err)
+	}
+	return ed, nil
+}
+
+// Classes of DER values.
+const (
+	derUniversal   = 0
+	derApplication = 1
+	derContext     = 2
+)
+
+// derValue is a DER encoded value.
+type derValue struct {
+	class    int
+	tag      int
+	compound bool
+	content  []byte
+}
+
+var errDERMalformed = errors.New("malformed DER value")
+
+// derParse parses the first value of b, returning the remaining bytes.
+func derParse(b []byte) (derValue, []byte, error) {
+	var v derValue
+	if len(b) < 2 {
+		return v, nil, errDERMalformed
+	}
+	v.class, v.compound, v.tag = int(b[0]>>6), b[0]&0x20 != 0, int(b[0]&0x1f)
+	if v.tag == 0x1f {
+		return v, nil, errDERMalformed
+	}
+	l, n := int(b[1]), 2
+	if l&0x80 != 0 {
+		nb := l & 0x7f
+		if nb == 0 || nb > 4 || len(b) < 2+nb {
+			return v, nil, errDERMalformed
+		}
+		l = 0
+		for _, c := range b[2 : 2+nb] {
+			l = l<<8 | int(c)
+		}
+		n += nb
+	}
+	if l < 0 || l > len(b)-n {
+		return v, nil, errDERMalformed
+	}
+	v.content = b[n : n+l]
+	return v, b[n+l:], nil
+}
+
+// derExpect parses the first value of b, which has to have the class and
+// tag, returning its content and the remaining bytes.
+func derExpect(b []byte, class, tag int) ([]byte, []byte, error) {
+	v, rest, err := derParse(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if v.class != class || v.tag != tag {
+		return nil, nil, fmt.Errorf("unexpected tag %d of class %d", v.tag, v.class)
+	}
+	return v.content, rest, nil
+}
+
+// derFields returns the values of the explicitly tagged fields of a
+// sequence, by tag.
+func derFields(b []byte) (map[int][]byte, error) {
+	fields := make(map[int][]byte)
+	for len(b) > 0 {
+		v, rest, err := derParse(b)
+		if err != nil {
+			return nil, err
+		}
+		if v.class != derContext || !v.compound {
+			return nil, errDERMalformed
+		}
+		fields[v.tag] = v.content
+		b = rest
+	}
+	return fields, nil
+}
+
+// derApplicationFields returns the fields of the sequence in the
+// application value with the tag.
+func derApplicationFields(b []byte, tag int) (map[int][]byte, error) {
+	app, _, err := derExpect(b, derApplication, tag)
+	if err != nil {
+		return nil, err
+	}
+	seq, _, err := derExpect(app, derUniversal, 16)
+	if err != nil {
+		return nil, err
+	}
+	return derFields(seq)
+}
+
+func derInt(b []byte) (int64, error) {
+	c, _, err := derExpect(b, derUniversal, 2)
+	if err != nil {
+		return 0, err
+	}
+	if len(c) == 0 || len(c) > 8 {
+		return 0, errDERMalformed
+	}
+	v := int64(int8(c[0]))
+	for _, d := range c[1:] {
+		v = v<<8 | int64(d)
+	}
+	return v, nil
+}
+
+func derOctets(b []byte) ([]byte, error) {
+	c, _, err := derExpect(b, derUniversal, 4)
+	return c, err
+}
+
+// derString parses a GeneralString, or another string type.
+func derString(b []byte) (string, error) {
+	v, _, err := derParse(b)
+	if err != nil {
+		return _EMPTY_, err
+	}
+	switch v.tag {
+	case 12, 19, 22, 27:
+		if v.class == derUniversal {
+			return string(v.content), nil
+		}
+	}
+	return _EMPTY_, fmt.Errorf("unexpected tag %d of class %d", v.tag, v.class)
+}
+
+func derTime(b []byte) (time.Time, error) {
+	c, _, err := derExpect(b, derUniversal, 24)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse("20060102150405Z", string(c))
+}
+
+// keytab holds the keys of a keytab file.
+type keytab struct {
+	entries []*keytabEntry
+}
+
+type keytabEntry struct {
+	principal string
+	kvno      int
+	etype     int
+	value     []byte
+}
+
+var errKeytabMalformed = errors.New("malformed keytab")
+
+// readKeytab reads a keytab file, in the version 2 format.
+func readKeytab(path string) (*keytab, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeytab(b)
+}
+
+func parseKeytab(b []byte) (*keytab, error) {
+	if len(b) < 2 || b[0] != 0x05 || b[1] != 0x02 {
+		return nil, fmt.Errorf("unsupported keytab version")
+	}
+	b = b[2:]
+	kt := &keytab{}
+	for len(b) >= 4 {
+		size := int32(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		if size < 0 {
+			// Holes of removed entries.
+			if int(-size) > len(b) {
+				return nil, errKeytabMalformed
+			}
+			b = b[-size:]
+			continue
+		}
+		if int(size) > len(b) {
+			return nil, errKeytabMalformed
+		}
+		e, err := parseKeytabEntry(b[:size])
+		if err != nil {
+			return nil, err
+		}
+		kt.entries = append(kt.entries, e)
+		b = b[size:]
+	}
+	if len(kt.entries) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	return kt, nil
+}
+
+func parseKeytabEntry(b []byte) (*keytabEntry, error) {
+	next := func(n int) ([]byte, error) {
+		if len(b) < n {
+			return nil, errKeytabMalformed
+		}
+		v := b[:n]
+		b = b[n:]
+		return v, nil
+	}
+	data := func() ([]byte, error) {
+		l, err := next(2)
+		if err != nil {
+			return nil, err
+		}
+		return next(int(binary.BigEndian.Uint16(l)))
+	}
+	n, err := next(2)
+	if err != nil {
+		return nil, err
+	}
+	realm, err := data()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, binary.BigEndian.Uint16(n))
+	for i := range names {
+		name, err := data()
+		if err != nil {
+			return nil, err
+		}
+		names[i] = string(name)
+	}
+	// Name type and timestamp.
+	if _, err := next(8); err != nil {
+		return nil, err
+	}
+	vno, err := next(1)
+	if err != nil {
+		return nil, err
+	}
+	etype, err := next(2)
+	if err != nil {
+		return nil, err
+	}
+	value, err := data()
+	if err != nil {
+		return nil, err
+	}
+	e := &keytabEntry{
+		principal: strings.Join(names, "/") + "@" + string(realm),
+		kvno:      int(vno[0]),
+		etype:     int(binary.BigEndian.Uint16(etype)),
+		value:     value,
+	}
+	// The 32 bits version number, if present, supersedes the 8 bits one.
+	if len(b) >= 4 {
+		if v := binary.BigEndian.Uint32(b); v != 0 {
+			e.kvno = int(v)
+		}
+	}
+	return e, nil
+}
+
+// keys returns the keys of the principal.
+func (kt *keytab) keys(principal string) []*keytabEntry {
+	var keys []*keytabEntry
+	for _, e := range kt.entries {
+		if e.principal == principal {
+			keys = append(keys, e)
+		}
+	}
+	return keys
+}
+
+// key returns the key of the principal with the encryption type and version
+// number, or the latest version if kvno is 0.
+func (kt *keytab) key(principal string, etype, kvno int) *keytabEntry {
+	var key *keytabEntry
+	for _, e := range kt.keys(principal) {
+		if e.etype != etype {
+			continue
+		}
+		if kvno != 0 && e.kvno == kvno {
+			return e
+		}
+		if kvno == 0 && (key == nil || e.kvno > key.kvno) {
+			key = e
+		}
+	}
+	return key
+}
+
+var errKrbIntegrity = errors.New("integrity check failed")
+
+// krbDecrypt decrypts the cipher text with the key for the usage.
+func krbDecrypt(etype int, key []byte, usage uint32, data []byte) ([]byte, error) {
+	switch etype {
+	case krbAES128, krbAES256:
+		if etype == krbAES128 && len(key) != 16 || etype == krbAES256 && len(key) != 32 {
+			return nil, fmt.Errorf("invalid key size")
+		}
+		return krbAESDecrypt(key, usage, data)
+	case krbRC4:
+		return krbRC4Decrypt(key, usage, data)
+	}
+	return nil, fmt.Errorf("unsupported encryption type %d", etype)
+}
+
+// krbAESDecrypt decrypts with aes-cts-hmac-sha1-96 (RFC 3962).
+func krbAESDecrypt(key []byte, usage uint32, data []byte) ([]byte, error) {
+	if len(data) < aes.BlockSize+12 {
+		return nil, errKrbIntegrity
+	}
+	ke, err := krbDeriveKey(key, usage, 0xaa)
+	if err != nil {
+		return nil, err
+	}
+	ki, err := krbDeriveKey(key, usage, 0x55)
+	if err != nil {
+		return nil, err
+	}
+	ct, mac := data[:len(data)-12], data[len(data)-12:]
+	pt, err := aesCTSDecrypt(ke, ct)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha1.New, ki)
+	h.Write(pt)
+	if !hmac.Equal(h.Sum(nil)[:12], mac) {
+		return nil, errKrbIntegrity
+	}
+	// Without the confounder.
+	return pt[aes.BlockSize:], nil
+}
+
+// krbDeriveKey derives the key for the usage and kind (RFC 3961).
+func krbDeriveKey(key []byte, usage uint32, kind byte) ([]byte, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	constant := make([]byte, 5)
+	binary.BigEndian.PutUint32(constant, usage)
+	constant[4] = kind
+	in := krbNFold(constant, aes.BlockSize)
+	out := make([]byte, 0, len(key)+aes.BlockSize)
+	for len(out) < len(key) {
+		block := make([]byte, aes.BlockSize)
+		c.Encrypt(block, in)
+		out = append(out, block...)
+		in = block
+	}
+	return out[:len(key)], nil
+}
+
+// krbNFold folds the input to n bytes (RFC 3961).
+func krbNFold(in []byte, n int) []byte {
+	lcm := len(in) * n / gcd(len(in), n)
+	// The input repeated, each copy rotated right by 13 more bits.
+	buf := make([]byte, 0, lcm)
+	bits := len(in) * 8
+	for i := 0; i < lcm/len(in); i++ {
+		r := make([]byte, len(in))
+		for j := 0; j < bits; j++ {
+			if in[j/8]&(0x80>>uint(j%8)) != 0 {
+				k := (j + 13*i) % bits
+				r[k/8] |= 0x80 >> uint(k%8)
+			}
+		}
+		buf = append(buf, r...)
+	}
+	// Ones' complement addition of the n bytes chunks.
+	out := make([]byte, n)
+	for i := 0; i < lcm; i += n {
+		carry := 0
+		for j := n - 1; j >= 0; j-- {
+			s := int(out[j]) + int(buf[i+j]) + carry
+			out[j], carry = byte(s), s>>8
+		}
+		for j := n - 1; carry != 0; j = (j + n - 1) % n {
+			s := int(out[j]) + carry
+			out[j], carry = byte(s), s>>8
+		}
+	}
+	return out
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// aesCTSDecrypt decrypts with AES in CBC mode with ciphertext stealing and a
+// zero initialization vector, as used by Kerberos.
+func aesCTSDecrypt(key, ct []byte) ([]byte, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	bs := aes.BlockSize
+	if len(ct) < bs {
+		return nil, errKrbIntegrity
+	}
+	out := make([]byte, len(ct))
+	if len(ct) == bs {
+		c.Decrypt(out, ct)
+		return out, nil
+	}
+	// The last two blocks are swapped, and the last one truncated.
+	pre := ((len(ct)+bs-1)/bs - 2) * bs
+	iv := make([]byte, bs)
+	if pre > 0 {
+		cipher.NewCBCDecrypter(c, iv).CryptBlocks(out[:pre], ct[:pre])
+		iv = ct[pre-bs : pre]
+	}
+	last := ct[pre+bs:]
+	d := make([]byte, bs)
+	c.Decrypt(d, ct[pre:pre+bs])
+	for i := range last {
+		out[pre+bs+i] = d[i] ^ last[i]
+	}
+	prev := append(append([]byte(nil), last...), d[len(last):]...)
+	c.Decrypt(out[pre:pre+bs], prev)
+	for i := 0; i < bs; i++ {
+		out[pre+i] ^= iv[i]
+	}
+	return out, nil
+}
+
+// krbRC4Decrypt decrypts with rc4-hmac (RFC 4757).
+func krbRC4Decrypt(key []byte, usage uint32, data []byte) ([]byte, error) {
+	if len(data) < md5.Size+8 {
+		return nil, errKrbIntegrity
+	}
+	k1 := krbRC4UsageKey(key, usage)
+	checksum, edata := data[:md5.Size], data[md5.Size:]
+	h := hmac.New(md5.New, k1)
+	h.Write(checksum)
+	c, err := rc4.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	pt := make([]byte, len(edata))
+	c.XORKeyStream(pt, edata)
+	h = hmac.New(md5.New, k1)
+	h.Write(pt)
+	if !hmac.Equal(h.Sum(nil), checksum) {
+		return nil, errKrbIntegrity
+	}
+	// Without the confounder.
+	return pt[8:], nil
+}
+
+// krbRC4UsageKey returns the key of rc4-hmac for the usage.
+func krbRC4UsageKey(key []byte, usage uint32) []byte {
+	if usage == 3 {
+		usage = 8
+	}
+	t := make([]byte, 4)
+	binary.LittleEndian.PutUint32(t, usage)
+	h := hmac.New(md5.New, key)
+	h.Write(t)
+	return h.Sum(nil)
+}
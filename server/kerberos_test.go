@@ -0,0 +1,496 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// DER encoding of the value with the identifier octet.
+func krbDER(id byte, content ...[]byte) []byte {
+	c := bytes.Join(content, nil)
+	b := []byte{id}
+	switch l := len(c); {
+	case l < 0x80:
+		b = append(b, byte(l))
+	case l < 0x100:
+		b = append(b, 0x81, byte(l))
+	default:
+		b = append(b, 0x82, byte(l>>8), byte(l))
+	}
+	return append(b, c...)
+}
+
+func krbDERInt(v int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if v == 0 && b[0]&0x80 == 0 {
+			break
+		}
+	}
+	return krbDER(0x02, b)
+}
+
+func krbDERString(s string) []byte { return krbDER(0x1b, []byte(s)) }
+func krbDEROctets(b []byte) []byte { return krbDER(0x04, b) }
+func krbDERTime(t time.Time) []byte {
+	return krbDER(0x18, []byte(t.UTC().Format("20060102150405Z")))
+}
+
+func krbDERField(tag int, content ...[]byte) []byte {
+	return krbDER(0xa0|byte(tag), content...)
+}
+
+func krbDERPrincipal(p string) []byte {
+	var names [][]byte
+	for _, n := range strings.Split(p, "/") {
+		names = append(names, krbDERString(n))
+	}
+	return krbDER(0x30, krbDERField(0, krbDERInt(1)), krbDERField(1, krbDER(0x30, names...)))
+}
+
+func krbDEREncryptedData(etype, kvno int, ct []byte) []byte {
+	return krbDER(0x30, krbDERField(0, krbDERInt(etype)), krbDERField(1, krbDERInt(kvno)), krbDERField(2, krbDEROctets(ct)))
+}
+
+// aesCTSEncrypt is the inverse of aesCTSDecrypt.
+func aesCTSEncrypt(t *testing.T, key, pt []byte) []byte {
+	t.Helper()
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("Error creating cipher: %v", err)
+	}
+	bs := aes.BlockSize
+	padded := make([]byte, (len(pt)+bs-1)/bs*bs)
+	copy(padded, pt)
+	ct := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(c, make([]byte, bs)).CryptBlocks(ct, padded)
+	if len(ct) == bs {
+		return ct
+	}
+	n := len(ct)
+	out := append([]byte(nil), ct[:n-2*bs]...)
+	out = append(out, ct[n-bs:]...)
+	out = append(out, ct[n-2*bs:n-bs]...)
+	return out[:len(pt)]
+}
+
+// krbTestEncrypt is the inverse of krbDecrypt.
+func krbTestEncrypt(t *testing.T, etype int, key []byte, usage uint32, pt []byte) []byte {
+	t.Helper()
+	switch etype {
+	case krbAES128, krbAES256:
+		ke, _ := krbDeriveKey(key, usage, 0xaa)
+		ki, _ := krbDeriveKey(key, usage, 0x55)
+		data := append(krbTestRandom(aes.BlockSize), pt...)
+		h := hmac.New(sha1.New, ki)
+		h.Write(data)
+		return append(aesCTSEncrypt(t, ke, data), h.Sum(nil)[:12]...)
+	case krbRC4:
+		k1 := krbRC4UsageKey(key, usage)
+		data := append(krbTestRandom(8), pt...)
+		h := hmac.New(md5.New, k1)
+		h.Write(data)
+		checksum := h.Sum(nil)
+		h = hmac.New(md5.New, k1)
+		h.Write(checksum)
+		c, _ := rc4.NewCipher(h.Sum(nil))
+		c.XORKeyStream(data, data)
+		return append(checksum, data...)
+	}
+	t.Fatalf("Unsupported encryption type %d", etype)
+	return nil
+}
+
+func krbTestRandom(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+type krbTestKey struct {
+	principal string
+	kvno      int
+	etype     int
+	value     []byte
+}
+
+// krbTestKeytab encodes the keys as a keytab, with a hole of a removed
+// entry first.
+func krbTestKeytab(keys ...krbTestKey) []byte {
+	data := func(s []byte) []byte {
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(len(s)))
+		return append(b, s...)
+	}
+	kt := []byte{0x05, 0x02, 0xff, 0xff, 0xff, 0xfc, 0, 0, 0, 0}
+	for _, k := range keys {
+		i := strings.LastIndex(k.principal, "@")
+		names := strings.Split(k.principal[:i], "/")
+		e := []byte{0, byte(len(names))}
+		e = append(e, data([]byte(k.principal[i+1:]))...)
+		for _, n := range names {
+			e = append(e, data([]byte(n))...)
+		}
+		e = append(e, 0, 0, 0, 1, 0, 0, 0, 0, byte(k.kvno), 0, byte(k.etype))
+		e = append(e, data(k.value)...)
+		e = append(e, 0, 0, 0, byte(k.kvno))
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(e)))
+		kt = append(kt, size...)
+		kt = append(kt, e...)
+	}
+	return kt
+}
+
+type krbTestTicket struct {
+	client  string
+	service string
+	key     krbTestKey
+	start   time.Time
+	end     time.Time
+	ctime   time.Time
+	spnego  bool
+}
+
+// krbTestToken returns the token of a ticket of the client for the service,
+// encrypted with the key.
+func krbTestToken(t *testing.T, tt krbTestTicket) string {
+	t.Helper()
+	crealm := tt.client[strings.LastIndex(tt.client, "@")+1:]
+	cname := tt.client[:strings.LastIndex(tt.client, "@")]
+	srealm := tt.service[strings.LastIndex(tt.service, "@")+1:]
+	sname := tt.service[:strings.LastIndex(tt.service, "@")]
+
+	session := krbTestRandom(len(tt.key.value))
+	encTicket := krbDER(0x63, krbDER(0x30,
+		krbDERField(0, krbDER(0x03, []byte{0, 0x40, 0, 0, 0})),
+		krbDERField(1, krbDER(0x30, krbDERField(0, krbDERInt(tt.key.etype)), krbDERField(1, krbDEROctets(session)))),
+		krbDERField(2, krbDERString(crealm)),
+		krbDERField(3, krbDERPrincipal(cname)),
+		krbDERField(4, krbDER(0x30, krbDERField(0, krbDERInt(1)), krbDERField(1, krbDEROctets(nil)))),
+		krbDERField(5, krbDERTime(tt.start)),
+		krbDERField(6, krbDERTime(tt.start)),
+		krbDERField(7, krbDERTime(tt.end)),
+	))
+	ticket := krbDER(0x61, krbDER(0x30,
+		krbDERField(0, krbDERInt(5)),
+		krbDERField(1, krbDERString(srealm)),
+		krbDERField(2, krbDERPrincipal(sname)),
+		krbDERField(3, krbDEREncryptedData(tt.key.etype, tt.key.kvno, krbTestEncrypt(t, tt.key.etype, tt.key.value, krbUsageTicket, encTicket))),
+	))
+	auth := krbDER(0x62, krbDER(0x30,
+		krbDERField(0, krbDERInt(5)),
+		krbDERField(1, krbDERString(crealm)),
+		krbDERField(2, krbDERPrincipal(cname)),
+		krbDERField(4, krbDERInt(tt.ctime.Nanosecond()/1000)),
+		krbDERField(5, krbDERTime(tt.ctime)),
+	))
+	apReq := krbDER(0x6e, krbDER(0x30,
+		krbDERField(0, krbDERInt(5)),
+		krbDERField(1, krbDERInt(14)),
+		krbDERField(2, krbDER(0x03, []byte{0, 0, 0, 0, 0})),
+		krbDERField(3, ticket),
+		krbDERField(4, krbDER(0x30,
+			krbDERField(0, krbDERInt(tt.key.etype)),
+			krbDERField(2, krbDEROctets(krbTestEncrypt(t, tt.key.etype, session, krbUsageAuthenticator, auth))),
+		)),
+	))
+	token := krbDER(0x60, krbDER(0x06, oidKerberos), []byte{0x01, 0x00}, apReq)
+	if tt.spnego {
+		token = krbDER(0x60, krbDER(0x06, oidSPNEGO), krbDERField(0, krbDER(0x30,
+			krbDERField(0, krbDER(0x30, krbDER(0x06, oidKerberosMS), krbDER(0x06, oidKerberos))),
+			krbDERField(2, krbDEROctets(token)),
+		)))
+	}
+	return base64.StdEncoding.EncodeToString(token)
+}
+
+func TestKerberosNFold(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"012345", 8, "be072631276b1955"},
+		{"password", 7, "78a07b6caf85fa"},
+		{"Rough Consensus, and Running Code", 8, "bb6ed30870b7f0e0"},
+		{"password", 21, "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{"kerberos", 16, "6b65726265726f737b9b5b2b93132b93"},
+	} {
+		if got := hex.EncodeToString(krbNFold([]byte(test.in), test.n)); got != test.want {
+			t.Fatalf("Expected %d-fold of %q to be %s, got %s", test.n*8, test.in, test.want, got)
+		}
+	}
+}
+
+func TestKerberosAESCTS(t *testing.T) {
+	key := []byte("chicken teriyaki")
+	ct, err := aesCTSDecrypt(key, mustDecodeHex(t, "c6353568f2bf8cb4d8a580362da7ff7f97"))
+	if err != nil || string(ct) != "I would like the " {
+		t.Fatalf("Unexpected decryption %q: %v", ct, err)
+	}
+	for _, n := range []int{16, 17, 31, 32, 33, 47, 48, 100} {
+		pt := krbTestRandom(n)
+		got, err := aesCTSDecrypt(key, aesCTSEncrypt(t, key, pt))
+		if err != nil || !bytes.Equal(got, pt) {
+			t.Fatalf("Round trip of %d bytes failed: %v", n, err)
+		}
+	}
+	for _, etype := range []int{krbAES128, krbAES256, krbRC4} {
+		k := krbTestRandom(32)
+		if etype != krbAES256 {
+			k = k[:16]
+		}
+		ct := krbTestEncrypt(t, etype, k, 7, []byte("hello"))
+		if pt, err := krbDecrypt(etype, k, 7, ct); err != nil || string(pt) != "hello" {
+			t.Fatalf("Round trip of type %d failed: %q %v", etype, pt, err)
+		}
+		if _, err := krbDecrypt(etype, k, 8, ct); err != errKrbIntegrity {
+			t.Fatalf("Expected integrity error with other usage, got %v", err)
+		}
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("Error decoding %q: %v", s, err)
+	}
+	return b
+}
+
+func TestKerberosAuthentication(t *testing.T) {
+	const service = "nats/localhost@EXAMPLE.COM"
+	aesKey := krbTestKey{service, 3, krbAES256, krbTestRandom(32)}
+	rc4Key := krbTestKey{service, 3, krbRC4, krbTestRandom(16)}
+	keytab := createConfFile(t, krbTestKeytab(
+		krbTestKey{service, 2, krbAES256, krbTestRandom(32)}, aesKey, rc4Key,
+		krbTestKey{"other@EXAMPLE.COM", 1, krbAES128, krbTestRandom(16)},
+	))
+	defer os.Remove(keytab)
+
+	opts := DefaultOptions()
+	opts.Accounts = []*Account{NewAccount("A"), NewAccount("B")}
+	opts.Kerberos = KerberosOpts{
+		Keytab:           keytab,
+		ServicePrincipal: service,
+		Mappings: []*KerberosMapping{
+			{Principal: "alice@EXAMPLE.COM", Account: "A"},
+			{Principal: "*@PARTNER.COM", Account: "B", Permissions: &Permissions{
+				Publish: &SubjectPermission{Allow: []string{"public.>"}},
+			}},
+		},
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	now := time.Now()
+	ticket := func(client string, key krbTestKey) krbTestTicket {
+		return krbTestTicket{client, service, key, now.Add(-time.Minute), now.Add(time.Hour), now, true}
+	}
+	connect := func(token string) (*nats.Conn, error) {
+		return nats.Connect(s.ClientURL(), nats.Token(token), nats.MaxReconnects(0))
+	}
+
+	token := krbTestToken(t, ticket("alice@EXAMPLE.COM", aesKey))
+	nc, err := connect(token)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	if acc, _ := s.LookupAccount("A"); acc.NumLocalConnections() != 1 {
+		t.Fatal("Expected 1 connection in account A")
+	}
+
+	// Kerberos tokens without SPNEGO, and in the HTTP form, are accepted.
+	tt := ticket("svc/bob@PARTNER.COM", rc4Key)
+	tt.spnego = false
+	errCh := make(chan error, 1)
+	nc2, err := nats.Connect(s.ClientURL(), nats.Token(kerberosNegotiatePrefix+krbTestToken(t, tt)),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errCh <- err }))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc2.Close()
+	if acc, _ := s.LookupAccount("B"); acc.NumLocalConnections() != 1 {
+		t.Fatal("Expected 1 connection in account B")
+	}
+	natsPub(t, nc2, "private", []byte("x"))
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "Permissions Violation") {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected permissions violation")
+	}
+
+	// Authorizing clients again does not replay their tickets.
+	if err := s.AddUser(&User{Username: "derek", Password: "pass"}); err != nil {
+		t.Fatalf("Error adding user: %v", err)
+	}
+	for _, nc := range []*nats.Conn{nc, nc2} {
+		if err := nc.Flush(); err != nil || !nc.IsConnected() {
+			t.Fatalf("Expected Kerberos clients to stay connected: %v", err)
+		}
+	}
+	for _, name := range []string{"A", "B"} {
+		if acc, _ := s.LookupAccount(name); acc.NumLocalConnections() != 1 {
+			t.Fatalf("Expected 1 connection in account %s after reauthorization", name)
+		}
+	}
+
+	expired := ticket("alice@EXAMPLE.COM", aesKey)
+	expired.start, expired.end = now.Add(-2*time.Hour), now.Add(-time.Hour)
+	future := ticket("alice@EXAMPLE.COM", aesKey)
+	future.start = now.Add(time.Hour)
+	stale := ticket("alice@EXAMPLE.COM", aesKey)
+	stale.ctime = now.Add(-10 * time.Minute)
+	otherService := ticket("alice@EXAMPLE.COM", krbTestKey{"other@EXAMPLE.COM", 1, krbAES128, krbTestRandom(16)})
+	otherService.service = "other@EXAMPLE.COM"
+	tampered, _ := base64.StdEncoding.DecodeString(krbTestToken(t, ticket("alice@EXAMPLE.COM", aesKey)))
+	tampered[len(tampered)-8] ^= 0xff
+
+	for _, test := range []struct {
+		name  string
+		token string
+	}{
+		{"replayed", token},
+		{"not mapped", krbTestToken(t, ticket("carol@OTHER.COM", aesKey))},
+		{"expired", krbTestToken(t, expired)},
+		{"not yet valid", krbTestToken(t, future)},
+		{"stale authenticator", krbTestToken(t, stale)},
+		{"wrong key", krbTestToken(t, ticket("alice@EXAMPLE.COM", krbTestKey{service, 3, krbAES256, krbTestRandom(32)}))},
+		{"unknown key version", krbTestToken(t, ticket("alice@EXAMPLE.COM", krbTestKey{service, 9, krbAES256, aesKey.value}))},
+		{"other service", krbTestToken(t, otherService)},
+		{"tampered", base64.StdEncoding.EncodeToString(tampered)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if !isKerberosToken(test.token) {
+				t.Fatal("Expected a Kerberos token")
+			}
+			if nc, err := connect(test.token); err == nil {
+				nc.Close()
+				t.Fatal("Expected authorization error")
+			}
+		})
+	}
+
+	// Other tokens are not taken for Kerberos ones.
+	for _, token := range []string{"bob", "YWJj", "s3cr3t", base64.StdEncoding.EncodeToString([]byte{0x60, 0x01, 0x00})} {
+		if isKerberosToken(token) {
+			t.Fatalf("Unexpected Kerberos token %q", token)
+		}
+	}
+}
+
+func TestKerberosConfig(t *testing.T) {
+	keytab := createConfFile(t, krbTestKeytab(krbTestKey{"nats/host.example.com@EXAMPLE.COM", 1, krbAES128, krbTestRandom(16)}))
+	defer os.Remove(keytab)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		accounts { A: {} }
+		kerberos {
+			keytab: %q
+			service_principal: "nats/host.example.com@EXAMPLE.COM"
+			clock_skew: "2m"
+			mappings: [
+				{principal: "*@EXAMPLE.COM", account: A, permissions: {publish: "public.>"}}
+			]
+		}
+	`, keytab)))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	o := &opts.Kerberos
+	if o.Keytab != keytab || o.ServicePrincipal != "nats/host.example.com@EXAMPLE.COM" ||
+		o.ClockSkew != 2*time.Minute || len(o.Mappings) != 1 {
+		t.Fatalf("Unexpected options: %+v", o)
+	}
+	if m := o.mapping("alice@EXAMPLE.COM"); m == nil || m.Account != "A" || m.Permissions.Publish.Allow[0] != "public.>" {
+		t.Fatalf("Unexpected mapping: %+v", m)
+	}
+	if m := o.mapping("alice@EXAMPLE.COM.EVIL"); m != nil {
+		t.Fatalf("Unexpected mapping: %+v", m)
+	}
+	if err := validateKerberosOptions(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	o.ServicePrincipal = "nats/other@EXAMPLE.COM"
+	if err := validateKerberosOptions(opts); err == nil || !strings.Contains(err.Error(), "no key") {
+		t.Fatalf("Expected error about service principal, got %v", err)
+	}
+	o.ServicePrincipal = _EMPTY_
+	o.Mappings[0].Account = "B"
+	if err := validateKerberosOptions(opts); err == nil || !strings.Contains(err.Error(), fmt.Sprintf("%q", "B")) {
+		t.Fatalf("Expected error about account, got %v", err)
+	}
+	o.Keytab = conf
+	if err := validateKerberosOptions(opts); err == nil || !strings.Contains(err.Error(), "keytab") {
+		t.Fatalf("Expected error about keytab, got %v", err)
+	}
+
+	for _, test := range []struct {
+		conf string
+		err  string
+	}{
+		{`kerberos { keytab: "/etc/krb5.keytab", bad: 1 }`, "bad"},
+		{`kerberos { keytab: "/etc/krb5.keytab", mappings: [{account: A}] }`, "principal"},
+	} {
+		conf := createConfFile(t, []byte(test.conf))
+		defer os.Remove(conf)
+		if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected error about %q, got %v", test.err, err)
+		}
+	}
+
+	for _, test := range []struct {
+		pattern, principal string
+		match              bool
+	}{
+		{"alice@EXAMPLE.COM", "alice@EXAMPLE.COM", true},
+		{"alice@EXAMPLE.COM", "bob@EXAMPLE.COM", false},
+		{"*", "anyone@ANY", true},
+		{"svc/*@EXAMPLE.COM", "svc/host@EXAMPLE.COM", true},
+		{"svc/*@EXAMPLE.COM", "user@EXAMPLE.COM", false},
+		{"*/*@*", "svc/host@EXAMPLE.COM", true},
+		{"*/*@*", "alice@EXAMPLE.COM", false},
+	} {
+		if got := kerberosMatch(test.pattern, test.principal); got != test.match {
+			t.Fatalf("Expected match of %q and %q to be %v", test.pattern, test.principal, test.match)
+		}
+	}
+}
@@ -70,6 +70,10 @@ type leaf struct {
 	// we would add it a second time in the smap causing later unsub to suppress the LS-.
 	tsub  map[*subscription]struct{}
 	tsubt *time.Timer
+	// Server ID of the remote, and its usage when accounted, for accepted
+	// leafnodes.
+	remoteID string
+	usage    *leafUsage
 }
 
 // Used for remote (solicited) leafnodes.
@@ -246,7 +250,7 @@ func (s *Server) setLeafNodeNonExportedOptions() {
 	}
 	s.leafNodeOpts.resolver = opts.LeafNode.resolver
 	if s.leafNodeOpts.resolver == nil {
-		s.leafNodeOpts.resolver = net.DefaultResolver
+		s.leafNodeOpts.resolver = s.dnsResolver
 	}
 }
 
@@ -470,7 +474,9 @@ func (c *client) sendLeafConnect(tlsRequired bool) {
 		}
 		defer wipeSlice(contents)
 		items := credsRe.FindAllSubmatch(contents, -1)
-		if len(items) < 2 {
+		// With a signer, the file only holds the user JWT.
+		signer := c.leaf.remote.Signer
+		if len(items) < 1 || (signer == nil && len(items) < 2) {
 			c.Errorf("Credentials file malformed")
 			return
 		}
@@ -479,16 +485,23 @@ func (c *client) sendLeafConnect(tlsRequired bool) {
 		raw := items[0][1]
 		tmp := make([]byte, len(raw))
 		copy(tmp, raw)
-		// Seed is second item.
-		kp, err := nkeys.FromSeed(items[1][1])
+		if signer == nil {
+			// Seed is second item.
+			kp, err := nkeys.FromSeed(items[1][1])
+			if err != nil {
+				c.Errorf("Credentials file has malformed seed")
+				return
+			}
+			// Wipe our key on exit.
+			defer kp.Wipe()
+			signer = kp
+		}
+
+		sigraw, err := signer.Sign(c.nonce)
 		if err != nil {
-			c.Errorf("Credentials file has malformed seed")
+			c.Errorf("Error signing leafnode nonce: %v", err)
 			return
 		}
-		// Wipe our key on exit.
-		defer kp.Wipe()
-
-		sigraw, _ := kp.Sign(c.nonce)
 		sig := base64.RawURLEncoding.EncodeToString(sigraw)
 		cinfo.JWT = string(tmp)
 		cinfo.Sig = sig
@@ -589,6 +602,12 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 	// Snapshot server options.
 	opts := s.getOpts()
 
+	// Reject remote IPs not allowed on the listener.
+	if remote == nil && !s.ipAllowedOnListener(MaintenanceLeafNode, conn) {
+		conn.Close()
+		return nil
+	}
+
 	maxPay := int32(opts.MaxPayload)
 	maxSubs := int32(opts.MaxSubs)
 	// For system, maxSubs of 0 means unlimited, so re-adjust here.
@@ -638,13 +657,15 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 	}
 	c.mu.Unlock()
 
-	var nonce [nonceLen]byte
+	var nonce []byte
 
 	// Grab server variables
 	s.mu.Lock()
 	info := s.copyLeafNodeInfo()
+	var lm *ListenerMaintenance
 	if !solicited {
-		s.generateNonce(nonce[:])
+		nonce = s.generateNonce()
+		lm = s.maintenance[MaintenanceLeafNode]
 	}
 	s.mu.Unlock()
 
@@ -669,10 +690,15 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 
 		c.mu.Unlock()
 		// Handle only connection to wrong port here, others will be handled below.
-		if err := c.parse([]byte(info)); err == ErrConnectedToWrongPort {
+		switch err := c.parse([]byte(info)); err {
+		case ErrConnectedToWrongPort:
 			c.Errorf(err.Error())
 			c.closeConnection(WrongPort)
 			return nil
+		case ErrServerIdentityInvalid, ErrServerIdentityUntrusted:
+			c.Errorf(err.Error())
+			c.closeConnection(AuthenticationViolation)
+			return nil
 		}
 		c.mu.Lock()
 
@@ -745,6 +771,7 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 			}
 			// Reset the read deadline
 			conn.SetReadDeadline(time.Time{})
+			s.recordTLSHandshake("leafnode", conn.ConnectionState().DidResume)
 
 			// Re-Grab lock
 			c.mu.Lock()
@@ -756,10 +783,10 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 	} else {
 		// Send our info to the other side.
 		// Remember the nonce we sent here for signatures, etc.
-		c.nonce = make([]byte, nonceLen)
-		copy(c.nonce, nonce[:])
+		c.nonce = nonce
 		info.Nonce = string(c.nonce)
 		info.CID = c.cid
+		s.setIdentity(info)
 		b, _ := json.Marshal(info)
 		pcs := [][]byte{[]byte("INFO"), b, []byte(CR_LF)}
 		// We have to send from this go routine because we may
@@ -768,6 +795,13 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 		// this before it can initiate the TLS handshake..
 		c.sendProtoNow(bytes.Join(pcs, []byte(" ")))
 
+		// Reject new connections if the listener is in maintenance mode.
+		if lm != nil {
+			c.mu.Unlock()
+			c.maintenanceRejected(lm.Hint)
+			return nil
+		}
+
 		// Check to see if we need to spin up TLS.
 		if info.TLSRequired {
 			c.Debugf("Starting TLS leafnode server handshake")
@@ -874,6 +908,11 @@ func (c *client) processLeafnodeInfo(info *Info) error {
 		if c.leaf.remote != nil && (info.CID == 0 || info.LeafNodeURLs == nil) {
 			return ErrConnectedToWrongPort
 		}
+		if c.leaf.remote != nil && len(c.leaf.remote.TrustedServers) > 0 {
+			if err := verifyServerIdentity(info, c.leaf.remote.TrustedServers, time.Now()); err != nil {
+				return err
+			}
+		}
 		// Capture a nonce here.
 		c.nonce = []byte(info.Nonce)
 		if info.TLSRequired && c.leaf.remote != nil {
@@ -1040,6 +1079,13 @@ func (c *client) processLeafNodeConnect(s *Server, arg []byte, lang string) erro
 		c.leaf.isSpoke = true
 	}
 
+	c.mu.Lock()
+	c.leaf.remoteID = proto.Name
+	if tokens := s.getOpts().LeafNode.UsageTokens; tokens > 0 {
+		c.leaf.usage = newLeafUsage(tokens)
+	}
+	c.mu.Unlock()
+
 	// Create and initialize the smap since we know our bound account now.
 	// This will send all registered subs too.
 	s.initLeafNodeSmapAndSendSubs(c)
@@ -1643,6 +1689,9 @@ func (c *client) processInboundLeafMsg(msg []byte) {
 	// The msg includes the CR_LF, so pull back out for accounting.
 	c.in.msgs++
 	c.in.bytes += int32(len(msg) - LEN_CR_LF)
+	if c.leaf != nil && c.leaf.usage != nil {
+		c.leaf.usage.add(c.pa.subject, int64(len(msg)-LEN_CR_LF), true)
+	}
 
 	// Check pub permissions
 	if c.perms != nil && (c.perms.pub.allow != nil || c.perms.pub.deny != nil) && !c.pubAllowed(string(c.pa.subject)) {
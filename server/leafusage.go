@@ -0,0 +1,202 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// With usage_tokens set in the leafnodes block, the hub accounts the
+// messages and bytes received from and sent to each accepted leafnode by
+// the prefix of their subjects made of that many tokens, so that the
+// bandwidth of the hub can be attributed to the edge sites. The usage is
+// reported in /leafz and the LEAFZ requests, and periodically sent in
+// system events. The counts are since the leafnode connected.
+
+const (
+	// Maximum number of prefixes accounted per leafnode, beyond which the
+	// messages are accounted under leafUsageOtherPrefix.
+	leafUsageMaxPrefixes = 1000
+	leafUsageOtherPrefix = "_other_"
+
+	// Default interval of the leafnode usage events.
+	leafUsageDefaultInterval = time.Minute
+)
+
+// LeafSubjectUsage is the usage of a leafnode for a subject prefix.
+type LeafSubjectUsage struct {
+	Prefix   string `json:"prefix"`
+	InMsgs   int64  `json:"in_msgs"`
+	OutMsgs  int64  `json:"out_msgs"`
+	InBytes  int64  `json:"in_bytes"`
+	OutBytes int64  `json:"out_bytes"`
+}
+
+// leafUsage accounts the messages exchanged with a leafnode.
+type leafUsage struct {
+	mu       sync.Mutex
+	tokens   int
+	prefixes map[string]*LeafSubjectUsage
+}
+
+func newLeafUsage(tokens int) *leafUsage {
+	return &leafUsage{tokens: tokens, prefixes: make(map[string]*LeafSubjectUsage)}
+}
+
+// subjectPrefix returns the first n tokens of the subject.
+func subjectPrefix(subject []byte, n int) []byte {
+	for i, b := range subject {
+		if b == btsep {
+			if n--; n == 0 {
+				return subject[:i]
+			}
+		}
+	}
+	return subject
+}
+
+// add accounts a message received from, or sent to, the leafnode.
+func (u *leafUsage) add(subject []byte, size int64, in bool) {
+	prefix := subjectPrefix(subject, u.tokens)
+	u.mu.Lock()
+	su := u.prefixes[string(prefix)]
+	if su == nil {
+		p := string(prefix)
+		if len(u.prefixes) >= leafUsageMaxPrefixes {
+			p = leafUsageOtherPrefix
+		}
+		if su = u.prefixes[p]; su == nil {
+			su = &LeafSubjectUsage{Prefix: p}
+			u.prefixes[p] = su
+		}
+	}
+	if in {
+		su.InMsgs++
+		su.InBytes += size
+	} else {
+		su.OutMsgs++
+		su.OutBytes += size
+	}
+	u.mu.Unlock()
+}
+
+// snapshot returns the usage by prefix, highest bandwidth first.
+func (u *leafUsage) snapshot() []*LeafSubjectUsage {
+	u.mu.Lock()
+	usage := make([]*LeafSubjectUsage, 0, len(u.prefixes))
+	for _, su := range u.prefixes {
+		cp := *su
+		usage = append(usage, &cp)
+	}
+	u.mu.Unlock()
+	sort.Slice(usage, func(i, j int) bool {
+		bi, bj := usage[i].InBytes+usage[i].OutBytes, usage[j].InBytes+usage[j].OutBytes
+		if bi != bj {
+			return bi > bj
+		}
+		return usage[i].Prefix < usage[j].Prefix
+	})
+	return usage
+}
+
+func validateLeafUsageOptions(o *Options) error {
+	if o.LeafNode.UsageTokens < 0 || o.LeafNode.UsageInterval < 0 {
+		return fmt.Errorf("leafnode usage_tokens and usage_interval can not be negative")
+	}
+	return nil
+}
+
+// LeafNodeUsageEventMsg is sent periodically with the usage of the
+// leafnodes connected to the server.
+type LeafNodeUsageEventMsg struct {
+	TypedEvent
+	Server ServerInfo   `json:"server"`
+	Leafs  []*LeafUsage `json:"leafnodes"`
+}
+
+// LeafUsage is the usage of a leafnode.
+type LeafUsage struct {
+	ServerID string              `json:"server_id,omitempty"`
+	Account  string              `json:"account"`
+	IP       string              `json:"ip"`
+	Port     int                 `json:"port"`
+	Usage    []*LeafSubjectUsage `json:"usage"`
+}
+
+// LeafNodeUsageEventMsgType is the schema type for LeafNodeUsageEventMsg
+const LeafNodeUsageEventMsgType = "io.nats.server.advisory.v1.leafnode_usage"
+
+// startLeafUsageEvents will periodically send the usage of the leafnodes.
+func (s *Server) startLeafUsageEvents() {
+	interval := s.getOpts().LeafNode.UsageInterval
+	if interval == 0 {
+		interval = leafUsageDefaultInterval
+	}
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.sendLeafUsageEvent()
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+func (s *Server) sendLeafUsageEvent() {
+	if !s.eventsEnabled() {
+		return
+	}
+	s.mu.Lock()
+	lconns := make([]*client, 0, len(s.leafs))
+	for _, ln := range s.leafs {
+		lconns = append(lconns, ln)
+	}
+	s.mu.Unlock()
+
+	var leafs []*LeafUsage
+	for _, ln := range lconns {
+		ln.mu.Lock()
+		if u := ln.leaf.usage; u != nil {
+			leafs = append(leafs, &LeafUsage{
+				ServerID: ln.leaf.remoteID,
+				Account:  ln.acc.Name,
+				IP:       ln.host,
+				Port:     int(ln.port),
+				Usage:    u.snapshot(),
+			})
+		}
+		ln.mu.Unlock()
+	}
+	if len(leafs) == 0 {
+		return
+	}
+	m := LeafNodeUsageEventMsg{
+		TypedEvent: TypedEvent{
+			Type: LeafNodeUsageEventMsgType,
+			ID:   s.nextEventID(),
+			Time: time.Now().UTC(),
+		},
+		Leafs: leafs,
+	}
+	s.sendInternalMsgLocked(fmt.Sprintf(leafNodeUsageEventSubj, s.ID()), _EMPTY_, &m.Server, &m)
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestLeafNodeUsage(t *testing.T) {
+	if sp := subjectPrefix([]byte("orders.eu.new"), 2); string(sp) != "orders.eu" {
+		t.Fatalf("Unexpected prefix %q", sp)
+	}
+	if sp := subjectPrefix([]byte("orders"), 2); string(sp) != "orders" {
+		t.Fatalf("Unexpected prefix %q", sp)
+	}
+
+	sys := NewAccount("SYS")
+	ho := DefaultOptions()
+	ho.Accounts = []*Account{sys}
+	ho.SystemAccount = "SYS"
+	ho.Users = []*User{{Username: "sys", Password: "pwd", Account: sys}, {Username: "app", Password: "pwd"}}
+	ho.LeafNode.Host = "127.0.0.1"
+	ho.LeafNode.Port = -1
+	ho.LeafNode.UsageTokens = 1
+	ho.LeafNode.UsageInterval = 50 * time.Millisecond
+	hub := RunServer(ho)
+	defer hub.Shutdown()
+
+	u, _ := url.Parse(fmt.Sprintf("nats://127.0.0.1:%d", ho.LeafNode.Port))
+	lo := DefaultOptions()
+	lo.LeafNode.Remotes = []*RemoteLeafOpts{{URLs: []*url.URL{u}}}
+	leaf := RunServer(lo)
+	defer leaf.Shutdown()
+	checkLeafNodeConnected(t, hub)
+
+	nch := natsConnect(t, hub.ClientURL(), nats.UserInfo("app", "pwd"))
+	defer nch.Close()
+	ncl := natsConnect(t, leaf.ClientURL())
+	defer ncl.Close()
+
+	orders := natsSubSync(t, nch, "orders.>")
+	natsFlush(t, nch)
+	metrics := natsSubSync(t, ncl, "metrics.>")
+	natsFlush(t, ncl)
+	checkSubInterest(t, leaf, globalAccountName, "orders.new", time.Second)
+	checkSubInterest(t, hub, globalAccountName, "metrics.cpu", time.Second)
+
+	for i := 0; i < 3; i++ {
+		natsPub(t, ncl, "orders.new", []byte("hello"))
+		natsNexMsg(t, orders, time.Second)
+	}
+	natsPub(t, nch, "metrics.cpu", []byte("hi"))
+	natsNexMsg(t, metrics, time.Second)
+
+	lz, err := hub.Leafz(nil)
+	if err != nil {
+		t.Fatalf("Error on leafz: %v", err)
+	}
+	if len(lz.Leafs) != 1 || lz.Leafs[0].ServerID != leaf.ID() {
+		t.Fatalf("Unexpected leafz: %+v", lz.Leafs)
+	}
+	usage := map[string]LeafSubjectUsage{}
+	for _, su := range lz.Leafs[0].Usage {
+		usage[su.Prefix] = *su
+	}
+	if su := usage["orders"]; su.InMsgs != 3 || su.InBytes != 15 || su.OutMsgs != 0 {
+		t.Fatalf("Unexpected orders usage: %+v", su)
+	}
+	if su := usage["metrics"]; su.OutMsgs != 1 || su.OutBytes != 2 || su.InMsgs != 0 {
+		t.Fatalf("Unexpected metrics usage: %+v", su)
+	}
+
+	ncs := natsConnect(t, hub.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer ncs.Close()
+	sub := natsSubSync(t, ncs, fmt.Sprintf(leafNodeUsageEventSubj, hub.ID()))
+	msg := natsNexMsg(t, sub, time.Second)
+	var em LeafNodeUsageEventMsg
+	if err := json.Unmarshal(msg.Data, &em); err != nil {
+		t.Fatalf("Error decoding event: %v", err)
+	}
+	if em.Type != LeafNodeUsageEventMsgType || len(em.Leafs) != 1 || em.Leafs[0].ServerID != leaf.ID() || len(em.Leafs[0].Usage) < 2 {
+		t.Fatalf("Unexpected event: %+v", em)
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Default window in which failed attempts are counted.
+	authLockoutDefaultWindow = time.Minute
+	// Default duration of lockouts.
+	authLockoutDefaultDuration = 5 * time.Minute
+)
+
+// Maximum number of tracked remotes and users, above which the oldest are
+// forgotten so that failures from many addresses can not exhaust memory.
+// A variable for tests.
+var authLockoutMaxEntries = 64 * 1024
+
+// Kinds of locked out attempts.
+const (
+	AuthLockoutIP   = "ip"
+	AuthLockoutUser = "user"
+)
+
+// AuthLockoutOpts limit failed authentication attempts of clients.
+type AuthLockoutOpts struct {
+	// MaxFailures is the number of failed attempts from a remote IP, or for
+	// a username, within the window after which attempts are rejected for
+	// the duration of the lockout. Disabled when 0.
+	MaxFailures int
+	// Window in which failed attempts are counted. Defaults to one minute.
+	Window time.Duration
+	// Duration of the lockout. Defaults to five minutes.
+	Duration time.Duration
+}
+
+func (o *AuthLockoutOpts) window() time.Duration {
+	if o.Window > 0 {
+		return o.Window
+	}
+	return authLockoutDefaultWindow
+}
+
+func (o *AuthLockoutOpts) duration() time.Duration {
+	if o.Duration > 0 {
+		return o.Duration
+	}
+	return authLockoutDefaultDuration
+}
+
+func validateAuthLockoutOptions(o *Options) error {
+	if o.AuthLockout.MaxFailures < 0 || o.AuthLockout.Window < 0 || o.AuthLockout.Duration < 0 {
+		return errors.New("auth_lockout values can not be negative")
+	}
+	return nil
+}
+
+// authFailures are the failed attempts of a remote IP or username.
+type authFailures struct {
+	key   authLockoutKey
+	count int
+	// Start of the window the attempts are counted in.
+	start time.Time
+	// Attempts are rejected until then when set.
+	until time.Time
+	// Element of the list of counting or locked out entries.
+	elem *list.Element
+}
+
+// authLockout tracks failed attempts to lock out remotes and users. Entries
+// still counting attempts are kept in the order their window started, and
+// locked out ones in the order their lockout ends, so that expired entries
+// are found, and the oldest evicted, without going through all of them.
+type authLockout struct {
+	mu       sync.Mutex
+	entries  map[authLockoutKey]*authFailures
+	counting *list.List
+	locked   *list.List
+}
+
+// add tracks a new entry for the key, evicting the oldest one, preferably
+// not locked out, when at the maximum.
+// Lock is held on entry.
+func (lo *authLockout) add(k authLockoutKey, now time.Time) *authFailures {
+	if lo.entries == nil {
+		lo.entries = make(map[authLockoutKey]*authFailures)
+		lo.counting, lo.locked = list.New(), list.New()
+	}
+	if len(lo.entries) >= authLockoutMaxEntries {
+		if e := lo.counting.Front(); e != nil {
+			lo.remove(e.Value.(*authFailures))
+		} else if e := lo.locked.Front(); e != nil {
+			lo.remove(e.Value.(*authFailures))
+		}
+	}
+	f := &authFailures{key: k, start: now}
+	f.elem = lo.counting.PushBack(f)
+	lo.entries[k] = f
+	return f
+}
+
+// remove forgets the entry.
+// Lock is held on entry.
+func (lo *authLockout) remove(f *authFailures) {
+	if f.until.IsZero() {
+		lo.counting.Remove(f.elem)
+	} else {
+		lo.locked.Remove(f.elem)
+	}
+	delete(lo.entries, f.key)
+}
+
+// lock locks out the entry until the given time.
+// Lock is held on entry.
+func (lo *authLockout) lock(f *authFailures, until time.Time) {
+	lo.counting.Remove(f.elem)
+	f.until = until
+	f.elem = lo.locked.PushBack(f)
+}
+
+// expire forgets the entries whose window or lockout ended.
+// Lock is held on entry.
+func (lo *authLockout) expire(now time.Time, window time.Duration) {
+	if lo.entries == nil {
+		return
+	}
+	for e := lo.counting.Front(); e != nil; e = lo.counting.Front() {
+		f := e.Value.(*authFailures)
+		if now.Sub(f.start) <= window {
+			break
+		}
+		lo.remove(f)
+	}
+	for e := lo.locked.Front(); e != nil; e = lo.locked.Front() {
+		f := e.Value.(*authFailures)
+		if now.Before(f.until) {
+			break
+		}
+		lo.remove(f)
+	}
+}
+
+type authLockoutKey struct {
+	kind  string
+	value string
+}
+
+// authLockoutKeys returns the remote IP and username of the client.
+func authLockoutKeys(c *client) []authLockoutKey {
+	c.mu.Lock()
+	host, user := c.host, c.opts.Username
+	if user == _EMPTY_ {
+		user = c.opts.Nkey
+	}
+	c.mu.Unlock()
+	return lockoutKeys(host, user)
+}
+
+// lockoutKeys returns the keys of the remote IP and username, if set.
+func lockoutKeys(host, user string) []authLockoutKey {
+	var keys []authLockoutKey
+	if host != _EMPTY_ {
+		keys = append(keys, authLockoutKey{AuthLockoutIP, host})
+	}
+	if user != _EMPTY_ {
+		keys = append(keys, authLockoutKey{AuthLockoutUser, user})
+	}
+	return keys
+}
+
+// authLockedOut returns the key of the client that is locked out, if any.
+func (s *Server) authLockedOut(c *client) (authLockoutKey, bool) {
+	if s.getOpts().AuthLockout.MaxFailures == 0 {
+		return authLockoutKey{}, false
+	}
+	return s.lockedOutKey(authLockoutKeys(c))
+}
+
+// lockedOutKey returns the first of the keys that is locked out, if any.
+func (s *Server) lockedOutKey(keys []authLockoutKey) (authLockoutKey, bool) {
+	now := time.Now()
+	s.lockout.mu.Lock()
+	defer s.lockout.mu.Unlock()
+	for _, k := range keys {
+		if f := s.lockout.entries[k]; f != nil && now.Before(f.until) {
+			return k, true
+		}
+	}
+	return authLockoutKey{}, false
+}
+
+// recordAuthFailure counts a failed attempt of the client, locking out its
+// remote IP or username when they reach the maximum.
+func (s *Server) recordAuthFailure(c *client) {
+	if s.getOpts().AuthLockout.MaxFailures == 0 {
+		return
+	}
+	keys := authLockoutKeys(c)
+	c.mu.Lock()
+	ci := ClientInfo{
+		Start:   c.start,
+		Host:    c.host,
+		ID:      c.cid,
+		Name:    c.opts.Name,
+		Lang:    c.opts.Lang,
+		Version: c.opts.Version,
+	}
+	c.mu.Unlock()
+	s.recordAuthFailures(keys, ci)
+}
+
+// recordAuthFailures counts a failed attempt of the remote IP and username
+// of the keys, locking them out when they reach the maximum.
+func (s *Server) recordAuthFailures(keys []authLockoutKey, ci ClientInfo) {
+	lo := s.getOpts().AuthLockout
+	if lo.MaxFailures == 0 {
+		return
+	}
+	now := time.Now()
+	var locked []authLockoutKey
+	var failures []int
+
+	s.lockout.mu.Lock()
+	s.lockout.expire(now, lo.window())
+	for _, k := range keys {
+		f := s.lockout.entries[k]
+		if f == nil {
+			f = s.lockout.add(k, now)
+		}
+		// Attempts during the lockout are not counted.
+		if !f.until.IsZero() {
+			continue
+		}
+		f.count++
+		if f.count >= lo.MaxFailures {
+			s.lockout.lock(f, now.Add(lo.duration()))
+			locked = append(locked, k)
+			failures = append(failures, f.count)
+		}
+	}
+	s.lockout.mu.Unlock()
+
+	for i, k := range locked {
+		s.Warnf("Locking out %s %q for %v after %d failed authentication attempts", k.kind, k.value, lo.duration(), failures[i])
+		s.sendAuthLockoutEvent(ci, k, failures[i], now.Add(lo.duration()))
+	}
+}
+
+// resetAuthFailures forgets the failed attempts of the username of the
+// client once it authenticated.
+func (s *Server) resetAuthFailures(c *client) {
+	if s.getOpts().AuthLockout.MaxFailures == 0 {
+		return
+	}
+	s.resetAuthFailureKeys(authLockoutKeys(c))
+}
+
+// resetAuthFailureKeys forgets the failed attempts of the username of the
+// keys.
+func (s *Server) resetAuthFailureKeys(keys []authLockoutKey) {
+	s.lockout.mu.Lock()
+	for _, k := range keys {
+		if f := s.lockout.entries[k]; f != nil && k.kind == AuthLockoutUser {
+			s.lockout.remove(f)
+		}
+	}
+	s.lockout.mu.Unlock()
+}
+
+// authLockoutRejected closes a client whose remote IP or username is locked
+// out, without checking its credentials.
+func (c *client) authLockoutRejected(k authLockoutKey) {
+	c.Errorf("%v - %s %q locked out", ErrAuthentication, k.kind, k.value)
+	c.sendErr("Authorization Violation")
+	c.closeConnection(AuthenticationViolation)
+}
+
+// sendAuthLockoutEvent sends a security event for a remote IP or username
+// locked out after the attempt of the client.
+func (s *Server) sendAuthLockoutEvent(ci ClientInfo, k authLockoutKey, failures int, until time.Time) {
+	m := AuthLockoutEventMsg{
+		TypedEvent: TypedEvent{
+			Type: AuthLockoutEventMsgType,
+		},
+		Client:   ci,
+		Kind:     k.kind,
+		Value:    k.value,
+		Failures: failures,
+		Until:    until.UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	m.ID = s.nextEventID()
+	m.Time = time.Now().UTC()
+	s.sendInternalMsg(fmt.Sprintf(authLockoutEventSubj, s.info.ID), _EMPTY_, &m.Server, &m)
+}
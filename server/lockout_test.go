@@ -0,0 +1,141 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestAuthLockout(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A: { users: [{user: a, password: pwd}, {user: b, password: pwd}] }
+			SYS: { users: [{user: sys, password: pwd}] }
+		}
+		system_account: SYS
+		auth_lockout { max_failures: 3, duration: "1s" }
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	if lo := opts.AuthLockout; lo.MaxFailures != 3 || lo.Duration != time.Second || lo.window() != authLockoutDefaultWindow {
+		t.Fatalf("Unexpected options: %+v", lo)
+	}
+
+	sys := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer sys.Close()
+	sub := natsSubSync(t, sys, fmt.Sprintf(authLockoutEventSubj, s.ID()))
+	natsFlush(t, sys)
+
+	connect := func(user, pass string) error {
+		t.Helper()
+		nc, err := nats.Connect(s.ClientURL(), nats.UserInfo(user, pass), nats.MaxReconnects(0))
+		if err == nil {
+			nc.Close()
+		}
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := connect("a", "bad"); err == nil {
+			t.Fatalf("Expected connection to fail")
+		}
+	}
+	// A success forgets the failures of the user, not of the remote.
+	if err := connect("a", "pwd"); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	if err := connect("b", "bad"); err == nil {
+		t.Fatalf("Expected connection to fail")
+	}
+	var ev AuthLockoutEventMsg
+	if err := json.Unmarshal(natsNexMsg(t, sub, time.Second).Data, &ev); err != nil {
+		t.Fatalf("Error unmarshalling event: %v", err)
+	}
+	if ev.Type != AuthLockoutEventMsgType || ev.Kind != AuthLockoutIP || ev.Value != "127.0.0.1" ||
+		ev.Failures != 3 || ev.Until.IsZero() || ev.Client.Host != "127.0.0.1" {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+	if m, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Unexpected event %q or error %v", m.Data, err)
+	}
+
+	// Valid credentials are rejected during the lockout.
+	if err := connect("a", "pwd"); err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Fatalf("Expected authorization error, got %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := connect("a", "pwd"); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+
+	// Users are locked out independently of the remotes they use.
+	for i := 0; i < 3; i++ {
+		c := &client{srv: s, kind: CLIENT, host: fmt.Sprintf("10.0.0.%d", i), opts: clientOpts{Username: "c"}}
+		if _, locked := s.authLockedOut(c); locked {
+			t.Fatalf("Unexpected lockout after %d failures", i)
+		}
+		s.recordAuthFailure(c)
+	}
+	c := &client{srv: s, kind: CLIENT, host: "10.0.0.10", opts: clientOpts{Username: "c"}}
+	if k, locked := s.authLockedOut(c); !locked || k.kind != AuthLockoutUser || k.value != "c" {
+		t.Fatalf("Expected user to be locked out, got %v %v", k, locked)
+	}
+	c.opts.Username = "d"
+	if _, locked := s.authLockedOut(c); locked {
+		t.Fatalf("Unexpected lockout")
+	}
+	if err := json.Unmarshal(natsNexMsg(t, sub, time.Second).Data, &ev); err != nil || ev.Kind != AuthLockoutUser || ev.Value != "c" {
+		t.Fatalf("Unexpected event %+v: %v", ev, err)
+	}
+
+	// The number of tracked remotes and users is bounded, the oldest not
+	// locked out are forgotten first.
+	defer func(max int) { authLockoutMaxEntries = max }(authLockoutMaxEntries)
+	authLockoutMaxEntries = 8
+	for i := 0; i < 100; i++ {
+		s.recordAuthFailures(lockoutKeys(fmt.Sprintf("10.1.0.%d", i), _EMPTY_), ClientInfo{})
+	}
+	s.lockout.mu.Lock()
+	n := len(s.lockout.entries)
+	s.lockout.mu.Unlock()
+	if n > authLockoutMaxEntries {
+		t.Fatalf("Expected at most %d entries, got %d", authLockoutMaxEntries, n)
+	}
+	c.opts.Username = "c"
+	if _, locked := s.authLockedOut(c); !locked {
+		t.Fatalf("Expected user to still be locked out")
+	}
+	// Entries are forgotten once their window or lockout ended.
+	s.lockout.mu.Lock()
+	s.lockout.expire(time.Now().Add(time.Hour), authLockoutDefaultWindow)
+	n = len(s.lockout.entries)
+	s.lockout.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("Expected expired entries to be removed, got %d", n)
+	}
+
+	o := DefaultOptions()
+	o.AuthLockout.Duration = -time.Second
+	if err := validateOptions(o); err == nil || !strings.Contains(err.Error(), "auth_lockout") {
+		t.Fatalf("Expected error about auth_lockout, got %v", err)
+	}
+}
@@ -157,6 +157,7 @@ func (s *Server) ReOpenLogFile() {
 
 // Noticef logs a notice statement
 func (s *Server) Noticef(format string, v ...interface{}) {
+	s.recordCrashEvent("INF", format, v...)
 	s.executeLogCall(func(logger Logger, format string, v ...interface{}) {
 		logger.Noticef(format, v...)
 	}, format, v...)
@@ -164,6 +165,7 @@ func (s *Server) Noticef(format string, v ...interface{}) {
 
 // Errorf logs an error
 func (s *Server) Errorf(format string, v ...interface{}) {
+	s.recordCrashEvent("ERR", format, v...)
 	s.executeLogCall(func(logger Logger, format string, v ...interface{}) {
 		logger.Errorf(format, v...)
 	}, format, v...)
@@ -192,6 +194,7 @@ func (s *Server) Errorsc(scope interface{}, ctx string, e error) {
 
 // Warnf logs a warning error
 func (s *Server) Warnf(format string, v ...interface{}) {
+	s.recordCrashEvent("WRN", format, v...)
 	s.executeLogCall(func(logger Logger, format string, v ...interface{}) {
 		logger.Warnf(format, v...)
 	}, format, v...)
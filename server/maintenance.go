@@ -0,0 +1,108 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Maintenance mode has a listener reject new connections with a retryable
+// error, while existing connections are left untouched. It is controlled
+// with requests to $SYS.REQ.SERVER.<id>.MAINTENANCE, or to
+// $SYS.REQ.SERVER.PING.MAINTENANCE for all servers.
+
+// Listeners that can be put in maintenance mode.
+const (
+	MaintenanceClient    = "client"
+	MaintenanceWebsocket = "websocket"
+	MaintenanceLeafNode  = "leafnode"
+)
+
+var maintenanceListeners = []string{MaintenanceClient, MaintenanceWebsocket, MaintenanceLeafNode}
+
+// MaintenanceOptions are the options for maintenance mode requests.
+// With neither Enter nor Exit set, only the current status is returned.
+type MaintenanceOptions struct {
+	// Listener is one of client, websocket or leafnode. All of them if empty.
+	Listener string `json:"listener,omitempty"`
+	Enter    bool   `json:"enter,omitempty"`
+	Exit     bool   `json:"exit,omitempty"`
+	// Hint is appended to the error sent to rejected connections, for
+	// instance when to retry or where to connect instead.
+	Hint string `json:"hint,omitempty"`
+}
+
+// ListenerMaintenance describes a listener in maintenance mode.
+type ListenerMaintenance struct {
+	Hint  string    `json:"hint,omitempty"`
+	Start time.Time `json:"start"`
+}
+
+// MaintenanceStatus reports the listeners in maintenance mode.
+type MaintenanceStatus struct {
+	Listeners map[string]*ListenerMaintenance `json:"listeners"`
+}
+
+// MaintenanceMode enters or exits maintenance mode for the given listener,
+// or all of them, and returns the listeners now in maintenance mode.
+func (s *Server) MaintenanceMode(opts *MaintenanceOptions) (*MaintenanceStatus, error) {
+	if opts == nil {
+		opts = &MaintenanceOptions{}
+	}
+	if opts.Enter && opts.Exit {
+		return nil, fmt.Errorf("cannot both enter and exit maintenance mode")
+	}
+	listeners := maintenanceListeners
+	if opts.Listener != _EMPTY_ {
+		listeners = nil
+		for _, l := range maintenanceListeners {
+			if l == opts.Listener {
+				listeners = []string{l}
+				break
+			}
+		}
+		if listeners == nil {
+			return nil, fmt.Errorf("unknown listener %q", opts.Listener)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range listeners {
+		switch {
+		case opts.Enter:
+			if s.maintenance == nil {
+				s.maintenance = make(map[string]*ListenerMaintenance)
+			}
+			if lm := s.maintenance[l]; lm != nil {
+				lm.Hint = opts.Hint
+				continue
+			}
+			s.maintenance[l] = &ListenerMaintenance{Hint: opts.Hint, Start: time.Now().UTC()}
+			s.Noticef("Entering maintenance mode for %s connections", l)
+		case opts.Exit:
+			if _, ok := s.maintenance[l]; ok {
+				delete(s.maintenance, l)
+				s.Noticef("Exiting maintenance mode for %s connections", l)
+			}
+		}
+	}
+	st := &MaintenanceStatus{Listeners: make(map[string]*ListenerMaintenance, len(s.maintenance))}
+	for l, lm := range s.maintenance {
+		clm := *lm
+		st.Listeners[l] = &clm
+	}
+	return st, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	opts := DefaultOptions()
+	sys := NewAccount("SYS")
+	opts.Accounts = []*Account{sys}
+	opts.SystemAccount = "SYS"
+	opts.Users = []*User{{Username: "sys", Password: "pwd", Account: sys}}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	if _, err := s.MaintenanceMode(&MaintenanceOptions{Listener: "route", Enter: true}); err == nil {
+		t.Fatal("Expected error for unknown listener")
+	}
+	if _, err := s.MaintenanceMode(&MaintenanceOptions{Enter: true, Exit: true}); err == nil {
+		t.Fatal("Expected error when both entering and exiting")
+	}
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "foo")
+	natsFlush(t, nc)
+
+	// Enter maintenance mode for clients with a system request.
+	req, _ := json.Marshal(&MaintenanceOptions{Listener: MaintenanceClient, Enter: true, Hint: "back at noon"})
+	msg, err := nc.Request(fmt.Sprintf("$SYS.REQ.SERVER.%s.MAINTENANCE", s.ID()), req, time.Second)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	var resp struct {
+		Data MaintenanceStatus `json:"data"`
+	}
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		t.Fatalf("Error unmarshalling response: %v", err)
+	}
+	if lm := resp.Data.Listeners[MaintenanceClient]; len(resp.Data.Listeners) != 1 || lm == nil || lm.Hint != "back at noon" {
+		t.Fatalf("Unexpected status: %+v", resp.Data)
+	}
+
+	// New connections are rejected with the hint.
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", opts.Port))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	br := bufio.NewReader(conn)
+	if line, err := br.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO ") {
+		t.Fatalf("Expected INFO, got %q, %v", line, err)
+	}
+	expected := fmt.Sprintf("-ERR '%s: back at noon'\r\n", ErrMaintenanceMode)
+	if line, err := br.ReadString('\n'); err != nil || line != expected {
+		t.Fatalf("Expected %q, got %q, %v", expected, line, err)
+	}
+
+	// Existing ones are not affected.
+	natsPub(t, nc, "foo", []byte("hello"))
+	natsNexMsg(t, sub, time.Second)
+
+	// Status only.
+	st, err := s.MaintenanceMode(nil)
+	if err != nil || len(st.Listeners) != 1 {
+		t.Fatalf("Unexpected status: %+v, %v", st, err)
+	}
+
+	// Exit maintenance mode for all listeners.
+	if st, err := s.MaintenanceMode(&MaintenanceOptions{Exit: true}); err != nil || len(st.Listeners) != 0 {
+		t.Fatalf("Unexpected status: %+v, %v", st, err)
+	}
+	nc2 := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	nc2.Close()
+}
+
+func TestMaintenanceModeLeafNode(t *testing.T) {
+	oa := DefaultOptions()
+	oa.LeafNode.Host = "127.0.0.1"
+	oa.LeafNode.Port = -1
+	sa := RunServer(oa)
+	defer sa.Shutdown()
+
+	if _, err := sa.MaintenanceMode(&MaintenanceOptions{Listener: MaintenanceLeafNode, Enter: true}); err != nil {
+		t.Fatalf("Error entering maintenance mode: %v", err)
+	}
+
+	ob := DefaultOptions()
+	ob.LeafNode.ReconnectInterval = 15 * time.Millisecond
+	u, _ := url.Parse(fmt.Sprintf("nats://127.0.0.1:%d", oa.LeafNode.Port))
+	ob.LeafNode.Remotes = []*RemoteLeafOpts{{URLs: []*url.URL{u}}}
+	sb := RunServer(ob)
+	defer sb.Shutdown()
+
+	time.Sleep(100 * time.Millisecond)
+	if n := sa.NumLeafNodes(); n != 0 {
+		t.Fatalf("Expected no leafnode, got %v", n)
+	}
+
+	// Clients are still accepted.
+	nc := natsConnect(t, sa.ClientURL())
+	nc.Close()
+
+	if _, err := sa.MaintenanceMode(&MaintenanceOptions{Listener: MaintenanceLeafNode, Exit: true}); err != nil {
+		t.Fatalf("Error exiting maintenance mode: %v", err)
+	}
+	checkLeafNodeConnected(t, sa)
+}
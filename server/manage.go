@@ -0,0 +1,260 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nkeys"
+)
+
+// The methods below allow an application embedding the server to manage
+// configured accounts and users at runtime. Changes are applied to a copy
+// of the current options which is then reloaded, so the semantics are the
+// same than a configuration reload: clients whose permissions changed are
+// updated and clients whose user or account was removed are disconnected.
+// These are not supported in operator mode, where accounts and users are
+// defined through JWTs.
+
+// AddAccount adds a new configured account to the running server.
+func (s *Server) AddAccount(acc *Account) error {
+	if acc == nil || acc.Name == "" {
+		return ErrBadAccount
+	}
+	return s.updateAuthOptions(func(opts *Options) error {
+		if acc.Name == globalAccountName || findOptsAccount(opts, acc.Name) >= 0 {
+			return ErrAccountExists
+		}
+		accounts := make([]*Account, 0, len(opts.Accounts)+1)
+		accounts = append(accounts, opts.Accounts...)
+		opts.Accounts = append(accounts, acc)
+		return nil
+	})
+}
+
+// UpdateAccount replaces the configured account with the same name.
+func (s *Server) UpdateAccount(acc *Account) error {
+	if acc == nil || acc.Name == "" {
+		return ErrBadAccount
+	}
+	return s.updateAuthOptions(func(opts *Options) error {
+		i := findOptsAccount(opts, acc.Name)
+		if i < 0 {
+			return ErrMissingAccount
+		}
+		accounts := make([]*Account, len(opts.Accounts))
+		copy(accounts, opts.Accounts)
+		accounts[i] = acc
+		opts.Accounts = accounts
+		return nil
+	})
+}
+
+// RemoveAccount removes the configured account with that name. This fails
+// if users are still bound to the account.
+func (s *Server) RemoveAccount(name string) error {
+	return s.updateAuthOptions(func(opts *Options) error {
+		i := findOptsAccount(opts, name)
+		if i < 0 {
+			return ErrMissingAccount
+		}
+		for _, u := range opts.Users {
+			if u.Account != nil && u.Account.Name == name {
+				return fmt.Errorf("%v: user %q is bound to account %q", ErrAccountInUse, u.Username, name)
+			}
+		}
+		for _, u := range opts.Nkeys {
+			if u.Account != nil && u.Account.Name == name {
+				return fmt.Errorf("%v: nkey user %q is bound to account %q", ErrAccountInUse, u.Nkey, name)
+			}
+		}
+		accounts := make([]*Account, 0, len(opts.Accounts)-1)
+		accounts = append(accounts, opts.Accounts[:i]...)
+		opts.Accounts = append(accounts, opts.Accounts[i+1:]...)
+		return nil
+	})
+}
+
+// AddUser adds a new user to the running server.
+func (s *Server) AddUser(user *User) error {
+	if user == nil || user.Username == "" {
+		return ErrBadUser
+	}
+	return s.updateAuthOptions(func(opts *Options) error {
+		if findOptsUser(opts, user.Username) >= 0 {
+			return ErrUserExists
+		}
+		if err := checkOptsUserAccount(opts, user.Account); err != nil {
+			return err
+		}
+		opts.Users = append(opts.Users, user.clone())
+		return nil
+	})
+}
+
+// UpdateUser replaces the user with the same username. Connected clients
+// of that user will have their permissions updated.
+func (s *Server) UpdateUser(user *User) error {
+	if user == nil || user.Username == "" {
+		return ErrBadUser
+	}
+	return s.updateAuthOptions(func(opts *Options) error {
+		i := findOptsUser(opts, user.Username)
+		if i < 0 {
+			return ErrMissingUser
+		}
+		if err := checkOptsUserAccount(opts, user.Account); err != nil {
+			return err
+		}
+		opts.Users[i] = user.clone()
+		return nil
+	})
+}
+
+// RemoveUser removes the user with that username. Connected clients of
+// that user will be disconnected.
+func (s *Server) RemoveUser(username string) error {
+	return s.updateAuthOptions(func(opts *Options) error {
+		i := findOptsUser(opts, username)
+		if i < 0 {
+			return ErrMissingUser
+		}
+		opts.Users = append(opts.Users[:i], opts.Users[i+1:]...)
+		return nil
+	})
+}
+
+// AddNkeyUser adds a new nkey user to the running server.
+func (s *Server) AddNkeyUser(user *NkeyUser) error {
+	if user == nil || !nkeys.IsValidPublicUserKey(user.Nkey) {
+		return ErrBadUser
+	}
+	return s.updateAuthOptions(func(opts *Options) error {
+		if findOptsNkeyUser(opts, user.Nkey) >= 0 {
+			return ErrUserExists
+		}
+		if err := checkOptsUserAccount(opts, user.Account); err != nil {
+			return err
+		}
+		opts.Nkeys = append(opts.Nkeys, user.clone())
+		return nil
+	})
+}
+
+// UpdateNkeyUser replaces the nkey user with the same public key.
+// Connected clients of that user will have their permissions updated.
+func (s *Server) UpdateNkeyUser(user *NkeyUser) error {
+	if user == nil || user.Nkey == "" {
+		return ErrBadUser
+	}
+	return s.updateAuthOptions(func(opts *Options) error {
+		i := findOptsNkeyUser(opts, user.Nkey)
+		if i < 0 {
+			return ErrMissingUser
+		}
+		if err := checkOptsUserAccount(opts, user.Account); err != nil {
+			return err
+		}
+		opts.Nkeys[i] = user.clone()
+		return nil
+	})
+}
+
+// RemoveNkeyUser removes the nkey user with that public key. Connected
+// clients of that user will be disconnected.
+func (s *Server) RemoveNkeyUser(nkey string) error {
+	return s.updateAuthOptions(func(opts *Options) error {
+		i := findOptsNkeyUser(opts, nkey)
+		if i < 0 {
+			return ErrMissingUser
+		}
+		opts.Nkeys = append(opts.Nkeys[:i], opts.Nkeys[i+1:]...)
+		return nil
+	})
+}
+
+// SetUserPermissions replaces the permissions of the user or nkey user
+// identified by the given username or public nkey.
+func (s *Server) SetUserPermissions(name string, perms *Permissions) error {
+	return s.updateAuthOptions(func(opts *Options) error {
+		if i := findOptsUser(opts, name); i >= 0 {
+			opts.Users[i].Permissions = perms.clone()
+			return nil
+		}
+		if i := findOptsNkeyUser(opts, name); i >= 0 {
+			opts.Nkeys[i].Permissions = perms.clone()
+			return nil
+		}
+		return ErrMissingUser
+	})
+}
+
+// Clones the current options, lets the given function update them
+// and then reloads the server with the result.
+func (s *Server) updateAuthOptions(update func(opts *Options) error) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.mu.Lock()
+	trusted := s.trustedKeys != nil
+	s.mu.Unlock()
+	if trusted {
+		return ErrOperatorModeNotSupported
+	}
+
+	// Clone deep copies users so we can update them in place.
+	opts := s.getOpts().Clone()
+	if err := update(opts); err != nil {
+		return err
+	}
+	return s.applyNewOptions(opts)
+}
+
+// Returns the index of the configured account, -1 if not found.
+func findOptsAccount(opts *Options, name string) int {
+	for i, acc := range opts.Accounts {
+		if acc.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the index of the user, -1 if not found.
+func findOptsUser(opts *Options, username string) int {
+	for i, u := range opts.Users {
+		if u.Username == username {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the index of the nkey user, -1 if not found.
+func findOptsNkeyUser(opts *Options, nkey string) int {
+	for i, u := range opts.Nkeys {
+		if u.Nkey == nkey {
+			return i
+		}
+	}
+	return -1
+}
+
+// Checks that the account a user is bound to is configured.
+func checkOptsUserAccount(opts *Options, acc *Account) error {
+	if acc == nil || acc.Name == globalAccountName || findOptsAccount(opts, acc.Name) >= 0 {
+		return nil
+	}
+	return fmt.Errorf("%v: %q", ErrMissingAccount, acc.Name)
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func TestManageUsers(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Users = []*User{{Username: "admin", Password: "pwd"}}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	if err := s.AddUser(&User{Username: "admin", Password: "other"}); err != ErrUserExists {
+		t.Fatalf("Expected error %v, got %v", ErrUserExists, err)
+	}
+	if err := s.AddUser(&User{Username: "bob", Password: "pwd", Account: NewAccount("UNKNOWN")}); err == nil {
+		t.Fatal("Expected error for unknown account")
+	}
+	if err := s.AddUser(&User{Username: "bob", Password: "pwd"}); err != nil {
+		t.Fatalf("Error adding user: %v", err)
+	}
+	nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("bob", "pwd"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	errCh := make(chan error, 1)
+	nc.SetErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		errCh <- err
+	})
+	err = s.SetUserPermissions("bob", &Permissions{Publish: &SubjectPermission{Allow: []string{"foo"}}})
+	if err != nil {
+		t.Fatalf("Error setting permissions: %v", err)
+	}
+	natsPub(t, nc, "bar", []byte("hello"))
+	select {
+	case <-errCh:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected permissions violation")
+	}
+
+	if err := s.UpdateUser(&User{Username: "alice", Password: "pwd"}); err != ErrMissingUser {
+		t.Fatalf("Expected error %v, got %v", ErrMissingUser, err)
+	}
+	if err := s.RemoveUser("bob"); err != nil {
+		t.Fatalf("Error removing user: %v", err)
+	}
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if !nc.IsClosed() && nc.IsConnected() {
+			return nats.ErrConnectionClosed
+		}
+		return nil
+	})
+	if nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("bob", "pwd")); err == nil {
+		nc.Close()
+		t.Fatal("Expected removed user to fail to connect")
+	}
+}
+
+func TestManageAccounts(t *testing.T) {
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+
+	if err := s.AddAccount(NewAccount("A")); err != nil {
+		t.Fatalf("Error adding account: %v", err)
+	}
+	if err := s.AddAccount(NewAccount("A")); err != ErrAccountExists {
+		t.Fatalf("Expected error %v, got %v", ErrAccountExists, err)
+	}
+	if _, err := s.LookupAccount("A"); err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	if err := s.AddNkeyUser(&NkeyUser{Nkey: "bad"}); err != ErrBadUser {
+		t.Fatalf("Expected error %v, got %v", ErrBadUser, err)
+	}
+	if err := s.AddNkeyUser(&NkeyUser{Nkey: pub, Account: NewAccount("A")}); err != nil {
+		t.Fatalf("Error adding nkey user: %v", err)
+	}
+	if err := s.RemoveAccount("A"); err == nil {
+		t.Fatal("Expected error removing account in use")
+	}
+	if err := s.RemoveNkeyUser(pub); err != nil {
+		t.Fatalf("Error removing nkey user: %v", err)
+	}
+	if err := s.RemoveAccount("A"); err != nil {
+		t.Fatalf("Error removing account: %v", err)
+	}
+	if _, err := s.LookupAccount("A"); err == nil {
+		t.Fatal("Expected account to be removed")
+	}
+	if err := s.RemoveAccount("A"); err != ErrMissingAccount {
+		t.Fatalf("Expected error %v, got %v", ErrMissingAccount, err)
+	}
+}
+
+func TestManageNotSupportedInOperatorMode(t *testing.T) {
+	s, _ := runTrustedServer(t)
+	defer s.Shutdown()
+
+	if err := s.AddUser(&User{Username: "bob", Password: "pwd"}); err != ErrOperatorModeNotSupported {
+		t.Fatalf("Expected error %v, got %v", ErrOperatorModeNotSupported, err)
+	}
+}
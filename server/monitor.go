@@ -116,6 +116,7 @@ type ConnInfo struct {
 	OutMsgs        int64       `json:"out_msgs"`
 	InBytes        int64       `json:"in_bytes"`
 	OutBytes       int64       `json:"out_bytes"`
+	ThrottledMsgs  int64       `json:"throttled_msgs,omitempty"`
 	NumSubs        uint32      `json:"subscriptions"`
 	Name           string      `json:"name,omitempty"`
 	Lang           string      `json:"lang,omitempty"`
@@ -124,8 +125,10 @@ type ConnInfo struct {
 	TLSCipher      string      `json:"tls_cipher_suite,omitempty"`
 	AuthorizedUser string      `json:"authorized_user,omitempty"`
 	Account        string      `json:"account,omitempty"`
+	UserConns      int         `json:"user_connections,omitempty"`
 	Subs           []string    `json:"subscriptions_list,omitempty"`
 	SubsDetail     []SubDetail `json:"subscriptions_list_detail,omitempty"`
+	Capabilities   []string    `json:"capabilities,omitempty"`
 }
 
 // DefaultConnListSize is the default size of the connection list.
@@ -333,6 +336,9 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 			if client.acc != nil && (client.acc.Name != globalAccountName) {
 				ci.Account = client.acc.Name
 			}
+			if client.uconn != _EMPTY_ {
+				ci.UserConns = s.userConnCount(client.uconn)
+			}
 		}
 		client.mu.Unlock()
 		pconns[i] = ci
@@ -454,10 +460,12 @@ func (ci *ConnInfo) fill(client *client, nc net.Conn, now time.Time) {
 	ci.Name = client.opts.Name
 	ci.Lang = client.opts.Lang
 	ci.Version = client.opts.Version
+	ci.Capabilities = client.caps.Names()
 	// inMsgs and inBytes are updated outside of the client's lock, so
 	// we need to use atomic here.
 	ci.InMsgs = atomic.LoadInt64(&client.inMsgs)
 	ci.InBytes = atomic.LoadInt64(&client.inBytes)
+	ci.ThrottledMsgs = atomic.LoadInt64(&client.throttledMsgs)
 
 	// If the connection is gone, too bad, we won't set TLSVersion and TLSCipher.
 	// Exclude clients that are still doing handshake so we don't block in
@@ -909,6 +917,78 @@ func (s *Server) Subsz(opts *SubszOptions) (*Subsz, error) {
 	return sz, nil
 }
 
+// ForEachConnection invokes f with information about every open client
+// connection, including subscriptions, user and account. Connections are
+// captured when this is called and f is invoked without holding any server
+// lock, so it can safely call back into the server. Iteration stops when
+// f returns false.
+func (s *Server) ForEachConnection(f func(ci *ConnInfo) bool) {
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	now := time.Now()
+	for _, c := range clients {
+		ci := &ConnInfo{}
+		c.mu.Lock()
+		ci.fill(c, c.nc, now)
+		if len(c.subs) > 0 {
+			ci.SubsDetail = newSubsDetailList(c)
+		}
+		ci.AuthorizedUser = c.getRawAuthUser()
+		if c.acc != nil {
+			ci.Account = c.acc.Name
+		}
+		c.mu.Unlock()
+		if !f(ci) {
+			return
+		}
+	}
+}
+
+// ForEachSubscription invokes f with the details of every local subscription
+// of every account, that is the data behind the subscription details of
+// Subsz. Subscriptions are captured when this is called and f is invoked
+// without holding any server lock. Iteration stops when f returns false.
+func (s *Server) ForEachSubscription(f func(sd *SubDetail) bool) {
+	var raw [4096]*subscription
+	subs := raw[:0]
+	s.accounts.Range(func(k, v interface{}) bool {
+		v.(*Account).sl.localSubs(&subs)
+		return true
+	})
+	for _, sub := range subs {
+		if sub.client == nil {
+			continue
+		}
+		sub.client.mu.Lock()
+		sd := newSubDetail(sub)
+		sub.client.mu.Unlock()
+		if !f(&sd) {
+			return
+		}
+	}
+}
+
+// ForEachAccount invokes f with every account currently registered with the
+// server. Accounts are captured when this is called and f is invoked without
+// holding any server lock. Iteration stops when f returns false.
+func (s *Server) ForEachAccount(f func(acc *Account) bool) {
+	var accounts []*Account
+	s.accounts.Range(func(k, v interface{}) bool {
+		accounts = append(accounts, v.(*Account))
+		return true
+	})
+	for _, acc := range accounts {
+		if !f(acc) {
+			return
+		}
+	}
+}
+
 // HandleSubsz processes HTTP requests for subjects stats.
 func (s *Server) HandleSubsz(w http.ResponseWriter, r *http.Request) {
 	s.mu.Lock()
@@ -981,6 +1061,49 @@ func (s *Server) HandleStacksz(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, buf[:n])
 }
 
+// Healthz represents the health of the server, returned by the /healthz endpoint.
+type Healthz struct {
+	Status    string                   `json:"status"`
+	JetStream *JetStreamRecoveryStatus `json:"jetstream,omitempty"`
+}
+
+const (
+	healthzStatusOK         = "ok"
+	healthzStatusRecovering = "recovering"
+)
+
+// Healthz returns the health of the server. The server is not ready while
+// JetStream is recovering its state from storage.
+func (s *Server) Healthz() *Healthz {
+	hz := &Healthz{Status: healthzStatusOK, JetStream: s.JetStreamRecovery()}
+	if hz.JetStream != nil && hz.JetStream.Recovering {
+		hz.Status = healthzStatusRecovering
+	}
+	return hz
+}
+
+// HandleHealthz processes HTTP requests for the health of the server.
+// Returns a 503 status code while the server is not ready.
+func (s *Server) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[HealthzPath]++
+	s.mu.Unlock()
+
+	hz := s.Healthz()
+	b, err := json.MarshalIndent(hz, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /healthz request: %v", err)
+	}
+	if hz.Status != healthzStatusOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(b)
+		return
+	}
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
 // Varz will output server information on the monitoring port at /varz.
 type Varz struct {
 	ID                string            `json:"server_id"`
@@ -1032,9 +1155,14 @@ type Varz struct {
 	InBytes           int64             `json:"in_bytes"`
 	OutBytes          int64             `json:"out_bytes"`
 	SlowConsumers     int64             `json:"slow_consumers"`
+	ThrottledMsgs     int64             `json:"throttled_msgs,omitempty"`
 	Subscriptions     uint32            `json:"subscriptions"`
 	HTTPReqStats      map[string]uint64 `json:"http_req_stats"`
 	ConfigLoadTime    time.Time         `json:"config_load_time"`
+	TLSCerts          []*CertExpiry     `json:"tls_certs,omitempty"`
+	TLSSessions       TLSSessionsVarz   `json:"tls_sessions,omitempty"`
+	AuthCache         *AuthCacheVarz    `json:"auth_cache,omitempty"`
+	ResolverCache     *ResolverVarz     `json:"resolver_cache,omitempty"`
 }
 
 // JetStreamVarz contains basic runtime information about jetstream
@@ -1329,12 +1457,17 @@ func (s *Server) updateVarzRuntimeFields(v *Varz, forceUpdate bool, pcpu float64
 	v.OutMsgs = atomic.LoadInt64(&s.outMsgs)
 	v.OutBytes = atomic.LoadInt64(&s.outBytes)
 	v.SlowConsumers = atomic.LoadInt64(&s.slowConsumers)
+	v.ThrottledMsgs = atomic.LoadInt64(&s.throttledMsgs)
 	// FIXME(dlc) - make this multi-account aware.
 	v.Subscriptions = s.gacc.sl.Count()
 	v.HTTPReqStats = make(map[string]uint64, len(s.httpReqStats))
 	for key, val := range s.httpReqStats {
 		v.HTTPReqStats[key] = val
 	}
+	v.TLSCerts = s.certExpiries()
+	v.TLSSessions = s.tlsSessionsVarz()
+	v.AuthCache = s.authCacheVarz()
+	v.ResolverCache = s.resolverCacheVarz()
 
 	// Update Gateway remote urls if applicable
 	gw := s.gateway
@@ -1749,6 +1882,11 @@ type LeafInfo struct {
 	OutBytes int64    `json:"out_bytes"`
 	NumSubs  uint32   `json:"subscriptions"`
 	Subs     []string `json:"subscriptions_list,omitempty"`
+
+	// Server ID of accepted leafnodes, and their usage by subject prefix
+	// when accounted.
+	ServerID string              `json:"server_id,omitempty"`
+	Usage    []*LeafSubjectUsage `json:"usage,omitempty"`
 }
 
 // Leafz returns a Leafz structure containing information about leafnodes.
@@ -1779,6 +1917,10 @@ func (s *Server) Leafz(opts *LeafzOptions) (*Leafz, error) {
 				InBytes:  atomic.LoadInt64(&ln.inBytes),
 				OutBytes: ln.outBytes,
 				NumSubs:  uint32(len(ln.subs)),
+				ServerID: ln.leaf.remoteID,
+			}
+			if ln.leaf.usage != nil {
+				lni.Usage = ln.leaf.usage.snapshot()
 			}
 			if opts != nil && opts.Subscriptions {
 				lni.Subs = make([]string, 0, len(ln.subs))
@@ -1900,6 +2042,16 @@ func (reason ClosedState) String() string {
 		return "Internal Client"
 	case MsgHeaderViolation:
 		return "Message Header Violation"
+	case MaintenanceMode:
+		return "Maintenance Mode"
+	case InactivityTimeout:
+		return "Inactivity Timeout"
+	case AccountDrained:
+		return "Account Drained"
+	case IPNotAllowed:
+		return "IP Not Allowed"
+	case TLSDowngrade:
+		return "TLS Downgrade"
 	}
 	return "Unknown State"
 }
@@ -3635,3 +3635,104 @@ func TestMonitorLeafz(t *testing.T) {
 		}
 	}
 }
+
+func TestMonitorForEachIterators(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Accounts = []*Account{NewAccount("A")}
+	opts.Users = []*User{{Username: "a", Password: "pwd", Account: opts.Accounts[0]}}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"), nats.Name("iter"))
+	defer nc.Close()
+	natsSubSync(t, nc, "foo")
+	natsQueueSubSync(t, nc, "bar", "queue")
+	natsFlush(t, nc)
+
+	var conns []*ConnInfo
+	s.ForEachConnection(func(ci *ConnInfo) bool {
+		conns = append(conns, ci)
+		return true
+	})
+	if len(conns) != 1 {
+		t.Fatalf("Expected 1 connection, got %d", len(conns))
+	}
+	if ci := conns[0]; ci.Name != "iter" || ci.AuthorizedUser != "a" || ci.Account != "A" || len(ci.SubsDetail) != 2 {
+		t.Fatalf("Unexpected connection info: %+v", ci)
+	}
+
+	var subs []*SubDetail
+	s.ForEachSubscription(func(sd *SubDetail) bool {
+		if sd.Account == "A" {
+			subs = append(subs, sd)
+		}
+		return true
+	})
+	if len(subs) != 2 {
+		t.Fatalf("Expected 2 subscriptions, got %d", len(subs))
+	}
+
+	accs := make(map[string]bool)
+	count := 0
+	s.ForEachAccount(func(acc *Account) bool {
+		accs[acc.GetName()] = true
+		count++
+		return true
+	})
+	if !accs["A"] || !accs[globalAccountName] {
+		t.Fatalf("Unexpected accounts: %v", accs)
+	}
+	// Check that iteration can be stopped.
+	visited := 0
+	s.ForEachAccount(func(acc *Account) bool {
+		visited++
+		return false
+	})
+	if count < 2 || visited != 1 {
+		t.Fatalf("Expected iteration to stop after first account, visited %d", visited)
+	}
+}
+
+func TestMonitorHealthz(t *testing.T) {
+	dir, err := ioutil.TempDir("", "healthz")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	resetPreviousHTTPConnections()
+	opts := DefaultMonitorOptions()
+	opts.JetStream = true
+	opts.StoreDir = dir
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", s.MonitorAddr().Port, HealthzPath)
+	var hz Healthz
+	if err := json.Unmarshal(readBody(t, url), &hz); err != nil {
+		t.Fatalf("Got an error unmarshalling the body: %v", err)
+	}
+	if hz.Status != healthzStatusOK || hz.JetStream == nil || hz.JetStream.Recovering {
+		t.Fatalf("Unexpected healthz: %+v", hz)
+	}
+
+	// Not ready while JetStream is recovering.
+	js := s.getJetStream()
+	js.startRecovery()
+	body := readBodyEx(t, url, http.StatusServiceUnavailable, appJSONContent)
+	if err := json.Unmarshal(body, &hz); err != nil {
+		t.Fatalf("Got an error unmarshalling the body: %v", err)
+	}
+	if hz.Status != healthzStatusRecovering || !hz.JetStream.Recovering {
+		t.Fatalf("Unexpected healthz: %+v", hz)
+	}
+	js.endRecovery()
+	readBody(t, url)
+
+	s.mu.Lock()
+	n := s.httpReqStats[HealthzPath]
+	s.mu.Unlock()
+	if n != 3 {
+		t.Fatalf("Expected 3 requests for healthz, got %d", n)
+	}
+}
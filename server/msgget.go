@@ -0,0 +1,205 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Besides a single message by sequence, message get requests can ask for
+// several sequences, or for the last message of every subject matching
+// subjects with wildcards, in one round trip. The messages are streamed to
+// the reply subject, one response each, followed by a response with the
+// end of the batch. Batches are bounded by a number of messages and of
+// bytes, the end of a truncated last per subject batch having what the
+// next request needs to continue where it stopped, as of the same last
+// sequence of the stream.
+
+const (
+	// Default and maximum number of messages of a batch.
+	jsMsgGetDefaultBatch = 100
+	jsMsgGetMaxBatch     = JSApiListLimit
+	// Default and maximum size of the payloads of a batch.
+	jsMsgGetDefaultMaxBytes = 1024 * 1024
+	jsMsgGetMaxBytes        = 8 * 1024 * 1024
+)
+
+// JSApiMsgGetEOB ends a batch of messages.
+type JSApiMsgGetEOB struct {
+	// Number of messages of the batch.
+	Count int `json:"count"`
+	// Requested sequences that were not found.
+	Missing []uint64 `json:"missing,omitempty"`
+	// Requested sequences left for another request.
+	Pending []uint64 `json:"pending,omitempty"`
+	// Last sequence of the stream the last per subject messages are as of.
+	UpToSeq uint64 `json:"up_to_seq,omitempty"`
+	// Set when the batch was truncated, with the last subject sent for
+	// last per subject batches.
+	More        bool   `json:"more,omitempty"`
+	LastSubject string `json:"last_subject,omitempty"`
+}
+
+// isBatch returns true for requests of more than a single sequence.
+func (req *JSApiMsgGetRequest) isBatch() bool {
+	return len(req.Seqs) > 0 || len(req.LastBySubjects) > 0
+}
+
+// validate checks the batch request and sets defaults.
+func (req *JSApiMsgGetRequest) validate() error {
+	if len(req.Seqs) > 0 && len(req.LastBySubjects) > 0 || req.Seq > 0 && req.isBatch() {
+		return fmt.Errorf("only one of seq, seqs and last_by_subjects can be set")
+	}
+	if len(req.Seqs) > jsMsgGetMaxBatch {
+		return fmt.Errorf("too many sequences, maximum is %d", jsMsgGetMaxBatch)
+	}
+	for _, filter := range req.LastBySubjects {
+		if !IsValidSubject(filter) {
+			return fmt.Errorf("invalid subject %q", filter)
+		}
+	}
+	if (req.UpToSeq > 0 || req.AfterSubject != _EMPTY_) && len(req.LastBySubjects) == 0 {
+		return fmt.Errorf("up_to_seq and after_subject require last_by_subjects")
+	}
+	if req.Batch < 0 || req.MaxBytes < 0 {
+		return fmt.Errorf("limits can not be negative")
+	}
+	if req.Batch == 0 {
+		req.Batch = jsMsgGetDefaultBatch
+	} else if req.Batch > jsMsgGetMaxBatch {
+		req.Batch = jsMsgGetMaxBatch
+	}
+	if req.MaxBytes == 0 {
+		req.MaxBytes = jsMsgGetDefaultMaxBytes
+	} else if req.MaxBytes > jsMsgGetMaxBytes {
+		req.MaxBytes = jsMsgGetMaxBytes
+	}
+	return nil
+}
+
+// lastBySubjects returns the sequences of the last messages of the subjects
+// matching the filters, up to the sequence or the last one of the stream
+// if not set, sorted by subject, and that sequence. Scans the stream,
+// bounded as queries are.
+func (mset *Stream) lastBySubjects(filters []string, upTo uint64) ([]string, map[string]uint64, uint64, error) {
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+	if store == nil {
+		return nil, nil, 0, ErrStoreClosed
+	}
+	state := store.State()
+	if upTo == 0 || upTo > state.LastSeq {
+		upTo = state.LastSeq
+	}
+	if upTo >= state.FirstSeq && upTo-state.FirstSeq >= jsQueryMaxScan {
+		return nil, nil, 0, fmt.Errorf("stream has too many messages to scan, maximum is %d", jsQueryMaxScan)
+	}
+	last := make(map[string]uint64)
+	deadline := time.Now().Add(jsQueryMaxDuration)
+scan:
+	for seq := state.FirstSeq; seq <= upTo && seq > 0; seq++ {
+		if seq%256 == 255 && time.Now().After(deadline) {
+			return nil, nil, 0, fmt.Errorf("stream scan took too long")
+		}
+		subj, _, _, _, err := store.LoadMsg(seq)
+		switch err {
+		case nil:
+		case ErrStoreMsgNotFound, errDeletedMsg:
+			continue
+		case ErrStoreEOF:
+			break scan
+		default:
+			return nil, nil, 0, err
+		}
+		for _, filter := range filters {
+			if subjectIsSubsetMatch(subj, filter) {
+				last[subj] = seq
+				break
+			}
+		}
+	}
+	subjects := make([]string, 0, len(last))
+	for subj := range last {
+		subjects = append(subjects, subj)
+	}
+	sort.Strings(subjects)
+	return subjects, last, upTo, nil
+}
+
+// sendMsgGetBatch streams the messages of a batch request to the reply
+// subject and returns the end of the batch.
+func (s *Server) sendMsgGetBatch(c *client, mset *Stream, reply string, req *JSApiMsgGetRequest) (*JSApiMsgGetEOB, error) {
+	eob := &JSApiMsgGetEOB{}
+	var size int
+	// Sends the message, returns false when the batch is full.
+	send := func(seq uint64) (bool, error) {
+		subj, hdr, data, ts, err := mset.store.LoadMsg(seq)
+		if err != nil {
+			return true, err
+		}
+		if eob.Count >= req.Batch || eob.Count > 0 && size+len(hdr)+len(data) > req.MaxBytes {
+			return false, nil
+		}
+		size += len(hdr) + len(data)
+		eob.Count++
+		resp := JSApiMsgGetResponse{ApiResponse: ApiResponse{Type: JSApiMsgGetResponseType}}
+		resp.Message = &StoredMsg{Subject: subj, Sequence: seq, Header: hdr, Data: data, Time: time.Unix(0, ts)}
+		s.sendInternalAccountMsg(c.acc, reply, s.jsonResponse(&resp))
+		return true, nil
+	}
+
+	if len(req.Seqs) > 0 {
+		for i, seq := range req.Seqs {
+			ok, err := send(seq)
+			if err != nil {
+				eob.Missing = append(eob.Missing, seq)
+			} else if !ok {
+				// The rest of the sequences are left for another request.
+				eob.More = true
+				eob.Pending = req.Seqs[i:]
+				break
+			}
+		}
+		return eob, nil
+	}
+
+	subjects, last, upTo, err := mset.lastBySubjects(req.LastBySubjects, req.UpToSeq)
+	if err != nil {
+		return nil, err
+	}
+	eob.UpToSeq = upTo
+	start := sort.SearchStrings(subjects, req.AfterSubject)
+	if start < len(subjects) && subjects[start] == req.AfterSubject {
+		start++
+	}
+	for _, subj := range subjects[start:] {
+		ok, err := send(last[subj])
+		if err != nil {
+			// Removed since the scan.
+			continue
+		}
+		if !ok {
+			eob.More = true
+			break
+		}
+		eob.LastSubject = subj
+	}
+	if !eob.More {
+		eob.LastSubject = _EMPTY_
+	}
+	return eob, nil
+}
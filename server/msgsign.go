@@ -0,0 +1,178 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nkeys"
+)
+
+// Headers of signed messages.
+const (
+	// MsgSignatureHdr is set by the publisher to the base64 url encoded,
+	// unpadded, nkey signature of the subject, a line feed and the payload.
+	MsgSignatureHdr = "Nats-Signature"
+	// MsgSignerHdr is set by the server to the public key of the publisher
+	// of a message whose signature was verified.
+	MsgSignerHdr = "Nats-Signer"
+	// MsgSignatureInvalidHdr is set by the server to the reason why the
+	// signature of a message could not be verified.
+	MsgSignatureInvalidHdr = "Nats-Signature-Invalid"
+)
+
+// Reasons of invalid signatures.
+const (
+	msgSignatureMissing  = "missing"
+	msgSignatureNoKey    = "no_key"
+	msgSignatureEncoding = "invalid_encoding"
+	msgSignatureBad      = "bad_signature"
+)
+
+// MsgSigningOpts are the subjects of an account whose messages have to be
+// signed by their publisher. Messages with an invalid signature are
+// dropped, unless Annotate is set, in which case they are delivered with
+// the reason in the Nats-Signature-Invalid header.
+type MsgSigningOpts struct {
+	Subjects []string
+	Annotate bool
+}
+
+// required returns true if messages on the subject have to be signed.
+func (o *MsgSigningOpts) required(subject string) bool {
+	for _, s := range o.Subjects {
+		if matchLiteral(subject, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// msgSigningOpts returns the message signing options of the account.
+func (a *Account) msgSigningOpts() *MsgSigningOpts {
+	a.mu.RLock()
+	ms := a.msgSigning
+	a.mu.RUnlock()
+	return ms
+}
+
+// getHeader returns the value of the key in the header block, if present.
+func getHeader(key string, hdr []byte) []byte {
+	for _, line := range bytes.Split(hdr, []byte(_CRLF_))[1:] {
+		if i := bytes.IndexByte(line, ':'); i > 0 && strings.EqualFold(string(line[:i]), key) {
+			return bytes.TrimSpace(line[i+1:])
+		}
+	}
+	return nil
+}
+
+// setHeaders returns the header block with the keys removed, and the
+// given key and value appended if not empty.
+func setHeaders(hdr []byte, remove []string, key, value string) []byte {
+	nhdr := []byte("NATS/1.0" + _CRLF_)
+	if len(hdr) > 0 {
+		lines := bytes.Split(bytes.TrimSuffix(hdr, []byte(_CRLF_+_CRLF_)), []byte(_CRLF_))
+		nhdr = append(append([]byte(nil), lines[0]...), _CRLF_...)
+	next:
+		for _, line := range lines[1:] {
+			if i := bytes.IndexByte(line, ':'); i > 0 {
+				for _, k := range remove {
+					if strings.EqualFold(string(line[:i]), k) {
+						continue next
+					}
+				}
+			}
+			nhdr = append(append(nhdr, line...), _CRLF_...)
+		}
+	}
+	if key != _EMPTY_ {
+		nhdr = append(nhdr, fmt.Sprintf("%s: %s%s", key, value, _CRLF_)...)
+	}
+	return append(nhdr, _CRLF_...)
+}
+
+// msgSignatureSigner returns the public key messages of the client are
+// verified against. Lock should be held.
+func (c *client) msgSignatureSigner() string {
+	switch {
+	case c.opts.JWT != _EMPTY_:
+		return c.pubKey
+	case c.opts.Nkey != _EMPTY_:
+		return c.opts.Nkey
+	}
+	return _EMPTY_
+}
+
+// verifyMsgSignature verifies the signature of the inbound message against
+// the key of the client, and sets the signer or the reason of the failure
+// in the headers. It returns the message and false if it has to be dropped.
+func (c *client) verifyMsgSignature(ms *MsgSigningOpts, msg []byte) ([]byte, bool) {
+	var hdr, data []byte
+	if c.pa.hdr > 0 {
+		hdr, data = msg[:c.pa.hdr], msg[c.pa.hdr:len(msg)-LEN_CR_LF]
+	} else {
+		data = msg[:len(msg)-LEN_CR_LF]
+	}
+	c.mu.Lock()
+	signer := c.msgSignatureSigner()
+	c.mu.Unlock()
+
+	reason := _EMPTY_
+	sig := getHeader(MsgSignatureHdr, hdr)
+	switch {
+	case len(sig) == 0:
+		reason = msgSignatureMissing
+	case signer == _EMPTY_:
+		reason = msgSignatureNoKey
+	default:
+		raw, err := base64.RawURLEncoding.DecodeString(string(sig))
+		if err != nil {
+			reason = msgSignatureEncoding
+			break
+		}
+		pub, err := nkeys.FromPublicKey(signer)
+		if err != nil {
+			reason = msgSignatureNoKey
+			break
+		}
+		signed := make([]byte, 0, len(c.pa.subject)+1+len(data))
+		signed = append(append(append(signed, c.pa.subject...), '\n'), data...)
+		if err := pub.Verify(signed, raw); err != nil {
+			reason = msgSignatureBad
+		}
+	}
+
+	remove := []string{MsgSignerHdr, MsgSignatureInvalidHdr}
+	var nhdr []byte
+	if reason == _EMPTY_ {
+		nhdr = setHeaders(hdr, remove, MsgSignerHdr, signer)
+	} else {
+		c.Debugf("Invalid signature of message on %q: %s", c.pa.subject, reason)
+		if !ms.Annotate {
+			c.sendErrAndDebug(fmt.Sprintf("Permissions Violation for Publish to %q, Message Rejected: %v: %s",
+				c.pa.subject, ErrMsgSignature, reason))
+			return nil, false
+		}
+		nhdr = setHeaders(hdr, append(remove, MsgSignatureHdr), MsgSignatureInvalidHdr, reason)
+	}
+	nmsg, err := c.setInboundMsgHeader(nhdr, data)
+	if err != nil {
+		c.sendErrAndDebug(fmt.Sprintf("Permissions Violation for Publish to %q, Message Rejected: %v", c.pa.subject, err))
+		return nil, false
+	}
+	return nmsg, true
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func TestMsgSigningHeaders(t *testing.T) {
+	hdr := []byte("NATS/1.0\r\nA: 1\r\nNats-Signer: spoofed\r\nB: 2\r\n\r\n")
+	if v := getHeader("a", hdr); string(v) != "1" {
+		t.Fatalf("Unexpected header value: %q", v)
+	}
+	if v := getHeader("C", hdr); v != nil {
+		t.Fatalf("Unexpected header value: %q", v)
+	}
+	nhdr := setHeaders(hdr, []string{MsgSignerHdr}, MsgSignerHdr, "UKEY")
+	if string(nhdr) != "NATS/1.0\r\nA: 1\r\nB: 2\r\nNats-Signer: UKEY\r\n\r\n" {
+		t.Fatalf("Unexpected header: %q", nhdr)
+	}
+	if nhdr := setHeaders(nil, nil, "A", "1"); string(nhdr) != "NATS/1.0\r\nA: 1\r\n\r\n" {
+		t.Fatalf("Unexpected header: %q", nhdr)
+	}
+}
+
+func TestMsgSigning(t *testing.T) {
+	kpA, _ := nkeys.CreateUser()
+	pubA, _ := kpA.PublicKey()
+	kpB, _ := nkeys.CreateUser()
+	pubB, _ := kpB.PublicKey()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A: {
+				users: [{nkey: %q}]
+				message_signing: { subjects: ["signed.>"] }
+			}
+			B: {
+				users: [{nkey: %q}, {user: b, password: pwd}]
+				message_signing: { subjects: ["signed.>"], invalid: annotate }
+			}
+		}
+	`, pubA, pubB)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sign := func(kp nkeys.KeyPair, subj string, data []byte) string {
+		sig, _ := kp.Sign(append([]byte(subj+"\n"), data...))
+		return base64.RawURLEncoding.EncodeToString(sig)
+	}
+	nkeyOpt := func(kp nkeys.KeyPair, pub string) nats.Option {
+		return nats.Nkey(pub, func(nonce []byte) ([]byte, error) { return kp.Sign(nonce) })
+	}
+	publish := func(nc *nats.Conn, subj, sig string) {
+		t.Helper()
+		m := nats.NewMsg(subj)
+		m.Data = []byte("hello")
+		m.Header.Set(MsgSignerHdr, "spoofed")
+		if sig != _EMPTY_ {
+			m.Header.Set(MsgSignatureHdr, sig)
+		}
+		if err := nc.PublishMsg(m); err != nil {
+			t.Fatalf("Error on publish: %v", err)
+		}
+		natsFlush(t, nc)
+	}
+
+	errCh := make(chan error, 10)
+	ncA := natsConnect(t, s.ClientURL(), nkeyOpt(kpA, pubA),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errCh <- err }))
+	defer ncA.Close()
+	subA := natsSubSync(t, ncA, ">")
+	natsFlush(t, ncA)
+
+	// Signed by the publisher.
+	publish(ncA, "signed.a", sign(kpA, "signed.a", []byte("hello")))
+	m := natsNexMsg(t, subA, time.Second)
+	if v := m.Header.Get(MsgSignerHdr); v != pubA {
+		t.Fatalf("Expected signer %q, got %q", pubA, v)
+	}
+	// Missing, or signed for another subject, are dropped.
+	publish(ncA, "signed.a", _EMPTY_)
+	publish(ncA, "signed.a", sign(kpA, "signed.b", []byte("hello")))
+	for _, reason := range []string{msgSignatureMissing, msgSignatureBad} {
+		select {
+		case err := <-errCh:
+			if !strings.Contains(err.Error(), reason) {
+				t.Fatalf("Expected error about %q, got %v", reason, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected error")
+		}
+	}
+	// Other subjects are not verified.
+	publish(ncA, "other", _EMPTY_)
+	if m := natsNexMsg(t, subA, time.Second); m.Subject != "other" {
+		t.Fatalf("Unexpected message on %q", m.Subject)
+	}
+
+	ncB := natsConnect(t, s.ClientURL(), nkeyOpt(kpB, pubB))
+	defer ncB.Close()
+	subB := natsSubSync(t, ncB, "signed.>")
+	natsFlush(t, ncB)
+	ncBPwd := natsConnect(t, s.ClientURL(), nats.UserInfo("b", "pwd"))
+	defer ncBPwd.Close()
+
+	checkAnnotated := func(reason string) {
+		t.Helper()
+		m := natsNexMsg(t, subB, time.Second)
+		if v := m.Header.Get(MsgSignatureInvalidHdr); v != reason {
+			t.Fatalf("Expected invalid reason %q, got %q", reason, v)
+		}
+		if m.Header.Get(MsgSignatureHdr) != _EMPTY_ || m.Header.Get(MsgSignerHdr) != _EMPTY_ {
+			t.Fatalf("Unexpected headers: %v", m.Header)
+		}
+		if string(m.Data) != "hello" {
+			t.Fatalf("Unexpected data: %q", m.Data)
+		}
+	}
+	// Signed with another key.
+	publish(ncB, "signed.b", sign(kpA, "signed.b", []byte("hello")))
+	checkAnnotated(msgSignatureBad)
+	publish(ncB, "signed.b", "not base64!")
+	checkAnnotated(msgSignatureEncoding)
+	// Users without nkey cannot sign.
+	publish(ncBPwd, "signed.b", sign(kpB, "signed.b", []byte("hello")))
+	checkAnnotated(msgSignatureNoKey)
+}
@@ -15,12 +15,30 @@ package server
 
 import (
 	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nkeys"
 )
 
 // Raw length of the nonce challenge
 const (
 	nonceRawLen = 11
 	nonceLen    = 15 // base64.RawURLEncoding.EncodedLen(nonceRawLen)
+
+	// Maximum raw length of the nonce challenge when configured.
+	nonceMaxRawLen = 64
+)
+
+// How long verified signatures are remembered to detect their replay.
+var nonceReplayWindow = 10 * time.Minute
+
+// Rate of nonce verification events, to not flood the system account
+// when under attack. The bucket holds authVerifyEventBurst tokens and
+// gets one back every authVerifyEventInterval.
+const (
+	authVerifyEventBurst    = 20
+	authVerifyEventInterval = 100 * time.Millisecond
 )
 
 // NonceRequired tells us if we should send a nonce.
@@ -36,11 +54,159 @@ func (s *Server) nonceRequired() bool {
 	return len(s.nkeys) > 0 || len(s.trustedKeys) > 0
 }
 
-// Generate a nonce for INFO challenge.
+// Generate a nonce for INFO challenge, of the configured size.
 // Assumes server lock is held
-func (s *Server) generateNonce(n []byte) {
-	var raw [nonceRawLen]byte
-	data := raw[:]
+func (s *Server) generateNonce() []byte {
+	rawLen := s.getOpts().NonceSize
+	if rawLen <= 0 {
+		rawLen = nonceRawLen
+	}
+	data := make([]byte, rawLen)
 	s.prand.Read(data)
+	n := make([]byte, base64.RawURLEncoding.EncodedLen(rawLen))
 	base64.RawURLEncoding.Encode(n, data)
+	return n
+}
+
+// Reasons of nonce signature verification failures.
+const (
+	authVerifyMissingSignature = "missing_signature"
+	authVerifyBadEncoding      = "invalid_signature_encoding"
+	authVerifyBadNkey          = "invalid_nkey"
+	authVerifyBadSignature     = "bad_signature"
+	authVerifyNonceExpired     = "nonce_expired"
+	authVerifyReplay           = "replay"
+)
+
+// verifyNonceSignature verifies the signature of the nonce sent in the
+// CONNECT with the public key. The nonce expires after the configured TTL,
+// and a signature already verified, on this or another connection, is a
+// replay. Clients authorized again, on reload, are not checked for either
+// since their signature was verified once already. Failures are sent as
+// security events.
+func (c *client) verifyNonceSignature(pubKey string) bool {
+	s := c.srv
+	fail := func(reason string) bool {
+		c.Debugf("Signature not verified: %s", reason)
+		s.sendAuthVerifyEvent(c, pubKey, reason)
+		return false
+	}
+	if c.opts.Sig == _EMPTY_ {
+		return fail(authVerifyMissingSignature)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(c.opts.Sig)
+	if err != nil {
+		// Allow fallback to normal base64.
+		sig, err = base64.StdEncoding.DecodeString(c.opts.Sig)
+		if err != nil {
+			return fail(authVerifyBadEncoding)
+		}
+	}
+	pub, err := nkeys.FromPublicKey(pubKey)
+	if err != nil {
+		return fail(authVerifyBadNkey)
+	}
+	c.mu.Lock()
+	verified := c.flags.isSet(nonceVerified)
+	c.mu.Unlock()
+	if !verified && s.isReplayedSignature(sig) {
+		return fail(authVerifyReplay)
+	}
+	if ttl := s.getOpts().NonceTTL; !verified && ttl > 0 && time.Since(c.start) > ttl {
+		return fail(authVerifyNonceExpired)
+	}
+	if err := pub.Verify(c.nonce, sig); err != nil {
+		return fail(authVerifyBadSignature)
+	}
+	if !verified {
+		s.rememberSignature(sig)
+		c.mu.Lock()
+		c.flags.set(nonceVerified)
+		c.mu.Unlock()
+	}
+	return true
+}
+
+// isReplayedSignature returns true if the signature was already verified.
+func (s *Server) isReplayedSignature(sig []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.verifiedSigs[string(sig)]
+	return ok && time.Since(t) < nonceReplayWindow
+}
+
+// rememberSignature remembers a verified signature to detect its replay,
+// forgetting the ones older than the replay window.
+func (s *Server) rememberSignature(sig []byte) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.verifiedSigs == nil {
+		s.verifiedSigs = make(map[string]time.Time)
+	}
+	if now.Sub(s.verifiedSigsPruned) >= nonceReplayWindow/10 {
+		for k, t := range s.verifiedSigs {
+			if now.Sub(t) >= nonceReplayWindow {
+				delete(s.verifiedSigs, k)
+			}
+		}
+		s.verifiedSigsPruned = now
+	}
+	s.verifiedSigs[string(sig)] = now
+}
+
+// signNonce signs the nonce with the signer if set, or else with the seed,
+// and returns the public key of the signer and the encoded signature, for
+// a server to authenticate the routes and gateways it connects to.
+func signNonce(signer Signer, seed, nonce string) (string, string, error) {
+	if signer == nil {
+		kp, err := nkeys.FromSeed([]byte(seed))
+		if err != nil {
+			return _EMPTY_, _EMPTY_, err
+		}
+		defer kp.Wipe()
+		signer = kp
+	}
+	pub, err := signer.PublicKey()
+	if err != nil {
+		return _EMPTY_, _EMPTY_, err
+	}
+	sig, err := signer.Sign([]byte(nonce))
+	if err != nil {
+		return _EMPTY_, _EMPTY_, err
+	}
+	return pub, base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// isServerNkeyAuthorized returns true if the nkey of the route or gateway
+// is one of the keys and signed the nonce.
+func (s *Server) isServerNkeyAuthorized(c *client, keys []string) bool {
+	for _, k := range keys {
+		if k == c.opts.Nkey {
+			return c.verifyNonceSignature(k)
+		}
+	}
+	return false
+}
+
+// validateServerNkeys validates the seed and the keys that routes and
+// gateways authenticate with, which have to be server keys.
+func validateServerNkeys(kind, seed string, keys []string) error {
+	if seed != _EMPTY_ {
+		kp, err := nkeys.FromSeed([]byte(seed))
+		if err != nil {
+			return fmt.Errorf("%s nkey seed is invalid: %v", kind, err)
+		}
+		pub, _ := kp.PublicKey()
+		kp.Wipe()
+		if !nkeys.IsValidPublicServerKey(pub) {
+			return fmt.Errorf("%s nkey seed is not a server seed", kind)
+		}
+	}
+	for _, k := range keys {
+		if !nkeys.IsValidPublicServerKey(k) {
+			return fmt.Errorf("%s nkey %q is not a valid server public key", kind, k)
+		}
+	}
+	return nil
 }
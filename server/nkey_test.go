@@ -25,6 +25,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 )
 
@@ -281,3 +282,136 @@ func BenchmarkPublicVerify(b *testing.B) {
 		}
 	}
 }
+
+func TestNonceSize(t *testing.T) {
+	kp, _ := nkeys.FromSeed(seed)
+	pub, _ := kp.PublicKey()
+	opts := defaultServerOptions
+	opts.Nkeys = []*NkeyUser{{Nkey: string(pub)}}
+	opts.NonceSize = 32
+	_, c, _, l := rawSetup(opts)
+	defer c.close()
+
+	var info nonceInfo
+	if err := json.Unmarshal([]byte(l[5:]), &info); err != nil {
+		t.Fatalf("Could not parse INFO json: %v\n", err)
+	}
+	if len(info.Nonce) != base64.RawURLEncoding.EncodedLen(32) {
+		t.Fatalf("Unexpected nonce %q", info.Nonce)
+	}
+}
+
+func TestNonceReplayAndExpiry(t *testing.T) {
+	kp, _ := nkeys.FromSeed(seed)
+	pub, _ := kp.PublicKey()
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		nonce_ttl: "250ms"
+		accounts {
+			A: { users: [{nkey: %q}] }
+			SYS: { users: [{user: sys, password: pwd}] }
+		}
+		system_account: SYS
+	`, pub)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sys := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer sys.Close()
+	sub := natsSubSync(t, sys, fmt.Sprintf(authVerifyEventSubj, s.ID()))
+	natsFlush(t, sys)
+
+	connect := func(sign bool, cs string) (string, string) {
+		t.Helper()
+		c, cr, l := newClientForServer(s)
+		defer c.close()
+		if sign {
+			var info nonceInfo
+			if err := json.Unmarshal([]byte(l[5:]), &info); err != nil {
+				t.Fatalf("Could not parse INFO json: %v\n", err)
+			}
+			sigraw, _ := kp.Sign([]byte(info.Nonce))
+			cs = fmt.Sprintf("CONNECT {\"nkey\":%q,\"sig\":%q,\"verbose\":true}\r\nPING\r\n",
+				pub, base64.RawURLEncoding.EncodeToString(sigraw))
+		}
+		c.parseAsync(cs)
+		l, _ = cr.ReadString('\n')
+		return l, cs
+	}
+	checkEvent := func(reason string) {
+		t.Helper()
+		var ev AuthVerifyEventMsg
+		if err := json.Unmarshal(natsNexMsg(t, sub, time.Second).Data, &ev); err != nil {
+			t.Fatalf("Error unmarshalling event: %v", err)
+		}
+		if ev.Type != AuthVerifyEventMsgType || ev.Reason != reason || ev.Nkey != pub || ev.Kind != "Client" {
+			t.Fatalf("Unexpected event: %+v", ev)
+		}
+	}
+
+	l, cs := connect(true, _EMPTY_)
+	if !strings.HasPrefix(l, "+OK") {
+		t.Fatalf("Expected an OK, got: %v", l)
+	}
+	// The same signed CONNECT on another connection is a replay.
+	if l, _ := connect(false, cs); !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error, got: %v", l)
+	}
+	checkEvent(authVerifyReplay)
+
+	// The nonce expires.
+	c, cr, l := newClientForServer(s)
+	defer c.close()
+	var info nonceInfo
+	json.Unmarshal([]byte(l[5:]), &info)
+	time.Sleep(300 * time.Millisecond)
+	sigraw, _ := kp.Sign([]byte(info.Nonce))
+	c.parseAsync(fmt.Sprintf("CONNECT {\"nkey\":%q,\"sig\":%q,\"verbose\":true}\r\nPING\r\n",
+		pub, base64.RawURLEncoding.EncodeToString(sigraw)))
+	if l, _ = cr.ReadString('\n'); !strings.HasPrefix(l, "-ERR ") {
+		t.Fatalf("Expected an error, got: %v", l)
+	}
+	checkEvent(authVerifyNonceExpired)
+}
+
+func TestNonceReauthorizationOnReload(t *testing.T) {
+	kp, _ := nkeys.FromSeed(seed)
+	pub, _ := kp.PublicKey()
+	confTemplate := `
+		listen: "127.0.0.1:-1"
+		nonce_ttl: "250ms"
+		authorization { users: [{nkey: %q}%s] }
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(confTemplate, pub, _EMPTY_)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL(), nats.Nkey(pub, func(nonce []byte) ([]byte, error) {
+		return kp.Sign(nonce)
+	}), nats.MaxReconnects(0))
+	defer nc.Close()
+
+	// Neither the signature already verified, nor the nonce expired since,
+	// disconnect the client on reload.
+	time.Sleep(300 * time.Millisecond)
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(confTemplate, pub, `, {user: bob, password: pwd}`)))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	if err := nc.Flush(); err != nil || !nc.IsConnected() {
+		t.Fatalf("Expected nkey client to stay connected: %v", err)
+	}
+
+	// Same for users with a JWT.
+	ts, _ := runTrustedServer(t)
+	defer ts.Shutdown()
+	_, akp := createAccount(ts)
+	jnc := natsConnect(t, ts.ClientURL(), createUserCreds(t, ts, akp), nats.MaxReconnects(0))
+	defer jnc.Close()
+	ts.reloadAuthorization()
+	if err := jnc.Flush(); err != nil || !jnc.IsConnected() {
+		t.Fatalf("Expected JWT client to stay connected: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Clients supporting headers that set no_responders in their CONNECT are
+// sent a message with a 503 status on the reply subject of their requests
+// when no one received them, instead of waiting for their timeout. With
+// no_responders_hints, the server remembers when each request subject of
+// an account was last delivered to a responder, and in which cluster, the
+// local one or the nearest gateway with interest, and adds them to the
+// status so that clients can decide whether and where to retry.
+
+const (
+	// NoRespondersLastSeenHdr is the last time a responder received a
+	// request on the subject, in RFC3339 format.
+	NoRespondersLastSeenHdr = "Nats-Responder-Last-Seen"
+	// NoRespondersClusterHdr is the cluster in which a responder last
+	// received a request on the subject.
+	NoRespondersClusterHdr = "Nats-Responder-Cluster"
+
+	// Maximum number of request subjects remembered per account.
+	maxResponderHints = 10000
+)
+
+// responderHints are the last deliveries of the requests of an account.
+type responderHints struct {
+	mu   sync.Mutex
+	seen map[string]responderSeen
+}
+
+type responderSeen struct {
+	last    time.Time
+	cluster string
+}
+
+// responderHints returns the responder hints of the account, creating
+// them if requested.
+func (a *Account) responderHints(create bool) *responderHints {
+	a.mu.RLock()
+	rh := a.rspHints
+	a.mu.RUnlock()
+	if rh != nil || !create {
+		return rh
+	}
+	a.mu.Lock()
+	if a.rspHints == nil {
+		a.rspHints = &responderHints{seen: make(map[string]responderSeen)}
+	}
+	rh = a.rspHints
+	a.mu.Unlock()
+	return rh
+}
+
+func (rh *responderHints) record(subject, cluster string) {
+	rh.mu.Lock()
+	if _, ok := rh.seen[subject]; !ok && len(rh.seen) >= maxResponderHints {
+		// Random delete.
+		for s := range rh.seen {
+			delete(rh.seen, s)
+			break
+		}
+	}
+	rh.seen[subject] = responderSeen{last: time.Now(), cluster: cluster}
+	rh.mu.Unlock()
+}
+
+func (rh *responderHints) lookup(subject string) (responderSeen, bool) {
+	rh.mu.Lock()
+	rs, ok := rh.seen[subject]
+	rh.mu.Unlock()
+	return rs, ok
+}
+
+// recordResponder remembers that the request was delivered, locally or
+// else through a gateway.
+func (c *client) recordResponder(local bool) {
+	s := c.srv
+	// Clusters are only named with gateways.
+	var cluster string
+	if s.gateway.enabled && local {
+		cluster = s.getGatewayName()
+	} else if s.gateway.enabled {
+		// The outbound gateways are ordered by RTT.
+		var gws []*client
+		s.getOutboundGatewayConnections(&gws)
+		for _, gwc := range gws {
+			if psi, qr := gwc.gatewayInterest(c.acc.Name, string(c.pa.subject)); psi || qr != nil {
+				gwc.mu.Lock()
+				cluster = gwc.gw.name
+				gwc.mu.Unlock()
+				break
+			}
+		}
+	}
+	c.acc.responderHints(true).record(string(c.pa.subject), cluster)
+}
+
+// sendNoResponders sends a 503 status to the subscription of the client on
+// the reply subject of its request, with the hints if enabled.
+func (c *client) sendNoResponders(hints bool) {
+	reply := string(c.pa.reply)
+	hdr := "NATS/1.0 503" + _CRLF_
+	if hints {
+		if rh := c.acc.responderHints(false); rh != nil {
+			if rs, ok := rh.lookup(string(c.pa.subject)); ok {
+				hdr += NoRespondersLastSeenHdr + ": " + rs.last.UTC().Format(time.RFC3339Nano) + _CRLF_
+				if rs.cluster != _EMPTY_ {
+					hdr += NoRespondersClusterHdr + ": " + rs.cluster + _CRLF_
+				}
+			}
+		}
+	}
+	hdr += _CRLF_
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, sub := range c.subs {
+		if sub.queue == nil && subjectIsSubsetMatch(reply, string(sub.subject)) {
+			proto := fmt.Sprintf("HMSG %s %s %d %d%s%s%s", reply, sub.sid, len(hdr), len(hdr), _CRLF_, hdr, _CRLF_)
+			if c.trace {
+				c.traceOutOp("HMSG", []byte(fmt.Sprintf("%s %s %d %d", reply, sub.sid, len(hdr), len(hdr))))
+			}
+			c.enqueueProto([]byte(proto))
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNoResponders(t *testing.T) {
+	opts := defaultServerOptions
+	opts.Port = -1
+	s := New(&opts)
+
+	// Reads the status sent for a request, returning its header.
+	readStatus := func(cr *bufio.Reader) string {
+		t.Helper()
+		l, err := cr.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error receiving msg from server: %v", err)
+		}
+		am := hmsgPat.FindAllStringSubmatch(l, -1)
+		if len(am) == 0 {
+			t.Fatalf("Did not get a match for %q", l)
+		}
+		if am[0][SUB_INDEX] != "reply" || am[0][SID_INDEX] != "1" {
+			t.Fatalf("Unexpected status %q", l)
+		}
+		n, _ := strconv.Atoi(am[0][TLEN_INDEX])
+		buf := make([]byte, n+LEN_CR_LF)
+		if _, err := io.ReadFull(cr, buf); err != nil {
+			t.Fatalf("Error reading status: %v", err)
+		}
+		hdr := string(buf[:n])
+		if !strings.HasPrefix(hdr, "NATS/1.0 503\r\n") {
+			t.Fatalf("Unexpected status header %q", hdr)
+		}
+		return hdr
+	}
+
+	c, cr, _ := newClientForServer(s)
+	defer c.close()
+	c.parseAsync("CONNECT {\"headers\":true,\"no_responders\":true}\r\nSUB reply 1\r\nPUB svc reply 0\r\n\r\n")
+	if hdr := readStatus(cr); hdr != "NATS/1.0 503\r\n\r\n" {
+		t.Fatalf("Unexpected status header %q", hdr)
+	}
+
+	// Clients not asking for it are not sent the status.
+	o, or, _ := newClientForServer(s)
+	defer o.close()
+	o.parseAsync("CONNECT {\"headers\":true}\r\nSUB reply 1\r\nPUB svc reply 0\r\n\r\nPING\r\n")
+	if l, err := or.ReadString('\n'); err != nil || l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q, %v", l, err)
+	}
+
+	// Without hints, the status stays the same after a responder was seen.
+	r, rr, _ := newClientForServer(s)
+	defer r.close()
+	r.parseAsync("SUB svc 1\r\nPING\r\n")
+	if l, err := rr.ReadString('\n'); err != nil || l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q, %v", l, err)
+	}
+	c.parseAsync("PUB svc reply 0\r\n\r\nPING\r\n")
+	if l, err := rr.ReadString('\n'); err != nil || !strings.HasPrefix(l, "MSG svc 1 reply 0") {
+		t.Fatalf("Expected request, got %q, %v", l, err)
+	}
+	if l, err := cr.ReadString('\n'); err != nil || l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q, %v", l, err)
+	}
+	r.parseAsync("UNSUB 1\r\nPING\r\n")
+	rr.ReadString('\n')
+	if l, err := rr.ReadString('\n'); err != nil || l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q, %v", l, err)
+	}
+	c.parseAsync("PUB svc reply 0\r\n\r\n")
+	if hdr := readStatus(cr); hdr != "NATS/1.0 503\r\n\r\n" {
+		t.Fatalf("Unexpected status header %q", hdr)
+	}
+
+	// With hints, the status has the last time a responder was seen.
+	s.mu.Lock()
+	s.opts.NoRespondersHints = true
+	s.mu.Unlock()
+	r.parseAsync("SUB svc 2\r\nPING\r\n")
+	if l, err := rr.ReadString('\n'); err != nil || l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q, %v", l, err)
+	}
+	start := time.Now().UTC()
+	c.parseAsync("PUB svc reply 0\r\n\r\nPING\r\n")
+	if l, err := cr.ReadString('\n'); err != nil || l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q, %v", l, err)
+	}
+	if l, err := rr.ReadString('\n'); err != nil || !strings.HasPrefix(l, "MSG svc 2 reply 0") {
+		t.Fatalf("Expected request, got %q, %v", l, err)
+	}
+	rr.ReadString('\n')
+	r.parseAsync("UNSUB 2\r\nPING\r\n")
+	if l, err := rr.ReadString('\n'); err != nil || l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q, %v", l, err)
+	}
+	c.parseAsync("PUB svc reply 0\r\n\r\n")
+	hdr := readStatus(cr)
+	last := getHeader(NoRespondersLastSeenHdr, []byte(hdr))
+	seen, err := time.Parse(time.RFC3339Nano, string(last))
+	if err != nil || seen.Before(start.Add(-time.Second)) || getHeader(NoRespondersClusterHdr, []byte(hdr)) != nil {
+		t.Fatalf("Unexpected status header %q: %v", hdr, err)
+	}
+}
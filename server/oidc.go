@@ -0,0 +1,534 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clients may present an access token of an OIDC provider as their
+// auth_token. The token is validated with the keys published by the
+// issuer, and its audience and groups select the account and permissions
+// of the client.
+
+const (
+	// Default interval at which the keys of the issuer are fetched again.
+	oidcDefaultRefresh = time.Hour
+	// Minimum interval between fetches triggered by an unknown key.
+	oidcMinRefresh = 10 * time.Second
+	// Timeout of requests to the issuer.
+	oidcFetchTimeout = 5 * time.Second
+	// Allowed difference between our clock and the one of the issuer.
+	oidcClockSkew = time.Minute
+	// Default claim holding the groups of the user.
+	oidcDefaultGroupsClaim = "groups"
+)
+
+// OIDCOpts are options for the validation of OIDC access tokens.
+type OIDCOpts struct {
+	// Issuer is the URL of the provider, which has to match the iss claim.
+	Issuer string
+	// JWKSURL is the URL of the keys of the issuer. If not set, it is
+	// discovered from the OpenID configuration of the issuer.
+	JWKSURL string
+	// Audience, if set, has to contain one of the aud claim values.
+	Audience []string
+	// GroupsClaim is the claim holding the groups, "groups" by default.
+	GroupsClaim string
+	// RefreshInterval is how often the keys are fetched again.
+	RefreshInterval time.Duration
+	// Mappings select the account and permissions of clients, the first
+	// matching the token being used. Without mappings, clients use the
+	// global account.
+	Mappings []*OIDCMapping
+}
+
+// OIDCMapping maps tokens with the audience and group, when set, to an
+// account and permissions.
+type OIDCMapping struct {
+	Audience    string
+	Group       string
+	Account     string
+	Permissions *Permissions
+}
+
+func validateOIDCOptions(o *Options) error {
+	oo := &o.OIDC
+	if oo.Issuer == _EMPTY_ {
+		return nil
+	}
+	if len(o.TrustedOperators) > 0 || len(o.TrustedKeys) > 0 {
+		return fmt.Errorf("oidc can not be used with trusted operators")
+	}
+	for _, u := range []string{oo.Issuer, oo.JWKSURL} {
+		if u == _EMPTY_ {
+			continue
+		}
+		if pu, err := url.Parse(u); err != nil || (pu.Scheme != "https" && pu.Scheme != "http") {
+			return fmt.Errorf("oidc url %q is not valid", u)
+		}
+	}
+	for _, m := range oo.Mappings {
+		if m.Account == _EMPTY_ {
+			continue
+		}
+		found := false
+		for _, acc := range o.Accounts {
+			if acc.Name == m.Account {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("oidc mapping to unknown account %q", m.Account)
+		}
+	}
+	return nil
+}
+
+// configureOIDC creates the validator of tokens, keeping the current one
+// and its keys if the options did not change.
+// Lock is held on entry.
+func (s *Server) configureOIDC(o *OIDCOpts) {
+	if o.Issuer == _EMPTY_ {
+		s.oidc = nil
+		return
+	}
+	s.info.AuthRequired = true
+	if s.oidc == nil || !reflect.DeepEqual(s.oidc.opts, *o) {
+		s.oidc = newOIDCProvider(*o)
+	}
+}
+
+// isOIDCToken returns true if the token has the form of a JWT.
+func isOIDCToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// processOIDCAuthentication validates the token of the client and
+// registers it with the account and permissions it maps to.
+func (s *Server) processOIDCAuthentication(c *client, p *oidcProvider) bool {
+	user, expires, err := s.oidcUser(p, c.opts.Token)
+	if err != nil {
+		c.Debugf("OIDC authentication failed: %v", err)
+		return false
+	}
+	c.RegisterUser(user)
+	s.accountConnectEvent(c)
+	c.setExpirationTimer(time.Until(expires))
+	return true
+}
+
+// oidcUser validates the token and returns the user it maps to, with the
+// time at which it expires.
+func (s *Server) oidcUser(p *oidcProvider, token string) (*User, time.Time, error) {
+	claims, err := p.verify(token, time.Now())
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("token not valid: %v", err)
+	}
+	acc := s.globalAccount()
+	var perms *Permissions
+	if len(p.opts.Mappings) > 0 {
+		m := p.opts.mapping(claims)
+		if m == nil {
+			return nil, time.Time{}, fmt.Errorf("token of %q not mapped to an account", claims.subject)
+		}
+		if m.Account != _EMPTY_ {
+			if acc, err = s.LookupAccount(m.Account); err != nil {
+				return nil, time.Time{}, fmt.Errorf("account %q lookup error: %v", m.Account, err)
+			}
+		}
+		perms = m.Permissions
+	}
+	user := &User{Username: claims.subject, Account: acc}
+	if perms != nil {
+		user.Permissions = perms.clone()
+		validateResponsePermissions(user.Permissions)
+	}
+	return user, claims.expires.Add(oidcClockSkew), nil
+}
+
+// oidcClaims are the claims of a validated token.
+type oidcClaims struct {
+	subject  string
+	audience []string
+	groups   []string
+	expires  time.Time
+}
+
+// mapping returns the first mapping matching the claims, if any.
+func (o *OIDCOpts) mapping(claims *oidcClaims) *OIDCMapping {
+	for _, m := range o.Mappings {
+		if m.Audience != _EMPTY_ && !oidcContains(claims.audience, m.Audience) {
+			continue
+		}
+		if m.Group != _EMPTY_ && !oidcContains(claims.groups, m.Group) {
+			continue
+		}
+		return m
+	}
+	return nil
+}
+
+func oidcContains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcProvider validates tokens, caching the keys of the issuer.
+type oidcProvider struct {
+	opts   OIDCOpts
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	// Closed when the fetch in progress, if any, is done.
+	fetching chan struct{}
+	// Error of the last fetch.
+	fetchErr error
+}
+
+func newOIDCProvider(o OIDCOpts) *oidcProvider {
+	return &oidcProvider{opts: o, client: &http.Client{Timeout: oidcFetchTimeout}}
+}
+
+// verify checks the signature and claims of the token.
+func (p *oidcProvider) verify(token string, now time.Time) (*oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := oidcDecodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %v", err)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := oidcVerifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims struct {
+		Issuer    string      `json:"iss"`
+		Subject   string      `json:"sub"`
+		Audience  interface{} `json:"aud"`
+		Expires   float64     `json:"exp"`
+		NotBefore float64     `json:"nbf"`
+	}
+	if err := oidcDecodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+	if claims.Issuer != p.opts.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	expires := time.Unix(int64(claims.Expires), 0)
+	if claims.Expires == 0 || now.After(expires.Add(oidcClockSkew)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(oidcClockSkew).Before(time.Unix(int64(claims.NotBefore), 0)) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	audience := oidcStrings(claims.Audience)
+	if len(p.opts.Audience) > 0 {
+		match := false
+		for _, aud := range p.opts.Audience {
+			if oidcContains(audience, aud) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return nil, fmt.Errorf("unexpected audience %q", audience)
+		}
+	}
+
+	// The groups claim is configurable, so decode it separately.
+	var all map[string]interface{}
+	if err := oidcDecodeSegment(parts[1], &all); err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+	groupsClaim := p.opts.GroupsClaim
+	if groupsClaim == _EMPTY_ {
+		groupsClaim = oidcDefaultGroupsClaim
+	}
+	return &oidcClaims{
+		subject:  claims.Subject,
+		audience: audience,
+		groups:   oidcStrings(all[groupsClaim]),
+		expires:  expires,
+	}, nil
+}
+
+// oidcStrings returns the values of a claim that is a string or an array
+// of strings.
+func oidcStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func oidcDecodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func oidcVerifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var hash crypto.Hash
+	switch {
+	case len(alg) != 5:
+	case strings.HasSuffix(alg, "256"):
+		hash = crypto.SHA256
+	case strings.HasSuffix(alg, "384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(alg, "512"):
+		hash = crypto.SHA512
+	}
+	if hash == 0 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var err error
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		case "PS":
+			err = rsa.VerifyPSS(pub, hash, digest, sig, nil)
+		default:
+			return fmt.Errorf("algorithm %q does not match RSA key", alg)
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size {
+			return fmt.Errorf("algorithm %q does not match EC key", alg)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			err = fmt.Errorf("verification failed")
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	return nil
+}
+
+// key returns the key with the id, fetching the keys of the issuer if
+// they are stale or the key is unknown. The keys are fetched without
+// holding the lock, and by a single caller at a time, the others waiting
+// for it when they do not have the key.
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	refresh := p.opts.RefreshInterval
+	if refresh <= 0 {
+		refresh = oidcDefaultRefresh
+	}
+
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	since := time.Since(p.fetched)
+	stale := since > refresh || (!ok && since > oidcMinRefresh)
+	fetching := p.fetching
+	if stale && fetching == nil {
+		p.fetched = time.Now()
+		p.fetching = make(chan struct{})
+	}
+	p.mu.Unlock()
+
+	switch {
+	case ok && (!stale || fetching != nil):
+		// Keep using the key while another caller refreshes the keys.
+		return key, nil
+	case fetching != nil:
+		<-fetching
+	case stale:
+		keys, err := p.fetchKeys()
+		p.mu.Lock()
+		if err == nil {
+			p.keys = keys
+		}
+		p.fetchErr = err
+		close(p.fetching)
+		p.fetching = nil
+		p.mu.Unlock()
+		// Keep using the key we have.
+		if err != nil && ok {
+			return key, nil
+		}
+	}
+
+	p.mu.Lock()
+	key, ok = p.keys[kid]
+	err := p.fetchErr
+	p.mu.Unlock()
+	if !ok {
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch keys: %v", err)
+		}
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// oidcJWK is a key of the JSON web key set of the issuer.
+type oidcJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (p *oidcProvider) fetchKeys() (map[string]crypto.PublicKey, error) {
+	jwksURL := p.opts.JWKSURL
+	if jwksURL == _EMPTY_ {
+		var config struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := p.get(strings.TrimSuffix(p.opts.Issuer, "/")+"/.well-known/openid-configuration", &config); err != nil {
+			return nil, err
+		}
+		if config.JWKSURI == _EMPTY_ {
+			return nil, fmt.Errorf("no jwks_uri in OpenID configuration")
+		}
+		jwksURL = config.JWKSURI
+	}
+	var set struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	if err := p.get(jwksURL, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != _EMPTY_ && jwk.Use != "sig" {
+			continue
+		}
+		// Keys of unsupported types are ignored.
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (p *oidcProvider) get(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q from %s", resp.Status, u)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (jwk *oidcJWK) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
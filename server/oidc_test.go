@@ -0,0 +1,290 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// runOIDCIssuer runs an issuer publishing the RSA and EC keys.
+func runOIDCIssuer(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) *httptest.Server {
+	t.Helper()
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	mux := http.NewServeMux()
+	var issuer string
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": issuer + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+			{"kty": "oct", "kid": "ignored", "k": "c2VjcmV0"},
+		}})
+	})
+	ts := httptest.NewServer(mux)
+	issuer = ts.URL
+	return ts
+}
+
+func oidcTestToken(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCAuthentication(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	issuer := runOIDCIssuer(t, rsaKey, ecKey)
+	defer issuer.Close()
+
+	opts := DefaultOptions()
+	opts.Accounts = []*Account{NewAccount("A"), NewAccount("B")}
+	opts.OIDC = OIDCOpts{
+		Issuer:   issuer.URL,
+		Audience: []string{"nats", "web"},
+		Mappings: []*OIDCMapping{
+			{Group: "admins", Account: "A"},
+			{Audience: "web", Account: "B", Permissions: &Permissions{
+				Publish: &SubjectPermission{Allow: []string{"public.>"}},
+			}},
+		},
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := func(aud interface{}, groups ...string) map[string]interface{} {
+		return map[string]interface{}{"iss": issuer.URL, "sub": "bob", "aud": aud, "exp": exp, "groups": groups}
+	}
+	connect := func(token string) (*nats.Conn, error) {
+		return nats.Connect(s.ClientURL(), nats.Token(token), nats.MaxReconnects(0))
+	}
+
+	// Admins are mapped to account A, whatever the audience.
+	nc, err := connect(oidcTestToken(t, rsaKey, "rsa", claims("nats", "users", "admins")))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	if acc, _ := s.LookupAccount("A"); acc.NumLocalConnections() != 1 {
+		t.Fatal("Expected 1 connection in account A")
+	}
+
+	// Web apps are mapped to account B, with permissions.
+	errCh := make(chan error, 1)
+	nc2, err := nats.Connect(s.ClientURL(), nats.Token(oidcTestToken(t, ecKey, "ec", claims([]string{"other", "web"}))),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errCh <- err }))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc2.Close()
+	if acc, _ := s.LookupAccount("B"); acc.NumLocalConnections() != 1 {
+		t.Fatal("Expected 1 connection in account B")
+	}
+	natsPub(t, nc2, "private", []byte("x"))
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "Permissions Violation") {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected permissions violation")
+	}
+
+	for _, test := range []struct {
+		name  string
+		token string
+	}{
+		{"not mapped", oidcTestToken(t, rsaKey, "rsa", claims("nats"))},
+		{"wrong audience", oidcTestToken(t, rsaKey, "rsa", claims("other", "admins"))},
+		{"expired", oidcTestToken(t, rsaKey, "rsa", map[string]interface{}{
+			"iss": issuer.URL, "aud": "nats", "exp": time.Now().Add(-time.Hour).Unix(), "groups": []string{"admins"},
+		})},
+		{"wrong issuer", oidcTestToken(t, rsaKey, "rsa", map[string]interface{}{
+			"iss": "https://other", "aud": "nats", "exp": exp, "groups": []string{"admins"},
+		})},
+		{"wrong key", oidcTestToken(t, rsaKey, "ec", claims("nats", "admins"))},
+		{"unknown key", oidcTestToken(t, rsaKey, "unknown", claims("nats", "admins"))},
+		{"malformed", "a.b.c"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if nc, err := connect(test.token); err == nil {
+				nc.Close()
+				t.Fatal("Expected authorization error")
+			}
+		})
+	}
+}
+
+func TestOIDCConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		accounts { A: {} }
+		oidc {
+			issuer: "https://idp.example.com"
+			audience: ["nats", "web"]
+			groups_claim: "roles"
+			refresh: "10m"
+			mappings: [
+				{group: "admins", account: A}
+				{audience: "web", account: A, permissions: {publish: "public.>"}}
+			]
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	o := opts.OIDC
+	if o.Issuer != "https://idp.example.com" || len(o.Audience) != 2 || o.GroupsClaim != "roles" ||
+		o.RefreshInterval != 10*time.Minute || len(o.Mappings) != 2 {
+		t.Fatalf("Unexpected options: %+v", o)
+	}
+	if m := o.Mappings[1]; m.Audience != "web" || m.Account != "A" || m.Permissions.Publish.Allow[0] != "public.>" {
+		t.Fatalf("Unexpected mapping: %+v", m)
+	}
+	if err := validateOIDCOptions(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	o.Mappings[0].Account = "B"
+	if err := validateOIDCOptions(opts); err == nil || !strings.Contains(err.Error(), fmt.Sprintf("%q", "B")) {
+		t.Fatalf("Expected error about account, got %v", err)
+	}
+	conf = createConfFile(t, []byte(`oidc { issuer: "https://idp", bad: 1 }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Fatalf("Expected error on unknown field, got %v", err)
+	}
+}
+
+func TestOIDCKeyFetch(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	var fetches int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		}})
+	}))
+	defer ts.Close()
+	var releaseOnce sync.Once
+	releaseFetch := func() { releaseOnce.Do(func() { close(release) }) }
+	defer releaseFetch()
+
+	p := newOIDCProvider(OIDCOpts{Issuer: ts.URL, JWKSURL: ts.URL})
+	if _, err := p.key("ec"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Make the keys stale, the refresh is then held by the issuer.
+	p.mu.Lock()
+	p.fetched = time.Now().Add(-2 * oidcDefaultRefresh)
+	p.mu.Unlock()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := p.key("ec"); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := atomic.LoadInt32(&fetches); n != 2 {
+			return fmt.Errorf("expected 2 fetches, got %v", n)
+		}
+		return nil
+	})
+
+	// The known key is returned while the refresh is in progress, and
+	// callers of unknown keys wait for it instead of fetching again.
+	start := time.Now()
+	if _, err := p.key("ec"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Key lookup blocked by the refresh for %v", d)
+	}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.key("unknown"); err == nil {
+				t.Errorf("Expected error for unknown key")
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	releaseFetch()
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatalf("Expected 2 fetches, got %v", n)
+	}
+}
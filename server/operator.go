@@ -0,0 +1,290 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+// Each trusted operator can have a policy, with its own account resolver
+// and system account, and limits on its accounts. With policies, accounts
+// signed by different operators are isolated from each other: imports
+// between them are ignored, and the resolver of an operator only serves
+// accounts signed by that operator.
+
+// OperatorPolicy is the policy of a trusted operator.
+type OperatorPolicy struct {
+	// AccountResolver fetches the accounts of the operator, before the
+	// account resolver of the server, if any.
+	AccountResolver AccountResolver
+	// SystemAccount overrides the system account of the operator JWT. With
+	// several operators and no system_account in the configuration, the
+	// system account of the server is the one of the first operator that
+	// has one. The other ones are regular accounts of their operator.
+	SystemAccount string
+	// MaxAccounts limits the number of accounts of the operator loaded at
+	// once, 0 being unlimited.
+	MaxAccounts int
+	// MaxConnections limits the number of client connections of all the
+	// accounts of the operator, 0 being unlimited.
+	MaxConnections int
+	// AllowedAccounts, if set, are the only accounts of the operator that
+	// are accepted, by public key.
+	AllowedAccounts []string
+}
+
+// allows returns true if the policy allows the account.
+func (p *OperatorPolicy) allows(name string) bool {
+	if len(p.AllowedAccounts) == 0 {
+		return true
+	}
+	for _, a := range p.AllowedAccounts {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// operatorPolicy returns the policy of the operator, by public key or name.
+func (o *Options) operatorPolicy(opc *jwt.OperatorClaims) *OperatorPolicy {
+	if p, ok := o.OperatorPolicies[opc.Subject]; ok {
+		return p
+	}
+	if opc.Name != _EMPTY_ {
+		return o.OperatorPolicies[opc.Name]
+	}
+	return nil
+}
+
+// validateOperatorPolicies checks that policies are for trusted operators,
+// and sets the system account from them if needed.
+func validateOperatorPolicies(o *Options) error {
+	if len(o.OperatorPolicies) == 0 {
+		return nil
+	}
+	used := make(map[*OperatorPolicy]bool)
+	allResolvers := true
+	for _, opc := range o.TrustedOperators {
+		p := o.operatorPolicy(opc)
+		if p == nil {
+			allResolvers = false
+			continue
+		}
+		used[p] = true
+		if p.AccountResolver == nil {
+			allResolvers = false
+		}
+		if p.MaxAccounts < 0 || p.MaxConnections < 0 {
+			return fmt.Errorf("operator %q policy limits can not be negative", opc.Name)
+		}
+	}
+	for name, p := range o.OperatorPolicies {
+		if !used[p] {
+			return fmt.Errorf("operator policy for unknown operator %q", name)
+		}
+	}
+	if o.AccountResolver == nil && !allResolvers {
+		return fmt.Errorf("operators require an account resolver to be configured")
+	}
+	if o.SystemAccount == _EMPTY_ {
+		for _, opc := range o.TrustedOperators {
+			if sa := operatorSystemAccount(o, opc); sa != _EMPTY_ {
+				o.SystemAccount = sa
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// operatorSystemAccount returns the system account of the operator, from
+// its policy or its JWT.
+func operatorSystemAccount(o *Options, opc *jwt.OperatorClaims) string {
+	if p := o.operatorPolicy(opc); p != nil && p.SystemAccount != _EMPTY_ {
+		return p.SystemAccount
+	}
+	return opc.SystemAccount
+}
+
+// serverOperators holds the operators with policies by their keys.
+type serverOperators struct {
+	mu   sync.RWMutex
+	keys map[string]*trustedOperator
+}
+
+// trustedOperator is a trusted operator with its policy.
+type trustedOperator struct {
+	claims *jwt.OperatorClaims
+	policy *OperatorPolicy
+}
+
+// configureOperatorPolicies maps the keys of the operators with policies to
+// their operator.
+func (s *Server) configureOperatorPolicies(opts *Options) {
+	var ops map[string]*trustedOperator
+	if len(opts.OperatorPolicies) > 0 {
+		ops = make(map[string]*trustedOperator)
+		for _, opc := range opts.TrustedOperators {
+			op := &trustedOperator{claims: opc, policy: opts.operatorPolicy(opc)}
+			if op.policy == nil {
+				op.policy = &OperatorPolicy{}
+			}
+			ops[opc.Subject] = op
+			for _, sk := range opc.SigningKeys {
+				ops[sk] = op
+			}
+		}
+	}
+	s.operators.mu.Lock()
+	s.operators.keys = ops
+	s.operators.mu.Unlock()
+}
+
+// operatorOf returns the operator of the account, if operators have
+// policies.
+func (s *Server) operatorOf(issuer string) *trustedOperator {
+	s.operators.mu.RLock()
+	defer s.operators.mu.RUnlock()
+	return s.operators.keys[issuer]
+}
+
+// sameOperator returns false if the accounts are signed by different
+// operators with policies.
+func (s *Server) sameOperator(a, b *Account) bool {
+	s.operators.mu.RLock()
+	defer s.operators.mu.RUnlock()
+	if len(s.operators.keys) == 0 {
+		return true
+	}
+	return s.operators.keys[a.Issuer] == s.operators.keys[b.Issuer]
+}
+
+// checkOperatorAccount checks that the policy of the operator of the
+// account claims allows to load the account.
+func (s *Server) checkOperatorAccount(ac *jwt.AccountClaims) error {
+	op := s.operatorOf(ac.Issuer)
+	if op == nil {
+		return nil
+	}
+	if !op.policy.allows(ac.Subject) {
+		return ErrOperatorAccountNotAllowed
+	}
+	if op.policy.MaxAccounts == 0 {
+		return nil
+	}
+	n := 0
+	s.accounts.Range(func(k, v interface{}) bool {
+		if acc := v.(*Account); acc.Name != ac.Subject && s.operatorOf(acc.Issuer) == op {
+			n++
+		}
+		return true
+	})
+	if n >= op.policy.MaxAccounts {
+		return ErrOperatorTooManyAccounts
+	}
+	return nil
+}
+
+// operatorConnectionsReached returns true if the operator of the account
+// reached the maximum number of client connections of its policy.
+func (s *Server) operatorConnectionsReached(acc *Account) bool {
+	op := s.operatorOf(acc.Issuer)
+	if op == nil || op.policy.MaxConnections == 0 {
+		return false
+	}
+	n := 0
+	s.accounts.Range(func(k, v interface{}) bool {
+		if a := v.(*Account); s.operatorOf(a.Issuer) == op {
+			n += a.NumLocalConnections()
+		}
+		return true
+	})
+	return n >= op.policy.MaxConnections
+}
+
+// operatorResolver fetches accounts with the resolvers of the operators,
+// then with the resolver of the server. An operator resolver only serves
+// the accounts of its operator.
+type operatorResolver struct {
+	s         *Server
+	resolvers []*operatorAccResolver
+	def       AccountResolver
+}
+
+type operatorAccResolver struct {
+	op *trustedOperator
+	ar AccountResolver
+}
+
+// newOperatorResolver returns a resolver using the resolvers of the
+// operators, or nil if none has one.
+func (s *Server) newOperatorResolver(opts *Options) AccountResolver {
+	or := &operatorResolver{s: s, def: opts.AccountResolver}
+	for _, opc := range opts.TrustedOperators {
+		if p := opts.operatorPolicy(opc); p != nil && p.AccountResolver != nil {
+			or.resolvers = append(or.resolvers, &operatorAccResolver{op: s.operatorOf(opc.Subject), ar: p.AccountResolver})
+		}
+	}
+	if len(or.resolvers) == 0 {
+		return nil
+	}
+	return or
+}
+
+// Fetch returns the first account JWT found by the resolver of its operator,
+// or else by the resolver of the server.
+func (or *operatorResolver) Fetch(name string) (string, error) {
+	var err error
+	for _, r := range or.resolvers {
+		var theJWT string
+		if theJWT, err = r.ar.Fetch(name); err != nil {
+			continue
+		}
+		if ac, derr := jwt.DecodeAccountClaims(theJWT); derr != nil {
+			err = derr
+		} else if or.s.operatorOf(ac.Issuer) != r.op {
+			err = fmt.Errorf("account %q not signed by operator %q", name, r.op.claims.Name)
+		} else {
+			return theJWT, nil
+		}
+	}
+	if or.def != nil {
+		return or.def.Fetch(name)
+	}
+	if err == nil {
+		err = ErrMissingAccount
+	}
+	return _EMPTY_, err
+}
+
+// Store stores the account JWT with the resolver of its operator, or else
+// with the resolver of the server.
+func (or *operatorResolver) Store(name, theJWT string) error {
+	if ac, err := jwt.DecodeAccountClaims(theJWT); err == nil {
+		op := or.s.operatorOf(ac.Issuer)
+		for _, r := range or.resolvers {
+			if r.op == op {
+				return r.ar.Store(name, theJWT)
+			}
+		}
+	}
+	if or.def != nil {
+		return or.def.Store(name, theJWT)
+	}
+	return fmt.Errorf("no account resolver for account %q", name)
+}
@@ -0,0 +1,238 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// createTestOperator returns the claims, as decoded from their JWT, and
+// the key pair of a new operator.
+func createTestOperator(t *testing.T, name string) (*jwt.OperatorClaims, string, nkeys.KeyPair) {
+	t.Helper()
+	okp, _ := nkeys.CreateOperator()
+	opub, _ := okp.PublicKey()
+	oc := jwt.NewOperatorClaims(opub)
+	oc.Name = name
+	ojwt, err := oc.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating operator JWT: %v", err)
+	}
+	opc, err := jwt.DecodeOperatorClaims(ojwt)
+	if err != nil {
+		t.Fatalf("Error decoding operator JWT: %v", err)
+	}
+	return opc, ojwt, okp
+}
+
+// createTestOperatorAccount returns the public key, JWT and key pair of a
+// new account of the operator.
+func createTestOperatorAccount(t *testing.T, okp nkeys.KeyPair, update func(*jwt.AccountClaims)) (string, string, nkeys.KeyPair) {
+	t.Helper()
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ac := jwt.NewAccountClaims(apub)
+	if update != nil {
+		update(ac)
+	}
+	ajwt, err := ac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	return apub, ajwt, akp
+}
+
+// connectTestOperatorUser connects with a new user of the account.
+func connectTestOperatorUser(s *Server, akp nkeys.KeyPair) (*nats.Conn, error) {
+	ukp, _ := nkeys.CreateUser()
+	upub, _ := ukp.PublicKey()
+	ujwt, err := jwt.NewUserClaims(upub).Encode(akp)
+	if err != nil {
+		return nil, err
+	}
+	return nats.Connect(s.ClientURL(), nats.MaxReconnects(0), nats.UserJWT(
+		func() (string, error) { return ujwt, nil },
+		func(nonce []byte) ([]byte, error) { return ukp.Sign(nonce) }))
+}
+
+func TestOperatorPolicies(t *testing.T) {
+	opc1, _, okp1 := createTestOperator(t, "OP1")
+	opc2, _, okp2 := createTestOperator(t, "OP2")
+
+	sysPub, sysJWT, _ := createTestOperatorAccount(t, okp1, nil)
+	aPub, aJWT, akp := createTestOperatorAccount(t, okp1, func(ac *jwt.AccountClaims) {
+		ac.Exports.Add(&jwt.Export{Subject: "shared.>", Type: jwt.Stream})
+	})
+	bPub, bJWT, bkp := createTestOperatorAccount(t, okp2, func(ac *jwt.AccountClaims) {
+		ac.Imports.Add(&jwt.Import{Account: aPub, Subject: "shared.>", Type: jwt.Stream})
+	})
+	b2Pub, b2JWT, b2kp := createTestOperatorAccount(t, okp2, nil)
+	cPub, cJWT, _ := createTestOperatorAccount(t, okp1, nil)
+
+	r1, r2 := &MemAccResolver{}, &MemAccResolver{}
+	r1.Store(sysPub, sysJWT)
+	r1.Store(aPub, aJWT)
+	r2.Store(bPub, bJWT)
+	r2.Store(b2Pub, b2JWT)
+	// Accounts of an operator served by the resolver of another are ignored.
+	r2.Store(cPub, cJWT)
+
+	opts := DefaultOptions()
+	opts.TrustedOperators = []*jwt.OperatorClaims{opc1, opc2}
+	opts.OperatorPolicies = map[string]*OperatorPolicy{
+		"OP1":        {AccountResolver: r1, SystemAccount: sysPub, MaxConnections: 2},
+		opc2.Subject: {AccountResolver: r2, MaxAccounts: 1},
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	if sys := s.SystemAccount(); sys == nil || sys.Name != sysPub {
+		t.Fatalf("Expected system account of the operator policy, got %+v", sys)
+	}
+
+	// Connections of all the accounts of OP1 are limited.
+	for i := 0; i < 2; i++ {
+		nc, err := connectTestOperatorUser(s, akp)
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		defer nc.Close()
+	}
+	if nc, err := connectTestOperatorUser(s, akp); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection over the operator limit to fail")
+	}
+
+	// Accounts of OP2 are limited.
+	nc, err := connectTestOperatorUser(s, bkp)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	if nc, err := connectTestOperatorUser(s, b2kp); err == nil {
+		nc.Close()
+		t.Fatal("Expected account over the operator limit to fail")
+	}
+	if _, err := s.LookupAccount(b2Pub); err != ErrOperatorTooManyAccounts {
+		t.Fatalf("Expected %v, got %v", ErrOperatorTooManyAccounts, err)
+	}
+
+	// Accounts of different operators are isolated.
+	bacc, _ := s.LookupAccount(bPub)
+	bacc.mu.RLock()
+	imports := len(bacc.imports.streams)
+	bacc.mu.RUnlock()
+	if imports != 0 {
+		t.Fatalf("Expected import from another operator to be ignored, got %d imports", imports)
+	}
+	if _, err := s.LookupAccount(cPub); err == nil {
+		t.Fatal("Expected account of OP1 served by the resolver of OP2 to be rejected")
+	}
+
+	// Allowed accounts.
+	r1.Store(cPub, cJWT)
+	opts.OperatorPolicies["OP1"].AllowedAccounts = []string{sysPub, aPub}
+	if _, err := s.LookupAccount(cPub); err != ErrOperatorAccountNotAllowed {
+		t.Fatalf("Expected %v, got %v", ErrOperatorAccountNotAllowed, err)
+	}
+}
+
+func TestOperatorPoliciesConfig(t *testing.T) {
+	_, ojwt1, okp1 := createTestOperator(t, "OP1")
+	opc2, ojwt2, _ := createTestOperator(t, "OP2")
+	sysPub, _, _ := createTestOperatorAccount(t, okp1, nil)
+	op1 := createConfFile(t, []byte(ojwt1))
+	defer os.Remove(op1)
+	op2 := createConfFile(t, []byte(ojwt2))
+	defer os.Remove(op2)
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		operator: [%q, %q]
+		operator_policies {
+			OP1: {
+				resolver: MEM
+				system_account: %s
+				max_accounts: 10
+				max_connections: 100
+				allowed_accounts: [%s]
+			}
+			%s: { resolver: "URL(http://127.0.0.1:9090/jwt/v1/accounts/)" }
+		}
+	`, op1, op2, sysPub, sysPub, opc2.Subject)))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if len(opts.TrustedOperators) != 2 || len(opts.OperatorPolicies) != 2 {
+		t.Fatalf("Unexpected operators %d and policies %d", len(opts.TrustedOperators), len(opts.OperatorPolicies))
+	}
+	p := opts.OperatorPolicies["OP1"]
+	if _, ok := p.AccountResolver.(*MemAccResolver); !ok || p.SystemAccount != sysPub ||
+		p.MaxAccounts != 10 || p.MaxConnections != 100 || len(p.AllowedAccounts) != 1 {
+		t.Fatalf("Unexpected policy: %+v", p)
+	}
+	if _, ok := opts.OperatorPolicies[opc2.Subject].AccountResolver.(*URLAccResolver); !ok {
+		t.Fatal("Expected URL resolver")
+	}
+	// Every operator has a resolver, so none is needed for the server.
+	if err := validateTrustedOperators(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.SystemAccount != sysPub {
+		t.Fatalf("Expected system account %q, got %q", sysPub, opts.SystemAccount)
+	}
+
+	for _, test := range []struct {
+		policies string
+		err      string
+	}{
+		{`OTHER: { resolver: MEM }`, `unknown operator "OTHER"`},
+		{`OP1: { max_accounts: 1 }`, "account resolver"},
+		{`OP1: { resolver: MEM, max_connections: -1 }`, "negative"},
+		{`OP1: { resolver: MEM }, OP2: { resolver: MEM, system_account: X }`, ""},
+	} {
+		conf := createConfFile(t, []byte(fmt.Sprintf("operator: [%q, %q]\noperator_policies { %s }", op1, op2, test.policies)))
+		defer os.Remove(conf)
+		opts, err := ProcessConfigFile(conf)
+		if err != nil {
+			t.Fatalf("Error processing config: %v", err)
+		}
+		err = validateTrustedOperators(opts)
+		if test.err == _EMPTY_ {
+			if err != nil || opts.SystemAccount != "X" {
+				t.Fatalf("Expected system account of OP2, got %q: %v", opts.SystemAccount, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected error about %q, got %v", test.err, err)
+		}
+	}
+
+	conf = createConfFile(t, []byte(`operator_policies { OP1: { resolver: MEM, bad: 1 } }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Fatalf("Expected error on unknown field, got %v", err)
+	}
+	opts = &Options{OperatorPolicies: map[string]*OperatorPolicy{"OP1": {}}}
+	if err := validateTrustedOperators(opts); err == nil || !strings.Contains(err.Error(), "trusted operators") {
+		t.Fatalf("Expected error without operators, got %v", err)
+	}
+}
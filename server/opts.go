@@ -15,8 +15,10 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
-	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -70,6 +72,9 @@ type ClusterOpts struct {
 	Advertise      string            `json:"-"`
 	NoAdvertise    bool              `json:"-"`
 	ConnectRetries int               `json:"-"`
+	NkeySeed       string            `json:"-"`
+	Nkeys          []string          `json:"-"`
+	Signer         Signer            `json:"-"`
 }
 
 // GatewayOpts are options for gateways.
@@ -89,6 +94,9 @@ type GatewayOpts struct {
 	ConnectRetries int                  `json:"connect_retries,omitempty"`
 	Gateways       []*RemoteGatewayOpts `json:"gateways,omitempty"`
 	RejectUnknown  bool                 `json:"reject_unknown,omitempty"`
+	NkeySeed       string               `json:"-"`
+	Nkeys          []string             `json:"-"`
+	Signer         Signer               `json:"-"`
 
 	// Not exported, for tests.
 	resolver         netResolver
@@ -121,6 +129,13 @@ type LeafNodeOpts struct {
 	NoAdvertise       bool          `json:"-"`
 	ReconnectInterval time.Duration `json:"-"`
 
+	// UsageTokens is the number of leading tokens of the subject prefixes
+	// by which the messages exchanged with accepted leafnodes are
+	// accounted. Disabled when 0.
+	UsageTokens int `json:"-"`
+	// UsageInterval at which the usage is sent in system events.
+	UsageInterval time.Duration `json:"-"`
+
 	// For solicited connections to other clusters/superclusters.
 	Remotes []*RemoteLeafOpts `json:"remotes,omitempty"`
 
@@ -141,82 +156,225 @@ type RemoteLeafOpts struct {
 	Hub          bool        `json:"hub,omitempty"`
 	DenyImports  []string    `json:"-"`
 	DenyExports  []string    `json:"-"`
+	Signer       Signer      `json:"-"`
+	// TrustedServers are the public keys of the servers whose signed
+	// identity is required in the INFO of the remote server, if any.
+	TrustedServers []string `json:"-"`
 }
 
 // Options block for nats-server.
 // NOTE: This structure is no longer used for monitoring endpoints
 // and json tags are deprecated and may be removed in the future.
 type Options struct {
-	ConfigFile            string        `json:"-"`
-	ServerName            string        `json:"server_name"`
-	Host                  string        `json:"addr"`
-	Port                  int           `json:"port"`
-	ClientAdvertise       string        `json:"-"`
-	Trace                 bool          `json:"-"`
-	Debug                 bool          `json:"-"`
-	TraceVerbose          bool          `json:"-"`
-	NoLog                 bool          `json:"-"`
-	NoSigs                bool          `json:"-"`
-	NoSublistCache        bool          `json:"-"`
-	NoHeaderSupport       bool          `json:"-"`
-	DisableShortFirstPing bool          `json:"-"`
-	Logtime               bool          `json:"-"`
-	MaxConn               int           `json:"max_connections"`
-	MaxSubs               int           `json:"max_subscriptions,omitempty"`
-	Nkeys                 []*NkeyUser   `json:"-"`
-	Users                 []*User       `json:"-"`
-	Accounts              []*Account    `json:"-"`
-	NoAuthUser            string        `json:"-"`
-	SystemAccount         string        `json:"-"`
-	NoSystemAccount       bool          `json:"-"`
-	AllowNewAccounts      bool          `json:"-"`
-	Username              string        `json:"-"`
-	Password              string        `json:"-"`
-	Authorization         string        `json:"-"`
-	PingInterval          time.Duration `json:"ping_interval"`
-	MaxPingsOut           int           `json:"ping_max"`
-	HTTPHost              string        `json:"http_host"`
-	HTTPPort              int           `json:"http_port"`
-	HTTPBasePath          string        `json:"http_base_path"`
-	HTTPSPort             int           `json:"https_port"`
-	AuthTimeout           float64       `json:"auth_timeout"`
-	MaxControlLine        int32         `json:"max_control_line"`
-	MaxPayload            int32         `json:"max_payload"`
-	MaxPending            int64         `json:"max_pending"`
-	Cluster               ClusterOpts   `json:"cluster,omitempty"`
-	Gateway               GatewayOpts   `json:"gateway,omitempty"`
-	LeafNode              LeafNodeOpts  `json:"leaf,omitempty"`
-	JetStream             bool          `json:"jetstream"`
-	JetStreamMaxMemory    int64         `json:"-"`
-	JetStreamMaxStore     int64         `json:"-"`
-	StoreDir              string        `json:"-"`
-	Websocket             WebsocketOpts `json:"-"`
-	ProfPort              int           `json:"-"`
-	PidFile               string        `json:"-"`
-	PortsFileDir          string        `json:"-"`
-	LogFile               string        `json:"-"`
-	LogSizeLimit          int64         `json:"-"`
-	Syslog                bool          `json:"-"`
-	RemoteSyslog          string        `json:"-"`
-	Routes                []*url.URL    `json:"-"`
-	RoutesStr             string        `json:"-"`
-	TLSTimeout            float64       `json:"tls_timeout"`
-	TLS                   bool          `json:"-"`
-	TLSVerify             bool          `json:"-"`
-	TLSMap                bool          `json:"-"`
-	TLSCert               string        `json:"-"`
-	TLSKey                string        `json:"-"`
-	TLSCaCert             string        `json:"-"`
-	TLSConfig             *tls.Config   `json:"-"`
-	AllowNonTLS           bool          `json:"-"`
-	WriteDeadline         time.Duration `json:"-"`
-	MaxClosedClients      int           `json:"-"`
-	LameDuckDuration      time.Duration `json:"-"`
-	LameDuckGracePeriod   time.Duration `json:"-"`
+	ConfigFile                   string        `json:"-"`
+	ServerName                   string        `json:"server_name"`
+	Host                         string        `json:"addr"`
+	Port                         int           `json:"port"`
+	ClientAdvertise              string        `json:"-"`
+	Trace                        bool          `json:"-"`
+	Debug                        bool          `json:"-"`
+	TraceVerbose                 bool          `json:"-"`
+	NoLog                        bool          `json:"-"`
+	NoSigs                       bool          `json:"-"`
+	NoSublistCache               bool          `json:"-"`
+	NoHeaderSupport              bool          `json:"-"`
+	DisableShortFirstPing        bool          `json:"-"`
+	Logtime                      bool          `json:"-"`
+	MaxConn                      int           `json:"max_connections"`
+	MaxSubs                      int           `json:"max_subscriptions,omitempty"`
+	Nkeys                        []*NkeyUser   `json:"-"`
+	Users                        []*User       `json:"-"`
+	Accounts                     []*Account    `json:"-"`
+	NoAuthUser                   string        `json:"-"`
+	UsersFile                    string        `json:"-"`
+	SystemAccount                string        `json:"-"`
+	NoSystemAccount              bool          `json:"-"`
+	AllowNewAccounts             bool          `json:"-"`
+	Username                     string        `json:"-"`
+	Password                     string        `json:"-"`
+	Authorization                string        `json:"-"`
+	Tokens                       []*TokenUser  `json:"-"`
+	BcryptMinCost                int           `json:"-"`
+	BcryptRehash                 bool          `json:"-"`
+	PingInterval                 time.Duration `json:"ping_interval"`
+	MaxPingsOut                  int           `json:"ping_max"`
+	HTTPHost                     string        `json:"http_host"`
+	HTTPPort                     int           `json:"http_port"`
+	HTTPBasePath                 string        `json:"http_base_path"`
+	HTTPSPort                    int           `json:"https_port"`
+	AuthTimeout                  float64       `json:"auth_timeout"`
+	MaxControlLine               int32         `json:"max_control_line"`
+	MaxPayload                   int32         `json:"max_payload"`
+	MaxPending                   int64         `json:"max_pending"`
+	Cluster                      ClusterOpts   `json:"cluster,omitempty"`
+	Gateway                      GatewayOpts   `json:"gateway,omitempty"`
+	LeafNode                     LeafNodeOpts  `json:"leaf,omitempty"`
+	JetStream                    bool          `json:"jetstream"`
+	JetStreamMaxMemory           int64         `json:"-"`
+	JetStreamMaxStore            int64         `json:"-"`
+	JetStreamRecoveryConcurrency int           `json:"-"`
+	JetStreamUsageInterval       time.Duration `json:"-"`
+	JetStreamUsageAggregation    string        `json:"-"`
+	StoreDir                     string        `json:"-"`
+	Websocket                    WebsocketOpts `json:"-"`
+	ProfPort                     int           `json:"-"`
+	PidFile                      string        `json:"-"`
+	PortsFileDir                 string        `json:"-"`
+	LogFile                      string        `json:"-"`
+	LogSizeLimit                 int64         `json:"-"`
+	Syslog                       bool          `json:"-"`
+	RemoteSyslog                 string        `json:"-"`
+	Routes                       []*url.URL    `json:"-"`
+	RoutesStr                    string        `json:"-"`
+	TLSTimeout                   float64       `json:"tls_timeout"`
+	TLS                          bool          `json:"-"`
+	TLSVerify                    bool          `json:"-"`
+	TLSMap                       bool          `json:"-"`
+	// TLSMapOrder are the certificate fields users are mapped from with
+	// TLSMap, in order.
+	TLSMapOrder                  []string      `json:"-"`
+	TLSCert                      string        `json:"-"`
+	TLSKey                       string        `json:"-"`
+	TLSCaCert                    string        `json:"-"`
+	TLSConfig                    *tls.Config   `json:"-"`
+	AllowNonTLS                  bool          `json:"-"`
+	WriteDeadline                time.Duration `json:"-"`
+	MaxClosedClients             int           `json:"-"`
+	LameDuckDuration             time.Duration `json:"-"`
+	LameDuckGracePeriod          time.Duration `json:"-"`
+
+	// LameDuckConnectURLs are the client URLs, in preferred order, sent to
+	// clients when entering lame duck mode. Defaults to the cluster's URLs.
+	LameDuckConnectURLs []string `json:"-"`
+	// LameDuckBatchSize is how many clients are evicted at once in lame duck
+	// mode. Computed from the number of clients and duration if not set.
+	LameDuckBatchSize int `json:"-"`
+	// LameDuckAccountPriority lists the accounts whose clients are evicted
+	// first in lame duck mode, in that order.
+	LameDuckAccountPriority []string `json:"-"`
+
+	// TLSExpiryThresholds are the days before a certificate expires at
+	// which advisories are sent. Defaults to 30, 7 and 1 days.
+	TLSExpiryThresholds []int `json:"-"`
 
 	// MaxTracedMsgLen is the maximum printable length for traced messages.
 	MaxTracedMsgLen int `json:"-"`
 
+	// ConfigSnapshots is the number of configurations applied on startup
+	// and reload kept for rollback. Negative disables snapshots.
+	ConfigSnapshots int `json:"-"`
+
+	// InactiveClientTimeout closes client connections without subscriptions
+	// that did not publish for that long. Can be overridden per account.
+	InactiveClientTimeout time.Duration `json:"-"`
+
+	// CrashReportDir is where a report is written when the server panics.
+	CrashReportDir string `json:"-"`
+	// SendCrashReports sends the reports found in CrashReportDir to the
+	// system account on startup.
+	SendCrashReports bool `json:"-"`
+
+	// DNSResolver configures how host names of routes, gateways and remote
+	// leafnodes are resolved.
+	DNSResolver DNSResolverOpts `json:"-"`
+
+	// NonceSize is the size, in bytes, of the random nonce challenge sent
+	// to clients and leafnodes signing it with their nkey.
+	NonceSize int `json:"-"`
+	// NonceTTL is how long the nonce challenge can be signed.
+	NonceTTL time.Duration `json:"-"`
+
+	// IPFilters are the allow and deny lists of remote IPs, keyed by
+	// listener: client, websocket or leafnode.
+	IPFilters map[string]*IPFilterOpts `json:"-"`
+
+	// FIPS restricts the server to cryptography approved by FIPS 140-3.
+	// Always enabled when built with a validated crypto module.
+	FIPS bool `json:"-"`
+
+	// UnixSocket is the listener of local clients on a unix domain socket.
+	UnixSocket UnixSocketOpts `json:"-"`
+
+	// NoTLSDowngrade rejects client connections that do not use TLS, or do
+	// not advertise it in their CONNECT, when the server requires TLS.
+	NoTLSDowngrade bool `json:"-"`
+
+	// ConnectionFingerprinting records the client library and network of
+	// authenticated users and sends advisories when they change.
+	ConnectionFingerprinting bool `json:"-"`
+
+	// NoRespondersHints adds the last time and cluster a responder was seen
+	// to the no responders status of requests.
+	NoRespondersHints bool `json:"-"`
+
+	// AuthLockout rejects the attempts of remote IPs and usernames with too
+	// many failed authentications.
+	AuthLockout AuthLockoutOpts `json:"-"`
+
+	// AuthCache caches the verifications of hashed passwords of clients.
+	AuthCache AuthCacheOpts `json:"-"`
+
+	// ResolverCache serves stale account claims while they are refreshed,
+	// and caches validated user JWTs.
+	ResolverCache ResolverCacheOpts `json:"-"`
+
+	// Kafka is the listener of Kafka clients, backed by JetStream.
+	Kafka KafkaOpts `json:"-"`
+
+	// Stomp is the listener of STOMP 1.2 clients.
+	Stomp StompOpts `json:"-"`
+
+	// AMQP is the listener of AMQP 1.0 connections.
+	AMQP AMQPOpts `json:"-"`
+
+	// Redis is the listener of Redis pub/sub clients.
+	Redis RedisOpts `json:"-"`
+
+	// REST is the listener of HTTP publish and request calls.
+	REST RESTOpts `json:"-"`
+
+	// ScatterGather fans requests on $SG.<subject> out to all responders
+	// and gathers their replies in a single response.
+	ScatterGather ScatterGatherOpts `json:"-"`
+
+	// ServiceGraph observes the requests to the services of accounts.
+	ServiceGraph ServiceGraphOpts `json:"-"`
+
+	// Webhooks deliver the messages of streams to HTTP endpoints.
+	Webhooks []*WebhookOpts `json:"-"`
+
+	// Tracing exports the traces of sampled JetStream messages.
+	Tracing TracingOpts `json:"-"`
+
+	// PrometheusWrite accepts Prometheus remote-write requests on the
+	// monitoring port.
+	PrometheusWrite PromWriteOpts `json:"-"`
+
+	// OIDC validates access tokens of an OIDC provider used as auth_token.
+	OIDC OIDCOpts `json:"-"`
+
+	// Kerberos validates Kerberos tickets, carried in SPNEGO tokens used as
+	// auth_token, with the keys of a keytab.
+	Kerberos KerberosOpts `json:"-"`
+
+	// BearerTokenListeners are the listeners bearer token user JWTs are
+	// accepted on, only websocket when nil.
+	BearerTokenListeners []string `json:"-"`
+
+	// TLSAccountMappings map client certificates without a user, with
+	// verify_and_map, to accounts by their attributes.
+	TLSAccountMappings []*TLSAccountMapping `json:"-"`
+	// SPIFFEMappings map client certificates that are SPIFFE SVIDs without
+	// a user, with verify_and_map, to accounts by their SPIFFE ID.
+	SPIFFEMappings []*SPIFFEMapping `json:"-"`
+
+	// Revocations reject and disconnect the clients of revoked users, nkeys
+	// and client certificates.
+	Revocations RevocationOpts `json:"-"`
+
+	// Anonymous binds clients without credentials to a read-only account.
+	Anonymous AnonymousOpts `json:"-"`
+
 	// Operating a trusted NATS server
 	TrustedKeys              []string              `json:"-"`
 	TrustedOperators         []*jwt.OperatorClaims `json:"-"`
@@ -224,8 +382,23 @@ type Options struct {
 	AccountResolverTLSConfig *tls.Config           `json:"-"`
 	resolverPreloads         map[string]string
 
+	// OperatorPolicies hold the policies of trusted operators, by operator
+	// name or public key.
+	OperatorPolicies map[string]*OperatorPolicy `json:"-"`
+
 	CustomClientAuthentication Authentication `json:"-"`
 	CustomRouterAuthentication Authentication `json:"-"`
+	// CustomClientAuthenticationV2 is used instead of the other client
+	// authentication methods, and can not be set along with
+	// CustomClientAuthentication.
+	CustomClientAuthenticationV2 AuthenticationV2 `json:"-"`
+
+	// Signer holds the nkey identity of the server when set.
+	Signer Signer `json:"-"`
+
+	// SignIdentity adds the signed identity of the server to the INFO
+	// sent to clients and leafnodes.
+	SignIdentity bool `json:"-"`
 
 	// CheckConfig configuration file syntax test was successful and exit.
 	CheckConfig bool `json:"-"`
@@ -346,6 +519,16 @@ func (o *Options) Clone() *Options {
 	return clone
 }
 
+// optionsDigest returns a digest of the options that can be marshaled.
+func optionsDigest(o *Options) string {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return _EMPTY_
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
 func deepCopyURLs(urls []*url.URL) []*url.URL {
 	if urls == nil {
 		return nil
@@ -369,6 +552,11 @@ type authorization struct {
 	// Multiple Nkeys/Users
 	nkeys              []*NkeyUser
 	users              []*User
+	usersFile          string
+	tokens             []*TokenUser
+	serverNkeys        []string
+	bcryptMinCost      int
+	bcryptRehash       bool
 	timeout            float64
 	defaultPermissions *Permissions
 }
@@ -379,12 +567,33 @@ type TLSConfigOpts struct {
 	CertFile         string
 	KeyFile          string
 	CaFile           string
+	// Cert, Key and Ca hold PEM content in place of the files, such as
+	// certificates and keys resolved from Vault.
+	Cert             string
+	Key              string
+	Ca               string
 	Verify           bool
 	Insecure         bool
 	Map              bool
 	Timeout          float64
 	Ciphers          []uint16
 	CurvePreferences []tls.CurveID
+
+	// SessionTicketsDisabled disables TLS session resumption.
+	SessionTicketsDisabled bool
+	// SessionTicketRotation is how often the session ticket keys are
+	// rotated, in place of the default rotation of the TLS stack.
+	SessionTicketRotation time.Duration
+
+	// CRLFiles are checked for the revocation of peer certificates.
+	CRLFiles []string
+	// OCSP checks the revocation of peer certificates with the responder,
+	// or else the one of the certificate.
+	OCSP              bool
+	OCSPResponder     string
+	OCSPTimeout       time.Duration
+	OCSPCacheTTL      time.Duration
+	OCSPRequireStatus bool
 }
 
 var tlsUsage = `
@@ -408,6 +617,10 @@ e.g.
             "CurveP384",
             "CurveP521"
         ]
+
+        # Rotate the session ticket keys every hour, or disable
+        # session resumption with session_resumption: false
+        session_ticket_rotation: "1h"
     }
 
 Available cipher suites include:
@@ -528,6 +741,16 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 	if err != nil {
 		return err
 	}
+	// Decrypt the encrypted values, so that the rest of the processing
+	// only sees plaintext values.
+	if err := configureSecrets(m); err != nil {
+		return err
+	}
+	// Likewise for the values referencing secrets of Vault.
+	if err := configureVault(m); err != nil {
+		return err
+	}
+
 	// Collect all errors and warnings and report them all together.
 	errors := make([]error, 0)
 	warnings := make([]error, 0)
@@ -633,6 +856,29 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			// NKeys may have been added from Accounts parsing, so do an append here
 			o.Nkeys = append(o.Nkeys, auth.nkeys...)
 		}
+		if auth.usersFile != "" {
+			if auth.user != "" || auth.token != "" {
+				err := &configErr{tk, "Can not have a single user/pass or a token and a users file"}
+				*errors = append(*errors, err)
+				return
+			}
+			o.UsersFile = auth.usersFile
+		}
+		o.BcryptMinCost = auth.bcryptMinCost
+		o.BcryptRehash = auth.bcryptRehash
+		if auth.serverNkeys != nil {
+			err := &configErr{tk, "Authorization nkeys are only allowed for cluster and gateway"}
+			*errors = append(*errors, err)
+			return
+		}
+		if auth.tokens != nil {
+			if auth.token != "" {
+				err := &configErr{tk, "Can not have a token and a tokens array"}
+				*errors = append(*errors, err)
+				return
+			}
+			o.Tokens = auth.tokens
+		}
 	case "http":
 		hp, err := parseListen(v)
 		if err != nil {
@@ -693,6 +939,10 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		o.PidFile = v.(string)
 	case "ports_file_dir":
 		o.PortsFileDir = v.(string)
+	case "crash_report_dir":
+		o.CrashReportDir = v.(string)
+	case "send_crash_reports":
+		o.SendCrashReports = v.(bool)
 	case "prof_port":
 		o.ProfPort = int(v.(int64))
 	case "max_control_line":
@@ -739,6 +989,12 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		o.AllowNonTLS = v.(bool)
 	case "write_deadline":
 		o.WriteDeadline = parseDuration("write_deadline", tk, v, errors, warnings)
+	case "config_snapshots":
+		o.ConfigSnapshots = int(v.(int64))
+	case "sign_identity":
+		o.SignIdentity = v.(bool)
+	case "inactive_client_timeout":
+		o.InactiveClientTimeout = parseDuration("inactive_client_timeout", tk, v, errors, warnings)
 	case "lame_duck_duration":
 		dur, err := time.ParseDuration(v.(string))
 		if err != nil {
@@ -765,6 +1021,39 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			return
 		}
 		o.LameDuckGracePeriod = dur
+	case "lame_duck_connect_urls":
+		o.LameDuckConnectURLs = parseStringList("lame_duck_connect_urls", tk, v, errors)
+	case "lame_duck_batch_size":
+		o.LameDuckBatchSize = int(v.(int64))
+		if o.LameDuckBatchSize < 0 {
+			err := &configErr{tk, "invalid lame_duck_batch_size, needs to be positive"}
+			*errors = append(*errors, err)
+			return
+		}
+	case "tls_expiry_thresholds":
+		var days []int
+		switch v := v.(type) {
+		case int64:
+			days = append(days, int(v))
+		case []interface{}:
+			for _, mv := range v {
+				tk, mv := unwrapValue(mv, &lt)
+				d, ok := mv.(int64)
+				if !ok || d < 0 {
+					err := &configErr{tk, fmt.Sprintf("error parsing tls_expiry_thresholds: expected positive number of days, got %v", mv)}
+					*errors = append(*errors, err)
+					continue
+				}
+				days = append(days, int(d))
+			}
+		default:
+			err := &configErr{tk, fmt.Sprintf("error parsing tls_expiry_thresholds: unsupported type %T", v)}
+			*errors = append(*errors, err)
+			return
+		}
+		o.TLSExpiryThresholds = days
+	case "lame_duck_account_priority":
+		o.LameDuckAccountPriority = parseStringList("lame_duck_account_priority", tk, v, errors)
 	case "operator", "operators", "roots", "root", "root_operators", "root_operator":
 		opFiles := []string{}
 		switch v := v.(type) {
@@ -772,6 +1061,8 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			opFiles = append(opFiles, v)
 		case []string:
 			opFiles = append(opFiles, v...)
+		case []interface{}:
+			opFiles = append(opFiles, parseStringList(k, tk, v, errors)...)
 		default:
 			err := &configErr{tk, fmt.Sprintf("error parsing operators: unsupported type %T", v)}
 			*errors = append(*errors, err)
@@ -804,37 +1095,16 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		// "resolver" takes precedence over value obtained from "operator".
 		// Clear so that parsing errors are not silently ignored.
 		o.AccountResolver = nil
-		var memResolverRe = regexp.MustCompile(`(MEM|MEMORY|mem|memory)\s*`)
-		var resolverRe = regexp.MustCompile(`(?:URL|url){1}(?:\({1}\s*"?([^\s"]*)"?\s*\){1})?\s*`)
-		str, ok := v.(string)
-		if !ok {
-			err := &configErr{tk, fmt.Sprintf("error parsing operator resolver, wrong type %T", v)}
+		ar, err := parseAccountResolver(tk, v)
+		if err != nil {
 			*errors = append(*errors, err)
 			return
 		}
-		if memResolverRe.MatchString(str) {
-			o.AccountResolver = &MemAccResolver{}
-		} else {
-			items := resolverRe.FindStringSubmatch(str)
-			if len(items) == 2 {
-				url := items[1]
-				_, err := parseURL(url, "account resolver")
-				if err != nil {
-					*errors = append(*errors, &configErr{tk, err.Error()})
-					return
-				}
-				if ur, err := NewURLAccResolver(url); err != nil {
-					err := &configErr{tk, err.Error()}
-					*errors = append(*errors, err)
-					return
-				} else {
-					o.AccountResolver = ur
-				}
-			}
-		}
-		if o.AccountResolver == nil {
-			err := &configErr{tk, "error parsing account resolver, should be MEM or URL(\"url\")"}
+		o.AccountResolver = ar
+	case "operator_policies":
+		if err := parseOperatorPolicies(tk, o, errors, warnings); err != nil {
 			*errors = append(*errors, err)
+			return
 		}
 	case "resolver_tls":
 		tc, err := parseTLS(tk)
@@ -874,10 +1144,21 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		}
 	case "no_auth_user":
 		o.NoAuthUser = v.(string)
+	case "anonymous":
+		if err := parseAnonymous(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
 	case "system_account", "system":
 		// Already processed at the beginning so we just skip them
 		// to not treat them as unknown values.
 		return
+	case "secrets_key_file":
+		// Used when decrypting values at the beginning.
+		return
+	case "vault":
+		// Used when resolving values at the beginning.
+		return
 	case "no_system_account", "no_system", "no_sys_acc":
 		o.NoSystemAccount = v.(bool)
 	case "trusted", "trusted_keys":
@@ -898,62 +1179,1867 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 					continue
 				}
 			}
-			o.TrustedKeys = keys
-		default:
-			err := &configErr{tk, fmt.Sprintf("error parsing trusted: unsupported type %T", v)}
-			*errors = append(*errors, err)
+			o.TrustedKeys = keys
+		default:
+			err := &configErr{tk, fmt.Sprintf("error parsing trusted: unsupported type %T", v)}
+			*errors = append(*errors, err)
+		}
+		// Do a quick sanity check on keys
+		for _, key := range o.TrustedKeys {
+			if !nkeys.IsValidPublicOperatorKey(key) {
+				err := &configErr{tk, fmt.Sprintf("trust key %q required to be a valid public operator nkey", key)}
+				*errors = append(*errors, err)
+			}
+		}
+	case "connect_error_reports":
+		o.ConnectErrorReports = int(v.(int64))
+	case "reconnect_error_reports":
+		o.ReconnectErrorReports = int(v.(int64))
+	case "websocket", "ws":
+		if err := parseWebsocket(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "ip_filters":
+		lm, ok := v.(map[string]interface{})
+		if !ok {
+			err := &configErr{tk, fmt.Sprintf("Expected ip_filters to be a map, got %T", v)}
+			*errors = append(*errors, err)
+			return
+		}
+		o.IPFilters = make(map[string]*IPFilterOpts, len(lm))
+		for listener, fv := range lm {
+			if f := parseIPFilter(fv, errors); f != nil {
+				o.IPFilters[strings.ToLower(listener)] = f
+			}
+		}
+	case "nonce_size":
+		size := int(v.(int64))
+		if size < nonceRawLen || size > nonceMaxRawLen {
+			err := &configErr{tk, fmt.Sprintf("nonce_size should be between %d and %d bytes", nonceRawLen, nonceMaxRawLen)}
+			*errors = append(*errors, err)
+			return
+		}
+		o.NonceSize = size
+	case "nonce_ttl":
+		o.NonceTTL = parseDuration("nonce_ttl", tk, v, errors, warnings)
+	case "fips":
+		o.FIPS = v.(bool)
+	case "no_tls_downgrade":
+		o.NoTLSDowngrade = v.(bool)
+	case "connection_fingerprinting":
+		o.ConnectionFingerprinting = v.(bool)
+	case "no_responders_hints":
+		o.NoRespondersHints = v.(bool)
+	case "bearer_token_listeners":
+		o.BearerTokenListeners = []string{}
+		for _, l := range parseStringList("bearer_token_listeners", tk, v, errors) {
+			o.BearerTokenListeners = append(o.BearerTokenListeners, strings.ToLower(l))
+		}
+	case "tls_map_order":
+		o.TLSMapOrder = nil
+		for _, f := range parseStringList("tls_map_order", tk, v, errors) {
+			o.TLSMapOrder = append(o.TLSMapOrder, strings.ToLower(f))
+		}
+	case "unix_socket":
+		if err := parseUnixSocket(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "kafka":
+		if err := parseKafka(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "stomp":
+		if err := parseStomp(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "amqp":
+		if err := parseAMQP(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "redis":
+		if err := parseRedis(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "rest":
+		if err := parseREST(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "scatter_gather":
+		if err := parseScatterGather(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "service_graph":
+		if err := parseServiceGraph(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "webhooks":
+		if err := parseWebhooks(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "tracing":
+		if err := parseTracing(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "prometheus_write", "prometheus_remote_write":
+		if err := parsePromWrite(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "oidc":
+		if err := parseOIDC(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "kerberos":
+		if err := parseKerberos(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "tls_account_map", "tls_account_mappings":
+		ma, ok := v.([]interface{})
+		if !ok {
+			err := &configErr{tk, fmt.Sprintf("Expected tls account mappings to be an array, got %T", v)}
+			*errors = append(*errors, err)
+			return
+		}
+		for _, e := range ma {
+			if m := parseTLSAccountMapping(e, errors, warnings); m != nil {
+				o.TLSAccountMappings = append(o.TLSAccountMappings, m)
+			}
+		}
+	case "spiffe_map", "spiffe_mappings":
+		ma, ok := v.([]interface{})
+		if !ok {
+			err := &configErr{tk, fmt.Sprintf("Expected spiffe mappings to be an array, got %T", v)}
+			*errors = append(*errors, err)
+			return
+		}
+		for _, e := range ma {
+			if m := parseSPIFFEMapping(e, errors, warnings); m != nil {
+				o.SPIFFEMappings = append(o.SPIFFEMappings, m)
+			}
+		}
+	case "revocations":
+		if err := parseRevocations(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "auth_cache":
+		if err := parseAuthCache(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "resolver_cache":
+		if err := parseResolverCache(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "auth_lockout":
+		if err := parseAuthLockout(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "dns_resolver", "dns":
+		if err := parseDNSResolver(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	default:
+		if au := atomic.LoadInt32(&allowUnknownTopLevelField); au == 0 && !tk.IsUsedVariable() {
+			err := &unknownConfigFieldErr{
+				field: k,
+				configErr: configErr{
+					token: tk,
+				},
+			}
+			*errors = append(*errors, err)
+		}
+	}
+}
+
+func parseDuration(field string, tk token, v interface{}, errors *[]error, warnings *[]error) time.Duration {
+	if wd, ok := v.(string); ok {
+		if dur, err := time.ParseDuration(wd); err != nil {
+			err := &configErr{tk, fmt.Sprintf("error parsing %s: %v", field, err)}
+			*errors = append(*errors, err)
+			return 0
+		} else {
+			return dur
+		}
+	} else {
+		// Backward compatible with old type, assume this is the
+		// number of seconds.
+		err := &configWarningErr{
+			field: field,
+			configErr: configErr{
+				token:  tk,
+				reason: field + " should be converted to a duration",
+			},
+		}
+		*warnings = append(*warnings, err)
+		return time.Duration(v.(int64)) * time.Second
+	}
+}
+
+// parseTime parses a datetime, or a string in RFC3339 format.
+func parseTime(field string, tk token, v interface{}, errors *[]error) time.Time {
+	switch v := v.(type) {
+	case time.Time:
+		return v
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			*errors = append(*errors, &configErr{tk, fmt.Sprintf("error parsing %s: %v", field, err)})
+		}
+		return t
+	}
+	*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected %s to be a datetime, got %T", field, v)})
+	return time.Time{}
+}
+
+// parseStringList parses a single string or an array of strings.
+func parseStringList(field string, tk token, v interface{}, errors *[]error) []string {
+	var lt token
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, mv := range v {
+			tk, mv := unwrapValue(mv, &lt)
+			if s, ok := mv.(string); ok {
+				list = append(list, s)
+			} else {
+				err := &configErr{tk, fmt.Sprintf("error parsing %s: unsupported type in array %T", field, mv)}
+				*errors = append(*errors, err)
+			}
+		}
+		return list
+	default:
+		err := &configErr{tk, fmt.Sprintf("error parsing %s: unsupported type %T", field, v)}
+		*errors = append(*errors, err)
+		return nil
+	}
+}
+
+// parseIPFilter parses a map of allow and deny lists of IPs or CIDRs.
+func parseIPFilter(v interface{}, errors *[]error) *IPFilterOpts {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	fm, ok := v.(map[string]interface{})
+	if !ok {
+		*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected ip filter to be a map, got %T", v)})
+		return nil
+	}
+	f := &IPFilterOpts{}
+	for mk, mv := range fm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "allow":
+			f.Allow = parseStringList("ip filter allow", tk, mv, errors)
+		case "deny":
+			f.Deny = parseStringList("ip filter deny", tk, mv, errors)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if err := f.compile(); err != nil {
+		*errors = append(*errors, &configErr{tk, fmt.Sprintf("error parsing ip filter: %v", err)})
+		return nil
+	}
+	return f
+}
+
+// parseMsgSigning parses the subjects of an account requiring signed
+// messages, and whether invalid messages are dropped or annotated.
+func parseMsgSigning(v interface{}, errors *[]error) *MsgSigningOpts {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mm, ok := v.(map[string]interface{})
+	if !ok {
+		*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected message signing to be a map, got %T", v)})
+		return nil
+	}
+	ms := &MsgSigningOpts{}
+	for mk, mv := range mm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "subjects":
+			ms.Subjects = parseStringList("message signing subjects", tk, mv, errors)
+			for _, subj := range ms.Subjects {
+				if !IsValidSubject(subj) {
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("invalid message signing subject %q", subj)})
+				}
+			}
+		case "invalid":
+			switch strings.ToLower(mv.(string)) {
+			case "drop":
+				ms.Annotate = false
+			case "annotate":
+				ms.Annotate = true
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("invalid message signing mode %q, expected drop or annotate", mv)})
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if len(ms.Subjects) == 0 {
+		*errors = append(*errors, &configErr{tk, "message signing requires subjects"})
+		return nil
+	}
+	return ms
+}
+
+// parseCloudEvents parses the subjects of an account carrying CloudEvents,
+// the content mode they are converted to and whether invalid events are
+// rejected.
+func parseCloudEvents(v interface{}, errors *[]error) *CloudEventsOpts {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	cm, ok := v.(map[string]interface{})
+	if !ok {
+		*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected cloudevents to be a map, got %T", v)})
+		return nil
+	}
+	ce := &CloudEventsOpts{}
+	for mk, mv := range cm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "subjects":
+			ce.Subjects = parseStringList("cloudevents subjects", tk, mv, errors)
+			for _, subj := range ce.Subjects {
+				if !IsValidSubject(subj) {
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("invalid cloudevents subject %q", subj)})
+				}
+			}
+		case "mode":
+			switch mode := strings.ToLower(mv.(string)); mode {
+			case CloudEventsBinary, CloudEventsStructured:
+				ce.Mode = mode
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("invalid cloudevents mode %q, expected binary or structured", mv)})
+			}
+		case "source":
+			ce.Source = mv.(string)
+		case "reject":
+			ce.Reject = mv.(bool)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if len(ce.Subjects) == 0 {
+		*errors = append(*errors, &configErr{tk, "cloudevents requires subjects"})
+		return nil
+	}
+	return ce
+}
+
+// parsePresence parses the subject patterns of an account tracked for
+// presence and the interval their changes are debounced for.
+func parsePresence(v interface{}, errors, warnings *[]error) *PresenceOpts {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	pm, ok := v.(map[string]interface{})
+	if !ok {
+		*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected presence to be a map, got %T", v)})
+		return nil
+	}
+	po := &PresenceOpts{Debounce: DEFAULT_PRESENCE_DEBOUNCE}
+	for mk, mv := range pm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "subjects":
+			po.Subjects = parseStringList("presence subjects", tk, mv, errors)
+			for _, subj := range po.Subjects {
+				if !IsValidSubject(subj) {
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("invalid presence subject %q", subj)})
+				}
+			}
+		case "debounce":
+			po.Debounce = parseDuration("presence debounce", tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if len(po.Subjects) == 0 {
+		*errors = append(*errors, &configErr{tk, "presence requires subjects"})
+		return nil
+	}
+	return po
+}
+
+// parseQueueGroups parses the weights of the members of queue groups, by
+// queue name.
+func parseQueueGroups(v interface{}, errors *[]error) map[string]*QueueGroupOpts {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	gm, ok := v.(map[string]interface{})
+	if !ok {
+		*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected queue groups to be a map, got %T", v)})
+		return nil
+	}
+	qgs := make(map[string]*QueueGroupOpts, len(gm))
+	for queue, gv := range gm {
+		tk, gv := unwrapValue(gv, &lt)
+		qm, ok := gv.(map[string]interface{})
+		if !ok {
+			*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected queue group %q to be a map, got %T", queue, gv)})
+			continue
+		}
+		qg := &QueueGroupOpts{DefaultWeight: queueGroupDefaultWeight}
+		for mk, mv := range qm {
+			tk, mv := unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "weights":
+				wm, ok := mv.(map[string]interface{})
+				if !ok {
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected queue group weights to be a map, got %T", mv)})
+					continue
+				}
+				qg.Weights = make(map[string]int, len(wm))
+				for user, wv := range wm {
+					wtk, wv := unwrapValue(wv, &lt)
+					w := int(wv.(int64))
+					if w < 0 {
+						*errors = append(*errors, &configErr{wtk, fmt.Sprintf("queue group weight of %q can not be negative", user)})
+						continue
+					}
+					qg.Weights[user] = w
+				}
+			case "default_weight":
+				qg.DefaultWeight = int(mv.(int64))
+				if qg.DefaultWeight < 0 {
+					*errors = append(*errors, &configErr{tk, "queue group default weight can not be negative"})
+				}
+			case "sticky":
+				qg.Sticky = mv.(bool)
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		qgs[queue] = qg
+	}
+	return qgs
+}
+
+// parseSubjectQuota parses the limits on the number of distinct subjects
+// the clients of an account can subscribe and publish to over a window.
+func parseSubjectQuota(v interface{}, errors, warnings *[]error) *SubjectQuotaOpts {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	qm, ok := v.(map[string]interface{})
+	if !ok {
+		*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected subject quota to be a map, got %T", v)})
+		return nil
+	}
+	sq := &SubjectQuotaOpts{Window: DEFAULT_SUBJECT_QUOTA_WINDOW, Warn: DEFAULT_SUBJECT_QUOTA_WARN}
+	for mk, mv := range qm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "max_interest", "max_subscribe_subjects":
+			sq.MaxInterest = int(mv.(int64))
+		case "max_publish", "max_publish_subjects":
+			sq.MaxPublish = int(mv.(int64))
+		case "window":
+			sq.Window = parseDuration("subject quota window", tk, mv, errors, warnings)
+		case "warn", "warn_percent":
+			sq.Warn = int(mv.(int64))
+			if sq.Warn < 0 || sq.Warn > 100 {
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("invalid subject quota warn percentage %d", sq.Warn)})
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if sq.MaxInterest <= 0 && sq.MaxPublish <= 0 {
+		*errors = append(*errors, &configErr{tk, "subject quota requires max_interest or max_publish"})
+		return nil
+	}
+	return sq
+}
+
+// parseSchemas parses the schemas of an account, the subjects they are
+// bound to and whether non-conforming messages are dropped or annotated.
+func parseSchemas(v interface{}, errors *[]error) *SchemaOpts {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	sm, ok := v.(map[string]interface{})
+	if !ok {
+		*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected schemas to be a map, got %T", v)})
+		return nil
+	}
+	so := &SchemaOpts{Schemas: make(map[string]*Schema)}
+	var bindings map[string]interface{}
+	var btk token
+	for mk, mv := range sm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "definitions":
+			dm, ok := mv.(map[string]interface{})
+			if !ok {
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected schema definitions to be a map, got %T", mv)})
+				continue
+			}
+			for name, dv := range dm {
+				dtk, dv := unwrapValue(dv, &lt)
+				fm, ok := dv.(map[string]interface{})
+				if !ok {
+					*errors = append(*errors, &configErr{dtk, fmt.Sprintf("Expected schema %q to be a map, got %T", name, dv)})
+					continue
+				}
+				var format, def string
+				for fk, fv := range fm {
+					ftk, fv := unwrapValue(fv, &lt)
+					switch strings.ToLower(fk) {
+					case "format":
+						format = fv.(string)
+					case "definition":
+						def = fv.(string)
+					default:
+						if !ftk.IsUsedVariable() {
+							err := &unknownConfigFieldErr{
+								field: fk,
+								configErr: configErr{
+									token: ftk,
+								},
+							}
+							*errors = append(*errors, err)
+						}
+					}
+				}
+				sc, err := NewSchema(name, format, def)
+				if err != nil {
+					*errors = append(*errors, &configErr{dtk, err.Error()})
+					continue
+				}
+				so.Schemas[name] = sc
+			}
+		case "bindings":
+			if bindings, ok = mv.(map[string]interface{}); !ok {
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected schema bindings to be a map, got %T", mv)})
+			}
+			btk = tk
+		case "invalid":
+			switch strings.ToLower(mv.(string)) {
+			case "drop":
+				so.Annotate = false
+			case "annotate":
+				so.Annotate = true
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("invalid schemas mode %q, expected drop or annotate", mv)})
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	// Bindings are checked once all schemas are known.
+	for subj, bv := range bindings {
+		tk, bv := unwrapValue(bv, &lt)
+		if !IsValidSubject(subj) {
+			*errors = append(*errors, &configErr{tk, fmt.Sprintf("invalid schema binding subject %q", subj)})
+			continue
+		}
+		for _, name := range parseStringList("schema bindings", tk, bv, errors) {
+			if so.Schemas[name] == nil {
+				*errors = append(*errors, &configErr{btk, fmt.Sprintf("unknown schema %q bound to %q", name, subj)})
+				continue
+			}
+			so.Bindings = append(so.Bindings, &SchemaBinding{Subject: subj, Schema: name})
+		}
+	}
+	so.sortBindings()
+	return so
+}
+
+// parseKafka parses the Kafka listener.
+func parseKafka(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	km, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected kafka to be a map, got %T", v)}
+	}
+	for mk, mv := range km {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				err := &configErr{tk, err.Error()}
+				*errors = append(*errors, err)
+				continue
+			}
+			o.Kafka.Host = hp.host
+			o.Kafka.Port = hp.port
+		case "port":
+			o.Kafka.Port = int(mv.(int64))
+		case "host", "net":
+			o.Kafka.Host = mv.(string)
+		case "advertise":
+			o.Kafka.Advertise = mv.(string)
+		case "account":
+			o.Kafka.Account = mv.(string)
+		case "auto_create_topics":
+			o.Kafka.AutoCreateTopics = mv.(bool)
+		case "tls":
+			tc, err := parseTLS(tk)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			if o.Kafka.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				err := &configErr{tk, err.Error()}
+				*errors = append(*errors, err)
+				continue
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseStomp parses the STOMP listener.
+func parseStomp(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	sm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected stomp to be a map, got %T", v)}
+	}
+	for mk, mv := range sm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				err := &configErr{tk, err.Error()}
+				*errors = append(*errors, err)
+				continue
+			}
+			o.Stomp.Host = hp.host
+			o.Stomp.Port = hp.port
+		case "port":
+			o.Stomp.Port = int(mv.(int64))
+		case "host", "net":
+			o.Stomp.Host = mv.(string)
+		case "no_auth_user":
+			o.Stomp.NoAuthUser = mv.(string)
+		case "tls":
+			tc, err := parseTLS(tk)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			if o.Stomp.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				err := &configErr{tk, err.Error()}
+				*errors = append(*errors, err)
+				continue
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseAMQP parses the AMQP listener.
+func parseAMQP(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	am, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected amqp to be a map, got %T", v)}
+	}
+	for mk, mv := range am {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				err := &configErr{tk, err.Error()}
+				*errors = append(*errors, err)
+				continue
+			}
+			o.AMQP.Host = hp.host
+			o.AMQP.Port = hp.port
+		case "port":
+			o.AMQP.Port = int(mv.(int64))
+		case "host", "net":
+			o.AMQP.Host = mv.(string)
+		case "no_auth_user":
+			o.AMQP.NoAuthUser = mv.(string)
+		case "tls":
+			tc, err := parseTLS(tk)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			if o.AMQP.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				err := &configErr{tk, err.Error()}
+				*errors = append(*errors, err)
+				continue
+			}
+		case "addresses":
+			m, ok := mv.(map[string]interface{})
+			if !ok {
+				err := &configErr{tk, fmt.Sprintf("Expected addresses to be a map, got %T", mv)}
+				*errors = append(*errors, err)
+				continue
+			}
+			o.AMQP.Addresses = make(map[string]string, len(m))
+			for address, sv := range m {
+				_, sv = unwrapValue(sv, &lt)
+				subject, ok := sv.(string)
+				if !ok {
+					err := &configErr{tk, fmt.Sprintf("Expected subject of address %q to be a string, got %T", address, sv)}
+					*errors = append(*errors, err)
+					continue
+				}
+				o.AMQP.Addresses[address] = subject
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseRedis parses the Redis listener.
+func parseRedis(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	sm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected redis to be a map, got %T", v)}
+	}
+	for mk, mv := range sm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				err := &configErr{tk, err.Error()}
+				*errors = append(*errors, err)
+				continue
+			}
+			o.Redis.Host = hp.host
+			o.Redis.Port = hp.port
+		case "port":
+			o.Redis.Port = int(mv.(int64))
+		case "host", "net":
+			o.Redis.Host = mv.(string)
+		case "no_auth_user":
+			o.Redis.NoAuthUser = mv.(string)
+		case "tls":
+			tc, err := parseTLS(tk)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			if o.Redis.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				err := &configErr{tk, err.Error()}
+				*errors = append(*errors, err)
+				continue
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseScatterGather parses the scatter-gather options, enabled by a map
+// or a boolean.
+func parseScatterGather(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	if b, ok := v.(bool); ok {
+		o.ScatterGather.Enabled = b
+		return nil
+	}
+	sm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected scatter_gather to be a map or a boolean, got %T", v)}
+	}
+	o.ScatterGather.Enabled = true
+	for mk, mv := range sm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "enabled":
+			o.ScatterGather.Enabled = mv.(bool)
+		case "timeout":
+			o.ScatterGather.Timeout = parseDuration("scatter_gather timeout", tk, mv, errors, warnings)
+		case "max_timeout":
+			o.ScatterGather.MaxTimeout = parseDuration("scatter_gather max_timeout", tk, mv, errors, warnings)
+		case "max_replies":
+			o.ScatterGather.MaxReplies = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseServiceGraph parses the service graph options, enabled by a map or
+// a boolean.
+func parseServiceGraph(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	if b, ok := v.(bool); ok {
+		o.ServiceGraph.Enabled = b
+		return nil
+	}
+	sm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected service_graph to be a map or a boolean, got %T", v)}
+	}
+	o.ServiceGraph.Enabled = true
+	for mk, mv := range sm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "enabled":
+			o.ServiceGraph.Enabled = mv.(bool)
+		case "interval":
+			o.ServiceGraph.Interval = parseDuration("service_graph interval", tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseTracing parses the export of the traces of JetStream messages.
+func parseTracing(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	tm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected tracing to be a map, got %T", v)}
+	}
+	for mk, mv := range tm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "otlp_endpoint", "endpoint":
+			o.Tracing.Endpoint = mv.(string)
+		case "service_name":
+			o.Tracing.ServiceName = mv.(string)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseREST parses the HTTP publish and request listener.
+func parseREST(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	rm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected rest to be a map, got %T", v)}
+	}
+	for mk, mv := range rm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				err := &configErr{tk, err.Error()}
+				*errors = append(*errors, err)
+				continue
+			}
+			o.REST.Host = hp.host
+			o.REST.Port = hp.port
+		case "port":
+			o.REST.Port = int(mv.(int64))
+		case "host", "net":
+			o.REST.Host = mv.(string)
+		case "max_timeout":
+			o.REST.MaxTimeout = parseDuration("max_timeout", tk, mv, errors, warnings)
+		case "tls":
+			tc, err := parseTLS(tk)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			if o.REST.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				err := &configErr{tk, err.Error()}
+				*errors = append(*errors, err)
+				continue
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseWebhooks parses the webhooks delivering messages of streams.
+func parseWebhooks(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	wa, ok := v.([]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected webhooks to be an array, got %T", v)}
+	}
+	for _, w := range wa {
+		tk, w = unwrapValue(w, &lt)
+		wm, ok := w.(map[string]interface{})
+		if !ok {
+			*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected webhook entry to be a map/struct, got %v", w)})
+			continue
+		}
+		wo := &WebhookOpts{}
+		for mk, mv := range wm {
+			tk, mv = unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "name":
+				wo.Name = mv.(string)
+			case "account":
+				wo.Account = mv.(string)
+			case "stream":
+				wo.Stream = mv.(string)
+			case "filter_subject", "subject":
+				wo.FilterSubject = mv.(string)
+			case "url":
+				wo.URL = mv.(string)
+			case "secret":
+				wo.Secret = mv.(string)
+			case "headers":
+				hm, ok := mv.(map[string]interface{})
+				if !ok {
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected webhook headers to be a map, got %T", mv)})
+					continue
+				}
+				wo.Headers = make(map[string]string, len(hm))
+				for hk, hv := range hm {
+					_, hv = unwrapValue(hv, &lt)
+					wo.Headers[hk] = hv.(string)
+				}
+			case "timeout":
+				wo.Timeout = parseDuration("timeout", tk, mv, errors, warnings)
+			case "max_retries":
+				wo.MaxRetries = int(mv.(int64))
+			case "retry_backoff":
+				wo.RetryBackoff = parseDuration("retry_backoff", tk, mv, errors, warnings)
+			case "rate_limit":
+				switch mv := mv.(type) {
+				case int64:
+					wo.RateLimit = float64(mv)
+				case float64:
+					wo.RateLimit = mv
+				default:
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected webhook rate_limit to be a number, got %T", mv)})
+				}
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		o.Webhooks = append(o.Webhooks, wo)
+	}
+	return nil
+}
+
+// parsePromWrite parses the Prometheus remote-write endpoint.
+func parsePromWrite(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	pm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected prometheus_write to be a map, got %T", v)}
+	}
+	for mk, mv := range pm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "subject":
+			o.PrometheusWrite.Subject = mv.(string)
+		case "path":
+			o.PrometheusWrite.Path = mv.(string)
+		case "account":
+			o.PrometheusWrite.Account = mv.(string)
+		case "stream":
+			o.PrometheusWrite.Stream = mv.(string)
+		case "token":
+			o.PrometheusWrite.Token = mv.(string)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseOIDC parses the validation of OIDC access tokens.
+func parseOIDC(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	om, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected oidc to be a map, got %T", v)}
+	}
+	for mk, mv := range om {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "issuer":
+			o.OIDC.Issuer = mv.(string)
+		case "jwks_url", "jwks_uri":
+			o.OIDC.JWKSURL = mv.(string)
+		case "audience", "aud":
+			switch av := mv.(type) {
+			case string:
+				o.OIDC.Audience = []string{av}
+			case []interface{}:
+				for _, a := range av {
+					_, a = unwrapValue(a, &lt)
+					o.OIDC.Audience = append(o.OIDC.Audience, a.(string))
+				}
+			default:
+				err := &configErr{tk, fmt.Sprintf("Expected audience to be a string or an array, got %T", mv)}
+				*errors = append(*errors, err)
+			}
+		case "groups_claim":
+			o.OIDC.GroupsClaim = mv.(string)
+		case "refresh", "refresh_interval":
+			o.OIDC.RefreshInterval = parseDuration(mk, tk, mv, errors, warnings)
+		case "mappings":
+			ma, ok := mv.([]interface{})
+			if !ok {
+				err := &configErr{tk, fmt.Sprintf("Expected mappings to be an array, got %T", mv)}
+				*errors = append(*errors, err)
+				continue
+			}
+			for _, e := range ma {
+				if m := parseOIDCMapping(e, errors, warnings); m != nil {
+					o.OIDC.Mappings = append(o.OIDC.Mappings, m)
+				}
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseOIDCMapping parses a mapping of OIDC tokens to an account and
+// permissions.
+func parseOIDCMapping(v interface{}, errors *[]error, warnings *[]error) *OIDCMapping {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mm, ok := v.(map[string]interface{})
+	if !ok {
+		*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected mapping to be a map, got %T", v)})
+		return nil
+	}
+	m := &OIDCMapping{}
+	for mk, mv := range mm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "audience", "aud":
+			m.Audience = mv.(string)
+		case "group":
+			m.Group = mv.(string)
+		case "account":
+			m.Account = mv.(string)
+		case "permissions":
+			perms, err := parseUserPermissions(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			m.Permissions = perms
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return m
+}
+
+// parseAccountResolver parses an account resolver, MEM or URL("url").
+func parseAccountResolver(tk token, v interface{}) (AccountResolver, error) {
+	var memResolverRe = regexp.MustCompile(`(MEM|MEMORY|mem|memory)\s*`)
+	var resolverRe = regexp.MustCompile(`(?:URL|url){1}(?:\({1}\s*"?([^\s"]*)"?\s*\){1})?\s*`)
+	str, ok := v.(string)
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("error parsing operator resolver, wrong type %T", v)}
+	}
+	if memResolverRe.MatchString(str) {
+		return &MemAccResolver{}, nil
+	}
+	items := resolverRe.FindStringSubmatch(str)
+	if len(items) == 2 {
+		url := items[1]
+		_, err := parseURL(url, "account resolver")
+		if err != nil {
+			return nil, &configErr{tk, err.Error()}
+		}
+		ur, err := NewURLAccResolver(url)
+		if err != nil {
+			return nil, &configErr{tk, err.Error()}
+		}
+		return ur, nil
+	}
+	return nil, &configErr{tk, "error parsing account resolver, should be MEM or URL(\"url\")"}
+}
+
+// parseOperatorPolicies parses the policies of trusted operators, by
+// operator name or public key.
+func parseOperatorPolicies(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	pm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected operator_policies to be a map, got %T", v)}
+	}
+	o.OperatorPolicies = make(map[string]*OperatorPolicy, len(pm))
+	for name, pv := range pm {
+		tk, pv := unwrapValue(pv, &lt)
+		mm, ok := pv.(map[string]interface{})
+		if !ok {
+			*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected operator policy to be a map, got %T", pv)})
+			continue
+		}
+		p := &OperatorPolicy{}
+		for mk, mv := range mm {
+			tk, mv = unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "resolver", "account_resolver":
+				ar, err := parseAccountResolver(tk, mv)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+				p.AccountResolver = ar
+			case "system_account", "system":
+				p.SystemAccount = mv.(string)
+			case "max_accounts":
+				p.MaxAccounts = int(mv.(int64))
+			case "max_connections", "max_conn":
+				p.MaxConnections = int(mv.(int64))
+			case "allowed_accounts", "accounts":
+				p.AllowedAccounts = parseStringList(mk, tk, mv, errors)
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		o.OperatorPolicies[name] = p
+	}
+	return nil
+}
+
+// parseKerberos parses the validation of Kerberos tickets.
+func parseKerberos(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	km, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected kerberos to be a map, got %T", v)}
+	}
+	for mk, mv := range km {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "keytab":
+			o.Kerberos.Keytab = mv.(string)
+		case "service_principal", "principal":
+			o.Kerberos.ServicePrincipal = mv.(string)
+		case "clock_skew":
+			o.Kerberos.ClockSkew = parseDuration(mk, tk, mv, errors, warnings)
+		case "mappings":
+			ma, ok := mv.([]interface{})
+			if !ok {
+				err := &configErr{tk, fmt.Sprintf("Expected mappings to be an array, got %T", mv)}
+				*errors = append(*errors, err)
+				continue
+			}
+			for _, e := range ma {
+				if m := parseKerberosMapping(e, errors, warnings); m != nil {
+					o.Kerberos.Mappings = append(o.Kerberos.Mappings, m)
+				}
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseKerberosMapping parses a mapping of Kerberos principals to an
+// account and permissions.
+func parseKerberosMapping(v interface{}, errors *[]error, warnings *[]error) *KerberosMapping {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mm, ok := v.(map[string]interface{})
+	if !ok {
+		*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected mapping to be a map, got %T", v)})
+		return nil
+	}
+	m := &KerberosMapping{}
+	for mk, mv := range mm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "principal":
+			m.Principal = mv.(string)
+		case "account":
+			m.Account = mv.(string)
+		case "permissions":
+			perms, err := parseUserPermissions(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			m.Permissions = perms
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if m.Principal == _EMPTY_ {
+		*errors = append(*errors, &configErr{tk, "Kerberos mapping requires a principal"})
+		return nil
+	}
+	return m
+}
+
+// parseTLSAccountMapping parses a mapping of client certificates to an
+// account and permissions.
+func parseTLSAccountMapping(v interface{}, errors *[]error, warnings *[]error) *TLSAccountMapping {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mm, ok := v.(map[string]interface{})
+	if !ok {
+		*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected mapping to be a map, got %T", v)})
+		return nil
+	}
+	m := &TLSAccountMapping{}
+	for mk, mv := range mm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "ou":
+			m.OrgUnit = mv.(string)
+		case "san_uri", "uri":
+			m.URIPattern = mv.(string)
+		case "account":
+			m.Account = mv.(string)
+		case "permissions":
+			perms, err := parseUserPermissions(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			m.Permissions = perms
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if m.Account == _EMPTY_ {
+		*errors = append(*errors, &configErr{tk, "TLS account mapping requires an account"})
+		return nil
+	}
+	return m
+}
+
+// parseSPIFFEMapping parses a mapping of SPIFFE IDs to an account and
+// permissions.
+func parseSPIFFEMapping(v interface{}, errors *[]error, warnings *[]error) *SPIFFEMapping {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mm, ok := v.(map[string]interface{})
+	if !ok {
+		*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected mapping to be a map, got %T", v)})
+		return nil
+	}
+	m := &SPIFFEMapping{}
+	for mk, mv := range mm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "id", "spiffe_id":
+			m.IDPattern = mv.(string)
+		case "account":
+			m.Account = mv.(string)
+		case "permissions":
+			perms, err := parseUserPermissions(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			m.Permissions = perms
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if m.IDPattern == _EMPTY_ || m.Account == _EMPTY_ {
+		*errors = append(*errors, &configErr{tk, "SPIFFE mapping requires an id and an account"})
+		return nil
+	}
+	return m
+}
+
+// parseUnixSocket parses the unix socket listener, either its path or
+// a map of path, mode and no_auth_user.
+func parseUnixSocket(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	switch v := v.(type) {
+	case string:
+		o.UnixSocket.Path = v
+		return nil
+	case map[string]interface{}:
+		for mk, mv := range v {
+			tk, mv = unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "path":
+				o.UnixSocket.Path = mv.(string)
+			case "mode":
+				var mode uint64
+				var err error
+				switch mv := mv.(type) {
+				case string:
+					mode, err = strconv.ParseUint(mv, 8, 32)
+				case int64:
+					// Octal digits written as a number, e.g. 660.
+					mode, err = strconv.ParseUint(strconv.FormatInt(mv, 10), 8, 32)
+				default:
+					err = fmt.Errorf("unsupported type %T", mv)
+				}
+				if err == nil && mode&^uint64(os.ModePerm) != 0 {
+					err = fmt.Errorf("%o is not a permission mode", mode)
+				}
+				if err != nil {
+					err := &configErr{tk, fmt.Sprintf("error parsing unix socket mode: %v", err)}
+					*errors = append(*errors, err)
+					continue
+				}
+				o.UnixSocket.Mode = os.FileMode(mode)
+			case "no_auth_user":
+				o.UnixSocket.NoAuthUser = mv.(string)
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		return nil
+	default:
+		return &configErr{tk, fmt.Sprintf("Expected unix socket to be a path or a map, got %T", v)}
+	}
+}
+
+// parseDNSResolver parses the dns resolver block, a map of servers, pinned
+// parseAuthCache parses the cache of password verifications.
+func parseAuthCache(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	cm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected auth_cache to be a map, got %T", v)}
+	}
+	for mk, mv := range cm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "ttl":
+			o.AuthCache.TTL = parseDuration("auth_cache ttl", tk, mv, errors, warnings)
+		case "max_entries":
+			o.AuthCache.MaxEntries = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseResolverCache parses the cache of account claims and user JWTs,
+// enabled by a map or a boolean.
+func parseResolverCache(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	if b, ok := v.(bool); ok {
+		o.ResolverCache.Enabled = b
+		return nil
+	}
+	cm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected resolver_cache to be a map or a boolean, got %T", v)}
+	}
+	o.ResolverCache.Enabled = true
+	for mk, mv := range cm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "enabled":
+			o.ResolverCache.Enabled = mv.(bool)
+		case "ttl":
+			o.ResolverCache.TTL = parseDuration("resolver_cache ttl", tk, mv, errors, warnings)
+		case "max_stale":
+			o.ResolverCache.MaxStale = parseDuration("resolver_cache max_stale", tk, mv, errors, warnings)
+		case "max_user_jwts":
+			o.ResolverCache.MaxUserJWTs = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseAuthLockout parses the lockout of failed authentication attempts.
+func parseAuthLockout(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	lm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected auth_lockout to be a map, got %T", v)}
+	}
+	for mk, mv := range lm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "max_failures":
+			o.AuthLockout.MaxFailures = int(mv.(int64))
+		case "window":
+			o.AuthLockout.Window = parseDuration("auth_lockout window", tk, mv, errors, warnings)
+		case "duration":
+			o.AuthLockout.Duration = parseDuration("auth_lockout duration", tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseAnonymous parses the account and subscribe subjects of anonymous
+// clients.
+func parseAnonymous(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	am, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected anonymous to be a map, got %T", v)}
+	}
+	for mk, mv := range am {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "account":
+			o.Anonymous.Account = mv.(string)
+		case "subscribe":
+			o.Anonymous.Subscribe = parseStringList("anonymous subscribe", tk, mv, errors)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
 		}
-		// Do a quick sanity check on keys
-		for _, key := range o.TrustedKeys {
-			if !nkeys.IsValidPublicOperatorKey(key) {
-				err := &configErr{tk, fmt.Sprintf("trust key %q required to be a valid public operator nkey", key)}
+	}
+	return nil
+}
+
+// parseRevocations parses the revoked users, nkeys and certificate
+// fingerprints, each mapped to the time its revocation takes effect.
+func parseRevocations(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	rm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected revocations to be a map, got %T", v)}
+	}
+	for mk, mv := range rm {
+		tk, mv = unwrapValue(mv, &lt)
+		var m *map[string]time.Time
+		switch strings.ToLower(mk) {
+		case "users":
+			m = &o.Revocations.Users
+		case "nkeys":
+			m = &o.Revocations.Nkeys
+		case "cert_fingerprints":
+			m = &o.Revocations.CertFingerprints
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
 				*errors = append(*errors, err)
 			}
+			continue
 		}
-	case "connect_error_reports":
-		o.ConnectErrorReports = int(v.(int64))
-	case "reconnect_error_reports":
-		o.ReconnectErrorReports = int(v.(int64))
-	case "websocket", "ws":
-		if err := parseWebsocket(tk, o, errors, warnings); err != nil {
-			*errors = append(*errors, err)
-			return
+		entries, ok := mv.(map[string]interface{})
+		if !ok {
+			*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected revocations %s to be a map, got %T", mk, mv)})
+			continue
 		}
-	default:
-		if au := atomic.LoadInt32(&allowUnknownTopLevelField); au == 0 && !tk.IsUsedVariable() {
-			err := &unknownConfigFieldErr{
-				field: k,
-				configErr: configErr{
-					token: tk,
-				},
+		*m = make(map[string]time.Time, len(entries))
+		for k, ev := range entries {
+			etk, ev := unwrapValue(ev, &lt)
+			field := fmt.Sprintf("revocation of %q", k)
+			if mk == "cert_fingerprints" {
+				fp, err := parseCertFingerprint(k)
+				if err != nil {
+					*errors = append(*errors, &configErr{etk, err.Error()})
+					continue
+				}
+				k = fp
 			}
-			*errors = append(*errors, err)
+			// Like the revocations of user JWTs, a number is a unix time.
+			if n, isInt := ev.(int64); isInt {
+				if n > 0 {
+					(*m)[k] = time.Unix(n, 0)
+				} else {
+					(*m)[k] = time.Time{}
+				}
+				continue
+			}
+			(*m)[k] = parseTime(field, etk, ev, errors)
 		}
 	}
+	return nil
 }
 
-func parseDuration(field string, tk token, v interface{}, errors *[]error, warnings *[]error) time.Duration {
-	if wd, ok := v.(string); ok {
-		if dur, err := time.ParseDuration(wd); err != nil {
-			err := &configErr{tk, fmt.Sprintf("error parsing %s: %v", field, err)}
-			*errors = append(*errors, err)
-			return 0
-		} else {
-			return dur
-		}
-	} else {
-		// Backward compatible with old type, assume this is the
-		// number of seconds.
-		err := &configWarningErr{
-			field: field,
-			configErr: configErr{
-				token:  tk,
-				reason: field + " should be converted to a duration",
-			},
+// hosts, dnssec and timeout.
+func parseDNSResolver(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	rm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected dns resolver to be a map, got %T", v)}
+	}
+	for mk, mv := range rm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "servers", "server":
+			for _, srv := range parseStringList("dns resolver servers", tk, mv, errors) {
+				// Default to the dns port.
+				if net.ParseIP(srv) != nil {
+					srv = net.JoinHostPort(srv, "53")
+				}
+				o.DNSResolver.Servers = append(o.DNSResolver.Servers, srv)
+			}
+		case "hosts":
+			hm, ok := mv.(map[string]interface{})
+			if !ok {
+				err := &configErr{tk, fmt.Sprintf("Expected dns resolver hosts to be a map, got %T", mv)}
+				*errors = append(*errors, err)
+				continue
+			}
+			o.DNSResolver.Hosts = make(map[string][]string, len(hm))
+			for host, hv := range hm {
+				tk, hv := unwrapValue(hv, &lt)
+				host = strings.ToLower(strings.TrimSuffix(host, "."))
+				o.DNSResolver.Hosts[host] = parseStringList("dns resolver hosts", tk, hv, errors)
+			}
+		case "dnssec":
+			o.DNSResolver.DNSSEC = mv.(bool)
+		case "timeout":
+			o.DNSResolver.Timeout = parseDuration("dns resolver timeout", tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
 		}
-		*warnings = append(*warnings, err)
-		return time.Duration(v.(int64)) * time.Second
 	}
+	return nil
 }
 
 func trackExplicitVal(opts *Options, pm *map[string]bool, name string, val bool) {
@@ -1036,6 +3122,7 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 			opts.Cluster.Username = auth.user
 			opts.Cluster.Password = auth.pass
 			opts.Cluster.AuthTimeout = auth.timeout
+			opts.Cluster.Nkeys = auth.serverNkeys
 
 			if auth.defaultPermissions != nil {
 				err := &configWarningErr{
@@ -1052,6 +3139,8 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 					setClusterPermissions(&opts.Cluster, auth.defaultPermissions)
 				}
 			}
+		case "nkey_seed":
+			opts.Cluster.NkeySeed = mv.(string)
 		case "routes":
 			ra := mv.([]interface{})
 			routes, errs := parseURLs(ra, "route")
@@ -1175,6 +3264,9 @@ func parseGateway(v interface{}, o *Options, errors *[]error, warnings *[]error)
 			o.Gateway.Username = auth.user
 			o.Gateway.Password = auth.pass
 			o.Gateway.AuthTimeout = auth.timeout
+			o.Gateway.Nkeys = auth.serverNkeys
+		case "nkey_seed":
+			o.Gateway.NkeySeed = mv.(string)
 		case "tls":
 			config, tlsopts, err := getTLSConfig(tk)
 			if err != nil {
@@ -1314,6 +3406,12 @@ func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]e
 				opts.JetStreamMaxMemory = mv.(int64)
 			case "max_file_store", "max_file":
 				opts.JetStreamMaxStore = mv.(int64)
+			case "recovery_concurrency":
+				opts.JetStreamRecoveryConcurrency = int(mv.(int64))
+			case "usage_interval":
+				opts.JetStreamUsageInterval = parseDuration(mk, tk, mv, errors, warnings)
+			case "usage_aggregation":
+				opts.JetStreamUsageAggregation = strings.ToLower(mv.(string))
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -1405,6 +3503,10 @@ func parseLeafNodes(v interface{}, opts *Options, errors *[]error, warnings *[]e
 		case "no_advertise":
 			opts.LeafNode.NoAdvertise = mv.(bool)
 			trackExplicitVal(opts, &opts.inConfig, "LeafNode.NoAdvertise", opts.LeafNode.NoAdvertise)
+		case "usage_tokens":
+			opts.LeafNode.UsageTokens = int(mv.(int64))
+		case "usage_interval":
+			opts.LeafNode.UsageInterval = parseDuration("usage_interval", tk, mv, errors, warnings)
 		default:
 			if !tk.IsUsedVariable() {
 				err := &unknownConfigFieldErr{
@@ -1618,6 +3720,22 @@ func parseRemoteLeafNodes(v interface{}, errors *[]error, warnings *[]error) ([]
 					continue
 				}
 				remote.DenyExports = subjects
+			case "trusted_servers", "trusted_server":
+				switch v := v.(type) {
+				case string:
+					remote.TrustedServers = []string{v}
+				case []interface{}:
+					for _, mv := range v {
+						tk, mv = unwrapValue(mv, &lt)
+						if key, ok := mv.(string); ok {
+							remote.TrustedServers = append(remote.TrustedServers, key)
+						} else {
+							*errors = append(*errors, &configErr{tk, fmt.Sprintf("error parsing trusted_servers: unsupported type in array %T", mv)})
+						}
+					}
+				default:
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("error parsing trusted_servers: unsupported type %T", v)})
+				}
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -1880,6 +3998,24 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 						continue
 					}
 					acc.defaultPerms = permissions
+				case "deny_by_default":
+					acc.denyDefault = mv.(bool)
+				case "inactive_client_timeout":
+					acc.inactive = parseDuration("inactive_client_timeout", tk, mv, errors, warnings)
+				case "ip_filter":
+					acc.ipFilter = parseIPFilter(tk, errors)
+				case "message_signing":
+					acc.msgSigning = parseMsgSigning(tk, errors)
+				case "cloudevents", "cloud_events":
+					acc.cloudEvents = parseCloudEvents(tk, errors)
+				case "schemas":
+					acc.schemas = parseSchemas(tk, errors)
+				case "presence":
+					acc.presenceOpts = parsePresence(tk, errors, warnings)
+				case "subject_quota":
+					acc.subjQuota = parseSubjectQuota(tk, errors, warnings)
+				case "queue_groups":
+					acc.queueGroups = parseQueueGroups(tk, errors)
 				default:
 					if !tk.IsUsedVariable() {
 						err := &unknownConfigFieldErr{
@@ -1892,6 +4028,11 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 					}
 				}
 			}
+			// Explicit default permissions take precedence over denying
+			// everything by default.
+			if acc.denyDefault && acc.defaultPerms == nil {
+				acc.defaultPerms = denyAllPermissions()
+			}
 			applyDefaultPermissions(users, nkeyUsr, acc.defaultPerms)
 			for _, u := range nkeyUsr {
 				if _, ok := uorn[u.Nkey]; ok {
@@ -2552,6 +4693,21 @@ func parseAuthorization(v interface{}, opts *Options, errors *[]error, warnings
 			}
 			auth.users = users
 			auth.nkeys = nkeys
+		case "users_file":
+			auth.usersFile = mv.(string)
+		case "bcrypt_min_cost":
+			auth.bcryptMinCost = int(mv.(int64))
+		case "bcrypt_rehash":
+			auth.bcryptRehash = mv.(bool)
+		case "nkeys":
+			auth.serverNkeys = parseStringList("nkeys", tk, mv, errors)
+		case "tokens":
+			tokens, err := parseTokens(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			auth.tokens = tokens
 		case "default_permission", "default_permissions", "permissions":
 			permissions, err := parseUserPermissions(tk, errors, warnings)
 			if err != nil {
@@ -2574,9 +4730,72 @@ func parseAuthorization(v interface{}, opts *Options, errors *[]error, warnings
 
 		applyDefaultPermissions(auth.users, auth.nkeys, auth.defaultPermissions)
 	}
+	if auth.defaultPermissions != nil {
+		for _, t := range auth.tokens {
+			if t.Permissions == nil {
+				t.Permissions = auth.defaultPermissions
+			}
+		}
+	}
 	return auth, nil
 }
 
+// parseTokens parses an array of tokens with their permissions and account.
+func parseTokens(mv interface{}, errors *[]error, warnings *[]error) ([]*TokenUser, error) {
+	var (
+		tk     token
+		lt     token
+		tokens = []*TokenUser{}
+	)
+	defer convertPanicToErrorList(&lt, errors)
+	tk, mv = unwrapValue(mv, &lt)
+
+	tv, ok := mv.([]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected tokens field to be an array, got %v", mv)}
+	}
+	for _, t := range tv {
+		tk, t = unwrapValue(t, &lt)
+		tm, ok := t.(map[string]interface{})
+		if !ok {
+			*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected token entry to be a map/struct, got %v", t)})
+			continue
+		}
+		tu := &TokenUser{}
+		for k, v := range tm {
+			tk, v = unwrapValue(v, &lt)
+			switch strings.ToLower(k) {
+			case "token":
+				tu.Token = v.(string)
+			case "account":
+				tu.Account = v.(string)
+			case "permission", "permissions", "authorization":
+				perms, err := parseUserPermissions(tk, errors, warnings)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+				tu.Permissions = perms
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: k,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		if tu.Token == "" {
+			return nil, &configErr{tk, "Token entry requires a token"}
+		}
+		tokens = append(tokens, tu)
+	}
+	return tokens, nil
+}
+
 // Helper function to parse multiple users array with optional permissions.
 func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]error) ([]*NkeyUser, []*User, error) {
 	var (
@@ -2584,6 +4803,7 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 		lt    token
 		keys  []*NkeyUser
 		users = []*User{}
+		fps   = make(map[string]string)
 	)
 	defer convertPanicToErrorList(&lt, errors)
 	tk, mv = unwrapValue(mv, &lt)
@@ -2605,10 +4825,12 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 		}
 
 		var (
-			user  = &User{}
-			nkey  = &NkeyUser{}
-			perms *Permissions
-			err   error
+			user     = &User{}
+			nkey     = &NkeyUser{}
+			perms    *Permissions
+			allowed  []string
+			maxConns int
+			err      error
 		)
 		for k, v := range um {
 			// Also needs to unwrap first
@@ -2627,6 +4849,27 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 					*errors = append(*errors, err)
 					continue
 				}
+			case "allowed_connections":
+				allowed = parseStringList("allowed_connections", tk, v, errors)
+			case "max_connections", "max_conns":
+				maxConns = int(v.(int64))
+				if maxConns < 0 {
+					*errors = append(*errors, &configErr{tk, "User max connections can not be negative"})
+					continue
+				}
+			case "valid_from":
+				user.ValidFrom = parseTime("valid_from", tk, v, errors)
+			case "expires":
+				user.Expires = parseTime("expires", tk, v, errors)
+			case "cert_fingerprint", "cert_fingerprints":
+				for _, fp := range parseStringList(k, tk, v, errors) {
+					nfp, err := parseCertFingerprint(fp)
+					if err != nil {
+						*errors = append(*errors, &configErr{tk, err.Error()})
+						continue
+					}
+					user.CertFingerprints = append(user.CertFingerprints, nfp)
+				}
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -2649,6 +4892,10 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 				user.Permissions = perms
 			}
 		}
+		nkey.AllowedConnections = allowed
+		user.AllowedConnections = allowed
+		nkey.MaxConnections = maxConns
+		user.MaxConnections = maxConns
 
 		// Check to make sure we have at least an nkey or username <password> defined.
 		if nkey.Nkey == "" && user.Username == "" {
@@ -2662,14 +4909,40 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 			if user.Username != "" || user.Password != "" {
 				return nil, nil, &configErr{tk, "Nkey users do not take usernames or passwords"}
 			}
+			if !user.ValidFrom.IsZero() || !user.Expires.IsZero() {
+				return nil, nil, &configErr{tk, "Nkey users do not take validity windows"}
+			}
+			if len(user.CertFingerprints) > 0 {
+				return nil, nil, &configErr{tk, "Nkey users do not take certificate fingerprints"}
+			}
 			keys = append(keys, nkey)
 		} else {
+			if !user.ValidFrom.IsZero() && !user.Expires.IsZero() && !user.Expires.After(user.ValidFrom) {
+				return nil, nil, &configErr{tk, fmt.Sprintf("User %q expires before it is valid", user.Username)}
+			}
+			// A certificate can only be mapped to one user.
+			for _, fp := range user.CertFingerprints {
+				if other, ok := fps[fp]; ok && other != user.Username {
+					return nil, nil, &configErr{tk, fmt.Sprintf("Certificate fingerprint of user %q already used by user %q", user.Username, other)}
+				}
+				fps[fp] = user.Username
+			}
 			users = append(users, user)
 		}
 	}
 	return keys, users, nil
 }
 
+// parseCertFingerprint returns the SHA-256 fingerprint in lowercase hex,
+// with any colons or spaces removed, as commonly displayed by tools.
+func parseCertFingerprint(fp string) (string, error) {
+	nfp := strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fp))
+	if b, err := hex.DecodeString(nfp); err != nil || len(b) != sha256.Size {
+		return _EMPTY_, fmt.Errorf("invalid certificate fingerprint %q, expected a SHA-256 hex digest", fp)
+	}
+	return nfp, nil
+}
+
 // Helper function to parse user/account permissions
 func parseUserPermissions(mv interface{}, errors, warnings *[]error) (*Permissions, error) {
 	var (
@@ -2705,6 +4978,13 @@ func parseUserPermissions(mv interface{}, errors, warnings *[]error) (*Permissio
 				continue
 			}
 			p.Subscribe = perms
+		case "publish_rate_limits", "rate_limits":
+			limits, err := parsePublishRateLimits(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			p.PublishRateLimits = limits
 		case "publish_allow_responses", "allow_responses":
 			rp := &ResponsePermission{
 				MaxMsgs: DEFAULT_ALLOW_RESPONSE_MAX_MSGS,
@@ -2738,6 +5018,48 @@ func parseUserPermissions(mv interface{}, errors, warnings *[]error) (*Permissio
 	return p, nil
 }
 
+// Helper function to parse the publish rate limits of permissions.
+func parsePublishRateLimits(v interface{}, errors, warnings *[]error) ([]*PublishRateLimit, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	la, ok := v.([]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected publish rate limits to be an array, got %T", v)}
+	}
+	var limits []*PublishRateLimit
+	for _, l := range la {
+		tk, l = unwrapValue(l, &lt)
+		lm, ok := l.(map[string]interface{})
+		if !ok {
+			return nil, &configErr{tk, fmt.Sprintf("Expected publish rate limit to be a map/struct, got %T", l)}
+		}
+		limit := &PublishRateLimit{}
+		for k, v := range lm {
+			tk, v = unwrapValue(v, &lt)
+			switch strings.ToLower(k) {
+			case "subject":
+				limit.Subject = v.(string)
+			case "msgs", "msgs_per_sec":
+				limit.MsgsPerSec = v.(int64)
+			case "bytes", "bytes_per_sec":
+				limit.BytesPerSec = v.(int64)
+			default:
+				if !tk.IsUsedVariable() {
+					err := &configErr{tk, fmt.Sprintf("Unknown field %q parsing publish rate limit", k)}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		if err := limit.validate(); err != nil {
+			return nil, &configErr{tk, err.Error()}
+		}
+		limits = append(limits, limit)
+	}
+	return limits, nil
+}
+
 // Top level parser for authorization configurations.
 func parseVariablePermissions(v interface{}, errors, warnings *[]error) (*SubjectPermission, error) {
 	switch vv := v.(type) {
@@ -2887,10 +5209,21 @@ func parseSubjectPermission(v interface{}, errors, warnings *[]error) (*SubjectP
 }
 
 // Helper function to validate subjects, etc for account permissioning.
+// Subscribe permissions can be scoped to queue groups, as "subject queue".
 func checkSubjectArray(sa []string) error {
 	for _, s := range sa {
-		if !IsValidSubject(s) {
-			return fmt.Errorf("subject %q is not a valid subject", s)
+		if !strings.ContainsAny(s, " \t") {
+			if !IsValidSubject(s) {
+				return fmt.Errorf("subject %q is not a valid subject", s)
+			}
+			continue
+		}
+		subject, queue, err := splitSubjectQueue(s)
+		if err != nil {
+			return err
+		}
+		if !IsValidSubject(string(subject)) || (queue != nil && !IsValidSubject(string(queue))) {
+			return fmt.Errorf("subject-queue %q is not valid", s)
 		}
 	}
 	return nil
@@ -2958,6 +5291,19 @@ func parseTLS(v interface{}) (t *TLSConfigOpts, retErr error) {
 				return nil, &configErr{tk, "error parsing tls config, expected 'ca_file' to be filename"}
 			}
 			tc.CaFile = caFile
+		case "cert", "key", "ca":
+			pem, ok := mv.(string)
+			if !ok {
+				return nil, &configErr{tk, fmt.Sprintf("error parsing tls config, expected '%s' to be PEM content", mk)}
+			}
+			switch strings.ToLower(mk) {
+			case "cert":
+				tc.Cert = pem
+			case "key":
+				tc.Key = pem
+			default:
+				tc.Ca = pem
+			}
 		case "insecure":
 			insecure, ok := mv.(bool)
 			if !ok {
@@ -3014,6 +5360,42 @@ func parseTLS(v interface{}) (t *TLSConfigOpts, retErr error) {
 				at = mv
 			}
 			tc.Timeout = at
+		case "session_resumption":
+			resumption, ok := mv.(bool)
+			if !ok {
+				return nil, &configErr{tk, "error parsing tls config, expected 'session_resumption' to be a boolean"}
+			}
+			tc.SessionTicketsDisabled = !resumption
+		case "session_ticket_rotation":
+			s, ok := mv.(string)
+			if !ok {
+				return nil, &configErr{tk, "error parsing tls config, expected 'session_ticket_rotation' to be a duration"}
+			}
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				return nil, &configErr{tk, fmt.Sprintf("error parsing tls config, invalid 'session_ticket_rotation' %q", s)}
+			}
+			tc.SessionTicketRotation = d
+		case "crl_file", "crl_files":
+			switch mv := mv.(type) {
+			case string:
+				tc.CRLFiles = []string{mv}
+			case []interface{}:
+				for _, f := range mv {
+					tk, f := unwrapValue(f, &lt)
+					file, ok := f.(string)
+					if !ok {
+						return nil, &configErr{tk, "error parsing tls config, expected 'crl_files' to be filenames"}
+					}
+					tc.CRLFiles = append(tc.CRLFiles, file)
+				}
+			default:
+				return nil, &configErr{tk, "error parsing tls config, expected 'crl_files' to be filenames"}
+			}
+		case "ocsp":
+			if err := parseOCSP(tk, mv, &tc); err != nil {
+				return nil, err
+			}
 		default:
 			return nil, &configErr{tk, fmt.Sprintf("error parsing tls config, unknown field [%q]", mk)}
 		}
@@ -3167,6 +5549,52 @@ func parseWebsocket(v interface{}, o *Options, errors *[]error, warnings *[]erro
 	return nil
 }
 
+// parseOCSP parses the OCSP checks of the tls config, enabled by a boolean
+// or a map.
+func parseOCSP(tk token, v interface{}, tc *TLSConfigOpts) error {
+	if b, ok := v.(bool); ok {
+		tc.OCSP = b
+		return nil
+	}
+	om, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, "error parsing tls config, expected 'ocsp' to be a boolean or a map"}
+	}
+	tc.OCSP = true
+	var lt token
+	for mk, mv := range om {
+		tk, mv := unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "responder", "url":
+			url, ok := mv.(string)
+			if !ok {
+				return &configErr{tk, "error parsing tls config, expected 'ocsp responder' to be a url"}
+			}
+			tc.OCSPResponder = url
+		case "timeout", "cache_ttl":
+			s, ok := mv.(string)
+			d, err := time.ParseDuration(s)
+			if !ok || err != nil || d <= 0 {
+				return &configErr{tk, fmt.Sprintf("error parsing tls config, invalid 'ocsp %s' %v", mk, mv)}
+			}
+			if strings.ToLower(mk) == "timeout" {
+				tc.OCSPTimeout = d
+			} else {
+				tc.OCSPCacheTTL = d
+			}
+		case "require_status":
+			require, ok := mv.(bool)
+			if !ok {
+				return &configErr{tk, "error parsing tls config, expected 'ocsp require_status' to be a boolean"}
+			}
+			tc.OCSPRequireStatus = require
+		default:
+			return &configErr{tk, fmt.Sprintf("error parsing tls config, unknown ocsp field [%q]", mk)}
+		}
+	}
+	return nil
+}
+
 // GenTLSConfig loads TLS related configuration parameters.
 func GenTLSConfig(tc *TLSConfigOpts) (*tls.Config, error) {
 	// Create the tls.Config from our options before including the certs.
@@ -3180,40 +5608,18 @@ func GenTLSConfig(tc *TLSConfigOpts) (*tls.Config, error) {
 		InsecureSkipVerify:       tc.Insecure,
 	}
 
-	switch {
-	case tc.CertFile != "" && tc.KeyFile == "":
-		return nil, fmt.Errorf("missing 'key_file' in TLS configuration")
-	case tc.CertFile == "" && tc.KeyFile != "":
-		return nil, fmt.Errorf("missing 'cert_file' in TLS configuration")
-	case tc.CertFile != "" && tc.KeyFile != "":
-		// Now load in cert and private key
-		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing X509 certificate/key pair: %v", err)
-		}
-		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
-		if err != nil {
-			return nil, fmt.Errorf("error parsing certificate: %v", err)
-		}
-		config.Certificates = []tls.Certificate{cert}
+	if err := setupCertificates(&config, tc); err != nil {
+		return nil, err
 	}
-
 	// Require client certificates as needed
 	if tc.Verify {
 		config.ClientAuth = tls.RequireAndVerifyClientCert
 	}
-	// Add in CAs if applicable.
-	if tc.CaFile != "" {
-		rootPEM, err := ioutil.ReadFile(tc.CaFile)
-		if err != nil || rootPEM == nil {
-			return nil, err
-		}
-		pool := x509.NewCertPool()
-		ok := pool.AppendCertsFromPEM(rootPEM)
-		if !ok {
-			return nil, fmt.Errorf("failed to parse root ca certificate")
-		}
-		config.ClientCAs = pool
+	if err := setupSessionTickets(&config, tc); err != nil {
+		return nil, err
+	}
+	if err := setupCertRevocation(&config, tc); err != nil {
+		return nil, err
 	}
 
 	return &config, nil
@@ -985,6 +985,135 @@ func TestNkeyUsersDefaultPermissionsConfig(t *testing.T) {
 	checkPerms(foundNk[0].Permissions, foundNk[1].Permissions)
 }
 
+func TestAccountDenyByDefaultConfig(t *testing.T) {
+	confFileName := createConfFile(t, []byte(`
+	listen: "127.0.0.1:-1"
+	accounts {
+		A {
+			deny_by_default: true
+			users = [
+				{ user: "none", password: "pwd"}
+				{ user: "explicit", password: "pwd", permissions = { publish = "foo", subscribe = "foo" } }
+			]
+		}
+		B {
+			deny_by_default: true
+			default_permissions = { publish = "bar" }
+			users = [ { user: "default", password: "pwd"} ]
+		}
+	}
+	`))
+	defer os.Remove(confFileName)
+	s, opts := RunServerWithConfig(confFileName)
+	defer s.Shutdown()
+
+	perms := make(map[string]*Permissions)
+	for _, u := range opts.Users {
+		perms[u.Username] = u.Permissions
+	}
+	if p := perms["none"]; p == nil || p.Publish.Deny[0] != ">" || p.Subscribe.Deny[0] != ">" {
+		t.Fatalf("Expected deny all permissions, got %+v", p)
+	}
+	if p := perms["explicit"]; p == nil || p.Publish.Allow[0] != "foo" || p.Publish.Deny != nil {
+		t.Fatalf("Expected explicit permissions, got %+v", p)
+	}
+	if p := perms["default"]; p == nil || p.Publish.Allow[0] != "bar" || p.Subscribe != nil {
+		t.Fatalf("Expected default permissions, got %+v", p)
+	}
+
+	errCh := make(chan error, 1)
+	nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("none", "pwd"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	if _, err := nc.SubscribeSync("foo"); err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "Permissions Violation") {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a permissions violation")
+	}
+}
+
+func TestAccountDenyByDefaultBoundUsers(t *testing.T) {
+	confFileName := createConfFile(t, []byte(`
+	listen: "127.0.0.1:-1"
+	accounts {
+		A {
+			deny_by_default: true
+			users = [ { user: "a", password: "pwd"} ]
+		}
+		B {
+			default_permissions = { publish = "bar", subscribe = "bar" }
+			users = [ { user: "b", password: "pwd"} ]
+		}
+	}
+	authorization {
+		tokens: [ { token: "tokenA", account: A } ]
+	}
+	`))
+	defer os.Remove(confFileName)
+	s, _ := RunServerWithConfig(confFileName)
+	defer s.Shutdown()
+
+	// Users added at runtime have the defaults of their account too.
+	acc, err := s.LookupAccount("B")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if err := s.AddUser(&User{Username: "added", Password: "pwd", Account: acc}); err != nil {
+		t.Fatalf("Error adding user: %v", err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		opt     nats.Option
+		allowed string
+	}{
+		{"token", nats.Token("tokenA"), _EMPTY_},
+		{"added user", nats.UserInfo("added", "pwd"), "bar"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			errCh := make(chan error, 1)
+			nc, err := nats.Connect(s.ClientURL(), test.opt,
+				nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+					errCh <- err
+				}))
+			if err != nil {
+				t.Fatalf("Error on connect: %v", err)
+			}
+			defer nc.Close()
+			if test.allowed != _EMPTY_ {
+				if _, err := nc.SubscribeSync(test.allowed); err != nil {
+					t.Fatalf("Error on subscribe: %v", err)
+				}
+				if err := nc.Flush(); err != nil {
+					t.Fatalf("Error on flush: %v", err)
+				}
+			}
+			if _, err := nc.SubscribeSync("foo"); err != nil {
+				t.Fatalf("Error on subscribe: %v", err)
+			}
+			select {
+			case err := <-errCh:
+				if !strings.Contains(err.Error(), "Permissions Violation") || !strings.Contains(err.Error(), "foo") {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Expected a permissions violation")
+			}
+		})
+	}
+}
+
 func TestNkeyUsersWithPermsConfig(t *testing.T) {
 	confFileName := createConfFile(t, []byte(`
     authorization {
@@ -2757,3 +2886,34 @@ func TestReadOperatorAssertVersionFail(t *testing.T) {
 		t.Fatal("expected different error got: ", err)
 	}
 }
+
+func TestLameDuckSteeringConfig(t *testing.T) {
+	confFileName := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		lame_duck_connect_urls: ["127.0.0.1:4333", "127.0.0.1:4222"]
+		lame_duck_batch_size: 10
+		lame_duck_account_priority: "B"
+	`))
+	defer os.Remove(confFileName)
+	opts, err := ProcessConfigFile(confFileName)
+	if err != nil {
+		t.Fatalf("Received unexpected error %s", err)
+	}
+	if !reflect.DeepEqual(opts.LameDuckConnectURLs, []string{"127.0.0.1:4333", "127.0.0.1:4222"}) {
+		t.Fatalf("Unexpected connect urls: %q", opts.LameDuckConnectURLs)
+	}
+	if opts.LameDuckBatchSize != 10 {
+		t.Fatalf("Unexpected batch size: %v", opts.LameDuckBatchSize)
+	}
+	if !reflect.DeepEqual(opts.LameDuckAccountPriority, []string{"B"}) {
+		t.Fatalf("Unexpected account priority: %q", opts.LameDuckAccountPriority)
+	}
+
+	confFileName = createConfFile(t, []byte(`
+		lame_duck_account_priority: [true]
+	`))
+	defer os.Remove(confFileName)
+	if _, err := ProcessConfigFile(confFileName); err == nil || !strings.Contains(err.Error(), "unsupported type in array") {
+		t.Fatalf("Expected error, got %v", err)
+	}
+}
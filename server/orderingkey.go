@@ -0,0 +1,78 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// Messages with the Nats-Ordering-Key header are delivered to the member of
+// a queue group their key maps to, instead of a random one, so that the
+// messages of an entity are processed in order by a single worker while
+// the entities are balanced across the workers. Keys are mapped with
+// rendezvous hashing, so that members joining or leaving a group only move
+// the keys mapped to them. In a cluster, a server maps the key to one of
+// its members or to the route of another server, which maps it to one of
+// its own members, so that publishers connected to the same server always
+// reach the same member.
+
+// OrderingKeyHdr is the header of the ordering key of a message.
+const OrderingKeyHdr = "Nats-Ordering-Key"
+
+// orderingKey returns the ordering key of the message, if any.
+func (c *client) orderingKey(msg []byte) []byte {
+	if c.pa.hdr <= 0 || c.pa.hdr > len(msg) {
+		return nil
+	}
+	return getHeader(OrderingKeyHdr, msg[:c.pa.hdr])
+}
+
+// orderingKeyIndex returns the index of the member of the queue group
+// with the highest weight for the key.
+func orderingKeyIndex(key []byte, qsubs []*subscription) int {
+	var (
+		best  uint64
+		index = -1
+		buf   [64]byte
+	)
+	for i, sub := range qsubs {
+		if sub == nil || sub.client == nil {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write(key)
+		h.Write(queueMemberID(buf[:0], sub))
+		if w := h.Sum64(); index < 0 || w > best {
+			best, index = w, i
+		}
+	}
+	if index < 0 {
+		return 0
+	}
+	return index
+}
+
+// queueMemberID returns the identity of the member of a queue group, which
+// is the connection for routes and leafnodes, and the subscription for
+// clients.
+func queueMemberID(b []byte, sub *subscription) []byte {
+	b = append(b, 0)
+	b = strconv.AppendUint(b, sub.client.cid, 10)
+	if sub.client.kind == CLIENT {
+		b = append(b, ' ')
+		b = append(b, sub.sid...)
+	}
+	return b
+}
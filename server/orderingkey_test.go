@@ -0,0 +1,108 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestOrderingKeyQueueDelivery(t *testing.T) {
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+
+	var mu sync.Mutex
+	members := make(map[string]map[int]bool)
+	received := 0
+	for i := 0; i < 3; i++ {
+		member := i
+		nc := natsConnect(t, s.ClientURL())
+		defer nc.Close()
+		natsQueueSub(t, nc, "work", "workers", func(m *nats.Msg) {
+			mu.Lock()
+			defer mu.Unlock()
+			received++
+			key := m.Header.Get(OrderingKeyHdr)
+			if key == _EMPTY_ {
+				return
+			}
+			if members[key] == nil {
+				members[key] = make(map[int]bool)
+			}
+			members[key][member] = true
+		})
+		natsFlush(t, nc)
+	}
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	const keys, perKey = 20, 10
+	for i := 0; i < perKey; i++ {
+		for k := 0; k < keys; k++ {
+			m := &nats.Msg{Subject: "work", Header: http.Header{OrderingKeyHdr: []string{fmt.Sprintf("entity-%d", k)}}}
+			if err := nc.PublishMsg(m); err != nil {
+				t.Fatalf("Error on publish: %v", err)
+			}
+		}
+		// Messages without a key are still balanced.
+		natsPub(t, nc, "work", []byte("no key"))
+	}
+	natsFlush(t, nc)
+
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if received != keys*perKey+perKey {
+			return fmt.Errorf("received %d messages", received)
+		}
+		return nil
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	used := make(map[int]bool)
+	for key, m := range members {
+		if len(m) != 1 {
+			t.Fatalf("Expected messages of %q to go to a single member, got %v", key, m)
+		}
+		for member := range m {
+			used[member] = true
+		}
+	}
+	if len(used) < 2 {
+		t.Fatalf("Expected keys to be balanced across members, got %v", used)
+	}
+}
+
+func TestOrderingKeyIndexStable(t *testing.T) {
+	var qsubs []*subscription
+	for i := 0; i < 5; i++ {
+		qsubs = append(qsubs, &subscription{client: &client{cid: uint64(i + 1), kind: CLIENT}, sid: []byte("1")})
+	}
+	// Removing a member only moves the keys mapped to it.
+	removed := qsubs[2]
+	remaining := append(append([]*subscription(nil), qsubs[:2]...), qsubs[3:]...)
+	for k := 0; k < 100; k++ {
+		key := []byte(fmt.Sprintf("key-%d", k))
+		before := qsubs[orderingKeyIndex(key, qsubs)]
+		after := remaining[orderingKeyIndex(key, remaining)]
+		if before != removed && before != after {
+			t.Fatalf("Key %q moved from member %d to %d", key, before.client.cid, after.client.cid)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Anything before that is considered a clock that was never set.
+var preflightMinTime = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Number of file descriptors needed on top of client connections for
+// routes, gateways, leafnodes, listeners and files.
+const preflightFDHeadroom = 64
+
+// PreflightIssue is a problem with the environment found before startup.
+type PreflightIssue struct {
+	// Check is one of files, ulimit, disk, port or clock.
+	Check string
+	// Fatal issues prevent the server from starting.
+	Fatal   bool
+	Problem string
+	Hint    string
+}
+
+func (i *PreflightIssue) String() string {
+	return fmt.Sprintf("%s: %s (%s)", i.Check, i.Problem, i.Hint)
+}
+
+// Preflight checks the environment against the given options: file
+// permissions, open files limit, disk space, port availability and the
+// clock. All issues are returned at once instead of failing on the first.
+func Preflight(opts *Options) []*PreflightIssue {
+	var issues []*PreflightIssue
+	add := func(check string, fatal bool, hint string, format string, args ...interface{}) {
+		issues = append(issues, &PreflightIssue{check, fatal, fmt.Sprintf(format, args...), hint})
+	}
+
+	// Files the server reads.
+	for _, f := range []string{opts.TLSCert, opts.TLSKey, opts.TLSCaCert} {
+		if f == _EMPTY_ {
+			continue
+		}
+		if fd, err := os.Open(f); err != nil {
+			add("files", true, "check that the file exists and is readable by the server user",
+				"cannot read %q: %v", f, err)
+		} else {
+			fd.Close()
+		}
+	}
+	// Directories the server writes to.
+	for _, d := range []string{dirOf(opts.PidFile), opts.PortsFileDir, dirOf(opts.LogFile)} {
+		if d == _EMPTY_ {
+			continue
+		}
+		if err := checkWritableDir(d); err != nil {
+			add("files", true, "create the directory or fix its permissions for the server user",
+				"cannot write to %q: %v", d, err)
+		}
+	}
+	storeDir := opts.StoreDir
+	if storeDir == _EMPTY_ {
+		storeDir = filepath.Join(os.TempDir(), JetStreamStoreDir)
+	}
+	if opts.JetStream {
+		if err := checkWritableDir(existingDir(storeDir)); err != nil {
+			add("files", true, "create the storage directory or fix its permissions for the server user",
+				"cannot write to JetStream storage directory %q: %v", storeDir, err)
+		}
+	}
+
+	// Enough file descriptors for the configured connections.
+	if limit := maxOpenFiles(); limit > 0 && opts.MaxConn > 0 {
+		if need := uint64(opts.MaxConn) + preflightFDHeadroom; limit < need {
+			add("ulimit", false, fmt.Sprintf("raise the limit with 'ulimit -n %d' or lower max_connections", need),
+				"open files limit %d is lower than max_connections %d", limit, opts.MaxConn)
+		}
+	}
+
+	// Enough disk space for the configured JetStream storage.
+	if opts.JetStream && opts.JetStreamMaxStore > 0 {
+		if avail := diskAvailable(existingDir(storeDir)); avail > 0 && avail < uint64(opts.JetStreamMaxStore) {
+			add("disk", false, "free up disk space, move store_dir or lower max_file_store",
+				"%s available in %q, less than JetStream max storage of %s",
+				FriendlyBytes(int64(avail)), storeDir, FriendlyBytes(opts.JetStreamMaxStore))
+		}
+	}
+
+	// Ports we are about to listen on.
+	for _, l := range []struct {
+		name string
+		host string
+		port int
+	}{
+		{"client", opts.Host, opts.Port},
+		{"monitoring", opts.HTTPHost, opts.HTTPPort},
+		{"monitoring", opts.HTTPHost, opts.HTTPSPort},
+		{"cluster", opts.Cluster.Host, opts.Cluster.Port},
+		{"gateway", opts.Gateway.Host, opts.Gateway.Port},
+		{"leafnode", opts.LeafNode.Host, opts.LeafNode.Port},
+		{"websocket", opts.Websocket.Host, opts.Websocket.Port},
+	} {
+		if l.port <= 0 {
+			continue
+		}
+		hp := net.JoinHostPort(l.host, fmt.Sprintf("%d", l.port))
+		ln, err := net.Listen("tcp", hp)
+		if err != nil {
+			add("port", true, "stop the process using the port or configure another one",
+				"%s port %s is not available: %v", l.name, hp, err)
+			continue
+		}
+		ln.Close()
+	}
+
+	// A clock that was never set breaks TLS and JWT validation.
+	if now := time.Now(); now.Before(preflightMinTime) {
+		add("clock", false, "synchronize the system clock, for instance with NTP",
+			"system time %v looks wrong", now.UTC())
+	}
+
+	return issues
+}
+
+// Preflight runs the preflight checks with the server options, warns
+// about each issue found and returns an error listing the fatal ones.
+func (s *Server) Preflight() error {
+	var fatal []string
+	for _, i := range Preflight(s.getOpts()) {
+		if i.Fatal {
+			s.Errorf("Preflight %s", i)
+			fatal = append(fatal, i.String())
+		} else {
+			s.Warnf("Preflight %s", i)
+		}
+	}
+	if len(fatal) > 0 {
+		return fmt.Errorf("preflight checks failed:\n  %s", strings.Join(fatal, "\n  "))
+	}
+	return nil
+}
+
+func dirOf(file string) string {
+	if file == _EMPTY_ {
+		return _EMPTY_
+	}
+	return filepath.Dir(file)
+}
+
+// existingDir returns dir or its closest existing parent, which is
+// where a directory created later on will need to be written.
+func existingDir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+func checkWritableDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("not a directory")
+	}
+	tmpfile, err := ioutil.TempFile(dir, "_preflight_")
+	if err != nil {
+		return err
+	}
+	tmpfile.Close()
+	return os.Remove(tmpfile.Name())
+}
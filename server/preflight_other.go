@@ -0,0 +1,26 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux,!darwin,!freebsd
+
+package server
+
+// maxOpenFiles returns the open files limit, or 0 if unknown.
+func maxOpenFiles() uint64 {
+	return 0
+}
+
+// diskAvailable returns the bytes available to the server in dir, or 0 if unknown.
+func diskAvailable(dir string) uint64 {
+	return 0
+}
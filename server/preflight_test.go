@@ -0,0 +1,73 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreflight(t *testing.T) {
+	opts := DefaultOptions()
+	if issues := Preflight(opts); len(issues) != 0 {
+		t.Fatalf("Expected no issue, got %v", issues)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	defer ln.Close()
+	opts.Port = ln.Addr().(*net.TCPAddr).Port
+	opts.TLSCert = filepath.Join(os.TempDir(), "preflight_missing_cert.pem")
+	opts.LogFile = filepath.Join(os.TempDir(), "preflight_missing_dir", "nats.log")
+
+	orgMinTime := preflightMinTime
+	preflightMinTime = time.Now().Add(time.Hour)
+	defer func() { preflightMinTime = orgMinTime }()
+	if limit := maxOpenFiles(); limit > 0 && limit < 1<<30 {
+		opts.MaxConn = int(limit)
+	}
+
+	// All issues are reported at once.
+	checks := make(map[string]int)
+	for _, i := range Preflight(opts) {
+		checks[i.Check]++
+		if i.Hint == _EMPTY_ {
+			t.Fatalf("Expected a hint for %v", i)
+		}
+		if fatal := i.Check == "port" || i.Check == "files"; fatal != i.Fatal {
+			t.Fatalf("Unexpected fatal for %v", i)
+		}
+	}
+	if checks["port"] != 1 || checks["files"] != 2 || checks["clock"] != 1 {
+		t.Fatalf("Unexpected issues: %v", checks)
+	}
+	if opts.MaxConn != DefaultOptions().MaxConn && checks["ulimit"] != 1 {
+		t.Fatalf("Expected ulimit issue, got %v", checks)
+	}
+
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	err = s.Preflight()
+	if err == nil || !strings.Contains(err.Error(), "port") || !strings.Contains(err.Error(), "preflight_missing_cert") {
+		t.Fatalf("Expected port and files errors, got %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// An account can be notified when interest on literal subjects matching
+// configured patterns appears or disappears, e.g. a client subscribing to
+// chat.user.alice making alice present, without heartbeat subjects. The
+// interest is tracked from the sublist of the account, which includes the
+// subscriptions of the routes, so that all the servers of a cluster see
+// the same presence. Each server then only delivers the events to its own
+// clients and leafnodes, so that a subscriber receives each event once.
+// Changes are debounced, an interest disappearing and appearing again
+// within the debounce interval does not generate events.
+
+// PresenceSubjectPrefix is the prefix of the subjects presence events are
+// published on, followed by the subject of the interest.
+const PresenceSubjectPrefix = "$PRESENCE."
+
+// DEFAULT_PRESENCE_DEBOUNCE is the default interval presence changes are
+// debounced for.
+const DEFAULT_PRESENCE_DEBOUNCE = time.Second
+
+// PresenceOpts are the subject patterns of an account whose interest is
+// tracked for presence.
+type PresenceOpts struct {
+	Subjects []string
+	Debounce time.Duration
+}
+
+// PresenceEventMsg is published in the account when interest on a subject
+// tracked for presence appears or disappears.
+type PresenceEventMsg struct {
+	TypedEvent
+	Account string `json:"account"`
+	Subject string `json:"subject"`
+	Present bool   `json:"present"`
+}
+
+// PresenceEventMsgType is the schema type for PresenceEventMsg
+const PresenceEventMsgType = "io.nats.server.advisory.v1.presence"
+
+// presence tracks the interest on the subjects of an account.
+type presence struct {
+	acc  *Account
+	srv  *Server
+	sl   *Sublist
+	opts *PresenceOpts
+
+	mu        sync.Mutex
+	interest  map[string]int32
+	published map[string]bool
+	pending   map[string]struct{}
+	tmr       *time.Timer
+
+	// Serializes the delivery of events by the internal client.
+	sendMu sync.Mutex
+	c      *client
+}
+
+// tracks returns true if presence is tracked for the subject.
+func (p *presence) tracks(subject string) bool {
+	if subjectHasWildcard(subject) {
+		return false
+	}
+	for _, pattern := range p.opts.Subjects {
+		if subjectIsSubsetMatch(subject, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// interestChanged is called by the sublist with its lock held.
+func (p *presence) interestChanged(sub *subscription, delta int32) {
+	subject := string(sub.subject)
+	if !p.tracks(subject) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := p.interest[subject] + delta
+	if n <= 0 {
+		delete(p.interest, subject)
+	} else {
+		p.interest[subject] = n
+	}
+	if (n > 0) == p.published[subject] {
+		return
+	}
+	p.pending[subject] = struct{}{}
+	if p.tmr == nil {
+		p.tmr = time.AfterFunc(p.opts.Debounce, p.flush)
+	}
+}
+
+// seed records the interest of a subscription present when the tracking
+// starts, as already published.
+func (p *presence) seed(sub *subscription) {
+	subject := string(sub.subject)
+	if !p.tracks(subject) {
+		return
+	}
+	p.mu.Lock()
+	p.interest[subject]++
+	p.published[subject] = true
+	p.mu.Unlock()
+}
+
+// flush publishes the events of the subjects whose presence changed since
+// the last events.
+func (p *presence) flush() {
+	var events []*PresenceEventMsg
+	p.mu.Lock()
+	for subject := range p.pending {
+		present := p.interest[subject] > 0
+		if present == p.published[subject] {
+			continue
+		}
+		if present {
+			p.published[subject] = true
+		} else {
+			delete(p.published, subject)
+		}
+		events = append(events, &PresenceEventMsg{
+			TypedEvent: TypedEvent{
+				Type: PresenceEventMsgType,
+				ID:   p.acc.nextEventID(),
+				Time: time.Now().UTC(),
+			},
+			Account: p.acc.Name,
+			Subject: subject,
+			Present: present,
+		})
+	}
+	p.pending = make(map[string]struct{})
+	p.tmr = nil
+	p.mu.Unlock()
+
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	for _, e := range events {
+		p.deliver(PresenceSubjectPrefix+e.Subject, e)
+	}
+}
+
+// deliver delivers the event to the local clients and leafnodes of the
+// account, other servers of the cluster delivering it to their own.
+// sendMu should be held.
+func (p *presence) deliver(subject string, e *PresenceEventMsg) {
+	r := p.sl.Match(subject)
+	if len(r.psubs)+len(r.qsubs) == 0 {
+		return
+	}
+	local := &SublistResult{}
+	for _, sub := range r.psubs {
+		if isLocalPresenceSub(sub) {
+			local.psubs = append(local.psubs, sub)
+		}
+	}
+	for _, qsubs := range r.qsubs {
+		var lq []*subscription
+		for _, sub := range qsubs {
+			if isLocalPresenceSub(sub) {
+				lq = append(lq, sub)
+			}
+		}
+		if len(lq) > 0 {
+			local.qsubs = append(local.qsubs, lq)
+		}
+	}
+	if len(local.psubs)+len(local.qsubs) == 0 {
+		return
+	}
+
+	if p.c == nil {
+		p.c = p.srv.createInternalAccountClient()
+		p.c.acc = p.acc
+	}
+	b, _ := json.Marshal(e)
+	c := p.c
+	c.pa.subject = []byte(subject)
+	c.pa.reply = nil
+	c.pa.size = len(b)
+	c.pa.szb = []byte(strconv.Itoa(len(b)))
+	c.pa.hdr = -1
+	c.pa.hdb = nil
+	c.processMsgResults(p.acc, local, append(b, _CRLF_...), nil, c.pa.subject, nil, pmrNoFlag)
+	c.pa.szb = nil
+	c.flushClients(0)
+}
+
+// isLocalPresenceSub returns true if the subscription is not the one of a
+// route or gateway.
+func isLocalPresenceSub(sub *subscription) bool {
+	if sub.client == nil {
+		return false
+	}
+	kind := sub.client.kind
+	return kind != ROUTER && kind != GATEWAY
+}
+
+// startPresence tracks the interest on the subjects of the account for
+// presence, if configured, replacing the tracking of its previous sublist.
+func (a *Account) startPresence() {
+	a.mu.Lock()
+	opts, sl := a.presenceOpts, a.sl
+	var p *presence
+	if opts != nil && a.srv != nil && sl != nil {
+		p = &presence{
+			acc:       a,
+			srv:       a.srv,
+			sl:        sl,
+			opts:      opts,
+			interest:  make(map[string]int32),
+			published: make(map[string]bool),
+			pending:   make(map[string]struct{}),
+		}
+	}
+	a.presence = p
+	a.mu.Unlock()
+
+	if sl == nil {
+		return
+	}
+	if p == nil {
+		sl.setChangeHandler(nil, nil)
+		return
+	}
+	sl.setChangeHandler(p.interestChanged, p.seed)
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestPresence(t *testing.T) {
+	confA := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		cluster { listen: "127.0.0.1:-1" }
+		accounts {
+			A: {
+				users: [{user: a, password: pwd}]
+				presence: { subjects: ["chat.user.*"], debounce: "50ms" }
+			}
+		}
+	`))
+	defer os.Remove(confA)
+	sA, optsA := RunServerWithConfig(confA)
+	defer sA.Shutdown()
+
+	if po := optsA.Accounts[0].presenceOpts; po == nil || len(po.Subjects) != 1 || po.Debounce != 50*time.Millisecond {
+		t.Fatalf("Unexpected presence options: %+v", po)
+	}
+
+	confB := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		cluster { listen: "127.0.0.1:-1", routes: ["nats://127.0.0.1:%d"] }
+		accounts {
+			A: {
+				users: [{user: a, password: pwd}]
+				presence: { subjects: ["chat.user.*"], debounce: "50ms" }
+			}
+		}
+	`, optsA.Cluster.Port)))
+	defer os.Remove(confB)
+	sB, _ := RunServerWithConfig(confB)
+	defer sB.Shutdown()
+	checkClusterFormed(t, sA, sB)
+
+	connect := func(s *Server) *nats.Conn {
+		t.Helper()
+		nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("a", "pwd"))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		return nc
+	}
+	// Watchers on both servers.
+	ncA, ncB := connect(sA), connect(sB)
+	defer ncA.Close()
+	defer ncB.Close()
+	watchA, _ := ncA.SubscribeSync(PresenceSubjectPrefix + "chat.user.*")
+	watchB, _ := ncB.SubscribeSync(PresenceSubjectPrefix + "chat.>")
+	ncA.Flush()
+	ncB.Flush()
+	checkSubInterest(t, sA, "A", PresenceSubjectPrefix+"chat.user.x", time.Second)
+	checkSubInterest(t, sB, "A", PresenceSubjectPrefix+"chat.user.x", time.Second)
+
+	checkEvent := func(sub *nats.Subscription, subject string, present bool) {
+		t.Helper()
+		msg, err := sub.NextMsg(2 * time.Second)
+		if err != nil {
+			t.Fatalf("Expected presence event: %v", err)
+		}
+		var e PresenceEventMsg
+		if err := json.Unmarshal(msg.Data, &e); err != nil {
+			t.Fatalf("Error unmarshaling event: %v", err)
+		}
+		if msg.Subject != PresenceSubjectPrefix+subject || e.Type != PresenceEventMsgType ||
+			e.Account != "A" || e.Subject != subject || e.Present != present {
+			t.Fatalf("Unexpected event on %q: %+v", msg.Subject, e)
+		}
+	}
+	checkNoEvent := func(sub *nats.Subscription) {
+		t.Helper()
+		if msg, err := sub.NextMsg(150 * time.Millisecond); err == nil {
+			t.Fatalf("Unexpected event: %s", msg.Data)
+		}
+	}
+
+	// Alice appears on B, each watcher gets a single event.
+	alice := connect(sB)
+	defer alice.Close()
+	aliceSub, _ := alice.SubscribeSync("chat.user.alice")
+	alice.Flush()
+	for _, w := range []*nats.Subscription{watchA, watchB} {
+		checkEvent(w, "chat.user.alice", true)
+		checkNoEvent(w)
+	}
+
+	// More interest on A does not change presence, nor other subjects.
+	alice2 := connect(sA)
+	defer alice2.Close()
+	alice2.SubscribeSync("chat.user.alice")
+	alice2.SubscribeSync("chat.room.alice")
+	alice2.SubscribeSync("chat.user.*")
+	alice2.Flush()
+	checkNoEvent(watchA)
+
+	// Going away and coming back within the debounce interval.
+	aliceSub.Unsubscribe()
+	alice2.Close()
+	alice.SubscribeSync("chat.user.alice")
+	alice.Flush()
+	checkNoEvent(watchB)
+
+	alice.Close()
+	for _, w := range []*nats.Subscription{watchA, watchB} {
+		checkEvent(w, "chat.user.alice", false)
+		checkNoEvent(w)
+	}
+}
@@ -0,0 +1,426 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The monitoring port can accept Prometheus remote-write requests, the
+// snappy compressed protobuf WriteRequest of the 1.0 protocol, and publish
+// each of their time series on a subject derived from its labels. Tokens
+// of the subject template of the form {label} are replaced by the value of
+// the label, or _ when it is not set. The payload of messages is the JSON
+// of the series:
+//
+//	{"labels":{"__name__":"up","job":"node"},"samples":[{"value":"1","timestamp":1600000000000}]}
+//
+// Values are strings so that NaN and infinities can be represented, like in
+// the HTTP API of Prometheus.
+
+const (
+	// DefaultPromWritePath is the default path of the remote-write endpoint.
+	DefaultPromWritePath = "/api/v1/write"
+
+	// Maximum size of compressed and decompressed requests.
+	promWriteMaxSize = 32 * 1024 * 1024
+)
+
+// PromWriteOpts configure the Prometheus remote-write endpoint of the
+// monitoring port.
+type PromWriteOpts struct {
+	// Subject template of the time series. The endpoint is enabled when set.
+	Subject string
+	// Path of the endpoint. Defaults to /api/v1/write.
+	Path string
+	// Account the series are published in. Defaults to the global account.
+	Account string
+	// Stream storing the series, created on the subjects of the template
+	// if it does not exist.
+	Stream string
+	// Token required as bearer token of requests when set.
+	Token string
+}
+
+func (o *PromWriteOpts) path() string {
+	if o.Path != _EMPTY_ {
+		return o.Path
+	}
+	return DefaultPromWritePath
+}
+
+// streamSubject returns the subject matching all the subjects of the
+// template.
+func (o *PromWriteOpts) streamSubject() string {
+	tokens := strings.Split(o.Subject, tsep)
+	for i, t := range tokens {
+		if isPromLabelToken(t) {
+			tokens[i] = string(pwc)
+		}
+	}
+	return strings.Join(tokens, tsep)
+}
+
+func isPromLabelToken(t string) bool {
+	return len(t) > 2 && t[0] == '{' && t[len(t)-1] == '}'
+}
+
+func validatePromWriteOptions(o *Options) error {
+	po := &o.PrometheusWrite
+	if po.Subject == _EMPTY_ {
+		return nil
+	}
+	if o.HTTPPort == 0 && o.HTTPSPort == 0 {
+		return errors.New("prometheus remote-write requires the monitoring port to be enabled")
+	}
+	for _, t := range strings.Split(po.Subject, tsep) {
+		if !isPromLabelToken(t) && strings.ContainsAny(t, "{}") {
+			return fmt.Errorf("prometheus remote-write subject %q has an invalid token %q", po.Subject, t)
+		}
+	}
+	if !IsValidSubject(po.streamSubject()) {
+		return fmt.Errorf("prometheus remote-write subject %q is invalid", po.Subject)
+	}
+	if !strings.HasPrefix(po.path(), "/") {
+		return fmt.Errorf("prometheus remote-write path %q is invalid", po.Path)
+	}
+	if po.Stream != _EMPTY_ && !o.JetStream {
+		return errors.New("prometheus remote-write stream requires jetstream to be enabled")
+	}
+	if po.Account == _EMPTY_ || po.Account == globalAccountName || len(o.TrustedOperators) > 0 {
+		return nil
+	}
+	for _, a := range o.Accounts {
+		if a.Name == po.Account {
+			return nil
+		}
+	}
+	return fmt.Errorf("prometheus remote-write account %q is not defined", po.Account)
+}
+
+// snappyDecode decodes a snappy block, as used by remote-write.
+func snappyDecode(src []byte, max int) ([]byte, error) {
+	errCorrupt := errors.New("snappy: corrupt input")
+	n, l := binary.Uvarint(src)
+	if l <= 0 || n > uint64(max) {
+		return nil, errCorrupt
+	}
+	dst := make([]byte, 0, n)
+	for s := l; s < len(src); {
+		tag := src[s]
+		s++
+		switch tag & 3 {
+		case 0:
+			length := int(tag >> 2)
+			if length >= 60 {
+				nb := length - 59
+				if s+nb > len(src) {
+					return nil, errCorrupt
+				}
+				length = 0
+				for i := nb - 1; i >= 0; i-- {
+					length = length<<8 | int(src[s+i])
+				}
+				s += nb
+			}
+			length++
+			if length <= 0 || s+length > len(src) || len(dst)+length > int(n) {
+				return nil, errCorrupt
+			}
+			dst = append(dst, src[s:s+length]...)
+			s += length
+		case 1:
+			if s >= len(src) {
+				return nil, errCorrupt
+			}
+			length := 4 + int(tag>>2)&7
+			offset := int(tag&0xe0)<<3 | int(src[s])
+			s++
+			if offset == 0 || offset > len(dst) || len(dst)+length > int(n) {
+				return nil, errCorrupt
+			}
+			for i := 0; i < length; i++ {
+				dst = append(dst, dst[len(dst)-offset])
+			}
+		case 2:
+			if s+2 > len(src) {
+				return nil, errCorrupt
+			}
+			length := 1 + int(tag>>2)
+			offset := int(binary.LittleEndian.Uint16(src[s:]))
+			s += 2
+			if offset == 0 || offset > len(dst) || len(dst)+length > int(n) {
+				return nil, errCorrupt
+			}
+			for i := 0; i < length; i++ {
+				dst = append(dst, dst[len(dst)-offset])
+			}
+		case 3:
+			if s+4 > len(src) {
+				return nil, errCorrupt
+			}
+			length := 1 + int(tag>>2)
+			offset := int(binary.LittleEndian.Uint32(src[s:]))
+			s += 4
+			if offset <= 0 || offset > len(dst) || len(dst)+length > int(n) {
+				return nil, errCorrupt
+			}
+			for i := 0; i < length; i++ {
+				dst = append(dst, dst[len(dst)-offset])
+			}
+		}
+	}
+	if len(dst) != int(n) {
+		return nil, errCorrupt
+	}
+	return dst, nil
+}
+
+// protoField is a field of a protobuf message.
+type protoField struct {
+	num  int
+	wire int
+	// Value of varint and fixed fields.
+	v uint64
+	// Value of length delimited fields.
+	b []byte
+}
+
+var errProtoMalformed = errors.New("malformed protobuf message")
+
+// protoFields decodes the fields of a protobuf message.
+func protoFields(b []byte, fn func(f *protoField) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoMalformed
+		}
+		b = b[n:]
+		f := &protoField{num: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case 0:
+			if f.v, n = binary.Uvarint(b); n <= 0 {
+				return errProtoMalformed
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errProtoMalformed
+			}
+			f.v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errProtoMalformed
+			}
+			f.b, b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return errProtoMalformed
+			}
+			f.v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return errProtoMalformed
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promSample is a sample of a time series.
+type promSample struct {
+	Value     string `json:"value"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// promSeries is a time series of a remote-write request.
+type promSeries struct {
+	Labels  map[string]string `json:"labels"`
+	Samples []promSample      `json:"samples"`
+}
+
+// decodePromWriteRequest returns the time series of a WriteRequest.
+// Metadata, exemplars and histograms are ignored.
+func decodePromWriteRequest(b []byte) ([]*promSeries, error) {
+	var series []*promSeries
+	err := protoFields(b, func(f *protoField) error {
+		if f.num != 1 || f.wire != 2 {
+			return nil
+		}
+		ts := &promSeries{Labels: make(map[string]string)}
+		err := protoFields(f.b, func(f *protoField) error {
+			if f.wire != 2 {
+				return nil
+			}
+			switch f.num {
+			case 1:
+				var name, value string
+				err := protoFields(f.b, func(f *protoField) error {
+					switch {
+					case f.num == 1 && f.wire == 2:
+						name = string(f.b)
+					case f.num == 2 && f.wire == 2:
+						value = string(f.b)
+					}
+					return nil
+				})
+				if err != nil || name == _EMPTY_ {
+					return errProtoMalformed
+				}
+				ts.Labels[name] = value
+			case 2:
+				var s promSample
+				var v float64
+				err := protoFields(f.b, func(f *protoField) error {
+					switch {
+					case f.num == 1 && f.wire == 1:
+						v = math.Float64frombits(f.v)
+					case f.num == 2 && f.wire == 0:
+						s.Timestamp = int64(f.v)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				s.Value = strconv.FormatFloat(v, 'g', -1, 64)
+				ts.Samples = append(ts.Samples, s)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		series = append(series, ts)
+		return nil
+	})
+	return series, err
+}
+
+// promSubjectToken returns the label value as a subject token.
+func promSubjectToken(v string) string {
+	if v == _EMPTY_ {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, v)
+}
+
+// subject returns the subject of the time series.
+func (o *PromWriteOpts) subject(ts *promSeries) string {
+	tokens := strings.Split(o.Subject, tsep)
+	for i, t := range tokens {
+		if isPromLabelToken(t) {
+			tokens[i] = promSubjectToken(ts.Labels[t[1:len(t)-1]])
+		}
+	}
+	return strings.Join(tokens, tsep)
+}
+
+// HandlePromWrite publishes the time series of a Prometheus remote-write
+// request.
+func (s *Server) HandlePromWrite(w http.ResponseWriter, r *http.Request) {
+	po := s.getOpts().PrometheusWrite
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if po.Token != _EMPTY_ {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(po.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nats"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	if ct := r.Header.Get("Content-Type"); ct != _EMPTY_ {
+		mt, params, err := mime.ParseMediaType(ct)
+		if err != nil || mt != "application/x-protobuf" ||
+			(params["proto"] != _EMPTY_ && params["proto"] != "prometheus.WriteRequest") {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	if ce := r.Header.Get("Content-Encoding"); ce != _EMPTY_ && ce != "snappy" {
+		http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, promWriteMaxSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if body, err = snappyDecode(body, promWriteMaxSize); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := decodePromWriteRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	acc := s.GlobalAccount()
+	if po.Account != _EMPTY_ {
+		if acc, err = s.LookupAccount(po.Account); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if po.Stream != _EMPTY_ {
+		if _, err := acc.LookupStream(po.Stream); err != nil {
+			_, err = acc.AddStream(&StreamConfig{Name: po.Stream, Subjects: []string{po.streamSubject()}})
+			// Ignore streams created concurrently.
+			if _, lerr := acc.LookupStream(po.Stream); err != nil && lerr != nil {
+				s.Errorf("Prometheus remote-write can not create stream %q: %v", po.Stream, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	c := s.createInternalAccountClient()
+	if err := c.registerWithAccount(acc); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer c.closeConnection(ClientClosed)
+	for _, ts := range series {
+		data, err := json.Marshal(ts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c.processInternalMsg(po.subject(ts), _EMPTY_, nil, data)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
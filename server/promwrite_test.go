@@ -0,0 +1,210 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Encoding of remote-write requests.
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func protoAppendKey(b []byte, num, wire int) []byte {
+	return appendUvarint(b, uint64(num<<3|wire))
+}
+
+func protoAppendBytes(b []byte, num int, v []byte) []byte {
+	b = protoAppendKey(b, num, 2)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func encodePromWriteRequest(series []*promSeries, values [][]float64) []byte {
+	var req []byte
+	for i, ts := range series {
+		var tsb []byte
+		for name, value := range ts.Labels {
+			var lb []byte
+			lb = protoAppendBytes(lb, 1, []byte(name))
+			lb = protoAppendBytes(lb, 2, []byte(value))
+			tsb = protoAppendBytes(tsb, 1, lb)
+		}
+		for j, s := range ts.Samples {
+			var sb []byte
+			sb = protoAppendKey(sb, 1, 1)
+			var vb [8]byte
+			binary.LittleEndian.PutUint64(vb[:], math.Float64bits(values[i][j]))
+			sb = append(sb, vb[:]...)
+			sb = protoAppendKey(sb, 2, 0)
+			sb = appendUvarint(sb, uint64(s.Timestamp))
+			tsb = protoAppendBytes(tsb, 2, sb)
+		}
+		req = protoAppendBytes(req, 1, tsb)
+	}
+	// Metadata is ignored.
+	return protoAppendBytes(req, 3, []byte{0x08, 0x01})
+}
+
+// snappyEncodeLiteral encodes the data as a single snappy literal.
+func snappyEncodeLiteral(data []byte) []byte {
+	b := appendUvarint(nil, uint64(len(data)))
+	if n := len(data) - 1; n < 60 {
+		b = append(b, byte(n<<2))
+	} else {
+		b = append(b, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	}
+	return append(b, data...)
+}
+
+func TestPromWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "promwrite")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		http: "127.0.0.1:-1"
+		jetstream: { store_dir: %q }
+		prometheus_write {
+			subject: "metrics.{job}.{__name__}"
+			stream: METRICS
+			token: s3cr3t
+		}
+	`, filepath.Join(dir, "js"))))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "metrics.>")
+	natsFlush(t, nc)
+
+	url := fmt.Sprintf("http://%s%s", s.MonitorAddr(), DefaultPromWritePath)
+	post := func(body []byte, token string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	series := []*promSeries{
+		{Labels: map[string]string{"__name__": "up", "job": "node.1"}, Samples: []promSample{{Timestamp: 1000}, {Timestamp: 2000}}},
+		{Labels: map[string]string{"__name__": "stale"}, Samples: []promSample{{Timestamp: 3000}}},
+	}
+	body := snappyEncodeLiteral(encodePromWriteRequest(series, [][]float64{{1, 0.5}, {math.NaN()}}))
+	if status := post(body, "bad"); status != http.StatusUnauthorized {
+		t.Fatalf("Expected unauthorized, got %d", status)
+	}
+	if status := post(body, "s3cr3t"); status != http.StatusNoContent {
+		t.Fatalf("Expected no content, got %d", status)
+	}
+	for _, expected := range []struct {
+		subject string
+		series  promSeries
+	}{
+		{"metrics.node_1.up", promSeries{Labels: series[0].Labels, Samples: []promSample{{"1", 1000}, {"0.5", 2000}}}},
+		{"metrics._.stale", promSeries{Labels: series[1].Labels, Samples: []promSample{{"NaN", 3000}}}},
+	} {
+		m := natsNexMsg(t, sub, time.Second)
+		var ts promSeries
+		if err := json.Unmarshal(m.Data, &ts); err != nil {
+			t.Fatalf("Error decoding %q: %v", m.Data, err)
+		}
+		if m.Subject != expected.subject || fmt.Sprint(ts) != fmt.Sprint(expected.series) {
+			t.Fatalf("Unexpected message on %q: %+v", m.Subject, ts)
+		}
+	}
+	mset, err := s.GlobalAccount().LookupStream("METRICS")
+	if err != nil {
+		t.Fatalf("Expected stream to be created: %v", err)
+	}
+	if state := mset.State(); state.Msgs != 2 {
+		t.Fatalf("Expected 2 stored messages, got %d", state.Msgs)
+	}
+
+	if status := post([]byte{0x10, 0xff}, "s3cr3t"); status != http.StatusBadRequest {
+		t.Fatalf("Expected bad request, got %d", status)
+	}
+	if status := post(snappyEncodeLiteral([]byte{0x0a, 0x10}), "s3cr3t"); status != http.StatusBadRequest {
+		t.Fatalf("Expected bad request, got %d", status)
+	}
+	if m, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Unexpected message %v or error %v", m, err)
+	}
+}
+
+func TestPromWriteSnappy(t *testing.T) {
+	// "abcabcabcd" with a literal and a copy with a 1 byte offset.
+	src := []byte{10, 2 << 2, 'a', 'b', 'c', 1 | (6-4)<<2, 3, 0, 'd'}
+	if dst, err := snappyDecode(src, 100); err != nil || string(dst) != "abcabcabcd" {
+		t.Fatalf("Unexpected result %q: %v", dst, err)
+	}
+	// Copy with a 2 bytes offset.
+	src = []byte{6, 2 << 2, 'x', 'y', 'z', 2 | (3-1)<<2, 3, 0}
+	if dst, err := snappyDecode(src, 100); err != nil || string(dst) != "xyzxyz" {
+		t.Fatalf("Unexpected result %q: %v", dst, err)
+	}
+	big := bytes.Repeat([]byte("m"), 1000)
+	if dst, err := snappyDecode(snappyEncodeLiteral(big), 1000); err != nil || !bytes.Equal(dst, big) {
+		t.Fatalf("Unexpected result: %v", err)
+	}
+	for _, src := range [][]byte{
+		snappyEncodeLiteral(big)[:100],
+		{4, 1 | 0<<2, 1},
+		{200, 1},
+	} {
+		if _, err := snappyDecode(src, 100); err == nil {
+			t.Fatalf("Expected error decoding %v", src)
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.HTTPPort = 0
+	opts.PrometheusWrite.Subject = "metrics.{__name__}"
+	if err := validatePromWriteOptions(opts); err == nil || !strings.Contains(err.Error(), "monitoring") {
+		t.Fatalf("Expected error about monitoring, got %v", err)
+	}
+	opts.HTTPPort = -1
+	opts.PrometheusWrite.Subject = "metrics.{a}b"
+	if err := validatePromWriteOptions(opts); err == nil || !strings.Contains(err.Error(), "token") {
+		t.Fatalf("Expected error about token, got %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// A client can claim the exclusive right to publish on a subject pattern
+// of its account for the lifetime of its connection, e.g. to be the single
+// writer of a state stream, by sending a PublisherClaimRequest to
+// $PUBLISHER.CLAIM with a reply subject. While the claim is held, the
+// messages other clients of the account publish on subjects matching the
+// pattern are rejected with a permissions violation. A claim can not
+// overlap the claims of other clients, unless it is a takeover by a client
+// of the same user, e.g. a new instance of a writer replacing one that is
+// stuck, in which case the previous owner loses its claims. Claims are
+// released with $PUBLISHER.RELEASE, or when the connection closes.
+// Claims are held and enforced by each server for its own clients.
+
+const (
+	// PublisherClaimSubject is the subject of the requests claiming a
+	// subject pattern.
+	PublisherClaimSubject = "$PUBLISHER.CLAIM"
+	// PublisherReleaseSubject is the subject of the requests releasing a
+	// claimed subject pattern.
+	PublisherReleaseSubject = "$PUBLISHER.RELEASE"
+
+	// Maximum number of claims held by a client.
+	maxPublisherClaims = 1024
+)
+
+// PublisherClaimRequest claims or releases a subject pattern.
+type PublisherClaimRequest struct {
+	Subject string `json:"subject"`
+	// Takeover the claims of another client of the same user.
+	Takeover bool `json:"takeover,omitempty"`
+}
+
+// PublisherClaimResponse is the response to a PublisherClaimRequest.
+type PublisherClaimResponse struct {
+	Subject string `json:"subject,omitempty"`
+	Claimed bool   `json:"claimed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// publisherClaims are the claimed subject patterns of an account.
+type publisherClaims struct {
+	// Number of claims, to skip the checks without any.
+	n  int32
+	mu sync.Mutex
+	// Owners by subject pattern.
+	owners map[string]*client
+}
+
+// publisherClaims returns the claims of the account, creating them if
+// requested.
+func (a *Account) publisherClaims(create bool) *publisherClaims {
+	a.mu.RLock()
+	pc := a.pubClaims
+	a.mu.RUnlock()
+	if pc != nil || !create {
+		return pc
+	}
+	a.mu.Lock()
+	if a.pubClaims == nil {
+		a.pubClaims = &publisherClaims{owners: make(map[string]*client)}
+	}
+	pc = a.pubClaims
+	a.mu.Unlock()
+	return pc
+}
+
+// claimIdentity returns the identity of the user of the client, used for
+// takeovers.
+func claimIdentity(c *client) string {
+	if c.opts.Nkey != _EMPTY_ {
+		return c.opts.Nkey
+	}
+	return c.opts.Username
+}
+
+// claim claims the subject pattern for the client.
+func (pc *publisherClaims) claim(c *client, subject string, takeover bool) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	var (
+		taken []string
+		held  int
+	)
+	for s, owner := range pc.owners {
+		if owner == c {
+			held++
+			continue
+		}
+		if !SubjectsCollide(s, subject) {
+			continue
+		}
+		if !takeover {
+			return fmt.Errorf("subject %q is claimed", s)
+		}
+		if id := claimIdentity(c); id == _EMPTY_ || id != claimIdentity(owner) {
+			return fmt.Errorf("subject %q is claimed by another user", s)
+		}
+		taken = append(taken, s)
+	}
+	if _, ok := pc.owners[subject]; !ok && held >= maxPublisherClaims {
+		return fmt.Errorf("maximum number of claims reached")
+	}
+	for _, s := range taken {
+		owner := pc.owners[s]
+		delete(pc.owners, s)
+		c.Noticef("Took over publisher claim on %q from client %d", s, owner.cid)
+	}
+	pc.owners[subject] = c
+	atomic.StoreInt32(&pc.n, int32(len(pc.owners)))
+	return nil
+}
+
+// release releases the subject pattern claimed by the client.
+func (pc *publisherClaims) release(c *client, subject string) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.owners[subject] != c {
+		return fmt.Errorf("subject %q is not claimed", subject)
+	}
+	delete(pc.owners, subject)
+	atomic.StoreInt32(&pc.n, int32(len(pc.owners)))
+	return nil
+}
+
+// releaseAll releases the subject patterns claimed by the client.
+func (pc *publisherClaims) releaseAll(c *client) {
+	if atomic.LoadInt32(&pc.n) == 0 {
+		return
+	}
+	pc.mu.Lock()
+	for s, owner := range pc.owners {
+		if owner == c {
+			delete(pc.owners, s)
+		}
+	}
+	atomic.StoreInt32(&pc.n, int32(len(pc.owners)))
+	pc.mu.Unlock()
+}
+
+// allowed returns false if the subject is claimed by another client.
+func (pc *publisherClaims) allowed(c *client, subject string) bool {
+	if atomic.LoadInt32(&pc.n) == 0 {
+		return true
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for s, owner := range pc.owners {
+		if owner != c && subjectIsSubsetMatch(subject, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// releasePublisherClaims releases the claims of the client in the account.
+func (a *Account) releasePublisherClaims(c *client) {
+	if pc := a.publisherClaims(false); pc != nil {
+		pc.releaseAll(c)
+	}
+}
+
+// isPublisherClaimRequest returns true if the subject is the one of claim
+// or release requests.
+func isPublisherClaimRequest(subject []byte) bool {
+	s := string(subject)
+	return s == PublisherClaimSubject || s == PublisherReleaseSubject
+}
+
+// processPublisherClaim claims or releases the subject pattern of the
+// request, and responds to its reply subject, if any.
+func (c *client) processPublisherClaim(msg []byte) {
+	acc, srv := c.acc, c.srv
+	subject, reply := string(c.pa.subject), string(c.pa.reply)
+	claim := subject == PublisherClaimSubject
+	var body []byte
+	if c.pa.hdr > 0 && c.pa.hdr <= len(msg)-LEN_CR_LF {
+		body = msg[c.pa.hdr : len(msg)-LEN_CR_LF]
+	} else {
+		body = msg[:len(msg)-LEN_CR_LF]
+	}
+
+	var req PublisherClaimRequest
+	resp := &PublisherClaimResponse{}
+	err := json.Unmarshal(body, &req)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("invalid request: %v", err)
+	case !IsValidSubject(req.Subject):
+		err = fmt.Errorf("invalid subject %q", req.Subject)
+	case claim && c.perms != nil && (c.perms.pub.allow != nil || c.perms.pub.deny != nil) && !c.pubAllowed(req.Subject):
+		err = fmt.Errorf("publish to %q not allowed", req.Subject)
+	case claim:
+		err = acc.publisherClaims(true).claim(c, req.Subject, req.Takeover)
+	default:
+		if pc := acc.publisherClaims(false); pc != nil {
+			err = pc.release(c, req.Subject)
+		} else {
+			err = fmt.Errorf("subject %q is not claimed", req.Subject)
+		}
+	}
+	resp.Subject = req.Subject
+	if err != nil {
+		c.Debugf("Publisher claim request on %q failed: %v", subject, err)
+		resp.Error = err.Error()
+	} else {
+		resp.Claimed = claim
+	}
+	if reply != _EMPTY_ {
+		srv.sendInternalAccountMsg(acc, reply, resp)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestPublisherClaims(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A: { users: [{user: writer, password: pwd}, {user: other, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	connect := func(user string) *nats.Conn {
+		t.Helper()
+		return natsConnect(t, s.ClientURL(), nats.UserInfo(user, "pwd"),
+			nats.ErrorHandler(func(*nats.Conn, *nats.Subscription, error) {}))
+	}
+	request := func(nc *nats.Conn, subject string, req *PublisherClaimRequest) *PublisherClaimResponse {
+		t.Helper()
+		b, _ := json.Marshal(req)
+		msg, err := nc.Request(subject, b, time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		var resp PublisherClaimResponse
+		if err := json.Unmarshal(msg.Data, &resp); err != nil {
+			t.Fatalf("Error decoding response: %v", err)
+		}
+		return &resp
+	}
+
+	sub := connect("other")
+	defer sub.Close()
+	msgs := natsSubSync(t, sub, "state.>")
+	natsFlush(t, sub)
+
+	// Publishes the payload, checking whether it is received.
+	checkPub := func(nc *nats.Conn, subject string, expected bool) {
+		t.Helper()
+		natsPub(t, nc, subject, []byte(subject))
+		natsFlush(t, nc)
+		msg, err := msgs.NextMsg(100 * time.Millisecond)
+		if expected && err != nil {
+			t.Fatalf("Expected message on %q: %v", subject, err)
+		} else if !expected && err == nil {
+			t.Fatalf("Unexpected message on %q", msg.Subject)
+		}
+	}
+
+	w1 := connect("writer")
+	defer w1.Close()
+	w2 := connect("writer")
+	defer w2.Close()
+	other := connect("other")
+	defer other.Close()
+
+	if resp := request(w1, PublisherClaimSubject, &PublisherClaimRequest{Subject: "state.>"}); !resp.Claimed || resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkPub(w1, "state.a", true)
+	checkPub(other, "state.a", false)
+
+	// Overlapping claims are rejected without a takeover by the same user.
+	if resp := request(w2, PublisherClaimSubject, &PublisherClaimRequest{Subject: "state.a"}); resp.Claimed || !strings.Contains(resp.Error, "claimed") {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if resp := request(other, PublisherClaimSubject, &PublisherClaimRequest{Subject: "state.*", Takeover: true}); resp.Claimed || !strings.Contains(resp.Error, "another user") {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if resp := request(w2, PublisherClaimSubject, &PublisherClaimRequest{Subject: "state.*", Takeover: true}); !resp.Claimed {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkPub(w2, "state.a", true)
+	checkPub(w1, "state.a", false)
+	checkPub(other, "state.a.b", true)
+
+	// Only the owner can release a claim.
+	if resp := request(w1, PublisherReleaseSubject, &PublisherClaimRequest{Subject: "state.*"}); resp.Error == _EMPTY_ {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if resp := request(w2, PublisherReleaseSubject, &PublisherClaimRequest{Subject: "state.*"}); resp.Error != _EMPTY_ || resp.Claimed {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkPub(other, "state.a", true)
+
+	// Claims are released when the connection closes.
+	if resp := request(w2, PublisherClaimSubject, &PublisherClaimRequest{Subject: "state.b"}); !resp.Claimed {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkPub(other, "state.b", false)
+	w2.Close()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if pc := s.globalAccount().publisherClaims(false); pc != nil {
+			t.Fatalf("Unexpected claims in the global account")
+		}
+		acc, _ := s.LookupAccount("A")
+		pc := acc.publisherClaims(false)
+		pc.mu.Lock()
+		n := len(pc.owners)
+		pc.mu.Unlock()
+		if n != 0 {
+			return fmt.Errorf("expected no claims, got %d", n)
+		}
+		return nil
+	})
+	checkPub(other, "state.b", true)
+
+	if resp := request(other, PublisherClaimSubject, &PublisherClaimRequest{Subject: "bad..subject"}); resp.Error == _EMPTY_ {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Publish permissions can carry rate limits, in messages and bytes per
+// second, on the subjects matching a subject. Messages of a client beyond
+// a limit are dropped instead of the client being disconnected, and the
+// client is sent a permissions violation error, that clients do not treat
+// as fatal, at most once per second per limit. Dropped messages are
+// counted in connz and varz.
+
+// How often a throttled client is notified.
+const pubRateNotifyInterval = time.Second
+
+// PublishRateLimit limits the rate at which a user publishes on the
+// subjects matching Subject. A rate of 0 is unlimited.
+type PublishRateLimit struct {
+	Subject     string `json:"subject"`
+	MsgsPerSec  int64  `json:"msgs_per_sec,omitempty"`
+	BytesPerSec int64  `json:"bytes_per_sec,omitempty"`
+}
+
+func (l *PublishRateLimit) validate() error {
+	if !IsValidSubject(l.Subject) {
+		return fmt.Errorf("publish rate limit subject %q is not a valid subject", l.Subject)
+	}
+	if l.MsgsPerSec < 0 || l.BytesPerSec < 0 {
+		return fmt.Errorf("publish rate limit of %q can not be negative", l.Subject)
+	}
+	if l.MsgsPerSec == 0 && l.BytesPerSec == 0 {
+		return fmt.Errorf("publish rate limit of %q requires msgs or bytes per second", l.Subject)
+	}
+	return nil
+}
+
+// pubRateLimiter is the token bucket of a publish rate limit of a client.
+// It holds up to one second of messages and bytes. It is only used from
+// the readLoop of the client.
+type pubRateLimiter struct {
+	*PublishRateLimit
+	msgs     float64
+	bytes    float64
+	last     time.Time
+	notified time.Time
+}
+
+func newPubRateLimiters(limits []*PublishRateLimit) []*pubRateLimiter {
+	if len(limits) == 0 {
+		return nil
+	}
+	now := time.Now()
+	rls := make([]*pubRateLimiter, 0, len(limits))
+	for _, l := range limits {
+		rls = append(rls, &pubRateLimiter{
+			PublishRateLimit: l,
+			msgs:             float64(l.MsgsPerSec),
+			bytes:            float64(l.BytesPerSec),
+			last:             now,
+		})
+	}
+	return rls
+}
+
+// refill returns the tokens of the bucket, refilled at rate per second up
+// to rate.
+func refill(tokens float64, rate int64, elapsed time.Duration) float64 {
+	if tokens += elapsed.Seconds() * float64(rate); tokens > float64(rate) {
+		tokens = float64(rate)
+	}
+	return tokens
+}
+
+// allow returns true and takes the tokens of the message if the limit
+// allows it. A message larger than the bytes per second is allowed when
+// the bucket is full.
+func (rl *pubRateLimiter) allow(now time.Time, size int64) bool {
+	elapsed := now.Sub(rl.last)
+	rl.last = now
+	if rl.MsgsPerSec > 0 {
+		if rl.msgs = refill(rl.msgs, rl.MsgsPerSec, elapsed); rl.msgs < 1 {
+			return false
+		}
+	}
+	if rl.BytesPerSec > 0 {
+		rl.bytes = refill(rl.bytes, rl.BytesPerSec, elapsed)
+		if rl.bytes < float64(size) && rl.bytes < float64(rl.BytesPerSec) {
+			return false
+		}
+	}
+	rl.msgs--
+	rl.bytes -= float64(size)
+	return true
+}
+
+// pubRateAllowed returns false if the message exceeds one of the publish
+// rate limits of its subject, in which case it is dropped.
+func (c *client) pubRateAllowed(subject string, size int64) bool {
+	now := time.Now()
+	for _, rl := range c.perms.rates {
+		if !matchLiteral(subject, rl.Subject) || rl.allow(now, size) {
+			continue
+		}
+		atomic.AddInt64(&c.throttledMsgs, 1)
+		if c.srv != nil {
+			atomic.AddInt64(&c.srv.throttledMsgs, 1)
+		}
+		if now.Sub(rl.notified) >= pubRateNotifyInterval {
+			rl.notified = now
+			c.sendErr(fmt.Sprintf("Permissions Violation for Publish to %q, Rate Limit Exceeded", subject))
+			c.Warnf("Publish Rate Limit Exceeded - %s, Subject %q, Limit %q", c.getAuthUser(), subject, rl.Subject)
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestPublishRateLimits(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users = [
+				{user: a, password: pwd, permissions: {
+					rate_limits: [{subject: "hot.>", msgs: 5}, {subject: "big", bytes_per_sec: 1KB}]
+				}}
+			]
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if l := opts.Users[0].Permissions.PublishRateLimits; len(l) != 2 || l[1].Subject != "big" || l[1].BytesPerSec != 1024 {
+		t.Fatalf("Unexpected rate limits: %+v", l)
+	}
+
+	errCh := make(chan error, 10)
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	defer nc.Close()
+	hot := natsSubSync(t, nc, "hot.>")
+	cold := natsSubSync(t, nc, "cold")
+	natsFlush(t, nc)
+
+	for i := 0; i < 20; i++ {
+		natsPub(t, nc, "hot.x", []byte("msg"))
+		natsPub(t, nc, "cold", []byte("msg"))
+	}
+	natsFlush(t, nc)
+
+	// Only the hot subject is throttled, and the client is not disconnected.
+	checkSubsPending(t, cold, 20)
+	if n, _, _ := hot.Pending(); n < 5 || n > 6 {
+		t.Fatalf("Expected about 5 messages on the hot subject, got %d", n)
+	}
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "Rate Limit Exceeded") {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a rate limit error")
+	}
+	if !nc.IsConnected() {
+		t.Fatal("Expected the client to still be connected")
+	}
+
+	// Messages larger than the byte rate pass when the bucket is full.
+	big := natsSubSync(t, nc, "big")
+	natsFlush(t, nc)
+	natsPub(t, nc, "big", make([]byte, 2048))
+	natsPub(t, nc, "big", make([]byte, 10))
+	natsFlush(t, nc)
+	checkSubsPending(t, big, 1)
+
+	v, _ := s.Varz(nil)
+	cz, _ := s.Connz(nil)
+	if v.ThrottledMsgs < 15 || len(cz.Conns) != 1 || cz.Conns[0].ThrottledMsgs != v.ThrottledMsgs {
+		t.Fatalf("Unexpected throttled counts, varz %d, connz %+v", v.ThrottledMsgs, cz.Conns)
+	}
+
+	// Rates are validated.
+	for _, l := range []*PublishRateLimit{{Subject: "foo..bar", MsgsPerSec: 1}, {Subject: "foo", MsgsPerSec: -1}, {Subject: "foo"}} {
+		if err := l.validate(); err == nil {
+			t.Fatalf("Expected error for %+v", l)
+		}
+	}
+}
+
+func checkSubsPending(t *testing.T, sub *nats.Subscription, expected int) {
+	t.Helper()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n, _, _ := sub.Pending(); n != expected {
+			return fmt.Errorf("expected %d pending messages, got %d", expected, n)
+		}
+		return nil
+	})
+}
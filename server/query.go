@@ -0,0 +1,383 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Streams can be queried in place, to select the messages in a time range
+// and on a subject whose JSON payload matches predicates, or to aggregate
+// fields of these messages, optionally grouped by a field. Queries scan the
+// stream from their start and are bounded by the number of messages
+// scanned and returned and by their duration. A truncated result has the
+// sequence of the last scanned message, to continue from the next one.
+
+const (
+	// Default and maximum number of messages returned.
+	jsQueryDefaultLimit = 100
+	jsQueryMaxLimit     = JSApiListLimit
+	// Maximum size of the payloads of returned messages.
+	jsQueryMaxBytes = 1024 * 1024
+	// Default and maximum number of messages scanned.
+	jsQueryDefaultMaxScan = 100000
+	jsQueryMaxScan        = 1000000
+	// Maximum number of groups of aggregates.
+	jsQueryMaxGroups = 1024
+	// Maximum duration of queries.
+	jsQueryMaxDuration = 2 * time.Second
+)
+
+// Name of the pseudo field of the subject of messages, for grouping.
+const jsQuerySubjectField = "$subject"
+
+// StreamQueryPredicate compares a field of the JSON payload of messages,
+// a path of object keys and array indexes separated by dots, to a value.
+type StreamQueryPredicate struct {
+	Field string `json:"field"`
+	// Op is one of eq, ne, gt, gte, lt, lte and exists.
+	Op    string      `json:"op"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// StreamQueryAggregate is a function of the matching messages, one of
+// count, sum, avg, min and max. Functions other than count apply to a
+// numeric field, ignoring messages without it, and are null without any.
+type StreamQueryAggregate struct {
+	Func  string `json:"func"`
+	Field string `json:"field,omitempty"`
+}
+
+// StreamQueryGroup holds the values of the aggregates, in the order of the
+// request, for the messages with the same value of the group field.
+type StreamQueryGroup struct {
+	Key    interface{} `json:"key,omitempty"`
+	Values []*float64  `json:"values"`
+	// State of the aggregates.
+	count []float64
+	sums  []float64
+}
+
+// StreamQueryResult is the result of a query.
+type StreamQueryResult struct {
+	Scanned  uint64              `json:"scanned"`
+	Matched  uint64              `json:"matched"`
+	Messages []*StoredMsg        `json:"messages,omitempty"`
+	Groups   []*StreamQueryGroup `json:"groups,omitempty"`
+	// Truncated is set when the query stopped at a limit before the end of
+	// the stream or of its time range.
+	Truncated bool   `json:"truncated,omitempty"`
+	LastSeq   uint64 `json:"last_seq,omitempty"`
+}
+
+// validate checks the request and sets its defaults.
+func (req *JSApiStreamQueryRequest) validate() error {
+	if req.Subject != _EMPTY_ && !IsValidSubject(req.Subject) {
+		return fmt.Errorf("invalid subject %q", req.Subject)
+	}
+	if req.StartTime != nil && req.EndTime != nil && req.EndTime.Before(*req.StartTime) {
+		return fmt.Errorf("end time before start time")
+	}
+	for _, p := range req.Where {
+		if p.Field == _EMPTY_ {
+			return fmt.Errorf("predicate without field")
+		}
+		switch p.Op {
+		case "eq", "ne", "exists":
+		case "gt", "gte", "lt", "lte":
+			switch p.Value.(type) {
+			case float64, string:
+			default:
+				return fmt.Errorf("predicate %q on %q requires a number or string", p.Op, p.Field)
+			}
+		default:
+			return fmt.Errorf("unknown predicate %q", p.Op)
+		}
+	}
+	for _, a := range req.Aggregates {
+		switch a.Func {
+		case "count":
+		case "sum", "avg", "min", "max":
+			if a.Field == _EMPTY_ {
+				return fmt.Errorf("aggregate %q requires a field", a.Func)
+			}
+		default:
+			return fmt.Errorf("unknown aggregate %q", a.Func)
+		}
+	}
+	if req.GroupBy != _EMPTY_ && len(req.Aggregates) == 0 {
+		return fmt.Errorf("group by requires aggregates")
+	}
+	if req.Limit < 0 || req.MaxScan < 0 {
+		return fmt.Errorf("limits can not be negative")
+	}
+	if req.Limit == 0 {
+		req.Limit = jsQueryDefaultLimit
+	} else if req.Limit > jsQueryMaxLimit {
+		req.Limit = jsQueryMaxLimit
+	}
+	if req.MaxScan == 0 {
+		req.MaxScan = jsQueryDefaultMaxScan
+	} else if req.MaxScan > jsQueryMaxScan {
+		req.MaxScan = jsQueryMaxScan
+	}
+	return nil
+}
+
+// jsonField returns the value of the field of the document.
+func jsonField(doc interface{}, field string) (interface{}, bool) {
+	for _, k := range strings.Split(field, tsep) {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc, ok = v[k]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// matches evaluates the predicate on the document.
+func (p *StreamQueryPredicate) matches(doc interface{}) bool {
+	v, ok := jsonField(doc, p.Field)
+	switch p.Op {
+	case "exists":
+		return ok
+	case "eq":
+		return ok && reflect.DeepEqual(v, p.Value)
+	case "ne":
+		return !ok || !reflect.DeepEqual(v, p.Value)
+	}
+	if !ok {
+		return false
+	}
+	var cmp int
+	switch pv := p.Value.(type) {
+	case float64:
+		f, ok := v.(float64)
+		if !ok {
+			return false
+		}
+		if f < pv {
+			cmp = -1
+		} else if f > pv {
+			cmp = 1
+		}
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(s, pv)
+	}
+	switch p.Op {
+	case "gt":
+		return cmp > 0
+	case "gte":
+		return cmp >= 0
+	case "lt":
+		return cmp < 0
+	case "lte":
+		return cmp <= 0
+	}
+	return false
+}
+
+// add accumulates the values of the aggregates for the document.
+func (g *StreamQueryGroup) add(aggs []*StreamQueryAggregate, doc interface{}) {
+	for i, a := range aggs {
+		if a.Func == "count" {
+			g.count[i]++
+			continue
+		}
+		v, _ := jsonField(doc, a.Field)
+		f, ok := v.(float64)
+		if !ok {
+			continue
+		}
+		g.count[i]++
+		g.sums[i] += f
+		switch cur := g.Values[i]; {
+		case a.Func == "min" && (cur == nil || f < *cur), a.Func == "max" && (cur == nil || f > *cur):
+			g.Values[i] = &f
+		}
+	}
+}
+
+// finish computes the values of the aggregates.
+func (g *StreamQueryGroup) finish(aggs []*StreamQueryAggregate) {
+	for i, a := range aggs {
+		var v float64
+		switch a.Func {
+		case "count":
+			v = g.count[i]
+		case "sum", "avg":
+			if g.count[i] == 0 {
+				continue
+			}
+			if v = g.sums[i]; a.Func == "avg" {
+				v /= g.count[i]
+			}
+		default:
+			continue
+		}
+		g.Values[i] = &v
+	}
+}
+
+// Query scans the stream for the messages matching the request.
+func (mset *Stream) Query(req *JSApiStreamQueryRequest) (*StreamQueryResult, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+	if store == nil {
+		return nil, ErrStoreClosed
+	}
+
+	state := store.State()
+	seq := state.FirstSeq
+	if req.StartSeq > seq {
+		seq = req.StartSeq
+	}
+	if req.StartTime != nil {
+		if tseq := store.GetSeqFromTime(*req.StartTime); tseq > seq {
+			seq = tseq
+		}
+	}
+	var end int64 = math.MaxInt64
+	if req.EndTime != nil {
+		end = req.EndTime.UnixNano()
+	}
+	// Payloads are only decoded when fields are used.
+	decode := len(req.Where) > 0 || len(req.Aggregates) > 0 && (req.GroupBy != _EMPTY_ || hasFieldAggregates(req.Aggregates))
+
+	res := &StreamQueryResult{}
+	groups := make(map[string]*StreamQueryGroup)
+	var size int
+	deadline := time.Now().Add(jsQueryMaxDuration)
+
+scan:
+	for ; seq <= state.LastSeq; seq++ {
+		if res.Scanned >= uint64(req.MaxScan) || (res.Scanned%256 == 255 && time.Now().After(deadline)) {
+			res.Truncated = true
+			break
+		}
+		subj, hdr, data, ts, err := store.LoadMsg(seq)
+		switch err {
+		case nil:
+		case ErrStoreMsgNotFound, errDeletedMsg:
+			continue
+		case ErrStoreEOF:
+			break scan
+		default:
+			return nil, err
+		}
+		if ts > end {
+			break
+		}
+		res.Scanned++
+		if req.Subject != _EMPTY_ && !subjectIsSubsetMatch(subj, req.Subject) {
+			res.LastSeq = seq
+			continue
+		}
+		var doc interface{}
+		if decode && json.Unmarshal(data, &doc) != nil {
+			doc = nil
+		}
+		matched := true
+		for _, p := range req.Where {
+			if !p.matches(doc) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			res.LastSeq = seq
+			continue
+		}
+
+		if len(req.Aggregates) == 0 {
+			if len(res.Messages) >= req.Limit || size+len(data) > jsQueryMaxBytes {
+				res.Truncated = true
+				break
+			}
+			res.Matched++
+			size += len(data)
+			res.Messages = append(res.Messages, &StoredMsg{
+				Subject:  subj,
+				Sequence: seq,
+				Header:   hdr,
+				Data:     data,
+				Time:     time.Unix(0, ts).UTC(),
+			})
+			res.LastSeq = seq
+			continue
+		}
+
+		var key interface{}
+		switch req.GroupBy {
+		case _EMPTY_:
+		case jsQuerySubjectField:
+			key = subj
+		default:
+			key, _ = jsonField(doc, req.GroupBy)
+		}
+		kb, _ := json.Marshal(key)
+		g := groups[string(kb)]
+		if g == nil {
+			if len(groups) >= jsQueryMaxGroups {
+				res.Truncated = true
+				break
+			}
+			n := len(req.Aggregates)
+			g = &StreamQueryGroup{Key: key, Values: make([]*float64, n), count: make([]float64, n), sums: make([]float64, n)}
+			groups[string(kb)] = g
+			res.Groups = append(res.Groups, g)
+		}
+		res.Matched++
+		g.add(req.Aggregates, doc)
+		res.LastSeq = seq
+	}
+	for _, g := range res.Groups {
+		g.finish(req.Aggregates)
+	}
+	return res, nil
+}
+
+func hasFieldAggregates(aggs []*StreamQueryAggregate) bool {
+	for _, a := range aggs {
+		if a.Field != _EMPTY_ {
+			return true
+		}
+	}
+	return false
+}
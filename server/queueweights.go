@@ -0,0 +1,134 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+)
+
+// The members of a queue group of an account can be given weights by the
+// user they connect as, so that e.g. a canary deployment receives 5% of the
+// messages of a queue group while the stable one receives the others:
+//
+//	queue_groups { workers: { weights: { canary: 5, stable: 95 } } }
+//
+// The messages are split between the users by weight, and evenly between
+// the members of a same user. Members of users without a weight, and the
+// routes and leafnodes of the group, have the default weight. With sticky,
+// the messages of a publisher, or with the same ordering key, keep going to
+// the same member while the members do not change. Weights are honored by
+// each server for its own members.
+
+// Default weight of the members of a queue group.
+const queueGroupDefaultWeight = 1
+
+// QueueGroupOpts are the weights of the members of a queue group.
+type QueueGroupOpts struct {
+	// Weights of the members by the username of their connection.
+	Weights map[string]int
+	// DefaultWeight of the members of users without a weight, 1 unless
+	// configured.
+	DefaultWeight int
+	// Sticky sends the messages of a publisher to the same member.
+	Sticky bool
+}
+
+func (qg *QueueGroupOpts) weight(sub *subscription) int {
+	if sub.client.kind == CLIENT {
+		if w, ok := qg.Weights[sub.client.opts.Username]; ok {
+			return w
+		}
+	}
+	return qg.DefaultWeight
+}
+
+// queueGroupOpts returns the options of the queue groups of the account.
+func (a *Account) queueGroupOpts() map[string]*QueueGroupOpts {
+	a.mu.RLock()
+	qgs := a.queueGroups
+	a.mu.RUnlock()
+	return qgs
+}
+
+// weightedQueueIndex returns the index of the member of the queue group
+// selected by weight, randomly or by the key when sticky, or -1 if all the
+// members have a weight of 0, the member being then selected as without
+// weights.
+func (c *client) weightedQueueIndex(qg *QueueGroupOpts, qsubs []*subscription, key []byte) int {
+	// The weight of a user is split between its members.
+	members := make(map[string]int, len(qsubs))
+	for _, sub := range qsubs {
+		if sub != nil && sub.client != nil && sub.client.kind == CLIENT {
+			members[sub.client.opts.Username]++
+		}
+	}
+	weights := make([]float64, len(qsubs))
+	total := 0.0
+	for i, sub := range qsubs {
+		if sub == nil || sub.client == nil {
+			continue
+		}
+		w := float64(qg.weight(sub))
+		if n := members[sub.client.opts.Username]; sub.client.kind == CLIENT && n > 1 {
+			w /= float64(n)
+		}
+		weights[i] = w
+		total += w
+	}
+	if total <= 0 {
+		return -1
+	}
+
+	if !qg.Sticky {
+		r := c.in.prand.Float64() * total
+		for i, w := range weights {
+			if r < w {
+				return i
+			}
+			r -= w
+		}
+		for i := len(weights) - 1; i >= 0; i-- {
+			if weights[i] > 0 {
+				return i
+			}
+		}
+		return -1
+	}
+
+	// Weighted rendezvous hashing of the ordering key, or the publisher.
+	if key == nil {
+		key = strconv.AppendUint(nil, c.cid, 10)
+	}
+	var (
+		best  float64
+		index = -1
+		buf   [64]byte
+	)
+	for i, sub := range qsubs {
+		if weights[i] <= 0 {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write(key)
+		h.Write(queueMemberID(buf[:0], sub))
+		// Uniform in (0, 1).
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		if score := -weights[i] / math.Log(u); index < 0 || score > best {
+			best, index = score, i
+		}
+	}
+	return index
+}
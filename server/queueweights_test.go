@@ -0,0 +1,125 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestQueueGroupWeights(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A: {
+				users: [{user: canary, password: pwd}, {user: stable, password: pwd}, {user: pub, password: pwd}]
+				queue_groups {
+					workers: { weights: { canary: 1, stable: 9 } }
+					pinned: { weights: { canary: 1 }, default_weight: 0 }
+					sticky: { sticky: true }
+				}
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	acc, err := s.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	qgs := acc.queueGroupOpts()
+	if qg := qgs["workers"]; qg == nil || qg.Weights["stable"] != 9 || qg.DefaultWeight != 1 || qg.Sticky {
+		t.Fatalf("Unexpected queue group options: %+v", qg)
+	}
+
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	subscribe := func(user, subj string, member int) *nats.Conn {
+		t.Helper()
+		nc := natsConnect(t, s.ClientURL(), nats.UserInfo(user, "pwd"))
+		natsQueueSub(t, nc, subj, subj, func(*nats.Msg) {
+			mu.Lock()
+			counts[fmt.Sprintf("%s.%s.%d", subj, user, member)]++
+			mu.Unlock()
+		})
+		natsFlush(t, nc)
+		return nc
+	}
+	for _, subj := range []string{"workers", "pinned", "sticky"} {
+		for i, user := range []string{"canary", "stable", "stable"} {
+			nc := subscribe(user, subj, i/2)
+			defer nc.Close()
+		}
+	}
+
+	pub := natsConnect(t, s.ClientURL(), nats.UserInfo("pub", "pwd"))
+	defer pub.Close()
+	const total = 2000
+	for i := 0; i < total; i++ {
+		natsPub(t, pub, "workers", nil)
+		if i < 100 {
+			natsPub(t, pub, "pinned", nil)
+			natsPub(t, pub, "sticky", nil)
+		}
+	}
+	natsFlush(t, pub)
+
+	get := func(k string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return counts[k]
+	}
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		n := get("workers.canary.0") + get("workers.stable.0") + get("workers.stable.1")
+		if n != total {
+			return fmt.Errorf("received %d messages", n)
+		}
+		return nil
+	})
+	// The canary gets about 10%, and each stable member about 45%.
+	if n := get("workers.canary.0"); n < total/20 || n > total/6 {
+		t.Fatalf("Unexpected canary messages: %d", n)
+	}
+	for i := 0; i < 2; i++ {
+		if n := get(fmt.Sprintf("workers.stable.%d", i)); n < total/3 || n > total*3/5 {
+			t.Fatalf("Unexpected stable member %d messages: %d", i, n)
+		}
+	}
+
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := get("pinned.canary.0"); n != 100 {
+			return fmt.Errorf("canary received %d pinned messages", n)
+		}
+		return nil
+	})
+
+	// The messages of a sticky group all go to the same member.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		c, s0, s1 := get("sticky.canary.0"), get("sticky.stable.0"), get("sticky.stable.1")
+		if c+s0+s1 != 100 {
+			return fmt.Errorf("received %d sticky messages", c+s0+s1)
+		}
+		if c != 100 && s0 != 100 && s1 != 100 {
+			return fmt.Errorf("sticky messages split: %d %d %d", c, s0, s1)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,640 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Redis clients using pub/sub connect on their own listener, speaking
+// RESP2. Channels are subjects, and patterns of PSUBSCRIBE are converted
+// to wildcard subjects: a '*' token matches a token, or any number of
+// them when last. Clients are in the account of the no auth user until
+// they AUTH as another user. Message headers are not delivered.
+
+const (
+	// Maximum size of an inline command or of a bulk string header.
+	redisMaxLineSize = 64 * 1024
+	// Maximum number of arguments of a command.
+	redisMaxArgs = 1024
+)
+
+var (
+	errRedisLineTooLong  = errors.New("protocol error: too big inline request")
+	errRedisProtocol     = errors.New("protocol error: invalid request")
+	errRedisSlowConsumer = errors.New("slow consumer")
+)
+
+// RedisOpts are options for the Redis pub/sub listener.
+type RedisOpts struct {
+	// The server will accept Redis client connections on this hostname/IP.
+	Host string
+	// The server will accept Redis client connections on this port.
+	Port int
+	// Until they AUTH, clients default to this user and associated
+	// account. This user has to exist in the global options.
+	NoAuthUser string
+	// TLS configuration is required for secure Redis connections.
+	TLSConfig *tls.Config
+}
+
+func validateRedisOptions(o *Options) error {
+	ro := &o.Redis
+	if ro.NoAuthUser == _EMPTY_ {
+		return nil
+	}
+	if ro.Port == 0 {
+		return fmt.Errorf("redis no_auth_user %q requires a port", ro.NoAuthUser)
+	}
+	for _, u := range o.Users {
+		if u.Username == ro.NoAuthUser {
+			return nil
+		}
+	}
+	return fmt.Errorf("redis no_auth_user %q not present as user in authorization block or account configuration",
+		ro.NoAuthUser)
+}
+
+// srvRedis is the state of the Redis listener.
+type srvRedis struct {
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[*redisConn]struct{}
+}
+
+// startRedisListener listens for Redis client connections.
+func (s *Server) startRedisListener() {
+	o := s.getOpts().Redis
+
+	port := o.Port
+	if port == -1 {
+		port = 0
+	}
+	hp := net.JoinHostPort(o.Host, strconv.Itoa(port))
+	l, err := net.Listen("tcp", hp)
+	if err != nil {
+		s.Fatalf("Unable to listen for Redis connections: %v", err)
+		return
+	}
+	scheme := "redis"
+	if o.TLSConfig != nil {
+		l = tls.NewListener(l, o.TLSConfig)
+		scheme = "rediss"
+	}
+	s.Noticef("Listening for Redis clients on %s://%s", scheme, l.Addr())
+
+	s.mu.Lock()
+	s.redis.listener = l
+	s.mu.Unlock()
+	s.redis.mu.Lock()
+	s.redis.conns = make(map[*redisConn]struct{})
+	s.redis.mu.Unlock()
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		tmpDelay := ACCEPT_MIN_SLEEP
+		for s.isRunning() {
+			conn, err := l.Accept()
+			if err != nil {
+				if s.isLameDuckMode() {
+					// Signal that we are not accepting new clients
+					s.ldmCh <- true
+					// Now wait for the Shutdown...
+					<-s.quitCh
+					return
+				}
+				tmpDelay = s.acceptError("Redis", err, tmpDelay)
+				continue
+			}
+			tmpDelay = ACCEPT_MIN_SLEEP
+			s.startGoRoutine(func() {
+				s.handleRedisConn(conn)
+				s.grWG.Done()
+			})
+		}
+		s.done <- true
+	})
+}
+
+// RedisAddr returns the address of the Redis listener, or nil if not
+// listening.
+func (s *Server) RedisAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.redis.listener == nil {
+		return nil
+	}
+	return s.redis.listener.Addr()
+}
+
+// closeRedisConns closes the connections of Redis clients on shutdown.
+func (s *Server) closeRedisConns() {
+	s.redis.mu.Lock()
+	for rc := range s.redis.conns {
+		rc.conn.Close()
+	}
+	s.redis.mu.Unlock()
+}
+
+// redisSub is a subscription to a channel or pattern.
+type redisSub struct {
+	name    string
+	pattern bool
+	sub     *subscription
+}
+
+// redisConn is a connection of a Redis client, using an internal client
+// registered with the account of its user.
+type redisConn struct {
+	srv   *Server
+	conn  net.Conn
+	br    *bufio.Reader
+	c     *client
+	subs  map[string]*redisSub
+	psubs map[string]*redisSub
+	sid   uint64
+
+	// Replies are written by a dedicated go routine, so that deliveries
+	// do not block the publishers.
+	mu         sync.Mutex
+	out        bytes.Buffer
+	flushCh    chan struct{}
+	closed     bool
+	maxPending int
+}
+
+func (s *Server) handleRedisConn(conn net.Conn) {
+	opts := s.getOpts()
+	rc := &redisConn{
+		srv:        s,
+		conn:       conn,
+		br:         bufio.NewReaderSize(conn, redisMaxLineSize),
+		subs:       make(map[string]*redisSub),
+		psubs:      make(map[string]*redisSub),
+		flushCh:    make(chan struct{}, 1),
+		maxPending: int(opts.MaxPending),
+	}
+	s.redis.mu.Lock()
+	if s.redis.conns == nil {
+		s.redis.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.redis.conns[rc] = struct{}{}
+	s.redis.mu.Unlock()
+
+	defer func() {
+		s.redis.mu.Lock()
+		delete(s.redis.conns, rc)
+		s.redis.mu.Unlock()
+		rc.close()
+		if rc.c != nil {
+			rc.c.closeConnection(ClientClosed)
+		}
+	}()
+	s.Debugf("Redis connection from %s", conn.RemoteAddr())
+
+	s.startGoRoutine(rc.writeLoop)
+	// Clients start as the no auth user, if allowed.
+	if s.anonymousLogin(opts.Redis.NoAuthUser) {
+		acc, user, err := s.checkLogin(conn.RemoteAddr(), _EMPTY_, _EMPTY_, opts.Redis.NoAuthUser)
+		if err == nil {
+			err = rc.register(acc, user)
+		}
+		if err != nil {
+			s.Debugf("Redis connection from %s not authorized: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+	for {
+		args, err := rc.readCommand(int(opts.MaxPayload))
+		if err != nil {
+			if err != io.EOF && !rc.isClosed() {
+				rc.sendError(err.Error())
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if quit := rc.processCommand(args); quit {
+			return
+		}
+	}
+}
+
+// register has the connection use an internal client of the account
+// and user, replacing the current one and its subscriptions.
+func (rc *redisConn) register(acc *Account, user *User) error {
+	c := rc.srv.createInternalAccountClient()
+	c.echo = true
+	if err := rc.srv.registerLogin(c, acc, user); err != nil {
+		c.closeConnection(ClientClosed)
+		return err
+	}
+	if rc.c != nil {
+		rc.c.closeConnection(ClientClosed)
+	}
+	rc.c = c
+	rc.subs = make(map[string]*redisSub)
+	rc.psubs = make(map[string]*redisSub)
+	return nil
+}
+
+func (rc *redisConn) isClosed() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.closed
+}
+
+// close has the pending replies flushed and the connection closed.
+func (rc *redisConn) close() {
+	rc.mu.Lock()
+	rc.closed = true
+	rc.mu.Unlock()
+	rc.signalFlush()
+}
+
+func (rc *redisConn) signalFlush() {
+	select {
+	case rc.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+func (rc *redisConn) writeLoop() {
+	defer rc.srv.grWG.Done()
+	defer rc.conn.Close()
+
+	for {
+		select {
+		case <-rc.flushCh:
+		case <-rc.srv.quitCh:
+			return
+		}
+		rc.mu.Lock()
+		b := append([]byte(nil), rc.out.Bytes()...)
+		rc.out.Reset()
+		closed := rc.closed
+		rc.mu.Unlock()
+		if len(b) > 0 {
+			if _, err := rc.conn.Write(b); err != nil {
+				return
+			}
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// send queues the reply, and closes the connection if too many replies
+// are pending.
+func (rc *redisConn) send(reply []byte) {
+	rc.mu.Lock()
+	if rc.closed {
+		rc.mu.Unlock()
+		return
+	}
+	rc.out.Write(reply)
+	slow := rc.maxPending > 0 && rc.out.Len() > rc.maxPending
+	rc.mu.Unlock()
+	if slow {
+		rc.srv.Noticef("Redis connection from %s is a slow consumer", rc.conn.RemoteAddr())
+		rc.sendError(errRedisSlowConsumer.Error())
+		rc.close()
+		return
+	}
+	rc.signalFlush()
+}
+
+func (rc *redisConn) sendError(message string) {
+	rc.mu.Lock()
+	if !rc.closed {
+		rc.out.WriteString("-ERR " + message + "\r\n")
+	}
+	rc.mu.Unlock()
+	rc.signalFlush()
+}
+
+// processCommand runs the command, returning true if the connection has
+// to be closed.
+func (rc *redisConn) processCommand(args [][]byte) bool {
+	cmd := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	subscribed := len(rc.subs)+len(rc.psubs) > 0
+	// Connections not registered yet, when the server requires
+	// authentication, can only authenticate or quit.
+	if rc.c == nil && cmd != "AUTH" && cmd != "QUIT" {
+		rc.sendError("NOAUTH Authentication required.")
+		return false
+	}
+	switch cmd {
+	case "QUIT":
+		rc.send([]byte("+OK\r\n"))
+		return true
+	case "PING":
+		if subscribed {
+			msg := []byte{}
+			if len(args) > 0 {
+				msg = args[0]
+			}
+			rc.send(redisArray([]byte("pong"), msg))
+		} else if len(args) > 0 {
+			rc.send(redisBulk(args[0]))
+		} else {
+			rc.send([]byte("+PONG\r\n"))
+		}
+		return false
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		if strings.HasSuffix(cmd, "UNSUBSCRIBE") {
+			rc.unsubscribe(args, cmd == "PUNSUBSCRIBE")
+		} else if len(args) == 0 {
+			rc.sendError(fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+		} else {
+			rc.subscribe(args, cmd == "PSUBSCRIBE")
+		}
+		return false
+	}
+	if subscribed {
+		rc.sendError(fmt.Sprintf("Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context",
+			strings.ToLower(cmd)))
+		return false
+	}
+	switch cmd {
+	case "AUTH":
+		var login, password string
+		switch len(args) {
+		case 1:
+			password = string(args[0])
+		case 2:
+			login, password = string(args[0]), string(args[1])
+		default:
+			rc.sendError("wrong number of arguments for 'auth' command")
+			return false
+		}
+		acc, user, err := rc.srv.checkLogin(rc.conn.RemoteAddr(), login, password, _EMPTY_)
+		if err == nil {
+			err = rc.register(acc, user)
+		}
+		if err != nil {
+			rc.srv.Debugf("Redis connection from %s not authorized: %v", rc.conn.RemoteAddr(), err)
+			rc.send([]byte("-WRONGPASS invalid username-password pair\r\n"))
+			return false
+		}
+		rc.send([]byte("+OK\r\n"))
+	case "ECHO":
+		if len(args) != 1 {
+			rc.sendError("wrong number of arguments for 'echo' command")
+			return false
+		}
+		rc.send(redisBulk(args[0]))
+	case "SELECT":
+		if len(args) != 1 || string(args[0]) != "0" {
+			rc.sendError("DB index is out of range")
+			return false
+		}
+		rc.send([]byte("+OK\r\n"))
+	case "PUBLISH":
+		if len(args) != 2 {
+			rc.sendError("wrong number of arguments for 'publish' command")
+			return false
+		}
+		n, err := rc.publish(string(args[0]), args[1])
+		if err != nil {
+			rc.sendError(err.Error())
+			return false
+		}
+		rc.send(redisInteger(n))
+	default:
+		rc.sendError(fmt.Sprintf("unknown command '%s'", strings.ToLower(cmd)))
+	}
+	return false
+}
+
+// publish publishes the message, returning the number of subscriptions
+// of the account it was delivered to.
+func (rc *redisConn) publish(channel string, msg []byte) (int, error) {
+	if !IsValidLiteralSubject(channel) {
+		return 0, fmt.Errorf("invalid channel %q", channel)
+	}
+	c := rc.c
+	c.mu.Lock()
+	allowed := c.perms == nil || c.pubAllowed(channel)
+	c.mu.Unlock()
+	if !allowed {
+		return 0, fmt.Errorf("permissions violation for publish to %q", channel)
+	}
+	r := c.acc.sl.Match(channel)
+	n := len(r.psubs) + len(r.qsubs)
+	c.processInternalMsg(channel, _EMPTY_, nil, msg)
+	return n, nil
+}
+
+// redisPatternSubject converts a pattern to a subject.
+func redisPatternSubject(pattern string) (string, bool) {
+	if strings.ContainsAny(pattern, "?[]\\") {
+		return _EMPTY_, false
+	}
+	tokens := strings.Split(pattern, tsep)
+	for i, t := range tokens {
+		if t == _EMPTY_ || strings.IndexByte(t, fwc) >= 0 || (strings.IndexByte(t, pwc) >= 0 && len(t) > 1) {
+			return _EMPTY_, false
+		}
+		if t == "*" && i == len(tokens)-1 {
+			tokens[i] = ">"
+		}
+	}
+	return strings.Join(tokens, tsep), true
+}
+
+func (rc *redisConn) subscribe(names [][]byte, pattern bool) {
+	kind, subs := "subscribe", rc.subs
+	if pattern {
+		kind, subs = "psubscribe", rc.psubs
+	}
+	c := rc.c
+	for _, b := range names {
+		name := string(b)
+		if _, ok := subs[name]; !ok {
+			subject, valid := name, IsValidSubject(name)
+			if pattern {
+				subject, valid = redisPatternSubject(name)
+			} else if valid {
+				// Channels are literal.
+				valid = IsValidLiteralSubject(name)
+			}
+			if !valid {
+				what := "channel"
+				if pattern {
+					what = "pattern"
+				}
+				rc.sendError(fmt.Sprintf("invalid %s %q", what, name))
+				continue
+			}
+			c.mu.Lock()
+			allowed := c.perms == nil || c.canSubscribe(subject)
+			c.mu.Unlock()
+			if !allowed {
+				rc.sendError(fmt.Sprintf("permissions violation for subscription to %q", subject))
+				continue
+			}
+			rc.sid++
+			sub, err := c.processSub([]byte(fmt.Sprintf("%s %d", subject, rc.sid)), false)
+			if err != nil || sub == nil {
+				rc.sendError(fmt.Sprintf("unable to subscribe to %q", name))
+				continue
+			}
+			rs := &redisSub{name: name, pattern: pattern, sub: sub}
+			sub.icb = func(_ *subscription, pc *client, subject, _ string, msg []byte) {
+				rc.deliver(rs, pc, subject, msg)
+			}
+			subs[name] = rs
+		}
+		rc.send(redisArray([]byte(kind), b, rc.count()))
+	}
+}
+
+func (rc *redisConn) unsubscribe(names [][]byte, pattern bool) {
+	kind, subs := "unsubscribe", rc.subs
+	if pattern {
+		kind, subs = "punsubscribe", rc.psubs
+	}
+	if len(names) == 0 {
+		if len(subs) == 0 {
+			rc.send(redisArray([]byte(kind), nil, rc.count()))
+			return
+		}
+		for name := range subs {
+			names = append(names, []byte(name))
+		}
+	}
+	for _, b := range names {
+		if rs, ok := subs[string(b)]; ok {
+			delete(subs, rs.name)
+			rc.c.processUnsub(rs.sub.sid)
+		}
+		rc.send(redisArray([]byte(kind), b, rc.count()))
+	}
+}
+
+// count returns the number of subscriptions, as an integer reply.
+func (rc *redisConn) count() []byte {
+	return redisInteger(len(rc.subs) + len(rc.psubs))
+}
+
+// deliver sends the message received on the subscription.
+func (rc *redisConn) deliver(rs *redisSub, pc *client, subject string, msg []byte) {
+	// Internal account clients receive the message with the trailing CRLF.
+	msg = msg[:len(msg)-LEN_CR_LF]
+	if pc != nil && pc.pa.hdr > 0 && pc.pa.hdr <= len(msg) {
+		msg = msg[pc.pa.hdr:]
+	}
+	if rs.pattern {
+		rc.send(redisArray([]byte("pmessage"), []byte(rs.name), []byte(subject), msg))
+	} else {
+		rc.send(redisArray([]byte("message"), []byte(subject), msg))
+	}
+}
+
+// redisBulk returns a bulk string reply, or a null one for nil.
+func redisBulk(b []byte) []byte {
+	if b == nil {
+		return []byte("$-1\r\n")
+	}
+	reply := make([]byte, 0, len(b)+16)
+	reply = append(reply, '$')
+	reply = strconv.AppendInt(reply, int64(len(b)), 10)
+	reply = append(reply, _CRLF_...)
+	reply = append(reply, b...)
+	return append(reply, _CRLF_...)
+}
+
+func redisInteger(n int) []byte {
+	return []byte(":" + strconv.Itoa(n) + _CRLF_)
+}
+
+// redisArray returns an array reply of bulk strings, elements that are
+// already replies, such as integers, being kept as is.
+func redisArray(elements ...[]byte) []byte {
+	reply := []byte("*" + strconv.Itoa(len(elements)) + _CRLF_)
+	for _, e := range elements {
+		if len(e) > 0 && e[0] == ':' && bytes.HasSuffix(e, []byte(_CRLF_)) {
+			reply = append(reply, e...)
+		} else {
+			reply = append(reply, redisBulk(e)...)
+		}
+	}
+	return reply
+}
+
+// readCommand reads the next command, either an array of bulk strings
+// or an inline command.
+func (rc *redisConn) readCommand(maxBulk int) ([][]byte, error) {
+	line, err := rc.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(append([]byte(nil), line...)), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > redisMaxArgs {
+		return nil, errRedisProtocol
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := rc.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errRedisProtocol
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || (maxBulk > 0 && size > maxBulk) {
+			return nil, errRedisProtocol
+		}
+		arg := make([]byte, size+LEN_CR_LF)
+		if _, err := io.ReadFull(rc.br, arg); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(arg, []byte(_CRLF_)) {
+			return nil, errRedisProtocol
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+func (rc *redisConn) readLine() ([]byte, error) {
+	b, err := rc.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errRedisLineTooLong
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b[:len(b)-1], []byte("\r")), nil
+}
@@ -0,0 +1,291 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+type redisTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func newRedisTestClient(t *testing.T, s *Server) *redisTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.RedisAddr().String())
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	return &redisTestClient{t: t, conn: conn, br: bufio.NewReader(conn)}
+}
+
+func (c *redisTestClient) send(args ...string) {
+	c.t.Helper()
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		c.t.Fatalf("Error writing command: %v", err)
+	}
+}
+
+// reply reads a reply, with errors as strings starting with '-'.
+func (c *redisTestClient) reply() interface{} {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("Error reading reply: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+', '-':
+		return line
+	case ':':
+		n, _ := strconv.Atoi(line[1:])
+		return n
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.br, b); err != nil {
+			c.t.Fatalf("Error reading reply: %v", err)
+		}
+		return string(b[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		a := make([]interface{}, n)
+		for i := range a {
+			a[i] = c.reply()
+		}
+		return a
+	}
+	c.t.Fatalf("Unexpected reply %q", line)
+	return nil
+}
+
+func (c *redisTestClient) expect(expected ...interface{}) {
+	c.t.Helper()
+	var r interface{} = expected
+	if len(expected) == 1 {
+		r = expected[0]
+	}
+	if reply := c.reply(); !reflect.DeepEqual(reply, r) {
+		c.t.Fatalf("Expected %q, got %q", r, reply)
+	}
+}
+
+func TestRedisPubSub(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A: {
+				users: [
+					{user: a, password: pwd, permissions: {publish: "orders.>", subscribe: "orders.>"}}
+				]
+			}
+		}
+		redis {
+			listen: "127.0.0.1:-1"
+			no_auth_user: a
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	c := newRedisTestClient(t, s)
+	defer c.conn.Close()
+	// Inline commands are supported.
+	if _, err := c.conn.Write([]byte("PING\r\n")); err != nil {
+		t.Fatalf("Error writing command: %v", err)
+	}
+	c.expect("+PONG")
+	c.send("SUBSCRIBE", "orders.new")
+	c.expect("subscribe", "orders.new", 1)
+	c.send("PSUBSCRIBE", "orders.*")
+	c.expect("psubscribe", "orders.*", 2)
+	c.send("PSUBSCRIBE", "other.*")
+	if r := c.reply(); !strings.Contains(r.(string), "permissions violation") {
+		t.Fatalf("Unexpected reply %q", r)
+	}
+	c.send("PUBLISH", "orders.new", "x")
+	if r := c.reply(); !strings.Contains(r.(string), "only (P)SUBSCRIBE") {
+		t.Fatalf("Unexpected reply %q", r)
+	}
+	c.send("PING")
+	c.expect("pong", "")
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "orders.>")
+	natsFlush(t, nc)
+
+	// From NATS to Redis, the pattern matching several tokens.
+	natsPub(t, nc, "orders.eu.new", []byte("hello"))
+	c.expect("pmessage", "orders.*", "orders.eu.new", "hello")
+	natsNexMsg(t, sub, time.Second)
+
+	// From Redis to NATS, with the number of subscriptions delivered to.
+	p := newRedisTestClient(t, s)
+	defer p.conn.Close()
+	p.send("PUBLISH", "orders.new", "hi")
+	p.expect(3)
+	if m := natsNexMsg(t, sub, time.Second); m.Subject != "orders.new" || string(m.Data) != "hi" {
+		t.Fatalf("Unexpected message %q %q", m.Subject, m.Data)
+	}
+	got := []interface{}{c.reply(), c.reply()}
+	if !reflect.DeepEqual(got[0], []interface{}{"message", "orders.new", "hi"}) {
+		got[0], got[1] = got[1], got[0]
+	}
+	if !reflect.DeepEqual(got, []interface{}{
+		[]interface{}{"message", "orders.new", "hi"},
+		[]interface{}{"pmessage", "orders.*", "orders.new", "hi"},
+	}) {
+		t.Fatalf("Unexpected messages %q", got)
+	}
+	p.send("PUBLISH", "other", "hi")
+	if r := p.reply(); !strings.Contains(r.(string), "permissions violation") {
+		t.Fatalf("Unexpected reply %q", r)
+	}
+
+	c.send("UNSUBSCRIBE")
+	c.expect("unsubscribe", "orders.new", 1)
+	c.send("PUNSUBSCRIBE", "orders.*")
+	c.expect("punsubscribe", "orders.*", 0)
+	c.send("ECHO", "back")
+	c.expect("back")
+	c.send("QUIT")
+	c.expect("+OK")
+}
+
+func TestRedisAuthentication(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization { users: [{user: a, password: pwd}] }
+		redis { listen: "127.0.0.1:-1" }
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	c := newRedisTestClient(t, s)
+	defer c.conn.Close()
+	// Only AUTH and QUIT are allowed before authenticating.
+	for _, cmd := range [][]string{{"PUBLISH", "foo", "x"}, {"SUBSCRIBE", "foo"}, {"PING"}, {"ECHO", "x"}} {
+		c.send(cmd...)
+		if r := c.reply(); !strings.Contains(r.(string), "NOAUTH") {
+			t.Fatalf("Unexpected reply %q to %v", r, cmd)
+		}
+	}
+	c.send("AUTH", "a", "bad")
+	if r := c.reply(); !strings.HasPrefix(r.(string), "-WRONGPASS") {
+		t.Fatalf("Unexpected reply %q", r)
+	}
+	c.send("AUTH", "a", "pwd")
+	c.expect("+OK")
+	c.send("PUBLISH", "foo", "x")
+	c.expect(0)
+	c.send("GET", "foo")
+	if r := c.reply(); !strings.Contains(r.(string), "unknown command 'get'") {
+		t.Fatalf("Unexpected reply %q", r)
+	}
+}
+
+func TestRedisUnsupportedAuthentication(t *testing.T) {
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization { users: [{nkey: %q}] }
+		redis { listen: "127.0.0.1:-1" }
+	`, pub)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	// Nkeys can not be used with AUTH, which must not let the connection in.
+	c := newRedisTestClient(t, s)
+	defer c.conn.Close()
+	c.send("PUBLISH", "foo", "x")
+	if r := c.reply(); !strings.Contains(r.(string), "NOAUTH") {
+		t.Fatalf("Unexpected reply %q", r)
+	}
+	c.send("AUTH", pub, "x")
+	if r := c.reply(); !strings.HasPrefix(r.(string), "-WRONGPASS") {
+		t.Fatalf("Unexpected reply %q", r)
+	}
+	c.send("PUBLISH", "foo", "x")
+	if r := c.reply(); !strings.Contains(r.(string), "NOAUTH") {
+		t.Fatalf("Unexpected reply %q", r)
+	}
+}
+
+func TestRedisConfig(t *testing.T) {
+	for _, test := range []struct {
+		pattern, subject string
+		ok               bool
+	}{
+		{"a.*", "a.>", true},
+		{"a.*.b", "a.*.b", true},
+		{"*", ">", true},
+		{"a*", _EMPTY_, false},
+		{"a.?", _EMPTY_, false},
+		{"a.>", _EMPTY_, false},
+	} {
+		if subject, ok := redisPatternSubject(test.pattern); subject != test.subject || ok != test.ok {
+			t.Fatalf("Unexpected subject %q %v for pattern %q", subject, ok, test.pattern)
+		}
+	}
+
+	conf := createConfFile(t, []byte(`
+		redis {
+			listen: "127.0.0.1:6379"
+			no_auth_user: missing
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.Redis.Host != "127.0.0.1" || opts.Redis.Port != 6379 {
+		t.Fatalf("Unexpected options: %+v", opts.Redis)
+	}
+	if err := validateRedisOptions(opts); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("Expected error about user, got %v", err)
+	}
+	conf = createConfFile(t, []byte(`redis { bad: 1 }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Fatalf("Expected error on unknown field, got %v", err)
+	}
+}
@@ -289,6 +289,116 @@ func (u *nkeysOption) Apply(server *Server) {
 	server.Noticef("Reloaded: authorization nkey users")
 }
 
+// oidcOption implements the option interface for the `oidc` setting.
+type oidcOption struct {
+	authOption
+}
+
+func (o *oidcOption) Apply(server *Server) {
+	server.Noticef("Reloaded: oidc")
+}
+
+// kerberosOption implements the option interface for the `kerberos` setting.
+type kerberosOption struct {
+	authOption
+}
+
+func (k *kerberosOption) Apply(server *Server) {
+	server.Noticef("Reloaded: kerberos")
+}
+
+// tokensOption implements the option interface for the authorization
+// `tokens` setting.
+type tokensOption struct {
+	authOption
+}
+
+func (t *tokensOption) Apply(server *Server) {
+	server.Noticef("Reloaded: authorization tokens")
+}
+
+// usersFileOption implements the option interface for the authorization
+// `users_file` setting.
+type usersFileOption struct {
+	authOption
+}
+
+func (u *usersFileOption) Apply(server *Server) {
+	server.Noticef("Reloaded: authorization users file")
+}
+
+// bcryptCostOption implements the option interface for the authorization
+// `bcrypt_min_cost` and `bcrypt_rehash` settings.
+type bcryptCostOption struct {
+	noopOption
+}
+
+func (b *bcryptCostOption) Apply(server *Server) {
+	server.Noticef("Reloaded: authorization bcrypt cost policy")
+}
+
+// tlsAccountMappingsOption implements the option interface for the
+// `tls_account_map` setting.
+type tlsAccountMappingsOption struct {
+	authOption
+}
+
+func (t *tlsAccountMappingsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: tls account mappings")
+}
+
+// spiffeMappingsOption implements the option interface for the
+// `spiffe_map` setting.
+type spiffeMappingsOption struct {
+	authOption
+}
+
+func (s *spiffeMappingsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: spiffe mappings")
+}
+
+// anonymousOption implements the option interface for the `anonymous`
+// setting.
+type anonymousOption struct {
+	authOption
+}
+
+func (a *anonymousOption) Apply(server *Server) {
+	server.Noticef("Reloaded: anonymous")
+}
+
+// revocationsOption implements the option interface for the `revocations`
+// setting.
+type revocationsOption struct {
+	authOption
+}
+
+func (r *revocationsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: revocations")
+}
+
+// tlsMapOrderOption implements the option interface for the `tls_map_order`
+// setting.
+type tlsMapOrderOption struct {
+	authOption
+	newValue []string
+}
+
+func (t *tlsMapOrderOption) Apply(server *Server) {
+	server.Noticef("Reloaded: tls_map_order = %v", t.newValue)
+}
+
+// bearerTokenListenersOption implements the option interface for the
+// `bearer_token_listeners` setting.
+type bearerTokenListenersOption struct {
+	authOption
+	newValue []string
+}
+
+func (b *bearerTokenListenersOption) Apply(server *Server) {
+	server.Noticef("Reloaded: bearer_token_listeners = %v", b.newValue)
+}
+
 // clusterOption implements the option interface for the `cluster` setting.
 type clusterOption struct {
 	authOption
@@ -303,7 +413,7 @@ func (c *clusterOption) Apply(server *Server) {
 	tlsRequired := c.newValue.TLSConfig != nil
 	server.routeInfo.TLSRequired = tlsRequired
 	server.routeInfo.TLSVerify = tlsRequired
-	server.routeInfo.AuthRequired = c.newValue.Username != ""
+	server.routeInfo.AuthRequired = c.newValue.Username != "" || len(c.newValue.Nkeys) > 0
 	if c.newValue.NoAdvertise {
 		server.routeInfo.ClientConnectURLs = nil
 		server.routeInfo.WSConnectURLs = nil
@@ -593,31 +703,250 @@ func (m *maxTracedMsgLenOption) Apply(server *Server) {
 	server.Noticef("Reloaded: max_traced_msg_len = %d", m.newValue)
 }
 
+// signIdentityOption implements the option interface for the `sign_identity` setting.
+type signIdentityOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op, the identity is signed for new connections.
+func (s *signIdentityOption) Apply(server *Server) {
+	server.Noticef("Reloaded: sign_identity = %v", s.newValue)
+}
+
+// tlsExpiryThresholdsOption implements the option interface for the `tls_expiry_thresholds` setting.
+type tlsExpiryThresholdsOption struct {
+	noopOption
+	newValue []int
+}
+
+// Apply is a no-op because the thresholds are read from the options on each check.
+func (t *tlsExpiryThresholdsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: tls_expiry_thresholds = %v", t.newValue)
+}
+
+// ipFiltersOption implements the option interface for the `ip_filters` setting.
+type ipFiltersOption struct {
+	noopOption
+	newValue map[string]*IPFilterOpts
+}
+
+// Apply is a no-op because the filters are read from the options when accepting connections.
+func (i *ipFiltersOption) Apply(server *Server) {
+	server.Noticef("Reloaded: ip_filters")
+}
+
+// nonceSizeOption implements the option interface for the `nonce_size` setting.
+type nonceSizeOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply is a no-op because the size is read from the options for each nonce.
+func (n *nonceSizeOption) Apply(server *Server) {
+	server.Noticef("Reloaded: nonce_size = %v", n.newValue)
+}
+
+// nonceTTLOption implements the option interface for the `nonce_ttl` setting.
+type nonceTTLOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op because the TTL is read from the options on each verification.
+func (n *nonceTTLOption) Apply(server *Server) {
+	server.Noticef("Reloaded: nonce_ttl = %v", n.newValue)
+}
+
+// noTLSDowngradeOption implements the option interface for the
+// `no_tls_downgrade` setting.
+type noTLSDowngradeOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the setting is read from the options on each
+// new connection.
+func (n *noTLSDowngradeOption) Apply(server *Server) {
+	server.Noticef("Reloaded: no_tls_downgrade = %v", n.newValue)
+}
+
+// connectionFingerprintingOption implements the option interface for the
+// `connection_fingerprinting` setting.
+type connectionFingerprintingOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the setting is read from the options on each
+// new connection.
+func (c *connectionFingerprintingOption) Apply(server *Server) {
+	server.Noticef("Reloaded: connection_fingerprinting = %v", c.newValue)
+}
+
+// noRespondersHintsOption implements the option interface for the
+// `no_responders_hints` setting.
+type noRespondersHintsOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the setting is read from the options on each
+// request.
+func (n *noRespondersHintsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: no_responders_hints = %v", n.newValue)
+}
+
+// dnsResolverOption implements the option interface for the `dns_resolver` setting.
+type dnsResolverOption struct {
+	noopOption
+	newValue DNSResolverOpts
+}
+
+// Apply is a no-op because the options are read on each lookup.
+func (d *dnsResolverOption) Apply(server *Server) {
+	server.Noticef("Reloaded: dns_resolver")
+}
+
+// scatterGatherOption implements the option interface for the
+// `scatter_gather` setting.
+type scatterGatherOption struct {
+	noopOption
+	newValue ScatterGatherOpts
+}
+
+// Apply is a no-op because the options are read on each request.
+func (sg *scatterGatherOption) Apply(server *Server) {
+	server.Noticef("Reloaded: scatter_gather")
+}
+
+// serviceGraphOption implements the option interface for the
+// `service_graph` setting.
+type serviceGraphOption struct {
+	noopOption
+	newValue ServiceGraphOpts
+}
+
+// Apply is a no-op because the options are read on each request and
+// interval.
+func (sg *serviceGraphOption) Apply(server *Server) {
+	server.Noticef("Reloaded: service_graph")
+}
+
+// authCacheOption implements the option interface for the `auth_cache`
+// setting.
+type authCacheOption struct {
+	noopOption
+	newValue AuthCacheOpts
+}
+
+// Apply purges the cached verifications, so that none outlives the new TTL.
+func (a *authCacheOption) Apply(server *Server) {
+	server.purgeAuthCache()
+	server.Noticef("Reloaded: auth_cache")
+}
+
+// resolverCacheOption implements the option interface for the
+// `resolver_cache` setting.
+type resolverCacheOption struct {
+	noopOption
+	newValue ResolverCacheOpts
+}
+
+// Apply purges the cached user JWTs, so that none outlives a smaller
+// maximum.
+func (r *resolverCacheOption) Apply(server *Server) {
+	server.purgeResolverCache()
+	server.Noticef("Reloaded: resolver_cache")
+}
+
+// authLockoutOption implements the option interface for the `auth_lockout` setting.
+type authLockoutOption struct {
+	noopOption
+	newValue AuthLockoutOpts
+}
+
+// Apply is a no-op because the options are read on each authentication.
+func (a *authLockoutOption) Apply(server *Server) {
+	server.Noticef("Reloaded: auth_lockout")
+}
+
+// inactiveClientTimeoutOption implements the option interface for the `inactive_client_timeout` setting.
+type inactiveClientTimeoutOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op because the timeout is read from the options on each check.
+func (i *inactiveClientTimeoutOption) Apply(server *Server) {
+	server.Noticef("Reloaded: inactive_client_timeout = %v", i.newValue)
+}
+
+// crashReportDirOption implements the option interface for the `crash_report_dir` setting.
+type crashReportDirOption struct {
+	noopOption
+	newValue string
+}
+
+// Apply is a no-op because the directory is looked up when the server panics.
+func (c *crashReportDirOption) Apply(server *Server) {
+	server.Noticef("Reloaded: crash_report_dir = %q", c.newValue)
+}
+
 // Reload reads the current configuration file and applies any supported
 // changes. This returns an error if the server was not started with a config
 // file or an option which doesn't support hot-swapping was changed.
 func (s *Server) Reload() error {
 	s.mu.Lock()
+	configFile := s.configFile
+	s.mu.Unlock()
 
-	s.reloading = true
-	defer func() {
-		s.mu.Lock()
-		s.reloading = false
-		s.mu.Unlock()
-	}()
-
-	if s.configFile == "" {
-		s.mu.Unlock()
+	if configFile == "" {
 		return errors.New("can only reload config when a file is provided using -c or --config")
 	}
 
-	newOpts, err := ProcessConfigFile(s.configFile)
+	newOpts, err := ProcessConfigFile(configFile)
 	if err != nil {
-		s.mu.Unlock()
 		// TODO: Dump previous good config to a .bak file?
 		return err
 	}
 
+	// Apply flags over config file settings.
+	newOpts = MergeOptions(newOpts, FlagSnapshot)
+
+	// Need more processing for boolean flags...
+	if FlagSnapshot != nil {
+		applyBoolFlags(newOpts, FlagSnapshot)
+	}
+
+	return s.ReloadOptions(newOpts)
+}
+
+// ReloadOptions applies the given options to the running server, with the
+// same semantics as a configuration file reload. This returns an error if
+// an option which doesn't support hot-swapping was changed. The options
+// are owned by the server after this call and should not be modified.
+func (s *Server) ReloadOptions(newOpts *Options) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.sdNotifyStatus(sdReloading, "Reloading configuration")
+	err := s.applyNewOptions(newOpts)
+	s.sdNotifyStatus(sdReady, "Accepting connections")
+	return err
+}
+
+// Applies new options to the running server.
+// Reload mutex should be held.
+func (s *Server) applyNewOptions(newOpts *Options) error {
+	s.mu.Lock()
+
+	s.reloading = true
+	defer func() {
+		s.mu.Lock()
+		s.reloading = false
+		s.mu.Unlock()
+	}()
+
 	curOpts := s.getOpts()
 
 	// Wipe trusted keys if needed when we have an operator.
@@ -633,14 +962,6 @@ func (s *Server) Reload() error {
 
 	s.mu.Unlock()
 
-	// Apply flags over config file settings.
-	newOpts = MergeOptions(newOpts, FlagSnapshot)
-
-	// Need more processing for boolean flags...
-	if FlagSnapshot != nil {
-		applyBoolFlags(newOpts, FlagSnapshot)
-	}
-
 	setBaselineOptions(newOpts)
 
 	// setBaselineOptions sets Port to 0 if set to -1 (RANDOM port)
@@ -669,7 +990,11 @@ func (s *Server) Reload() error {
 	s.mu.Lock()
 	s.configTime = time.Now()
 	s.updateVarzConfigReloadableFields(s.varz)
+	s.recordConfigSnapshot(newOpts)
 	s.mu.Unlock()
+
+	// The account resolver may have been replaced.
+	s.startAccountResolverNotifications()
 	return nil
 }
 
@@ -706,6 +1031,8 @@ func (s *Server) reloadOptions(curOpts, newOpts *Options) error {
 	// applications starting NATS Server programmatically).
 	newOpts.CustomClientAuthentication = curOpts.CustomClientAuthentication
 	newOpts.CustomRouterAuthentication = curOpts.CustomRouterAuthentication
+	newOpts.CustomClientAuthenticationV2 = curOpts.CustomClientAuthenticationV2
+	keepSigners(curOpts, newOpts)
 
 	changed, err := s.diffOptions(newOpts)
 	if err != nil {
@@ -746,6 +1073,10 @@ func imposeOrder(value interface{}) error {
 		sort.Slice(value, func(i, j int) bool {
 			return value[i].Nkey < value[j].Nkey
 		})
+	case []*TokenUser:
+		sort.Slice(value, func(i, j int) bool {
+			return value[i].Token < value[j].Token
+		})
 	case []*url.URL:
 		sort.Slice(value, func(i, j int) bool {
 			return value[i].String() < value[j].String()
@@ -754,6 +1085,8 @@ func imposeOrder(value interface{}) error {
 		sort.Slice(value, func(i, j int) bool {
 			return value[i] < value[j]
 		})
+	case []int:
+		sort.Ints(value)
 	case []*jwt.OperatorClaims:
 		sort.Slice(value, func(i, j int) bool {
 			return value[i].Issuer < value[j].Issuer
@@ -762,12 +1095,18 @@ func imposeOrder(value interface{}) error {
 		sort.Slice(value.Gateways, func(i, j int) bool {
 			return value.Gateways[i].Name < value.Gateways[j].Name
 		})
+	case []*WebhookOpts:
+		sort.Slice(value, func(i, j int) bool {
+			return value[i].Name < value[j].Name
+		})
+	case AnonymousOpts:
+		sort.Strings(value.Subscribe)
 	case WebsocketOpts:
 		sort.Slice(value.AllowedOrigins, func(i, j int) bool {
 			return value.AllowedOrigins[i] < value.AllowedOrigins[j]
 		})
 	case string, bool, int, int32, int64, time.Duration, float64, nil,
-		LeafNodeOpts, ClusterOpts, *tls.Config, *URLAccResolver, *MemAccResolver, Authentication:
+		LeafNodeOpts, ClusterOpts, DNSResolverOpts, AuthLockoutOpts, AuthCacheOpts, ResolverCacheOpts, ScatterGatherOpts, ServiceGraphOpts, TracingOpts, UnixSocketOpts, KafkaOpts, StompOpts, AMQPOpts, RedisOpts, RESTOpts, PromWriteOpts, OIDCOpts, KerberosOpts, []*TLSAccountMapping, []*SPIFFEMapping, RevocationOpts, map[string]*IPFilterOpts, map[string]*OperatorPolicy, *tls.Config, *URLAccResolver, *MemAccResolver, Authentication, Signer:
 		// explicitly skipped types
 	default:
 		// this will fail during unit tests
@@ -797,11 +1136,16 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			oldValue = oldConfig.Field(i).Interface()
 			newValue = newConfig.Field(i).Interface()
 		)
-		if err := imposeOrder(oldValue); err != nil {
-			return nil, err
-		}
-		if err := imposeOrder(newValue); err != nil {
-			return nil, err
+		// Some lists are ordered by preference, so leave them as is.
+		switch field.Name {
+		case "LameDuckConnectURLs", "LameDuckAccountPriority":
+		default:
+			if err := imposeOrder(oldValue); err != nil {
+				return nil, err
+			}
+			if err := imposeOrder(newValue); err != nil {
+				return nil, err
+			}
 		}
 		if changed := !reflect.DeepEqual(oldValue, newValue); !changed {
 			continue
@@ -837,6 +1181,28 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			diffOpts = append(diffOpts, &usersOption{})
 		case "nkeys":
 			diffOpts = append(diffOpts, &nkeysOption{})
+		case "tokens":
+			diffOpts = append(diffOpts, &tokensOption{})
+		case "usersfile":
+			diffOpts = append(diffOpts, &usersFileOption{})
+		case "bcryptmincost", "bcryptrehash":
+			diffOpts = append(diffOpts, &bcryptCostOption{})
+		case "oidc":
+			diffOpts = append(diffOpts, &oidcOption{})
+		case "tlsaccountmappings":
+			diffOpts = append(diffOpts, &tlsAccountMappingsOption{})
+		case "spiffemappings":
+			diffOpts = append(diffOpts, &spiffeMappingsOption{})
+		case "anonymous":
+			diffOpts = append(diffOpts, &anonymousOption{})
+		case "revocations":
+			diffOpts = append(diffOpts, &revocationsOption{})
+		case "tlsmaporder":
+			diffOpts = append(diffOpts, &tlsMapOrderOption{newValue: newValue.([]string)})
+		case "bearertokenlisteners":
+			diffOpts = append(diffOpts, &bearerTokenListenersOption{newValue: newValue.([]string)})
+		case "kerberos":
+			diffOpts = append(diffOpts, &kerberosOption{})
 		case "cluster":
 			newClusterOpts := newValue.(ClusterOpts)
 			oldClusterOpts := oldValue.(ClusterOpts)
@@ -882,7 +1248,7 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 				return nil, fmt.Errorf("config reload does not support moving to or from an account resolver")
 			}
 			diffOpts = append(diffOpts, &accountsOption{})
-		case "accountresolvertlsconfig":
+		case "accountresolvertlsconfig", "operatorpolicies":
 			diffOpts = append(diffOpts, &accountsOption{})
 		case "gateway":
 			// Not supported for now, but report warning if configuration of gateway
@@ -924,6 +1290,10 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			return nil, fmt.Errorf("config reload not supported for jetstream max memory")
 		case "jetstreammaxstore":
 			return nil, fmt.Errorf("config reload not supported for jetstream max storage")
+		case "jetstreamrecoveryconcurrency":
+			return nil, fmt.Errorf("config reload not supported for jetstream recovery concurrency")
+		case "jetstreamusageinterval", "jetstreamusageaggregation":
+			return nil, fmt.Errorf("config reload not supported for jetstream usage records")
 		case "websocket":
 			// Similar to gateways
 			tmpOld := oldValue.(WebsocketOpts)
@@ -936,6 +1306,52 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
 					field.Name, oldValue, newValue)
 			}
+		case "kafka":
+			tmpOld := oldValue.(KafkaOpts)
+			tmpNew := newValue.(KafkaOpts)
+			tmpOld.TLSConfig = nil
+			tmpNew.TLSConfig = nil
+			if !reflect.DeepEqual(tmpOld, tmpNew) {
+				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
+					field.Name, oldValue, newValue)
+			}
+		case "stomp":
+			tmpOld := oldValue.(StompOpts)
+			tmpNew := newValue.(StompOpts)
+			tmpOld.TLSConfig = nil
+			tmpNew.TLSConfig = nil
+			if !reflect.DeepEqual(tmpOld, tmpNew) {
+				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
+					field.Name, oldValue, newValue)
+			}
+		case "amqp":
+			tmpOld := oldValue.(AMQPOpts)
+			tmpNew := newValue.(AMQPOpts)
+			tmpOld.TLSConfig = nil
+			tmpNew.TLSConfig = nil
+			if !reflect.DeepEqual(tmpOld, tmpNew) {
+				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
+					field.Name, oldValue, newValue)
+			}
+		case "redis":
+			tmpOld := oldValue.(RedisOpts)
+			tmpNew := newValue.(RedisOpts)
+			tmpOld.TLSConfig = nil
+			tmpNew.TLSConfig = nil
+			if !reflect.DeepEqual(tmpOld, tmpNew) {
+				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
+					field.Name, oldValue, newValue)
+			}
+		case "rest":
+			// The maximum timeout is read for each request.
+			tmpOld := oldValue.(RESTOpts)
+			tmpNew := newValue.(RESTOpts)
+			tmpOld.TLSConfig, tmpOld.MaxTimeout = nil, 0
+			tmpNew.TLSConfig, tmpNew.MaxTimeout = nil, 0
+			if !reflect.DeepEqual(tmpOld, tmpNew) {
+				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
+					field.Name, oldValue, newValue)
+			}
 		case "connecterrorreports":
 			diffOpts = append(diffOpts, &connectErrorReports{newValue: newValue.(int)})
 		case "reconnecterrorreports":
@@ -947,8 +1363,46 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 		case "disableshortfirstping":
 			newOpts.DisableShortFirstPing = oldValue.(bool)
 			continue
+		case "signidentity":
+			diffOpts = append(diffOpts, &signIdentityOption{newValue: newValue.(bool)})
 		case "maxtracedmsglen":
 			diffOpts = append(diffOpts, &maxTracedMsgLenOption{newValue: newValue.(int)})
+		case "tlsexpirythresholds":
+			diffOpts = append(diffOpts, &tlsExpiryThresholdsOption{newValue: newValue.([]int)})
+		case "configsnapshots":
+			// Applied when the next snapshot is recorded.
+			continue
+		case "ipfilters":
+			diffOpts = append(diffOpts, &ipFiltersOption{newValue: newValue.(map[string]*IPFilterOpts)})
+		case "noncesize":
+			diffOpts = append(diffOpts, &nonceSizeOption{newValue: newValue.(int)})
+		case "noncettl":
+			diffOpts = append(diffOpts, &nonceTTLOption{newValue: newValue.(time.Duration)})
+		case "notlsdowngrade":
+			diffOpts = append(diffOpts, &noTLSDowngradeOption{newValue: newValue.(bool)})
+		case "connectionfingerprinting":
+			diffOpts = append(diffOpts, &connectionFingerprintingOption{newValue: newValue.(bool)})
+		case "norespondershints":
+			diffOpts = append(diffOpts, &noRespondersHintsOption{newValue: newValue.(bool)})
+		case "scattergather":
+			diffOpts = append(diffOpts, &scatterGatherOption{newValue: newValue.(ScatterGatherOpts)})
+		case "servicegraph":
+			diffOpts = append(diffOpts, &serviceGraphOption{newValue: newValue.(ServiceGraphOpts)})
+		case "authcache":
+			diffOpts = append(diffOpts, &authCacheOption{newValue: newValue.(AuthCacheOpts)})
+		case "resolvercache":
+			diffOpts = append(diffOpts, &resolverCacheOption{newValue: newValue.(ResolverCacheOpts)})
+		case "authlockout":
+			diffOpts = append(diffOpts, &authLockoutOption{newValue: newValue.(AuthLockoutOpts)})
+		case "dnsresolver":
+			diffOpts = append(diffOpts, &dnsResolverOption{newValue: newValue.(DNSResolverOpts)})
+		case "inactiveclienttimeout":
+			diffOpts = append(diffOpts, &inactiveClientTimeoutOption{newValue: newValue.(time.Duration)})
+		case "crashreportdir":
+			diffOpts = append(diffOpts, &crashReportDirOption{newValue: newValue.(string)})
+		case "sendcrashreports":
+			// Reports are only sent on startup.
+			continue
 		case "port":
 			// check to see if newValue == 0 and continue if so.
 			if newValue == 0 {
@@ -1106,6 +1560,8 @@ func (s *Server) reloadAuthorization() {
 				newAcc.sl = acc.sl
 				newAcc.rm = acc.rm
 				newAcc.js = acc.js
+				newAcc.pubClaims = acc.pubClaims
+				newAcc.svcGraph = acc.svcGraph
 
 				if len(acc.imports.rrMap) > 0 {
 					newAcc.imports.rrMap = make(map[string][]*serviceRespEntry)
@@ -1115,6 +1571,7 @@ func (s *Server) reloadAuthorization() {
 				}
 				newAcc.mu.Unlock()
 				acc.mu.RUnlock()
+				newAcc.startPresence()
 
 				// Check if current and new config of this account are same
 				// in term of stream imports.
@@ -1134,7 +1591,7 @@ func (s *Server) reloadAuthorization() {
 		}
 		// Double check any JetStream configs.
 		checkJetStream = true
-	} else if s.opts.AccountResolver != nil {
+	} else if s.opts.AccountResolver != nil || len(s.opts.OperatorPolicies) > 0 {
 		s.configureResolver()
 		if _, ok := s.accResolver.(*MemAccResolver); ok {
 			// Check preloads so we can issue warnings etc if needed.
@@ -1205,7 +1662,15 @@ func (s *Server) reloadAuthorization() {
 		client.closeConnection(ClientClosed)
 	}
 
+	// Authorize the most recent clients first, so that a lower limit of
+	// connections of a user closes its most recent connections.
+	sort.Slice(clients, func(i, j int) bool { return clients[i].cid > clients[j].cid })
 	for _, client := range clients {
+		// Disconnect any revoked clients.
+		if s.isRevoked(client) {
+			client.userRevoked()
+			continue
+		}
 		// Disconnect any unauthorized clients.
 		if !s.isClientAuthorized(client) {
 			client.authViolation()
@@ -1434,3 +1899,96 @@ addLoop:
 
 	return add, remove
 }
+
+// ConfigSnapshot describes a configuration applied on startup or reload.
+type ConfigSnapshot struct {
+	ID         int       `json:"id"`
+	Time       time.Time `json:"time"`
+	ConfigFile string    `json:"config_file,omitempty"`
+	Digest     string    `json:"digest,omitempty"`
+	Current    bool      `json:"current,omitempty"`
+	opts       *Options
+}
+
+// ConfigSnapshotsOptions are the options for configuration snapshots requests.
+type ConfigSnapshotsOptions struct {
+	// Rollback, if set, is the ID of the snapshot to roll back to.
+	Rollback int `json:"rollback,omitempty"`
+}
+
+// recordConfigSnapshot keeps a copy of the options just applied, dropping
+// the oldest snapshots past the configured number.
+// Lock should be held.
+func (s *Server) recordConfigSnapshot(opts *Options) {
+	max := opts.ConfigSnapshots
+	if max == 0 {
+		max = DEFAULT_CONFIG_SNAPSHOTS
+	}
+	if max < 0 {
+		s.configSnapshots = nil
+		return
+	}
+	s.configSnapshotID++
+	s.configSnapshots = append(s.configSnapshots, &ConfigSnapshot{
+		ID:         s.configSnapshotID,
+		Time:       time.Now().UTC(),
+		ConfigFile: opts.ConfigFile,
+		Digest:     optionsDigest(opts),
+		opts:       opts.Clone(),
+	})
+	if n := len(s.configSnapshots) - max; n > 0 {
+		s.configSnapshots = append(s.configSnapshots[:0], s.configSnapshots[n:]...)
+	}
+}
+
+// ConfigSnapshots returns the configurations kept for rollback, oldest first.
+// The last one is the configuration in effect.
+func (s *Server) ConfigSnapshots() []*ConfigSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snaps := make([]*ConfigSnapshot, 0, len(s.configSnapshots))
+	for i, cs := range s.configSnapshots {
+		c := *cs
+		c.Current = i == len(s.configSnapshots)-1
+		c.opts = nil
+		snaps = append(snaps, &c)
+	}
+	return snaps
+}
+
+// RollbackConfig applies again the configuration of the given snapshot,
+// with the same semantics as a reload. On success, that configuration
+// is recorded as a new snapshot.
+func (s *Server) RollbackConfig(id int) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.mu.Lock()
+	var opts *Options
+	for _, cs := range s.configSnapshots {
+		if cs.ID == id {
+			opts = cs.opts.Clone()
+			break
+		}
+	}
+	s.mu.Unlock()
+	if opts == nil {
+		return fmt.Errorf("configuration snapshot %d not found", id)
+	}
+	if err := s.applyNewOptions(opts); err != nil {
+		return err
+	}
+	s.Noticef("Rolled back to configuration snapshot %d", id)
+	return nil
+}
+
+// configSnapshotsReq handles configuration snapshots requests, rolling
+// back first if requested.
+func (s *Server) configSnapshotsReq(opts *ConfigSnapshotsOptions) ([]*ConfigSnapshot, error) {
+	if opts.Rollback > 0 {
+		if err := s.RollbackConfig(opts.Rollback); err != nil {
+			return nil, err
+		}
+	}
+	return s.ConfigSnapshots(), nil
+}
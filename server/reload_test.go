@@ -4383,3 +4383,61 @@ func TestConfigReloadDefaultSystemAccount(t *testing.T) {
 	}
 	testInAccounts()
 }
+
+func TestConfigReloadSnapshotsAndRollback(t *testing.T) {
+	s, _, conf := runReloadServerWithContent(t, []byte(`
+		listen: "127.0.0.1:-1"
+		max_payload: 1000
+		config_snapshots: 2
+		accounts { SYS: { users: [{user: sys, password: pwd}] } }
+		system_account: SYS
+	`))
+	defer os.Remove(conf)
+	defer s.Shutdown()
+
+	for _, mp := range []int{2000, 3000} {
+		changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(`
+			listen: "127.0.0.1:-1"
+			max_payload: %d
+			config_snapshots: 2
+			accounts { SYS: { users: [{user: sys, password: pwd}] } }
+			system_account: SYS
+		`, mp)))
+		if err := s.Reload(); err != nil {
+			t.Fatalf("Error reloading config: %v", err)
+		}
+	}
+	// The startup configuration was dropped.
+	snaps := s.ConfigSnapshots()
+	if len(snaps) != 2 || snaps[0].ID != 2 || snaps[1].ID != 3 || !snaps[1].Current || snaps[0].Current {
+		t.Fatalf("Unexpected snapshots: %+v", snaps)
+	}
+	if snaps[0].Digest == snaps[1].Digest {
+		t.Fatalf("Expected different digests, got %+v", snaps)
+	}
+	if err := s.RollbackConfig(1); err == nil {
+		t.Fatal("Expected error rolling back to a dropped snapshot")
+	}
+
+	// Roll back with a system request.
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer nc.Close()
+	req, _ := json.Marshal(&ConfigSnapshotsOptions{Rollback: 2})
+	msg, err := nc.Request(fmt.Sprintf("$SYS.REQ.SERVER.%s.CONFIG", s.ID()), req, time.Second)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	var resp struct {
+		Data  []*ConfigSnapshot `json:"data"`
+		Error interface{}       `json:"error"`
+	}
+	if err := json.Unmarshal(msg.Data, &resp); err != nil || resp.Error != nil {
+		t.Fatalf("Unexpected response: %s, %v", msg.Data, err)
+	}
+	if len(resp.Data) != 2 || resp.Data[1].ID != 4 || resp.Data[1].Digest != snaps[0].Digest {
+		t.Fatalf("Unexpected snapshots: %s", msg.Data)
+	}
+	if mp := s.getOpts().MaxPayload; mp != 2000 {
+		t.Fatalf("Expected max payload to be rolled back to 2000, got %v", mp)
+	}
+}
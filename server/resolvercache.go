@@ -0,0 +1,225 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+// In operator mode, the claims of accounts are refreshed from the account
+// resolver once they are older than the cache TTL of the resolver, which
+// blocks the authentication of clients on the resolver, and fails it while
+// the resolver is unreachable. With resolver_cache, stale claims keep being
+// used while they are refreshed in the background, up to max_stale after
+// the TTL when set, so that clients can authenticate during outages of the
+// resolver. Validated user JWTs are also cached, up to max_user_jwts, so
+// that reconnecting clients do not have their signature verified again.
+// Their expiration is still checked on each use.
+
+// Default maximum number of cached user JWTs.
+const resolverCacheDefaultMaxUserJWTs = 10000
+
+// ErrAccountResolverStale is returned when the claims of an account are
+// older than allowed and can not be refreshed.
+var ErrAccountResolverStale = errors.New("account claims are stale and could not be refreshed")
+
+// ResolverCacheOpts configure the cache of account claims and user JWTs.
+type ResolverCacheOpts struct {
+	Enabled bool
+	// TTL after which account claims are refreshed. Defaults to the cache
+	// TTL of the account resolver.
+	TTL time.Duration
+	// MaxStale is how long after the TTL the claims of an account are used
+	// when they can not be refreshed. Unlimited when 0.
+	MaxStale time.Duration
+	// MaxUserJWTs is the maximum number of cached user JWTs. Defaults to
+	// 10000, a negative value disables their caching.
+	MaxUserJWTs int
+}
+
+func (o *ResolverCacheOpts) maxUserJWTs() int {
+	switch {
+	case o.MaxUserJWTs < 0:
+		return 0
+	case o.MaxUserJWTs == 0:
+		return resolverCacheDefaultMaxUserJWTs
+	}
+	return o.MaxUserJWTs
+}
+
+func validateResolverCacheOptions(o *Options) error {
+	if o.ResolverCache.TTL < 0 || o.ResolverCache.MaxStale < 0 {
+		return errors.New("resolver_cache durations can not be negative")
+	}
+	return nil
+}
+
+// ResolverVarz are the stats of the cache of account claims and user JWTs.
+type ResolverVarz struct {
+	// Lookups of accounts whose claims were fresh.
+	AccountHits uint64 `json:"account_hits"`
+	// Lookups served with stale claims while they were refreshed.
+	StaleServed uint64 `json:"stale_served"`
+	// Lookups rejected because the claims were too stale.
+	StaleRejected uint64 `json:"stale_rejected"`
+	// Background refreshes of claims, and the ones that failed.
+	Refreshes     uint64 `json:"refreshes"`
+	RefreshErrors uint64 `json:"refresh_errors"`
+	UserJWTs      int    `json:"user_jwts"`
+	UserJWTHits   uint64 `json:"user_jwt_hits"`
+	UserJWTMisses uint64 `json:"user_jwt_misses"`
+}
+
+// resolverCache holds the validated user JWTs and the stats of the cache.
+type resolverCache struct {
+	// Updated atomically, first for alignment.
+	accountHits   uint64
+	staleServed   uint64
+	staleRejected uint64
+	refreshes     uint64
+	refreshErrors uint64
+	jwtHits       uint64
+	jwtMisses     uint64
+
+	mu   sync.Mutex
+	jwts map[[sha256.Size]byte]*jwt.UserClaims
+}
+
+// markValidated records that the claims of the account were just fetched
+// from, or pushed by, the resolver.
+func (a *Account) markValidated() {
+	a.mu.Lock()
+	a.validated = time.Now()
+	a.mu.Unlock()
+}
+
+// revalidateAccount checks the age of the claims of the account, refreshing
+// them in the background once stale. It returns an error if they are too
+// stale to be used and can not be refreshed.
+// Lock MUST NOT be held upon entry.
+func (s *Server) revalidateAccount(acc *Account, opts *ResolverCacheOpts) error {
+	rc := &s.resolverCache
+	ttl := opts.TTL
+	if ttl <= 0 {
+		ttl = s.accountResolverCacheTTL()
+	}
+	acc.mu.RLock()
+	age := time.Since(acc.validated)
+	acc.mu.RUnlock()
+	if ttl <= 0 || age <= ttl {
+		atomic.AddUint64(&rc.accountHits, 1)
+		return nil
+	}
+	if opts.MaxStale > 0 && age > ttl+opts.MaxStale {
+		// Too stale to be served, this lookup has to wait for the refresh,
+		// unless the claims were just refreshed.
+		err := s.updateAccount(acc)
+		if err != nil && err != ErrAccountResolverSameClaims && err != ErrAccountResolverUpdateTooSoon {
+			atomic.AddUint64(&rc.staleRejected, 1)
+			s.Warnf("Account [%s] claims are stale for %v and could not be refreshed: %v", acc.Name, age, err)
+			return ErrAccountResolverStale
+		}
+		atomic.AddUint64(&rc.refreshes, 1)
+		return nil
+	}
+	atomic.AddUint64(&rc.staleServed, 1)
+	// Only one refresh at a time per account.
+	if !atomic.CompareAndSwapInt32(&acc.refreshing, 0, 1) {
+		return nil
+	}
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		defer atomic.StoreInt32(&acc.refreshing, 0)
+		s.Debugf("Account [%s] claims are stale, refreshing in the background", acc.Name)
+		atomic.AddUint64(&rc.refreshes, 1)
+		if err := s.updateAccount(acc); err != nil && err != ErrAccountResolverSameClaims {
+			atomic.AddUint64(&rc.refreshErrors, 1)
+		}
+	})
+	return nil
+}
+
+// decodeUserClaims decodes the user JWT, using the cached claims of the
+// JWT when the cache is enabled.
+func (s *Server) decodeUserClaims(ujwt string) (*jwt.UserClaims, error) {
+	opts := s.getOpts().ResolverCache
+	max := opts.maxUserJWTs()
+	if !opts.Enabled || max == 0 {
+		return jwt.DecodeUserClaims(ujwt)
+	}
+	rc := &s.resolverCache
+	k := sha256.Sum256([]byte(ujwt))
+	rc.mu.Lock()
+	juc := rc.jwts[k]
+	rc.mu.Unlock()
+	if juc != nil {
+		atomic.AddUint64(&rc.jwtHits, 1)
+		return juc, nil
+	}
+	atomic.AddUint64(&rc.jwtMisses, 1)
+	juc, err := jwt.DecodeUserClaims(ujwt)
+	if err != nil {
+		return nil, err
+	}
+	rc.mu.Lock()
+	if rc.jwts == nil {
+		rc.jwts = make(map[[sha256.Size]byte]*jwt.UserClaims)
+	}
+	if len(rc.jwts) >= max {
+		// Random delete.
+		for ek := range rc.jwts {
+			delete(rc.jwts, ek)
+			break
+		}
+	}
+	rc.jwts[k] = juc
+	rc.mu.Unlock()
+	return juc, nil
+}
+
+// purgeResolverCache removes the cached user JWTs, when the cache is
+// changed on reload.
+func (s *Server) purgeResolverCache() {
+	rc := &s.resolverCache
+	rc.mu.Lock()
+	rc.jwts = nil
+	rc.mu.Unlock()
+}
+
+// resolverCacheVarz returns the stats of the cache, if enabled.
+func (s *Server) resolverCacheVarz() *ResolverVarz {
+	if !s.getOpts().ResolverCache.Enabled {
+		return nil
+	}
+	rc := &s.resolverCache
+	rc.mu.Lock()
+	entries := len(rc.jwts)
+	rc.mu.Unlock()
+	return &ResolverVarz{
+		AccountHits:   atomic.LoadUint64(&rc.accountHits),
+		StaleServed:   atomic.LoadUint64(&rc.staleServed),
+		StaleRejected: atomic.LoadUint64(&rc.staleRejected),
+		Refreshes:     atomic.LoadUint64(&rc.refreshes),
+		RefreshErrors: atomic.LoadUint64(&rc.refreshErrors),
+		UserJWTs:      entries,
+		UserJWTHits:   atomic.LoadUint64(&rc.jwtHits),
+		UserJWTMisses: atomic.LoadUint64(&rc.jwtMisses),
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+// outageAccResolver fails to fetch accounts while down.
+type outageAccResolver struct {
+	MemAccResolver
+	mu   sync.Mutex
+	down bool
+}
+
+func (r *outageAccResolver) Fetch(name string) (string, error) {
+	r.mu.Lock()
+	down := r.down
+	r.mu.Unlock()
+	if down {
+		return _EMPTY_, errors.New("resolver unreachable")
+	}
+	return r.MemAccResolver.Fetch(name)
+}
+
+func (r *outageAccResolver) setDown(down bool) {
+	r.mu.Lock()
+	r.down = down
+	r.mu.Unlock()
+}
+
+func TestResolverCache(t *testing.T) {
+	okp, _ := nkeys.FromSeed(oSeed)
+	opub, _ := okp.PublicKey()
+	r := &outageAccResolver{}
+	opts := DefaultOptions()
+	opts.TrustedKeys = []string{opub}
+	opts.AccountResolver = r
+	opts.ResolverCache = ResolverCacheOpts{Enabled: true, TTL: 50 * time.Millisecond}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	store := func(subs int64) {
+		t.Helper()
+		nac := jwt.NewAccountClaims(apub)
+		nac.Limits.Subs = subs
+		ajwt, err := nac.Encode(okp)
+		if err != nil {
+			t.Fatalf("Error encoding account claims: %v", err)
+		}
+		r.Store(apub, ajwt)
+	}
+	maxSubs := func(acc *Account) int32 {
+		acc.mu.RLock()
+		defer acc.mu.RUnlock()
+		return acc.msubs
+	}
+
+	store(10)
+	acc, err := s.LookupAccount(apub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if _, err := s.LookupAccount(apub); err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+
+	// Clients authenticate with cached user JWTs.
+	c, cr, cs := createClient(t, s, akp)
+	defer c.close()
+	c.parseAsync(cs)
+	if l, _ := cr.ReadString('\n'); !strings.HasPrefix(l, "PONG") {
+		t.Fatalf("Expected a PONG, got %q", l)
+	}
+	ujwt := c.opts.JWT
+	if _, err := s.decodeUserClaims(ujwt); err != nil {
+		t.Fatalf("Error decoding user JWT: %v", err)
+	}
+	v := s.resolverCacheVarz()
+	if v.AccountHits == 0 || v.UserJWTs != 1 || v.UserJWTHits != 1 || v.UserJWTMisses != 1 {
+		t.Fatalf("Unexpected stats: %+v", v)
+	}
+
+	// Stale claims are served while they are refreshed.
+	store(20)
+	time.Sleep(60 * time.Millisecond)
+	if _, err := s.LookupAccount(apub); err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if n := maxSubs(acc); n != 20 {
+			return fmt.Errorf("expected max subs of 20, got %d", n)
+		}
+		return nil
+	})
+
+	// And while the resolver is down.
+	r.setDown(true)
+	time.Sleep(60 * time.Millisecond)
+	if _, err := s.LookupAccount(apub); err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if v := s.resolverCacheVarz(); v.RefreshErrors != 1 {
+			return fmt.Errorf("expected a refresh error, got %+v", v)
+		}
+		return nil
+	})
+	v = s.resolverCacheVarz()
+	if v.StaleServed != 2 || v.Refreshes != 2 {
+		t.Fatalf("Unexpected stats: %+v", v)
+	}
+
+	// Up to max_stale. Updates are not done more often than once per
+	// second.
+	s.mu.Lock()
+	s.opts.ResolverCache.MaxStale = 50 * time.Millisecond
+	s.mu.Unlock()
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := s.LookupAccount(apub); err != ErrAccountResolverStale {
+		t.Fatalf("Expected stale error, got %v", err)
+	}
+	if v := s.resolverCacheVarz(); v.StaleRejected != 1 {
+		t.Fatalf("Unexpected stats: %+v", v)
+	}
+	r.setDown(false)
+	if _, err := s.LookupAccount(apub); err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// The REST listener lets webhooks and tools without a client library
+// inject messages with a single HTTP request:
+//
+//	POST /v1/accounts/{account}/subjects/{subject}
+//
+// The body is the payload and headers prefixed with Nats-Header- are
+// passed as message headers, without the prefix. Requests authenticate
+// with basic auth, or with a bearer token that is either the server
+// token or an OIDC access token. With the request or timeout query
+// parameters, the message is sent as a request and the response is the
+// reply, with its headers prefixed with Nats-Header-.
+
+const (
+	// RESTPathPrefix is the path prefix of the publish endpoint.
+	RESTPathPrefix = "/v1/accounts/"
+	// RESTHeaderPrefix is the prefix of HTTP headers mapped to message headers.
+	RESTHeaderPrefix = "Nats-Header-"
+
+	// Timeout of requests without a timeout parameter.
+	restDefaultTimeout = 5 * time.Second
+	// Default maximum timeout of requests.
+	restDefaultMaxTimeout = time.Minute
+)
+
+// RESTOpts are options for the HTTP publish and request listener.
+type RESTOpts struct {
+	// The server will accept HTTP requests on this hostname/IP.
+	Host string
+	// The server will accept HTTP requests on this port.
+	Port int
+	// TLS configuration is required for HTTPS.
+	TLSConfig *tls.Config
+	// MaxTimeout caps the timeout of requests waiting for a reply.
+	// Defaults to one minute.
+	MaxTimeout time.Duration
+}
+
+// srvREST is the state of the REST listener.
+type srvREST struct {
+	listener net.Listener
+}
+
+// startRESTListener listens for HTTP publish and request calls.
+func (s *Server) startRESTListener() {
+	o := s.getOpts().REST
+
+	port := o.Port
+	if port == -1 {
+		port = 0
+	}
+	hp := net.JoinHostPort(o.Host, strconv.Itoa(port))
+	l, err := net.Listen("tcp", hp)
+	if err != nil {
+		s.Fatalf("Unable to listen for REST requests: %v", err)
+		return
+	}
+	scheme := "http"
+	if o.TLSConfig != nil {
+		l = tls.NewListener(l, o.TLSConfig)
+		scheme = "https"
+	}
+	s.Noticef("Listening for REST requests on %s://%s", scheme, l.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(RESTPathPrefix, s.HandleREST)
+	srv := &http.Server{
+		Addr:           hp,
+		Handler:        mux,
+		MaxHeaderBytes: 1 << 20,
+	}
+	s.mu.Lock()
+	s.rest.listener = l
+	s.mu.Unlock()
+
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			s.mu.Lock()
+			shutdown := s.shutdown
+			s.mu.Unlock()
+			if !shutdown {
+				s.Fatalf("Error serving REST requests on %q: %v", hp, err)
+			}
+		}
+		srv.Close()
+		s.done <- true
+	}()
+}
+
+// RESTAddr returns the address of the REST listener, or nil if not
+// listening.
+func (s *Server) RESTAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rest.listener == nil {
+		return nil
+	}
+	return s.rest.listener.Addr()
+}
+
+// restLogin authenticates the HTTP request.
+func (s *Server) restLogin(r *http.Request) (*Account, *User, error) {
+	var remote net.Addr
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		remote = addr
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		return s.checkLogin(remote, user, pass, _EMPTY_)
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		// Requests without credentials are only allowed when the server
+		// does not require authentication.
+		if !s.anonymousLogin(_EMPTY_) {
+			return nil, nil, ErrAuthentication
+		}
+		return s.checkLogin(remote, _EMPTY_, _EMPTY_, _EMPTY_)
+	}
+	token := strings.TrimSpace(auth[len("Bearer "):])
+	s.mu.Lock()
+	oidc := s.oidc
+	s.mu.Unlock()
+	if oidc != nil && isOIDCToken(token) {
+		user, _, err := s.oidcUser(oidc, token)
+		if err != nil {
+			return nil, nil, err
+		}
+		return user.Account, user, nil
+	}
+	return s.checkLogin(remote, _EMPTY_, token, _EMPTY_)
+}
+
+// HandleREST publishes the body of the HTTP request, or sends it as a
+// request and responds with the reply.
+func (s *Server) HandleREST(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, RESTPathPrefix), "/", 3)
+	if len(parts) != 3 || parts[0] == _EMPTY_ || parts[1] != "subjects" {
+		http.NotFound(w, r)
+		return
+	}
+	accName, subject := parts[0], parts[2]
+	if !IsValidLiteralSubject(subject) {
+		http.Error(w, fmt.Sprintf("invalid subject %q", subject), http.StatusBadRequest)
+		return
+	}
+
+	opts := s.getOpts()
+	q := r.URL.Query()
+	_, request := q["request"]
+	timeout := restDefaultTimeout
+	if t := q.Get("timeout"); t != _EMPTY_ {
+		d, err := time.ParseDuration(t)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("invalid timeout %q", t), http.StatusBadRequest)
+			return
+		}
+		maxTimeout := opts.REST.MaxTimeout
+		if maxTimeout <= 0 {
+			maxTimeout = restDefaultMaxTimeout
+		}
+		if d > maxTimeout {
+			d = maxTimeout
+		}
+		timeout, request = d, true
+	}
+
+	acc, user, err := s.restLogin(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="nats"`)
+		http.Error(w, "authorization violation", http.StatusUnauthorized)
+		return
+	}
+	if acc.GetName() != accName {
+		http.Error(w, fmt.Sprintf("not authorized for account %q", accName), http.StatusForbidden)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(opts.MaxPayload)+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hdr := restMsgHeader(r.Header)
+	if len(hdr)+len(body) > int(opts.MaxPayload) {
+		http.Error(w, ErrMaxPayload.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	c := s.createInternalAccountClient()
+	defer c.closeConnection(ClientClosed)
+	if err := s.registerLogin(c, acc, user); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var inbox string
+	if request {
+		inbox = "_INBOX." + nuid.Next()
+	}
+	c.mu.Lock()
+	allowed := c.perms == nil || (c.pubAllowed(subject) && (inbox == _EMPTY_ || c.canSubscribe(inbox)))
+	c.mu.Unlock()
+	if !allowed {
+		http.Error(w, fmt.Sprintf("permissions violation for publish to %q", subject), http.StatusForbidden)
+		return
+	}
+
+	if !request {
+		c.processInternalMsg(subject, _EMPTY_, hdr, body)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	type restReply struct {
+		hdr, body []byte
+	}
+	replyCh := make(chan *restReply, 1)
+	sub, err := c.processSub([]byte(inbox+" 1"), false)
+	if err != nil || sub == nil {
+		http.Error(w, "unable to subscribe to the reply subject", http.StatusInternalServerError)
+		return
+	}
+	sub.icb = func(_ *subscription, pc *client, _, _ string, msg []byte) {
+		// Internal account clients receive the message with the trailing CRLF.
+		msg = msg[:len(msg)-LEN_CR_LF]
+		rr := &restReply{}
+		if pc != nil && pc.pa.hdr > 0 && pc.pa.hdr <= len(msg) {
+			rr.hdr = append([]byte(nil), msg[:pc.pa.hdr]...)
+			msg = msg[pc.pa.hdr:]
+		}
+		rr.body = append([]byte(nil), msg...)
+		select {
+		case replyCh <- rr:
+		default:
+		}
+	}
+	c.processInternalMsg(subject, inbox, hdr, body)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case rr := <-replyCh:
+		restReplyHeader(w.Header(), rr.hdr)
+		w.WriteHeader(http.StatusOK)
+		w.Write(rr.body)
+	case <-timer.C:
+		http.Error(w, "timeout waiting for a reply", http.StatusGatewayTimeout)
+	case <-s.quitCh:
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+	case <-r.Context().Done():
+	}
+}
+
+// restMsgHeader returns the message header for the HTTP headers, or nil
+// if there are none to pass.
+func restMsgHeader(h http.Header) []byte {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		if strings.HasPrefix(k, RESTHeaderPrefix) && len(k) > len(RESTHeaderPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	ct := h.Get("Content-Type")
+	if len(keys) == 0 && ct == _EMPTY_ {
+		return nil
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	b.WriteString("NATS/1.0" + _CRLF_)
+	if ct != _EMPTY_ {
+		b.WriteString("Content-Type: " + ct + _CRLF_)
+	}
+	for _, k := range keys {
+		for _, v := range h[k] {
+			b.WriteString(k[len(RESTHeaderPrefix):] + ": " + v + _CRLF_)
+		}
+	}
+	b.WriteString(_CRLF_)
+	return b.Bytes()
+}
+
+// restReplyHeader sets the HTTP headers for the message header of a reply.
+func restReplyHeader(h http.Header, hdr []byte) {
+	if len(hdr) == 0 {
+		return
+	}
+	for _, line := range bytes.Split(hdr, []byte(_CRLF_))[1:] {
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		k, v := string(line[:i]), string(bytes.TrimSpace(line[i+1:]))
+		if strings.EqualFold(k, "Content-Type") {
+			h.Set("Content-Type", v)
+		}
+		h.Add(RESTHeaderPrefix+k, v)
+	}
+}
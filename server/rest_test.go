@@ -0,0 +1,255 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func restPost(t *testing.T, url, user, pass string, hdr map[string]string, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	if user != _EMPTY_ {
+		req.SetBasicAuth(user, pass)
+	}
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+	return resp, string(b)
+}
+
+func TestRESTPublishAndRequest(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A: {
+				users: [
+					{user: a, password: pwd}
+					{user: limited, password: pwd, permissions: {publish: "orders.>", subscribe: "orders.>"}}
+				]
+			}
+			B: { users: [{user: b, password: pwd}] }
+		}
+		rest {
+			listen: "127.0.0.1:-1"
+			max_timeout: "250ms"
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	base := "http://" + s.RESTAddr().String() + RESTPathPrefix
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "orders.new")
+	natsSub(t, nc, "svc", func(m *nats.Msg) {
+		reply := nats.NewMsg(m.Reply)
+		reply.Header.Set("Content-Type", "text/plain")
+		reply.Header.Set("Order", m.Header.Get("Order"))
+		reply.Data = append([]byte("re: "), m.Data...)
+		m.RespondMsg(reply)
+	})
+	natsFlush(t, nc)
+
+	// One-shot publish, with header mapping.
+	resp, _ := restPost(t, base+"A/subjects/orders.new", "a", "pwd",
+		map[string]string{"Nats-Header-Order": "1", "Content-Type": "application/json", "X-Other": "x"}, `{}`)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Unexpected status %v", resp.Status)
+	}
+	m := natsNexMsg(t, sub, time.Second)
+	if string(m.Data) != "{}" || m.Header.Get("Order") != "1" || m.Header.Get("Content-Type") != "application/json" ||
+		m.Header.Get("X-Other") != _EMPTY_ {
+		t.Fatalf("Unexpected message %q %v", m.Data, m.Header)
+	}
+
+	// Request and reply.
+	resp, body := restPost(t, base+"A/subjects/svc?request", "a", "pwd", map[string]string{"Nats-Header-Order": "2"}, "hi")
+	if resp.StatusCode != http.StatusOK || body != "re: hi" || resp.Header.Get("Content-Type") != "text/plain" ||
+		resp.Header.Get("Nats-Header-Order") != "2" {
+		t.Fatalf("Unexpected response %v %q %v", resp.Status, body, resp.Header)
+	}
+
+	// No reply within the timeout, capped by max_timeout.
+	start := time.Now()
+	if resp, _ := restPost(t, base+"A/subjects/nobody?timeout=10s", "a", "pwd", nil, "hi"); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("Unexpected status %v", resp.Status)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Timeout not capped: %v", d)
+	}
+
+	for _, test := range []struct {
+		name, url, user string
+		status          int
+	}{
+		{"not authenticated", "A/subjects/orders.new", _EMPTY_, http.StatusUnauthorized},
+		{"wrong password", "A/subjects/orders.new", "bad", http.StatusUnauthorized},
+		{"other account", "A/subjects/orders.new", "b", http.StatusForbidden},
+		{"publish not allowed", "A/subjects/other", "limited", http.StatusForbidden},
+		{"reply not allowed", "A/subjects/orders.new?request", "limited", http.StatusForbidden},
+		{"wildcard", "A/subjects/orders.*", "a", http.StatusBadRequest},
+		{"bad timeout", "A/subjects/svc?timeout=x", "a", http.StatusBadRequest},
+		{"bad path", "A/streams/orders.new", "a", http.StatusNotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			user, pass := test.user, "pwd"
+			if user == "bad" {
+				user, pass = "a", "bad"
+			}
+			if resp, _ := restPost(t, base+test.url, user, pass, nil, "x"); resp.StatusCode != test.status {
+				t.Fatalf("Expected status %v, got %v", test.status, resp.Status)
+			}
+		})
+	}
+	if _, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Unexpected message or error: %v", err)
+	}
+
+	resp, err := http.Get(base + "A/subjects/orders.new")
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Unexpected status %v", resp.Status)
+	}
+}
+
+func TestRESTTokenAuthentication(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization { token: "s3cr3t" }
+		rest { listen: "127.0.0.1:-1" }
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	url := "http://" + s.RESTAddr().String() + RESTPathPrefix + globalAccountName + "/subjects/foo"
+	for token, status := range map[string]int{"s3cr3t": http.StatusAccepted, "bad": http.StatusUnauthorized} {
+		resp, _ := restPost(t, url, _EMPTY_, _EMPTY_, map[string]string{"Authorization": "Bearer " + token}, "x")
+		if resp.StatusCode != status {
+			t.Fatalf("Expected status %v for token %q, got %v", status, token, resp.Status)
+		}
+	}
+	// Requests without credentials are rejected.
+	if resp, _ := restPost(t, url, _EMPTY_, _EMPTY_, nil, "x"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401 without credentials, got %v", resp.Status)
+	}
+}
+
+func TestRESTTokensAuthentication(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts { A {} }
+		authorization {
+			tokens: [
+				{token: "tok-pub", permissions: {publish: "foo"}}
+				{token: "tok-a", account: A}
+			]
+		}
+		rest { listen: "127.0.0.1:-1" }
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	base := "http://" + s.RESTAddr().String() + RESTPathPrefix
+	for _, test := range []struct {
+		name, url, token string
+		status           int
+	}{
+		{"token", globalAccountName + "/subjects/foo", "tok-pub", http.StatusAccepted},
+		{"token permissions", globalAccountName + "/subjects/bar", "tok-pub", http.StatusForbidden},
+		{"token account", "A/subjects/bar", "tok-a", http.StatusAccepted},
+		{"other account", globalAccountName + "/subjects/foo", "tok-a", http.StatusForbidden},
+		{"unknown token", globalAccountName + "/subjects/foo", "bad", http.StatusUnauthorized},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp, _ := restPost(t, base+test.url, _EMPTY_, _EMPTY_, map[string]string{"Authorization": "Bearer " + test.token}, "x")
+			if resp.StatusCode != test.status {
+				t.Fatalf("Expected status %v, got %v", test.status, resp.Status)
+			}
+		})
+	}
+}
+
+func TestRESTUnsupportedAuthentication(t *testing.T) {
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization { users: [{nkey: %q}] }
+		rest { listen: "127.0.0.1:-1" }
+	`, pub)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	// Nkeys can not be used over HTTP, which must not let requests in.
+	url := "http://" + s.RESTAddr().String() + RESTPathPrefix + globalAccountName + "/subjects/foo"
+	for _, hdr := range []map[string]string{nil, {"Authorization": "Bearer " + pub}} {
+		if resp, _ := restPost(t, url, _EMPTY_, _EMPTY_, hdr, "x"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected status 401 with %v, got %v", hdr, resp.Status)
+		}
+	}
+	if resp, _ := restPost(t, url, pub, _EMPTY_, nil, "x"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401 with basic auth, got %v", resp.Status)
+	}
+}
+
+func TestRESTConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		rest {
+			listen: "127.0.0.1:8222"
+			max_timeout: "30s"
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.REST.Host != "127.0.0.1" || opts.REST.Port != 8222 || opts.REST.MaxTimeout != 30*time.Second {
+		t.Fatalf("Unexpected options: %+v", opts.REST)
+	}
+	conf = createConfFile(t, []byte(`rest { bad: 1 }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Fatalf("Expected error on unknown field, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Interest retention streams remove messages once all their consumers
+// acknowledged them. With a retention floor, acknowledged messages younger
+// than the minimum age, or among the last minimum number of messages, are
+// kept until they are not anymore, so that consumers created later, or
+// snapshots, still find recent messages.
+
+// Maximum interval at which acknowledged messages are checked against the
+// retention floor.
+const streamRetainedSweepInterval = time.Second
+
+// checkRetentionFloor validates the retention floor of the configuration.
+func checkRetentionFloor(cfg *StreamConfig) error {
+	if cfg.RetainMinAge < 0 || cfg.RetainMinMsgs < 0 {
+		return fmt.Errorf("stream retention floor can not be negative")
+	}
+	if (cfg.RetainMinAge > 0 || cfg.RetainMinMsgs > 0) && cfg.Retention != InterestPolicy {
+		return fmt.Errorf("stream retention floor requires interest retention policy")
+	}
+	return nil
+}
+
+// hasRetentionFloor returns true if acknowledged messages may be retained.
+// Lock should be held.
+func (mset *Stream) hasRetentionFloor() bool {
+	return mset.config.RetainMinAge > 0 || mset.config.RetainMinMsgs > 0
+}
+
+// retainedByFloor returns true if the acknowledged message is still within
+// the retention floor.
+// Lock should be held.
+func (mset *Stream) retainedByFloor(seq uint64, ts int64, lastSeq uint64, now int64) bool {
+	if n := mset.config.RetainMinMsgs; n > 0 && seq <= lastSeq && lastSeq-seq < uint64(n) {
+		return true
+	}
+	return mset.config.RetainMinAge > 0 && now-ts < int64(mset.config.RetainMinAge)
+}
+
+// removeAckedMsg removes a message acknowledged by all consumers, or
+// retains it if within the retention floor.
+func (mset *Stream) removeAckedMsg(seq uint64) {
+	mset.mu.Lock()
+	store := mset.store
+	if !mset.hasRetentionFloor() || store == nil {
+		mset.mu.Unlock()
+		if store != nil {
+			store.RemoveMsg(seq)
+		}
+		return
+	}
+	_, _, _, ts, err := store.LoadMsg(seq)
+	if err != nil {
+		mset.mu.Unlock()
+		return
+	}
+	if !mset.retainedByFloor(seq, ts, store.State().LastSeq, time.Now().UnixNano()) {
+		mset.mu.Unlock()
+		store.RemoveMsg(seq)
+		return
+	}
+	if mset.retained == nil {
+		mset.retained = make(map[uint64]int64)
+	}
+	mset.retained[seq] = ts
+	if mset.rtmr == nil {
+		mset.rtmr = time.AfterFunc(mset.retainedSweepInterval(), mset.sweepRetained)
+	}
+	mset.mu.Unlock()
+}
+
+// retainedSweepInterval returns the interval at which retained messages
+// are checked.
+// Lock should be held.
+func (mset *Stream) retainedSweepInterval() time.Duration {
+	if age := mset.config.RetainMinAge; age > 0 && age < streamRetainedSweepInterval {
+		return age
+	}
+	return streamRetainedSweepInterval
+}
+
+// sweepRetained removes the retained messages that left the retention floor.
+func (mset *Stream) sweepRetained() {
+	mset.mu.Lock()
+	mset.rtmr = nil
+	store := mset.store
+	if mset.client == nil || store == nil {
+		mset.mu.Unlock()
+		return
+	}
+	lastSeq := store.State().LastSeq
+	now := time.Now().UnixNano()
+	var remove []uint64
+	for seq, ts := range mset.retained {
+		if !mset.retainedByFloor(seq, ts, lastSeq, now) {
+			delete(mset.retained, seq)
+			remove = append(remove, seq)
+		}
+	}
+	obs := make([]*Consumer, 0, len(mset.consumers))
+	for _, o := range mset.consumers {
+		obs = append(obs, o)
+	}
+	if len(mset.retained) > 0 {
+		mset.rtmr = time.AfterFunc(mset.retainedSweepInterval(), mset.sweepRetained)
+	}
+	mset.mu.Unlock()
+
+	for _, seq := range remove {
+		// Consumers created since the acknowledgement may still need it,
+		// it will be acknowledged again.
+		needAck := false
+		for _, o := range obs {
+			if o.needAck(seq) {
+				needAck = true
+				break
+			}
+		}
+		if !needAck {
+			store.RemoveMsg(seq)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/x509"
+	"time"
+)
+
+// Without an operator, users, nkeys and client certificates can be revoked
+// from the configuration, as user JWTs are revoked by their account. Each
+// revocation takes effect at its time, immediately if it is in the past or
+// not set: revoked clients are rejected and connected ones are disconnected,
+// with a config reload or when the time of the revocation is reached.
+
+// RevocationOpts are the revoked usernames, nkeys and SHA-256 fingerprints
+// of client certificates, with the time their revocation takes effect.
+type RevocationOpts struct {
+	Users            map[string]time.Time
+	Nkeys            map[string]time.Time
+	CertFingerprints map[string]time.Time
+}
+
+// isSet returns true if anything is revoked.
+func (r *RevocationOpts) isSet() bool {
+	return len(r.Users)+len(r.Nkeys)+len(r.CertFingerprints) > 0
+}
+
+// revoked returns true if the username, nkey or certificate of the client is
+// revoked at the given time.
+func (r *RevocationOpts) revoked(username, nkey string, cert *x509.Certificate, now time.Time) bool {
+	effective := func(m map[string]time.Time, k string) bool {
+		if k == _EMPTY_ {
+			return false
+		}
+		t, ok := m[k]
+		return ok && !now.Before(t)
+	}
+	if effective(r.Users, username) || effective(r.Nkeys, nkey) {
+		return true
+	}
+	return cert != nil && len(r.CertFingerprints) > 0 && effective(r.CertFingerprints, certFingerprint(cert))
+}
+
+// next returns the time of the first revocation taking effect after now,
+// or the zero time if there is none.
+func (r *RevocationOpts) next(now time.Time) time.Time {
+	var next time.Time
+	for _, m := range []map[string]time.Time{r.Users, r.Nkeys, r.CertFingerprints} {
+		for _, t := range m {
+			if t.After(now) && (next.IsZero() || t.Before(next)) {
+				next = t
+			}
+		}
+	}
+	return next
+}
+
+// isRevoked returns true if the client is revoked by the configuration.
+func (s *Server) isRevoked(c *client) bool {
+	r := &s.getOpts().Revocations
+	if !r.isSet() {
+		return false
+	}
+	var cert *x509.Certificate
+	if tlsState := c.GetTLSConnectionState(); tlsState != nil && len(tlsState.PeerCertificates) > 0 {
+		cert = tlsState.PeerCertificates[0]
+	}
+	c.mu.Lock()
+	username, nkey := c.opts.Username, c.opts.Nkey
+	c.mu.Unlock()
+	return r.revoked(username, nkey, cert, time.Now())
+}
+
+// userRevoked disconnects a client whose user has been revoked.
+func (c *client) userRevoked() {
+	c.sendErrAndDebug("User Authentication Revoked")
+	c.closeConnection(Revocation)
+}
+
+// scheduleRevocations arms the timer disconnecting the clients revoked at
+// the time of the next revocation.
+// Server lock is held on entry.
+func (s *Server) scheduleRevocations() {
+	if s.revTmr != nil {
+		s.revTmr.Stop()
+		s.revTmr = nil
+	}
+	r := &s.getOpts().Revocations
+	now := time.Now()
+	next := r.next(now)
+	if next.IsZero() {
+		return
+	}
+	s.revTmr = time.AfterFunc(next.Sub(now), s.enforceRevocations)
+}
+
+// enforceRevocations disconnects the revoked clients and schedules the
+// next revocations.
+func (s *Server) enforceRevocations() {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return
+	}
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.scheduleRevocations()
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		if s.isRevoked(c) {
+			c.userRevoked()
+		}
+	}
+}
@@ -78,6 +78,9 @@ type route struct {
 	gatewayURL   string
 	leafnodeURL  string
 	hash         string
+	// INFO of a solicited route signing the remote nonce, sent along the
+	// CONNECT once the remote INFO is received.
+	pendingInfo []byte
 }
 
 type connectInfo struct {
@@ -90,6 +93,8 @@ type connectInfo struct {
 	Headers  bool   `json:"headers"`
 	Name     string `json:"name"`
 	Gateway  string `json:"gateway,omitempty"`
+	Nkey     string `json:"nkey,omitempty"`
+	Sig      string `json:"sig,omitempty"`
 }
 
 // Route protocol constants
@@ -351,12 +356,20 @@ func (c *client) processInboundRoutedMsg(msg []byte) {
 }
 
 // Lock should be held entering here.
-func (c *client) sendRouteConnect(tlsRequired bool) {
+func (c *client) sendRouteConnect(tlsRequired bool, nonce string) {
 	var user, pass string
 	if userInfo := c.route.url.User; userInfo != nil {
 		user = userInfo.Username()
 		pass, _ = userInfo.Password()
 	}
+	var nkey, sig string
+	if o := c.srv.getOpts().Cluster; o.NkeySeed != _EMPTY_ || o.Signer != nil {
+		var err error
+		if nkey, sig, err = signNonce(o.Signer, o.NkeySeed, nonce); err != nil {
+			c.Errorf("Error signing route nonce: %v", err)
+			return
+		}
+	}
 	cinfo := connectInfo{
 		Echo:     true,
 		Verbose:  false,
@@ -366,6 +379,8 @@ func (c *client) sendRouteConnect(tlsRequired bool) {
 		TLS:      tlsRequired,
 		Name:     c.srv.info.ID,
 		Headers:  c.srv.supportsHeaders(),
+		Nkey:     nkey,
+		Sig:      sig,
 	}
 
 	b, err := json.Marshal(cinfo)
@@ -401,6 +416,15 @@ func (c *client) processRouteInfo(info *Info) {
 
 	s := c.srv
 
+	// A solicited route authenticating with an nkey signs the nonce of
+	// this first INFO in its CONNECT.
+	if infoJSON := c.route.pendingInfo; infoJSON != nil {
+		c.route.pendingInfo = nil
+		c.Debugf("Route connect msg sent")
+		c.sendRouteConnect(s.getOpts().Cluster.TLSConfig != nil, info.Nonce)
+		c.enqueueProto(infoJSON)
+	}
+
 	// Detect route to self.
 	if info.ID == s.info.ID {
 		// Need to set this so that the close does the right thing
@@ -1110,15 +1134,15 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 		}
 	}
 
-	c := &client{srv: s, nc: conn, opts: clientOpts{}, kind: ROUTER, msubs: -1, mpay: -1, route: r}
+	c := &client{srv: s, nc: conn, opts: clientOpts{}, kind: ROUTER, msubs: -1, mpay: -1, route: r, start: time.Now()}
 
 	// Grab server variables
 	s.mu.Lock()
-	// New proto wants a nonce (although not used in routes, that is, not signed in CONNECT)
-	var raw [nonceLen]byte
-	nonce := raw[:]
-	s.generateNonce(nonce)
-	s.routeInfo.Nonce = string(nonce)
+	// New proto wants a nonce, signed in the CONNECT of routes authenticating with an nkey.
+	s.routeInfo.Nonce = string(s.generateNonce())
+	if !didSolicit {
+		c.nonce = []byte(s.routeInfo.Nonce)
+	}
 	s.generateRouteInfoJSON()
 	// Clear now that it has been serialized. Will prevent nonce to be included in async INFO that we may send.
 	s.routeInfo.Nonce = _EMPTY_
@@ -1174,6 +1198,9 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 		}
 		// Reset the read deadline
 		conn.SetReadDeadline(time.Time{})
+		if !didSolicit {
+			s.recordTLSHandshake("cluster", conn.ConnectionState().DidResume)
+		}
 
 		// Re-Grab lock
 		c.mu.Lock()
@@ -1233,15 +1260,21 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 		c.Debugf("TLS version %s, cipher suite %s", tlsVersion(cs.Version), tlsCipher(cs.CipherSuite))
 	}
 
-	// Queue Connect proto if we solicited the connection.
-	if didSolicit {
-		c.Debugf("Route connect msg sent")
-		c.sendRouteConnect(tlsRequired)
-	}
+	if didSolicit && (opts.Cluster.NkeySeed != _EMPTY_ || opts.Cluster.Signer != nil) {
+		// Connect proto signs the nonce of the remote INFO, it is
+		// sent along our info once that is received.
+		r.pendingInfo = infoJSON
+	} else {
+		// Queue Connect proto if we solicited the connection.
+		if didSolicit {
+			c.Debugf("Route connect msg sent")
+			c.sendRouteConnect(tlsRequired, _EMPTY_)
+		}
 
-	// Send our info to the other side.
-	// Our new version requires dynamic information for accounts and a nonce.
-	c.enqueueProto(infoJSON)
+		// Send our info to the other side.
+		// Our new version requires dynamic information for accounts and a nonce.
+		c.enqueueProto(infoJSON)
+	}
 	c.mu.Unlock()
 
 	c.Noticef("Route connection created")
@@ -1536,7 +1569,7 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 		opts.Cluster.Port = l.Addr().(*net.TCPAddr).Port
 	}
 	// Check for Auth items
-	if opts.Cluster.Username != "" {
+	if opts.Cluster.Username != "" || len(opts.Cluster.Nkeys) > 0 {
 		info.AuthRequired = true
 	}
 	// Check for permissions.
@@ -1672,7 +1705,15 @@ func (s *Server) connectToRoute(rURL *url.URL, tryForEver, firstConnect bool) {
 			return
 		}
 		s.Debugf("Trying to connect to route on %s", rURL.Host)
-		conn, err := net.DialTimeout("tcp", rURL.Host, DEFAULT_ROUTE_DIAL)
+		address := rURL.Host
+		var err error
+		if opts.DNSResolver.configured() {
+			address, err = s.getRandomIP(s.dnsResolver, rURL.Host)
+		}
+		var conn net.Conn
+		if err == nil {
+			conn, err = net.DialTimeout("tcp", address, DEFAULT_ROUTE_DIAL)
+		}
 		if err != nil {
 			attempts++
 			if s.shouldReportConnectErr(firstConnect, attempts) {
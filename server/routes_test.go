@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,6 +27,7 @@ import (
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 func init() {
@@ -1286,3 +1288,66 @@ func TestRouteCloseTLSConnection(t *testing.T) {
 	route.closeConnection(SlowConsumerWriteDeadline)
 	ch <- true
 }
+
+func TestRouteNkeyAuth(t *testing.T) {
+	createKey := func() (string, string) {
+		t.Helper()
+		kp, err := nkeys.CreateServer()
+		if err != nil {
+			t.Fatalf("Error creating key: %v", err)
+		}
+		seed, _ := kp.Seed()
+		pub, _ := kp.PublicKey()
+		return string(seed), pub
+	}
+	seedA, pubA := createKey()
+	seedB, pubB := createKey()
+	seedC, _ := createKey()
+
+	optsA := DefaultOptions()
+	optsA.Cluster.NkeySeed = seedA
+	optsA.Cluster.Nkeys = []string{pubB}
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	routeToA := RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", optsA.Cluster.Port))
+	optsB := DefaultOptions()
+	optsB.Cluster.NkeySeed = seedB
+	optsB.Cluster.Nkeys = []string{pubA}
+	optsB.Routes = routeToA
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+
+	checkClusterFormed(t, srvA, srvB)
+
+	// Servers with an unknown key, or without one, are rejected.
+	for _, seed := range []string{seedC, _EMPTY_} {
+		optsC := DefaultOptions()
+		optsC.Cluster.NkeySeed = seed
+		optsC.Routes = routeToA
+		srvC := RunServer(optsC)
+		time.Sleep(100 * time.Millisecond)
+		checkNumRoutes(t, srvA, 1)
+		checkNumRoutes(t, srvC, 0)
+		srvC.Shutdown()
+	}
+	if err := validateOptions(&Options{Cluster: ClusterOpts{Nkeys: []string{"UABC"}}}); err == nil {
+		t.Fatal("Expected error for invalid cluster nkey")
+	}
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		cluster {
+			listen: "127.0.0.1:-1"
+			nkey_seed: %q
+			authorization { nkeys: [%q] }
+		}
+	`, seedA, pubB)))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.Cluster.NkeySeed != seedA || len(opts.Cluster.Nkeys) != 1 || opts.Cluster.Nkeys[0] != pubB {
+		t.Fatalf("Unexpected cluster options: %+v", opts.Cluster)
+	}
+}
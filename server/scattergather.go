@@ -0,0 +1,297 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// With scatter_gather enabled, a request published on $SG.<subject> is
+// sent by the server to all the responders of <subject>, and their replies
+// are returned to the requester in a single response, once the number of
+// replies in the Nats-SG-Replies header of the request are received, or
+// when the timeout in the Nats-SG-Timeout header, or the default one,
+// expires. When all the responders are clients of this server, the
+// response is also sent as soon as each of them replied.
+//
+// The response has the Nats-SG-Replies header with the number of replies
+// and the Nats-SG-Status header, and its payload is the replies framed as
+// "<header size> <total size>\r\n<header><payload>\r\n", as in HMSG.
+
+const (
+	// ScatterGatherPrefix is the prefix of the subjects of scatter-gather
+	// requests, followed by the subject of the responders.
+	ScatterGatherPrefix = "$SG."
+	// ScatterGatherRepliesHdr is the number of replies to wait for in a
+	// request, and the number of replies in a response.
+	ScatterGatherRepliesHdr = "Nats-SG-Replies"
+	// ScatterGatherTimeoutHdr is the time to wait for replies in a request.
+	ScatterGatherTimeoutHdr = "Nats-SG-Timeout"
+	// ScatterGatherStatusHdr is the status of a response.
+	ScatterGatherStatusHdr = "Nats-SG-Status"
+
+	// Statuses of the responses.
+	ScatterGatherComplete     = "complete"
+	ScatterGatherTimeout      = "timeout"
+	ScatterGatherTruncated    = "truncated"
+	ScatterGatherNoResponders = "no_responders"
+	ScatterGatherInvalid      = "invalid"
+
+	// Default time to wait for replies.
+	scatterGatherDefaultTimeout = time.Second
+	// Default maximum time to wait for replies.
+	scatterGatherDefaultMaxTimeout = 10 * time.Second
+	// Default maximum number of replies in a response.
+	scatterGatherDefaultMaxReplies = 1000
+)
+
+// ScatterGatherOpts enable scatter-gather requests.
+type ScatterGatherOpts struct {
+	Enabled bool
+	// Timeout of requests without a Nats-SG-Timeout header. Defaults to
+	// one second.
+	Timeout time.Duration
+	// MaxTimeout caps the timeout of requests. Defaults to ten seconds.
+	MaxTimeout time.Duration
+	// MaxReplies caps the number of replies in a response. Defaults to 1000.
+	MaxReplies int
+}
+
+func (o *ScatterGatherOpts) timeout() time.Duration {
+	if o.Timeout > 0 {
+		return o.Timeout
+	}
+	return scatterGatherDefaultTimeout
+}
+
+func (o *ScatterGatherOpts) maxTimeout() time.Duration {
+	if o.MaxTimeout > 0 {
+		return o.MaxTimeout
+	}
+	return scatterGatherDefaultMaxTimeout
+}
+
+func (o *ScatterGatherOpts) maxReplies() int {
+	if o.MaxReplies > 0 {
+		return o.MaxReplies
+	}
+	return scatterGatherDefaultMaxReplies
+}
+
+func validateScatterGatherOptions(o *Options) error {
+	sg := &o.ScatterGather
+	if sg.Timeout < 0 || sg.MaxTimeout < 0 || sg.MaxReplies < 0 {
+		return errors.New("scatter_gather values can not be negative")
+	}
+	return nil
+}
+
+// scatterGather is a request waiting for the replies of the responders.
+type scatterGather struct {
+	mu       sync.Mutex
+	frames   bytes.Buffer
+	replies  int
+	want     int
+	maxSize  int
+	status   string
+	finished bool
+	done     chan struct{}
+}
+
+// addReply frames the reply, and finishes the request once the wanted
+// replies are received.
+func (sg *scatterGather) addReply(hdr, body []byte) {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	if sg.finished {
+		return
+	}
+	frame := fmt.Sprintf("%d %d%s", len(hdr), len(hdr)+len(body), _CRLF_)
+	if sg.frames.Len()+len(frame)+len(hdr)+len(body)+LEN_CR_LF > sg.maxSize {
+		sg.finish(ScatterGatherTruncated)
+		return
+	}
+	sg.frames.WriteString(frame)
+	sg.frames.Write(hdr)
+	sg.frames.Write(body)
+	sg.frames.WriteString(_CRLF_)
+	sg.replies++
+	if sg.replies >= sg.want {
+		sg.finish(ScatterGatherComplete)
+	}
+}
+
+// Lock should be held.
+func (sg *scatterGather) finish(status string) {
+	if sg.finished {
+		return
+	}
+	sg.finished, sg.status = true, status
+	close(sg.done)
+}
+
+// processScatterGather fans the request out to the responders of its
+// subject, the response being sent when the replies are gathered. It
+// returns false if the request is not valid.
+func (c *client) processScatterGather(opts *ScatterGatherOpts, msg []byte) bool {
+	subject := strings.TrimPrefix(string(c.pa.subject), ScatterGatherPrefix)
+	reply := string(c.pa.reply)
+	if reply == _EMPTY_ {
+		c.Debugf("Scatter-gather request on %q without a reply subject", c.pa.subject)
+		return false
+	}
+	var hdr []byte
+	if c.pa.hdr > 0 {
+		hdr = msg[:c.pa.hdr]
+	}
+	body := msg[len(hdr) : len(msg)-LEN_CR_LF]
+
+	acc, srv := c.acc, c.srv
+	maxSize := int(srv.getOpts().MaxPayload)
+	want := opts.maxReplies()
+	timeout := opts.timeout()
+	valid := IsValidLiteralSubject(subject)
+	if v := getHeader(ScatterGatherRepliesHdr, hdr); v != nil {
+		n, err := strconv.Atoi(string(v))
+		if err != nil || n <= 0 {
+			valid = false
+		} else if n < want {
+			want = n
+		}
+	}
+	if v := getHeader(ScatterGatherTimeoutHdr, hdr); v != nil {
+		d, err := time.ParseDuration(string(v))
+		if err != nil || d <= 0 {
+			valid = false
+		} else {
+			timeout = d
+		}
+	}
+	if timeout > opts.maxTimeout() {
+		timeout = opts.maxTimeout()
+	}
+	if !valid {
+		srv.sendScatterGatherResponse(acc, reply, ScatterGatherInvalid, 0, nil)
+		return false
+	}
+	if c.perms != nil && (c.perms.pub.allow != nil || c.perms.pub.deny != nil) && !c.pubAllowed(subject) {
+		c.pubPermissionViolation([]byte(subject))
+		return false
+	}
+
+	// Stop as soon as all the responders replied when they are all known.
+	r := acc.sl.Match(subject)
+	if len(r.psubs)+len(r.qsubs) == 0 {
+		srv.sendScatterGatherResponse(acc, reply, ScatterGatherNoResponders, 0, nil)
+		return true
+	}
+	if n, ok := localResponders(r); ok && n < want {
+		want = n
+	}
+
+	if len(hdr) > 0 {
+		hdr = setHeaders(hdr, []string{ScatterGatherRepliesHdr, ScatterGatherTimeoutHdr}, _EMPTY_, _EMPTY_)
+	}
+	body = append([]byte(nil), body...)
+	sg := &scatterGather{want: want, maxSize: maxSize, done: make(chan struct{})}
+	srv.startGoRoutine(func() {
+		defer srv.grWG.Done()
+		srv.gather(acc, sg, subject, reply, hdr, body, timeout)
+	})
+	return true
+}
+
+// localResponders returns the number of responders in the result, or
+// false if some of them may be behind routes, gateways or leafnodes.
+func localResponders(r *SublistResult) (int, bool) {
+	for _, sub := range r.psubs {
+		if sub.client == nil || sub.client.kind != CLIENT {
+			return 0, false
+		}
+	}
+	for _, qsubs := range r.qsubs {
+		for _, sub := range qsubs {
+			if sub.client == nil || sub.client.kind != CLIENT {
+				return 0, false
+			}
+		}
+	}
+	return len(r.psubs) + len(r.qsubs), true
+}
+
+// gather sends the request with the reply subject of an internal client,
+// and then the gathered replies to the requester.
+func (s *Server) gather(acc *Account, sg *scatterGather, subject, reply string, hdr, body []byte, timeout time.Duration) {
+	c := s.createInternalAccountClient()
+	if err := c.registerWithAccount(acc); err != nil {
+		return
+	}
+	defer c.closeConnection(ClientClosed)
+
+	inbox := "_INBOX." + nuid.Next()
+	sub, err := c.processSub([]byte(inbox+" 1"), false)
+	if err != nil || sub == nil {
+		return
+	}
+	sub.icb = func(_ *subscription, pc *client, _, _ string, msg []byte) {
+		// Internal account clients receive the message with the trailing CRLF.
+		msg = msg[:len(msg)-LEN_CR_LF]
+		var rhdr []byte
+		if pc != nil && pc.pa.hdr > 0 && pc.pa.hdr <= len(msg) {
+			rhdr = msg[:pc.pa.hdr]
+		}
+		sg.addReply(rhdr, msg[len(rhdr):])
+	}
+	c.processInternalMsg(subject, inbox, hdr, body)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-sg.done:
+	case <-timer.C:
+	case <-s.quitCh:
+		return
+	}
+	sg.mu.Lock()
+	sg.finish(ScatterGatherTimeout)
+	status, replies, frames := sg.status, sg.replies, append([]byte(nil), sg.frames.Bytes()...)
+	sg.mu.Unlock()
+
+	c.sendScatterGatherResponse(reply, status, replies, frames)
+}
+
+// sendScatterGatherResponse sends the response with an internal client of
+// the account.
+func (s *Server) sendScatterGatherResponse(acc *Account, reply, status string, replies int, frames []byte) {
+	c := s.createInternalAccountClient()
+	if err := c.registerWithAccount(acc); err != nil {
+		return
+	}
+	defer c.closeConnection(ClientClosed)
+	c.sendScatterGatherResponse(reply, status, replies, frames)
+}
+
+func (c *client) sendScatterGatherResponse(reply, status string, replies int, frames []byte) {
+	hdr := fmt.Sprintf("NATS/1.0%s%s: %d%s%s: %s%s%s", _CRLF_,
+		ScatterGatherRepliesHdr, replies, _CRLF_, ScatterGatherStatusHdr, status, _CRLF_, _CRLF_)
+	c.processInternalMsg(reply, _EMPTY_, []byte(hdr), frames)
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// scatterGatherFrames returns the payloads of the framed replies.
+func scatterGatherFrames(t *testing.T, data []byte) []string {
+	t.Helper()
+	var payloads []string
+	for len(data) > 0 {
+		i := bytes.Index(data, []byte(_CRLF_))
+		if i < 0 {
+			t.Fatalf("Missing frame line in %q", data)
+		}
+		var hs, ts int
+		if _, err := fmt.Sscanf(string(data[:i]), "%d %d", &hs, &ts); err != nil {
+			t.Fatalf("Invalid frame line %q: %v", data[:i], err)
+		}
+		data = data[i+LEN_CR_LF:]
+		payloads = append(payloads, string(data[hs:ts]))
+		data = data[ts+LEN_CR_LF:]
+	}
+	sort.Strings(payloads)
+	return payloads
+}
+
+func TestScatterGather(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		scatter_gather { timeout: "250ms", max_replies: 10 }
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	if sg := opts.ScatterGather; !sg.Enabled || sg.Timeout != 250*time.Millisecond || sg.MaxReplies != 10 {
+		t.Fatalf("Unexpected options: %+v", sg)
+	}
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+
+	request := func(hdr http.Header) *nats.Msg {
+		t.Helper()
+		m, err := nc.RequestMsg(&nats.Msg{Subject: ScatterGatherPrefix + "svc", Header: hdr, Data: []byte("req")}, 2*time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		return m
+	}
+	check := func(m *nats.Msg, status string, payloads ...string) {
+		t.Helper()
+		if st := m.Header.Get(ScatterGatherStatusHdr); st != status {
+			t.Fatalf("Expected status %q, got %q", status, st)
+		}
+		if n := m.Header.Get(ScatterGatherRepliesHdr); n != strconv.Itoa(len(payloads)) {
+			t.Fatalf("Expected %d replies, got %q", len(payloads), n)
+		}
+		if got := scatterGatherFrames(t, m.Data); strings.Join(got, ",") != strings.Join(payloads, ",") {
+			t.Fatalf("Expected replies %q, got %q", payloads, got)
+		}
+	}
+
+	check(request(nil), ScatterGatherNoResponders)
+
+	for i := 0; i < 3; i++ {
+		rc := natsConnect(t, s.ClientURL())
+		defer rc.Close()
+		reply := fmt.Sprintf("r%d", i)
+		natsSub(t, rc, "svc", func(m *nats.Msg) {
+			if string(m.Data) != "req" || m.Header.Get(ScatterGatherRepliesHdr) != _EMPTY_ {
+				reply = "unexpected request"
+			}
+			m.Respond([]byte(reply))
+		})
+		natsFlush(t, rc)
+	}
+
+	// All the local responders replied, no need to wait for the timeout.
+	start := time.Now()
+	check(request(nil), ScatterGatherComplete, "r0", "r1", "r2")
+	if time.Since(start) >= 250*time.Millisecond {
+		t.Fatal("Expected response before the timeout")
+	}
+
+	// Bound by count.
+	m := request(http.Header{ScatterGatherRepliesHdr: []string{"2"}})
+	if n := len(scatterGatherFrames(t, m.Data)); n != 2 || m.Header.Get(ScatterGatherStatusHdr) != ScatterGatherComplete {
+		t.Fatalf("Expected 2 replies, got %d", n)
+	}
+
+	// Bound by deadline, with a responder that does not reply.
+	slow := natsConnect(t, s.ClientURL())
+	defer slow.Close()
+	natsSub(t, slow, "svc", func(*nats.Msg) {})
+	natsFlush(t, slow)
+	start = time.Now()
+	check(request(http.Header{ScatterGatherTimeoutHdr: []string{"100ms"}}), ScatterGatherTimeout, "r0", "r1", "r2")
+	if el := time.Since(start); el < 100*time.Millisecond || el > time.Second {
+		t.Fatalf("Unexpected response time: %v", el)
+	}
+
+	check(request(http.Header{ScatterGatherRepliesHdr: []string{"zero"}}), ScatterGatherInvalid)
+
+	conf = createConfFile(t, []byte(`scatter_gather { max_replies: -1 }`))
+	defer os.Remove(conf)
+	o, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if err := validateOptions(o); err == nil || !strings.Contains(err.Error(), "negative") {
+		t.Fatalf("Expected error on negative max replies, got %v", err)
+	}
+}
@@ -0,0 +1,989 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Accounts have a registry of schemas, bound to subjects. The payload of
+// messages published on a bound subject has to conform to all schemas bound
+// to subjects matching it. Non-conforming messages are dropped, unless
+// Annotate is set, in which case they are delivered with the reason in the
+// Nats-Schema-Invalid header. The registry can be changed at runtime with
+// requests to $SYS.REQ.ACCOUNT.<account>.SCHEMAS, these changes are kept
+// until the configuration is reloaded.
+
+// Formats of schemas.
+const (
+	// SchemaFormatJSON schemas are JSON Schemas, supporting the type,
+	// properties, required, additionalProperties, items, enum, const,
+	// minimum, maximum, exclusiveMinimum, exclusiveMaximum, minLength,
+	// maxLength, pattern, minItems and maxItems keywords.
+	SchemaFormatJSON = "json"
+	// SchemaFormatProtobuf schemas are protobuf message definitions, in the
+	// proto2 or proto3 syntax, without imports. Payloads are messages of the
+	// first message type of the definition.
+	SchemaFormatProtobuf = "protobuf"
+)
+
+// SchemaInvalidHdr is set by the server to the reason why the payload of a
+// message does not conform to a schema bound to its subject.
+const SchemaInvalidHdr = "Nats-Schema-Invalid"
+
+// Maximum nesting of validated payloads.
+const schemaMaxDepth = 64
+
+// Schema is a named schema of an account.
+type Schema struct {
+	Name       string `json:"name"`
+	Format     string `json:"format"`
+	Definition string `json:"definition"`
+
+	validate func(data []byte) error
+}
+
+// NewSchema compiles the definition of a schema.
+func NewSchema(name, format, definition string) (*Schema, error) {
+	if !isValidName(name) {
+		return nil, fmt.Errorf("invalid schema name %q", name)
+	}
+	sc := &Schema{Name: name, Format: strings.ToLower(format), Definition: definition}
+	switch sc.Format {
+	case SchemaFormatJSON:
+		var v interface{}
+		if err := json.Unmarshal([]byte(definition), &v); err != nil {
+			return nil, fmt.Errorf("invalid JSON schema %q: %v", name, err)
+		}
+		js, err := compileJSONSchema(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON schema %q: %v", name, err)
+		}
+		sc.validate = func(data []byte) error {
+			var v interface{}
+			if err := json.Unmarshal(data, &v); err != nil {
+				return fmt.Errorf("invalid JSON")
+			}
+			return js.validate(v, "$", 0)
+		}
+	case SchemaFormatProtobuf:
+		pm, err := parseProtoSchema(definition)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protobuf schema %q: %v", name, err)
+		}
+		sc.validate = func(data []byte) error {
+			return pm.validate(data, pm.name, 0)
+		}
+	default:
+		return nil, fmt.Errorf("invalid format %q of schema %q, expected json or protobuf", format, name)
+	}
+	return sc, nil
+}
+
+// SchemaBinding binds a schema to the subjects matching Subject.
+type SchemaBinding struct {
+	Subject string `json:"subject"`
+	Schema  string `json:"schema"`
+}
+
+// SchemaOpts are the schemas of an account and the subjects they are bound
+// to.
+type SchemaOpts struct {
+	Schemas  map[string]*Schema
+	Bindings []*SchemaBinding
+	Annotate bool
+}
+
+// bound returns the schemas bound to the subject.
+func (o *SchemaOpts) bound(subject string) []*Schema {
+	var schemas []*Schema
+	for _, b := range o.Bindings {
+		if matchLiteral(subject, b.Subject) {
+			if sc := o.Schemas[b.Schema]; sc != nil {
+				schemas = append(schemas, sc)
+			}
+		}
+	}
+	return schemas
+}
+
+func (o *SchemaOpts) clone() *SchemaOpts {
+	no := &SchemaOpts{Schemas: make(map[string]*Schema), Annotate: o.Annotate}
+	for name, sc := range o.Schemas {
+		no.Schemas[name] = sc
+	}
+	no.Bindings = append([]*SchemaBinding(nil), o.Bindings...)
+	return no
+}
+
+// sortBindings orders the bindings by subject and schema.
+func (o *SchemaOpts) sortBindings() {
+	sort.Slice(o.Bindings, func(i, j int) bool {
+		if o.Bindings[i].Subject != o.Bindings[j].Subject {
+			return o.Bindings[i].Subject < o.Bindings[j].Subject
+		}
+		return o.Bindings[i].Schema < o.Bindings[j].Schema
+	})
+}
+
+// schemaOpts returns the schemas of the account.
+func (a *Account) schemaOpts() *SchemaOpts {
+	a.mu.RLock()
+	so := a.schemas
+	a.mu.RUnlock()
+	return so
+}
+
+// updateSchemas applies the change to a copy of the schemas of the account.
+func (a *Account) updateSchemas(change func(so *SchemaOpts) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	so := &SchemaOpts{Schemas: make(map[string]*Schema)}
+	if a.schemas != nil {
+		so = a.schemas.clone()
+	}
+	if err := change(so); err != nil {
+		return err
+	}
+	a.schemas = so
+	return nil
+}
+
+// AddSchema registers the schema in the account, replacing the one with the
+// same name.
+func (a *Account) AddSchema(sc *Schema) error {
+	if sc == nil || sc.validate == nil {
+		return fmt.Errorf("schema not compiled")
+	}
+	return a.updateSchemas(func(so *SchemaOpts) error {
+		so.Schemas[sc.Name] = sc
+		return nil
+	})
+}
+
+// RemoveSchema removes the schema from the account. This fails if the
+// schema is still bound to subjects.
+func (a *Account) RemoveSchema(name string) error {
+	return a.updateSchemas(func(so *SchemaOpts) error {
+		if so.Schemas[name] == nil {
+			return ErrMissingSchema
+		}
+		for _, b := range so.Bindings {
+			if b.Schema == name {
+				return fmt.Errorf("schema %q is bound to %q", name, b.Subject)
+			}
+		}
+		delete(so.Schemas, name)
+		return nil
+	})
+}
+
+// BindSchema binds the schema of the account to the subject.
+func (a *Account) BindSchema(subject, name string) error {
+	if !IsValidSubject(subject) {
+		return ErrBadSubject
+	}
+	return a.updateSchemas(func(so *SchemaOpts) error {
+		if so.Schemas[name] == nil {
+			return ErrMissingSchema
+		}
+		for _, b := range so.Bindings {
+			if b.Subject == subject && b.Schema == name {
+				return nil
+			}
+		}
+		so.Bindings = append(so.Bindings, &SchemaBinding{Subject: subject, Schema: name})
+		so.sortBindings()
+		return nil
+	})
+}
+
+// UnbindSchema removes the binding of the schema to the subject.
+func (a *Account) UnbindSchema(subject, name string) error {
+	return a.updateSchemas(func(so *SchemaOpts) error {
+		for i, b := range so.Bindings {
+			if b.Subject == subject && b.Schema == name {
+				so.Bindings = append(so.Bindings[:i], so.Bindings[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("schema %q is not bound to %q", name, subject)
+	})
+}
+
+// SchemaRegistry is the registry of schemas of an account.
+type SchemaRegistry struct {
+	Account  string           `json:"account"`
+	Schemas  []*Schema        `json:"schemas"`
+	Bindings []*SchemaBinding `json:"bindings"`
+	Annotate bool             `json:"annotate,omitempty"`
+}
+
+// SchemaRegistry returns the schemas of the account and their bindings.
+func (a *Account) SchemaRegistry() *SchemaRegistry {
+	sr := &SchemaRegistry{Account: a.GetName(), Schemas: []*Schema{}, Bindings: []*SchemaBinding{}}
+	so := a.schemaOpts()
+	if so == nil {
+		return sr
+	}
+	for _, sc := range so.Schemas {
+		sr.Schemas = append(sr.Schemas, sc)
+	}
+	sort.Slice(sr.Schemas, func(i, j int) bool { return sr.Schemas[i].Name < sr.Schemas[j].Name })
+	sr.Bindings = append(sr.Bindings, so.Bindings...)
+	sr.Annotate = so.Annotate
+	return sr
+}
+
+// Actions of schema registry requests.
+const (
+	SchemaActionList   = "list"
+	SchemaActionAdd    = "add"
+	SchemaActionRemove = "remove"
+	SchemaActionBind   = "bind"
+	SchemaActionUnbind = "unbind"
+)
+
+// SchemaRegistryRequest is a request to change, or list, the schema
+// registry of an account.
+type SchemaRegistryRequest struct {
+	// Action is one of list, the default, add, remove, bind and unbind.
+	Action     string `json:"action,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Format     string `json:"format,omitempty"`
+	Definition string `json:"definition,omitempty"`
+	Subject    string `json:"subject,omitempty"`
+}
+
+// UpdateSchemaRegistry applies the request to the schema registry of the
+// account, returning the registry.
+func (s *Server) UpdateSchemaRegistry(account string, req *SchemaRegistryRequest) (*SchemaRegistry, error) {
+	acc, err := s.lookupAccount(account)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(req.Action) {
+	case _EMPTY_, SchemaActionList:
+	case SchemaActionAdd:
+		sc, err := NewSchema(req.Name, req.Format, req.Definition)
+		if err == nil {
+			err = acc.AddSchema(sc)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.Noticef("Registered schema %q in account %q", req.Name, account)
+	case SchemaActionRemove:
+		if err := acc.RemoveSchema(req.Name); err != nil {
+			return nil, err
+		}
+		s.Noticef("Removed schema %q from account %q", req.Name, account)
+	case SchemaActionBind:
+		if err := acc.BindSchema(req.Subject, req.Name); err != nil {
+			return nil, err
+		}
+		s.Noticef("Bound schema %q to %q in account %q", req.Name, req.Subject, account)
+	case SchemaActionUnbind:
+		if err := acc.UnbindSchema(req.Subject, req.Name); err != nil {
+			return nil, err
+		}
+		s.Noticef("Unbound schema %q from %q in account %q", req.Name, req.Subject, account)
+	default:
+		return nil, fmt.Errorf("unknown schema registry action %q", req.Action)
+	}
+	return acc.SchemaRegistry(), nil
+}
+
+// accountSchemasRequest handles schema registry requests for the account in
+// the subject.
+func (s *Server) accountSchemasRequest(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	// Subject is $SYS.REQ.ACCOUNT.<account>.SCHEMAS
+	tokens := strings.Split(subject, tsep)
+	if len(tokens) != accReqTokens {
+		return
+	}
+	req := &SchemaRegistryRequest{}
+	s.zReq(reply, msg, req, func() (interface{}, error) { return s.UpdateSchemaRegistry(tokens[accReqAccIndex], req) })
+}
+
+// validateMsgSchemas validates the payload of the inbound message against
+// the schemas bound to its subject, setting the reason of the failure in
+// the headers. It returns the message and false if it has to be dropped.
+func (c *client) validateMsgSchemas(so *SchemaOpts, msg []byte) ([]byte, bool) {
+	schemas := so.bound(string(c.pa.subject))
+	if len(schemas) == 0 {
+		return msg, true
+	}
+	var hdr, data []byte
+	if c.pa.hdr > 0 {
+		hdr, data = msg[:c.pa.hdr], msg[c.pa.hdr:len(msg)-LEN_CR_LF]
+	} else {
+		data = msg[:len(msg)-LEN_CR_LF]
+	}
+	reason := _EMPTY_
+	for _, sc := range schemas {
+		if err := sc.validate(data); err != nil {
+			reason = strings.NewReplacer("\r", " ", "\n", " ").Replace(fmt.Sprintf("%s: %v", sc.Name, err))
+			break
+		}
+	}
+	if reason == _EMPTY_ {
+		// Publishers can not set the header themselves.
+		if len(getHeader(SchemaInvalidHdr, hdr)) == 0 {
+			return msg, true
+		}
+	} else {
+		c.Debugf("Payload of message on %q does not conform to schema %s", c.pa.subject, reason)
+		if !so.Annotate {
+			c.sendErrAndDebug(fmt.Sprintf("Permissions Violation for Publish to %q, Message Rejected: %v: %s",
+				c.pa.subject, ErrSchemaViolation, reason))
+			return nil, false
+		}
+	}
+	nmsg, err := c.setInboundMsgHeader(setHeaders(hdr, []string{SchemaInvalidHdr}, SchemaInvalidHdr, reason), data)
+	if err != nil {
+		c.sendErrAndDebug(fmt.Sprintf("Permissions Violation for Publish to %q, Message Rejected: %v", c.pa.subject, err))
+		return nil, false
+	}
+	return nmsg, true
+}
+
+// jsonSchema is a compiled JSON Schema.
+type jsonSchema struct {
+	never      bool
+	types      []string
+	properties map[string]*jsonSchema
+	required   []string
+	additional *jsonSchema
+	items      *jsonSchema
+	enum       []interface{}
+	minimum    *float64
+	maximum    *float64
+	exclMin    *float64
+	exclMax    *float64
+	minLength  int
+	maxLength  int
+	minItems   int
+	maxItems   int
+	pattern    *regexp.Regexp
+}
+
+// compileJSONSchema compiles the decoded JSON Schema.
+func compileJSONSchema(v interface{}) (*jsonSchema, error) {
+	js := &jsonSchema{maxLength: -1, maxItems: -1}
+	if b, ok := v.(bool); ok {
+		js.never = !b
+		return js, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an object, got %T", v)
+	}
+	num := func(k string) (*float64, error) {
+		f, ok := m[k].(float64)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a number", k)
+		}
+		return &f, nil
+	}
+	count := func(k string) (int, error) {
+		f, ok := m[k].(float64)
+		if !ok || f < 0 || f != math.Trunc(f) {
+			return 0, fmt.Errorf("%q is not a positive integer", k)
+		}
+		return int(f), nil
+	}
+	var err error
+	for k, kv := range m {
+		switch k {
+		case "$schema", "$id", "$comment", "title", "description", "default", "examples":
+		case "type":
+			switch t := kv.(type) {
+			case string:
+				js.types = []string{t}
+			case []interface{}:
+				for _, e := range t {
+					s, ok := e.(string)
+					if !ok {
+						return nil, fmt.Errorf("invalid type %v", e)
+					}
+					js.types = append(js.types, s)
+				}
+			default:
+				return nil, fmt.Errorf("invalid type %v", t)
+			}
+			for _, t := range js.types {
+				switch t {
+				case "null", "boolean", "object", "array", "number", "integer", "string":
+				default:
+					return nil, fmt.Errorf("invalid type %q", t)
+				}
+			}
+		case "properties":
+			pm, ok := kv.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("properties is not an object")
+			}
+			js.properties = make(map[string]*jsonSchema, len(pm))
+			for name, pv := range pm {
+				if js.properties[name], err = compileJSONSchema(pv); err != nil {
+					return nil, fmt.Errorf("property %q: %v", name, err)
+				}
+			}
+		case "required":
+			rl, ok := kv.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("required is not an array")
+			}
+			for _, r := range rl {
+				name, ok := r.(string)
+				if !ok {
+					return nil, fmt.Errorf("invalid required property %v", r)
+				}
+				js.required = append(js.required, name)
+			}
+		case "additionalProperties":
+			if js.additional, err = compileJSONSchema(kv); err != nil {
+				return nil, fmt.Errorf("additionalProperties: %v", err)
+			}
+		case "items":
+			if js.items, err = compileJSONSchema(kv); err != nil {
+				return nil, fmt.Errorf("items: %v", err)
+			}
+		case "enum":
+			if js.enum, ok = kv.([]interface{}); !ok {
+				return nil, fmt.Errorf("enum is not an array")
+			}
+		case "const":
+			js.enum = []interface{}{kv}
+		case "minimum":
+			js.minimum, err = num(k)
+		case "maximum":
+			js.maximum, err = num(k)
+		case "exclusiveMinimum":
+			js.exclMin, err = num(k)
+		case "exclusiveMaximum":
+			js.exclMax, err = num(k)
+		case "minLength":
+			js.minLength, err = count(k)
+		case "maxLength":
+			js.maxLength, err = count(k)
+		case "minItems":
+			js.minItems, err = count(k)
+		case "maxItems":
+			js.maxItems, err = count(k)
+		case "pattern":
+			p, ok := kv.(string)
+			if !ok {
+				return nil, fmt.Errorf("pattern is not a string")
+			}
+			if js.pattern, err = regexp.Compile(p); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", p, err)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported keyword %q", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return js, nil
+}
+
+// jsonType returns the JSON Schema type of the decoded value.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	}
+	return _EMPTY_
+}
+
+// validate checks that the decoded value at the path conforms to the schema.
+func (js *jsonSchema) validate(v interface{}, path string, depth int) error {
+	if js.never {
+		return fmt.Errorf("%s: not allowed", path)
+	}
+	if depth > schemaMaxDepth {
+		return fmt.Errorf("%s: too deeply nested", path)
+	}
+	t := jsonType(v)
+	if len(js.types) > 0 {
+		ok := false
+		for _, st := range js.types {
+			if st == t || st == "number" && t == "integer" {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(js.types, " or "), t)
+		}
+	}
+	if js.enum != nil {
+		ok := false
+		for _, e := range js.enum {
+			if reflect.DeepEqual(v, e) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: value not allowed", path)
+		}
+	}
+	switch v := v.(type) {
+	case float64:
+		switch {
+		case js.minimum != nil && v < *js.minimum:
+			return fmt.Errorf("%s: less than %v", path, *js.minimum)
+		case js.maximum != nil && v > *js.maximum:
+			return fmt.Errorf("%s: greater than %v", path, *js.maximum)
+		case js.exclMin != nil && v <= *js.exclMin:
+			return fmt.Errorf("%s: not greater than %v", path, *js.exclMin)
+		case js.exclMax != nil && v >= *js.exclMax:
+			return fmt.Errorf("%s: not less than %v", path, *js.exclMax)
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		switch {
+		case n < js.minLength:
+			return fmt.Errorf("%s: shorter than %d", path, js.minLength)
+		case js.maxLength >= 0 && n > js.maxLength:
+			return fmt.Errorf("%s: longer than %d", path, js.maxLength)
+		case js.pattern != nil && !js.pattern.MatchString(v):
+			return fmt.Errorf("%s: does not match %q", path, js.pattern)
+		}
+	case []interface{}:
+		switch {
+		case len(v) < js.minItems:
+			return fmt.Errorf("%s: fewer than %d items", path, js.minItems)
+		case js.maxItems >= 0 && len(v) > js.maxItems:
+			return fmt.Errorf("%s: more than %d items", path, js.maxItems)
+		}
+		if js.items != nil {
+			for i, e := range v {
+				if err := js.items.validate(e, fmt.Sprintf("%s[%d]", path, i), depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range js.required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing property %q", path, name)
+			}
+		}
+		for name, pv := range v {
+			ps := js.properties[name]
+			if ps == nil {
+				ps = js.additional
+			}
+			if ps == nil {
+				continue
+			}
+			if err := ps.validate(pv, path+"."+name, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Wire types of protobuf scalar types.
+var protoScalarWire = map[string]int{
+	"double": 1, "fixed64": 1, "sfixed64": 1,
+	"float": 5, "fixed32": 5, "sfixed32": 5,
+	"int32": 0, "int64": 0, "uint32": 0, "uint64": 0, "sint32": 0, "sint64": 0, "bool": 0,
+	"string": 2, "bytes": 2,
+}
+
+// protoMessageDef is a parsed protobuf message type.
+type protoMessageDef struct {
+	name   string
+	fields map[int]*protoFieldDef
+}
+
+// protoFieldDef is a field of a protobuf message type.
+type protoFieldDef struct {
+	name     string
+	typ      string
+	repeated bool
+	required bool
+	wire     int
+	msg      *protoMessageDef
+}
+
+// protoParser parses protobuf definitions.
+type protoParser struct {
+	toks     []string
+	pos      int
+	messages map[string]*protoMessageDef
+	enums    map[string]bool
+	fields   []*protoFieldDef
+}
+
+// protoTokens splits the definition into tokens, without comments.
+func protoTokens(def string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(def); {
+		c := def[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case strings.HasPrefix(def[i:], "//"):
+			if j := strings.IndexByte(def[i:], '\n'); j >= 0 {
+				i += j
+			} else {
+				i = len(def)
+			}
+		case strings.HasPrefix(def[i:], "/*"):
+			j := strings.Index(def[i+2:], "*/")
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated comment")
+			}
+			i += j + 4
+		case c == '"' || c == '\'':
+			j := strings.IndexByte(def[i+1:], c)
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			toks = append(toks, def[i:i+j+2])
+			i += j + 2
+		case strings.IndexByte("{}[]<>=;,()", c) >= 0:
+			toks = append(toks, string(c))
+			i++
+		default:
+			j := i
+			for j < len(def) && !unicode.IsSpace(rune(def[j])) && strings.IndexByte("{}[]<>=;,()\"'/", def[j]) < 0 {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected %q", c)
+			}
+			toks = append(toks, def[i:j])
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+func (p *protoParser) next() (string, error) {
+	if p.pos >= len(p.toks) {
+		return _EMPTY_, fmt.Errorf("unexpected end of definition")
+	}
+	p.pos++
+	return p.toks[p.pos-1], nil
+}
+
+func (p *protoParser) expect(tok string) error {
+	t, err := p.next()
+	if err == nil && t != tok {
+		err = fmt.Errorf("expected %q, got %q", tok, t)
+	}
+	return err
+}
+
+// skip skips the tokens up to the end of the statement, or of the block it
+// opens.
+func (p *protoParser) skip() error {
+	depth := 0
+	for {
+		t, err := p.next()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case "{":
+			depth++
+		case "}":
+			if depth--; depth == 0 {
+				return nil
+			}
+		case ";":
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+// parseMessage parses a message type after the message keyword.
+func (p *protoParser) parseMessage() (*protoMessageDef, error) {
+	name, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	m := &protoMessageDef{name: name, fields: make(map[int]*protoFieldDef)}
+	if p.messages[name] != nil {
+		return nil, fmt.Errorf("duplicate message %q", name)
+	}
+	p.messages[name] = m
+	if err := p.parseFields(m, "}"); err != nil {
+		return nil, fmt.Errorf("message %q: %v", name, err)
+	}
+	return m, nil
+}
+
+// parseFields parses the fields of the message up to the closing token.
+func (p *protoParser) parseFields(m *protoMessageDef, end string) error {
+	for {
+		t, err := p.next()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case end:
+			return nil
+		case ";":
+			continue
+		case "message":
+			if _, err := p.parseMessage(); err != nil {
+				return err
+			}
+			continue
+		case "enum":
+			name, err := p.next()
+			if err != nil {
+				return err
+			}
+			p.enums[name] = true
+			if err := p.skip(); err != nil {
+				return err
+			}
+			continue
+		case "option", "reserved", "extensions":
+			if err := p.skip(); err != nil {
+				return err
+			}
+			continue
+		case "oneof":
+			if _, err := p.next(); err != nil {
+				return err
+			}
+			if err := p.expect("{"); err != nil {
+				return err
+			}
+			if err := p.parseFields(m, "}"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		f := &protoFieldDef{}
+		switch t {
+		case "repeated":
+			f.repeated = true
+		case "required":
+			f.required = true
+		case "optional":
+		default:
+			p.pos--
+		}
+		if f.typ, err = p.next(); err != nil {
+			return err
+		}
+		if f.typ == "map" {
+			// Map entries are repeated messages of a key and a value.
+			if err := p.expect("<"); err != nil {
+				return err
+			}
+			for t != ">" {
+				if t, err = p.next(); err != nil {
+					return err
+				}
+			}
+			f.typ, f.repeated = "bytes", true
+		}
+		if f.name, err = p.next(); err != nil {
+			return err
+		}
+		if err := p.expect("="); err != nil {
+			return err
+		}
+		if t, err = p.next(); err != nil {
+			return err
+		}
+		num, err := strconv.Atoi(t)
+		if err != nil || num < 1 || num > 1<<29-1 {
+			return fmt.Errorf("invalid number %q of field %q", t, f.name)
+		}
+		if m.fields[num] != nil {
+			return fmt.Errorf("duplicate field number %d", num)
+		}
+		if t, err = p.next(); err == nil && t == "[" {
+			for t != "]" && err == nil {
+				t, err = p.next()
+			}
+			if err == nil {
+				t, err = p.next()
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if t != ";" {
+			return fmt.Errorf("expected \";\" after field %q, got %q", f.name, t)
+		}
+		m.fields[num] = f
+		p.fields = append(p.fields, f)
+	}
+}
+
+// parseProtoSchema parses the protobuf definition, returning its first
+// message type.
+func parseProtoSchema(def string) (*protoMessageDef, error) {
+	toks, err := protoTokens(def)
+	if err != nil {
+		return nil, err
+	}
+	p := &protoParser{toks: toks, messages: make(map[string]*protoMessageDef), enums: make(map[string]bool)}
+	var root *protoMessageDef
+	for p.pos < len(p.toks) {
+		t, _ := p.next()
+		switch t {
+		case "syntax", "package", "option":
+			err = p.skip()
+		case "import":
+			err = fmt.Errorf("imports are not supported")
+		case "message":
+			var m *protoMessageDef
+			if m, err = p.parseMessage(); root == nil {
+				root = m
+			}
+		case "enum":
+			if t, err = p.next(); err == nil {
+				p.enums[t] = true
+				err = p.skip()
+			}
+		case ";":
+		default:
+			err = fmt.Errorf("unexpected %q", t)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("no message defined")
+	}
+	// Resolve the types of fields, by their last component.
+	for _, f := range p.fields {
+		typ := f.typ[strings.LastIndexByte(f.typ, '.')+1:]
+		if wire, ok := protoScalarWire[typ]; ok {
+			f.typ, f.wire = typ, wire
+		} else if p.enums[typ] {
+			f.typ, f.wire = "enum", 0
+		} else if m := p.messages[typ]; m != nil {
+			f.msg, f.wire = m, 2
+		} else {
+			return nil, fmt.Errorf("unknown type %q of field %q", f.typ, f.name)
+		}
+	}
+	return root, nil
+}
+
+// validate checks that the protobuf message at the path conforms to its
+// type.
+func (m *protoMessageDef) validate(b []byte, path string, depth int) error {
+	if depth > schemaMaxDepth {
+		return fmt.Errorf("%s: too deeply nested", path)
+	}
+	seen := make(map[int]bool)
+	err := protoFields(b, func(pf *protoField) error {
+		f := m.fields[pf.num]
+		if f == nil {
+			return fmt.Errorf("%s: unknown field %d", path, pf.num)
+		}
+		fpath := path + "." + f.name
+		seen[pf.num] = true
+		if pf.wire != f.wire {
+			// Repeated scalars can be packed.
+			if !f.repeated || f.wire == 2 || pf.wire != 2 {
+				return fmt.Errorf("%s: invalid wire type %d", fpath, pf.wire)
+			}
+			return validatePackedField(f.wire, pf.b, fpath)
+		}
+		switch {
+		case f.typ == "string" && !utf8.Valid(pf.b):
+			return fmt.Errorf("%s: invalid UTF-8 string", fpath)
+		case f.msg != nil:
+			return f.msg.validate(pf.b, fpath, depth+1)
+		}
+		return nil
+	})
+	if err == errProtoMalformed {
+		return fmt.Errorf("%s: %v", path, err)
+	} else if err != nil {
+		return err
+	}
+	for num, f := range m.fields {
+		if f.required && !seen[num] {
+			return fmt.Errorf("%s: missing field %q", path, f.name)
+		}
+	}
+	return nil
+}
+
+// validatePackedField checks the encoding of packed repeated scalars.
+func validatePackedField(wire int, b []byte, path string) error {
+	switch wire {
+	case 0:
+		for len(b) > 0 {
+			_, n := binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("%s: %v", path, errProtoMalformed)
+			}
+			b = b[n:]
+		}
+	case 1:
+		if len(b)%8 != 0 {
+			return fmt.Errorf("%s: %v", path, errProtoMalformed)
+		}
+	case 5:
+		if len(b)%4 != 0 {
+			return fmt.Errorf("%s: %v", path, errProtoMalformed)
+		}
+	}
+	return nil
+}
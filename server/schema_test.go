@@ -0,0 +1,319 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const testOrderSchema = `{
+	"type": "object",
+	"required": ["id", "total"],
+	"properties": {
+		"id": {"type": "string", "pattern": "^o-[0-9]+$"},
+		"total": {"type": "number", "minimum": 0},
+		"items": {"type": "array", "maxItems": 2, "items": {"type": "integer"}},
+		"status": {"enum": ["new", "paid"]}
+	},
+	"additionalProperties": false
+}`
+
+func TestSchemaValidation(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			D: {
+				users: [{user: d, password: pwd}]
+				schemas {
+					definitions { orders: { format: json, definition: %q } }
+					bindings { "orders.*": orders }
+				}
+			}
+			A: {
+				users: [{user: a, password: pwd}]
+				schemas {
+					definitions { orders: { format: json, definition: %q } }
+					bindings { "orders.>": [orders] }
+					invalid: annotate
+				}
+			}
+		}
+	`, testOrderSchema, testOrderSchema)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	errCh := make(chan error, 10)
+	ncD := natsConnect(t, s.ClientURL(), nats.UserInfo("d", "pwd"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errCh <- err }))
+	defer ncD.Close()
+	subD := natsSubSync(t, ncD, ">")
+	natsFlush(t, ncD)
+
+	for _, test := range []struct {
+		data   string
+		reason string
+	}{
+		{`{"id":"o-1","total":10,"items":[1,2],"status":"paid"}`, _EMPTY_},
+		{`not json`, "invalid JSON"},
+		{`{"id":"o-1"}`, `$: missing property "total"`},
+		{`{"id":"x","total":1}`, `$.id: does not match`},
+		{`{"id":"o-1","total":-1}`, `$.total: less than 0`},
+		{`{"id":"o-1","total":1,"items":[1.5]}`, `$.items[0]: expected integer, got number`},
+		{`{"id":"o-1","total":1,"items":[1,2,3]}`, `$.items: more than 2 items`},
+		{`{"id":"o-1","total":1,"status":"old"}`, `$.status: value not allowed`},
+		{`{"id":"o-1","total":1,"other":true}`, `$.other: not allowed`},
+	} {
+		natsPub(t, ncD, "orders.new", []byte(test.data))
+		if test.reason == _EMPTY_ {
+			if m := natsNexMsg(t, subD, time.Second); string(m.Data) != test.data {
+				t.Fatalf("Unexpected message %q", m.Data)
+			}
+			continue
+		}
+		select {
+		case err := <-errCh:
+			if !strings.Contains(err.Error(), ErrSchemaViolation.Error()) || !strings.Contains(err.Error(), test.reason) {
+				t.Fatalf("Unexpected error for %s: %v", test.data, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected error for %s", test.data)
+		}
+		if m, err := subD.NextMsg(50 * time.Millisecond); err != nats.ErrTimeout {
+			t.Fatalf("Unexpected message %v or error %v", m, err)
+		}
+	}
+	// Other subjects are not validated.
+	natsPub(t, ncD, "other", []byte("x"))
+	natsNexMsg(t, subD, time.Second)
+
+	// Invalid messages are annotated, and publishers can not set the header.
+	ncA := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"))
+	defer ncA.Close()
+	subA := natsSubSync(t, ncA, ">")
+	natsFlush(t, ncA)
+	m := nats.NewMsg("orders.eu.new")
+	m.Header.Set(SchemaInvalidHdr, "forged")
+	m.Data = []byte(`{"id":"o-2","total":5}`)
+	if err := ncA.PublishMsg(m); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if rm := natsNexMsg(t, subA, time.Second); rm.Header.Get(SchemaInvalidHdr) != _EMPTY_ || string(rm.Data) != string(m.Data) {
+		t.Fatalf("Unexpected message %v %q", rm.Header, rm.Data)
+	}
+	natsPub(t, ncA, "orders.eu.new", []byte(`{"total":5}`))
+	if rm := natsNexMsg(t, subA, time.Second); rm.Header.Get(SchemaInvalidHdr) != `orders: $: missing property "id"` {
+		t.Fatalf("Unexpected headers: %v", rm.Header)
+	}
+}
+
+func TestSchemaProtobuf(t *testing.T) {
+	sc, err := NewSchema("order", SchemaFormatProtobuf, `
+		syntax = "proto2";
+		package shop;
+
+		// An order.
+		message Order {
+			required string id = 1;
+			optional int64 total = 2;
+			repeated int32 items = 3 [packed = true];
+			optional Customer customer = 4;
+			optional Status status = 5;
+			map<string, string> labels = 6;
+			oneof payment {
+				string card = 7;
+				bytes token = 8;
+			}
+		}
+		message Customer {
+			required string region = 1;
+			optional double score = 2;
+		}
+		enum Status { NEW = 0; PAID = 1; }
+	`)
+	if err != nil {
+		t.Fatalf("Error compiling schema: %v", err)
+	}
+	customer := protoAppendBytes(nil, 1, []byte("eu"))
+	customer = protoAppendKey(customer, 2, 1)
+	customer = append(customer, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f)
+	valid := protoAppendBytes(nil, 1, []byte("o-1"))
+	valid = appendUvarint(protoAppendKey(valid, 2, 0), 300)
+	valid = protoAppendBytes(valid, 3, []byte{1, 0x96, 0x01})
+	valid = appendUvarint(protoAppendKey(valid, 3, 0), 4)
+	valid = protoAppendBytes(valid, 4, customer)
+	valid = appendUvarint(protoAppendKey(valid, 5, 0), 1)
+	valid = protoAppendBytes(valid, 6, protoAppendBytes(nil, 1, []byte("k")))
+	valid = protoAppendBytes(valid, 8, []byte{0xff})
+	if err := sc.validate(valid); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// with returns the valid message followed by the field.
+	with := func(f []byte) []byte {
+		return append(append([]byte(nil), valid...), f...)
+	}
+	for _, test := range []struct {
+		data   []byte
+		reason string
+	}{
+		{appendUvarint(protoAppendKey(nil, 2, 0), 1), `Order: missing field "id"`},
+		{append(protoAppendBytes(nil, 1, []byte("o")), 0x10), "malformed"},
+		{with(protoAppendBytes(nil, 9, nil)), "unknown field 9"},
+		{with(appendUvarint(protoAppendKey(nil, 1, 0), 1)), "Order.id: invalid wire type 0"},
+		{with(protoAppendBytes(nil, 1, []byte{0xff})), "Order.id: invalid UTF-8"},
+		{with(protoAppendBytes(nil, 4, protoAppendBytes(nil, 2, nil))), "Order.customer.score: invalid wire type 2"},
+		{with(protoAppendBytes(nil, 4, []byte{})), `Order.customer: missing field "region"`},
+		{with(protoAppendBytes(nil, 3, []byte{0x80})), "Order.items: malformed"},
+	} {
+		if err := sc.validate(test.data); err == nil || !strings.Contains(err.Error(), test.reason) {
+			t.Fatalf("Expected error with %q, got %v", test.reason, err)
+		}
+	}
+
+	for _, def := range []string{
+		``,
+		`import "other.proto"; message A { string a = 1; }`,
+		`message A { Other a = 1; }`,
+		`message A { string a = 1; string b = 1; }`,
+		`message A { string a = 0; }`,
+		`message A { string a = 1 }`,
+		`message A { string a = 1;`,
+	} {
+		if _, err := NewSchema("bad", SchemaFormatProtobuf, def); err == nil {
+			t.Fatalf("Expected error compiling %q", def)
+		}
+	}
+	for _, def := range []string{
+		`[]`,
+		`{"type": "decimal"}`,
+		`{"$ref": "#/definitions/a"}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+	} {
+		if _, err := NewSchema("bad", SchemaFormatJSON, def); err == nil {
+			t.Fatalf("Expected error compiling %q", def)
+		}
+	}
+}
+
+func TestSchemaRegistry(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A: { users: [{user: a, password: pwd}] }
+			SYS: { users: [{user: sys, password: pwd}] }
+		}
+		system_account: SYS
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sys := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer sys.Close()
+	errCh := make(chan error, 10)
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errCh <- err }))
+	defer nc.Close()
+
+	registry := func(req *SchemaRegistryRequest) (*SchemaRegistry, string) {
+		t.Helper()
+		data, _ := json.Marshal(req)
+		msg, err := sys.Request(fmt.Sprintf(accSchemasReqSubj, "A"), data, time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		var resp struct {
+			Data  *SchemaRegistry `json:"data"`
+			Error *ApiError       `json:"error"`
+		}
+		if err := json.Unmarshal(msg.Data, &resp); err != nil {
+			t.Fatalf("Error unmarshalling response: %v", err)
+		}
+		if resp.Error != nil {
+			return nil, resp.Error.Description
+		}
+		return resp.Data, _EMPTY_
+	}
+
+	if sr, e := registry(&SchemaRegistryRequest{}); e != _EMPTY_ || sr.Account != "A" || len(sr.Schemas) != 0 {
+		t.Fatalf("Unexpected registry %+v: %s", sr, e)
+	}
+	if _, e := registry(&SchemaRegistryRequest{Action: "add", Name: "num", Format: "json", Definition: `{"type":`}); !strings.Contains(e, "invalid JSON schema") {
+		t.Fatalf("Expected error, got %q", e)
+	}
+	if _, e := registry(&SchemaRegistryRequest{Action: "bind", Name: "num", Subject: "nums"}); e != ErrMissingSchema.Error() {
+		t.Fatalf("Expected error, got %q", e)
+	}
+	if _, e := registry(&SchemaRegistryRequest{Action: "add", Name: "num", Format: "json", Definition: `{"type":"number"}`}); e != _EMPTY_ {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	sr, e := registry(&SchemaRegistryRequest{Action: "bind", Name: "num", Subject: "nums.>"})
+	if e != _EMPTY_ || len(sr.Schemas) != 1 || sr.Schemas[0].Definition != `{"type":"number"}` ||
+		len(sr.Bindings) != 1 || *sr.Bindings[0] != (SchemaBinding{"nums.>", "num"}) {
+		t.Fatalf("Unexpected registry %+v: %s", sr, e)
+	}
+
+	natsPub(t, nc, "nums.a", []byte("x"))
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), ErrSchemaViolation.Error()) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected error")
+	}
+
+	if _, e := registry(&SchemaRegistryRequest{Action: "remove", Name: "num"}); !strings.Contains(e, "is bound") {
+		t.Fatalf("Expected error, got %q", e)
+	}
+	if _, e := registry(&SchemaRegistryRequest{Action: "unbind", Name: "num", Subject: "nums.>"}); e != _EMPTY_ {
+		t.Fatalf("Unexpected error: %s", e)
+	}
+	if sr, e := registry(&SchemaRegistryRequest{Action: "remove", Name: "num"}); e != _EMPTY_ || len(sr.Schemas) != 0 || len(sr.Bindings) != 0 {
+		t.Fatalf("Unexpected registry %+v: %s", sr, e)
+	}
+	sub := natsSubSync(t, nc, "nums.a")
+	natsPub(t, nc, "nums.a", []byte("x"))
+	natsNexMsg(t, sub, time.Second)
+	if _, e := registry(&SchemaRegistryRequest{Action: "drop"}); !strings.Contains(e, "unknown schema registry action") {
+		t.Fatalf("Expected error, got %q", e)
+	}
+}
+
+func TestSchemaConfigErrors(t *testing.T) {
+	for _, test := range []struct {
+		conf string
+		err  string
+	}{
+		{`schemas { definitions { s: { format: xml, definition: "" } } }`, "invalid format"},
+		{`schemas { bindings { "a": s } }`, `unknown schema "s"`},
+		{`schemas { definitions { s: { format: json, definition: "{}" } }, bindings { "a..b": s } }`, "invalid schema binding subject"},
+		{`schemas { invalid: ignore }`, "invalid schemas mode"},
+	} {
+		conf := createConfFile(t, []byte(fmt.Sprintf(`accounts { A { %s } }`, test.conf)))
+		_, err := ProcessConfigFile(conf)
+		os.Remove(conf)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected error with %q, got %v", test.err, err)
+		}
+	}
+}
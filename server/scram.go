@@ -0,0 +1,356 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCRAM-SHA-256 (RFC 7677) lets clients authenticate without sending the
+// password, with the verifier of the user stored in place of its password
+// in the form $scram-sha-256$<iterations>$<base64 salt>$<base64 stored
+// key>$<base64 server key>. The exchange happens over INFO and CONNECT:
+//
+//	C: CONNECT {"scram":"n,,n=user,r=<client nonce>", ...}
+//	S: INFO {"scram":"r=<nonce>,s=<salt>,i=<iterations>"}
+//	C: CONNECT {"scram":"c=biws,r=<nonce>,p=<proof>", ...}
+//	S: INFO {"scram":"v=<server signature>"}
+//
+// Channel binding is not supported. Users with a verifier can still
+// authenticate with their password in the CONNECT.
+
+const (
+	scramPrefix        = "$scram-sha-256$"
+	scramSaltLen       = 16
+	scramNonceLen      = 18
+	scramMinIterations = 4096
+)
+
+// DefaultScramIterations is the number of iterations used to derive SCRAM
+// verifiers when not specified.
+const DefaultScramIterations = 15000
+
+var errScramMalformed = errors.New("malformed SCRAM message")
+
+// Key used to derive the salts of challenges for unknown users, so that
+// they look the same as the ones of existing users.
+var scramMockKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// isScramVerifier checks whether the given password is a SCRAM verifier.
+func isScramVerifier(password string) bool {
+	return strings.HasPrefix(password, scramPrefix)
+}
+
+// scramVerifier is a decoded SCRAM verifier.
+type scramVerifier struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+func parseScramVerifier(v string) (*scramVerifier, error) {
+	parts := strings.Split(strings.TrimPrefix(v, scramPrefix), "$")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid SCRAM verifier")
+	}
+	sv := &scramVerifier{}
+	var err error
+	if sv.iterations, err = strconv.Atoi(parts[0]); err != nil || sv.iterations < 1 {
+		return nil, fmt.Errorf("invalid SCRAM verifier iterations %q", parts[0])
+	}
+	for i, b := range []*[]byte{&sv.salt, &sv.storedKey, &sv.serverKey} {
+		if *b, err = base64.RawStdEncoding.DecodeString(parts[i+1]); err != nil || len(*b) == 0 {
+			return nil, fmt.Errorf("invalid SCRAM verifier encoding")
+		}
+	}
+	if len(sv.storedKey) != sha256.Size || len(sv.serverKey) != sha256.Size {
+		return nil, fmt.Errorf("invalid SCRAM verifier key length")
+	}
+	return sv, nil
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// scramKeys returns the stored and server keys for the password.
+func scramKeys(password string, salt []byte, iterations int) ([]byte, []byte) {
+	salted := pbkdf2SHA256([]byte(password), salt, iterations, sha256.Size)
+	storedKey := sha256.Sum256(scramHMAC(salted, "Client Key"))
+	return storedKey[:], scramHMAC(salted, "Server Key")
+}
+
+// GenerateScramVerifier derives the SCRAM-SHA-256 verifier of the password
+// with a random salt, for use as a password in the configuration.
+func GenerateScramVerifier(password string, iterations int) (string, error) {
+	if iterations < scramMinIterations {
+		return _EMPTY_, fmt.Errorf("scram requires at least %d iterations", scramMinIterations)
+	}
+	salt := make([]byte, scramSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return _EMPTY_, err
+	}
+	storedKey, serverKey := scramKeys(password, salt, iterations)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s%d$%s$%s$%s", scramPrefix, iterations,
+		enc.EncodeToString(salt), enc.EncodeToString(storedKey), enc.EncodeToString(serverKey)), nil
+}
+
+// compareScram checks a password sent in the CONNECT against the verifier.
+func compareScram(verifier, password string) bool {
+	sv, err := parseScramVerifier(verifier)
+	if err != nil {
+		return false
+	}
+	storedKey, _ := scramKeys(password, sv.salt, sv.iterations)
+	return subtle.ConstantTimeCompare(storedKey, sv.storedKey) == 1
+}
+
+// scramState is the state of a client between the two CONNECT of a SCRAM
+// exchange.
+type scramState struct {
+	// Nil when the user is unknown, the exchange then fails.
+	user            *User
+	verifier        *scramVerifier
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	// Set once the client proved it knows the password of the user.
+	authenticated bool
+}
+
+// scramAttrs returns the attributes of a SCRAM message.
+func scramAttrs(msg string) ([][2]string, error) {
+	var attrs [][2]string
+	for _, a := range strings.Split(msg, ",") {
+		if len(a) < 2 || a[1] != '=' {
+			return nil, errScramMalformed
+		}
+		attrs = append(attrs, [2]string{a[:1], a[2:]})
+	}
+	return attrs, nil
+}
+
+// scramUsername decodes the username of the client-first message.
+func scramUsername(name string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			sb.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			sb.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			sb.WriteByte('=')
+		default:
+			return _EMPTY_, errScramMalformed
+		}
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+// parseScramClientFirst returns the state of the exchange started by the
+// client-first message, without the user.
+func parseScramClientFirst(msg string) (*scramState, string, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, _EMPTY_, errScramMalformed
+	}
+	// Channel binding and authorization identities are not supported.
+	if (parts[0] != "n" && parts[0] != "y") || parts[1] != _EMPTY_ {
+		return nil, _EMPTY_, fmt.Errorf("unsupported SCRAM header %q", parts[0]+","+parts[1])
+	}
+	attrs, err := scramAttrs(parts[2])
+	if err != nil {
+		return nil, _EMPTY_, err
+	}
+	if len(attrs) < 2 || attrs[0][0] != "n" || attrs[1][0] != "r" || attrs[1][1] == _EMPTY_ {
+		return nil, _EMPTY_, errScramMalformed
+	}
+	username, err := scramUsername(attrs[0][1])
+	if err != nil {
+		return nil, _EMPTY_, err
+	}
+	st := &scramState{
+		gs2Header:       parts[0] + "," + parts[1] + ",",
+		clientFirstBare: parts[2],
+		nonce:           attrs[1][1],
+	}
+	return st, username, nil
+}
+
+// sendScramInfo sends the SCRAM message in an INFO to the client.
+func (c *client) sendScramInfo(msg string) {
+	b, _ := json.Marshal(&Info{Scram: msg})
+	c.mu.Lock()
+	c.enqueueProto([]byte(fmt.Sprintf(InfoProto, b)))
+	c.mu.Unlock()
+}
+
+// processScramClientFirst answers the client-first message of the first
+// CONNECT with the challenge for the user.
+func (s *Server) processScramClientFirst(c *client, msg string) error {
+	st, username, err := parseScramClientFirst(msg)
+	if err != nil {
+		c.Debugf("SCRAM authentication failed: %v", err)
+		c.authViolation()
+		return ErrAuthentication
+	}
+	opts := s.getOpts()
+	var auth authOpts
+	s.mu.Lock()
+	s.getAuthOpts(c, opts, &auth)
+	u := auth.users[username]
+	s.mu.Unlock()
+	if u != nil && isScramVerifier(u.Password) {
+		if st.verifier, err = parseScramVerifier(u.Password); err != nil {
+			c.Errorf("User %q: %v", username, err)
+		} else {
+			st.user = u
+		}
+	}
+	if st.user == nil {
+		st.verifier = &scramVerifier{
+			iterations: DefaultScramIterations,
+			salt:       scramHMAC(scramMockKey, username)[:scramSaltLen],
+		}
+	}
+
+	nonce := make([]byte, scramNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	st.nonce += base64.StdEncoding.EncodeToString(nonce)
+	st.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", st.nonce,
+		base64.StdEncoding.EncodeToString(st.verifier.salt), st.verifier.iterations)
+
+	timeout := opts.AuthTimeout
+	if c.ws != nil && opts.Websocket.AuthTimeout != 0 {
+		timeout = opts.Websocket.AuthTimeout
+	}
+	c.mu.Lock()
+	c.scram = st
+	// The client authenticates with the next CONNECT.
+	c.setAuthTimer(secondsToDuration(timeout))
+	c.mu.Unlock()
+	c.sendScramInfo(st.serverFirst)
+	return nil
+}
+
+// processScramAuthentication verifies the client-final message of the
+// second CONNECT and registers the client with its user. Clients that
+// already authenticated, authorized again on reload, are so with the
+// current version of their user, as long as its verifier did not change.
+func (s *Server) processScramAuthentication(c *client, users map[string]*User) bool {
+	c.mu.Lock()
+	st, msg := c.scram, c.opts.Scram
+	c.mu.Unlock()
+
+	if st.authenticated {
+		u := users[st.user.Username]
+		if u == nil || u.Password != st.user.Password {
+			c.Debugf("SCRAM user %q removed or its verifier changed", st.user.Username)
+			return c.authFailed(authFailInvalidScram)
+		}
+		return s.registerScramUser(c, u)
+	}
+
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		c.Debugf("SCRAM authentication failed: %v", errScramMalformed)
+		return c.authFailed(authFailInvalidScram)
+	}
+	withoutProof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+len(",p="):])
+	attrs, aerr := scramAttrs(withoutProof)
+	if err != nil || aerr != nil || len(proof) != sha256.Size || len(attrs) < 2 ||
+		attrs[0][0] != "c" || attrs[1][0] != "r" {
+		c.Debugf("SCRAM authentication failed: %v", errScramMalformed)
+		return c.authFailed(authFailInvalidScram)
+	}
+	if attrs[0][1] != base64.StdEncoding.EncodeToString([]byte(st.gs2Header)) || attrs[1][1] != st.nonce {
+		c.Debugf("SCRAM authentication failed: channel binding or nonce mismatch")
+		return c.authFailed(authFailInvalidScram)
+	}
+	if st.user == nil {
+		c.Debugf("SCRAM authentication failed: no verifier for the user")
+		return c.authFailed(authFailInvalidScram)
+	}
+
+	authMsg := st.clientFirstBare + "," + st.serverFirst + "," + withoutProof
+	clientKey := scramHMAC(st.verifier.storedKey, authMsg)
+	for i := range clientKey {
+		clientKey[i] ^= proof[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], st.verifier.storedKey) != 1 {
+		c.Debugf("SCRAM authentication failed: invalid proof")
+		return c.authFailed(authFailInvalidScram)
+	}
+
+	if !s.registerScramUser(c, st.user) {
+		return false
+	}
+	c.mu.Lock()
+	st.authenticated = true
+	c.mu.Unlock()
+	c.sendScramInfo("v=" + base64.StdEncoding.EncodeToString(scramHMAC(st.verifier.serverKey, authMsg)))
+	return true
+}
+
+// registerScramUser checks the connection restrictions of the user the
+// client authenticated as and registers the client with it.
+func (s *Server) registerScramUser(c *client, user *User) bool {
+	if !remoteAllowed(c, user.AllowedConnections) {
+		c.Debugf("User %q not allowed to connect from %v", user.Username, c.RemoteAddress())
+		return c.authFailed(authFailRemoteNotAllowed)
+	}
+	if !user.validAt(time.Now()) {
+		c.Debugf("User %q not valid at this time", user.Username)
+		return c.authFailed(authFailUserNotValid)
+	}
+	if !s.addUserConn(c, user.Username, user.MaxConnections) {
+		c.Debugf("User %q reached its maximum connections", user.Username)
+		return c.authFailed(authFailUserConnLimit)
+	}
+	c.mu.Lock()
+	c.opts.Username = user.Username
+	c.mu.Unlock()
+	c.RegisterUser(user)
+	// Generate an event if we have a system account and this is not the $G account.
+	s.accountConnectEvent(c)
+	c.checkExpiresAt(user.Expires)
+	return true
+}
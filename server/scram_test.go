@@ -0,0 +1,201 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// scramTestLogin runs a SCRAM exchange, returning the last line read.
+func scramTestLogin(t *testing.T, s *Server, user, password string) string {
+	t.Helper()
+	conn, _, line := scramTestConnect(t, s, user, password)
+	conn.Close()
+	return line
+}
+
+// scramTestConnect runs a SCRAM exchange, returning the connection, its
+// reader and the last line read.
+func scramTestConnect(t *testing.T, s *Server, user, password string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	readLine := func() string {
+		t.Helper()
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		return strings.TrimSuffix(line, "\r\n")
+	}
+	parseScram := func(line string) string {
+		t.Helper()
+		var info Info
+		if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil || info.Scram == _EMPTY_ {
+			t.Fatalf("Expected SCRAM INFO, got %q", line)
+		}
+		return info.Scram
+	}
+	send := func(scram string, extra string) {
+		t.Helper()
+		b, _ := json.Marshal(map[string]interface{}{"verbose": false, "protocol": 1, "scram": scram})
+		if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n%s", b, extra); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+	}
+	readLine() // INFO
+
+	send("n,,n="+user+",r=rOprNGfwEbeRWgbNEkqO", _EMPTY_)
+	serverFirst := parseScram(readLine())
+	attrs, err := scramAttrs(serverFirst)
+	if err != nil || len(attrs) != 3 || !strings.HasPrefix(attrs[0][1], "rOprNGfwEbeRWgbNEkqO") {
+		t.Fatalf("Unexpected server-first message %q", serverFirst)
+	}
+	salt, _ := base64.StdEncoding.DecodeString(attrs[1][1])
+	iterations, _ := strconv.Atoi(attrs[2][1])
+
+	salted := pbkdf2SHA256([]byte(password), salt, iterations, sha256.Size)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + attrs[0][1]
+	authMsg := "n=" + user + ",r=rOprNGfwEbeRWgbNEkqO," + serverFirst + "," + withoutProof
+	proof := scramHMAC(storedKey[:], authMsg)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	send(withoutProof+",p="+base64.StdEncoding.EncodeToString(proof), "PING\r\n")
+	line := readLine()
+	if !strings.HasPrefix(line, "INFO ") {
+		return conn, br, line
+	}
+	serverSig := base64.StdEncoding.EncodeToString(scramHMAC(scramHMAC(salted, "Server Key"), authMsg))
+	if final := parseScram(line); final != "v="+serverSig {
+		t.Fatalf("Unexpected server-final message %q", final)
+	}
+	return conn, br, readLine()
+}
+
+func TestScramAuthentication(t *testing.T) {
+	verifier, err := GenerateScramVerifier("s3cr3t", scramMinIterations)
+	if err != nil {
+		t.Fatalf("Error generating verifier: %v", err)
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users: [
+				{user: bob, password: "%s", max_connections: 1}
+				{user: alice, password: pwd}
+			]
+		}
+	`, verifier)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	conn, br, line := scramTestConnect(t, s, "bob", "s3cr3t")
+	defer conn.Close()
+	if line != "PONG" {
+		t.Fatalf("Expected PONG, got %q", line)
+	}
+	// The connection limit of the user applies.
+	if line := scramTestLogin(t, s, "bob", "s3cr3t"); !strings.Contains(line, "Authorization Violation") {
+		t.Fatalf("Expected authorization violation, got %q", line)
+	}
+	// Authorizing the client again on reload keeps it connected.
+	if err := s.AddUser(&User{Username: "derek", Password: "pass"}); err != nil {
+		t.Fatalf("Error adding user: %v", err)
+	}
+	if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if line, err := br.ReadString('\n'); err != nil || line != "PONG\r\n" {
+		t.Fatalf("Expected PONG after reload, got %q, %v", line, err)
+	}
+	conn.Close()
+
+	for _, test := range []struct{ name, user, password string }{
+		{"wrong password", "bob", "bad"},
+		{"unknown user", "joe", "s3cr3t"},
+		{"no verifier", "alice", "pwd"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if line := scramTestLogin(t, s, test.user, test.password); !strings.Contains(line, "Authorization Violation") {
+				t.Fatalf("Expected authorization violation, got %q", line)
+			}
+		})
+	}
+
+	// Clients without SCRAM support can still send the password.
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := s.userConnCount("bob"); n != 0 {
+			return fmt.Errorf("%d connections of bob", n)
+		}
+		return nil
+	})
+	nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("bob", "s3cr3t"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+	if nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("bob", "bad")); err == nil {
+		nc.Close()
+		t.Fatal("Expected authorization error")
+	}
+}
+
+func TestScramMessages(t *testing.T) {
+	if _, err := GenerateScramVerifier("pwd", scramMinIterations-1); err == nil {
+		t.Fatal("Expected error on too few iterations")
+	}
+	v, err := GenerateScramVerifier("pwd", scramMinIterations)
+	if err != nil {
+		t.Fatalf("Error generating verifier: %v", err)
+	}
+	if !isHashedPassword(v) || !comparePasswords(v, "pwd") || comparePasswords(v, "bad") {
+		t.Fatalf("Unexpected verification with %q", v)
+	}
+
+	st, user, err := parseScramClientFirst("n,,n=a=2Cb=3Dc,r=nonce")
+	if err != nil || user != "a,b=c" || st.nonce != "nonce" || st.gs2Header != "n,," {
+		t.Fatalf("Unexpected result %+v %q %v", st, user, err)
+	}
+	for _, msg := range []string{
+		"p=tls-unique,,n=a,r=nonce",
+		"n,a=admin,n=a,r=nonce",
+		"n,,r=nonce",
+		"n,,n=a=2,r=nonce",
+		"n,,n=a",
+	} {
+		if _, _, err := parseScramClientFirst(msg); err == nil {
+			t.Fatalf("Expected error for %q", msg)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notifications to systemd for services with Type=notify, see sd_notify(3).
+// These are no-op unless systemd has set the NOTIFY_SOCKET environment variable.
+const (
+	sdReady     = "READY=1"
+	sdReloading = "RELOADING=1"
+	sdStopping  = "STOPPING=1"
+	sdWatchdog  = "WATCHDOG=1"
+)
+
+// sdNotify sends the given state to systemd.
+func sdNotify(state string) error {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == _EMPTY_ {
+		return nil
+	}
+	// Abstract socket.
+	if sock[0] == '@' {
+		sock = "\x00" + sock[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdNotifyStatus sends the state and a status line to systemd, logging
+// errors in debug.
+func (s *Server) sdNotifyStatus(state, status string) {
+	if status != _EMPTY_ {
+		state += "\nSTATUS=" + status
+	}
+	if err := sdNotify(state); err != nil {
+		s.Debugf("Error notifying systemd: %v", err)
+	}
+}
+
+// sdWatchdogInterval returns the interval at which systemd expects to be
+// notified that the server is alive, or 0 if the watchdog is not enabled.
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != _EMPTY_ && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// sdNotifyReady tells systemd that the server is accepting connections,
+// and starts notifying its watchdog, if enabled, at half the interval.
+func (s *Server) sdNotifyReady() {
+	if os.Getenv("NOTIFY_SOCKET") == _EMPTY_ {
+		return
+	}
+	s.sdNotifyStatus(sdReady+"\nMAINPID="+strconv.Itoa(os.Getpid()), "Accepting connections")
+
+	interval := sdWatchdogInterval() / 2
+	if interval <= 0 {
+		return
+	}
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if s.isRunning() {
+					s.sdNotifyStatus(sdWatchdog, _EMPTY_)
+				}
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,194 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	// Prefix of the encrypted values of the configuration.
+	secretPrefix = "enc:v1:"
+	// Size of the AES-256 key of the encrypted values.
+	secretKeySize = 32
+
+	// Environment variables holding the key, base64 encoded, or the path
+	// of a file holding it. A key kept in a KMS can be handed to the server
+	// through either of them by the service manager.
+	secretsKeyEnv     = "NATS_SECRETS_KEY"
+	secretsKeyFileEnv = "NATS_SECRETS_KEY_FILE"
+)
+
+var errSecretsNoKey = fmt.Errorf("encrypted value requires a key, set with secrets_key_file, %s or %s",
+	secretsKeyEnv, secretsKeyFileEnv)
+
+// GenerateSecretsKey returns a new random key, base64 encoded, to encrypt
+// values of the configuration.
+func GenerateSecretsKey() (string, error) {
+	key := make([]byte, secretKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return _EMPTY_, err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// EncryptSecret encrypts a value of the configuration, such as a password,
+// a token or an nkey seed, with the base64 encoded key. The result is of
+// the form enc:v1:<base64 of nonce and AES-256-GCM ciphertext>.
+func EncryptSecret(key, value string) (string, error) {
+	aead, err := secretsCipher(key)
+	if err != nil {
+		return _EMPTY_, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return _EMPTY_, err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(secretPrefix))
+	return secretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret decrypts a value produced by EncryptSecret.
+func decryptSecret(key, value string) (string, error) {
+	aead, err := secretsCipher(key)
+	if err != nil {
+		return _EMPTY_, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, secretPrefix))
+	if err != nil {
+		return _EMPTY_, fmt.Errorf("invalid encrypted value: %v", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return _EMPTY_, errors.New("invalid encrypted value: too short")
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, []byte(secretPrefix))
+	if err != nil {
+		return _EMPTY_, errors.New("could not decrypt value, wrong key or altered value")
+	}
+	return string(plain), nil
+}
+
+func secretsCipher(key string) (cipher.AEAD, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid secrets key: %v", err)
+	}
+	if len(raw) != secretKeySize {
+		return nil, fmt.Errorf("invalid secrets key: expected %d bytes, got %d", secretKeySize, len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptedToken replaces the token of an encrypted value by its
+// decrypted value, keeping its location for error reporting.
+type decryptedToken struct {
+	token
+	value string
+}
+
+func (t *decryptedToken) Value() interface{} {
+	return t.value
+}
+
+// configureSecrets decrypts, in place, the encrypted values of the parsed
+// configuration, so that any password, token or seed can be encrypted.
+// The key is loaded from secrets_key_file, or from the environment, only
+// if there is an encrypted value.
+func configureSecrets(m map[string]interface{}) (retErr error) {
+	var lt token
+	defer convertPanicToError(&lt, &retErr)
+
+	var key string
+	loadKey := func() error {
+		if key != _EMPTY_ {
+			return nil
+		}
+		var file string
+		if v, ok := m["secrets_key_file"]; ok {
+			tk, v := unwrapValue(v, &lt)
+			f, ok := v.(string)
+			if !ok {
+				return &configErr{tk, "secrets_key_file must be a string"}
+			}
+			file = f
+		} else if f := os.Getenv(secretsKeyFileEnv); f != _EMPTY_ {
+			file = f
+		} else if key = os.Getenv(secretsKeyEnv); key != _EMPTY_ {
+			return nil
+		} else {
+			return errSecretsNoKey
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("error reading secrets key file: %v", err)
+		}
+		key = string(data)
+		return nil
+	}
+
+	var decrypt func(v interface{}) (interface{}, error)
+	decrypt = func(v interface{}) (interface{}, error) {
+		tk, uv := unwrapValue(v, &lt)
+		switch uv := uv.(type) {
+		case string:
+			if !strings.HasPrefix(uv, secretPrefix) {
+				return v, nil
+			}
+			if err := loadKey(); err != nil {
+				return nil, &configErr{tk, err.Error()}
+			}
+			plain, err := decryptSecret(key, uv)
+			if err != nil {
+				return nil, &configErr{tk, err.Error()}
+			}
+			if tk == nil {
+				return plain, nil
+			}
+			return &decryptedToken{tk, plain}, nil
+		case map[string]interface{}:
+			for k, mv := range uv {
+				dv, err := decrypt(mv)
+				if err != nil {
+					return nil, err
+				}
+				uv[k] = dv
+			}
+		case []interface{}:
+			for i, av := range uv {
+				dv, err := decrypt(av)
+				if err != nil {
+					return nil, err
+				}
+				uv[i] = dv
+			}
+		}
+		return v, nil
+	}
+	_, err := decrypt(m)
+	return err
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSecretsEncryptDecrypt(t *testing.T) {
+	key, err := GenerateSecretsKey()
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	enc, err := EncryptSecret(key, "s3cr3t")
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	if !strings.HasPrefix(enc, secretPrefix) {
+		t.Fatalf("Unexpected encrypted value: %q", enc)
+	}
+	if v, err := decryptSecret(key, enc); err != nil || v != "s3cr3t" {
+		t.Fatalf("Unexpected decrypted value %q, err=%v", v, err)
+	}
+	other, _ := GenerateSecretsKey()
+	if _, err := decryptSecret(other, enc); err == nil {
+		t.Fatal("Expected error decrypting with another key")
+	}
+	if _, err := EncryptSecret("bad", "s3cr3t"); err == nil {
+		t.Fatal("Expected error with invalid key")
+	}
+}
+
+func TestSecretsInConfig(t *testing.T) {
+	key, _ := GenerateSecretsKey()
+	keyFile, err := ioutil.TempFile("", "secrets_key")
+	if err != nil {
+		t.Fatalf("Error creating key file: %v", err)
+	}
+	defer os.Remove(keyFile.Name())
+	keyFile.WriteString(key + "\n")
+	keyFile.Close()
+
+	pass, _ := EncryptSecret(key, "pwd")
+	content := fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		secrets_key_file: %q
+		accounts {
+			A: { users: [{user: a, password: %q}] }
+		}
+		leafnodes {
+			authorization { user: leaf, password: %q }
+		}
+	`, keyFile.Name(), pass, pass)
+	conf := createConfFile(t, []byte(content))
+	defer os.Remove(conf)
+
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if len(opts.Users) != 1 || opts.Users[0].Password != "pwd" {
+		t.Fatalf("Expected decrypted password, got %+v", opts.Users)
+	}
+	if opts.LeafNode.Password != "pwd" {
+		t.Fatalf("Expected decrypted password, got %q", opts.LeafNode.Password)
+	}
+
+	// Key from the environment.
+	token, _ := EncryptSecret(key, "tok")
+	conf2 := createConfFile(t, []byte(fmt.Sprintf(`authorization { token: %q }`, token)))
+	defer os.Remove(conf2)
+	if _, err := ProcessConfigFile(conf2); err == nil || !strings.Contains(err.Error(), secretsKeyEnv) {
+		t.Fatalf("Expected error about missing key, got %v", err)
+	}
+	os.Setenv(secretsKeyEnv, key)
+	defer os.Unsetenv(secretsKeyEnv)
+	opts, err = ProcessConfigFile(conf2)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.Authorization != "tok" {
+		t.Fatalf("Expected decrypted token, got %q", opts.Authorization)
+	}
+
+	// Wrong key.
+	other, _ := GenerateSecretsKey()
+	os.Setenv(secretsKeyEnv, other)
+	if _, err := ProcessConfigFile(conf2); err == nil || !strings.Contains(err.Error(), "could not decrypt") {
+		t.Fatalf("Expected error decrypting, got %v", err)
+	}
+}
@@ -32,6 +32,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -75,10 +76,14 @@ type Info struct {
 	CID               uint64   `json:"client_id,omitempty"`
 	ClientIP          string   `json:"client_ip,omitempty"`
 	Nonce             string   `json:"nonce,omitempty"`
+	Identity          string   `json:"identity,omitempty"` // Signed identity of the server.
+	Scram             string   `json:"scram,omitempty"`    // Server messages of a SCRAM exchange.
 	Cluster           string   `json:"cluster,omitempty"`
 	ClientConnectURLs []string `json:"connect_urls,omitempty"`    // Contains URLs a client can connect to.
 	WSConnectURLs     []string `json:"ws_connect_urls,omitempty"` // Contains URLs a ws client can connect to.
 	LameDuckMode      bool     `json:"ldm,omitempty"`
+	// Capabilities supported by the server.
+	Capabilities Capabilities `json:"capabilities,omitempty"`
 
 	// Route Specific
 	Import *SubjectPermission `json:"import,omitempty"`
@@ -101,7 +106,7 @@ type Server struct {
 	gcid uint64
 	stats
 	mu               sync.Mutex
-	kp               nkeys.KeyPair
+	kp               Signer
 	prand            *rand.Rand
 	info             Info
 	configFile       string
@@ -110,14 +115,31 @@ type Server struct {
 	running          bool
 	shutdown         bool
 	reloading        bool
+	reloadMu         sync.Mutex
 	listener         net.Listener
+	unixListener     net.Listener
+	kafka            srvKafka
+	stomp            srvStomp
+	amqp             srvAMQP
+	redis            srvRedis
+	rest             srvREST
+	oidc             *oidcProvider
+	kerberos         *kerberosAcceptor
+	lockout          authLockout
+	uconns           userConns
+	revTmr           *time.Timer
+	authCache        authCache
+	resolverCache    resolverCache
+	operators        serverOperators
 	gacc             *Account
 	sys              *internal
 	js               *jetStream
+	storeProvider    StreamStoreProvider
 	accounts         sync.Map
 	tmpAccounts      sync.Map // Temporarily stores accounts that are being built
 	activeAccounts   int32
 	accResolver      AccountResolver
+	accResNotifier   AccountResolverNotifier
 	clients          map[uint64]*client
 	routes           map[uint64]*client
 	routesByHash     sync.Map
@@ -141,6 +163,7 @@ type Server struct {
 	leafNodeListener net.Listener
 	leafNodeInfo     Info
 	leafNodeInfoJSON []byte
+	dnsResolver      *dnsResolver
 	leafNodeOpts     struct {
 		resolver    netResolver
 		dialTimeout time.Duration
@@ -158,6 +181,10 @@ type Server struct {
 	cproto     int64     // number of clients supporting async INFO
 	configTime time.Time // last time config was loaded
 
+	// Configurations applied on startup and reload, for rollback.
+	configSnapshots  []*ConfigSnapshot
+	configSnapshotID int
+
 	logging struct {
 		sync.RWMutex
 		logger      Logger
@@ -186,6 +213,44 @@ type Server struct {
 	ldm   bool
 	ldmCh chan bool
 
+	// Upgrade mode
+	upgrade *upgradeState
+
+	// Listeners in maintenance mode, keyed by listener name.
+	maintenance map[string]*ListenerMaintenance
+
+	// Accounts whose connections are rejected.
+	drainingAccounts map[string]struct{}
+
+	// Lowest threshold, in days, notified for expiring certificates.
+	certExpiryNotified map[string]int
+
+	// Users of the users file and the version of the file they were
+	// loaded from.
+	fileNkeys      []*NkeyUser
+	fileUsers      []*User
+	usersFileStamp usersFileStamp
+	// Serializes rewrites of the users file, and hashes being rehashed.
+	usersFileMu sync.Mutex
+	rehashing   map[string]struct{}
+
+	// Recent log events for crash reports.
+	crashEvents crashEvents
+
+	// Verified nonce signatures, to detect their replay.
+	verifiedSigs       map[string]time.Time
+	verifiedSigsPruned time.Time
+
+	// Token bucket of nonce verification events.
+	authVerifyTokens int
+	authVerifyRefill time.Time
+
+	// Fingerprints and networks of authenticated users.
+	fingerprints fingerprints
+
+	// TLS handshakes and resumed sessions, keyed by listener.
+	tlsSessions map[string]*tlsSessionCounts
+
 	// Trusted public operator keys.
 	trustedKeys []string
 
@@ -215,6 +280,15 @@ type Server struct {
 
 	// Websocket structure
 	websocket srvWebsocket
+
+	// Callbacks registered by embedding applications.
+	hooks *LifecycleHooks
+
+	// Message interceptors, holds a []*msgInterceptor.
+	interceptors atomic.Value
+
+	// Exports the traces of JetStream messages, if configured.
+	tracer *tracer
 }
 
 // Make sure all are 64bits for atomic use
@@ -224,6 +298,7 @@ type stats struct {
 	inBytes       int64
 	outBytes      int64
 	slowConsumers int64
+	throttledMsgs int64
 }
 
 // New will setup a new server struct after parsing the options.
@@ -242,8 +317,13 @@ func NewServer(opts *Options) (*Server, error) {
 	tlsReq := opts.TLSConfig != nil
 	verify := (tlsReq && opts.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert)
 
-	// Created server's nkey identity.
-	kp, _ := nkeys.CreateServer()
+	// Created server's nkey identity, unless held by a signer.
+	var kp Signer
+	if opts.Signer != nil {
+		kp = opts.Signer
+	} else {
+		kp, _ = nkeys.CreateServer()
+	}
 	pub, _ := kp.PublicKey()
 
 	serverName := pub
@@ -276,6 +356,7 @@ func NewServer(opts *Options) (*Server, error) {
 		MaxPayload:   opts.MaxPayload,
 		JetStream:    opts.JetStream,
 		Headers:      !opts.NoHeaderSupport,
+		Capabilities: supportedCapabilities,
 	}
 
 	if tlsReq && !info.TLSRequired {
@@ -296,6 +377,7 @@ func NewServer(opts *Options) (*Server, error) {
 		gwLeafSubs:   NewSublistWithCache(),
 		httpBasePath: httpBasePath,
 		eventIds:     nuid.New(),
+		tlsSessions:  newTLSSessionCounts(),
 	}
 
 	// Trusted root operator keys.
@@ -309,9 +391,19 @@ func NewServer(opts *Options) (*Server, error) {
 	// Used internally for quick look-ups.
 	s.websocket.connectURLsMap = make(map[string]struct{})
 
+	// Resolves outbound host names with the current dns resolver options.
+	s.dnsResolver = &dnsResolver{s: s}
+
+	if opts.Tracing.Endpoint != _EMPTY_ {
+		s.tracer = newTracer(s, opts.Tracing)
+	}
+
 	// Ensure that non-exported options (used in tests) are properly set.
 	s.setLeafNodeNonExportedOptions()
 
+	// Keep the startup configuration for rollback.
+	s.recordConfigSnapshot(opts)
+
 	// Used internally for quick look-ups.
 	s.clientConnectURLsMap = make(map[string]struct{})
 
@@ -449,6 +541,108 @@ func validateOptions(o *Options) error {
 	if err := validateGatewayOptions(o); err != nil {
 		return err
 	}
+	if err := validateIPFilterOptions(o); err != nil {
+		return err
+	}
+	if err := validateAllowedConnections(o); err != nil {
+		return err
+	}
+	if err := validateTLSDowngradeOptions(o); err != nil {
+		return err
+	}
+	if err := validateFIPSOptions(o); err != nil {
+		return err
+	}
+	if err := validateUnixSocketOptions(o); err != nil {
+		return err
+	}
+	if err := validateKafkaOptions(o); err != nil {
+		return err
+	}
+	if err := validateStompOptions(o); err != nil {
+		return err
+	}
+	if err := validateAMQPOptions(o); err != nil {
+		return err
+	}
+	if err := validateRedisOptions(o); err != nil {
+		return err
+	}
+	if err := validateAnonymousOptions(o); err != nil {
+		return err
+	}
+	if err := validateScatterGatherOptions(o); err != nil {
+		return err
+	}
+	if err := validateServiceGraphOptions(o); err != nil {
+		return err
+	}
+	if err := validateTracingOptions(o); err != nil {
+		return err
+	}
+	if err := validateAuthCacheOptions(o); err != nil {
+		return err
+	}
+	if err := validateResolverCacheOptions(o); err != nil {
+		return err
+	}
+	if err := validateAuthLockoutOptions(o); err != nil {
+		return err
+	}
+	if err := validateTLSMapOrder(o); err != nil {
+		return err
+	}
+	if err := validateBearerTokenListeners(o); err != nil {
+		return err
+	}
+	if err := validateWebhookOptions(o); err != nil {
+		return err
+	}
+	if err := validatePromWriteOptions(o); err != nil {
+		return err
+	}
+	if err := validateOIDCOptions(o); err != nil {
+		return err
+	}
+	if err := validateKerberosOptions(o); err != nil {
+		return err
+	}
+	if err := validateTLSAccountMappings(o); err != nil {
+		return err
+	}
+	if err := validateSPIFFEMappings(o); err != nil {
+		return err
+	}
+	if err := validateServerIdentityOptions(o); err != nil {
+		return err
+	}
+	if err := validateLeafUsageOptions(o); err != nil {
+		return err
+	}
+	if err := validateUsersFile(o); err != nil {
+		return err
+	}
+	if err := validateTokens(o); err != nil {
+		return err
+	}
+	if err := validateBcryptCost(o); err != nil {
+		return err
+	}
+	if err := validateServerNkeys("cluster", o.Cluster.NkeySeed, o.Cluster.Nkeys); err != nil {
+		return err
+	}
+	if err := validateServerNkeys("gateway", o.Gateway.NkeySeed, o.Gateway.Nkeys); err != nil {
+		return err
+	}
+	if err := validateSigners(o); err != nil {
+		return err
+	}
+	if err := validateDNSResolverOptions(o); err != nil {
+		return err
+	}
+	if err := validateJetStreamUsage(o); err != nil {
+		return err
+	}
 	return validateWebsocketOptions(o)
 }
 
@@ -576,7 +770,12 @@ func (s *Server) configureAccounts() error {
 // properly formed but do not enforce expiration etc.
 func (s *Server) configureResolver() error {
 	opts := s.getOpts()
+	s.configureOperatorPolicies(opts)
 	s.accResolver = opts.AccountResolver
+	// Operators may have their own resolvers.
+	if ar := s.newOperatorResolver(opts); ar != nil {
+		s.accResolver = ar
+	}
 	if opts.AccountResolver != nil {
 		// For URL resolver, set the TLSConfig if specified.
 		if opts.AccountResolverTLSConfig != nil {
@@ -588,7 +787,7 @@ func (s *Server) configureResolver() error {
 			}
 		}
 		if len(opts.resolverPreloads) > 0 {
-			if _, ok := s.accResolver.(*MemAccResolver); !ok {
+			if _, ok := opts.AccountResolver.(*MemAccResolver); !ok {
 				return fmt.Errorf("resolver preloads only available for resolver type MEM")
 			}
 			for k, v := range opts.resolverPreloads {
@@ -1059,6 +1258,7 @@ func (s *Server) registerAccountNoLock(acc *Account) *Account {
 	}
 	acc.srv = s
 	acc.mu.Unlock()
+	acc.startPresence()
 	s.accounts.Store(acc.Name, acc)
 	s.tmpAccounts.Delete(acc.Name)
 	s.enableAccountTracking(acc)
@@ -1088,6 +1288,15 @@ func (s *Server) lookupAccount(name string) (*Account, error) {
 			} else {
 				return nil, ErrAccountExpired
 			}
+		} else if rc := s.getOpts().ResolverCache; rc.Enabled {
+			if err := s.revalidateAccount(acc, &rc); err != nil {
+				return nil, err
+			}
+		} else if ttl := s.accountResolverCacheTTL(); ttl > 0 && time.Since(acc.updated) > ttl {
+			// The resolver wants claims to be refreshed. On failure keep
+			// using the current ones, fetch errors are already logged.
+			s.Debugf("Requested account [%s] claims are stale, refreshing", name)
+			s.updateAccount(acc)
 		}
 		return acc, nil
 	}
@@ -1108,7 +1317,10 @@ func (s *Server) LookupAccount(name string) (*Account, error) {
 // Lock MUST NOT be held upon entry.
 func (s *Server) updateAccount(acc *Account) error {
 	// TODO(dlc) - Make configurable
-	if time.Since(acc.updated) < time.Second {
+	acc.mu.RLock()
+	updated := acc.updated
+	acc.mu.RUnlock()
+	if time.Since(updated) < time.Second {
 		s.Debugf("Requested account update for [%s] ignored, too soon", acc.Name)
 		return ErrAccountResolverUpdateTooSoon
 	}
@@ -1125,15 +1337,19 @@ func (s *Server) updateAccountWithClaimJWT(acc *Account, claimJWT string) error
 	if acc == nil {
 		return ErrMissingAccount
 	}
+	acc.mu.Lock()
 	acc.updated = time.Now()
+	acc.mu.Unlock()
 	if acc.claimJWT != "" && acc.claimJWT == claimJWT {
 		s.Debugf("Requested account update for [%s], same claims detected", acc.Name)
+		acc.markValidated()
 		return ErrAccountResolverSameClaims
 	}
 	accClaims, _, err := s.verifyAccountClaims(claimJWT)
 	if err == nil && accClaims != nil {
 		acc.claimJWT = claimJWT
 		s.UpdateAccountClaims(acc, accClaims)
+		acc.markValidated()
 		return nil
 	}
 	return err
@@ -1191,8 +1407,13 @@ func (s *Server) verifyAccountClaims(claimJWT string) (*jwt.AccountClaims, strin
 func (s *Server) fetchAccount(name string) (*Account, error) {
 	accClaims, claimJWT, err := s.fetchAccountClaims(name)
 	if accClaims != nil {
+		if err := s.checkOperatorAccount(accClaims); err != nil {
+			s.Warnf("Account [%s] rejected: %v", name, err)
+			return nil, err
+		}
 		acc := s.buildInternalAccount(accClaims)
 		acc.claimJWT = claimJWT
+		acc.markValidated()
 		// Due to possible race, if registerAccount() returns a non
 		// nil account, it means the same account was already
 		// registered and we should use this one.
@@ -1232,6 +1453,9 @@ func (s *Server) Start() {
 	// Check for insecure configurations.
 	s.checkAuthforWarnings()
 
+	// Report how FIPS mode is enforced, if enabled.
+	s.logFIPSMode()
+
 	// Avoid RACE between Start() and Shutdown()
 	s.mu.Lock()
 	s.running = true
@@ -1264,6 +1488,9 @@ func (s *Server) Start() {
 		s.checkResolvePreloads()
 	}
 
+	// Start account JWT update notifications if the resolver supports them.
+	s.startAccountResolverNotifications()
+
 	// Log the pid to a file
 	if opts.PidFile != _EMPTY_ {
 		if err := s.logPid(); err != nil {
@@ -1286,6 +1513,40 @@ func (s *Server) Start() {
 	// this server is configured with gateway or not.
 	s.startGWReplyMapExpiration()
 
+	// Start checking TLS certificates for expiry.
+	s.startCertExpiryCheck()
+
+	// Start computing the rates of the service graphs.
+	s.startServiceGraphUpdates()
+
+	// Start exporting traces if needed.
+	if s.tracer != nil {
+		s.startTracing()
+	}
+
+	// Start sending the usage of the leafnodes if accounted.
+	if opts.LeafNode.Port != 0 && opts.LeafNode.UsageTokens > 0 {
+		s.startLeafUsageEvents()
+	}
+
+	// Start watching the users file if needed.
+	if opts.UsersFile != _EMPTY_ {
+		s.startUsersFileWatcher()
+	}
+
+	// Start closing inactive client connections, if configured.
+	s.startInactiveClientCheck()
+
+	// Send crash reports from previous runs if configured.
+	s.sendCrashReports()
+
+	// Start monitoring if needed. This is done before JetStream so that
+	// the recovery of its state can be followed through /healthz.
+	if err := s.StartMonitoring(); err != nil {
+		s.Fatalf("Can't start monitoring: %v", err)
+		return
+	}
+
 	// Check if JetStream has been enabled. This needs to be after
 	// the system account setup above. JetStream will create its
 	// own system account if one is not present.
@@ -1295,9 +1556,12 @@ func (s *Server) Start() {
 			s.Fatalf("Not allowed to enable JetStream on the system account")
 		}
 		cfg := &JetStreamConfig{
-			StoreDir:  opts.StoreDir,
-			MaxMemory: opts.JetStreamMaxMemory,
-			MaxStore:  opts.JetStreamMaxStore,
+			StoreDir:            opts.StoreDir,
+			MaxMemory:           opts.JetStreamMaxMemory,
+			MaxStore:            opts.JetStreamMaxStore,
+			RecoveryConcurrency: opts.JetStreamRecoveryConcurrency,
+			UsageInterval:       opts.JetStreamUsageInterval,
+			UsageAggregation:    opts.JetStreamUsageAggregation,
 		}
 		if err := s.EnableJetStream(cfg); err != nil {
 			s.Fatalf("Can't start JetStream: %v", err)
@@ -1319,12 +1583,6 @@ func (s *Server) Start() {
 		})
 	}
 
-	// Start monitoring if needed
-	if err := s.StartMonitoring(); err != nil {
-		s.Fatalf("Can't start monitoring: %v", err)
-		return
-	}
-
 	// Start up gateway if needed. Do this before starting the routes, because
 	// we want to resolve the gateway host:port so that this information can
 	// be sent to other routes.
@@ -1358,6 +1616,41 @@ func (s *Server) Start() {
 		s.startWebsocketServer()
 	}
 
+	// Start the unix socket listener for local clients if needed.
+	if opts.UnixSocket.Path != _EMPTY_ {
+		s.startUnixSocketListener()
+	}
+
+	// Start the listener for Kafka clients if needed.
+	if opts.Kafka.Port != 0 {
+		s.startKafkaListener()
+	}
+
+	// Start the listener for STOMP clients if needed.
+	if opts.Stomp.Port != 0 {
+		s.startStompListener()
+	}
+
+	// Start the listener for AMQP connections if needed.
+	if opts.AMQP.Port != 0 {
+		s.startAMQPListener()
+	}
+
+	// Start the listener for Redis clients if needed.
+	if opts.Redis.Port != 0 {
+		s.startRedisListener()
+	}
+
+	// Start the listener for REST requests if needed.
+	if opts.REST.Port != 0 {
+		s.startRESTListener()
+	}
+
+	// Start delivering messages to webhooks if needed.
+	if len(opts.Webhooks) > 0 {
+		s.startWebhooks()
+	}
+
 	// Start up routing as well if needed.
 	if opts.Cluster.Port != 0 {
 		s.startGoRoutine(func() {
@@ -1390,6 +1683,9 @@ func (s *Server) Shutdown() {
 	// Now check jetstream.
 	s.shutdownJetStream()
 
+	// Stop account resolver notifications.
+	s.stopAccountResolverNotifications()
+
 	s.mu.Lock()
 	// Prevent issues with multiple calls.
 	if s.shutdown {
@@ -1397,11 +1693,16 @@ func (s *Server) Shutdown() {
 		return
 	}
 	s.Noticef("Initiating Shutdown...")
+	s.sdNotifyStatus(sdStopping, "Shutting down")
 
 	opts := s.getOpts()
 
 	s.shutdown = true
 	s.running = false
+	if s.revTmr != nil {
+		s.revTmr.Stop()
+		s.revTmr = nil
+	}
 	s.grMu.Lock()
 	s.grRunning = false
 	s.grMu.Unlock()
@@ -1449,6 +1750,48 @@ func (s *Server) Shutdown() {
 		s.websocket.listener = nil
 	}
 
+	// Kick unix socket AcceptLoop()
+	if s.unixListener != nil {
+		doneExpected++
+		s.unixListener.Close()
+		s.unixListener = nil
+	}
+
+	// Kick Kafka AcceptLoop()
+	if s.kafka.listener != nil {
+		doneExpected++
+		s.kafka.listener.Close()
+		s.kafka.listener = nil
+	}
+
+	// Kick STOMP AcceptLoop()
+	if s.stomp.listener != nil {
+		doneExpected++
+		s.stomp.listener.Close()
+		s.stomp.listener = nil
+	}
+
+	// Kick AMQP AcceptLoop()
+	if s.amqp.listener != nil {
+		doneExpected++
+		s.amqp.listener.Close()
+		s.amqp.listener = nil
+	}
+
+	// Kick Redis AcceptLoop()
+	if s.redis.listener != nil {
+		doneExpected++
+		s.redis.listener.Close()
+		s.redis.listener = nil
+	}
+
+	// Kick REST server if its running
+	if s.rest.listener != nil {
+		doneExpected++
+		s.rest.listener.Close()
+		s.rest.listener = nil
+	}
+
 	// Kick leafnodes AcceptLoop()
 	if s.leafNodeListener != nil {
 		doneExpected++
@@ -1493,6 +1836,10 @@ func (s *Server) Shutdown() {
 		c.setNoReconnect()
 		c.closeConnection(ServerShutdown)
 	}
+	s.closeKafkaConns()
+	s.closeStompConns()
+	s.closeAMQPConns()
+	s.closeRedisConns()
 
 	// Block until the accept loops exit
 	for doneExpected > 0 {
@@ -1585,6 +1932,9 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 	close(clr)
 	clr = nil
 
+	// Let systemd know too, if it started us.
+	s.sdNotifyReady()
+
 	tmpDelay := ACCEPT_MIN_SLEEP
 
 	for s.isRunning() {
@@ -1725,6 +2075,8 @@ const (
 	LeafzPath    = "/leafz"
 	SubszPath    = "/subsz"
 	StackszPath  = "/stacksz"
+	HealthzPath  = "/healthz"
+	ServicezPath = "/servicez"
 )
 
 func (s *Server) basePath(p string) string {
@@ -1744,6 +2096,8 @@ func (s *Server) startMonitoring(secure bool) error {
 		RoutezPath:   0,
 		GatewayzPath: 0,
 		SubszPath:    0,
+		HealthzPath:  0,
+		ServicezPath: 0,
 	}
 
 	var (
@@ -1802,6 +2156,14 @@ func (s *Server) startMonitoring(secure bool) error {
 	mux.HandleFunc(s.basePath("/subscriptionsz"), s.HandleSubsz)
 	// Stacksz
 	mux.HandleFunc(s.basePath(StackszPath), s.HandleStacksz)
+	// Healthz
+	mux.HandleFunc(s.basePath(HealthzPath), s.HandleHealthz)
+	// Servicez
+	mux.HandleFunc(s.basePath(ServicezPath), s.HandleServicez)
+	// Prometheus remote-write
+	if po := opts.PrometheusWrite; po.Subject != _EMPTY_ {
+		mux.HandleFunc(s.basePath(po.path()), s.HandlePromWrite)
+	}
 
 	// Do not set a WriteTimeout because it could cause cURL/browser
 	// to return empty response or unable to display page if the
@@ -1882,6 +2244,16 @@ func (s *Server) createClient(conn net.Conn, ws *websocket) *client {
 	// Snapshot server options.
 	opts := s.getOpts()
 
+	// Reject remote IPs not allowed on the listener.
+	listener := MaintenanceClient
+	if ws != nil {
+		listener = MaintenanceWebsocket
+	}
+	if !s.ipAllowedOnListener(listener, conn) {
+		conn.Close()
+		return nil
+	}
+
 	maxPay := int32(opts.MaxPayload)
 	maxSubs := int32(opts.MaxSubs)
 	// For system, maxSubs of 0 means unlimited, so re-adjust here.
@@ -1891,6 +2263,7 @@ func (s *Server) createClient(conn net.Conn, ws *websocket) *client {
 	now := time.Now()
 
 	c := &client{srv: s, nc: conn, opts: defaultOpts, mpay: maxPay, msubs: maxSubs, start: now, last: now, ws: ws}
+	_, c.unix = conn.(*net.UnixConn)
 
 	c.registerWithAccount(s.globalAccount())
 
@@ -1903,16 +2276,18 @@ func (s *Server) createClient(conn net.Conn, ws *websocket) *client {
 	if ws != nil && !info.AuthRequired {
 		info.AuthRequired = s.websocket.authRequired
 	}
+	// Local clients on the unix socket do not need TLS.
+	if c.unix {
+		info.TLSRequired, info.TLSVerify = false, false
+	}
 	if s.nonceRequired() {
 		// Nonce handling
-		var raw [nonceLen]byte
-		nonce := raw[:]
-		s.generateNonce(nonce)
-		info.Nonce = string(nonce)
+		info.Nonce = string(s.generateNonce())
 	}
 	c.nonce = []byte(info.Nonce)
 	s.totalClients++
 	s.mu.Unlock()
+	s.setIdentity(&info)
 
 	// Grab lock
 	c.mu.Lock()
@@ -1944,6 +2319,13 @@ func (s *Server) createClient(conn net.Conn, ws *websocket) *client {
 		return c
 	}
 
+	// Reject new connections on a listener in maintenance mode.
+	if lm := s.maintenance[listener]; lm != nil {
+		s.mu.Unlock()
+		c.maintenanceRejected(lm.Hint)
+		return nil
+	}
+
 	// If there is a max connections specified, check that adding
 	// this new client would not push us over the max
 	if opts.MaxConn > 0 && len(s.clients) >= opts.MaxConn {
@@ -1961,7 +2343,7 @@ func (s *Server) createClient(conn net.Conn, ws *websocket) *client {
 	var pre []byte
 	// If we have both TLS and non-TLS allowed we need to see which
 	// one the client wants.
-	if opts.TLSConfig != nil && opts.AllowNonTLS {
+	if opts.TLSConfig != nil && opts.AllowNonTLS && !c.unix {
 		pre = make([]byte, 4)
 		c.nc.SetReadDeadline(time.Now().Add(secondsToDuration(opts.TLSTimeout)))
 		n, _ := io.ReadFull(c.nc, pre[:])
@@ -1974,6 +2356,13 @@ func (s *Server) createClient(conn net.Conn, ws *websocket) *client {
 		}
 	}
 
+	// Reject clients falling back to plaintext if downgrades are not allowed.
+	if !tlsRequired && opts.NoTLSDowngrade && opts.TLSConfig != nil && ws == nil && !c.unix {
+		c.mu.Unlock()
+		c.tlsDowngradeRejected(tlsDowngradePlaintext)
+		return nil
+	}
+
 	// Check for TLS
 	if tlsRequired {
 		c.Debugf("Starting TLS client connection handshake")
@@ -1984,7 +2373,11 @@ func (s *Server) createClient(conn net.Conn, ws *websocket) *client {
 			pre = nil
 		}
 
-		c.nc = tls.Server(c.nc, opts.TLSConfig)
+		tlsConfig := opts.TLSConfig
+		if opts.ConnectionFingerprinting {
+			tlsConfig = c.fingerprintTLSConfig(tlsConfig)
+		}
+		c.nc = tls.Server(c.nc, tlsConfig)
 		conn := c.nc.(*tls.Conn)
 
 		// Setup the timeout
@@ -2001,6 +2394,7 @@ func (s *Server) createClient(conn net.Conn, ws *websocket) *client {
 		}
 		// Reset the read deadline
 		conn.SetReadDeadline(time.Time{})
+		s.recordTLSHandshake("client", conn.ConnectionState().DidResume)
 
 		// Re-Grab lock
 		c.mu.Lock()
@@ -2064,6 +2458,9 @@ func (s *Server) saveClosedClient(c *client, nc net.Conn, reason ClosedState) {
 	now := time.Now()
 
 	s.accountDisconnectEvent(c, now, reason.String())
+	if c.kind == CLIENT {
+		s.clientDisconnectHook(c, now, reason.String())
+	}
 
 	c.mu.Lock()
 
@@ -2419,7 +2816,10 @@ func (s *Server) startGoRoutine(f func()) {
 	s.grMu.Lock()
 	if s.grRunning {
 		s.grWG.Add(1)
-		go f()
+		go func() {
+			defer s.capturePanic()
+			f()
+		}()
 	}
 	s.grMu.Unlock()
 }
@@ -2764,6 +3164,7 @@ func (s *Server) lameDuckMode() {
 		return
 	}
 	s.Noticef("Entering lame duck mode, stop accepting new clients")
+	s.sdNotifyStatus(sdStopping, "Lame duck mode, draining connections")
 	s.ldm = true
 	expected := 1
 	s.listener.Close()
@@ -2774,6 +3175,31 @@ func (s *Server) lameDuckMode() {
 		s.websocket.server = nil
 		s.websocket.listener = nil
 	}
+	if s.unixListener != nil {
+		expected++
+		s.unixListener.Close()
+		s.unixListener = nil
+	}
+	if s.kafka.listener != nil {
+		expected++
+		s.kafka.listener.Close()
+		s.kafka.listener = nil
+	}
+	if s.stomp.listener != nil {
+		expected++
+		s.stomp.listener.Close()
+		s.stomp.listener = nil
+	}
+	if s.amqp.listener != nil {
+		expected++
+		s.amqp.listener.Close()
+		s.amqp.listener = nil
+	}
+	if s.redis.listener != nil {
+		expected++
+		s.redis.listener.Close()
+		s.redis.listener = nil
+	}
 	s.ldmCh = make(chan bool, expected)
 	opts := s.getOpts()
 	gp := opts.LameDuckGracePeriod
@@ -2785,6 +3211,8 @@ func (s *Server) lameDuckMode() {
 	}
 	s.mu.Unlock()
 
+	s.lameDuckModeHook()
+
 	// Wait for accept loops to be done to make sure that no new
 	// client can connect
 	for i := 0; i < expected; i++ {
@@ -2810,7 +3238,16 @@ func (s *Server) lameDuckMode() {
 	batch := 1
 	// Sleep interval between each client connection close.
 	si := dur / numClients
-	if si < 1 {
+	if opts.LameDuckBatchSize > 1 {
+		// Spread the configured batches over the duration.
+		batch = opts.LameDuckBatchSize
+		si = dur / ((numClients + int64(batch) - 1) / int64(batch))
+		if si < 1 {
+			si = 1
+		} else if si > int64(time.Second) {
+			si = int64(time.Second)
+		}
+	} else if si < 1 {
 		// Should not happen (except in test with very small LD duration), but
 		// if there are too many clients, batch the number of close and
 		// use a tiny sleep interval that will result in yield likely.
@@ -2828,6 +3265,9 @@ func (s *Server) lameDuckMode() {
 	for _, client := range s.clients {
 		clients = append(clients, client)
 	}
+	if len(opts.LameDuckAccountPriority) > 0 {
+		sortClientsByAccountPriority(clients, opts.LameDuckAccountPriority)
+	}
 	// Now that we know that no new client can be accepted,
 	// send INFO to routes and clients to notify this state.
 	s.sendLDMToRoutes()
@@ -2845,12 +3285,19 @@ func (s *Server) lameDuckMode() {
 		t.Stop()
 		return
 	}
+	s.sendLameDuckEvent(len(clients), 0)
+	var lastEvent time.Time
 	for i, client := range clients {
 		client.closeConnection(ServerShutdown)
 		if i == len(clients)-1 {
 			break
 		}
-		if batch == 1 || i%batch == 0 {
+		// Report progress from time to time.
+		if time.Since(lastEvent) >= ldmEventInterval {
+			s.sendLameDuckEvent(len(clients), i+1)
+			lastEvent = time.Now()
+		}
+		if batch == 1 || (i+1)%batch == 0 {
 			// We pick a random interval which will be at least si/2
 			v := rand.Int63n(si)
 			if v < si/2 {
@@ -2866,9 +3313,31 @@ func (s *Server) lameDuckMode() {
 			}
 		}
 	}
+	s.sendLameDuckEvent(len(clients), len(clients))
 	s.Shutdown()
 }
 
+// Order clients so that the ones of the given accounts are first, in that order.
+func sortClientsByAccountPriority(clients []*client, accounts []string) {
+	prio := make(map[string]int, len(accounts))
+	for i, name := range accounts {
+		if _, ok := prio[name]; !ok {
+			prio[name] = i
+		}
+	}
+	rank := make(map[*client]int, len(clients))
+	for _, c := range clients {
+		c.mu.Lock()
+		r, ok := prio[accForClient(c)]
+		c.mu.Unlock()
+		if !ok {
+			r = len(accounts)
+		}
+		rank[c] = r
+	}
+	sort.SliceStable(clients, func(i, j int) bool { return rank[clients[i]] < rank[clients[j]] })
+}
+
 // Send an INFO update to routes with the indication that this server is in LDM mode.
 // Server lock is held on entry.
 func (s *Server) sendLDMToRoutes() {
@@ -2896,11 +3365,17 @@ func (s *Server) sendLDMToClients() {
 	// Reset content first.
 	s.info.ClientConnectURLs = s.info.ClientConnectURLs[:0]
 	s.info.WSConnectURLs = s.info.WSConnectURLs[:0]
-	// Only add the other nodes if we are allowed to.
-	if !s.getOpts().Cluster.NoAdvertise {
+	// Suggest the configured URLs, in order, otherwise the other nodes
+	// if we are allowed to.
+	opts := s.getOpts()
+	if len(opts.LameDuckConnectURLs) > 0 {
+		s.info.ClientConnectURLs = append(s.info.ClientConnectURLs, opts.LameDuckConnectURLs...)
+	} else if !opts.Cluster.NoAdvertise {
 		for url := range s.clientConnectURLsMap {
 			s.info.ClientConnectURLs = append(s.info.ClientConnectURLs, url)
 		}
+	}
+	if !opts.Cluster.NoAdvertise {
 		for url := range s.websocket.connectURLsMap {
 			s.info.WSConnectURLs = append(s.info.WSConnectURLs, url)
 		}
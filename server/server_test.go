@@ -617,6 +617,69 @@ func TestCustomRouterAuthentication(t *testing.T) {
 	checkNumRoutes(t, s3, 1)
 }
 
+type dummyAuthV2 struct{}
+
+func (d *dummyAuthV2) Check(c ClientAuthenticationV2) (bool, error) {
+	switch c.GetOpts().Username {
+	case "a":
+		acc, err := c.LookupAccount("A")
+		if err != nil {
+			return false, err
+		}
+		perms := &Permissions{Publish: &SubjectPermission{Allow: []string{"foo"}}}
+		return true, c.BindAccount(acc, perms)
+	case "missing":
+		_, err := c.LookupAccount("B")
+		return false, err
+	}
+	return false, nil
+}
+
+func TestCustomClientAuthenticationV2(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Accounts = []*Account{NewAccount("A")}
+	opts.CustomClientAuthenticationV2 = &dummyAuthV2{}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	addr := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	for _, user := range []string{"missing", "invalid"} {
+		if _, err := nats.Connect(addr, nats.UserInfo(user, "")); err == nil {
+			t.Fatalf("Expected client %q to fail to connect", user)
+		}
+	}
+
+	errCh := make(chan error, 1)
+	nc, err := nats.Connect(addr, nats.UserInfo("a", ""),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errCh <- err }))
+	if err != nil {
+		t.Fatalf("Expected client to connect, got: %s", err)
+	}
+	defer nc.Close()
+	nc.Flush()
+
+	acc, _ := s.LookupAccount("A")
+	if n := acc.NumLocalConnections(); n != 1 {
+		t.Fatalf("Expected client to be bound to account A, got %d connections", n)
+	}
+	nc.Publish("bar", nil)
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "Permissions Violation") {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a permissions violation")
+	}
+
+	opts = DefaultOptions()
+	opts.CustomClientAuthentication = &DummyAuth{}
+	opts.CustomClientAuthenticationV2 = &dummyAuthV2{}
+	if _, err := NewServer(opts); err == nil {
+		t.Fatal("Expected error with both custom authentications")
+	}
+}
+
 func TestMonitoringNoTimeout(t *testing.T) {
 	s := runMonitorServer()
 	defer s.Shutdown()
@@ -1069,6 +1132,96 @@ func TestLameDuckModeInfo(t *testing.T) {
 	wg.Wait()
 }
 
+func TestLameDuckModeSteering(t *testing.T) {
+	opts := DefaultOptions()
+	testSetLDMGracePeriod(opts, time.Nanosecond)
+	opts.LameDuckDuration = 400 * time.Millisecond
+	opts.LameDuckBatchSize = 2
+	opts.LameDuckAccountPriority = []string{"B"}
+	opts.LameDuckConnectURLs = []string{"127.0.0.1:4333", "127.0.0.1:4222"}
+	aA, aB, sys := NewAccount("A"), NewAccount("B"), NewAccount("SYS")
+	opts.Accounts = []*Account{aA, aB, sys}
+	opts.SystemAccount = "SYS"
+	opts.Users = []*User{
+		{Username: "ua", Password: "pwd", Account: aA},
+		{Username: "ub", Password: "pwd", Account: aB},
+		{Username: "sys", Password: "pwd", Account: sys},
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	ncSys := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer ncSys.Close()
+	evSub := natsSubSync(t, ncSys, fmt.Sprintf(lameDuckEventSubj, s.ID()))
+	natsFlush(t, ncSys)
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", opts.Port))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	cr := bufio.NewReaderSize(c, maxBufSize)
+	cr.ReadString('\n')
+	c.Write([]byte("CONNECT {\"user\":\"ua\",\"pass\":\"pwd\",\"protocol\":1,\"verbose\":false}\r\nPING\r\n"))
+	cr.ReadString('\n')
+
+	var mu sync.Mutex
+	var closed []string
+	for _, user := range []string{"ua", "ua", "ub", "ub"} {
+		user := user
+		nc, err := nats.Connect(s.ClientURL(), nats.UserInfo(user, "pwd"), nats.NoReconnect(),
+			nats.DisconnectErrHandler(func(*nats.Conn, error) {
+				mu.Lock()
+				closed = append(closed, user)
+				mu.Unlock()
+			}))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		defer nc.Close()
+	}
+	checkClientsCount(t, s, 6)
+
+	s.lameDuckMode()
+
+	// Clients are steered to the configured URLs, in order.
+	l, err := cr.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error receiving info from server: %v", err)
+	}
+	var info serverInfo
+	if err := json.Unmarshal([]byte(l[5:]), &info); err != nil {
+		t.Fatalf("Could not parse INFO json: %v", err)
+	}
+	if !info.LameDuckMode || !reflect.DeepEqual(info.ConnectURLs, opts.LameDuckConnectURLs) {
+		t.Fatalf("Unexpected INFO: %+v", info)
+	}
+
+	// Clients of the priority account are evicted first.
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(closed) != 4 {
+			return fmt.Errorf("Expected 4 clients to be closed, got %d", len(closed))
+		}
+		return nil
+	})
+	mu.Lock()
+	if !reflect.DeepEqual(closed, []string{"ub", "ub", "ua", "ua"}) {
+		t.Fatalf("Unexpected eviction order: %q", closed)
+	}
+	mu.Unlock()
+
+	// Progress was reported.
+	var ev LameDuckEventMsg
+	if err := json.Unmarshal(natsNexMsg(t, evSub, time.Second).Data, &ev); err != nil {
+		t.Fatalf("Error unmarshalling event: %v", err)
+	}
+	if ev.Type != LameDuckEventMsgType || ev.Clients != 6 || ev.Evicted != 0 {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+}
+
 func TestServerValidateGatewaysOptions(t *testing.T) {
 	baseOpt := testDefaultOptionsForGateway("A")
 	u, _ := url.Parse("host:5222")
@@ -0,0 +1,161 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package servertest
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Proxy is a TCP proxy that can be placed between two endpoints, for
+// instance a leaf node and its hub, to inject network faults.
+type Proxy struct {
+	mu      sync.Mutex
+	l       net.Listener
+	target  string
+	latency time.Duration
+	paused  bool
+	conns   map[net.Conn]struct{}
+	wg      sync.WaitGroup
+}
+
+// NewProxy starts a proxy forwarding connections to the target host:port.
+func NewProxy(t TB, target string) *Proxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error creating proxy listener: %v", err)
+	}
+	p := &Proxy{l: l, target: target, conns: make(map[net.Conn]struct{})}
+	p.wg.Add(1)
+	go p.acceptLoop()
+	return p
+}
+
+// Addr returns the host:port the proxy is listening on.
+func (p *Proxy) Addr() string {
+	return p.l.Addr().String()
+}
+
+// URL returns a URL with the given scheme pointing to the proxy.
+func (p *Proxy) URL(scheme string) *url.URL {
+	return &url.URL{Scheme: scheme, Host: p.Addr()}
+}
+
+// Pause closes all proxied connections and refuses new ones until Resume
+// is called, simulating a network partition.
+func (p *Proxy) Pause() {
+	p.mu.Lock()
+	p.paused = true
+	for c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+}
+
+// Resume accepts proxied connections again.
+func (p *Proxy) Resume() {
+	p.mu.Lock()
+	p.paused = false
+	p.mu.Unlock()
+}
+
+// SetLatency adds the given delay to every chunk of data forwarded.
+func (p *Proxy) SetLatency(latency time.Duration) {
+	p.mu.Lock()
+	p.latency = latency
+	p.mu.Unlock()
+}
+
+// Close stops the proxy and closes all proxied connections.
+func (p *Proxy) Close() {
+	p.l.Close()
+	p.Pause()
+	p.wg.Wait()
+}
+
+func (p *Proxy) acceptLoop() {
+	defer p.wg.Done()
+	for {
+		c, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		paused := p.paused
+		p.mu.Unlock()
+		if paused {
+			c.Close()
+			continue
+		}
+		tc, err := net.Dial("tcp", p.target)
+		if err != nil {
+			c.Close()
+			continue
+		}
+		if !p.track(c, tc) {
+			continue
+		}
+		p.wg.Add(2)
+		go p.forward(c, tc)
+		go p.forward(tc, c)
+	}
+}
+
+// Registers the connections, returns false if they were closed because
+// the proxy got paused in the meantime.
+func (p *Proxy) track(conns ...net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		for _, c := range conns {
+			c.Close()
+		}
+		return false
+	}
+	for _, c := range conns {
+		p.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (p *Proxy) forward(dst, src net.Conn) {
+	defer p.wg.Done()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			p.mu.Lock()
+			latency := p.latency
+			p.mu.Unlock()
+			if latency > 0 {
+				time.Sleep(latency)
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				err = werr
+			}
+		}
+		if err != nil {
+			src.Close()
+			dst.Close()
+			p.mu.Lock()
+			delete(p.conns, src)
+			delete(p.conns, dst)
+			p.mu.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package servertest provides helpers to run NATS servers, clusters,
+// super clusters and leaf node topologies in-process for integration tests.
+// All servers listen on ephemeral ports on the loopback interface.
+package servertest
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// TB is the subset of testing.TB used by this package.
+type TB interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+}
+
+// How long to wait for servers to start and topologies to form.
+const defaultWait = 10 * time.Second
+
+// DefaultOptions returns options suitable for an in-process server
+// listening on an ephemeral client port, with logging disabled.
+func DefaultOptions() *server.Options {
+	return &server.Options{
+		Host:     "127.0.0.1",
+		Port:     -1,
+		HTTPPort: -1,
+		NoLog:    true,
+		NoSigs:   true,
+	}
+}
+
+// RunServer starts a server with the given options, or DefaultOptions
+// if nil, and waits for it to accept client connections.
+func RunServer(t TB, opts *server.Options) *server.Server {
+	t.Helper()
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	s, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(defaultWait) {
+		s.Shutdown()
+		t.Fatalf("Server %q not ready for connections", s.ID())
+	}
+	return s
+}
+
+// WaitFor calls f until it returns nil or the timeout expires, in which
+// case the test fails with the last error returned by f.
+func WaitFor(t TB, timeout time.Duration, f func() error) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	var err error
+	for time.Now().Before(deadline) {
+		if err = f(); err == nil {
+			return
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+	t.Fatalf("%v", err)
+}
+
+// Cluster is a set of servers connected with routes.
+type Cluster struct {
+	Name    string
+	Servers []*server.Server
+	Opts    []*server.Options
+	stopped map[int]bool
+	t       TB
+}
+
+// ClusterOptions returns the options for a server of a cluster, with
+// routes set to the given route URLs.
+func ClusterOptions(routes []*url.URL) *server.Options {
+	o := DefaultOptions()
+	o.Cluster.Host = "127.0.0.1"
+	o.Cluster.Port = -1
+	o.Routes = routes
+	return o
+}
+
+// RunCluster starts a cluster of size servers and waits for the full mesh
+// of routes to be formed.
+func RunCluster(t TB, name string, size int) *Cluster {
+	t.Helper()
+	return runCluster(t, name, size, nil)
+}
+
+func runCluster(t TB, name string, size int, configure func(o *server.Options)) *Cluster {
+	t.Helper()
+	if size < 1 {
+		t.Fatalf("Cluster size should be at least 1, got %d", size)
+	}
+	c := &Cluster{Name: name, stopped: make(map[int]bool), t: t}
+	var routes []*url.URL
+	for i := 0; i < size; i++ {
+		o := ClusterOptions(routes)
+		o.ServerName = fmt.Sprintf("%s-S%d", name, i+1)
+		if configure != nil {
+			configure(o)
+		}
+		s := RunServer(t, o)
+		c.Servers = append(c.Servers, s)
+		c.Opts = append(c.Opts, o)
+		if i == 0 {
+			routes = []*url.URL{routeURL(s)}
+		}
+	}
+	c.WaitForRoutes()
+	return c
+}
+
+// Returns the route URL of that server.
+func routeURL(s *server.Server) *url.URL {
+	return &url.URL{Scheme: "nats-route", Host: s.ClusterAddr().String()}
+}
+
+// WaitForRoutes waits for all running servers of the cluster to be routed
+// to each other.
+func (c *Cluster) WaitForRoutes() {
+	c.t.Helper()
+	WaitFor(c.t, defaultWait, func() error {
+		running := c.running()
+		for _, s := range running {
+			if nr := s.NumRoutes(); nr != len(running)-1 {
+				return fmt.Errorf("server %q has %d routes, expected %d", s.ID(), nr, len(running)-1)
+			}
+		}
+		return nil
+	})
+}
+
+// Returns the servers currently running.
+func (c *Cluster) running() []*server.Server {
+	var running []*server.Server
+	for i, s := range c.Servers {
+		if !c.stopped[i] {
+			running = append(running, s)
+		}
+	}
+	return running
+}
+
+// RandomServer returns a running server of the cluster.
+func (c *Cluster) RandomServer() *server.Server {
+	running := c.running()
+	if len(running) == 0 {
+		return nil
+	}
+	return running[time.Now().UnixNano()%int64(len(running))]
+}
+
+// ClientURLs returns the client URLs of all running servers, suitable for
+// a client connect string.
+func (c *Cluster) ClientURLs() string {
+	var urls string
+	for _, s := range c.running() {
+		if urls != "" {
+			urls += ","
+		}
+		urls += s.ClientURL()
+	}
+	return urls
+}
+
+// StopServer shuts down the i-th server of the cluster.
+func (c *Cluster) StopServer(i int) {
+	c.Servers[i].Shutdown()
+	c.Servers[i].WaitForShutdown()
+	c.stopped[i] = true
+}
+
+// RestartServer restarts the i-th server of the cluster with its
+// original options, that is on the same ports, and waits for its routes.
+func (c *Cluster) RestartServer(i int) *server.Server {
+	c.t.Helper()
+	c.StopServer(i)
+	c.Servers[i] = RunServer(c.t, c.Opts[i])
+	delete(c.stopped, i)
+	c.WaitForRoutes()
+	return c.Servers[i]
+}
+
+// Shutdown stops all servers of the cluster.
+func (c *Cluster) Shutdown() {
+	for _, s := range c.Servers {
+		s.Shutdown()
+	}
+}
+
+// SuperCluster is a set of clusters connected with gateways.
+type SuperCluster struct {
+	Clusters []*Cluster
+	t        TB
+}
+
+// RunSuperCluster starts numClusters clusters of size servers each, and
+// waits for all gateways to be connected. Clusters are named C1, C2, etc...
+func RunSuperCluster(t TB, numClusters, size int) *SuperCluster {
+	t.Helper()
+	sc := &SuperCluster{t: t}
+	var gateways []*server.RemoteGatewayOpts
+	for i := 0; i < numClusters; i++ {
+		name := fmt.Sprintf("C%d", i+1)
+		remotes := gateways
+		c := runCluster(t, name, size, func(o *server.Options) {
+			o.Gateway.Name = name
+			o.Gateway.Host = "127.0.0.1"
+			o.Gateway.Port = -1
+			o.Gateway.Gateways = remotes
+		})
+		sc.Clusters = append(sc.Clusters, c)
+		gw := &server.RemoteGatewayOpts{Name: name}
+		for _, s := range c.Servers {
+			gw.URLs = append(gw.URLs, &url.URL{Scheme: "nats", Host: s.GatewayAddr().String()})
+		}
+		gateways = append(gateways, gw)
+	}
+	sc.WaitForGateways()
+	return sc
+}
+
+// WaitForGateways waits for all running servers to have an outbound
+// gateway to every other cluster.
+func (sc *SuperCluster) WaitForGateways() {
+	sc.t.Helper()
+	// Gateways are solicited after a delay, so be more patient.
+	WaitFor(sc.t, 2*defaultWait, func() error {
+		for _, c := range sc.Clusters {
+			for _, s := range c.running() {
+				if n := s.NumOutboundGateways(); n != len(sc.Clusters)-1 {
+					return fmt.Errorf("server %q has %d outbound gateways, expected %d", s.ID(), n, len(sc.Clusters)-1)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// ClusterForName returns the cluster with that name, or nil.
+func (sc *SuperCluster) ClusterForName(name string) *Cluster {
+	for _, c := range sc.Clusters {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Shutdown stops all servers of the super cluster.
+func (sc *SuperCluster) Shutdown() {
+	for _, c := range sc.Clusters {
+		c.Shutdown()
+	}
+}
+
+// HubOptions returns options for a server accepting leaf node connections
+// on an ephemeral port.
+func HubOptions() *server.Options {
+	o := DefaultOptions()
+	o.LeafNode.Host = "127.0.0.1"
+	o.LeafNode.Port = -1
+	return o
+}
+
+// LeafNodeURL returns the URL leaf nodes should use to connect to a hub
+// started with the given options, for instance obtained with HubOptions.
+func LeafNodeURL(hubOpts *server.Options) *url.URL {
+	return &url.URL{Scheme: "nats-leaf", Host: fmt.Sprintf("127.0.0.1:%d", hubOpts.LeafNode.Port)}
+}
+
+// RunLeafNode starts a server connecting as a leaf node to the given URLs
+// and waits for the leaf node connection to be established.
+func RunLeafNode(t TB, urls ...*url.URL) *server.Server {
+	t.Helper()
+	o := DefaultOptions()
+	o.LeafNode.Remotes = []*server.RemoteLeafOpts{{URLs: urls}}
+	s := RunServer(t, o)
+	WaitFor(t, defaultWait, func() error {
+		if n := s.NumLeafNodes(); n != 1 {
+			return fmt.Errorf("leaf node %q has %d connections, expected 1", s.ID(), n)
+		}
+		return nil
+	})
+	return s
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package servertest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestRunCluster(t *testing.T) {
+	c := RunCluster(t, "A", 3)
+	defer c.Shutdown()
+
+	nc, err := nats.Connect(c.Servers[0].ClientURL())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	sub, _ := nc.SubscribeSync("foo")
+	nc.Flush()
+
+	c.RestartServer(2)
+	nc2, err := nats.Connect(c.Servers[2].ClientURL())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc2.Close()
+	WaitFor(t, 2*time.Second, func() error {
+		if n := c.Servers[2].NumSubscriptions(); n == 0 {
+			return fmt.Errorf("no subscription propagated yet")
+		}
+		return nil
+	})
+	nc2.Publish("foo", []byte("hello"))
+	if _, err := sub.NextMsg(2 * time.Second); err != nil {
+		t.Fatalf("Did not receive message: %v", err)
+	}
+}
+
+func TestRunSuperCluster(t *testing.T) {
+	sc := RunSuperCluster(t, 2, 2)
+	defer sc.Shutdown()
+
+	if c := sc.ClusterForName("C2"); c == nil || len(c.Servers) != 2 {
+		t.Fatalf("Unexpected cluster: %+v", c)
+	}
+}
+
+func TestLeafNodeThroughProxy(t *testing.T) {
+	hubOpts := HubOptions()
+	hub := RunServer(t, hubOpts)
+	defer hub.Shutdown()
+
+	p := NewProxy(t, LeafNodeURL(hubOpts).Host)
+	defer p.Close()
+
+	leaf := RunLeafNode(t, p.URL("nats-leaf"))
+	defer leaf.Shutdown()
+
+	p.Pause()
+	WaitFor(t, 2*time.Second, func() error {
+		if n := hub.NumLeafNodes(); n != 0 {
+			return fmt.Errorf("hub still has %d leaf nodes", n)
+		}
+		return nil
+	})
+	p.Resume()
+	WaitFor(t, 5*time.Second, func() error {
+		if n := hub.NumLeafNodes(); n != 1 {
+			return fmt.Errorf("hub has %d leaf nodes", n)
+		}
+		return nil
+	})
+}
+
+func TestRunServerDefaults(t *testing.T) {
+	s := RunServer(t, nil)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+}
@@ -72,9 +72,10 @@ func (w *winServiceWrapper) Execute(args []string, changes <-chan svc.ChangeRequ
 		return false, 1
 	}
 
+	accepts := svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange | svc.AcceptPauseAndContinue | acceptReopenLog
 	status <- svc.Status{
 		State:   svc.Running,
-		Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange | acceptReopenLog,
+		Accepts: accepts,
 	}
 
 loop:
@@ -82,9 +83,22 @@ loop:
 		switch change.Cmd {
 		case svc.Interrogate:
 			status <- change.CurrentStatus
-		case svc.Stop, svc.Shutdown:
+		case svc.Stop:
+			// Drain connections in lame duck mode before stopping,
+			// keeping the service control manager updated on progress.
+			w.drain(status)
+			break loop
+		case svc.Shutdown:
+			// The system is shutting down, there is no time to drain.
 			w.server.Shutdown()
 			break loop
+		case svc.Pause:
+			// Stop accepting new connections, keeping existing ones.
+			w.server.MaintenanceMode(&MaintenanceOptions{Enter: true})
+			status <- svc.Status{State: svc.Paused, Accepts: accepts}
+		case svc.Continue:
+			w.server.MaintenanceMode(&MaintenanceOptions{Exit: true})
+			status <- svc.Status{State: svc.Running, Accepts: accepts}
 		case reopenLogCmd:
 			// File log re-open for rotating file logs.
 			w.server.ReOpenLogFile()
@@ -103,6 +117,27 @@ loop:
 	return false, 0
 }
 
+// drain has the server enter lame duck mode, which shuts it down once
+// connections are closed, while reporting the stop as pending.
+func (w *winServiceWrapper) drain(status chan<- svc.Status) {
+	done := make(chan struct{})
+	go func() {
+		w.server.lameDuckMode()
+		w.server.Shutdown()
+		close(done)
+	}()
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for checkPoint := uint32(1); ; checkPoint++ {
+		status <- svc.Status{State: svc.StopPending, CheckPoint: checkPoint, WaitHint: 2000}
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+	}
+}
+
 // Run starts the NATS server as a Windows service.
 func Run(server *Server) error {
 	if dockerized {
@@ -0,0 +1,300 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// With service_graph enabled, the server counts the requests its
+// connections publish to the services exported by each account, by
+// importing account and user, and computes their rates at each interval.
+// The resulting graph is returned by the /servicez monitoring endpoint and
+// the SERVICEZ system request, for architecture and capacity reviews. Each
+// server observes the requests of its own connections.
+
+const (
+	// Default interval the rates of the service graph are computed at.
+	serviceGraphDefaultInterval = time.Minute
+	// Maximum number of edges of the service graph of an account.
+	maxServiceGraphEdges = 10000
+	// Number of intervals without requests after which an edge is removed.
+	serviceGraphIdleIntervals = 60
+)
+
+// ServiceGraphOpts enable the observation of the service graph.
+type ServiceGraphOpts struct {
+	Enabled bool
+	// Interval the rates are computed at. Defaults to one minute.
+	Interval time.Duration
+}
+
+func (o *ServiceGraphOpts) interval() time.Duration {
+	if o.Interval > 0 {
+		return o.Interval
+	}
+	return serviceGraphDefaultInterval
+}
+
+func validateServiceGraphOptions(o *Options) error {
+	if o.ServiceGraph.Interval < 0 {
+		return errors.New("service_graph interval can not be negative")
+	}
+	return nil
+}
+
+// ServicezOptions are the options passed to Servicez.
+type ServicezOptions struct {
+	// Account filters the graph to the services of this account.
+	Account string `json:"account"`
+}
+
+// Servicez is the service graph observed by the server.
+type Servicez struct {
+	ID       string                 `json:"server_id"`
+	Now      time.Time              `json:"now"`
+	Interval time.Duration          `json:"interval"`
+	Accounts []*AccountServiceGraph `json:"accounts"`
+}
+
+// AccountServiceGraph are the requests to the services of an account.
+type AccountServiceGraph struct {
+	Account string         `json:"account"`
+	Edges   []*ServiceEdge `json:"edges"`
+}
+
+// ServiceEdge are the requests of a user of an account to a service.
+type ServiceEdge struct {
+	Account  string    `json:"account"`
+	User     string    `json:"user,omitempty"`
+	Kind     string    `json:"kind"`
+	Service  string    `json:"service"`
+	Requests uint64    `json:"requests"`
+	Rate     float64   `json:"rate"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type serviceEdgeKey struct {
+	account string
+	user    string
+	kind    string
+	service string
+}
+
+type serviceEdge struct {
+	requests uint64
+	// Requests at the last interval, and their rate over it.
+	prev uint64
+	rate float64
+	last time.Time
+	idle int
+}
+
+// serviceGraph are the requests to the services of an account.
+type serviceGraph struct {
+	mu    sync.Mutex
+	edges map[serviceEdgeKey]*serviceEdge
+	// Last time the rates were computed.
+	updated time.Time
+}
+
+// serviceGraph returns the service graph of the account, creating it if
+// requested.
+func (a *Account) serviceGraph(create bool) *serviceGraph {
+	a.mu.RLock()
+	sg := a.svcGraph
+	a.mu.RUnlock()
+	if sg != nil || !create {
+		return sg
+	}
+	a.mu.Lock()
+	if a.svcGraph == nil {
+		a.svcGraph = &serviceGraph{edges: make(map[serviceEdgeKey]*serviceEdge), updated: time.Now()}
+	}
+	sg = a.svcGraph
+	a.mu.Unlock()
+	return sg
+}
+
+// recordServiceRequest counts the request of the client, in its account
+// acc, to the service imported with si.
+func (c *client) recordServiceRequest(acc *Account, si *serviceImport) {
+	key := serviceEdgeKey{account: acc.Name, kind: c.typeString(), service: si.to}
+	if c.kind == CLIENT {
+		key.user = c.opts.Username
+		if c.opts.Nkey != _EMPTY_ {
+			key.user = c.opts.Nkey
+		} else if c.opts.JWT != _EMPTY_ {
+			key.user = c.pubKey
+		}
+	}
+	sg := si.acc.serviceGraph(true)
+	sg.mu.Lock()
+	e := sg.edges[key]
+	if e == nil {
+		if len(sg.edges) >= maxServiceGraphEdges {
+			sg.mu.Unlock()
+			return
+		}
+		e = &serviceEdge{}
+		sg.edges[key] = e
+	}
+	e.requests++
+	e.last = time.Now()
+	e.idle = 0
+	sg.mu.Unlock()
+}
+
+// update computes the rates of the edges, and removes idle ones.
+func (sg *serviceGraph) update(now time.Time) {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	elapsed := now.Sub(sg.updated).Seconds()
+	sg.updated = now
+	for k, e := range sg.edges {
+		if e.requests == e.prev {
+			if e.idle++; e.idle >= serviceGraphIdleIntervals {
+				delete(sg.edges, k)
+				continue
+			}
+		}
+		if elapsed > 0 {
+			e.rate = float64(e.requests-e.prev) / elapsed
+		}
+		e.prev = e.requests
+	}
+}
+
+// startServiceGraphUpdates will periodically compute the rates of the
+// service graphs, if enabled.
+func (s *Server) startServiceGraphUpdates() {
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		opts := s.getOpts().ServiceGraph
+		t := time.NewTimer(opts.interval())
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				opts = s.getOpts().ServiceGraph
+				if opts.Enabled {
+					s.updateServiceGraphs()
+				}
+				t.Reset(opts.interval())
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+func (s *Server) updateServiceGraphs() {
+	now := time.Now()
+	s.accounts.Range(func(k, v interface{}) bool {
+		if sg := v.(*Account).serviceGraph(false); sg != nil {
+			sg.update(now)
+		}
+		return true
+	})
+}
+
+// Servicez returns the service graph observed by the server.
+func (s *Server) Servicez(opts *ServicezOptions) (*Servicez, error) {
+	if opts == nil {
+		opts = &ServicezOptions{}
+	}
+	sgo := s.getOpts().ServiceGraph
+	if !sgo.Enabled {
+		return nil, errors.New("service graph not enabled")
+	}
+	var accs []*Account
+	if opts.Account != _EMPTY_ {
+		acc, err := s.lookupAccount(opts.Account)
+		if err != nil {
+			return nil, fmt.Errorf("account %q not found", opts.Account)
+		}
+		accs = append(accs, acc)
+	} else {
+		s.accounts.Range(func(k, v interface{}) bool {
+			accs = append(accs, v.(*Account))
+			return true
+		})
+	}
+
+	sz := &Servicez{ID: s.ID(), Now: time.Now().UTC(), Interval: sgo.interval(), Accounts: []*AccountServiceGraph{}}
+	for _, acc := range accs {
+		sg := acc.serviceGraph(false)
+		if sg == nil {
+			continue
+		}
+		ag := &AccountServiceGraph{Account: acc.GetName()}
+		sg.mu.Lock()
+		for k, e := range sg.edges {
+			ag.Edges = append(ag.Edges, &ServiceEdge{
+				Account:  k.account,
+				User:     k.user,
+				Kind:     k.kind,
+				Service:  k.service,
+				Requests: e.requests,
+				Rate:     e.rate,
+				LastSeen: e.last.UTC(),
+			})
+		}
+		sg.mu.Unlock()
+		if len(ag.Edges) == 0 {
+			continue
+		}
+		sort.Slice(ag.Edges, func(i, j int) bool {
+			ei, ej := ag.Edges[i], ag.Edges[j]
+			if ei.Service != ej.Service {
+				return ei.Service < ej.Service
+			}
+			if ei.Account != ej.Account {
+				return ei.Account < ej.Account
+			}
+			return ei.User < ej.User
+		})
+		sz.Accounts = append(sz.Accounts, ag)
+	}
+	sort.Slice(sz.Accounts, func(i, j int) bool { return sz.Accounts[i].Account < sz.Accounts[j].Account })
+	return sz, nil
+}
+
+// HandleServicez processes HTTP requests for the service graph.
+func (s *Server) HandleServicez(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[ServicezPath]++
+	s.mu.Unlock()
+
+	sz, err := s.Servicez(&ServicezOptions{Account: r.URL.Query().Get("acc")})
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	b, err := json.MarshalIndent(sz, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /servicez request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestServiceGraph(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		http: "127.0.0.1:-1"
+		service_graph { interval: "100ms" }
+		accounts {
+			A: {
+				users: [{user: a, password: pwd}]
+				exports: [{service: "svc.echo"}]
+			}
+			B: {
+				users: [{user: b, password: pwd}]
+				imports: [{service: {account: A, subject: "svc.echo"}}]
+			}
+			SYS: { users: [{user: sys, password: pwd}] }
+		}
+		system_account: SYS
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nca := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"))
+	defer nca.Close()
+	natsSub(t, nca, "svc.echo", func(m *nats.Msg) { m.Respond([]byte("ok")) })
+	natsFlush(t, nca)
+
+	ncb := natsConnect(t, s.ClientURL(), nats.UserInfo("b", "pwd"))
+	defer ncb.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := ncb.Request("svc.echo", nil, time.Second); err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+	}
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		sz, err := s.Servicez(&ServicezOptions{Account: "A"})
+		if err != nil {
+			t.Fatalf("Error getting service graph: %v", err)
+		}
+		if len(sz.Accounts) != 1 || sz.Accounts[0].Account != "A" || len(sz.Accounts[0].Edges) != 1 {
+			return fmt.Errorf("unexpected service graph: %+v", sz.Accounts)
+		}
+		e := sz.Accounts[0].Edges[0]
+		if e.Account != "B" || e.User != "b" || e.Kind != "Client" || e.Service != "svc.echo" || e.Requests != 10 {
+			t.Fatalf("Unexpected edge: %+v", e)
+		}
+		if e.Rate <= 0 {
+			return fmt.Errorf("rate not computed yet")
+		}
+		return nil
+	})
+	// The rate goes back to 0 without requests.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		sz, _ := s.Servicez(nil)
+		if len(sz.Accounts) != 1 {
+			t.Fatalf("Unexpected service graph: %+v", sz.Accounts)
+		}
+		if e := sz.Accounts[0].Edges[0]; e.Rate != 0 {
+			return fmt.Errorf("unexpected rate %v", e.Rate)
+		}
+		return nil
+	})
+
+	var sz Servicez
+	url := fmt.Sprintf("http://127.0.0.1:%d/servicez?acc=A", s.MonitorAddr().Port)
+	if err := json.Unmarshal(readBody(t, url), &sz); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if len(sz.Accounts) != 1 || sz.Accounts[0].Edges[0].Requests != 10 {
+		t.Fatalf("Unexpected service graph: %+v", sz.Accounts)
+	}
+	readBodyEx(t, fmt.Sprintf("http://127.0.0.1:%d/servicez?acc=X", s.MonitorAddr().Port), 400, "text/plain; charset=utf-8")
+
+	ncs := natsConnect(t, s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer ncs.Close()
+	msg, err := ncs.Request("$SYS.REQ.SERVER.PING.SERVICEZ", []byte(`{"account":"A"}`), time.Second)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	var resp struct {
+		Data *Servicez `json:"data"`
+	}
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if resp.Data == nil || len(resp.Data.Accounts) != 1 || resp.Data.Accounts[0].Edges[0].User != "b" {
+		t.Fatalf("Unexpected response: %s", msg.Data)
+	}
+}
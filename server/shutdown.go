@@ -0,0 +1,247 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ShutdownPhase identifies a phase of a graceful shutdown.
+type ShutdownPhase int
+
+const (
+	// ShutdownListeners stops accepting new client connections and notifies
+	// clients and routes that this server is going away.
+	ShutdownListeners ShutdownPhase = iota
+	// ShutdownClients flushes pending data to clients and closes them.
+	ShutdownClients
+	// ShutdownRoutes flushes pending data to routes, gateways and leaf nodes.
+	ShutdownRoutes
+	// ShutdownJetStream stops JetStream, closing all streams and stores.
+	ShutdownJetStream
+)
+
+// String returns the name of the phase.
+func (p ShutdownPhase) String() string {
+	switch p {
+	case ShutdownListeners:
+		return "Listeners"
+	case ShutdownClients:
+		return "Clients"
+	case ShutdownRoutes:
+		return "Routes"
+	case ShutdownJetStream:
+		return "JetStream"
+	default:
+		return "Unknown Phase"
+	}
+}
+
+// ShutdownProgress is reported at the start and end of each shutdown phase.
+type ShutdownProgress struct {
+	Phase ShutdownPhase
+	Done  bool
+	// Elapsed is the time spent in the phase, set when done.
+	Elapsed time.Duration
+	// Err is set when done if the phase did not complete in time.
+	Err error
+}
+
+// ShutdownOptions control a graceful shutdown.
+type ShutdownOptions struct {
+	// PhaseTimeouts bounds the duration of individual phases. A phase
+	// without timeout is only bounded by the context given to the shutdown.
+	PhaseTimeouts map[ShutdownPhase]time.Duration
+	// Progress, if set, is invoked at the start and end of each phase.
+	Progress func(p ShutdownProgress)
+}
+
+// How often we check if connections are gone.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// ShutdownContext gracefully shuts down the server. See ShutdownWithOptions.
+func (s *Server) ShutdownContext(ctx context.Context) error {
+	return s.ShutdownWithOptions(ctx, nil)
+}
+
+// ShutdownWithOptions gracefully shuts down the server in ordered phases:
+// stop accepting clients, drain clients, flush routes and close JetStream.
+// A phase that does not complete in time is abandoned and the shutdown moves
+// on to the next one. The server is always fully shutdown when this returns.
+// The returned error is the first phase error, if any.
+func (s *Server) ShutdownWithOptions(ctx context.Context, sopts *ShutdownOptions) error {
+	if sopts == nil {
+		sopts = &ShutdownOptions{}
+	}
+	phases := []struct {
+		phase ShutdownPhase
+		run   func(ctx context.Context) error
+	}{
+		{ShutdownListeners, s.shutdownListeners},
+		{ShutdownClients, s.shutdownClients},
+		{ShutdownRoutes, s.shutdownFlushRoutes},
+		{ShutdownJetStream, s.shutdownJetStreamContext},
+	}
+
+	var firstErr error
+	for _, p := range phases {
+		if !s.isRunning() {
+			break
+		}
+		if sopts.Progress != nil {
+			sopts.Progress(ShutdownProgress{Phase: p.phase})
+		}
+		var pctx context.Context
+		var cancel context.CancelFunc
+		if to := sopts.PhaseTimeouts[p.phase]; to > 0 {
+			pctx, cancel = context.WithTimeout(ctx, to)
+		} else {
+			pctx, cancel = context.WithCancel(ctx)
+		}
+		start := time.Now()
+		err := p.run(pctx)
+		cancel()
+		if err != nil {
+			err = fmt.Errorf("shutdown phase %s: %v", p.phase, err)
+			s.Warnf("Graceful shutdown: %v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if sopts.Progress != nil {
+			sopts.Progress(ShutdownProgress{Phase: p.phase, Done: true, Elapsed: time.Since(start), Err: err})
+		}
+	}
+	s.Shutdown()
+	return firstErr
+}
+
+// Stops accepting client connections, similar to entering lame duck mode.
+func (s *Server) shutdownListeners(ctx context.Context) error {
+	s.mu.Lock()
+	if s.shutdown || s.ldm || s.listener == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.Noticef("Graceful shutdown, stop accepting new clients")
+	s.ldm = true
+	expected := 1
+	s.listener.Close()
+	s.listener = nil
+	if s.websocket.server != nil {
+		expected++
+		s.websocket.server.Close()
+		s.websocket.server = nil
+		s.websocket.listener = nil
+	}
+	s.ldmCh = make(chan bool, expected)
+	ldmCh := s.ldmCh
+	s.mu.Unlock()
+
+	// Wait for accept loops to be done to make sure that no new
+	// client can connect.
+	for i := 0; i < expected; i++ {
+		select {
+		case <-ldmCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.mu.Lock()
+	s.sendLDMToRoutes()
+	s.sendLDMToClients()
+	s.mu.Unlock()
+	return nil
+}
+
+// Flushes and closes all client connections, waiting for them to be gone.
+// Once the context is done, the remaining clients are closed without first
+// flushing what is pending for them.
+func (s *Server) shutdownClients(ctx context.Context) error {
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		if ctx.Err() == nil {
+			c.mu.Lock()
+			if !c.isClosed() {
+				c.flushOutbound()
+			}
+			c.mu.Unlock()
+		} else {
+			c.mu.Lock()
+			c.flags.set(skipFlushOnClose)
+			c.mu.Unlock()
+		}
+		c.closeConnection(ServerShutdown)
+	}
+	for {
+		s.mu.Lock()
+		n := len(s.clients)
+		s.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d client connections still open: %v", n, ctx.Err())
+		case <-time.After(shutdownPollInterval):
+		}
+	}
+}
+
+// Flushes pending data to routes, gateways and leaf nodes.
+func (s *Server) shutdownFlushRoutes(ctx context.Context) error {
+	conns := make(map[uint64]*client)
+	s.mu.Lock()
+	for i, r := range s.routes {
+		conns[i] = r
+	}
+	s.getAllGatewayConnections(conns)
+	for i, l := range s.leafs {
+		conns[i] = l
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.mu.Lock()
+		c.flushOutbound()
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// Shuts down JetStream, giving up waiting when the context is done.
+func (s *Server) shutdownJetStreamContext(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.shutdownJetStream()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestShutdownContextPhases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shutdown")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.Cluster.Port = 0
+	opts.JetStream = true
+	opts.StoreDir = dir
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "foo", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	closedCh := make(chan struct{}, 1)
+	nc := natsConnect(t, s.ClientURL(), nats.NoReconnect(), nats.ClosedHandler(func(*nats.Conn) {
+		closedCh <- struct{}{}
+	}))
+	defer nc.Close()
+
+	var progress []ShutdownProgress
+	err = s.ShutdownWithOptions(context.Background(), &ShutdownOptions{
+		PhaseTimeouts: map[ShutdownPhase]time.Duration{ShutdownClients: 2 * time.Second},
+		Progress:      func(p ShutdownProgress) { progress = append(progress, p) },
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error on shutdown: %v", err)
+	}
+	select {
+	case <-closedCh:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Client connection was not closed")
+	}
+	expected := []ShutdownPhase{ShutdownListeners, ShutdownClients, ShutdownRoutes, ShutdownJetStream}
+	if len(progress) != 2*len(expected) {
+		t.Fatalf("Unexpected progress reports: %+v", progress)
+	}
+	for i, phase := range expected {
+		if start, end := progress[2*i], progress[2*i+1]; start.Phase != phase || start.Done || end.Phase != phase || !end.Done || end.Err != nil {
+			t.Fatalf("Unexpected progress reports for phase %v: %+v %+v", phase, start, end)
+		}
+	}
+	if _, err := mset.Publish("foo", nil, []byte("hello")); err == nil {
+		t.Fatal("Expected stream to be closed")
+	}
+	if s.isRunning() {
+		t.Fatal("Server should not be running")
+	}
+}
+
+func TestShutdownContextPhaseTimeout(t *testing.T) {
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Phases give up right away but the server still shuts down.
+	if err := s.ShutdownContext(ctx); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if s.isRunning() {
+		t.Fatal("Server should not be running")
+	}
+}
+
+func TestShutdownContextJetStreamTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shutdown")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.Cluster.Port = 0
+	opts.JetStream = true
+	opts.StoreDir = dir
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	for _, name := range []string{"foo", "bar", "baz"} {
+		if _, err := s.GlobalAccount().AddStream(&StreamConfig{Name: name, Storage: FileStorage}); err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+	}
+
+	// The JetStream phase gives up right away, while the shutdown that
+	// follows must not stop JetStream a second time.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.ShutdownContext(ctx); err == nil {
+		t.Fatal("Expected an error")
+	}
+	s.Shutdown()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if s.JetStreamEnabled() {
+			return fmt.Errorf("JetStream still enabled")
+		}
+		return nil
+	})
+}
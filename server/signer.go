@@ -0,0 +1,101 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nkeys"
+)
+
+// The nkeys of the server can be held by an external signer, such as a
+// PKCS#11 device or a cloud KMS, so that their seeds never exist on disk.
+// Applications embedding the server set signers in the options: for the
+// identity of the server, whose public key is then the server ID and which
+// signs the JetStream usage records, instead of the seeds of the nkeys
+// routes and gateways authenticate with, and for the users of the
+// credentials of leafnode remotes, whose files then only hold the user JWT.
+// Signers can not be set in the configuration file and are kept on reload.
+
+// Signer signs with an nkey whose seed is held outside of the server.
+// An nkeys.KeyPair is a Signer.
+type Signer interface {
+	// PublicKey returns the public nkey of the signer.
+	PublicKey() (string, error)
+	// Sign returns the signature of the input.
+	Sign(input []byte) ([]byte, error)
+}
+
+// validateSigner checks that the public key of the signer is of the kind
+// returned valid by isValid.
+func validateSigner(kind string, signer Signer, isValid func(string) bool) error {
+	pub, err := signer.PublicKey()
+	if err != nil {
+		return fmt.Errorf("%s signer public key: %v", kind, err)
+	}
+	if !isValid(pub) {
+		return fmt.Errorf("%s signer public key %q is not of the expected type", kind, pub)
+	}
+	return nil
+}
+
+func validateSigners(o *Options) error {
+	if o.Signer != nil {
+		if err := validateSigner("server", o.Signer, nkeys.IsValidPublicServerKey); err != nil {
+			return err
+		}
+	}
+	if o.Cluster.Signer != nil {
+		if o.Cluster.NkeySeed != _EMPTY_ {
+			return fmt.Errorf("cluster can not have both an nkey seed and a signer")
+		}
+		if err := validateSigner("cluster", o.Cluster.Signer, nkeys.IsValidPublicServerKey); err != nil {
+			return err
+		}
+	}
+	if o.Gateway.Signer != nil {
+		if o.Gateway.NkeySeed != _EMPTY_ {
+			return fmt.Errorf("gateway can not have both an nkey seed and a signer")
+		}
+		if err := validateSigner("gateway", o.Gateway.Signer, nkeys.IsValidPublicServerKey); err != nil {
+			return err
+		}
+	}
+	for _, r := range o.LeafNode.Remotes {
+		if r.Signer == nil {
+			continue
+		}
+		if r.Credentials == _EMPTY_ {
+			return fmt.Errorf("leafnode remote signer requires a credentials file with the user JWT")
+		}
+		if err := validateSigner("leafnode remote", r.Signer, nkeys.IsValidPublicUserKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepSigners sets the signers of the current options, which can not be
+// configured in the configuration file, in the reloaded ones.
+func keepSigners(curOpts, newOpts *Options) {
+	newOpts.Signer = curOpts.Signer
+	newOpts.Cluster.Signer = curOpts.Cluster.Signer
+	newOpts.Gateway.Signer = curOpts.Gateway.Signer
+	// Leafnode remotes can not be changed on reload.
+	if len(newOpts.LeafNode.Remotes) == len(curOpts.LeafNode.Remotes) {
+		for i, r := range newOpts.LeafNode.Remotes {
+			r.Signer = curOpts.LeafNode.Remotes[i].Signer
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+)
+
+// countingSigner counts the signatures of its key pair.
+type countingSigner struct {
+	nkeys.KeyPair
+	signed int32
+}
+
+func (cs *countingSigner) Sign(input []byte) ([]byte, error) {
+	atomic.AddInt32(&cs.signed, 1)
+	return cs.KeyPair.Sign(input)
+}
+
+func TestSigner(t *testing.T) {
+	newSigner := func(create func() (nkeys.KeyPair, error)) (*countingSigner, string) {
+		t.Helper()
+		kp, err := create()
+		if err != nil {
+			t.Fatalf("Error creating key: %v", err)
+		}
+		pub, _ := kp.PublicKey()
+		return &countingSigner{KeyPair: kp}, pub
+	}
+	signerA, pubA := newSigner(nkeys.CreateServer)
+	signerB, pubB := newSigner(nkeys.CreateServer)
+
+	optsA := DefaultOptions()
+	optsA.Signer = signerA
+	optsA.Cluster.Signer = signerA
+	optsA.Cluster.Nkeys = []string{pubB}
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	if srvA.ID() != pubA {
+		t.Fatalf("Expected server ID to be the signer key %q, got %q", pubA, srvA.ID())
+	}
+
+	optsB := DefaultOptions()
+	optsB.Cluster.Signer = signerB
+	optsB.Cluster.Nkeys = []string{pubA}
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", optsA.Cluster.Port))
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+
+	checkClusterFormed(t, srvA, srvB)
+	// The soliciting server signed the nonce of the other one.
+	if atomic.LoadInt32(&signerB.signed) == 0 {
+		t.Fatalf("Expected the signer to sign the route nonce")
+	}
+
+	userSigner, _ := newSigner(nkeys.CreateUser)
+	seedB, _ := signerB.Seed()
+	for _, test := range []struct {
+		name string
+		set  func(o *Options)
+		err  string
+	}{
+		{"server user key", func(o *Options) { o.Signer = userSigner }, "server signer"},
+		{"cluster seed and signer", func(o *Options) {
+			o.Cluster.NkeySeed = string(seedB)
+			o.Cluster.Signer = signerB
+		}, "both"},
+		{"gateway user key", func(o *Options) { o.Gateway.Signer = userSigner }, "gateway signer"},
+		{"leafnode without credentials", func(o *Options) {
+			o.LeafNode.Remotes = []*RemoteLeafOpts{{Signer: userSigner}}
+		}, "credentials"},
+		{"leafnode server key", func(o *Options) {
+			o.LeafNode.Remotes = []*RemoteLeafOpts{{Credentials: "user.creds", Signer: signerB}}
+		}, "leafnode remote signer"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			o := DefaultOptions()
+			test.set(o)
+			if err := validateSigners(o); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
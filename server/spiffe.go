@@ -0,0 +1,133 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// With verify_and_map, workloads presenting a SPIFFE X.509 SVID, as issued
+// by SPIRE, can be mapped by their SPIFFE ID to an account and permissions,
+// without credentials of their own. The SPIFFE ID is the single URI SAN of
+// the certificate, of the form spiffe://trust-domain/path, and is used as
+// the name of the user. The first mapping matching the SPIFFE ID is used.
+
+const spiffeScheme = "spiffe://"
+
+// SPIFFEMapping maps workloads with a SPIFFE ID matching the pattern, a '*'
+// matching any characters, to an account and permissions.
+type SPIFFEMapping struct {
+	IDPattern   string
+	Account     string
+	Permissions *Permissions
+}
+
+// spiffeID returns the SPIFFE ID of the certificate, if it is an SVID.
+func spiffeID(cert *x509.Certificate) (string, error) {
+	if len(cert.URIs) != 1 {
+		return _EMPTY_, fmt.Errorf("svid must have exactly one uri san, got %d", len(cert.URIs))
+	}
+	if cert.IsCA {
+		return _EMPTY_, fmt.Errorf("svid can not be a ca certificate")
+	}
+	u := cert.URIs[0]
+	if u.Scheme != "spiffe" {
+		return _EMPTY_, fmt.Errorf("uri san %q is not a spiffe id", u)
+	}
+	if u.User != nil || u.Port() != _EMPTY_ || u.RawQuery != _EMPTY_ || u.Fragment != _EMPTY_ {
+		return _EMPTY_, fmt.Errorf("spiffe id %q can not have user info, port, query or fragment", u)
+	}
+	if err := validateSPIFFETrustDomain(u.Host); err != nil {
+		return _EMPTY_, err
+	}
+	if strings.HasSuffix(u.Path, "/") {
+		return _EMPTY_, fmt.Errorf("spiffe id %q can not have a trailing slash", u)
+	}
+	return u.String(), nil
+}
+
+// validateSPIFFETrustDomain checks that the trust domain is not empty and
+// only has lowercase letters, digits, dots, dashes and underscores.
+func validateSPIFFETrustDomain(td string) error {
+	if td == _EMPTY_ {
+		return fmt.Errorf("spiffe id requires a trust domain")
+	}
+	for _, r := range td {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+			return fmt.Errorf("invalid spiffe trust domain %q", td)
+		}
+	}
+	return nil
+}
+
+func validateSPIFFEMappings(o *Options) error {
+	if len(o.SPIFFEMappings) == 0 {
+		return nil
+	}
+	if !o.TLSMap && !o.Websocket.TLSMap {
+		return fmt.Errorf("spiffe mappings require verify_and_map")
+	}
+	for _, m := range o.SPIFFEMappings {
+		if !strings.HasPrefix(m.IDPattern, spiffeScheme) {
+			return fmt.Errorf("spiffe mapping to %q requires an id starting with %q", m.Account, spiffeScheme)
+		}
+		td := strings.SplitN(strings.TrimPrefix(m.IDPattern, spiffeScheme), "/", 2)[0]
+		if !strings.Contains(td, "*") {
+			if err := validateSPIFFETrustDomain(td); err != nil {
+				return err
+			}
+		}
+		found := false
+		for _, acc := range o.Accounts {
+			if acc.Name == m.Account {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("spiffe mapping to unknown account %q", m.Account)
+		}
+	}
+	return nil
+}
+
+// spiffeUser returns a user of the account the SPIFFE ID of the certificate
+// maps to, or nil if the certificate is not an SVID or none does.
+// Server lock is held on entry.
+func (s *Server) spiffeUser(c *client, mappings []*SPIFFEMapping, cert *x509.Certificate) *User {
+	id, err := spiffeID(cert)
+	if err != nil {
+		c.Debugf("Certificate is not a valid SVID: %v", err)
+		return nil
+	}
+	for _, m := range mappings {
+		if !wildcardMatch(m.IDPattern, id) {
+			continue
+		}
+		v, ok := s.accounts.Load(m.Account)
+		if !ok {
+			return nil
+		}
+		user := &User{Username: id, Account: v.(*Account)}
+		if m.Permissions != nil {
+			user.Permissions = m.Permissions.clone()
+			validateResponsePermissions(user.Permissions)
+		}
+		return user
+	}
+	c.Debugf("SPIFFE ID [%q] not mapped", id)
+	return nil
+}
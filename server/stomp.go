@@ -0,0 +1,753 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// STOMP 1.2 clients connect on their own listener and are authenticated
+// with the login and passcode of a user, whose account and permissions are
+// used. Destinations are subjects, optionally prefixed with /topic/ or
+// /queue/ and with '/' as the separator, subscriptions to /queue/ ones
+// being in a queue group named after the destination. Custom headers are
+// carried as message headers, and sends in a transaction are published
+// when it is committed. Messages are delivered at most once, ACK and NACK
+// frames are accepted but have no effect.
+
+const (
+	stompTopicPrefix = "/topic/"
+	stompQueuePrefix = "/queue/"
+
+	// Maximum size of the command and of each header line of a frame.
+	stompMaxLineSize = 64 * 1024
+)
+
+var (
+	errStompFrameTooLarge = errors.New("frame too large")
+	errStompSlowConsumer  = errors.New("slow consumer")
+)
+
+// Headers of frames that are not carried in messages.
+var stompFrameHeaders = map[string]struct{}{
+	"destination":    {},
+	"content-length": {},
+	"receipt":        {},
+	"transaction":    {},
+	"reply-to":       {},
+	"subscription":   {},
+	"message-id":     {},
+	"ack":            {},
+	"id":             {},
+}
+
+// StompOpts are options for the STOMP listener.
+type StompOpts struct {
+	// The server will accept STOMP client connections on this hostname/IP.
+	Host string
+	// The server will accept STOMP client connections on this port.
+	Port int
+	// If no login is provided when a client connects, will default to this
+	// user and associated account. This user has to exist in the global
+	// options.
+	NoAuthUser string
+	// TLS configuration is required for secure STOMP connections.
+	TLSConfig *tls.Config
+}
+
+func validateStompOptions(o *Options) error {
+	so := &o.Stomp
+	if so.NoAuthUser == _EMPTY_ {
+		return nil
+	}
+	if so.Port == 0 {
+		return fmt.Errorf("stomp no_auth_user %q requires a port", so.NoAuthUser)
+	}
+	for _, u := range o.Users {
+		if u.Username == so.NoAuthUser {
+			return nil
+		}
+	}
+	return fmt.Errorf("stomp no_auth_user %q not present as user in authorization block or account configuration",
+		so.NoAuthUser)
+}
+
+// srvStomp is the state of the STOMP listener.
+type srvStomp struct {
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[*stompConn]struct{}
+}
+
+// startStompListener listens for STOMP client connections.
+func (s *Server) startStompListener() {
+	o := s.getOpts().Stomp
+
+	port := o.Port
+	if port == -1 {
+		port = 0
+	}
+	hp := net.JoinHostPort(o.Host, strconv.Itoa(port))
+	l, err := net.Listen("tcp", hp)
+	if err != nil {
+		s.Fatalf("Unable to listen for STOMP connections: %v", err)
+		return
+	}
+	scheme := "stomp"
+	if o.TLSConfig != nil {
+		l = tls.NewListener(l, o.TLSConfig)
+		scheme = "stomp+ssl"
+	}
+	s.Noticef("Listening for STOMP clients on %s://%s", scheme, l.Addr())
+
+	s.mu.Lock()
+	s.stomp.listener = l
+	s.mu.Unlock()
+	s.stomp.mu.Lock()
+	s.stomp.conns = make(map[*stompConn]struct{})
+	s.stomp.mu.Unlock()
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		tmpDelay := ACCEPT_MIN_SLEEP
+		for s.isRunning() {
+			conn, err := l.Accept()
+			if err != nil {
+				if s.isLameDuckMode() {
+					// Signal that we are not accepting new clients
+					s.ldmCh <- true
+					// Now wait for the Shutdown...
+					<-s.quitCh
+					return
+				}
+				tmpDelay = s.acceptError("STOMP", err, tmpDelay)
+				continue
+			}
+			tmpDelay = ACCEPT_MIN_SLEEP
+			s.startGoRoutine(func() {
+				s.handleStompConn(conn)
+				s.grWG.Done()
+			})
+		}
+		s.done <- true
+	})
+}
+
+// StompAddr returns the address of the STOMP listener, or nil if not
+// listening.
+func (s *Server) StompAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stomp.listener == nil {
+		return nil
+	}
+	return s.stomp.listener.Addr()
+}
+
+// closeStompConns closes the connections of STOMP clients on shutdown.
+func (s *Server) closeStompConns() {
+	s.stomp.mu.Lock()
+	for sc := range s.stomp.conns {
+		sc.conn.Close()
+	}
+	s.stomp.mu.Unlock()
+}
+
+// stompFrame is a frame with its headers, the first value of repeated
+// headers being used.
+type stompFrame struct {
+	command string
+	headers map[string]string
+	order   []string
+	body    []byte
+}
+
+func (f *stompFrame) header(key string) string {
+	return f.headers[key]
+}
+
+func (f *stompFrame) setHeader(key, value string) {
+	if f.headers == nil {
+		f.headers = make(map[string]string)
+	}
+	if _, ok := f.headers[key]; !ok {
+		f.order = append(f.order, key)
+	}
+	f.headers[key] = value
+}
+
+// stompSub is a subscription of a STOMP client.
+type stompSub struct {
+	id     string
+	prefix string
+	ack    string
+	sub    *subscription
+}
+
+// stompConn is a connection of a STOMP client, using an internal client
+// registered with the account of its user.
+type stompConn struct {
+	srv  *Server
+	conn net.Conn
+	br   *bufio.Reader
+	c    *client
+	subs map[string]*stompSub
+	txs  map[string][]*stompFrame
+	sid  uint64
+	mid  uint64
+
+	// Frames are written by a dedicated go routine, so that deliveries
+	// do not block the publishers.
+	mu         sync.Mutex
+	out        bytes.Buffer
+	flushCh    chan struct{}
+	closed     bool
+	maxPending int
+}
+
+func (s *Server) handleStompConn(conn net.Conn) {
+	opts := s.getOpts()
+	sc := &stompConn{
+		srv:        s,
+		conn:       conn,
+		br:         bufio.NewReaderSize(conn, stompMaxLineSize),
+		subs:       make(map[string]*stompSub),
+		txs:        make(map[string][]*stompFrame),
+		flushCh:    make(chan struct{}, 1),
+		maxPending: int(opts.MaxPending),
+	}
+	s.stomp.mu.Lock()
+	if s.stomp.conns == nil {
+		s.stomp.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.stomp.conns[sc] = struct{}{}
+	s.stomp.mu.Unlock()
+
+	defer func() {
+		s.stomp.mu.Lock()
+		delete(s.stomp.conns, sc)
+		s.stomp.mu.Unlock()
+		sc.close()
+		if sc.c != nil {
+			sc.c.closeConnection(ClientClosed)
+		}
+	}()
+	s.Debugf("STOMP connection from %s", conn.RemoteAddr())
+
+	s.startGoRoutine(sc.writeLoop)
+	for {
+		f, err := sc.readFrame(int(opts.MaxPayload))
+		if err != nil {
+			if err != io.EOF && !sc.isClosed() {
+				sc.sendError(nil, err.Error())
+			}
+			return
+		}
+		if err := sc.processFrame(f); err != nil {
+			sc.sendError(f, err.Error())
+			return
+		}
+		if f.command == "DISCONNECT" {
+			return
+		}
+	}
+}
+
+func (sc *stompConn) isClosed() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.closed
+}
+
+// close has the pending frames flushed and the connection closed.
+func (sc *stompConn) close() {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.mu.Unlock()
+	sc.signalFlush()
+}
+
+func (sc *stompConn) signalFlush() {
+	select {
+	case sc.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+func (sc *stompConn) writeLoop() {
+	defer sc.srv.grWG.Done()
+	defer sc.conn.Close()
+
+	for {
+		select {
+		case <-sc.flushCh:
+		case <-sc.srv.quitCh:
+			return
+		}
+		sc.mu.Lock()
+		b := append([]byte(nil), sc.out.Bytes()...)
+		sc.out.Reset()
+		closed := sc.closed
+		sc.mu.Unlock()
+		if len(b) > 0 {
+			if _, err := sc.conn.Write(b); err != nil {
+				return
+			}
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// send queues the frame, and closes the connection if too many frames
+// are pending.
+func (sc *stompConn) send(f *stompFrame) {
+	sc.mu.Lock()
+	if sc.closed {
+		sc.mu.Unlock()
+		return
+	}
+	writeStompFrame(&sc.out, f)
+	slow := sc.maxPending > 0 && sc.out.Len() > sc.maxPending
+	sc.mu.Unlock()
+	if slow {
+		sc.srv.Noticef("STOMP connection from %s is a slow consumer", sc.conn.RemoteAddr())
+		sc.sendError(nil, errStompSlowConsumer.Error())
+		sc.close()
+		return
+	}
+	sc.signalFlush()
+}
+
+func (sc *stompConn) sendError(f *stompFrame, message string) {
+	e := &stompFrame{command: "ERROR"}
+	e.setHeader("message", message)
+	if f != nil && f.header("receipt") != _EMPTY_ {
+		e.setHeader("receipt-id", f.header("receipt"))
+	}
+	sc.mu.Lock()
+	if !sc.closed {
+		writeStompFrame(&sc.out, e)
+	}
+	sc.mu.Unlock()
+	sc.signalFlush()
+}
+
+func (sc *stompConn) processFrame(f *stompFrame) error {
+	if sc.c == nil && f.command != "CONNECT" && f.command != "STOMP" {
+		return fmt.Errorf("not connected")
+	}
+	var err error
+	switch f.command {
+	case "CONNECT", "STOMP":
+		err = sc.processConnect(f)
+	case "SEND":
+		if tx := f.header("transaction"); tx != _EMPTY_ {
+			if _, ok := sc.txs[tx]; !ok {
+				return fmt.Errorf("unknown transaction %q", tx)
+			}
+			sc.txs[tx] = append(sc.txs[tx], f)
+		} else {
+			err = sc.publish(f)
+		}
+	case "SUBSCRIBE":
+		err = sc.subscribe(f)
+	case "UNSUBSCRIBE":
+		err = sc.unsubscribe(f)
+	case "ACK", "NACK":
+		if f.header("id") == _EMPTY_ {
+			err = fmt.Errorf("missing id header")
+		}
+	case "BEGIN", "COMMIT", "ABORT":
+		err = sc.transaction(f)
+	case "DISCONNECT":
+	default:
+		err = fmt.Errorf("unknown command %q", f.command)
+	}
+	if err != nil {
+		return err
+	}
+	if receipt := f.header("receipt"); receipt != _EMPTY_ {
+		r := &stompFrame{command: "RECEIPT"}
+		r.setHeader("receipt-id", receipt)
+		sc.send(r)
+	}
+	return nil
+}
+
+func (sc *stompConn) processConnect(f *stompFrame) error {
+	if sc.c != nil {
+		return fmt.Errorf("already connected")
+	}
+	if versions := f.header("accept-version"); versions != _EMPTY_ {
+		supported := false
+		for _, v := range strings.Split(versions, ",") {
+			if v == "1.2" {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("supported protocol versions are 1.2")
+		}
+	}
+	acc, user, err := sc.srv.checkLogin(sc.conn.RemoteAddr(), f.header("login"), f.header("passcode"), sc.srv.getOpts().Stomp.NoAuthUser)
+	if err != nil {
+		sc.srv.Debugf("STOMP connection from %s not authorized: %v", sc.conn.RemoteAddr(), err)
+		return err
+	}
+	c := sc.srv.createInternalAccountClient()
+	c.echo = true
+	if err := sc.srv.registerLogin(c, acc, user); err != nil {
+		c.closeConnection(ClientClosed)
+		return err
+	}
+	sc.c = c
+
+	r := &stompFrame{command: "CONNECTED"}
+	r.setHeader("version", "1.2")
+	r.setHeader("heart-beat", "0,0")
+	r.setHeader("server", "nats-server/"+VERSION)
+	sc.send(r)
+	return nil
+}
+
+// stompSubject returns the subject of a destination and its prefix.
+func stompSubject(dest string) (string, string) {
+	for _, prefix := range []string{stompTopicPrefix, stompQueuePrefix} {
+		if strings.HasPrefix(dest, prefix) {
+			return strings.Replace(dest[len(prefix):], "/", ".", -1), prefix
+		}
+	}
+	return dest, _EMPTY_
+}
+
+// stompDestination returns the destination of a subject.
+func stompDestination(subject, prefix string) string {
+	if prefix == _EMPTY_ {
+		return subject
+	}
+	return prefix + strings.Replace(subject, ".", "/", -1)
+}
+
+func (sc *stompConn) publish(f *stompFrame) error {
+	subject, _ := stompSubject(f.header("destination"))
+	if !IsValidLiteralSubject(subject) {
+		return fmt.Errorf("invalid destination %q", f.header("destination"))
+	}
+	var reply string
+	if replyTo := f.header("reply-to"); replyTo != _EMPTY_ {
+		if reply, _ = stompSubject(replyTo); !IsValidLiteralSubject(reply) {
+			return fmt.Errorf("invalid reply-to %q", replyTo)
+		}
+	}
+
+	c := sc.c
+	c.mu.Lock()
+	allowed := c.perms == nil || c.pubAllowed(subject)
+	c.mu.Unlock()
+	if !allowed {
+		return fmt.Errorf("permissions violation for publish to %q", subject)
+	}
+
+	var hdr []byte
+	for _, k := range f.order {
+		if _, ok := stompFrameHeaders[k]; ok || strings.ContainsAny(k, " \r\n") {
+			continue
+		}
+		v := f.headers[k]
+		if strings.ContainsAny(v, "\r\n") {
+			continue
+		}
+		if hdr == nil {
+			hdr = []byte("NATS/1.0" + _CRLF_)
+		}
+		hdr = append(hdr, fmt.Sprintf("%s: %s%s", k, v, _CRLF_)...)
+	}
+
+	if hdr != nil {
+		hdr = append(hdr, _CRLF_...)
+	}
+	c.processInternalMsg(subject, reply, hdr, f.body)
+	return nil
+}
+
+func (sc *stompConn) subscribe(f *stompFrame) error {
+	id, dest := f.header("id"), f.header("destination")
+	if id == _EMPTY_ {
+		return fmt.Errorf("missing id header")
+	}
+	if _, ok := sc.subs[id]; ok {
+		return fmt.Errorf("subscription %q already exists", id)
+	}
+	subject, prefix := stompSubject(dest)
+	if !IsValidSubject(subject) {
+		return fmt.Errorf("invalid destination %q", dest)
+	}
+	ack := f.header("ack")
+	switch ack {
+	case _EMPTY_:
+		ack = "auto"
+	case "auto", "client", "client-individual":
+	default:
+		return fmt.Errorf("invalid ack mode %q", ack)
+	}
+
+	c := sc.c
+	queue := _EMPTY_
+	if prefix == stompQueuePrefix {
+		queue = subject
+	}
+	c.mu.Lock()
+	allowed := c.perms == nil
+	if !allowed && queue != _EMPTY_ {
+		allowed = c.canQueueSubscribe(subject, queue)
+	} else if !allowed {
+		allowed = c.canSubscribe(subject)
+	}
+	c.mu.Unlock()
+	if !allowed {
+		return fmt.Errorf("permissions violation for subscription to %q", subject)
+	}
+
+	ss := &stompSub{id: id, prefix: prefix, ack: ack}
+	sc.sid++
+	arg := fmt.Sprintf("%s %d", subject, sc.sid)
+	if queue != _EMPTY_ {
+		arg = fmt.Sprintf("%s %s %d", subject, queue, sc.sid)
+	}
+	sub, err := c.processSub([]byte(arg), false)
+	if err != nil {
+		return err
+	}
+	if sub == nil {
+		return ErrTooManySubs
+	}
+	sub.icb = func(_ *subscription, pc *client, subject, reply string, msg []byte) {
+		sc.deliver(ss, pc, subject, reply, msg)
+	}
+	ss.sub = sub
+	sc.subs[id] = ss
+	return nil
+}
+
+func (sc *stompConn) unsubscribe(f *stompFrame) error {
+	id := f.header("id")
+	ss := sc.subs[id]
+	if ss == nil {
+		return fmt.Errorf("unknown subscription %q", id)
+	}
+	delete(sc.subs, id)
+	return sc.c.processUnsub(ss.sub.sid)
+}
+
+// deliver sends the message received on the subscription as a MESSAGE
+// frame.
+func (sc *stompConn) deliver(ss *stompSub, pc *client, subject, reply string, msg []byte) {
+	// Internal account clients receive the message with the trailing CRLF.
+	msg = msg[:len(msg)-LEN_CR_LF]
+	var hdr []byte
+	if pc != nil && pc.pa.hdr > 0 && pc.pa.hdr <= len(msg) {
+		hdr, msg = msg[:pc.pa.hdr], msg[pc.pa.hdr:]
+	}
+	f := &stompFrame{command: "MESSAGE", body: msg}
+	f.setHeader("destination", stompDestination(subject, ss.prefix))
+	f.setHeader("message-id", strconv.FormatUint(atomic.AddUint64(&sc.mid, 1), 10))
+	f.setHeader("subscription", ss.id)
+	if ss.ack != "auto" {
+		f.setHeader("ack", f.header("message-id"))
+	}
+	if reply != _EMPTY_ {
+		f.setHeader("reply-to", stompDestination(reply, ss.prefix))
+	}
+	if len(hdr) > 0 {
+		for _, line := range bytes.Split(hdr, []byte(_CRLF_))[1:] {
+			i := bytes.IndexByte(line, ':')
+			if i <= 0 {
+				continue
+			}
+			k := string(line[:i])
+			if _, ok := stompFrameHeaders[strings.ToLower(k)]; ok {
+				continue
+			}
+			if _, ok := f.headers[k]; !ok {
+				f.setHeader(k, string(bytes.TrimSpace(line[i+1:])))
+			}
+		}
+	}
+	sc.send(f)
+}
+
+func (sc *stompConn) transaction(f *stompFrame) error {
+	tx := f.header("transaction")
+	if tx == _EMPTY_ {
+		return fmt.Errorf("missing transaction header")
+	}
+	sends, ok := sc.txs[tx]
+	if f.command == "BEGIN" {
+		if ok {
+			return fmt.Errorf("transaction %q already started", tx)
+		}
+		sc.txs[tx] = nil
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("unknown transaction %q", tx)
+	}
+	delete(sc.txs, tx)
+	if f.command == "ABORT" {
+		return nil
+	}
+	// The sends are checked before any is published.
+	for _, send := range sends {
+		subject, _ := stompSubject(send.header("destination"))
+		if !IsValidLiteralSubject(subject) {
+			return fmt.Errorf("invalid destination %q", send.header("destination"))
+		}
+	}
+	for _, send := range sends {
+		if err := sc.publish(send); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFrame reads the next frame, skipping heart-beats.
+func (sc *stompConn) readFrame(maxBody int) (*stompFrame, error) {
+	var line string
+	for {
+		var err error
+		if line, err = sc.readLine(); err != nil {
+			return nil, err
+		}
+		if line != _EMPTY_ {
+			break
+		}
+	}
+	f := &stompFrame{command: line}
+	escaped := f.command != "CONNECT" && f.command != "STOMP"
+	for {
+		line, err := sc.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == _EMPTY_ {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header %q", line)
+		}
+		k, v := line[:i], line[i+1:]
+		if escaped {
+			k, v = stompUnescape(k), stompUnescape(v)
+		}
+		if _, ok := f.headers[k]; !ok {
+			f.setHeader(k, v)
+		}
+	}
+	if cl := f.header("content-length"); cl != _EMPTY_ {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid content-length %q", cl)
+		}
+		if maxBody > 0 && n > maxBody {
+			return nil, errStompFrameTooLarge
+		}
+		f.body = make([]byte, n+1)
+		if _, err := io.ReadFull(sc.br, f.body); err != nil {
+			return nil, err
+		}
+		if f.body[n] != 0 {
+			return nil, fmt.Errorf("frame not terminated by a null byte")
+		}
+		f.body = f.body[:n]
+		return f, nil
+	}
+	for {
+		b, err := sc.br.ReadSlice(0)
+		f.body = append(f.body, b...)
+		if maxBody > 0 && len(f.body) > maxBody+1 {
+			return nil, errStompFrameTooLarge
+		}
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+	f.body = f.body[:len(f.body)-1]
+	return f, nil
+}
+
+func (sc *stompConn) readLine() (string, error) {
+	b, err := sc.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return _EMPTY_, errStompFrameTooLarge
+	}
+	if err != nil {
+		return _EMPTY_, err
+	}
+	return strings.TrimSuffix(string(b[:len(b)-1]), "\r"), nil
+}
+
+var (
+	stompEscaper   = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+	stompUnescaper = strings.NewReplacer("\\\\", "\\", "\\r", "\r", "\\n", "\n", "\\c", ":")
+)
+
+func stompUnescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	return stompUnescaper.Replace(s)
+}
+
+func writeStompFrame(b *bytes.Buffer, f *stompFrame) {
+	b.WriteString(f.command)
+	b.WriteByte('\n')
+	escaped := f.command != "CONNECTED"
+	for _, k := range f.order {
+		v := f.headers[k]
+		if escaped {
+			k, v = stompEscaper.Replace(k), stompEscaper.Replace(v)
+		}
+		b.WriteString(k)
+		b.WriteByte(':')
+		b.WriteString(v)
+		b.WriteByte('\n')
+	}
+	if len(f.body) > 0 {
+		fmt.Fprintf(b, "content-length:%d\n", len(f.body))
+	}
+	b.WriteByte('\n')
+	b.Write(f.body)
+	b.WriteByte(0)
+}
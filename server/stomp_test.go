@@ -0,0 +1,245 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+type stompTestClient struct {
+	t  *testing.T
+	sc *stompConn
+}
+
+func newStompTestClient(t *testing.T, s *Server) *stompTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.StompAddr().String())
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	return &stompTestClient{t: t, sc: &stompConn{conn: conn, br: bufio.NewReader(conn)}}
+}
+
+func (c *stompTestClient) send(command string, body string, headers ...string) {
+	c.t.Helper()
+	f := &stompFrame{command: command, body: []byte(body)}
+	for i := 0; i < len(headers); i += 2 {
+		f.setHeader(headers[i], headers[i+1])
+	}
+	var b bytes.Buffer
+	writeStompFrame(&b, f)
+	if _, err := c.sc.conn.Write(b.Bytes()); err != nil {
+		c.t.Fatalf("Error writing frame: %v", err)
+	}
+}
+
+func (c *stompTestClient) next() *stompFrame {
+	c.t.Helper()
+	c.sc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f, err := c.sc.readFrame(0)
+	if err != nil {
+		c.t.Fatalf("Error reading frame: %v", err)
+	}
+	return f
+}
+
+func (c *stompTestClient) expect(command string) *stompFrame {
+	c.t.Helper()
+	f := c.next()
+	if f.command != command {
+		c.t.Fatalf("Expected %s, got %s %v %q", command, f.command, f.headers, f.body)
+	}
+	return f
+}
+
+func TestStompPubSub(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A: {
+				users: [
+					{user: a, password: pwd, permissions: {publish: ["orders.>", "reply.>"], subscribe: ["orders.>", "_INBOX.>"]}}
+				]
+			}
+		}
+		stomp {
+			listen: "127.0.0.1:-1"
+			no_auth_user: a
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	c := newStompTestClient(t, s)
+	defer c.sc.conn.Close()
+	// Authenticated as the no auth user.
+	c.send("CONNECT", "", "accept-version", "1.2", "host", "nats")
+	if f := c.expect("CONNECTED"); f.header("version") != "1.2" {
+		t.Fatalf("Unexpected version %q", f.header("version"))
+	}
+	c.send("SUBSCRIBE", "", "id", "1", "destination", "/topic/orders/>", "receipt", "r1")
+	if f := c.expect("RECEIPT"); f.header("receipt-id") != "r1" {
+		t.Fatalf("Unexpected receipt %v", f.headers)
+	}
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "orders.>")
+	natsFlush(t, nc)
+
+	// From NATS to STOMP, with headers and reply.
+	m := nats.NewMsg("orders.new")
+	m.Reply = "_INBOX.x"
+	m.Header.Set("Priority", "high")
+	m.Data = []byte("hello")
+	if err := nc.PublishMsg(m); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	f := c.expect("MESSAGE")
+	if f.header("destination") != "/topic/orders/new" || f.header("subscription") != "1" ||
+		f.header("Priority") != "high" || f.header("reply-to") != "/topic/_INBOX/x" || string(f.body) != "hello" {
+		t.Fatalf("Unexpected message %v %q", f.headers, f.body)
+	}
+	natsNexMsg(t, sub, time.Second)
+
+	// From STOMP to NATS, with escaped headers.
+	c.send("SEND", "hi", "destination", "/queue/orders/created", "x-note", "a:b")
+	rm := natsNexMsg(t, sub, time.Second)
+	if rm.Subject != "orders.created" || rm.Header.Get("x-note") != "a:b" || string(rm.Data) != "hi" {
+		t.Fatalf("Unexpected message %q %v %q", rm.Subject, rm.Header, rm.Data)
+	}
+	// STOMP clients receive their own messages.
+	if f := c.expect("MESSAGE"); f.header("destination") != "/topic/orders/created" {
+		t.Fatalf("Unexpected destination %q", f.header("destination"))
+	}
+
+	// Sends in a transaction are published on commit.
+	c.send("BEGIN", "", "transaction", "tx1")
+	c.send("SEND", "1", "destination", "orders.tx", "transaction", "tx1")
+	c.send("SEND", "2", "destination", "orders.tx", "transaction", "tx1")
+	c.send("BEGIN", "", "transaction", "tx2")
+	c.send("SEND", "3", "destination", "orders.tx", "transaction", "tx2")
+	c.send("ABORT", "", "transaction", "tx2", "receipt", "r2")
+	c.expect("RECEIPT")
+	if _, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatal("Expected no message before commit")
+	}
+	c.send("COMMIT", "", "transaction", "tx1")
+	for _, expected := range []string{"1", "2"} {
+		if rm := natsNexMsg(t, sub, time.Second); string(rm.Data) != expected {
+			t.Fatalf("Expected %q, got %q", expected, rm.Data)
+		}
+	}
+	if _, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatal("Expected no message of aborted transaction")
+	}
+
+	// Own messages of the transaction are received before the receipt.
+	c.send("UNSUBSCRIBE", "", "id", "1", "receipt", "r3")
+	for f := c.next(); f.command != "RECEIPT"; f = c.next() {
+		if f.command != "MESSAGE" {
+			t.Fatalf("Unexpected frame %s %v", f.command, f.headers)
+		}
+	}
+
+	// Permissions of the user are enforced.
+	c.send("SEND", "x", "destination", "other")
+	if f := c.expect("ERROR"); !strings.Contains(f.header("message"), "permissions violation") {
+		t.Fatalf("Unexpected error %v", f.headers)
+	}
+}
+
+func TestStompAuthentication(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization { users: [{user: a, password: pwd}] }
+		stomp { listen: "127.0.0.1:-1" }
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	for _, test := range []struct {
+		login, passcode, expected string
+	}{
+		{"a", "bad", "ERROR"},
+		{"", "", "ERROR"},
+		{"a", "pwd", "CONNECTED"},
+	} {
+		c := newStompTestClient(t, s)
+		c.send("STOMP", "", "accept-version", "1.2", "login", test.login, "passcode", test.passcode)
+		c.expect(test.expected)
+		c.sc.conn.Close()
+	}
+
+	c := newStompTestClient(t, s)
+	defer c.sc.conn.Close()
+	c.send("CONNECT", "", "accept-version", "1.0,1.1")
+	if f := c.expect("ERROR"); !strings.Contains(f.header("message"), "1.2") {
+		t.Fatalf("Unexpected error %v", f.headers)
+	}
+
+	// Connections are not let in when the server requires an authentication
+	// that STOMP does not support.
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	conf = createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization { users: [{nkey: %q}] }
+		stomp { listen: "127.0.0.1:-1" }
+	`, pub)))
+	defer os.Remove(conf)
+	s2, _ := RunServerWithConfig(conf)
+	defer s2.Shutdown()
+	c2 := newStompTestClient(t, s2)
+	defer c2.sc.conn.Close()
+	c2.send("CONNECT", "", "accept-version", "1.2")
+	c2.expect("ERROR")
+}
+
+func TestStompConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		stomp {
+			listen: "127.0.0.1:61613"
+			no_auth_user: missing
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.Stomp.Host != "127.0.0.1" || opts.Stomp.Port != 61613 {
+		t.Fatalf("Unexpected options: %+v", opts.Stomp)
+	}
+	if err := validateStompOptions(opts); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("Expected error about user, got %v", err)
+	}
+	conf = createConfFile(t, []byte(`stomp { bad: 1 }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Fatalf("Expected error on unknown field, got %v", err)
+	}
+}
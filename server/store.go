@@ -68,6 +68,59 @@ type StreamStore interface {
 	Snapshot(deadline time.Duration, includeConsumers, checkMsgs bool) (*SnapshotResult, error)
 }
 
+// StreamStoreProvider allows alternate storage backends to be plugged in
+// behind streams. The builtin file and memory stores, available through
+// NewFileStore and NewMemStore, are the reference implementations.
+type StreamStoreProvider interface {
+	// NewStreamStore returns the store for a stream of the given account.
+	// The storage type in the config selects the account limits the stored
+	// bytes are accounted against, and fcfg holds the directory reserved for
+	// this stream. Returning a nil store selects the builtin store.
+	NewStreamStore(account string, cfg *StreamConfig, fcfg FileStoreConfig) (StreamStore, error)
+}
+
+// StreamStoreCompactor is implemented by stores able to reclaim the storage
+// space left behind by deleted messages, like the file store.
+type StreamStoreCompactor interface {
+	// CompactBlocks returns the number of bytes reclaimed.
+	CompactBlocks() (uint64, error)
+}
+
+// StreamStoreScrubber is implemented by stores able to verify the integrity
+// of stored messages, like the file store.
+type StreamStoreScrubber interface {
+	// Scrub verifies all stored messages.
+	Scrub() (*ScrubReport, error)
+	// LastScrub returns the report of the last scrub, including background
+	// ones, or nil if none happened yet.
+	LastScrub() *ScrubReport
+}
+
+// ScrubReport is the result of verifying the integrity of stored messages.
+type ScrubReport struct {
+	Time      time.Time     `json:"time"`
+	Duration  time.Duration `json:"duration"`
+	Corrupted []uint64      `json:"corrupted,omitempty"`
+}
+
+// NewFileStore creates the builtin file based store for a stream.
+func NewFileStore(fcfg FileStoreConfig, cfg StreamConfig) (StreamStore, error) {
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// NewMemStore creates the builtin memory based store for a stream.
+func NewMemStore(cfg *StreamConfig) (StreamStore, error) {
+	ms, err := newMemStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
 // RetentionPolicy determines how messages in a set are retained.
 type RetentionPolicy int
 
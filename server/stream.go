@@ -17,6 +17,7 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -48,13 +49,24 @@ type StreamConfig struct {
 	Replicas     int             `json:"num_replicas"`
 	NoAck        bool            `json:"no_ack,omitempty"`
 	Template     string          `json:"template_owner,omitempty"`
+	// Idempotency, if set, makes the stream remember message ids.
+	Idempotency *IdempotencyConfig `json:"idempotency,omitempty"`
+	// Retention floor of interest retention, acknowledged messages being
+	// kept while younger than RetainMinAge or among the last RetainMinMsgs.
+	RetainMinAge  time.Duration `json:"retain_min_age,omitempty"`
+	RetainMinMsgs int64         `json:"retain_min_msgs,omitempty"`
+	// Archive, if set, moves aged messages to another stream.
+	Archive *StreamArchive `json:"archive,omitempty"`
+	// Visibility timeouts of work queue messages by subject.
+	Visibility []*VisibilityGroup `json:"visibility,omitempty"`
 }
 
 // PubAck is the detail you get back from a publish to a stream that was successful.
 // e.g. +OK {"stream": "Orders", "seq": 22}
 type PubAck struct {
-	Stream string `json:"stream"`
-	Seq    uint64 `json:"seq"`
+	Stream    string `json:"stream"`
+	Seq       uint64 `json:"seq"`
+	Duplicate bool   `json:"duplicate,omitempty"`
 }
 
 // StreamInfo shows config and current state for this stream.
@@ -79,6 +91,18 @@ type Stream struct {
 	consumers map[string]*Consumer
 	config    StreamConfig
 	created   time.Time
+	idx       *idempotencyIndex
+	// Acknowledged messages retained by the retention floor, with their
+	// timestamp.
+	retained map[uint64]int64
+	rtmr     *time.Timer
+	// Archival timer and last archival error.
+	atmr    *time.Timer
+	archErr string
+	// Revision of the last change.
+	rev uint64
+	// Traces sampled messages, if configured.
+	tracer *tracer
 }
 
 const (
@@ -136,7 +160,7 @@ func (a *Account) AddStreamWithStore(config *StreamConfig, fsConfig *FileStoreCo
 
 	// Setup the internal client.
 	c := s.createInternalJetStreamClient()
-	mset := &Stream{jsa: jsa, config: cfg, client: c, consumers: make(map[string]*Consumer)}
+	mset := &Stream{jsa: jsa, config: cfg, client: c, consumers: make(map[string]*Consumer), rev: jsa.nextRevision(), tracer: s.tracer}
 	mset.sg = sync.NewCond(&mset.mu)
 
 	jsa.streams[cfg.Name] = mset
@@ -152,7 +176,7 @@ func (a *Account) AddStreamWithStore(config *StreamConfig, fsConfig *FileStoreCo
 		fsCfg = &FileStoreConfig{}
 	}
 	fsCfg.StoreDir = storeDir
-	if err := mset.setupStore(fsCfg); err != nil {
+	if err := mset.setupStore(s.streamStoreProvider(), a.Name, fsCfg); err != nil {
 		mset.Delete()
 		return nil, err
 	}
@@ -173,7 +197,12 @@ func (a *Account) AddStreamWithStore(config *StreamConfig, fsConfig *FileStoreCo
 	mset.pubAck = append(mset.pubAck, OK...)
 	mset.pubAck = append(mset.pubAck, fmt.Sprintf(" {\"stream\": %q, \"seq\": ", cfg.Name)...)
 
+	mset.mu.Lock()
+	mset.setupArchive()
+	mset.mu.Unlock()
+
 	mset.sendCreateAdvisory()
+	s.streamCreatedHook(a, cfg)
 
 	return mset, nil
 }
@@ -335,6 +364,37 @@ func checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
 			dset[subj] = struct{}{}
 		}
 	}
+	if cfg.Idempotency != nil {
+		ic := *cfg.Idempotency
+		if err := checkIdempotencyCfg(&ic); err != nil {
+			return StreamConfig{}, err
+		}
+		cfg.Idempotency = &ic
+	}
+	if err := checkRetentionFloor(&cfg); err != nil {
+		return StreamConfig{}, err
+	}
+	if len(cfg.Visibility) > 0 {
+		groups := make([]*VisibilityGroup, 0, len(cfg.Visibility))
+		for _, g := range cfg.Visibility {
+			if g != nil {
+				vg := *g
+				g = &vg
+			}
+			groups = append(groups, g)
+		}
+		cfg.Visibility = groups
+		if err := checkVisibilityCfg(&cfg); err != nil {
+			return StreamConfig{}, err
+		}
+	}
+	if cfg.Archive != nil {
+		ac := *cfg.Archive
+		cfg.Archive = &ac
+		if err := checkArchiveCfg(&cfg); err != nil {
+			return StreamConfig{}, err
+		}
+	}
 	return cfg, nil
 }
 
@@ -356,6 +416,7 @@ func (mset *Stream) Delete() error {
 	jsa.mu.Lock()
 	delete(jsa.streams, mset.config.Name)
 	jsa.mu.Unlock()
+	jsa.assetDeleted(mset.Name(), _EMPTY_)
 
 	return mset.delete()
 }
@@ -391,6 +452,13 @@ func (mset *Stream) Update(config *StreamConfig) error {
 	if cfg.Template != "" {
 		return fmt.Errorf("stream configuration update can not be owned by a template")
 	}
+	// Can only change the limits of idempotency.
+	if (cfg.Idempotency == nil) != (o_cfg.Idempotency == nil) {
+		return fmt.Errorf("stream configuration update can not enable or disable idempotency")
+	}
+	if cfg.Idempotency != nil && cfg.Idempotency.Scope != o_cfg.Idempotency.Scope {
+		return fmt.Errorf("stream configuration update can not change idempotency scope")
+	}
 
 	// Check limits.
 	mset.mu.Lock()
@@ -438,7 +506,19 @@ func (mset *Stream) Update(config *StreamConfig) error {
 
 	// Now update config and store's version of our config.
 	mset.config = cfg
+	mset.rev = jsa.nextRevision()
 	mset.store.UpdateConfig(&cfg)
+	if mset.idx != nil {
+		mset.idx.mu.Lock()
+		mset.idx.cfg.TTL, mset.idx.cfg.MaxKeys = cfg.Idempotency.TTL, cfg.Idempotency.MaxKeys
+		mset.idx.mu.Unlock()
+	}
+	mset.setupArchive()
+	for _, o := range mset.consumers {
+		o.mu.Lock()
+		o.vgroups = cfg.Visibility
+		o.mu.Unlock()
+	}
 
 	mset.sendUpdateAdvisoryLocked()
 
@@ -465,6 +545,43 @@ func (mset *Stream) Purge() uint64 {
 	return purged
 }
 
+// CompactStore reclaims the storage space left behind by deleted messages
+// and returns the number of bytes reclaimed. Stores that do not support
+// compaction reclaim nothing.
+func (mset *Stream) CompactStore() (uint64, error) {
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+	if sc, ok := store.(StreamStoreCompactor); ok {
+		return sc.CompactBlocks()
+	}
+	return 0, nil
+}
+
+// Scrub verifies the integrity of all messages of the stream. Stores that
+// do not support it return nil.
+func (mset *Stream) Scrub() (*ScrubReport, error) {
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+	if sc, ok := store.(StreamStoreScrubber); ok {
+		return sc.Scrub()
+	}
+	return nil, nil
+}
+
+// LastScrub returns the report of the last integrity check of the stream,
+// including background ones, or nil if none happened yet.
+func (mset *Stream) LastScrub() *ScrubReport {
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+	if sc, ok := store.(StreamStoreScrubber); ok {
+		return sc.LastScrub()
+	}
+	return nil
+}
+
 // RemoveMsg will remove a message from a stream.
 // FIXME(dlc) - Should pick one and be consistent.
 func (mset *Stream) RemoveMsg(seq uint64) (bool, error) {
@@ -572,20 +689,30 @@ func (mset *Stream) unsubscribeUnlocked(sub *subscription) {
 	mset.mu.Unlock()
 }
 
-func (mset *Stream) setupStore(fsCfg *FileStoreConfig) error {
+func (mset *Stream) setupStore(sp StreamStoreProvider, account string, fsCfg *FileStoreConfig) error {
 	mset.mu.Lock()
 	defer mset.mu.Unlock()
 
 	mset.created = time.Now().UTC()
 
-	switch mset.config.Storage {
-	case MemoryStorage:
+	if sp != nil {
+		store, err := sp.NewStreamStore(account, &mset.config, *fsCfg)
+		if err != nil {
+			return err
+		}
+		mset.store = store
+	}
+
+	switch {
+	case mset.store != nil:
+		// Provided by an alternate backend.
+	case mset.config.Storage == MemoryStorage:
 		ms, err := newMemStore(&mset.config)
 		if err != nil {
 			return err
 		}
 		mset.store = ms
-	case FileStorage:
+	case mset.config.Storage == FileStorage:
 		fs, err := newFileStoreWithCreated(*fsCfg, mset.config, mset.created)
 		if err != nil {
 			return err
@@ -594,11 +721,106 @@ func (mset *Stream) setupStore(fsCfg *FileStoreConfig) error {
 	}
 	jsa, st := mset.jsa, mset.config.Storage
 	mset.store.StorageBytesUpdate(func(delta int64) { jsa.updateUsage(st, delta) })
+
+	if ic := mset.config.Idempotency; ic != nil {
+		// Message ids of file based streams are kept along their messages.
+		var dir string
+		if mset.config.Storage == FileStorage {
+			dir = fsCfg.StoreDir
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("could not create stream directory - %v", err)
+			}
+		}
+		idx, err := newIdempotencyIndex(*ic, dir)
+		if err != nil {
+			return err
+		}
+		mset.idx = idx
+	}
 	return nil
 }
 
+var (
+	// ErrStreamMsgSizeExceeded is returned when a message is larger than allowed by the stream.
+	ErrStreamMsgSizeExceeded = errors.New("message size exceeds maximum allowed")
+	// ErrJetStreamResourcesExceeded is returned when a message would exceed the account limits.
+	ErrJetStreamResourcesExceeded = errors.New("resource limits exceeded for account")
+)
+
 // processInboundJetStreamMsg handles processing messages bound for a stream.
 func (mset *Stream) processInboundJetStreamMsg(_ *subscription, pc *client, subject, reply string, msg []byte) {
+	mset.mu.Lock()
+	c := mset.client
+	doAck := !mset.config.NoAck
+	pubAck := mset.pubAck
+	mset.mu.Unlock()
+
+	if c == nil {
+		return
+	}
+
+	// Header support.
+	var hdr []byte
+	if pc != nil && pc.pa.hdr > 0 {
+		hdr = msg[:pc.pa.hdr]
+		msg = msg[pc.pa.hdr:]
+	}
+
+	seq, err := mset.storeMsg(pc, subject, hdr, msg)
+
+	// Send response here.
+	if doAck && len(reply) > 0 {
+		var response []byte
+		if err == errDuplicateMsg {
+			response = append(pubAck, strconv.FormatUint(seq, 10)...)
+			response = append(response, ", \"duplicate\": true}"...)
+		} else if err != nil {
+			response = []byte(fmt.Sprintf("-ERR '%v'", err))
+		} else {
+			response = append(pubAck, strconv.FormatUint(seq, 10)...)
+			response = append(response, '}')
+		}
+		mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+	}
+}
+
+// Publish stores a message in the stream directly, without going through
+// a client connection, and returns its stream sequence. The subject needs
+// to match the subjects of the stream.
+func (mset *Stream) Publish(subject string, hdr, msg []byte) (uint64, error) {
+	mset.mu.Lock()
+	closed := mset.client == nil
+	subjects := mset.config.Subjects
+	mset.mu.Unlock()
+
+	if closed {
+		return 0, ErrStoreClosed
+	}
+	if !IsValidLiteralSubject(subject) {
+		return 0, ErrBadPublishSubject
+	}
+	var match bool
+	for _, subj := range subjects {
+		if matchLiteral(subject, subj) {
+			match = true
+			break
+		}
+	}
+	if !match {
+		return 0, fmt.Errorf("subject %q does not match stream subjects", subject)
+	}
+	seq, err := mset.storeMsg(nil, subject, hdr, msg)
+	if err == errDuplicateMsg {
+		return seq, nil
+	}
+	return seq, err
+}
+
+// Stores the message, checking limits and message ids, and hands it to the
+// consumers. Returns errDuplicateMsg with the sequence of the original
+// message if its id was already stored.
+// Lock should not be held.
+func (mset *Stream) storeMsg(pc *client, subject string, hdr, msg []byte) (uint64, error) {
 	mset.mu.Lock()
 	store := mset.store
 	c := mset.client
@@ -606,62 +828,77 @@ func (mset *Stream) processInboundJetStreamMsg(_ *subscription, pc *client, subj
 	if c != nil && c.acc != nil {
 		accName = c.acc.Name
 	}
-	doAck := !mset.config.NoAck
-	pubAck := mset.pubAck
 	jsa := mset.jsa
 	stype := mset.config.Storage
 	name := mset.config.Name
 	maxMsgSize := int(mset.config.MaxMsgSize)
 	numConsumers := len(mset.consumers)
+	idx := mset.idx
+	tr := mset.tracer
 	mset.mu.Unlock()
 
 	if c == nil {
-		return
+		return 0, ErrStoreClosed
 	}
 
-	// Response Ack.
-	var (
-		response []byte
-		seq      uint64
-		err      error
-		ts       int64
-	)
-
-	// Header support.
-	var hdr []byte
-
 	// Check to see if we are over the account limit.
-	if maxMsgSize >= 0 && len(msg) > maxMsgSize {
-		response = []byte("-ERR 'message size exceeds maximum allowed'")
-	} else {
-		// Headers.
-		if pc != nil && pc.pa.hdr > 0 {
-			hdr = msg[:pc.pa.hdr]
-			msg = msg[pc.pa.hdr:]
+	if maxMsgSize >= 0 && len(hdr)+len(msg) > maxMsgSize {
+		return 0, ErrStreamMsgSizeExceeded
+	}
+
+	// Check the message id, the index being locked until the message is stored.
+	var key string
+	if idx != nil {
+		var pub string
+		if idx.cfg.Scope == IdempotencyPublisher {
+			pub = publisherID(pc)
 		}
-		seq, ts, err = store.StoreMsg(subject, hdr, msg)
-		if err != nil {
-			if err != ErrStoreClosed {
-				c.Errorf("JetStream failed to store a msg on account: %q stream: %q -  %v", accName, name, err)
+		if key = idx.idempotencyKey(subject, pub, hdr); key != _EMPTY_ {
+			idx.mu.Lock()
+			if dseq, ok := idx.lookup(key, time.Now().UnixNano()); ok {
+				idx.mu.Unlock()
+				return dseq, errDuplicateMsg
 			}
-			response = []byte(fmt.Sprintf("-ERR '%v'", err))
-		} else if jsa.limitsExceeded(stype) {
-			c.Warnf("JetStream resource limits exceeded for account: %q", accName)
-			response = []byte("-ERR 'resource limits exceeded for account'")
-			store.RemoveMsg(seq)
-			seq = 0
-		} else if err == nil && doAck && len(reply) > 0 {
-			response = append(pubAck, strconv.FormatUint(seq, 10)...)
-			response = append(response, '}')
 		}
 	}
-
-	// Send response here.
-	if doAck && len(reply) > 0 {
-		mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+	// Trace the commit of sampled messages, their header then carrying the
+	// commit span to the consumers.
+	var span *otlpSpan
+	if tr != nil {
+		span, hdr = tr.startSpan("jetstream.commit", hdr)
+	}
+	seq, ts, err := store.StoreMsg(subject, hdr, msg)
+	if err == nil && jsa.limitsExceeded(stype) {
+		c.Warnf("JetStream resource limits exceeded for account: %q", accName)
+		store.RemoveMsg(seq)
+		err = ErrJetStreamResourcesExceeded
+	} else if err != nil && err != ErrStoreClosed {
+		c.Errorf("JetStream failed to store a msg on account: %q stream: %q -  %v", accName, name, err)
+	}
+	if key != _EMPTY_ {
+		if err == nil {
+			if ierr := idx.store(key, seq, ts); ierr != nil {
+				c.Warnf("JetStream failed to store a msg id on account: %q stream: %q - %v", accName, name, ierr)
+			}
+		}
+		idx.mu.Unlock()
+	}
+	if span != nil {
+		span.setString("nats.stream", name)
+		span.setString("nats.subject", subject)
+		if err != nil {
+			span.setError(err)
+		} else {
+			span.setInt("nats.stream_sequence", seq)
+		}
+		tr.end(span)
+	}
+	if err != nil {
+		return 0, err
 	}
+	jsa.meterIngest(len(hdr) + len(msg))
 
-	if err == nil && numConsumers > 0 && seq > 0 {
+	if numConsumers > 0 {
 		var needSignal bool
 		mset.mu.Lock()
 		for _, o := range mset.consumers {
@@ -675,6 +912,7 @@ func (mset *Stream) processInboundJetStreamMsg(_ *subscription, pc *client, subj
 			mset.signalConsumers()
 		}
 	}
+	return seq, nil
 }
 
 // Will signal all waiting consumers.
@@ -738,6 +976,7 @@ func (mset *Stream) internalSendLoop() {
 	s := c.srv
 	sendq := mset.sendq
 	name := mset.config.Name
+	jsa := mset.jsa
 	mset.mu.Unlock()
 
 	// Warn when internal send queue is backed up past 75%
@@ -777,8 +1016,12 @@ func (mset *Stream) internalSendLoop() {
 			c.flushClients(0)
 			// Check to see if this is a delivery for an observable and
 			// we failed to deliver the message. If so alert the observable.
-			if pm.o != nil && pm.seq > 0 && !didDeliver {
-				pm.o.didNotDeliver(pm.seq)
+			if pm.o != nil && pm.seq > 0 {
+				if !didDeliver {
+					pm.o.didNotDeliver(pm.seq)
+				} else if jsa != nil {
+					jsa.meterDelivery(len(pm.hdr) + len(pm.msg))
+				}
 			}
 		case <-s.quitCh:
 			return
@@ -809,6 +1052,11 @@ func (mset *Stream) stop(delete bool) error {
 		mset.mu.Unlock()
 		return nil
 	}
+	if mset.rtmr != nil {
+		mset.rtmr.Stop()
+		mset.rtmr = nil
+	}
+	mset.setupArchive()
 	var obs []*Consumer
 	for _, o := range mset.consumers {
 		obs = append(obs, o)
@@ -834,6 +1082,9 @@ func (mset *Stream) stop(delete bool) error {
 	if mset.store == nil {
 		return nil
 	}
+	if mset.idx != nil {
+		mset.idx.close()
+	}
 
 	if delete {
 		if err := mset.store.Delete(); err != nil {
@@ -954,7 +1205,7 @@ func (mset *Stream) ackMsg(obs *Consumer, seq uint64) {
 		}
 		mset.mu.Unlock()
 		if !needAck {
-			mset.store.RemoveMsg(seq)
+			mset.removeAckedMsg(seq)
 		}
 	}
 }
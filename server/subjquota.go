@@ -0,0 +1,185 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// An account can limit the number of distinct subjects its clients
+// subscribe or publish to over a window, to protect the sublist and the
+// interest sent to routes and gateways from an unbounded number of
+// subjects. Subjects already used in the window are always allowed, new
+// ones are rejected once the limit is reached, until the next window.
+// Advisories are sent when the limit is approached and when it is reached.
+
+// Kinds of subject quotas.
+const (
+	SubjectQuotaInterest = "interest"
+	SubjectQuotaPublish  = "publish"
+)
+
+// Defaults of subject quotas.
+const (
+	DEFAULT_SUBJECT_QUOTA_WINDOW = time.Minute
+	DEFAULT_SUBJECT_QUOTA_WARN   = 80
+)
+
+// SubjectQuotaOpts are the limits on the number of distinct subjects the
+// clients of an account can subscribe and publish to over the window. Warn
+// is the percentage of a limit at which an advisory is sent.
+type SubjectQuotaOpts struct {
+	MaxInterest int
+	MaxPublish  int
+	Window      time.Duration
+	Warn        int
+
+	mu     sync.Mutex
+	start  time.Time
+	quotas map[string]*subjectQuota
+}
+
+// subjectQuota is the usage of a kind of quota in the current window.
+type subjectQuota struct {
+	subjects map[string]struct{}
+	warned   bool
+	exceeded bool
+}
+
+// SubjectQuotaEventMsg is sent when the number of distinct subjects used by
+// an account in the window reaches the warning level, or the limit.
+type SubjectQuotaEventMsg struct {
+	TypedEvent
+	Server   ServerInfo    `json:"server"`
+	Account  string        `json:"account"`
+	Kind     string        `json:"kind"`
+	Subjects int           `json:"subjects"`
+	Limit    int           `json:"limit"`
+	Window   time.Duration `json:"window"`
+	Exceeded bool          `json:"exceeded"`
+}
+
+// SubjectQuotaEventMsgType is the schema type for SubjectQuotaEventMsg
+const SubjectQuotaEventMsgType = "io.nats.server.advisory.v1.subject_quota"
+
+// limit returns the limit of the kind of quota, 0 if none.
+func (o *SubjectQuotaOpts) limit(kind string) int {
+	if kind == SubjectQuotaInterest {
+		return o.MaxInterest
+	}
+	return o.MaxPublish
+}
+
+// use records the use of the subject. It returns false if the subject is
+// new and the limit is reached, and the number of subjects used in the
+// window and whether the advisory has to be sent, for a warning or for
+// the limit.
+func (o *SubjectQuotaOpts) use(kind, subject string, now time.Time) (bool, int, bool) {
+	max := o.limit(kind)
+	if max <= 0 {
+		return true, 0, false
+	}
+	window := o.Window
+	if window <= 0 {
+		window = DEFAULT_SUBJECT_QUOTA_WINDOW
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.quotas == nil || now.Sub(o.start) >= window {
+		o.start, o.quotas = now, make(map[string]*subjectQuota, 2)
+	}
+	q := o.quotas[kind]
+	if q == nil {
+		q = &subjectQuota{subjects: make(map[string]struct{})}
+		o.quotas[kind] = q
+	}
+	if _, ok := q.subjects[subject]; ok {
+		return true, len(q.subjects), false
+	}
+	if len(q.subjects) >= max {
+		advise := !q.exceeded
+		q.exceeded = true
+		return false, len(q.subjects), advise
+	}
+	q.subjects[subject] = struct{}{}
+	n := len(q.subjects)
+	if !q.warned && o.Warn > 0 && n*100 >= max*o.Warn {
+		q.warned = true
+		return true, n, true
+	}
+	return true, n, false
+}
+
+// subjectQuotaOpts returns the subject quota of the account.
+func (a *Account) subjectQuotaOpts() *SubjectQuotaOpts {
+	a.mu.RLock()
+	sq := a.subjQuota
+	a.mu.RUnlock()
+	return sq
+}
+
+// checkSubjectQuota returns false if the client can not use the subject
+// for the kind of quota of its account. Client lock should not be held.
+func (c *client) checkSubjectQuota(acc *Account, kind string, subject []byte) bool {
+	sq := acc.subjectQuotaOpts()
+	if sq == nil {
+		return true
+	}
+	ok, n, advise := sq.use(kind, string(subject), time.Now())
+	if advise && c.srv != nil {
+		c.srv.sendSubjectQuotaEvent(acc, sq, kind, n, !ok)
+	}
+	if !ok {
+		// Reported as a permissions violation so that clients do not
+		// consider the error fatal to the connection.
+		op := "Publish"
+		if kind == SubjectQuotaInterest {
+			op = "Subscription"
+		}
+		c.sendErr(fmt.Sprintf("Permissions Violation for %s to %q, Subject Quota Exceeded", op, subject))
+		c.Errorf("Subject Quota Exceeded - %s, Kind %s, Subject %q", c.getAuthUser(), kind, subject)
+	}
+	return ok
+}
+
+// sendSubjectQuotaEvent sends an advisory for an account approaching or
+// reaching a subject quota.
+func (s *Server) sendSubjectQuotaEvent(acc *Account, sq *SubjectQuotaOpts, kind string, subjects int, exceeded bool) {
+	if exceeded {
+		s.Warnf("Account %q reached its %s subject quota of %d", acc.Name, kind, sq.limit(kind))
+	} else {
+		s.Noticef("Account %q uses %d of its %s subject quota of %d", acc.Name, subjects, kind, sq.limit(kind))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	m := SubjectQuotaEventMsg{
+		TypedEvent: TypedEvent{
+			Type: SubjectQuotaEventMsgType,
+			ID:   s.nextEventID(),
+			Time: time.Now().UTC(),
+		},
+		Account:  acc.Name,
+		Kind:     kind,
+		Subjects: subjects,
+		Limit:    sq.limit(kind),
+		Window:   sq.Window,
+		Exceeded: exceeded,
+	}
+	s.sendInternalMsg(fmt.Sprintf(subjectQuotaEventSubj, acc.Name), _EMPTY_, &m.Server, &m)
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestSubjectQuotaWindow(t *testing.T) {
+	sq := &SubjectQuotaOpts{MaxInterest: 2, Window: time.Minute}
+	now := time.Now()
+	for _, subj := range []string{"a", "b", "a"} {
+		if ok, _, _ := sq.use(SubjectQuotaInterest, subj, now); !ok {
+			t.Fatalf("Expected %q to be allowed", subj)
+		}
+	}
+	if ok, n, advise := sq.use(SubjectQuotaInterest, "c", now); ok || n != 2 || !advise {
+		t.Fatalf("Unexpected use: %v %d %v", ok, n, advise)
+	}
+	if ok, _, advise := sq.use(SubjectQuotaInterest, "d", now); ok || advise {
+		t.Fatalf("Expected a single advisory, got %v %v", ok, advise)
+	}
+	// No limit on publish.
+	if ok, _, _ := sq.use(SubjectQuotaPublish, "c", now); !ok {
+		t.Fatalf("Expected publish to be allowed")
+	}
+	// Next window.
+	if ok, n, _ := sq.use(SubjectQuotaInterest, "c", now.Add(time.Minute)); !ok || n != 1 {
+		t.Fatalf("Expected new window, got %v %d", ok, n)
+	}
+}
+
+func TestSubjectQuota(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		system_account: SYS
+		accounts {
+			A: {
+				users: [{user: a, password: pwd}]
+				subject_quota: { max_interest: 2, max_publish: 2, window: "1h", warn: 50 }
+			}
+			SYS: { users: [{user: sys, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	acc, err := s.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if sq := acc.subjectQuotaOpts(); sq == nil || sq.MaxInterest != 2 || sq.MaxPublish != 2 || sq.Window != time.Hour || sq.Warn != 50 {
+		t.Fatalf("Unexpected subject quota: %+v", sq)
+	}
+
+	ncs, err := nats.Connect(s.ClientURL(), nats.UserInfo("sys", "pwd"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+	events, _ := ncs.SubscribeSync("$SYS.ACCOUNT.A.SUBJECT.QUOTA")
+	ncs.Flush()
+
+	errCh := make(chan error, 10)
+	nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("a", "pwd"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errCh <- err }))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	checkErr := func(subj string) {
+		t.Helper()
+		select {
+		case err := <-errCh:
+			if !strings.Contains(err.Error(), "Subject Quota Exceeded") || !strings.Contains(err.Error(), subj) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected an error for %q", subj)
+		}
+	}
+	checkEvent := func(kind string, subjects int, exceeded bool) {
+		t.Helper()
+		msg, err := events.NextMsg(2 * time.Second)
+		if err != nil {
+			t.Fatalf("Expected an advisory: %v", err)
+		}
+		var e SubjectQuotaEventMsg
+		if err := json.Unmarshal(msg.Data, &e); err != nil {
+			t.Fatalf("Error unmarshaling advisory: %v", err)
+		}
+		if e.Type != SubjectQuotaEventMsgType || e.Account != "A" || e.Kind != kind ||
+			e.Subjects != subjects || e.Limit != 2 || e.Exceeded != exceeded {
+			t.Fatalf("Unexpected advisory: %+v", e)
+		}
+	}
+
+	foo, _ := nc.SubscribeSync("foo")
+	nc.SubscribeSync("bar")
+	nc.SubscribeSync("baz")
+	checkErr("baz")
+	checkEvent(SubjectQuotaInterest, 1, false)
+	checkEvent(SubjectQuotaInterest, 2, true)
+	// Subjects already used are still allowed.
+	foo2, _ := nc.SubscribeSync("foo")
+	nc.Flush()
+
+	nc.Publish("foo", []byte("1"))
+	nc.Publish("p1", nil)
+	nc.Publish("p2", nil)
+	nc.Publish("foo", []byte("2"))
+	checkErr("p2")
+	checkEvent(SubjectQuotaPublish, 1, false)
+	checkEvent(SubjectQuotaPublish, 2, true)
+
+	for _, sub := range []*nats.Subscription{foo, foo2} {
+		for _, data := range []string{"1", "2"} {
+			if msg, err := sub.NextMsg(time.Second); err != nil || string(msg.Data) != data {
+				t.Fatalf("Expected message %q, got %v %v", data, msg, err)
+			}
+		}
+		if msg, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+			t.Fatalf("Unexpected message: %q", msg.Data)
+		}
+	}
+}
@@ -70,6 +70,8 @@ type Sublist struct {
 	ccSweep   int32
 	notify    *notifyMaps
 	count     uint32
+	// Called with the subscriptions inserted and removed, lock held.
+	changes func(sub *subscription, delta int32)
 }
 
 // notifyMaps holds maps of arrays of channels for notifications
@@ -189,6 +191,22 @@ func chkAndRemove(subject string, notify chan<- bool, ms map[string][]chan<- boo
 	return false
 }
 
+// setChangeHandler sets the handler called with the subscriptions inserted
+// and removed, nil to clear it, and calls seed with the current ones. Both
+// are called with the sublist lock held.
+func (s *Sublist) setChangeHandler(fn func(sub *subscription, delta int32), seed func(sub *subscription)) {
+	s.Lock()
+	s.changes = fn
+	if fn != nil && seed != nil {
+		var subs []*subscription
+		s.collectAllSubs(s.root, &subs)
+		for _, sub := range subs {
+			seed(sub)
+		}
+	}
+	s.Unlock()
+}
+
 func (s *Sublist) ClearNotification(subject string, notify chan<- bool) bool {
 	s.Lock()
 	if s.notify == nil {
@@ -383,6 +401,9 @@ func (s *Sublist) Insert(sub *subscription) error {
 
 	s.count++
 	s.inserts++
+	if s.changes != nil {
+		s.changes(sub, 1)
+	}
 
 	s.addToCache(subject, sub)
 	atomic.AddUint64(&s.genid, 1)
@@ -715,6 +736,9 @@ func (s *Sublist) remove(sub *subscription, shouldLock bool, doCacheUpdates bool
 
 	s.count--
 	s.removes++
+	if s.changes != nil {
+		s.changes(sub, -1)
+	}
 
 	for i := len(levels) - 1; i >= 0; i-- {
 		l, n, t := levels[i].l, levels[i].n, levels[i].t
@@ -0,0 +1,131 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/x509"
+	"fmt"
+)
+
+// With verify_and_map, clients whose certificate does not map to a user can
+// be mapped to an account by attributes of the certificate instead, so that
+// all the clients with certificates of a tenant land in its account without
+// a user for each of them. The first mapping matching the certificate is
+// used.
+
+// TLSAccountMapping maps certificates with the organizational unit and a
+// SAN URI matching the pattern, when set, to an account and permissions.
+type TLSAccountMapping struct {
+	OrgUnit string
+	// URIPattern matches a SAN URI, a '*' matching any characters.
+	URIPattern  string
+	Account     string
+	Permissions *Permissions
+}
+
+// matches returns true if the certificate has the attributes of the mapping.
+func (m *TLSAccountMapping) matches(cert *x509.Certificate) bool {
+	if m.OrgUnit != _EMPTY_ {
+		found := false
+		for _, ou := range cert.Subject.OrganizationalUnit {
+			if ou == m.OrgUnit {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if m.URIPattern != _EMPTY_ {
+		found := false
+		for _, u := range cert.URIs {
+			if wildcardMatch(m.URIPattern, u.String()) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// wildcardMatch returns true if the string matches the pattern, a '*'
+// matching any characters.
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == '*' {
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(s) == 0 || s[0] != pattern[0] {
+			return false
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+func validateTLSAccountMappings(o *Options) error {
+	if len(o.TLSAccountMappings) == 0 {
+		return nil
+	}
+	if !o.TLSMap && !o.Websocket.TLSMap {
+		return fmt.Errorf("tls account mappings require verify_and_map")
+	}
+	for _, m := range o.TLSAccountMappings {
+		if m.OrgUnit == _EMPTY_ && m.URIPattern == _EMPTY_ {
+			return fmt.Errorf("tls account mapping to %q requires an ou or a san_uri", m.Account)
+		}
+		found := false
+		for _, acc := range o.Accounts {
+			if acc.Name == m.Account {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("tls account mapping to unknown account %q", m.Account)
+		}
+	}
+	return nil
+}
+
+// tlsAccountUser returns a user of the account the certificate maps to, or
+// nil if none does.
+// Server lock is held on entry.
+func (s *Server) tlsAccountUser(mappings []*TLSAccountMapping, cert *x509.Certificate) *User {
+	for _, m := range mappings {
+		if !m.matches(cert) {
+			continue
+		}
+		v, ok := s.accounts.Load(m.Account)
+		if !ok {
+			return nil
+		}
+		user := &User{Username: cert.Subject.String(), Account: v.(*Account)}
+		if m.Permissions != nil {
+			user.Permissions = m.Permissions.clone()
+			validateResponsePermissions(user.Permissions)
+		}
+		return user
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// Certificates, keys and CAs of a tls block are read from `cert_file`,
+// `key_file` and `ca_file`, or given inline as PEM content with `cert`,
+// `key` and `ca`, such as when resolved from Vault.
+
+// setupCertificates loads the certificate and key, and the CAs used to
+// verify clients, into the configuration.
+func setupCertificates(config *tls.Config, tc *TLSConfigOpts) error {
+	hasCert := tc.CertFile != "" || tc.Cert != ""
+	hasKey := tc.KeyFile != "" || tc.Key != ""
+	switch {
+	case hasCert && !hasKey:
+		return fmt.Errorf("missing 'key_file' in TLS configuration")
+	case !hasCert && hasKey:
+		return fmt.Errorf("missing 'cert_file' in TLS configuration")
+	case hasCert && hasKey:
+		certPEM, err := tlsPEM("cert", tc.CertFile, tc.Cert)
+		if err != nil {
+			return fmt.Errorf("error parsing X509 certificate/key pair: %v", err)
+		}
+		keyPEM, err := tlsPEM("key", tc.KeyFile, tc.Key)
+		if err != nil {
+			return fmt.Errorf("error parsing X509 certificate/key pair: %v", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("error parsing X509 certificate/key pair: %v", err)
+		}
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("error parsing certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if tc.CaFile != "" || tc.Ca != "" {
+		rootPEM, err := tlsPEM("ca", tc.CaFile, tc.Ca)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		ok := pool.AppendCertsFromPEM(rootPEM)
+		if !ok {
+			return fmt.Errorf("failed to parse root ca certificate")
+		}
+		config.ClientCAs = pool
+	}
+	return nil
+}
+
+// tlsPEM returns the PEM content of the file, or the inline content.
+func tlsPEM(name, file, inline string) ([]byte, error) {
+	if file != "" && inline != "" {
+		return nil, fmt.Errorf("both '%s_file' and '%s' in TLS configuration", name, name)
+	}
+	if file != "" {
+		return ioutil.ReadFile(file)
+	}
+	return []byte(inline), nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session resumption lets clients skip the full TLS handshake when they
+// reconnect, with a ticket encrypted by the server. It can be disabled per
+// listener with `session_resumption: false` in the tls block, and the keys
+// of the tickets rotated with `session_ticket_rotation`. 0-RTT early data
+// is never accepted, on any listener, since the TLS stack does not
+// support it.
+
+// Number of ticket keys kept, so that tickets issued before a rotation
+// can still be used until the next one.
+const sessionTicketKeys = 2
+
+// sessionTicketRotator rotates the session ticket keys of a TLS
+// configuration, when a handshake starts after the rotation interval.
+type sessionTicketRotator struct {
+	sync.Mutex
+	config   *tls.Config
+	interval time.Duration
+	keys     [][32]byte
+	rotated  time.Time
+}
+
+// setupSessionTickets applies the session resumption options to the
+// configuration.
+func setupSessionTickets(config *tls.Config, tc *TLSConfigOpts) error {
+	config.SessionTicketsDisabled = tc.SessionTicketsDisabled
+	if tc.SessionTicketsDisabled || tc.SessionTicketRotation <= 0 {
+		return nil
+	}
+	r := &sessionTicketRotator{config: config, interval: tc.SessionTicketRotation}
+	if err := r.rotate(); err != nil {
+		return err
+	}
+	config.GetConfigForClient = r.getConfigForClient
+	return nil
+}
+
+// Lock should be held.
+func (r *sessionTicketRotator) rotate() error {
+	var key [32]byte
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return err
+	}
+	r.keys = append([][32]byte{key}, r.keys...)
+	if len(r.keys) > sessionTicketKeys {
+		r.keys = r.keys[:sessionTicketKeys]
+	}
+	r.config.SetSessionTicketKeys(r.keys)
+	r.rotated = time.Now()
+	return nil
+}
+
+// getConfigForClient rotates the keys if needed. It returns the rotated
+// configuration since connections may use a copy of it.
+func (r *sessionTicketRotator) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.Lock()
+	defer r.Unlock()
+	if time.Since(r.rotated) >= r.interval {
+		if err := r.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return r.config, nil
+}
+
+// TLSSessionStats are the TLS handshakes of a listener, and how many of
+// them resumed a previous session.
+type TLSSessionStats struct {
+	Handshakes     uint64  `json:"handshakes"`
+	Resumed        uint64  `json:"resumed"`
+	ResumptionRate float64 `json:"resumption_rate"`
+}
+
+// TLSSessionsVarz are the TLS session stats, keyed by listener: client,
+// websocket, cluster, gateway or leafnode.
+type TLSSessionsVarz map[string]*TLSSessionStats
+
+// tlsSessionCounts are updated atomically.
+type tlsSessionCounts struct {
+	handshakes uint64
+	resumed    uint64
+}
+
+func newTLSSessionCounts() map[string]*tlsSessionCounts {
+	m := make(map[string]*tlsSessionCounts)
+	for _, kind := range []string{"client", "websocket", "cluster", "gateway", "leafnode"} {
+		m[kind] = &tlsSessionCounts{}
+	}
+	return m
+}
+
+// recordTLSHandshake counts a handshake accepted on the listener.
+func (s *Server) recordTLSHandshake(listener string, resumed bool) {
+	c := s.tlsSessions[listener]
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.handshakes, 1)
+	if resumed {
+		atomic.AddUint64(&c.resumed, 1)
+	}
+}
+
+// tlsSessionsVarz returns the stats of the listeners with handshakes.
+func (s *Server) tlsSessionsVarz() TLSSessionsVarz {
+	var v TLSSessionsVarz
+	for kind, c := range s.tlsSessions {
+		hs := atomic.LoadUint64(&c.handshakes)
+		if hs == 0 {
+			continue
+		}
+		if v == nil {
+			v = make(TLSSessionsVarz)
+		}
+		resumed := atomic.LoadUint64(&c.resumed)
+		v[kind] = &TLSSessionStats{
+			Handshakes:     hs,
+			Resumed:        resumed,
+			ResumptionRate: float64(resumed) / float64(hs),
+		}
+	}
+	return v
+}
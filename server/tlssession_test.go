@@ -0,0 +1,135 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tlsSessionConnect(t *testing.T, s *Server, cache tls.ClientSessionCache) bool {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if l, _ := bufio.NewReader(conn).ReadString('\n'); !strings.HasPrefix(l, "INFO ") {
+		t.Fatalf("Expected INFO, got %q", l)
+	}
+	tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ClientSessionCache: cache})
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("Error on handshake: %v", err)
+	}
+	// Reading the PONG processes the session ticket.
+	fmt.Fprint(tc, "CONNECT {\"verbose\":false}\r\nPING\r\n")
+	if l, _ := bufio.NewReader(tc).ReadString('\n'); !strings.HasPrefix(l, "PONG") {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+	return tc.ConnectionState().DidResume
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		tls     string
+		resumed []bool
+	}{
+		{"default", "", []bool{false, true}},
+		{"disabled", "session_resumption: false", []bool{false, false}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				listen: "127.0.0.1:-1"
+				tls {
+					cert_file: "../test/configs/certs/server-cert.pem"
+					key_file: "../test/configs/certs/server-key.pem"
+					%s
+				}
+			`, test.tls)))
+			defer os.Remove(conf)
+			s, _ := RunServerWithConfig(conf)
+			defer s.Shutdown()
+
+			cache := tls.NewLRUClientSessionCache(1)
+			var resumed uint64
+			for i, expected := range test.resumed {
+				if tlsSessionConnect(t, s, cache) != expected {
+					t.Fatalf("Expected connection %d resumed to be %v", i, expected)
+				}
+				if expected {
+					resumed++
+				}
+			}
+			v, _ := s.Varz(nil)
+			st := v.TLSSessions["client"]
+			if st == nil || st.Handshakes != uint64(len(test.resumed)) || st.Resumed != resumed {
+				t.Fatalf("Unexpected stats: %+v", st)
+			}
+		})
+	}
+}
+
+func TestTLSSessionTicketRotation(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		tls {
+			cert_file: "../test/configs/certs/server-cert.pem"
+			key_file: "../test/configs/certs/server-key.pem"
+			session_ticket_rotation: "100ms"
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	cacheA := tls.NewLRUClientSessionCache(1)
+	cacheB := tls.NewLRUClientSessionCache(1)
+	tlsSessionConnect(t, s, cacheA)
+	if !tlsSessionConnect(t, s, cacheA) {
+		t.Fatal("Expected session to be resumed")
+	}
+	// Each handshake after the interval rotates the keys, and the tickets
+	// of the previous key are still accepted.
+	time.Sleep(150 * time.Millisecond)
+	tlsSessionConnect(t, s, cacheB)
+	time.Sleep(150 * time.Millisecond)
+	if !tlsSessionConnect(t, s, cacheB) {
+		t.Fatal("Expected session to be resumed after one rotation")
+	}
+	if tlsSessionConnect(t, s, cacheA) {
+		t.Fatal("Expected session to not be resumed after two rotations")
+	}
+}
+
+func TestTLSSessionConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		tls {
+			cert_file: "../test/configs/certs/server-cert.pem"
+			key_file: "../test/configs/certs/server-key.pem"
+			session_ticket_rotation: "not a duration"
+		}
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "session_ticket_rotation") {
+		t.Fatalf("Expected error about rotation, got %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// With tracing configured, JetStream messages published with a sampled
+// W3C traceparent header are traced through the server, and the spans are
+// exported to an OpenTelemetry collector with OTLP over HTTP, in JSON. A
+// jetstream.commit span, child of the span of the publisher, measures the
+// storage of the message in the stream. A jetstream.deliver span, child of
+// the commit span, measures each delivery to a consumer until it is
+// acknowledged, negatively acknowledged, terminated or redelivered, or
+// until it is sent for consumers that do not acknowledge. The traceparent
+// header of stored and delivered messages is replaced by the one of their
+// span so that subscribers can carry on the trace.
+
+const (
+	// TraceParentHdr is the W3C trace context header of traced messages.
+	TraceParentHdr = "traceparent"
+
+	tracingDefaultServiceName = "nats-server"
+	tracingExportTimeout      = 10 * time.Second
+	tracingFlushInterval      = time.Second
+	// Maximum number of spans per export request.
+	tracingBatchSize = 512
+	// Spans waiting to be exported, after which they are dropped.
+	tracingQueueSize = 8192
+	// Maximum number of unacknowledged deliveries traced per consumer.
+	maxTracedDeliveries = 10000
+)
+
+// Outcomes of traced deliveries.
+const (
+	traceAck         = "ack"
+	traceNak         = "nak"
+	traceTerm        = "term"
+	traceRedelivered = "redelivered"
+	traceNoAck       = "none"
+)
+
+// TracingOpts configure the export of the traces of JetStream messages.
+type TracingOpts struct {
+	// Endpoint is the OTLP/HTTP traces URL of the collector, e.g.
+	// http://localhost:4318/v1/traces. Tracing is enabled when set.
+	Endpoint string
+	// ServiceName of the exported spans. Defaults to nats-server.
+	ServiceName string
+}
+
+func (o *TracingOpts) serviceName() string {
+	if o.ServiceName != _EMPTY_ {
+		return o.ServiceName
+	}
+	return tracingDefaultServiceName
+}
+
+func validateTracingOptions(o *Options) error {
+	if o.Tracing.Endpoint == _EMPTY_ {
+		return nil
+	}
+	if u, err := url.Parse(o.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == _EMPTY_ {
+		return fmt.Errorf("tracing otlp_endpoint %q is invalid", o.Tracing.Endpoint)
+	}
+	return nil
+}
+
+// parseTraceParent returns the trace and parent span ids of a traceparent
+// header, if the trace is sampled.
+func parseTraceParent(tp []byte) (string, string, bool) {
+	// version-traceid-parentid-flags
+	if len(tp) < 55 || tp[2] != '-' || tp[35] != '-' || tp[52] != '-' || string(tp[:2]) == "ff" {
+		return _EMPTY_, _EMPTY_, false
+	}
+	if len(tp) > 55 && (string(tp[:2]) == "00" || tp[55] != '-') {
+		return _EMPTY_, _EMPTY_, false
+	}
+	flags, err := hex.DecodeString(string(tp[53:55]))
+	if err != nil || flags[0]&1 == 0 {
+		return _EMPTY_, _EMPTY_, false
+	}
+	traceID, spanID := string(tp[3:35]), string(tp[36:52])
+	if !isTraceID(traceID) || !isTraceID(spanID) {
+		return _EMPTY_, _EMPTY_, false
+	}
+	return traceID, spanID, true
+}
+
+// isTraceID returns true for a valid, lowercase hex and not all zeros, id.
+func isTraceID(id string) bool {
+	zero := true
+	for i := 0; i < len(id); i++ {
+		switch c := id[i]; {
+		case c == '0':
+		case c >= '1' && c <= '9', c >= 'a' && c <= 'f':
+			zero = false
+		default:
+			return false
+		}
+	}
+	return !zero
+}
+
+func newSpanID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// OTLP JSON encoding of spans.
+type otlpExportRequest struct {
+	ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource      `json:"resource"`
+	ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// Internal span kind, and error status code.
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusError      = 2
+)
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+func (sp *otlpSpan) setString(key, value string) {
+	sp.Attributes = append(sp.Attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}})
+}
+
+func (sp *otlpSpan) setInt(key string, value uint64) {
+	v := strconv.FormatUint(value, 10)
+	sp.Attributes = append(sp.Attributes, otlpAttribute{Key: key, Value: otlpValue{IntValue: &v}})
+}
+
+func (sp *otlpSpan) setError(err error) {
+	sp.Status = &otlpStatus{Code: otlpStatusError, Message: err.Error()}
+}
+
+// tracer exports the spans of traced messages.
+type tracer struct {
+	srv    *Server
+	opts   TracingOpts
+	client *http.Client
+	spans  chan *otlpSpan
+	// Spans dropped since the last warning.
+	dropped uint64
+}
+
+func newTracer(s *Server, opts TracingOpts) *tracer {
+	return &tracer{
+		srv:    s,
+		opts:   opts,
+		client: &http.Client{Timeout: tracingExportTimeout},
+		spans:  make(chan *otlpSpan, tracingQueueSize),
+	}
+}
+
+// startSpan starts a span, child of the span of the traceparent header if
+// the message is sampled, and returns it with the header of the message
+// updated to the new span. The span is nil if the message is not traced.
+func (t *tracer) startSpan(name string, hdr []byte) (*otlpSpan, []byte) {
+	if len(hdr) == 0 {
+		return nil, hdr
+	}
+	traceID, parentID, ok := parseTraceParent(getHeader(TraceParentHdr, hdr))
+	if !ok {
+		return nil, hdr
+	}
+	sp := &otlpSpan{
+		TraceID:      traceID,
+		SpanID:       newSpanID(),
+		ParentSpanID: parentID,
+		Name:         name,
+		Kind:         otlpSpanKindInternal,
+		Start:        strconv.FormatInt(time.Now().UnixNano(), 10),
+	}
+	hdr = setHeaders(hdr, []string{TraceParentHdr}, TraceParentHdr, "00-"+traceID+"-"+sp.SpanID+"-01")
+	return sp, hdr
+}
+
+// end ends the span and queues it for export.
+func (t *tracer) end(sp *otlpSpan) {
+	sp.End = strconv.FormatInt(time.Now().UnixNano(), 10)
+	select {
+	case t.spans <- sp:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// startTracing starts exporting the spans of traced messages.
+func (s *Server) startTracing() {
+	t := s.tracer
+	s.Noticef("Exporting JetStream traces to %s", t.opts.Endpoint)
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		tick := time.NewTicker(tracingFlushInterval)
+		defer tick.Stop()
+		batch := make([]*otlpSpan, 0, tracingBatchSize)
+		for {
+			select {
+			case sp := <-t.spans:
+				if batch = append(batch, sp); len(batch) < tracingBatchSize {
+					continue
+				}
+			case <-tick.C:
+				if dropped := atomic.SwapUint64(&t.dropped, 0); dropped > 0 {
+					s.Warnf("Dropped %d JetStream trace spans, export not keeping up", dropped)
+				}
+				if len(batch) == 0 {
+					continue
+				}
+			case <-s.quitCh:
+				return
+			}
+			if err := t.export(batch); err != nil {
+				s.Warnf("Error exporting %d JetStream trace spans: %v", len(batch), err)
+			}
+			batch = batch[:0]
+		}
+	})
+}
+
+// export sends the spans to the collector.
+func (t *tracer) export(spans []*otlpSpan) error {
+	service := t.opts.serviceName()
+	req := &otlpExportRequest{ResourceSpans: []*otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: &service}}}},
+		ScopeSpans: []*otlpScopeSpans{{
+			Scope: otlpScope{Name: "nats-server", Version: VERSION},
+			Spans: spans,
+		}},
+	}}}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.opts.Endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// traceDelivery starts the span of the delivery of a traced message and
+// returns its updated header. The span of a previous delivery of the
+// message is ended as redelivered.
+// Lock should be held.
+func (o *Consumer) traceDelivery(hdr []byte, seq, dcount uint64) []byte {
+	o.endDelivery(seq, traceRedelivered)
+	if o.config.AckPolicy != AckNone && len(o.traces) >= maxTracedDeliveries {
+		return hdr
+	}
+	sp, hdr := o.tracer.startSpan("jetstream.deliver", hdr)
+	if sp == nil {
+		return hdr
+	}
+	sp.setString("nats.stream", o.stream)
+	sp.setString("nats.consumer", o.name)
+	sp.setInt("nats.stream_sequence", seq)
+	sp.setInt("nats.consumer_sequence", o.dseq)
+	sp.setInt("nats.deliveries", dcount)
+	if o.config.AckPolicy == AckNone {
+		sp.setString("nats.ack", traceNoAck)
+		o.tracer.end(sp)
+		return hdr
+	}
+	if o.traces == nil {
+		o.traces = make(map[uint64]*otlpSpan)
+	}
+	o.traces[seq] = sp
+	return hdr
+}
+
+// endDelivery ends the span of the delivery of the message, if traced,
+// with its outcome.
+// Lock should be held.
+func (o *Consumer) endDelivery(seq uint64, outcome string) {
+	sp := o.traces[seq]
+	if sp == nil {
+		return
+	}
+	delete(o.traces, seq)
+	sp.setString("nats.ack", outcome)
+	o.tracer.end(sp)
+}
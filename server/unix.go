@@ -0,0 +1,110 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// UnixSocketOpts are options for the unix domain socket listener of local
+// clients. Who can connect is controlled by the permissions of the socket
+// file, and those clients can be authenticated as NoAuthUser without
+// credentials. Windows 10 and later support unix domain sockets as well.
+type UnixSocketOpts struct {
+	// Path of the socket file.
+	Path string
+	// Mode of the socket file, DEFAULT_UNIX_SOCKET_MODE if not set.
+	Mode os.FileMode
+	// If no user is provided when a client connects on the socket, will
+	// default to this user and associated account. This user has to exist
+	// in the global options.
+	NoAuthUser string
+}
+
+func validateUnixSocketOptions(o *Options) error {
+	uo := &o.UnixSocket
+	if uo.NoAuthUser == _EMPTY_ {
+		return nil
+	}
+	if uo.Path == _EMPTY_ {
+		return fmt.Errorf("unix socket no_auth_user %q requires a path", uo.NoAuthUser)
+	}
+	if len(o.TrustedOperators) > 0 {
+		return fmt.Errorf("unix socket no_auth_user not compatible with Trusted Operator")
+	}
+	for _, u := range o.Users {
+		if u.Username == uo.NoAuthUser {
+			return nil
+		}
+	}
+	return fmt.Errorf("unix socket no_auth_user %q not present as user in authorization block or account configuration",
+		uo.NoAuthUser)
+}
+
+// startUnixSocketListener listens for client connections on the unix socket.
+func (s *Server) startUnixSocketListener() {
+	o := &s.getOpts().UnixSocket
+
+	// Remove the socket file left over by a previous run, if any.
+	if fi, err := os.Lstat(o.Path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(o.Path)
+	}
+	l, err := net.Listen("unix", o.Path)
+	if err != nil {
+		s.Fatalf("Error listening on unix socket %q: %v", o.Path, err)
+		return
+	}
+	mode := o.Mode
+	if mode == 0 {
+		mode = DEFAULT_UNIX_SOCKET_MODE
+	}
+	if err := os.Chmod(o.Path, mode); err != nil {
+		l.Close()
+		s.Fatalf("Error setting mode of unix socket %q: %v", o.Path, err)
+		return
+	}
+	s.Noticef("Listening for local client connections on unix socket %s (mode %v)", o.Path, mode)
+
+	s.mu.Lock()
+	s.unixListener = l
+	s.mu.Unlock()
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		tmpDelay := ACCEPT_MIN_SLEEP
+		for s.isRunning() {
+			conn, err := l.Accept()
+			if err != nil {
+				if s.isLameDuckMode() {
+					// Signal that we are not accepting new clients
+					s.ldmCh <- true
+					// Now wait for the Shutdown...
+					<-s.quitCh
+					return
+				}
+				tmpDelay = s.acceptError("Unix socket", err, tmpDelay)
+				continue
+			}
+			tmpDelay = ACCEPT_MIN_SLEEP
+			s.startGoRoutine(func() {
+				s.createClient(conn, nil)
+				s.grWG.Done()
+			})
+		}
+		s.done <- true
+	})
+}
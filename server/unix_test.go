@@ -0,0 +1,89 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type unixDialer string
+
+func (d unixDialer) Dial(_, _ string) (net.Conn, error) {
+	return net.Dial("unix", string(d))
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unixsock")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "nats.sock")
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A: { users: [{user: sidecar, password: pwd}] }
+		}
+		unix_socket {
+			path: %q
+			mode: "0660"
+			no_auth_user: sidecar
+		}
+	`, sock)))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	if opts.UnixSocket.Mode != 0660 || opts.UnixSocket.NoAuthUser != "sidecar" {
+		t.Fatalf("Unexpected options: %+v", opts.UnixSocket)
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(sock)
+		if err != nil {
+			t.Fatalf("Error on stat: %v", err)
+		}
+		if fi.Mode().Perm() != 0660 {
+			t.Fatalf("Unexpected mode: %v", fi.Mode())
+		}
+	}
+
+	// Local clients are authenticated as sidecar without credentials.
+	nc := natsConnect(t, "nats://localhost", nats.SetCustomDialer(unixDialer(sock)))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "foo")
+	natsFlush(t, nc)
+	tcp := natsConnect(t, s.ClientURL(), nats.UserInfo("sidecar", "pwd"))
+	defer tcp.Close()
+	natsPub(t, tcp, "foo", []byte("hello"))
+	natsNexMsg(t, sub, time.Second)
+
+	// Not over TCP though.
+	if _, err := nats.Connect(s.ClientURL()); err == nil {
+		t.Fatal("Expected TCP connection without credentials to fail")
+	}
+
+	s.Shutdown()
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Fatalf("Socket file should have been removed: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Upgrade mode is used to roll a cluster to a new version with a single
+// request to $SYS.REQ.SERVER.PING.UPGRADE. Servers not yet running the
+// target version then take turns entering lame duck mode, one at a time,
+// and only once the cluster is healthy again.
+
+// How often servers in upgrade mode exchange their status and check if
+// it is their turn. Peers not heard from in 3 intervals are forgotten.
+var upgradeCheckInterval = time.Second
+
+// UpgradeOptions are the options for entering upgrade mode.
+type UpgradeOptions struct {
+	// Version is the version the cluster is upgraded to.
+	Version string `json:"version"`
+}
+
+// UpgradeStatus is the upgrade mode status of a server.
+type UpgradeStatus struct {
+	Version   string `json:"version"`
+	Current   string `json:"current"`
+	Upgrading bool   `json:"upgrading"`
+}
+
+// UpgradeStatusMsg is sent periodically by servers in upgrade mode.
+type UpgradeStatusMsg struct {
+	Server   ServerInfo `json:"server"`
+	Version  string     `json:"version"`
+	LameDuck bool       `json:"ldm,omitempty"`
+}
+
+// Tracks upgrade mode on this server.
+type upgradeState struct {
+	version string
+	// Number of routes when entering upgrade mode, the route mesh is
+	// considered complete when we are back to that many.
+	routes int
+	peers  map[string]*upgradePeer
+	tmr    *time.Timer
+	// Number of status sent, we wait to hear from peers before acting.
+	sent int
+}
+
+// A remote server in upgrade mode.
+type upgradePeer struct {
+	name  string
+	ldm   bool
+	ltime time.Time
+}
+
+// EnterUpgradeMode will have this server enter lame duck mode when it is
+// its turn to be upgraded to the given version. This is a no-op if the
+// server already runs that version.
+func (s *Server) EnterUpgradeMode(opts *UpgradeOptions) (*UpgradeStatus, error) {
+	if opts == nil || opts.Version == _EMPTY_ {
+		return nil, fmt.Errorf("upgrade version required")
+	}
+	st := &UpgradeStatus{Version: opts.Version, Current: VERSION}
+	if opts.Version == VERSION {
+		return st, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return nil, ErrNoSysAccount
+	}
+	st.Upgrading = true
+	if s.upgrade != nil {
+		if s.upgrade.version != opts.Version {
+			return nil, fmt.Errorf("upgrade to version %q already in progress", s.upgrade.version)
+		}
+		return st, nil
+	}
+	s.Noticef("Entering upgrade mode to version %q", opts.Version)
+	s.upgrade = &upgradeState{
+		version: opts.Version,
+		routes:  len(s.routes),
+		peers:   make(map[string]*upgradePeer),
+	}
+	s.upgrade.tmr = time.AfterFunc(upgradeCheckInterval, s.wrapChk(s.checkUpgradeTurn))
+	return st, nil
+}
+
+// checkUpgradeTurn sends our upgrade status and enters lame duck mode if
+// the cluster is healthy and no server before us is left to upgrade.
+// Lock should be held upon entry.
+func (s *Server) checkUpgradeTurn() {
+	u := s.upgrade
+	if u == nil || s.shutdown || s.ldm {
+		return
+	}
+	// Forget about servers that are gone, hopefully being upgraded.
+	for id, p := range u.peers {
+		if time.Since(p.ltime) > 3*upgradeCheckInterval {
+			delete(u.peers, id)
+		}
+	}
+	reason := s.upgradeNotReady()
+	if reason == _EMPTY_ && u.sent > 0 {
+		s.Noticef("Upgrade mode, entering lame duck mode to upgrade to version %q", u.version)
+		s.sendUpgradeStatus(true)
+		s.upgrade = nil
+		go s.lameDuckMode()
+		return
+	}
+	if reason != _EMPTY_ {
+		s.Debugf("Upgrade mode, waiting: %s", reason)
+	}
+	s.sendUpgradeStatus(false)
+	u.sent++
+	u.tmr.Reset(upgradeCheckInterval)
+}
+
+// upgradeNotReady returns why this server can not go down yet, if any.
+// Lock should be held upon entry.
+func (s *Server) upgradeNotReady() string {
+	u := s.upgrade
+	// The route mesh needs to be complete, any server restarted as part
+	// of the upgrade must be back.
+	if len(s.routes) < u.routes {
+		return fmt.Sprintf("route mesh incomplete, %d of %d routes", len(s.routes), u.routes)
+	}
+	for id, p := range u.peers {
+		if p.ldm {
+			return fmt.Sprintf("server %q in lame duck mode", p.name)
+		}
+		if _, ok := s.remotes[id]; !ok {
+			return fmt.Sprintf("no route to server %q", p.name)
+		}
+	}
+	// JetStream is standalone only for now, so there are no replicas that
+	// would lose their quorum. Servers restarting with JetStream enabled
+	// need to have recovered their state.
+	if js := s.js; js != nil && js.recoveryStatus().Recovering {
+		return "jetstream recovering"
+	}
+	// Servers go in order of their name.
+	for _, p := range u.peers {
+		if strings.Compare(p.name, s.info.Name) < 0 {
+			return fmt.Sprintf("server %q goes first", p.name)
+		}
+	}
+	return _EMPTY_
+}
+
+// Lock should be held upon entry.
+func (s *Server) sendUpgradeStatus(ldm bool) {
+	m := &UpgradeStatusMsg{Version: s.upgrade.version, LameDuck: ldm}
+	s.sendInternalMsg(fmt.Sprintf(upgradeEventSubj, s.info.ID), _EMPTY_, &m.Server, m)
+}
+
+// remoteUpgradeStatus is called when we get the upgrade status of another server.
+func (s *Server) remoteUpgradeStatus(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	var m UpgradeStatusMsg
+	if err := json.Unmarshal(msg, &m); err != nil {
+		s.Debugf("Received bad upgrade status: %v", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.upgrade
+	if u == nil || m.Server.ID == s.info.ID || m.Version != u.version {
+		return
+	}
+	// Only servers of our cluster take turns with us.
+	if s.gateway.enabled && m.Server.Cluster != s.getGatewayName() {
+		return
+	}
+	u.peers[m.Server.ID] = &upgradePeer{name: m.Server.Name, ldm: m.LameDuck, ltime: time.Now()}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestUpgradeMode(t *testing.T) {
+	orgInterval := upgradeCheckInterval
+	upgradeCheckInterval = 50 * time.Millisecond
+	defer func() { upgradeCheckInterval = orgInterval }()
+
+	upgradeOpts := func(name string, routeTo *Server) *Options {
+		o := DefaultOptions()
+		o.ServerName = name
+		o.LameDuckDuration = 50 * time.Millisecond
+		testSetLDMGracePeriod(o, time.Nanosecond)
+		o.Cluster.Host = "127.0.0.1"
+		if routeTo != nil {
+			o.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", routeTo.ClusterAddr().Port))
+		}
+		sys := NewAccount("SYS")
+		o.Accounts = []*Account{sys}
+		o.SystemAccount = "SYS"
+		o.Users = []*User{{Username: "sys", Password: "pwd", Account: sys}}
+		return o
+	}
+	checkShutdown := func(s *Server) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			if s.isRunning() {
+				return fmt.Errorf("Server %q still running", s.Name())
+			}
+			return nil
+		})
+	}
+
+	sB := RunServer(upgradeOpts("B", nil))
+	defer sB.Shutdown()
+	sA := RunServer(upgradeOpts("A", sB))
+	defer sA.Shutdown()
+	checkClusterFormed(t, sA, sB)
+
+	if _, err := sB.EnterUpgradeMode(&UpgradeOptions{}); err == nil {
+		t.Fatal("Expected error without version")
+	}
+	if st, err := sB.EnterUpgradeMode(&UpgradeOptions{Version: VERSION}); err != nil || st.Upgrading {
+		t.Fatalf("Expected no upgrade to the current version, got %+v, %v", st, err)
+	}
+
+	// Enter upgrade mode on all servers with a single request.
+	nc := natsConnect(t, sB.ClientURL(), nats.UserInfo("sys", "pwd"))
+	defer nc.Close()
+	inbox := nats.NewInbox()
+	sub := natsSubSync(t, nc, inbox)
+	req, _ := json.Marshal(&UpgradeOptions{Version: "99.0.0"})
+	if err := nc.PublishRequest("$SYS.REQ.SERVER.PING.UPGRADE", inbox, req); err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		var resp struct {
+			Data UpgradeStatus `json:"data"`
+		}
+		if err := json.Unmarshal(natsNexMsg(t, sub, time.Second).Data, &resp); err != nil {
+			t.Fatalf("Error unmarshalling response: %v", err)
+		}
+		if !resp.Data.Upgrading || resp.Data.Version != "99.0.0" || resp.Data.Current != VERSION {
+			t.Fatalf("Unexpected status: %+v", resp.Data)
+		}
+	}
+
+	// A goes first, and B waits for it to be back.
+	checkShutdown(sA)
+	time.Sleep(5 * upgradeCheckInterval)
+	if !sB.isRunning() || sB.isLameDuckMode() {
+		t.Fatal("Server B should wait for the route mesh to be complete")
+	}
+
+	sA = RunServer(upgradeOpts("A", sB))
+	defer sA.Shutdown()
+	checkShutdown(sB)
+	if !sA.isRunning() {
+		t.Fatal("Server A should still be running")
+	}
+}
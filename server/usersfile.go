@@ -0,0 +1,225 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/conf"
+)
+
+// Users of the global account can be kept in a file of their own, with a
+// "users" array as in the authorization block, in JSON or in the format of
+// the configuration. The server watches the file and, when it changes,
+// rebuilds its users and applies them to connected clients, without a
+// reload of the configuration. A file that can not be loaded is ignored,
+// the previous users being kept.
+
+// How often the users file is checked for changes.
+var usersFileCheckInterval = 2 * time.Second
+
+// usersFileStamp identifies a version of the users file.
+type usersFileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+// loadUsersFile parses the users of the file, which can not have the
+// username or nkey of another user of the file or of the options.
+func loadUsersFile(fn string, o *Options) ([]*NkeyUser, []*User, error) {
+	m, err := conf.ParseFileWithChecks(fn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("users file %q: %v", fn, err)
+	}
+	var (
+		errors   []error
+		warnings []error
+		nkeys    []*NkeyUser
+		users    []*User
+	)
+	for k, v := range m {
+		switch k {
+		case "users":
+			if nkeys, users, err = parseUsers(v, nil, &errors, &warnings); err != nil {
+				errors = append(errors, err)
+			}
+		default:
+			errors = append(errors, fmt.Errorf("unknown field %q", k))
+		}
+	}
+	if len(errors) > 0 {
+		return nil, nil, fmt.Errorf("users file %q: %v", fn, errors[0])
+	}
+	if err := checkUsersFileDuplicates(o, nkeys, users); err != nil {
+		return nil, nil, fmt.Errorf("users file %q: %v", fn, err)
+	}
+	return nkeys, users, nil
+}
+
+// checkUsersFileDuplicates returns an error if a user of the file has the
+// username or nkey of another user, so that it can not replace a user of
+// the options.
+func checkUsersFileDuplicates(o *Options, nkeys []*NkeyUser, users []*User) error {
+	uorn := optsUsersOrNkeys(o)
+	for _, u := range nkeys {
+		if _, ok := uorn[u.Nkey]; ok {
+			return fmt.Errorf("duplicate nkey %q detected", u.Nkey)
+		}
+		uorn[u.Nkey] = struct{}{}
+	}
+	for _, u := range users {
+		if _, ok := uorn[u.Username]; ok {
+			return fmt.Errorf("duplicate user %q detected", u.Username)
+		}
+		uorn[u.Username] = struct{}{}
+	}
+	return nil
+}
+
+// optsUsersOrNkeys returns the usernames and nkeys of the users of the
+// options.
+func optsUsersOrNkeys(o *Options) map[string]struct{} {
+	uorn := make(map[string]struct{}, len(o.Users)+len(o.Nkeys))
+	for _, u := range o.Users {
+		uorn[u.Username] = struct{}{}
+	}
+	for _, u := range o.Nkeys {
+		uorn[u.Nkey] = struct{}{}
+	}
+	return uorn
+}
+
+func validateUsersFile(o *Options) error {
+	if o.UsersFile == _EMPTY_ {
+		return nil
+	}
+	if len(o.TrustedOperators) > 0 || len(o.TrustedKeys) > 0 {
+		return fmt.Errorf("users file can not be used with trusted operators")
+	}
+	_, _, err := loadUsersFile(o.UsersFile, o)
+	return err
+}
+
+// statUsersFile returns the stamp of the current version of the file.
+func statUsersFile(fn string) (usersFileStamp, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return usersFileStamp{}, err
+	}
+	return usersFileStamp{mod: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// loadUsersFileLocked loads the users of the file into the server, keeping
+// the previous ones on error.
+// Lock is held on entry.
+func (s *Server) loadUsersFileLocked(opts *Options) {
+	fn := opts.UsersFile
+	if fn == _EMPTY_ {
+		s.fileNkeys, s.fileUsers = nil, nil
+		s.usersFileStamp = usersFileStamp{}
+		return
+	}
+	stamp, err := statUsersFile(fn)
+	if err == nil {
+		var (
+			nkeys []*NkeyUser
+			users []*User
+		)
+		if nkeys, users, err = loadUsersFile(fn, opts); err == nil {
+			s.fileNkeys, s.fileUsers = nkeys, users
+		}
+	}
+	if err != nil {
+		s.Errorf("Error loading users file, keeping previous users: %v", err)
+	}
+	// Not retried until the file changes again.
+	s.usersFileStamp = stamp
+}
+
+// startUsersFileWatcher will reload the users of the file when it changes.
+func (s *Server) startUsersFileWatcher() {
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		t := time.NewTicker(usersFileCheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				fn := s.getOpts().UsersFile
+				if fn == _EMPTY_ {
+					continue
+				}
+				stamp, err := statUsersFile(fn)
+				s.mu.Lock()
+				changed := err == nil && stamp != s.usersFileStamp
+				s.mu.Unlock()
+				if changed {
+					s.reloadUsersFile()
+				}
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+// reloadUsersFile rebuilds the users with the ones of the file and applies
+// them to connected clients, disconnecting the ones that are not authorized
+// anymore and removing subscriptions that are not permitted anymore.
+func (s *Server) reloadUsersFile() {
+	s.mu.Lock()
+	s.configureAuthorization()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	s.Noticef("Reloaded: users file")
+	for _, c := range clients {
+		if !s.isClientAuthorized(c) {
+			c.authViolation()
+			continue
+		}
+		c.processSubsOnConfigReload(nil)
+	}
+}
+
+// usersFromOptions returns the users of the options and of the users file.
+// Users of the file kept after a failed load, that have the username or nkey
+// of a user of the options, are left out.
+// Lock is held on entry.
+func (s *Server) usersFromOptions(opts *Options) ([]*NkeyUser, []*User) {
+	nkeys, users := opts.Nkeys, opts.Users
+	if len(s.fileNkeys) == 0 && len(s.fileUsers) == 0 {
+		return nkeys, users
+	}
+	uorn := optsUsersOrNkeys(opts)
+	nkeys = nkeys[:len(nkeys):len(nkeys)]
+	for _, u := range s.fileNkeys {
+		if _, ok := uorn[u.Nkey]; !ok {
+			nkeys = append(nkeys, u)
+		}
+	}
+	users = users[:len(users):len(users)]
+	for _, u := range s.fileUsers {
+		if _, ok := uorn[u.Username]; !ok {
+			users = append(users, u)
+		}
+	}
+	return nkeys, users
+}
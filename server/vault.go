@@ -0,0 +1,357 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Any value of the configuration can reference a secret of the key/value
+// engine of HashiCorp Vault, as vault:<path>#<key>, such as
+// vault:secret/nats/users#password. Without a key, the value is the one of
+// the only key "value" of the secret, or else the whole secret, so that
+// lists of users or permissions can be kept in Vault too. References are
+// resolved each time the configuration is loaded, at startup and on
+// reload. The settings of Vault are in the vault block of the
+// configuration, or in the usual VAULT_* environment variables:
+//
+//	vault {
+//	    address: "https://vault.example.com:8200"
+//	    token_file: "/run/secrets/vault-token"
+//	    namespace: "nats"
+//	    kv_version: 2
+//	    ca_file: "/etc/vault/ca.pem"
+//	    timeout: "5s"
+//	}
+
+const (
+	// Prefix of the values referencing a secret of Vault.
+	vaultPrefix = "vault:"
+	// Default timeout of requests to Vault.
+	vaultDefaultTimeout = 10 * time.Second
+	// Default version of the key/value engine.
+	vaultDefaultKVVersion = 2
+
+	// Environment variables of the settings of Vault, as used by its
+	// command line.
+	vaultAddrEnv      = "VAULT_ADDR"
+	vaultTokenEnv     = "VAULT_TOKEN"
+	vaultNamespaceEnv = "VAULT_NAMESPACE"
+)
+
+// vaultClient reads secrets of the key/value engine of Vault.
+type vaultClient struct {
+	addr      string
+	token     string
+	namespace string
+	kvVersion int
+	client    *http.Client
+	// Secrets already read, by path.
+	secrets map[string]map[string]interface{}
+}
+
+// resolvedToken replaces the token of a value referencing a secret by the
+// value of the secret, keeping its location for error reporting.
+type resolvedToken struct {
+	token
+	value interface{}
+}
+
+func (t *resolvedToken) Value() interface{} {
+	return t.value
+}
+
+// configureVault replaces, in place, the values of the parsed configuration
+// referencing secrets of Vault by the values of the secrets. Vault is only
+// contacted if there is such a reference.
+func configureVault(m map[string]interface{}) (retErr error) {
+	var lt token
+	defer convertPanicToError(&lt, &retErr)
+
+	var vc *vaultClient
+	var resolve func(v interface{}) (interface{}, error)
+	resolve = func(v interface{}) (interface{}, error) {
+		tk, uv := unwrapValue(v, &lt)
+		switch uv := uv.(type) {
+		case string:
+			if !strings.HasPrefix(uv, vaultPrefix) {
+				return v, nil
+			}
+			if vc == nil {
+				var err error
+				if vc, err = newVaultClient(m["vault"]); err != nil {
+					return nil, err
+				}
+			}
+			sv, err := vc.resolve(strings.TrimPrefix(uv, vaultPrefix))
+			if err != nil {
+				if tk == nil {
+					return nil, err
+				}
+				return nil, &configErr{tk, err.Error()}
+			}
+			if tk == nil {
+				return sv, nil
+			}
+			return vaultTokens(tk, sv), nil
+		case map[string]interface{}:
+			for k, mv := range uv {
+				rv, err := resolve(mv)
+				if err != nil {
+					return nil, err
+				}
+				uv[k] = rv
+			}
+		case []interface{}:
+			for i, av := range uv {
+				rv, err := resolve(av)
+				if err != nil {
+					return nil, err
+				}
+				uv[i] = rv
+			}
+		}
+		return v, nil
+	}
+	for k, v := range m {
+		if strings.ToLower(k) == "vault" {
+			continue
+		}
+		rv, err := resolve(v)
+		if err != nil {
+			return err
+		}
+		m[k] = rv
+	}
+	return nil
+}
+
+// newVaultClient returns a client with the settings of the vault block of
+// the configuration, if any, and of the environment.
+func newVaultClient(v interface{}) (vc *vaultClient, retErr error) {
+	var lt token
+	defer convertPanicToError(&lt, &retErr)
+
+	vc = &vaultClient{
+		addr:      os.Getenv(vaultAddrEnv),
+		token:     os.Getenv(vaultTokenEnv),
+		namespace: os.Getenv(vaultNamespaceEnv),
+		kvVersion: vaultDefaultKVVersion,
+		secrets:   make(map[string]map[string]interface{}),
+	}
+	timeout := vaultDefaultTimeout
+	var tlsConfig *tls.Config
+	if v != nil {
+		tk, v := unwrapValue(v, &lt)
+		vm, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, &configErr{tk, fmt.Sprintf("Expected vault to be a map, got %T", v)}
+		}
+		for mk, mv := range vm {
+			tk, mv = unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "address", "addr", "url":
+				vc.addr = mv.(string)
+			case "token":
+				vc.token = mv.(string)
+			case "token_file":
+				data, err := ioutil.ReadFile(mv.(string))
+				if err != nil {
+					return nil, &configErr{tk, fmt.Sprintf("error reading vault token file: %v", err)}
+				}
+				vc.token = strings.TrimSpace(string(data))
+			case "namespace":
+				vc.namespace = mv.(string)
+			case "kv_version":
+				vc.kvVersion = int(mv.(int64))
+				if vc.kvVersion != 1 && vc.kvVersion != 2 {
+					return nil, &configErr{tk, fmt.Sprintf("vault kv_version must be 1 or 2, got %d", vc.kvVersion)}
+				}
+			case "ca_file":
+				rootPEM, err := ioutil.ReadFile(mv.(string))
+				if err != nil {
+					return nil, &configErr{tk, fmt.Sprintf("error reading vault ca_file: %v", err)}
+				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(rootPEM) {
+					return nil, &configErr{tk, "failed to parse vault ca_file"}
+				}
+				tlsConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+			case "timeout":
+				var errs, warns []error
+				if timeout = parseDuration(mk, tk, mv, &errs, &warns); len(errs) > 0 {
+					return nil, errs[0]
+				}
+			default:
+				if !tk.IsUsedVariable() {
+					return nil, &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+				}
+			}
+		}
+	}
+	if vc.addr == _EMPTY_ {
+		return nil, fmt.Errorf("vault reference requires an address, set in the vault block or with %s", vaultAddrEnv)
+	}
+	if vc.token == _EMPTY_ {
+		return nil, fmt.Errorf("vault reference requires a token, set in the vault block or with %s", vaultTokenEnv)
+	}
+	vc.addr = strings.TrimSuffix(vc.addr, "/")
+	vc.client = &http.Client{Timeout: timeout}
+	if tlsConfig != nil {
+		vc.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	return vc, nil
+}
+
+// resolve returns the value of a reference, path#key, to a secret.
+func (vc *vaultClient) resolve(ref string) (interface{}, error) {
+	path, key := ref, _EMPTY_
+	if i := strings.LastIndexByte(ref, '#'); i >= 0 {
+		path, key = ref[:i], ref[i+1:]
+	}
+	path = strings.Trim(path, "/")
+	if path == _EMPTY_ {
+		return nil, fmt.Errorf("invalid vault reference %q", ref)
+	}
+	secret, err := vc.secret(path)
+	if err != nil {
+		return nil, err
+	}
+	if key != _EMPTY_ {
+		v, ok := secret[key]
+		if !ok {
+			return nil, fmt.Errorf("no key %q in vault secret %q", key, path)
+		}
+		return v, nil
+	}
+	if v, ok := secret["value"]; ok && len(secret) == 1 {
+		return v, nil
+	}
+	return secret, nil
+}
+
+// secret returns the data of the secret at the path.
+func (vc *vaultClient) secret(path string) (map[string]interface{}, error) {
+	if secret, ok := vc.secrets[path]; ok {
+		return secret, nil
+	}
+	apiPath := path
+	if vc.kvVersion == 2 {
+		// The data of version 2 secrets is under data/ in their mount.
+		if i := strings.IndexByte(path, '/'); i > 0 {
+			apiPath = path[:i] + "/data" + path[i:]
+		}
+	}
+	u := vc.addr + "/v1/" + (&url.URL{Path: apiPath}).EscapedPath()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vault address: %v", err)
+	}
+	req.Header.Set("X-Vault-Token", vc.token)
+	if vc.namespace != _EMPTY_ {
+		req.Header.Set("X-Vault-Namespace", vc.namespace)
+	}
+	resp, err := vc.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error reading vault secret %q: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading vault secret %q: %v", path, err)
+	}
+	var r struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []string               `json:"errors"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&r); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("error decoding vault secret %q: %v", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(r.Errors) > 0 {
+			return nil, fmt.Errorf("error reading vault secret %q: %s: %s", path, resp.Status, strings.Join(r.Errors, ", "))
+		}
+		return nil, fmt.Errorf("error reading vault secret %q: %s", path, resp.Status)
+	}
+	data := r.Data
+	if vc.kvVersion == 2 {
+		data, _ = data["data"].(map[string]interface{})
+	}
+	if data == nil {
+		return nil, fmt.Errorf("vault secret %q has no data", path)
+	}
+	secret := vaultConfigValue(data).(map[string]interface{})
+	vc.secrets[path] = secret
+	return secret, nil
+}
+
+// vaultTokens returns the value of a secret with its values, nested ones
+// included, wrapped in tokens of the location of the reference, as parsed
+// values are.
+func vaultTokens(tk token, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, mv := range v {
+			m[k] = vaultTokens(tk, mv)
+		}
+		return &resolvedToken{tk, m}
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, av := range v {
+			a[i] = vaultTokens(tk, av)
+		}
+		return &resolvedToken{tk, a}
+	}
+	return &resolvedToken{tk, v}
+}
+
+// vaultConfigValue converts a JSON value to the types of the values of the
+// parsed configuration, where numbers are integers when they can be.
+func vaultConfigValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, mv := range v {
+			v[k] = vaultConfigValue(mv)
+		}
+	case []interface{}:
+		for i, av := range v {
+			v[i] = vaultConfigValue(av)
+		}
+	}
+	return v
+}
@@ -0,0 +1,206 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+// testVault serves secrets of a version 1 key/value engine mounted at kv/
+// and of a version 2 one mounted at secret/.
+type testVault struct {
+	sync.Mutex
+	*httptest.Server
+	secrets  map[string]map[string]interface{}
+	requests int
+}
+
+func runTestVault(t *testing.T, secrets map[string]map[string]interface{}) *testVault {
+	t.Helper()
+	tv := &testVault{secrets: secrets}
+	tv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tv.Lock()
+		defer tv.Unlock()
+		tv.requests++
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/v1/")
+		var resp interface{}
+		switch {
+		case strings.HasPrefix(path, "kv/"):
+			if data, ok := tv.secrets[path]; ok {
+				resp = map[string]interface{}{"data": data}
+			}
+		case strings.HasPrefix(path, "secret/data/"):
+			if data, ok := tv.secrets["secret/"+strings.TrimPrefix(path, "secret/data/")]; ok {
+				resp = map[string]interface{}{"data": map[string]interface{}{"data": data, "metadata": map[string]interface{}{"version": 1}}}
+			}
+		}
+		if resp == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	return tv
+}
+
+func (tv *testVault) set(path, key string, value interface{}) {
+	tv.Lock()
+	tv.secrets[path][key] = value
+	tv.Unlock()
+}
+
+func TestVaultInConfig(t *testing.T) {
+	cert, err := ioutil.ReadFile("../test/configs/certs/server-cert.pem")
+	if err != nil {
+		t.Fatalf("Error reading certificate: %v", err)
+	}
+	key, err := ioutil.ReadFile("../test/configs/certs/server-key.pem")
+	if err != nil {
+		t.Fatalf("Error reading key: %v", err)
+	}
+	tv := runTestVault(t, map[string]map[string]interface{}{
+		"secret/nats/auth": {
+			"users": []interface{}{
+				map[string]interface{}{"user": "a", "password": "apwd"},
+				map[string]interface{}{"user": "b", "password": "bpwd", "permissions": map[string]interface{}{"publish": "b.>"}},
+			},
+			"max_conn": 42,
+		},
+		"secret/nats/tls": {"cert": string(cert), "key": string(key)},
+		"kv/nats/leaf":    {"value": "leafpwd"},
+	})
+	defer tv.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		vault { address: %q, token: "root" }
+		authorization { users: "vault:secret/nats/auth#users" }
+		max_connections: "vault:secret/nats/auth#max_conn"
+		tls {
+			cert: "vault:secret/nats/tls#cert"
+			key: "vault:secret/nats/tls#key"
+		}
+	`, tv.URL)))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if len(opts.Users) != 2 || opts.Users[1].Username != "b" || opts.Users[1].Password != "bpwd" ||
+		opts.Users[1].Permissions.Publish.Allow[0] != "b.>" {
+		t.Fatalf("Unexpected users: %+v", opts.Users)
+	}
+	if opts.MaxConn != 42 {
+		t.Fatalf("Expected max connections of 42, got %v", opts.MaxConn)
+	}
+	if opts.TLSConfig == nil || len(opts.TLSConfig.Certificates) != 1 {
+		t.Fatal("Expected TLS configured with the certificate of Vault")
+	}
+	// Secrets are read once per configuration.
+	if tv.requests != 2 {
+		t.Fatalf("Expected 2 requests, got %v", tv.requests)
+	}
+
+	// Version 1 engine, and a secret with a single value.
+	conf2 := createConfFile(t, []byte(fmt.Sprintf(`
+		vault { address: %q, token: "root", kv_version: 1 }
+		leafnodes { authorization { user: leaf, password: "vault:kv/nats/leaf" } }
+	`, tv.URL)))
+	defer os.Remove(conf2)
+	opts, err = ProcessConfigFile(conf2)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.LeafNode.Password != "leafpwd" {
+		t.Fatalf("Expected password from Vault, got %q", opts.LeafNode.Password)
+	}
+
+	for _, test := range []struct {
+		name  string
+		vault string
+		value string
+		err   string
+	}{
+		{"missing key", fmt.Sprintf(`vault { address: %q, token: "root" }`, tv.URL), "vault:secret/nats/auth#password", `no key "password"`},
+		{"unknown secret", fmt.Sprintf(`vault { address: %q, token: "root" }`, tv.URL), "vault:secret/nats/other#password", "404"},
+		{"wrong token", fmt.Sprintf(`vault { address: %q, token: "other" }`, tv.URL), "vault:secret/nats/auth#users", "permission denied"},
+		{"no address", ``, "vault:secret/nats/auth#users", vaultAddrEnv},
+		{"no token", fmt.Sprintf(`vault { address: %q }`, tv.URL), "vault:secret/nats/auth#users", vaultTokenEnv},
+		{"bad kv version", fmt.Sprintf(`vault { address: %q, token: "root", kv_version: 3 }`, tv.URL), "vault:secret/nats/auth#users", "kv_version"},
+		{"unknown field", fmt.Sprintf(`vault { address: %q, token: "root", bad: 1 }`, tv.URL), "vault:secret/nats/auth#users", "bad"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf("%s\nauthorization { token: %q }", test.vault, test.value)))
+			defer os.Remove(conf)
+			if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error about %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestVaultReload(t *testing.T) {
+	tv := runTestVault(t, map[string]map[string]interface{}{
+		"secret/nats/auth": {"password": "pwd"},
+	})
+	defer tv.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		vault { address: %q, token: "root" }
+		authorization { user: a, password: "vault:secret/nats/auth#password" }
+	`, tv.URL)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	connect := func(pwd string) error {
+		nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("a", pwd), nats.MaxReconnects(0))
+		if err == nil {
+			nc.Close()
+		}
+		return err
+	}
+	if err := connect("pwd"); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+
+	// Passwords rotated in Vault are used on reload.
+	tv.set("secret/nats/auth", "password", "pwd2")
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	if err := connect("pwd"); err == nil {
+		t.Fatal("Expected old password to be rejected")
+	}
+	if err := connect("pwd2"); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Work queue streams can set visibility timeouts for groups of subjects.
+// A message of a group that is delivered and not acknowledged within the
+// timeout of its group returns to the queue, whatever the AckWait of the
+// consumer it was delivered to, so that the time a message stays invisible
+// is set once for all the consumers of the queue.
+
+// VisibilityGroup is the visibility timeout of messages on subjects
+// matching the subject.
+type VisibilityGroup struct {
+	Subject string        `json:"subject"`
+	Timeout time.Duration `json:"timeout"`
+}
+
+// checkVisibilityCfg validates the visibility groups of the configuration.
+func checkVisibilityCfg(cfg *StreamConfig) error {
+	if len(cfg.Visibility) == 0 {
+		return nil
+	}
+	if cfg.Retention != WorkQueuePolicy {
+		return fmt.Errorf("stream visibility timeouts require work queue retention policy")
+	}
+	seen := make(map[string]struct{}, len(cfg.Visibility))
+	for _, g := range cfg.Visibility {
+		if g == nil || !IsValidSubject(g.Subject) {
+			return fmt.Errorf("stream visibility group requires a valid subject")
+		}
+		if _, ok := seen[g.Subject]; ok {
+			return fmt.Errorf("duplicate stream visibility group %q", g.Subject)
+		}
+		seen[g.Subject] = struct{}{}
+		if g.Timeout <= 0 {
+			return fmt.Errorf("stream visibility group %q requires a positive timeout", g.Subject)
+		}
+	}
+	return nil
+}
+
+// visibilityTimeout returns the timeout of the first group matching the
+// subject, or 0 if none does.
+func visibilityTimeout(groups []*VisibilityGroup, subj string) time.Duration {
+	for _, g := range groups {
+		if subjectIsSubsetMatch(subj, g.Subject) {
+			return g.Timeout
+		}
+	}
+	return 0
+}
+
+// trackVisibility records the visibility timeout of the delivered message.
+// Lock should be held.
+func (o *Consumer) trackVisibility(seq uint64, subj string) {
+	if t := visibilityTimeout(o.vgroups, subj); t > 0 {
+		if o.vis == nil {
+			o.vis = make(map[uint64]int64)
+		}
+		o.vis[seq] = int64(t)
+	} else if o.vis != nil {
+		delete(o.vis, seq)
+	}
+}
+
+// pendingTTL returns how long the pending message waits for its ack.
+// Lock should be held.
+func (o *Consumer) pendingTTL(seq uint64) int64 {
+	if t, ok := o.vis[seq]; ok {
+		return t
+	}
+	return int64(o.config.AckWait)
+}
+
+// minPendingTTL returns the shortest time pending messages wait for their
+// ack.
+// Lock should be held.
+func (o *Consumer) minPendingTTL() time.Duration {
+	ttl := o.config.AckWait
+	for _, g := range o.vgroups {
+		if g.Timeout < ttl {
+			ttl = g.Timeout
+		}
+	}
+	return ttl
+}
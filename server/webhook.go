@@ -0,0 +1,394 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhooks deliver the messages of a stream to an HTTP endpoint, in order,
+// with a durable pull consumer named after the webhook. Each message is
+// the body of a POST request, with its headers prefixed with Nats-Header-
+// and its subject, stream, sequence and time in the Nats-Subject,
+// Nats-Stream, Nats-Sequence and Nats-Time headers. A message is
+// acknowledged on a 2xx response. Other responses and errors are retried
+// with an exponential backoff, except client errors other than 408 and
+// 429, and the message is terminated once the retries are exhausted.
+//
+// With a secret, requests are signed in the Nats-Webhook-Signature header
+// with t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">.
+
+const (
+	// WebhookSignatureHeader is the header of the signature of requests.
+	WebhookSignatureHeader = "Nats-Webhook-Signature"
+
+	webhookDefaultTimeout      = 10 * time.Second
+	webhookDefaultMaxRetries   = 5
+	webhookDefaultRetryBackoff = time.Second
+	webhookMaxRetryBackoff     = time.Minute
+	// Interval at which an idle webhook checks for messages, or for its
+	// stream when it does not exist.
+	webhookPollInterval = 250 * time.Millisecond
+)
+
+// WebhookOpts are options of a webhook delivering the messages of a stream.
+type WebhookOpts struct {
+	// Name of the webhook, also the name of its durable consumer.
+	Name string
+	// Account of the stream. Defaults to the global account.
+	Account string
+	// Stream whose messages are delivered.
+	Stream string
+	// FilterSubject restricts the messages delivered to the ones on this
+	// subject.
+	FilterSubject string
+	// URL receiving the messages.
+	URL string
+	// Headers added to the requests.
+	Headers map[string]string
+	// Secret signs the requests when set.
+	Secret string
+	// Timeout of requests. Defaults to 10 seconds.
+	Timeout time.Duration
+	// MaxRetries is the number of retries of a failed request before the
+	// message is terminated. Defaults to 5, a negative value disables retries.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubled for each
+	// following one up to a minute. Defaults to one second.
+	RetryBackoff time.Duration
+	// RateLimit caps the number of requests per second when positive.
+	RateLimit float64
+}
+
+func (wo *WebhookOpts) timeout() time.Duration {
+	if wo.Timeout > 0 {
+		return wo.Timeout
+	}
+	return webhookDefaultTimeout
+}
+
+func (wo *WebhookOpts) maxRetries() int {
+	switch {
+	case wo.MaxRetries < 0:
+		return 0
+	case wo.MaxRetries == 0:
+		return webhookDefaultMaxRetries
+	}
+	return wo.MaxRetries
+}
+
+func (wo *WebhookOpts) retryBackoff() time.Duration {
+	if wo.RetryBackoff > 0 {
+		return wo.RetryBackoff
+	}
+	return webhookDefaultRetryBackoff
+}
+
+// ackWait returns the ack wait of the consumer, long enough for all the
+// attempts of a message to be made before it is redelivered.
+func (wo *WebhookOpts) ackWait() time.Duration {
+	retries := wo.maxRetries()
+	wait := time.Duration(retries+1)*wo.timeout() + 30*time.Second
+	for i, backoff := 0, wo.retryBackoff(); i < retries; i++ {
+		wait += backoff
+		if backoff *= 2; backoff > webhookMaxRetryBackoff {
+			backoff = webhookMaxRetryBackoff
+		}
+	}
+	return wait
+}
+
+func validateWebhookOptions(o *Options) error {
+	if len(o.Webhooks) == 0 {
+		return nil
+	}
+	if !o.JetStream {
+		return fmt.Errorf("webhooks require jetstream to be enabled")
+	}
+	names := make(map[string]struct{}, len(o.Webhooks))
+	for _, wo := range o.Webhooks {
+		if wo.Name == _EMPTY_ || strings.ContainsAny(wo.Name, ".*> \t") {
+			return fmt.Errorf("webhook name %q is invalid", wo.Name)
+		}
+		if _, ok := names[wo.Name]; ok {
+			return fmt.Errorf("duplicate webhook %q", wo.Name)
+		}
+		names[wo.Name] = struct{}{}
+		if wo.Stream == _EMPTY_ {
+			return fmt.Errorf("webhook %q requires a stream", wo.Name)
+		}
+		if u, err := url.Parse(wo.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == _EMPTY_ {
+			return fmt.Errorf("webhook %q url %q is invalid", wo.Name, wo.URL)
+		}
+		if wo.RateLimit < 0 {
+			return fmt.Errorf("webhook %q rate limit can not be negative", wo.Name)
+		}
+		if wo.Account == _EMPTY_ || wo.Account == globalAccountName || len(o.TrustedOperators) > 0 {
+			continue
+		}
+		found := false
+		for _, a := range o.Accounts {
+			if a.Name == wo.Account {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("webhook %q account %q is not defined", wo.Name, wo.Account)
+		}
+	}
+	return nil
+}
+
+// webhookSignature returns the signature of a request with the body sent
+// at the time.
+func webhookSignature(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts + "."))
+	h.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// webhookStatusError is a response to a request that is not a success.
+type webhookStatusError struct {
+	status int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("unexpected response status %d", e.status)
+}
+
+// retryable returns false for client errors that do not change when the
+// request is retried.
+func (e *webhookStatusError) retryable() bool {
+	switch {
+	case e.status == http.StatusRequestTimeout, e.status == http.StatusTooManyRequests:
+		return true
+	case e.status >= 400 && e.status < 500:
+		return false
+	}
+	return true
+}
+
+// webhook is the state of a running webhook.
+type webhook struct {
+	srv    *Server
+	opts   *WebhookOpts
+	client *http.Client
+	o      *Consumer
+	// Time at which the rate limit allows the next request.
+	next time.Time
+	// Set while the stream can not be consumed, to warn once.
+	waiting bool
+}
+
+// startWebhooks starts delivering the messages of the configured webhooks.
+func (s *Server) startWebhooks() {
+	for _, wo := range s.getOpts().Webhooks {
+		wh := &webhook{
+			srv:    s,
+			opts:   wo,
+			client: &http.Client{Timeout: wo.timeout()},
+		}
+		s.Noticef("Starting webhook %q for stream %q to %s", wo.Name, wo.Stream, wo.URL)
+		s.startGoRoutine(wh.run)
+	}
+}
+
+// webhookWait waits for the duration, returning false if the context is
+// done first.
+func webhookWait(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (wh *webhook) run() {
+	s := wh.srv
+	defer s.grWG.Done()
+
+	// Cancel pending requests and waits on shutdown.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.quitCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		if wh.o == nil {
+			o, err := wh.consumer()
+			if err != nil {
+				if !wh.waiting {
+					s.Warnf("Webhook %q waiting for stream %q: %v", wh.opts.Name, wh.opts.Stream, err)
+					wh.waiting = true
+				}
+				if !webhookWait(ctx, webhookPollInterval) {
+					return
+				}
+				continue
+			}
+			if wh.waiting {
+				s.Noticef("Webhook %q consuming stream %q", wh.opts.Name, wh.opts.Stream)
+				wh.waiting = false
+			}
+			wh.o = o
+		}
+		msgs, err := wh.o.Fetch(1)
+		if err != nil {
+			// The stream or the consumer were deleted.
+			wh.o = nil
+		}
+		if len(msgs) == 0 {
+			if !webhookWait(ctx, webhookPollInterval) {
+				return
+			}
+			continue
+		}
+		if !wh.deliver(ctx, msgs[0]) {
+			return
+		}
+	}
+}
+
+// consumer returns the durable consumer of the webhook, creating it if
+// needed.
+func (wh *webhook) consumer() (*Consumer, error) {
+	s := wh.srv
+	acc := s.GlobalAccount()
+	if wh.opts.Account != _EMPTY_ {
+		var err error
+		if acc, err = s.LookupAccount(wh.opts.Account); err != nil {
+			return nil, err
+		}
+	}
+	mset, err := acc.LookupStream(wh.opts.Stream)
+	if err != nil {
+		return nil, err
+	}
+	if o := mset.LookupConsumer(wh.opts.Name); o != nil {
+		return o, nil
+	}
+	return mset.AddConsumer(&ConsumerConfig{
+		Durable:       wh.opts.Name,
+		AckPolicy:     AckExplicit,
+		AckWait:       wh.opts.ackWait(),
+		FilterSubject: wh.opts.FilterSubject,
+	})
+}
+
+// deliver sends the message until it succeeds or the retries are
+// exhausted. It returns false if the server is shutting down, leaving the
+// message to be redelivered.
+func (wh *webhook) deliver(ctx context.Context, m *ConsumerMsg) bool {
+	s := wh.srv
+	retries, backoff := wh.opts.maxRetries(), wh.opts.retryBackoff()
+	for attempt := 0; ; attempt++ {
+		if !wh.limit(ctx) {
+			return false
+		}
+		err := wh.post(ctx, m)
+		if err == nil {
+			wh.o.AckMsg(m)
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		se, ok := err.(*webhookStatusError)
+		if attempt >= retries || (ok && !se.retryable()) {
+			s.Warnf("Webhook %q dropping message %d of stream %q: %v", wh.opts.Name, m.Sequence, wh.opts.Stream, err)
+			wh.o.processTerm(m.Sequence, m.DeliverySeq, m.Deliveries)
+			return true
+		}
+		s.Debugf("Webhook %q failed to deliver message %d, retrying in %v: %v", wh.opts.Name, m.Sequence, backoff, err)
+		if !webhookWait(ctx, backoff) {
+			return false
+		}
+		if backoff *= 2; backoff > webhookMaxRetryBackoff {
+			backoff = webhookMaxRetryBackoff
+		}
+	}
+}
+
+// limit waits until the rate limit allows the next request.
+func (wh *webhook) limit(ctx context.Context) bool {
+	if wh.opts.RateLimit <= 0 {
+		return true
+	}
+	now := time.Now()
+	if wh.next.After(now) {
+		if !webhookWait(ctx, wh.next.Sub(now)) {
+			return false
+		}
+		now = wh.next
+	}
+	wh.next = now.Add(time.Duration(float64(time.Second) / wh.opts.RateLimit))
+	return true
+}
+
+// post sends the message to the URL of the webhook.
+func (wh *webhook) post(ctx context.Context, m *ConsumerMsg) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.opts.URL, bytes.NewReader(m.Data))
+	if err != nil {
+		return err
+	}
+	h := req.Header
+	restReplyHeader(h, m.Header)
+	if h.Get("Content-Type") == _EMPTY_ {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+	for k, v := range wh.opts.Headers {
+		h.Set(k, v)
+	}
+	h.Set("Nats-Subject", m.Subject)
+	h.Set("Nats-Stream", wh.opts.Stream)
+	h.Set("Nats-Sequence", strconv.FormatUint(m.Sequence, 10))
+	h.Set("Nats-Time", m.Time.UTC().Format(time.RFC3339Nano))
+	if wh.opts.Secret != _EMPTY_ {
+		h.Set(WebhookSignatureHeader, webhookSignature(wh.opts.Secret, time.Now(), m.Data))
+	}
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Drain some of the body so the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &webhookStatusError{status: resp.StatusCode}
+	}
+	return nil
+}
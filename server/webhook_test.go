@@ -0,0 +1,201 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	type request struct {
+		h    http.Header
+		body string
+	}
+	reqs := make(chan request, 10)
+	statuses := make(chan int, 10)
+	for _, status := range []int{500, 200, 400, 200} {
+		statuses <- status
+	}
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		reqs <- request{r.Header, string(body)}
+		select {
+		case status := <-statuses:
+			w.WriteHeader(status)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer hs.Close()
+
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := DefaultOptions()
+	opts.Cluster.Port = 0
+	opts.JetStream = true
+	opts.StoreDir = filepath.Join(dir, "js")
+	opts.Webhooks = []*WebhookOpts{{
+		Name:          "hook",
+		Stream:        "orders",
+		FilterSubject: "orders.new",
+		URL:           hs.URL,
+		Headers:       map[string]string{"X-Token": "abc"},
+		Secret:        "s3cr3t",
+		MaxRetries:    1,
+		RetryBackoff:  10 * time.Millisecond,
+	}}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	// The webhook waits for the stream to be created.
+	time.Sleep(2 * webhookPollInterval)
+	if _, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "orders", Subjects: []string{"orders.>"}}); err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	m := nats.NewMsg("orders.new")
+	m.Header.Set("Content-Type", "application/json")
+	m.Header.Set("Order", "1")
+	m.Data = []byte(`{"id":1}`)
+	nc.PublishMsg(m)
+	natsPub(t, nc, "orders.other", []byte("filtered"))
+	natsPub(t, nc, "orders.new", []byte("2"))
+	natsPub(t, nc, "orders.new", []byte("3"))
+
+	next := func() request {
+		t.Helper()
+		select {
+		case r := <-reqs:
+			return r
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected a request")
+		}
+		return request{}
+	}
+	// Retried after the server error.
+	for i := 0; i < 2; i++ {
+		r := next()
+		h := r.h
+		if r.body != `{"id":1}` || h.Get("Content-Type") != "application/json" || h.Get(RESTHeaderPrefix+"Order") != "1" ||
+			h.Get("X-Token") != "abc" || h.Get("Nats-Subject") != "orders.new" || h.Get("Nats-Stream") != "orders" ||
+			h.Get("Nats-Sequence") != "1" || h.Get("Nats-Time") == _EMPTY_ {
+			t.Fatalf("Unexpected request %v %q", h, r.body)
+		}
+		sig := h.Get(WebhookSignatureHeader)
+		ts, _ := strconv.ParseInt(strings.TrimPrefix(strings.Split(sig, ",")[0], "t="), 10, 64)
+		if sig != webhookSignature("s3cr3t", time.Unix(ts, 0), []byte(r.body)) {
+			t.Fatalf("Unexpected signature %q", sig)
+		}
+	}
+	// Not retried after the client error.
+	if r := next(); r.body != "2" || r.h.Get("Content-Type") != "application/octet-stream" || r.h.Get("Nats-Sequence") != "3" {
+		t.Fatalf("Unexpected request %v %q", r.h, r.body)
+	}
+	if r := next(); r.body != "3" {
+		t.Fatalf("Unexpected request %v %q", r.h, r.body)
+	}
+	select {
+	case r := <-reqs:
+		t.Fatalf("Unexpected request %v %q", r.h, r.body)
+	case <-time.After(3 * webhookPollInterval):
+	}
+}
+
+func TestWebhookConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		jetstream: enabled
+		webhooks: [
+			{
+				name: hook
+				stream: orders
+				filter_subject: "orders.new"
+				url: "https://example.com/hook"
+				headers: { Authorization: "Bearer x" }
+				secret: s3cr3t
+				timeout: "2s"
+				max_retries: 3
+				retry_backoff: "100ms"
+				rate_limit: 2.5
+			}
+		]
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if len(opts.Webhooks) != 1 {
+		t.Fatalf("Unexpected webhooks: %+v", opts.Webhooks)
+	}
+	wo := opts.Webhooks[0]
+	if wo.Name != "hook" || wo.Stream != "orders" || wo.FilterSubject != "orders.new" || wo.URL != "https://example.com/hook" ||
+		wo.Headers["Authorization"] != "Bearer x" || wo.Secret != "s3cr3t" || wo.Timeout != 2*time.Second ||
+		wo.MaxRetries != 3 || wo.RetryBackoff != 100*time.Millisecond || wo.RateLimit != 2.5 {
+		t.Fatalf("Unexpected options: %+v", wo)
+	}
+	if err := validateWebhookOptions(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, test := range []struct {
+		update func(o *Options)
+		err    string
+	}{
+		{func(o *Options) { o.JetStream = false }, "jetstream"},
+		{func(o *Options) { o.Webhooks[0].Name = "a.b" }, "name"},
+		{func(o *Options) { o.Webhooks = append(o.Webhooks, o.Webhooks[0]) }, "duplicate"},
+		{func(o *Options) { o.Webhooks[0].URL = "ftp://example.com" }, "url"},
+		{func(o *Options) { o.Webhooks[0].Account = "missing" }, "missing"},
+	} {
+		o := opts.Clone()
+		o.Webhooks = []*WebhookOpts{{}}
+		*o.Webhooks[0] = *wo
+		test.update(o)
+		if err := validateWebhookOptions(o); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected error about %s, got %v", test.err, err)
+		}
+	}
+
+	// Defaults and the rate limit.
+	wo = &WebhookOpts{RateLimit: 20}
+	if wo.timeout() != webhookDefaultTimeout || wo.maxRetries() != webhookDefaultMaxRetries ||
+		wo.retryBackoff() != webhookDefaultRetryBackoff || wo.ackWait() < 6*webhookDefaultTimeout {
+		t.Fatalf("Unexpected defaults")
+	}
+	wh := &webhook{opts: wo}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if !wh.limit(context.Background()) {
+			t.Fatalf("Unexpected cancellation")
+		}
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("Expected requests to be rate limited, took %v", d)
+	}
+}
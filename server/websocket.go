@@ -68,6 +68,7 @@ const (
 	wsCloseStatusPolicyViolation    = 1008
 	wsCloseStatusMessageTooBig      = 1009
 	wsCloseStatusInternalSrvError   = 1011
+	wsCloseStatusTryAgainLater      = 1013
 	wsCloseStatusTLSHandshake       = 1015
 
 	wsFirstFrame        = true
@@ -463,7 +464,8 @@ func (c *client) wsEnqueueCloseMessage(reason ClosedState) {
 		status = wsCloseStatusNormalClosure
 	case AuthenticationTimeout, AuthenticationViolation, SlowConsumerPendingBytes, SlowConsumerWriteDeadline,
 		MaxAccountConnectionsExceeded, MaxConnectionsExceeded, MaxControlLineExceeded, MaxSubscriptionsExceeded,
-		MissingAccount, AuthenticationExpired, Revocation:
+		MissingAccount, AuthenticationExpired, Revocation, InactivityTimeout,
+		AccountDrained, IPNotAllowed, TLSDowngrade:
 		status = wsCloseStatusPolicyViolation
 	case TLSHandshakeError:
 		status = wsCloseStatusTLSHandshake
@@ -473,6 +475,8 @@ func (c *client) wsEnqueueCloseMessage(reason ClosedState) {
 		status = wsCloseStatusMessageTooBig
 	case ServerShutdown:
 		status = wsCloseStatusGoingAway
+	case MaintenanceMode:
+		status = wsCloseStatusTryAgainLater
 	case WriteError, ReadError, StaleConnection:
 		status = wsCloseStatusAbnormalClosure
 	default:
@@ -834,6 +838,9 @@ func (s *Server) startWebsocketServer() {
 	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			s.recordTLSHandshake("websocket", r.TLS.DidResume)
+		}
 		res, err := s.wsUpgrade(w, r)
 		if err != nil {
 			s.Errorf(err.Error())
@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -28,6 +30,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -5886,6 +5889,108 @@ func TestJetStreamAPIConsumerListPaging(t *testing.T) {
 	checkResp(reqList(consumersNum-22), 22, consumersNum-22)
 }
 
+func TestJetStreamAPIListCursorAndChanges(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	// Forced cleanup of all persisted state.
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	for _, name := range []string{"A", "B", "C"} {
+		if _, err := acc.AddStream(&server.StreamConfig{Name: name}); err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+	}
+
+	// Client for API requests.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	reqStreams := func(req server.ApiPagedRequest) *server.JSApiStreamNamesResponse {
+		t.Helper()
+		b, _ := json.Marshal(&server.JSApiStreamNamesRequest{ApiPagedRequest: req})
+		resp, err := nc.Request(server.JSApiStreams, b, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error getting stream list: %v", err)
+		}
+		var listResponse server.JSApiStreamNamesResponse
+		if err := json.Unmarshal(resp.Data, &listResponse); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &listResponse
+	}
+
+	// Cursor past the first stream.
+	resp := reqStreams(server.ApiPagedRequest{After: "A"})
+	if !reflect.DeepEqual(resp.Streams, []string{"B", "C"}) || resp.Offset != 1 || resp.Next != "" {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	// Offset out of range returns an empty page.
+	if resp := reqStreams(server.ApiPagedRequest{Offset: 10}); resp.Error != nil || len(resp.Streams) != 0 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+
+	rev := reqStreams(server.ApiPagedRequest{}).Revision
+	if rev == 0 {
+		t.Fatalf("Expected a revision")
+	}
+	if resp := reqStreams(server.ApiPagedRequest{Since: rev}); len(resp.Streams) != 0 || len(resp.Deleted) != 0 || resp.Revision != rev {
+		t.Fatalf("Expected no changes, got %+v", resp)
+	}
+
+	mset, _ := acc.LookupStream("B")
+	if err := mset.Update(&server.StreamConfig{Name: "B", MaxMsgs: 10}); err != nil {
+		t.Fatalf("Unexpected error updating stream: %v", err)
+	}
+	mset, _ = acc.LookupStream("C")
+	if err := mset.Delete(); err != nil {
+		t.Fatalf("Unexpected error deleting stream: %v", err)
+	}
+	resp = reqStreams(server.ApiPagedRequest{Since: rev})
+	if !reflect.DeepEqual(resp.Streams, []string{"B"}) || !reflect.DeepEqual(resp.Deleted, []string{"C"}) || resp.Revision <= rev {
+		t.Fatalf("Unexpected changes: %+v", resp)
+	}
+
+	// Same for the consumers of a stream.
+	mset, _ = acc.LookupStream("A")
+	for _, name := range []string{"d1", "d2"} {
+		if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: name, AckPolicy: server.AckExplicit}); err != nil {
+			t.Fatalf("Unexpected error adding consumer: %v", err)
+		}
+	}
+	reqConsumers := func(req server.ApiPagedRequest) *server.JSApiConsumerNamesResponse {
+		t.Helper()
+		b, _ := json.Marshal(&server.JSApiConsumersRequest{ApiPagedRequest: req})
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiConsumersT, "A"), b, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error getting consumer list: %v", err)
+		}
+		var listResponse server.JSApiConsumerNamesResponse
+		if err := json.Unmarshal(resp.Data, &listResponse); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &listResponse
+	}
+	cresp := reqConsumers(server.ApiPagedRequest{})
+	if !reflect.DeepEqual(cresp.Consumers, []string{"d1", "d2"}) {
+		t.Fatalf("Unexpected response: %+v", cresp)
+	}
+	rev = cresp.Revision
+	if err := mset.LookupConsumer("d1").Delete(); err != nil {
+		t.Fatalf("Unexpected error deleting consumer: %v", err)
+	}
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "d3", AckPolicy: server.AckExplicit}); err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	cresp = reqConsumers(server.ApiPagedRequest{Since: rev})
+	if !reflect.DeepEqual(cresp.Consumers, []string{"d3"}) || !reflect.DeepEqual(cresp.Deleted, []string{"d1"}) {
+		t.Fatalf("Unexpected changes: %+v", cresp)
+	}
+}
+
 func TestJetStreamUpdateStream(t *testing.T) {
 	cases := []struct {
 		name    string
@@ -7072,3 +7177,1299 @@ func TestJetStreamPubSubPerf(t *testing.T) {
 	fmt.Printf("time is %v\n", tt)
 	fmt.Printf("%.0f msgs/sec\n", float64(toSend)/tt.Seconds())
 }
+
+func TestJetStreamDirectPublishAndFetch(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{
+		Name:       "ORDERS",
+		Subjects:   []string{"orders.*"},
+		Storage:    server.MemoryStorage,
+		MaxMsgSize: 32,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	if _, err := mset.Publish("foo", nil, []byte("bad")); err == nil {
+		t.Fatalf("Expected an error publishing to a subject not in the stream")
+	}
+	if _, err := mset.Publish("orders.new", nil, make([]byte, 64)); err != server.ErrStreamMsgSizeExceeded {
+		t.Fatalf("Expected error %v, got %v", server.ErrStreamMsgSizeExceeded, err)
+	}
+	for i := 1; i <= 3; i++ {
+		seq, err := mset.Publish("orders.new", nil, []byte(fmt.Sprintf("order-%d", i)))
+		if err != nil {
+			t.Fatalf("Unexpected error publishing: %v", err)
+		}
+		if seq != uint64(i) {
+			t.Fatalf("Expected sequence %d, got %d", i, seq)
+		}
+	}
+	if state := mset.State(); state.Msgs != 3 {
+		t.Fatalf("Expected 3 messages, got %d", state.Msgs)
+	}
+
+	o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.Delete()
+
+	msgs, err := o.Fetch(2)
+	if err != nil {
+		t.Fatalf("Unexpected error fetching: %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+	if string(msgs[0].Data) != "order-1" || msgs[0].DeliverySeq != 1 || msgs[0].Deliveries != 1 {
+		t.Fatalf("Unexpected message: %+v", msgs[0])
+	}
+	o.AckMsg(msgs[0])
+	o.NakMsg(msgs[1])
+
+	// The nak'd message should be redelivered first.
+	msgs, err = o.Fetch(5)
+	if err != nil {
+		t.Fatalf("Unexpected error fetching: %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+	if msgs[0].Sequence != 2 || msgs[0].Deliveries != 2 || msgs[1].Sequence != 3 {
+		t.Fatalf("Unexpected messages: %+v %+v", msgs[0], msgs[1])
+	}
+	for _, m := range msgs {
+		o.AckMsg(m)
+	}
+	if info := o.Info(); info.NumPending != 0 || info.AckFloor.StreamSeq != 3 {
+		t.Fatalf("Unexpected consumer info: %+v", info)
+	}
+	if msgs, _ := o.Fetch(1); len(msgs) != 0 {
+		t.Fatalf("Expected no message, got %d", len(msgs))
+	}
+}
+
+type countingStreamStore struct {
+	server.StreamStore
+	stored int32
+}
+
+func (cs *countingStreamStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error) {
+	atomic.AddInt32(&cs.stored, 1)
+	return cs.StreamStore.StoreMsg(subj, hdr, msg)
+}
+
+type countingStoreProvider struct {
+	mu     sync.Mutex
+	stores map[string]*countingStreamStore
+}
+
+func (p *countingStoreProvider) NewStreamStore(account string, cfg *server.StreamConfig, fcfg server.FileStoreConfig) (server.StreamStore, error) {
+	if cfg.Name == "BUILTIN" {
+		return nil, nil
+	}
+	var store server.StreamStore
+	var err error
+	if cfg.Storage == server.FileStorage {
+		store, err = server.NewFileStore(fcfg, *cfg)
+	} else {
+		store, err = server.NewMemStore(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cs := &countingStreamStore{StreamStore: store}
+	p.mu.Lock()
+	p.stores[account+"/"+cfg.Name] = cs
+	p.mu.Unlock()
+	return cs, nil
+}
+
+func TestJetStreamStreamStoreProvider(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	sp := &countingStoreProvider{stores: make(map[string]*countingStreamStore)}
+	s.SetStreamStoreProvider(sp)
+
+	acc := s.GlobalAccount()
+	for _, st := range []server.StorageType{server.MemoryStorage, server.FileStorage} {
+		mset, err := acc.AddStream(&server.StreamConfig{Name: "S" + st.String(), Storage: st})
+		if err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+		defer mset.Delete()
+		for i := 0; i < 5; i++ {
+			if _, err := mset.Publish(mset.Name(), nil, []byte("hello")); err != nil {
+				t.Fatalf("Unexpected error publishing: %v", err)
+			}
+		}
+		cs := sp.stores[acc.Name+"/"+mset.Name()]
+		if cs == nil {
+			t.Fatalf("Expected stream %q to use the provided store", mset.Name())
+		}
+		if n := atomic.LoadInt32(&cs.stored); n != 5 {
+			t.Fatalf("Expected 5 messages stored through the provider, got %d", n)
+		}
+		if state := mset.State(); state.Msgs != 5 {
+			t.Fatalf("Expected 5 messages, got %d", state.Msgs)
+		}
+	}
+	stats := acc.JetStreamUsage()
+	if stats.Memory == 0 || stats.Store == 0 {
+		t.Fatalf("Expected usage to be accounted for, got %+v", stats)
+	}
+
+	// A nil store from the provider selects the builtin store.
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "BUILTIN", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+	if _, ok := sp.stores[acc.Name+"/BUILTIN"]; ok {
+		t.Fatalf("Expected builtin store to be used")
+	}
+}
+
+func TestJetStreamStreamCompact(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	msg := make([]byte, 1024)
+	fsCfg := &server.FileStoreConfig{BlockSize: 20 * 1024}
+	mset, err := s.GlobalAccount().AddStreamWithStore(&server.StreamConfig{Name: "CMP", Storage: server.FileStorage}, fsCfg)
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	for i := 0; i < 50; i++ {
+		if _, err := mset.Publish("CMP", nil, msg); err != nil {
+			t.Fatalf("Unexpected error publishing: %v", err)
+		}
+	}
+	for seq := uint64(2); seq <= 40; seq += 2 {
+		if _, err := mset.DeleteMsg(seq); err != nil {
+			t.Fatalf("Unexpected error deleting: %v", err)
+		}
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiStreamCompactT, "CMP"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var cResp server.JSApiStreamCompactResponse
+	if err = json.Unmarshal(resp.Data, &cResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !cResp.Success || cResp.Error != nil {
+		t.Fatalf("Got a bad response %+v", cResp)
+	}
+	if cResp.Reclaimed == 0 {
+		t.Fatalf("Expected space to be reclaimed")
+	}
+	if state := mset.State(); state.Msgs != 30 {
+		t.Fatalf("Expected 30 messages, got %d", state.Msgs)
+	}
+	for seq := uint64(1); seq <= 50; seq++ {
+		_, err := mset.GetMsg(seq)
+		if deleted := seq <= 40 && seq%2 == 0; deleted != (err != nil) {
+			t.Fatalf("Unexpected result loading %d: %v", seq, err)
+		}
+	}
+
+	// Memory streams have nothing to compact.
+	mset2, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "MEM", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset2.Delete()
+	if reclaimed, err := mset2.CompactStore(); reclaimed != 0 || err != nil {
+		t.Fatalf("Expected nothing reclaimed, got %d, %v", reclaimed, err)
+	}
+}
+
+func TestJetStreamStreamScrub(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "SCRUB", Storage: server.FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	if mset.LastScrub() != nil {
+		t.Fatalf("Expected no scrub report yet")
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := mset.Publish("SCRUB", nil, []byte("hello")); err != nil {
+			t.Fatalf("Unexpected error publishing: %v", err)
+		}
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiStreamScrubT, "SCRUB"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var sResp server.JSApiStreamScrubResponse
+	if err = json.Unmarshal(resp.Data, &sResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sResp.Error != nil || sResp.Report == nil {
+		t.Fatalf("Got a bad response %+v", sResp)
+	}
+	if len(sResp.Report.Corrupted) != 0 {
+		t.Fatalf("Expected no corrupted messages, got %v", sResp.Report.Corrupted)
+	}
+	if sr := mset.LastScrub(); sr == nil || !sr.Time.Equal(sResp.Report.Time) {
+		t.Fatalf("Expected last scrub report to match, got %+v", sr)
+	}
+}
+
+func TestJetStreamStreamQuery(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "Q", Subjects: []string{"orders.*"}, Storage: server.FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	for i := 1; i <= 20; i++ {
+		region := "eu"
+		if i%2 == 0 {
+			region = "us"
+		}
+		subj := "orders.new"
+		if i > 15 {
+			subj = "orders.old"
+		}
+		data := fmt.Sprintf(`{"id":%d,"amount":%d,"customer":{"region":%q}}`, i, i*10, region)
+		if _, err := mset.Publish(subj, nil, []byte(data)); err != nil {
+			t.Fatalf("Unexpected error publishing: %v", err)
+		}
+	}
+	if _, err := mset.Publish("orders.new", nil, []byte("not json")); err != nil {
+		t.Fatalf("Unexpected error publishing: %v", err)
+	}
+	mset.RemoveMsg(3)
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	query := func(stream, req string) *server.JSApiStreamQueryResponse {
+		t.Helper()
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiStreamQueryT, stream), []byte(req), time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var qResp server.JSApiStreamQueryResponse
+		if err = json.Unmarshal(resp.Data, &qResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &qResp
+	}
+
+	// Messages with predicates on fields, continued after the limit.
+	req := `{"subject":"orders.new","where":[{"field":"customer.region","op":"eq","value":"eu"},{"field":"amount","op":"gte","value":50}],"limit":3}`
+	qr := query("Q", req)
+	if qr.Error != nil || qr.StreamQueryResult == nil {
+		t.Fatalf("Got a bad response %+v", qr)
+	}
+	if len(qr.Messages) != 3 || !qr.Truncated || qr.LastSeq != 10 {
+		t.Fatalf("Unexpected result: %+v", qr.StreamQueryResult)
+	}
+	for i, seq := range []uint64{5, 7, 9} {
+		if m := qr.Messages[i]; m.Sequence != seq || m.Subject != "orders.new" {
+			t.Fatalf("Unexpected message: %+v", m)
+		}
+	}
+	req = fmt.Sprintf(`{"subject":"orders.new","where":[{"field":"customer.region","op":"eq","value":"eu"},{"field":"amount","op":"gte","value":50}],"start_seq":%d}`, qr.LastSeq+1)
+	if qr = query("Q", req); qr.Error != nil || len(qr.Messages) != 3 || qr.Truncated || qr.Messages[2].Sequence != 15 {
+		t.Fatalf("Unexpected result: %+v", qr.StreamQueryResult)
+	}
+
+	// Aggregates grouped by a field, the deleted and invalid messages are skipped.
+	req = `{"aggregates":[{"func":"count"},{"func":"sum","field":"amount"},{"func":"avg","field":"amount"},{"func":"min","field":"amount"},{"func":"max","field":"amount"}],"group_by":"customer.region"}`
+	if qr = query("Q", req); qr.Error != nil || qr.Scanned != 20 || qr.Matched != 20 || len(qr.Groups) != 3 {
+		t.Fatalf("Unexpected result: %+v", qr)
+	}
+	for i, expected := range []struct {
+		key    interface{}
+		values string
+	}{
+		{"eu", "[9 970 107.77777777777777 10 190]"},
+		{"us", "[10 1100 110 20 200]"},
+		{nil, "[1 <nil> <nil> <nil> <nil>]"},
+	} {
+		g := qr.Groups[i]
+		var values []interface{}
+		for _, v := range g.Values {
+			if v == nil {
+				values = append(values, nil)
+			} else {
+				values = append(values, *v)
+			}
+		}
+		if g.Key != expected.key || fmt.Sprint(values) != expected.values {
+			t.Fatalf("Unexpected group %v: %v", g.Key, values)
+		}
+	}
+	req = `{"aggregates":[{"func":"count"}],"group_by":"$subject","where":[{"field":"id","op":"exists"}]}`
+	if qr = query("Q", req); qr.Error != nil || len(qr.Groups) != 2 || *qr.Groups[1].Values[0] != 5 {
+		t.Fatalf("Unexpected result: %+v", qr)
+	}
+
+	// Scans are bounded.
+	if qr = query("Q", `{"max_scan":5}`); qr.Error != nil || qr.Scanned != 5 || !qr.Truncated || qr.LastSeq != 6 {
+		t.Fatalf("Unexpected result: %+v", qr.StreamQueryResult)
+	}
+	end := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	if qr = query("Q", fmt.Sprintf(`{"end_time":%q}`, end)); qr.Error != nil || qr.Scanned != 0 || qr.Truncated {
+		t.Fatalf("Unexpected result: %+v", qr.StreamQueryResult)
+	}
+
+	for _, req := range []string{
+		`{"where":[{"field":"id","op":"like"}]}`,
+		`{"where":[{"field":"id","op":"gt","value":true}]}`,
+		`{"aggregates":[{"func":"sum"}]}`,
+		`{"group_by":"id"}`,
+		`{"limit":-1}`,
+		`{"subject":"orders..new"}`,
+	} {
+		if qr = query("Q", req); qr.Error == nil || qr.Error.Code != 400 {
+			t.Fatalf("Expected a bad request for %s, got %+v", req, qr)
+		}
+	}
+	if qr = query("NONE", ""); qr.Error == nil || qr.Error.Code != 404 {
+		t.Fatalf("Expected not found, got %+v", qr)
+	}
+}
+
+func TestJetStreamParallelRecovery(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	numStreams := 20
+	for i := 0; i < numStreams; i++ {
+		name := fmt.Sprintf("S%d", i)
+		mset, err := acc.AddStream(&server.StreamConfig{Name: name, Storage: server.FileStorage})
+		if err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+		if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit}); err != nil {
+			t.Fatalf("Unexpected error adding consumer: %v", err)
+		}
+		for j := 0; j <= i; j++ {
+			if _, err := mset.Publish(name, nil, []byte("ok")); err != nil {
+				t.Fatalf("Unexpected error publishing: %v", err)
+			}
+		}
+	}
+
+	// Capture port since it was dynamic.
+	u, _ := url.Parse(s.ClientURL())
+	port, _ := strconv.Atoi(u.Port())
+	sd := s.JetStreamConfig().StoreDir
+
+	// Stop current server.
+	s.Shutdown()
+
+	// Restart with limited recovery concurrency.
+	opts := DefaultTestOptions
+	opts.Port = port
+	opts.JetStream = true
+	opts.StoreDir = filepath.Dir(sd)
+	opts.JetStreamRecoveryConcurrency = 3
+	s = RunServer(&opts)
+	defer s.Shutdown()
+
+	if rc := s.JetStreamConfig().RecoveryConcurrency; rc != 3 {
+		t.Fatalf("Expected recovery concurrency of 3, got %d", rc)
+	}
+	rs := s.JetStreamRecovery()
+	if rs == nil || rs.Recovering || rs.Streams != numStreams || rs.Recovered != numStreams || rs.Failed != 0 {
+		t.Fatalf("Unexpected recovery status: %+v", rs)
+	}
+	acc = s.GlobalAccount()
+	for i := 0; i < numStreams; i++ {
+		mset, err := acc.LookupStream(fmt.Sprintf("S%d", i))
+		if err != nil {
+			t.Fatalf("Expected to find stream S%d", i)
+		}
+		if state := mset.State(); state.Msgs != uint64(i+1) {
+			t.Fatalf("Expected %d messages for stream S%d, got %d", i+1, i, state.Msgs)
+		}
+		if o := mset.LookupConsumer("dlc"); o == nil {
+			t.Fatalf("Expected consumer for stream S%d to be recovered", i)
+		}
+	}
+}
+
+func TestJetStreamUsageRecords(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		jetstream: {usage_interval: "50ms"}
+		accounts: {
+			A: {
+				jetstream: {max_mem: 1GB, max_store: 1GB}
+				users: [ {user: ua, password: pwd} ]
+			},
+			SYS: {
+				users: [ {user: sys, password: pwd} ]
+			},
+		}
+		system_account: SYS
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	ncs := clientConnectToServerWithUP(t, opts, "sys", "pwd")
+	defer ncs.Close()
+	sub, _ := ncs.SubscribeSync("$SYS.ACCOUNT.A.JETSTREAM.USAGE")
+	ncs.Flush()
+
+	nca := clientConnectToServerWithUP(t, opts, "ua", "pwd")
+	defer nca.Close()
+
+	acc, err := s.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "USAGE", Storage: server.FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	dsub, _ := nca.SubscribeSync(nats.NewInbox())
+	defer dsub.Unsubscribe()
+	nca.Flush()
+	o, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: dsub.Subject})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.Delete()
+
+	for i := 0; i < 2; i++ {
+		if _, err := nca.Request("USAGE", []byte("hello"), time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if nmsgs, _, _ := dsub.Pending(); nmsgs != 2 {
+			return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, 2)
+		}
+		return nil
+	})
+	if _, err := nca.Request(server.JSApiAccountInfo, nil, time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Delta records add up to the usage of the account.
+	var total server.JSUsage
+	var last time.Time
+	deadline := time.Now().Add(2 * time.Second)
+	for total.Messages != 2 || total.DeliveredMessages != 2 || total.APICalls != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected usage: %+v", total)
+		}
+		msg, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var em server.JSUsageEventMsg
+		if err := json.Unmarshal(msg.Data, &em); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if em.Type != server.JSUsageEventMsgType {
+			t.Fatalf("Unexpected event type: %q", em.Type)
+		}
+		u, err := em.Verify()
+		if err != nil {
+			t.Fatalf("Unexpected error verifying usage record: %v", err)
+		}
+		if u.Account != "A" || u.Server != s.ID() || !u.End.After(u.Start) {
+			t.Fatalf("Unexpected usage record: %+v", u)
+		}
+		if !last.IsZero() && !u.Start.Equal(last) {
+			t.Fatalf("Expected record to start at %v, got %v", last, u.Start)
+		}
+		last = u.End
+		total.Messages += u.Messages
+		total.Bytes += u.Bytes
+		total.APICalls += u.APICalls
+		total.DeliveredMessages += u.DeliveredMessages
+		total.DeliveredBytes += u.DeliveredBytes
+		total.StorageByteHours += u.StorageByteHours
+
+		// Altered records are detected.
+		em.Usage = bytes.Replace(em.Usage, []byte(`"A"`), []byte(`"B"`), 1)
+		if _, err := em.Verify(); err == nil {
+			t.Fatal("Expected altered usage record to fail verification")
+		}
+	}
+	if total.Bytes != 10 || total.DeliveredBytes != 10 {
+		t.Fatalf("Unexpected usage: %+v", total)
+	}
+	// Stored messages accrue storage over time.
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var em server.JSUsageEventMsg
+	json.Unmarshal(msg.Data, &em)
+	if u, err := em.Verify(); err != nil || u.StorageByteHours <= 0 || u.Messages != 0 {
+		t.Fatalf("Unexpected usage record: %+v, %v", u, err)
+	}
+}
+
+func TestJetStreamUsageConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		jetstream: {usage_interval: "1m", usage_aggregation: cumulative}
+	`))
+	defer os.Remove(conf)
+	opts, err := server.ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.JetStreamUsageInterval != time.Minute || opts.JetStreamUsageAggregation != server.JSUsageCumulative {
+		t.Fatalf("Unexpected usage options: %v %q", opts.JetStreamUsageInterval, opts.JetStreamUsageAggregation)
+	}
+
+	dopts := DefaultTestOptions
+	dopts.JetStreamUsageAggregation = "hourly"
+	if _, err := server.NewServer(&dopts); err == nil || !strings.Contains(err.Error(), "aggregation") {
+		t.Fatalf("Expected error on aggregation, got %v", err)
+	}
+}
+
+func TestJetStreamIdempotency(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	cfg := &server.StreamConfig{
+		Name:        "ID",
+		Subjects:    []string{"ID.*"},
+		Storage:     server.FileStorage,
+		Idempotency: &server.IdempotencyConfig{Scope: server.IdempotencySubject},
+	}
+	mset, err := s.GlobalAccount().AddStream(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	var nc *nats.Conn
+	pub := func(subj, id string) server.PubAck {
+		t.Helper()
+		m := nats.NewMsg(subj)
+		if id != "" {
+			m.Header.Set(server.JSMsgId, id)
+		}
+		m.Data = []byte("ok")
+		resp, err := nc.RequestMsg(m, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var pa server.PubAck
+		if err := json.Unmarshal(bytes.TrimPrefix(resp.Data, []byte(server.OK)), &pa); err != nil {
+			t.Fatalf("Unexpected response %q: %v", resp.Data, err)
+		}
+		return pa
+	}
+	expect := func(pa server.PubAck, seq uint64, dup bool) {
+		t.Helper()
+		if pa.Stream != "ID" || pa.Seq != seq || pa.Duplicate != dup {
+			t.Fatalf("Expected seq %d and duplicate %v, got %+v", seq, dup, pa)
+		}
+	}
+
+	nc = clientConnectToServer(t, s)
+	defer nc.Close()
+
+	expect(pub("ID.a", "1"), 1, false)
+	expect(pub("ID.a", "1"), 1, true)
+	// Ids are per subject.
+	expect(pub("ID.b", "1"), 2, false)
+	expect(pub("ID.a", ""), 3, false)
+	expect(pub("ID.a", ""), 4, false)
+	if seq, err := mset.Publish("ID.b", []byte("NATS/1.0\r\nNats-Msg-Id: 1\r\n\r\n"), []byte("ok")); err != nil || seq != 2 {
+		t.Fatalf("Expected original sequence 2, got %d: %v", seq, err)
+	}
+	if state := mset.State(); state.Msgs != 4 {
+		t.Fatalf("Expected 4 messages, got %d", state.Msgs)
+	}
+
+	// Ids are remembered past a restart, even once messages are gone.
+	mset.Purge()
+	u, _ := url.Parse(s.ClientURL())
+	port, _ := strconv.Atoi(u.Port())
+	sd := s.JetStreamConfig().StoreDir
+	nc.Close()
+	s.Shutdown()
+
+	s = RunJetStreamServerOnPort(port, sd)
+	defer s.Shutdown()
+	nc = clientConnectToServer(t, s)
+	defer nc.Close()
+
+	expect(pub("ID.a", "1"), 1, true)
+	expect(pub("ID.a", "2"), 5, false)
+
+	// Ids are forgotten after their ttl.
+	mset, err = s.GlobalAccount().LookupStream("ID")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ucfg := mset.Config()
+	ucfg.Idempotency = &server.IdempotencyConfig{Scope: server.IdempotencySubject, TTL: 50 * time.Millisecond}
+	if err := mset.Update(&ucfg); err != nil {
+		t.Fatalf("Unexpected error updating stream: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	expect(pub("ID.a", "1"), 6, false)
+
+	ucfg.Idempotency = &server.IdempotencyConfig{Scope: server.IdempotencyPublisher}
+	if err := mset.Update(&ucfg); err == nil || !strings.Contains(err.Error(), "scope") {
+		t.Fatalf("Expected error changing scope, got %v", err)
+	}
+	cfg.Name, cfg.Subjects = "BAD", nil
+	cfg.Idempotency = &server.IdempotencyConfig{Scope: "account"}
+	if _, err := s.GlobalAccount().AddStream(cfg); err == nil || !strings.Contains(err.Error(), "scope") {
+		t.Fatalf("Expected error on scope, got %v", err)
+	}
+}
+
+func TestJetStreamIdempotencyPerPublisher(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		jetstream: enabled
+		authorization {
+			users: [ {user: a, password: pwd}, {user: b, password: pwd} ]
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{
+		Name:        "ID",
+		Storage:     server.MemoryStorage,
+		Idempotency: &server.IdempotencyConfig{Scope: server.IdempotencyPublisher, MaxKeys: 2},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	nca := clientConnectToServerWithUP(t, opts, "a", "pwd")
+	defer nca.Close()
+	ncb := clientConnectToServerWithUP(t, opts, "b", "pwd")
+	defer ncb.Close()
+
+	pub := func(nc *nats.Conn, id string) {
+		t.Helper()
+		m := nats.NewMsg("ID")
+		m.Header.Set(server.JSMsgId, id)
+		if _, err := nc.RequestMsg(m, time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	pub(nca, "1")
+	pub(nca, "1")
+	pub(ncb, "1")
+	if state := mset.State(); state.Msgs != 2 {
+		t.Fatalf("Expected 2 messages, got %d", state.Msgs)
+	}
+	// The oldest id is forgotten over the maximum number of ids.
+	pub(nca, "2")
+	pub(nca, "1")
+	if state := mset.State(); state.Msgs != 4 {
+		t.Fatalf("Expected 4 messages, got %d", state.Msgs)
+	}
+}
+
+func TestJetStreamMsgGetBatch(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "KV", Subjects: []string{"kv.>"}})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"kv.a.1", "kv.a.2", "kv.b.1", "kv.c"} {
+			if _, err := nc.Request(key, []byte(fmt.Sprintf("%s-%d", key, i)), time.Second); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+	}
+
+	// Returns the streamed messages and the end of the batch.
+	get := func(req *server.JSApiMsgGetRequest) ([]*server.StoredMsg, *server.JSApiMsgGetEOB) {
+		t.Helper()
+		inbox := nats.NewInbox()
+		sub, _ := nc.SubscribeSync(inbox)
+		defer sub.Unsubscribe()
+		b, _ := json.Marshal(req)
+		if err := nc.PublishRequest(fmt.Sprintf(server.JSApiMsgGetT, "KV"), inbox, b); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var msgs []*server.StoredMsg
+		for {
+			m, err := sub.NextMsg(time.Second)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var resp server.JSApiMsgGetResponse
+			if err := json.Unmarshal(m.Data, &resp); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if resp.Error != nil {
+				t.Fatalf("Unexpected error: %+v", resp.Error)
+			}
+			if resp.EOB != nil {
+				if resp.EOB.Count != len(msgs) {
+					t.Fatalf("Expected count %d, got %d", len(msgs), resp.EOB.Count)
+				}
+				return msgs, resp.EOB
+			}
+			msgs = append(msgs, resp.Message)
+		}
+	}
+
+	// Batch of sequences, with a missing one.
+	msgs, eob := get(&server.JSApiMsgGetRequest{Seqs: []uint64{2, 5, 100}})
+	if len(msgs) != 2 || msgs[0].Sequence != 2 || msgs[1].Sequence != 5 || string(msgs[1].Data) != "kv.a.1-1" {
+		t.Fatalf("Unexpected messages: %+v", msgs)
+	}
+	if len(eob.Missing) != 1 || eob.Missing[0] != 100 || eob.More {
+		t.Fatalf("Unexpected end of batch: %+v", eob)
+	}
+	msgs, eob = get(&server.JSApiMsgGetRequest{Seqs: []uint64{1, 2, 3}, Batch: 2})
+	if len(msgs) != 2 || !eob.More || len(eob.Pending) != 1 || eob.Pending[0] != 3 {
+		t.Fatalf("Unexpected batch %+v: %+v", msgs, eob)
+	}
+
+	// Last per subject for wildcards, sorted by subject.
+	msgs, eob = get(&server.JSApiMsgGetRequest{LastBySubjects: []string{"kv.a.*", "kv.c"}})
+	if len(msgs) != 3 || eob.More || eob.UpToSeq != 12 {
+		t.Fatalf("Unexpected batch %+v: %+v", msgs, eob)
+	}
+	for i, subj := range []string{"kv.a.1", "kv.a.2", "kv.c"} {
+		if msgs[i].Subject != subj || string(msgs[i].Data) != subj+"-2" {
+			t.Fatalf("Unexpected message %d: %+v", i, msgs[i])
+		}
+	}
+
+	// Truncated batches continue as of the same sequence.
+	msgs, eob = get(&server.JSApiMsgGetRequest{LastBySubjects: []string{"kv.>"}, Batch: 3})
+	if len(msgs) != 3 || !eob.More || eob.LastSubject != "kv.b.1" {
+		t.Fatalf("Unexpected batch %+v: %+v", msgs, eob)
+	}
+	if _, err := nc.Request("kv.d", []byte("new"), time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	msgs, eob = get(&server.JSApiMsgGetRequest{LastBySubjects: []string{"kv.>"}, UpToSeq: eob.UpToSeq, AfterSubject: eob.LastSubject})
+	if len(msgs) != 1 || msgs[0].Subject != "kv.c" || eob.More {
+		t.Fatalf("Unexpected batch %+v: %+v", msgs, eob)
+	}
+
+	// Invalid requests.
+	for _, req := range []string{`{"seq":1,"seqs":[2]}`, `{"last_by_subjects":["kv..a"]}`, `{"seqs":[1],"after_subject":"kv.a"}`} {
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiMsgGetT, "KV"), []byte(req), time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var r server.JSApiMsgGetResponse
+		if err := json.Unmarshal(resp.Data, &r); err != nil || r.Error == nil || r.Error.Code != 400 {
+			t.Fatalf("Expected bad request for %s, got %q", req, resp.Data)
+		}
+	}
+}
+
+func TestJetStreamInterestRetentionFloor(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *server.StreamConfig
+	}{
+		{"MemoryStore", &server.StreamConfig{Name: "DC", Storage: server.MemoryStorage, Retention: server.InterestPolicy, RetainMinMsgs: 2}},
+		{"FileStore", &server.StreamConfig{Name: "DC", Storage: server.FileStorage, Retention: server.InterestPolicy, RetainMinMsgs: 2}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
+
+			if config := s.JetStreamConfig(); config != nil {
+				defer os.RemoveAll(config.StoreDir)
+			}
+
+			mset, err := s.GlobalAccount().AddStream(c.mconfig)
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			sub, _ := nc.SubscribeSync(nats.NewInbox())
+			nc.Flush()
+			o, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: sub.Subject, AckPolicy: server.AckExplicit})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer o.Delete()
+
+			sendAndAck := func(n int) {
+				t.Helper()
+				for i := 0; i < n; i++ {
+					nc.Publish("DC", []byte("OK!"))
+				}
+				for i := 0; i < n; i++ {
+					m, err := sub.NextMsg(time.Second)
+					if err != nil {
+						t.Fatalf("Unexpected error: %v", err)
+					}
+					m.Respond(nil)
+				}
+				nc.Flush()
+			}
+			checkMsgs := func(first, last uint64) {
+				t.Helper()
+				checkFor(t, 2*time.Second, 25*time.Millisecond, func() error {
+					if state := mset.State(); state.Msgs != last-first+1 || state.FirstSeq != first || state.LastSeq != last {
+						return fmt.Errorf("Expected messages %d to %d, got %+v", first, last, state)
+					}
+					return nil
+				})
+			}
+
+			// The last 2 acknowledged messages are retained.
+			sendAndAck(5)
+			checkMsgs(4, 5)
+			sendAndAck(3)
+			checkMsgs(7, 8)
+
+			// A consumer created later finds them.
+			sub2, _ := nc.SubscribeSync(nats.NewInbox())
+			nc.Flush()
+			o2, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: sub2.Subject, AckPolicy: server.AckExplicit})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer o2.Delete()
+			for seq := uint64(7); seq <= 8; seq++ {
+				m, err := sub2.NextMsg(time.Second)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if sseq, _, _, _ := o2.ReplyInfo(m.Reply); sseq != seq {
+					t.Fatalf("Expected stream sequence %d, got %d", seq, sseq)
+				}
+			}
+
+			// Acknowledged messages are also retained while younger than the minimum age.
+			cfg := mset.Config()
+			cfg.RetainMinMsgs = 0
+			cfg.RetainMinAge = 250 * time.Millisecond
+			if err := mset.Update(&cfg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			o2.Delete()
+			start := time.Now()
+			sendAndAck(2)
+			if state := mset.State(); state.Msgs == 0 {
+				t.Fatalf("Expected acknowledged messages to be retained")
+			}
+			checkFor(t, 2*time.Second, 25*time.Millisecond, func() error {
+				if state := mset.State(); state.Msgs != 0 {
+					return fmt.Errorf("Expected no messages, got %+v", state)
+				}
+				return nil
+			})
+			if time.Since(start) < 250*time.Millisecond {
+				t.Fatalf("Expected messages to be retained for the minimum age")
+			}
+		})
+	}
+}
+
+func TestJetStreamInterestRetentionFloorConfig(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	for _, cfg := range []*server.StreamConfig{
+		{Name: "L", Retention: server.LimitsPolicy, RetainMinMsgs: 10},
+		{Name: "W", Retention: server.WorkQueuePolicy, RetainMinAge: time.Minute},
+		{Name: "I", Retention: server.InterestPolicy, RetainMinMsgs: -1},
+	} {
+		if _, err := s.GlobalAccount().AddStream(cfg); err == nil {
+			t.Fatalf("Expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestJetStreamStreamArchive(t *testing.T) {
+	cases := []struct {
+		name    string
+		storage server.StorageType
+	}{
+		{"MemoryStore", server.MemoryStorage},
+		{"FileStore", server.FileStorage},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
+
+			if config := s.JetStreamConfig(); config != nil {
+				defer os.RemoveAll(config.StoreDir)
+			}
+
+			mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{
+				Name:     "HOT",
+				Subjects: []string{"hot.>"},
+				Storage:  c.storage,
+				Archive:  &server.StreamArchive{Stream: "COLD", MaxAge: 100 * time.Millisecond},
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			for i := 0; i < 3; i++ {
+				if _, err := nc.Request("hot.foo", []byte("OK!"), time.Second); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			// Messages are kept until the archive stream exists.
+			time.Sleep(300 * time.Millisecond)
+			if state := mset.State(); state.Msgs != 3 {
+				t.Fatalf("Expected 3 messages, got %+v", state)
+			}
+
+			archive, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "COLD", Storage: server.FileStorage})
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer archive.Delete()
+
+			checkFor(t, 2*time.Second, 25*time.Millisecond, func() error {
+				if state := mset.State(); state.Msgs != 0 {
+					return fmt.Errorf("Expected no messages, got %+v", state)
+				}
+				if state := archive.State(); state.Msgs != 3 {
+					return fmt.Errorf("Expected 3 archived messages, got %+v", state)
+				}
+				return nil
+			})
+			sm, err := archive.GetMsg(2)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if sm.Subject != "hot.foo" || string(sm.Data) != "OK!" {
+				t.Fatalf("Unexpected archived message: %+v", sm)
+			}
+			hdr := string(sm.Header)
+			if !strings.Contains(hdr, server.StreamArchivedHdr+": HOT") || !strings.Contains(hdr, server.StreamArchivedSeqHdr+": 2") {
+				t.Fatalf("Unexpected archived message headers: %q", hdr)
+			}
+
+			// Young messages stay in the stream.
+			mset.Update(&server.StreamConfig{
+				Name:     "HOT",
+				Subjects: []string{"hot.>"},
+				Storage:  c.storage,
+				Archive:  &server.StreamArchive{Stream: "COLD", MaxAge: time.Hour},
+			})
+			nc.Request("hot.bar", []byte("OK!"), time.Second)
+			time.Sleep(200 * time.Millisecond)
+			if state := mset.State(); state.Msgs != 1 {
+				t.Fatalf("Expected 1 message, got %+v", state)
+			}
+		})
+	}
+}
+
+func TestJetStreamStreamArchiveConfig(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	for _, cfg := range []*server.StreamConfig{
+		{Name: "A", Archive: &server.StreamArchive{Stream: "A", MaxAge: time.Minute}},
+		{Name: "B", Archive: &server.StreamArchive{Stream: "C.D", MaxAge: time.Minute}},
+		{Name: "C", Archive: &server.StreamArchive{Stream: "D"}},
+		{Name: "D", MaxAge: time.Minute, Archive: &server.StreamArchive{Stream: "E", MaxAge: time.Hour}},
+	} {
+		if _, err := s.GlobalAccount().AddStream(cfg); err == nil {
+			t.Fatalf("Expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestJetStreamWorkQueueVisibilityTimeout(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{
+		Name:       "WQ",
+		Subjects:   []string{"jobs.>"},
+		Storage:    server.MemoryStorage,
+		Retention:  server.WorkQueuePolicy,
+		Visibility: []*server.VisibilityGroup{{Subject: "jobs.fast", Timeout: 100 * time.Millisecond}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	mset.Publish("jobs.fast", nil, []byte("fast"))
+	mset.Publish("jobs.slow", nil, []byte("slow"))
+
+	o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit, AckWait: time.Hour})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.Delete()
+
+	if msgs, err := o.Fetch(2); err != nil || len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d - %v", len(msgs), err)
+	}
+	// Only the message of the group returns to the queue, the other one
+	// waits for the AckWait of the consumer.
+	var msgs []*server.ConsumerMsg
+	checkFor(t, 2*time.Second, 25*time.Millisecond, func() error {
+		var err error
+		if msgs, err = o.Fetch(2); err != nil || len(msgs) == 0 {
+			return fmt.Errorf("Expected redelivery, got %v", err)
+		}
+		return nil
+	})
+	if len(msgs) != 1 || msgs[0].Subject != "jobs.fast" || msgs[0].Deliveries != 2 {
+		t.Fatalf("Unexpected redelivery: %+v", msgs)
+	}
+	o.AckMsg(msgs[0])
+	time.Sleep(250 * time.Millisecond)
+	if msgs, _ := o.Fetch(2); len(msgs) != 0 {
+		t.Fatalf("Expected no redelivery, got %+v", msgs)
+	}
+
+	for _, cfg := range []*server.StreamConfig{
+		{Name: "L", Visibility: []*server.VisibilityGroup{{Subject: "foo", Timeout: time.Second}}},
+		{Name: "W1", Retention: server.WorkQueuePolicy, Visibility: []*server.VisibilityGroup{{Subject: "foo"}}},
+		{Name: "W2", Retention: server.WorkQueuePolicy, Visibility: []*server.VisibilityGroup{{Subject: "foo..bar", Timeout: time.Second}}},
+	} {
+		if _, err := s.GlobalAccount().AddStream(cfg); err == nil {
+			t.Fatalf("Expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestJetStreamTracing(t *testing.T) {
+	type span struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+		Attributes   []struct {
+			Key   string `json:"key"`
+			Value struct {
+				StringValue string `json:"stringValue"`
+			} `json:"value"`
+		} `json:"attributes"`
+	}
+	var mu sync.Mutex
+	var spans []*span
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []*span `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Error decoding export request: %v", err)
+		}
+		mu.Lock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	opts := DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.Tracing.Endpoint = ts.URL
+	s := RunServer(&opts)
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "TRACED", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.Delete()
+
+	traceID, pubSpanID := "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	mset.Publish("TRACED", []byte("NATS/1.0\r\ntraceparent: 00-"+traceID+"-"+pubSpanID+"-01\r\n\r\n"), []byte("sampled"))
+	unsampled := "NATS/1.0\r\ntraceparent: 00-" + traceID + "-" + pubSpanID + "-00\r\n\r\n"
+	mset.Publish("TRACED", []byte(unsampled), []byte("unsampled"))
+
+	traceParent := func(hdr []byte) string {
+		t.Helper()
+		for _, l := range strings.Split(string(hdr), "\r\n") {
+			if strings.HasPrefix(l, "traceparent: ") {
+				return strings.TrimPrefix(l, "traceparent: ")
+			}
+		}
+		t.Fatalf("No traceparent in %q", hdr)
+		return ""
+	}
+
+	msgs, err := o.Fetch(2)
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d - %v", len(msgs), err)
+	}
+	if string(msgs[1].Header) != unsampled {
+		t.Fatalf("Expected unsampled header to be unchanged, got %q", msgs[1].Header)
+	}
+	tp := traceParent(msgs[0].Header)
+	if !strings.HasPrefix(tp, "00-"+traceID+"-") || strings.Contains(tp, pubSpanID) {
+		t.Fatalf("Unexpected traceparent %q", tp)
+	}
+	firstSpanID := strings.Split(tp, "-")[2]
+	o.NakMsg(msgs[0])
+	o.AckMsg(msgs[1])
+	if msgs, err = o.Fetch(1); err != nil || len(msgs) != 1 || msgs[0].Deliveries != 2 {
+		t.Fatalf("Expected redelivery, got %+v - %v", msgs, err)
+	}
+	secondSpanID := strings.Split(traceParent(msgs[0].Header), "-")[2]
+	o.AckMsg(msgs[0])
+
+	attr := func(sp *span, key string) string {
+		for _, a := range sp.Attributes {
+			if a.Key == key {
+				return a.Value.StringValue
+			}
+		}
+		return ""
+	}
+	checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(spans) < 3 {
+			return fmt.Errorf("expected 3 spans, got %d", len(spans))
+		}
+		return nil
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, got %d", len(spans))
+	}
+	commit := spans[0]
+	if commit.Name != "jetstream.commit" || commit.TraceID != traceID || commit.ParentSpanID != pubSpanID || attr(commit, "nats.stream") != "TRACED" {
+		t.Fatalf("Unexpected commit span: %+v", commit)
+	}
+	for i, expected := range []struct{ spanID, ack string }{{firstSpanID, "nak"}, {secondSpanID, "ack"}} {
+		sp := spans[i+1]
+		if sp.Name != "jetstream.deliver" || sp.TraceID != traceID || sp.SpanID != expected.spanID || sp.ParentSpanID != commit.SpanID {
+			t.Fatalf("Unexpected deliver span: %+v", sp)
+		}
+		if attr(sp, "nats.consumer") != "dlc" || attr(sp, "nats.ack") != expected.ack {
+			t.Fatalf("Unexpected deliver span attributes: %+v", sp.Attributes)
+		}
+	}
+}
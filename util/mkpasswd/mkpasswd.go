@@ -20,16 +20,18 @@ import (
 	"crypto/rand"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/big"
 	"syscall"
 
+	"github.com/nats-io/nats-server/v2/server"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 func usage() {
-	fmt.Printf("Usage: mkpasswd [-p <stdin password>] [-c COST] \n")
+	fmt.Printf("Usage: mkpasswd [-p <stdin password>] [-c COST] [-pbkdf2|-scram [-i ITERATIONS]] [-k KEYFILE] [-genkey]\n")
 	flag.PrintDefaults()
 }
 
@@ -45,11 +47,26 @@ const (
 func main() {
 	var pw = flag.Bool("p", false, "Input password via stdin")
 	var cost = flag.Int("c", DefaultCost, fmt.Sprintf("The cost weight, range of %d-%d", bcrypt.MinCost, bcrypt.MaxCost))
+	var pbkdf2 = flag.Bool("pbkdf2", false, "Produce a PBKDF2 hash instead of bcrypt, as required in FIPS mode")
+	var scram = flag.Bool("scram", false, "Produce a SCRAM-SHA-256 verifier instead of bcrypt, for challenge/response authentication")
+	var iterations = flag.Int("i", 0, fmt.Sprintf("The number of PBKDF2 or SCRAM iterations (default %d or %d)",
+		server.DefaultPBKDF2Iterations, server.DefaultScramIterations))
+	var keyFile = flag.String("k", "", "Encrypt the password, token or seed with the secrets key in this file, instead of hashing it")
+	var genKey = flag.Bool("genkey", false, "Generate a secrets key to encrypt configuration values")
 
 	log.SetFlags(0)
 	flag.Usage = usage
 	flag.Parse()
 
+	if *genKey {
+		key, err := server.GenerateSecretsKey()
+		if err != nil {
+			log.Fatalf("Error generating secrets key: %v\n", err)
+		}
+		fmt.Printf("%s\n", key)
+		return
+	}
+
 	var password string
 
 	if *pw {
@@ -73,6 +90,43 @@ func main() {
 		fmt.Printf("pass: %s\n", password)
 	}
 
+	if *keyFile != "" {
+		key, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			log.Fatalf("Error reading secrets key: %v\n", err)
+		}
+		enc, err := server.EncryptSecret(string(key), password)
+		if err != nil {
+			log.Fatalf("Error encrypting: %v\n", err)
+		}
+		fmt.Printf("encrypted: %s\n", enc)
+		return
+	}
+
+	if *scram {
+		if *iterations == 0 {
+			*iterations = server.DefaultScramIterations
+		}
+		verifier, err := server.GenerateScramVerifier(password, *iterations)
+		if err != nil {
+			log.Fatalf("Error producing scram verifier: %v\n", err)
+		}
+		fmt.Printf("scram verifier: %s\n", verifier)
+		return
+	}
+
+	if *pbkdf2 {
+		if *iterations == 0 {
+			*iterations = server.DefaultPBKDF2Iterations
+		}
+		hash, err := server.GeneratePBKDF2Password(password, *iterations)
+		if err != nil {
+			log.Fatalf("Error producing pbkdf2 hash: %v\n", err)
+		}
+		fmt.Printf("pbkdf2 hash: %s\n", hash)
+		return
+	}
+
 	cb, err := bcrypt.GenerateFromPassword([]byte(password), *cost)
 	if err != nil {
 		log.Fatalf("Error producing bcrypt hash: %v\n", err)